@@ -0,0 +1,34 @@
+// roc-agent keeps etcd watches of service discovery for all roc processes on a host and serves them over unix socket,
+// processes use it by setting ROC_REGISTRY=agent and optionally ROC_REGISTRY_ADDRS to the socket path
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	rocserv "github.com/shawnfeng/roc/util/service"
+)
+
+func main() {
+	sock := flag.String("sock", rocserv.DefaultAgentSocket, "unix socket to serve on")
+	etcdAddrs := flag.String("etcd", "http://127.0.0.1:2379", "etcd endpoints separated by ','")
+	baseLoc := flag.String("baseloc", "/roc", "base location of service registry in etcd")
+	flag.Parse()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if err := rocserv.RunDiscoveryAgent(ctx, *sock, strings.Split(*etcdAddrs, ","), *baseLoc); err != nil {
+		log.Fatalf("roc-agent: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+// roc-ctl command line tool of roc services, subcommands:
+//
+//	roc-ctl idl list -serv base/account          list hash of idl versions published by service
+//	roc-ctl idl get -serv base/account [-hash h] [-out dir]
+//	                                             fetch idl files of version h, default is the deployed one
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	rocserv "github.com/shawnfeng/roc/util/service"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: roc-ctl idl list|get [flags]\n")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 3 || os.Args[1] != "idl" {
+		usage()
+	}
+
+	cmd := os.Args[2]
+	fs := flag.NewFlagSet("roc-ctl idl "+cmd, flag.ExitOnError)
+	etcdAddrs := fs.String("etcd", "http://127.0.0.1:2379", "etcd endpoints separated by ','")
+	baseLoc := fs.String("baseloc", "/roc", "base location of service registry in etcd")
+	serv := fs.String("serv", "", "service location, e.g. base/account")
+	hash := fs.String("hash", "", "idl version hash, default is the deployed one")
+	out := fs.String("out", ".", "directory to write idl files into")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of etcd requests")
+	fs.Parse(os.Args[3:])
+
+	if len(*serv) == 0 {
+		log.Fatalf("roc-ctl: -serv need")
+	}
+
+	client, err := etcd.New(etcd.Config{Endpoints: strings.Split(*etcdAddrs, ",")})
+	if err != nil {
+		log.Fatalf("roc-ctl: create etcd client err: %v", err)
+	}
+	kapi := etcd.NewKeysAPI(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	switch cmd {
+	case "list":
+		err = listIDL(ctx, kapi, *baseLoc, *serv)
+	case "get":
+		err = getIDL(ctx, kapi, *baseLoc, *serv, *hash, *out)
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatalf("roc-ctl: %v", err)
+	}
+}
+
+func listIDL(ctx context.Context, kapi etcd.KeysAPI, baseLoc, serv string) error {
+	hashes, err := rocserv.ListIDLVersions(ctx, kapi, baseLoc, serv)
+	if err != nil {
+		return err
+	}
+	current, err := rocserv.GetIDL(ctx, kapi, baseLoc, serv, "")
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return err
+	}
+	for _, h := range hashes {
+		if current != nil && current.Hash == h {
+			fmt.Printf("%s\tcurrent\n", h)
+			continue
+		}
+		fmt.Println(h)
+	}
+	return nil
+}
+
+func getIDL(ctx context.Context, kapi etcd.KeysAPI, baseLoc, serv, hash, out string) error {
+	bundle, err := rocserv.GetIDL(ctx, kapi, baseLoc, serv, hash)
+	if err != nil {
+		return err
+	}
+	for _, f := range bundle.Files {
+		// 文件名来自 etcd, 不允许写到输出目录之外
+		name := filepath.Clean(filepath.FromSlash(f.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid idl file name: %s", f.Name)
+		}
+		path := filepath.Join(out, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, f.Content, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s\t%d\n", f.Kind, path, len(f.Content))
+	}
+	fmt.Printf("hash: %s\n", bundle.Hash)
+	return nil
+}
@@ -5,8 +5,10 @@ require (
 	github.com/HdrHistogram/hdrhistogram-go v1.0.0 // indirect
 	github.com/coreos/etcd v3.3.22+incompatible
 	github.com/gin-gonic/gin v1.4.0
+	github.com/golang/protobuf v1.4.2
 	github.com/grpc-ecosystem/go-grpc-middleware v1.0.0
 	github.com/julienschmidt/httprouter v1.2.0
+	github.com/rs/zerolog v1.18.0
 	github.com/shawnfeng/consistent v1.0.3
 	github.com/stretchr/testify v1.6.1
 	github.com/uber/jaeger-client-go v2.20.1+incompatible
@@ -16,7 +18,10 @@ require (
 	gitlab.pri.ibanyu.com/server/servmonitor/pub.git v0.0.0-20201104035512-0152ae98fa6a
 	gitlab.pri.ibanyu.com/tracing/go-grpc v0.0.0-20201117083632-fd2d4bfc37a7
 	gitlab.pri.ibanyu.com/tracing/go-stdlib v1.0.1-0.20201126030004-a3785d4be9ed
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	google.golang.org/genproto v0.0.0-20191108220845-16a3f7862a1a
 	google.golang.org/grpc v1.24.0
+	google.golang.org/protobuf v1.23.0
 )
 
 go 1.13
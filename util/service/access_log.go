@@ -0,0 +1,180 @@
+package rocserv
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// 配置中心 application namespace 中的配置, 运行时生效
+	accessLogEnableKey = "access_log_enable"
+	// 采样百分比, 默认 100, 出错及慢请求总是记录
+	accessLogSampleKey = "access_log_sample_rate"
+	// 耗时超过该值(ms)的请求总是记录, 0 表示不区分
+	accessLogSlowKey = "access_log_slow_ms"
+
+	accessLogDefaultSample = 100
+)
+
+type accessLogConf struct {
+	sample int
+	slow   time.Duration
+}
+
+// getAccessLogConf 未开启时返回 nil, 运行时设置的采样率优先于配置中心
+func getAccessLogConf() *accessLogConf {
+	if v, ok := appRuntimeSettings.get(RuntimeSettingAccessLogSample); ok {
+		n, _ := strconv.Atoi(v)
+		return &accessLogConf{sample: n}
+	}
+	cc := GetConfigCenter()
+	if cc == nil {
+		return nil
+	}
+	ctx := context.TODO()
+	if enable, _ := cc.GetBool(ctx, accessLogEnableKey); !enable {
+		return nil
+	}
+	conf := &accessLogConf{sample: accessLogDefaultSample}
+	if n, ok := cc.GetInt(ctx, accessLogSampleKey); ok {
+		conf.sample = n
+	}
+	if n, ok := cc.GetInt(ctx, accessLogSlowKey); ok && n > 0 {
+		conf.slow = time.Duration(n) * time.Millisecond
+	}
+	return conf
+}
+
+func (m *accessLogConf) hit(failed bool, dur time.Duration) bool {
+	if failed || (m.slow > 0 && dur >= m.slow) {
+		return true
+	}
+	if m.sample >= 100 {
+		return true
+	}
+	if m.sample <= 0 {
+		return false
+	}
+	muRetryRand.Lock()
+	n := retryRand.Intn(100)
+	muRetryRand.Unlock()
+	return n < m.sample
+}
+
+// logAccess 记录一次请求, 字段名与流量日志一致的使用相同的 key
+func logAccess(ctx context.Context, typ, method, code string, failed bool, dur time.Duration) {
+	conf := getAccessLogConf()
+	if conf == nil || !conf.hit(failed, dur) {
+		return
+	}
+	logger().Infow(ctx, "access", "type", typ, "method", method, "status", code,
+		"cost_ms", float64(dur)/float64(time.Millisecond), "caller", costCaller(ctx), TrafficLogKeyTraceID, traceIDFromContext(ctx))
+}
+
+type accessResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *accessResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *accessResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer not support hijack")
+	}
+	// 协议升级后由 handler 自行处理, 按 101 记录
+	w.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// accessLogHttpMiddleware gin 与 http processor 共用, 记录 url path 及响应状态码
+func accessLogHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aw := &accessResponseWriter{ResponseWriter: w}
+		st := time.Now()
+		next.ServeHTTP(aw, r)
+		code := aw.status
+		if code == 0 {
+			code = http.StatusOK
+		}
+		logAccess(r.Context(), PROCESSOR_HTTP, r.Method+" "+r.URL.Path, strconv.Itoa(code), code >= http.StatusInternalServerError, time.Since(st))
+	})
+}
+
+func accessLogServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		st := time.Now()
+		resp, err := handler(ctx, req)
+		logAccess(ctx, PROCESSOR_GRPC, grpcMethodName(info.FullMethod), status.Code(err).String(), err != nil, time.Since(st))
+		return resp, err
+	}
+}
+
+func accessLogStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		st := time.Now()
+		err := handler(srv, ss)
+		logAccess(ss.Context(), PROCESSOR_GRPC, grpcMethodName(info.FullMethod), status.Code(err).String(), err != nil, time.Since(st))
+		return err
+	}
+}
+
+// accessLogProcessor thrift 的 handler 没有 ctx, 日志中没有调用方及 trace id
+type accessLogProcessor struct {
+	thrift.TProcessor
+}
+
+func (m *accessLogProcessor) Process(in, out thrift.TProtocol) (bool, thrift.TException) {
+	rin := &messageNameProtocol{TProtocol: in}
+	st := time.Now()
+	ok, err := m.TProcessor.Process(rin, out)
+	code := "OK"
+	if err != nil {
+		code = "ERROR"
+	}
+	logAccess(context.Background(), PROCESSOR_THRIFT, rin.name, code, err != nil, time.Since(st))
+	return ok, err
+}
+
+// messageNameProtocol 记录读到的 message 名
+type messageNameProtocol struct {
+	thrift.TProtocol
+	name string
+}
+
+func (m *messageNameProtocol) ReadMessageBegin() (string, thrift.TMessageType, int32, error) {
+	name, typeId, seqid, err := m.TProtocol.ReadMessageBegin()
+	if err == nil {
+		m.name = name
+	}
+	return name, typeId, seqid, err
+}
@@ -0,0 +1,38 @@
+package rocserv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLog(t *testing.T) {
+	ass := assert.New(t)
+
+	conf := &accessLogConf{sample: 0, slow: 100 * time.Millisecond}
+	ass.False(conf.hit(false, time.Millisecond))
+	ass.True(conf.hit(true, time.Millisecond))
+	ass.True(conf.hit(false, 200*time.Millisecond))
+	conf.sample = 100
+	ass.True(conf.hit(false, time.Millisecond))
+
+	rec := httptest.NewRecorder()
+	aw := &accessResponseWriter{ResponseWriter: rec}
+	aw.WriteHeader(http.StatusNotFound)
+	aw.Write([]byte("not found"))
+	ass.Equal(http.StatusNotFound, aw.status)
+	aw = &accessResponseWriter{ResponseWriter: rec}
+	aw.Write([]byte("ok"))
+	ass.Equal(http.StatusOK, aw.status)
+
+	// 未开启时透传
+	h := accessLogHttpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/user", nil))
+	ass.Equal(http.StatusCreated, rec.Code)
+}
@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xfile"
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xnet/xhttp"
 
 	"github.com/julienschmidt/httprouter"
@@ -50,9 +49,49 @@ func (m *backDoorHttp) Driver() (string, interface{}) {
 	// healthcheck
 	router.GET("/backdoor/health/check", xhttp.HttpRequestWrapper(FactoryHealthCheck))
 
+	// 运行时调整日志级别
+	router.GET("/backdoor/loglevel", logLevelHandler)
+	router.POST("/backdoor/loglevel", logLevelHandler)
+
+	// 运行时开关, 可设置过期时间及是否在重启后保留
+	router.GET("/backdoor/settings", runtimeSettingsHandler)
+	router.POST("/backdoor/settings", runtimeSettingsHandler)
+
+	// 存活及就绪探针
+	router.GET("/healthz", xhttp.HttpRequestWrapper(FactoryHealthz))
+	router.GET("/readyz", xhttp.HttpRequestWrapper(FactoryReadyz))
+
 	// 获取实例md5值
 	router.GET("/backdoor/md5", xhttp.HttpRequestWrapper(FactoryMD5))
 
+	// 按指纹聚合的错误统计
+	router.GET("/backdoor/errors", xhttp.HttpRequestWrapper(FactoryErrorReport))
+
+	// 各接口的调用方及版本
+	router.GET("/backdoor/callers", xhttp.HttpRequestWrapper(FactoryCallerReport))
+
+	// lazy processor 状态及手动预热
+	router.GET("/backdoor/warm", warmHandler)
+	router.POST("/backdoor/warm", warmHandler)
+
+	// 实例权重及摘除
+	router.GET("/backdoor/instance", instanceCtrlHandler)
+	router.POST("/backdoor/instance", instanceCtrlHandler)
+
+	// 本实例写入注册中心的内容及 manual 设置
+	router.GET("/_admin/reginfo", regInfoHandler)
+
+	// 解释路由选择, 参数 service, processor, key, lane
+	router.GET("/backdoor/route/explain", routeExplainHandler)
+
+	// 管理页面, 需要配置 admin_ui_token
+	router.GET("/backdoor/ui", adminUIAuth(adminUIHandler))
+	router.GET("/backdoor/ui/api/status", adminUIAuth(adminStatusHandler))
+	router.POST("/backdoor/ui/api/drain", adminUIAuth(adminDrainHandler))
+
+	// pprof 及 expvar, 需要配置 debug_token 或 debug_allow_ips
+	registerDebugHandlers(router)
+
 	return "0.0.0.0:60000", router
 }
 
@@ -65,7 +104,7 @@ func FactoryRestart() xhttp.HandleRequest {
 }
 
 func (m *Restart) Handle(r *xhttp.HttpRequest) xhttp.HttpResponse {
-	xlog.Infof(context.Background(), "RECEIVE RESTART COMMAND")
+	logger().Infof(context.Background(), "RECEIVE RESTART COMMAND")
 	server.sbase.Stop()
 	os.Exit(1)
 	// 这里的代码执行不到了，因为之前已经退出了
@@ -82,8 +121,12 @@ func FactoryHealthCheck() xhttp.HandleRequest {
 
 func (m *HealthCheck) Handle(r *xhttp.HttpRequest) xhttp.HttpResponse {
 	fun := "HealthCheck -->"
-	xlog.Infof(context.Background(), "%s in", fun)
+	logger().Infof(context.Background(), "%s in", fun)
 
+	// 降级时仍可处理请求, 只在内容中标记
+	if IsDegraded() {
+		return xhttp.NewHttpRespString(200, `{"degraded":true}`)
+	}
 	return xhttp.NewHttpRespString(200, "{}")
 }
 
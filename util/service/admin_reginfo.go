@@ -0,0 +1,96 @@
+package rocserv
+
+import (
+	"encoding/json"
+	"net/http"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/julienschmidt/httprouter"
+)
+
+// regInfoStatus 本实例写入注册中心的内容, 以及运维设置的 manual 节点, 即服务发现客户端看到的数据
+type regInfoStatus struct {
+	Service string `json:"service"`
+	Servid  int    `json:"servid"`
+	Lane    string `json:"lane"`
+	Region  string `json:"region,omitempty"`
+	Zone    string `json:"zone,omitempty"`
+	State   string `json:"state"`
+	// 注册节点路径 -> 写入的 RegData 等, 与 etcd 中的内容一致
+	RegData map[string]json.RawMessage `json:"reg_data"`
+	// manual 节点的原始内容, 未设置时为空
+	ManualData json.RawMessage `json:"manual_data,omitempty"`
+	// 读取 manual 节点失败时的错误, 此时 groups, disable 及 weight 为默认值
+	ManualError string   `json:"manual_error,omitempty"`
+	Groups      []string `json:"groups"`
+	Disable     bool     `json:"disable"`
+	Weight      int      `json:"weight"`
+}
+
+func newRegInfoStatus(sb *ServBaseV2, manual string, manualErr error) *regInfoStatus {
+	st := &regInfoStatus{
+		Service: sb.Servname(),
+		Servid:  sb.Servid(),
+		Lane:    sb.Lane(),
+		Region:  sb.Region(),
+		Zone:    sb.Zone(),
+		State:   sb.getRegState(),
+		RegData: make(map[string]json.RawMessage),
+		Groups:  []string{},
+		Weight:  100,
+	}
+	for path, info := range sb.RegInfos() {
+		st.RegData[path] = rawJSON(info)
+	}
+
+	if manualErr != nil {
+		st.ManualError = manualErr.Error()
+		return st
+	}
+	if len(manual) == 0 {
+		return st
+	}
+	st.ManualData = rawJSON(manual)
+	data := &ManualData{}
+	if err := json.Unmarshal([]byte(manual), data); err != nil {
+		st.ManualError = err.Error()
+		return st
+	}
+	if ctrl := data.Ctrl; ctrl != nil {
+		if ctrl.Groups != nil {
+			st.Groups = ctrl.Groups
+		}
+		st.Disable, st.Weight = ctrl.Disable, ctrl.Weight
+	}
+	return st
+}
+
+// rawJSON 不是 json 的内容作为字符串输出
+func rawJSON(s string) json.RawMessage {
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	js, _ := json.Marshal(s)
+	return js
+}
+
+// regInfoHandler GET /_admin/reginfo, manual 节点每次从 etcd 读取
+func regInfoHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	sb, ok := server.sbase.(*ServBaseV2)
+	if !ok {
+		http.Error(w, "server not init", http.StatusServiceUnavailable)
+		return
+	}
+
+	var manual string
+	var err error
+	if !sb.IsLocalRunning() {
+		manual, err = sb.getValueFromEtcd(sb.manualPath(sb.servId))
+		if etcd.IsKeyNotFound(err) {
+			err = nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newRegInfoStatus(sb, manual, err))
+}
@@ -0,0 +1,45 @@
+package rocserv
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegInfoStatus(t *testing.T) {
+	ass := assert.New(t)
+
+	sb := &ServBaseV2{servLocation: "base/test", servId: 2, envGroup: "lane1", regInfos: map[string]string{
+		"/roc/dist2/base/test/2/serve": `{"servs":{"proc_grpc":{"type":"grpc","addr":"10.0.0.1:9000"}},"lane":"lane1"}`,
+		"/roc/dist/base/test/2":        "not json",
+	}}
+
+	st := newRegInfoStatus(sb, `{"ctrl":{"weight":50,"disable":true,"groups":["g1"]}}`, nil)
+	ass.Equal("base/test", st.Service)
+	ass.Equal(RegStateActive, st.State)
+	ass.Equal([]string{"g1"}, st.Groups)
+	ass.True(st.Disable)
+	ass.Equal(50, st.Weight)
+
+	// 注册内容原样输出
+	js, err := json.Marshal(st)
+	ass.Nil(err)
+	var res struct {
+		RegData map[string]json.RawMessage `json:"reg_data"`
+	}
+	ass.Nil(json.Unmarshal(js, &res))
+	reg := &RegData{}
+	ass.Nil(json.Unmarshal(res.RegData["/roc/dist2/base/test/2/serve"], reg))
+	ass.Equal("10.0.0.1:9000", reg.Servs["proc_grpc"].Addr)
+	ass.Equal(`"not json"`, string(res.RegData["/roc/dist/base/test/2"]))
+
+	// 未设置 manual 及读取失败时为默认值
+	st = newRegInfoStatus(sb, "", nil)
+	ass.Equal(100, st.Weight)
+	ass.False(st.Disable)
+	ass.Len(st.Groups, 0)
+	st = newRegInfoStatus(sb, "", errors.New("etcd unavailable"))
+	ass.Equal("etcd unavailable", st.ManualError)
+}
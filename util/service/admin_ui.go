@@ -0,0 +1,309 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// 管理页面的访问口令, 在应用配置中设置, 未设置时管理页面不可用
+	adminUITokenKey = "admin_ui_token"
+	// 修改类请求必须带该 header, 跨域页面无法在不经过 CORS 预检的情况下设置, 以此防止 CSRF
+	adminUIHeader = "X-Roc-Admin"
+)
+
+// 进程内创建的服务发现客户端, 管理页面展示路由表
+var clientLookups sync.Map
+
+func registerClientLookup(cli *ClientEtcdV2) {
+	clientLookups.Store(cli, struct{}{})
+}
+
+func adminUIToken() string {
+	if server.sbase == nil || server.sbase.ConfigCenter() == nil {
+		return ""
+	}
+	token, _ := server.sbase.ConfigCenter().GetString(context.TODO(), adminUITokenKey)
+	return token
+}
+
+// adminUIAuth 口令可以作为 basic auth 的密码, 也可以作为 Bearer token, basic auth 的用户名用于审计日志
+func adminUIAuth(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		token := adminUIToken()
+		if len(token) == 0 {
+			http.Error(w, fmt.Sprintf("admin ui disabled, set %s in config to enable", adminUITokenKey), http.StatusForbidden)
+			return
+		}
+
+		if !adminUIAuthorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="roc admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+func adminUIAuthorized(r *http.Request, token string) bool {
+	_, pass, ok := r.BasicAuth()
+	if !ok {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return false
+		}
+		pass = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(pass), []byte(token)) == 1
+}
+
+type adminRouteInstance struct {
+	Servid  int                  `json:"servid"`
+	Lane    string               `json:"lane"`
+	Zone    string               `json:"zone"`
+	Weight  int                  `json:"weight"`
+	Disable bool                 `json:"disable"`
+	State   string               `json:"state"`
+	Servs   map[string]*ServInfo `json:"servs"`
+}
+
+type adminRoute struct {
+	Service   string                `json:"service"`
+	Instances []*adminRouteInstance `json:"instances"`
+	// addr -> 熔断状态, 1 为熔断, 2 为半开
+	Breakers map[string]int `json:"breakers"`
+	// 使用覆盖文件中的地址
+	Override bool `json:"override"`
+}
+
+func (m *ClientEtcdV2) routingTable() *adminRoute {
+	m.muServlist.Lock()
+	instances := make([]*adminRouteInstance, 0, len(m.servCopy))
+	for sid, c := range m.servCopy {
+		if c == nil || c.reg == nil {
+			continue
+		}
+		lane, hasLane := c.reg.GetLane()
+		ins := &adminRouteInstance{Servid: sid, Lane: lane, Zone: c.reg.Zone, State: c.reg.State, Servs: c.reg.Servs}
+		if c.manual != nil && c.manual.Ctrl != nil {
+			ins.Weight, ins.Disable = c.manual.Ctrl.Weight, c.manual.Ctrl.Disable
+			// 老版本泳道信息在 manual 中
+			if !hasLane && len(c.manual.Ctrl.Groups) > 0 {
+				ins.Lane = c.manual.Ctrl.Groups[0]
+			}
+		}
+		instances = append(instances, ins)
+	}
+	override := m.overridden
+	m.muServlist.Unlock()
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Servid < instances[j].Servid
+	})
+	return &adminRoute{Service: m.servKey, Instances: instances, Breakers: m.GetInstanceBreakerStates(), Override: override}
+}
+
+type adminStatus struct {
+	Service    string               `json:"service"`
+	Servid     int                  `json:"servid"`
+	Lane       string               `json:"lane"`
+	Region     string               `json:"region"`
+	Zone       string               `json:"zone"`
+	Ip         string               `json:"ip"`
+	Md5        string               `json:"md5"`
+	StartUp    string               `json:"start_up"`
+	NotReady   map[string]string    `json:"not_ready"`
+	Processors map[string]*ServInfo `json:"processors"`
+	LazyStates map[string]string    `json:"lazy_states"`
+	LogLevel   string               `json:"log_level"`
+	Ctrl       *ServCtrl            `json:"ctrl"`
+	Heartbeat  *HeartbeatStatus     `json:"heartbeat"`
+	// 内部 processor 异常时实例降级
+	SystemProcessors []*SystemProcessorStatus `json:"system_processors"`
+	Degraded         bool                     `json:"degraded"`
+	Routes           []*adminRoute            `json:"routes"`
+}
+
+func getAdminStatus() *adminStatus {
+	st := &adminStatus{
+		Md5:        serviceMD5,
+		StartUp:    startUpTime,
+		Processors: server.servInfos(),
+		LazyStates: GetLazyProcessorStates(),
+		LogLevel:   GetLogLevel(),
+
+		SystemProcessors: GetSystemProcessorStatus(),
+		Degraded:         IsDegraded(),
+	}
+	if sb, ok := server.sbase.(*ServBaseV2); ok {
+		st.Service, st.Servid, st.Lane, st.Region, st.Zone, st.Ip = sb.servLocation, sb.servId, sb.envGroup, sb.region, sb.zone, sb.servIp
+		st.NotReady = sb.readiness.check()
+		st.Ctrl, _ = sb.GetInstanceCtrl(sb.servId)
+		st.Heartbeat = sb.HeartbeatStatus()
+	}
+	clientLookups.Range(func(key, _ interface{}) bool {
+		st.Routes = append(st.Routes, key.(*ClientEtcdV2).routingTable())
+		return true
+	})
+	sort.Slice(st.Routes, func(i, j int) bool {
+		return st.Routes[i].Service < st.Routes[j].Service
+	})
+	return st
+}
+
+func adminUIHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write([]byte(adminUIPage))
+}
+
+func adminStatusHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s, _ := json.Marshal(getAdminStatus())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s)
+}
+
+// adminDrainHandler POST disable=true|false 摘除或恢复当前实例
+func adminDrainHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	fun := "adminDrainHandler -->"
+
+	if r.Header.Get(adminUIHeader) == "" {
+		http.Error(w, fmt.Sprintf("missing header %s", adminUIHeader), http.StatusForbidden)
+		return
+	}
+	sb, ok := server.sbase.(*ServBaseV2)
+	if !ok {
+		http.Error(w, "server not init", http.StatusServiceUnavailable)
+		return
+	}
+	disable, err := strconv.ParseBool(r.FormValue("disable"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid disable: %s", r.FormValue("disable")), http.StatusBadRequest)
+		return
+	}
+
+	user, _, _ := r.BasicAuth()
+	logger().Infof(context.Background(), "%s user: %s remote: %s servid: %d disable: %v", fun, user, r.RemoteAddr, sb.servId, disable)
+	if err := sb.DisableInstance(sb.servId, disable); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	adminStatusHandler(w, r, nil)
+}
+
+const adminUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>roc admin</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 16px; }
+table { border-collapse: collapse; margin-bottom: 16px; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+th { background: #f0f0f0; }
+.bad { color: #c00; }
+button { margin-right: 8px; }
+</style>
+</head>
+<body>
+<h2 id="title">roc admin</h2>
+<div>
+<button onclick="load()">refresh</button>
+<button onclick="drain(true)">drain</button>
+<button onclick="drain(false)">undrain</button>
+<span id="msg"></span>
+</div>
+<h3>status</h3><table id="status"></table>
+<h3>processors</h3><table id="processors"></table>
+<h3>routing</h3><div id="routes"></div>
+<script>
+function cell(tr, tag, text, cls) {
+  var c = document.createElement(tag);
+  c.textContent = text;
+  if (cls) c.className = cls;
+  tr.appendChild(c);
+}
+function table(el, head, rows) {
+  el.textContent = "";
+  var tr = document.createElement("tr");
+  head.forEach(function (h) { cell(tr, "th", h); });
+  el.appendChild(tr);
+  rows.forEach(function (r) {
+    tr = document.createElement("tr");
+    r.forEach(function (v) { cell(tr, "td", v[0], v[1]); });
+    el.appendChild(tr);
+  });
+}
+function kv(obj) {
+  return Object.keys(obj || {}).sort().map(function (k) {
+    return k + "=" + (typeof obj[k] === "object" ? JSON.stringify(obj[k]) : obj[k]);
+  }).join(" ");
+}
+function render(st) {
+  document.getElementById("title").textContent = st.service + " #" + st.servid;
+  var ctrl = st.ctrl || {};
+  var notReady = kv(st.not_ready);
+  var hb = st.heartbeat || {};
+  var hbText = hb.last_success ? "last success " + hb.last_success + ", keys " + hb.keys + ", ttl " + hb.ttl : "not registered";
+  if (hb.failures) hbText += ", " + hb.failures + " failures: " + hb.last_error;
+  table(document.getElementById("status"), ["key", "value"], [
+    [["lane"], [st.lane]], [["region / zone"], [st.region + " / " + st.zone]], [["ip"], [st.ip]],
+    [["md5"], [st.md5]], [["start up"], [st.start_up]], [["log level"], [st.log_level]],
+    [["ready"], [notReady ? "not ready: " + notReady : "ok", notReady ? "bad" : ""]],
+    [["weight"], [String(ctrl.weight)]], [["disable"], [String(!!ctrl.disable), ctrl.disable ? "bad" : ""]],
+    [["lazy"], [kv(st.lazy_states)]],
+    [["heartbeat"], [hbText, hb.healthy && !hb.failures ? "" : "bad"]],
+    [["system processors"], [(st.system_processors || []).map(function (p) {
+      return p.name + (p.up ? " up" : " down: " + p.error);
+    }).join(", "), st.degraded ? "bad" : ""]]
+  ]);
+  table(document.getElementById("processors"), ["name", "type", "addr"], Object.keys(st.processors || {}).sort().map(function (k) {
+    return [[k], [st.processors[k].type], [st.processors[k].addr]];
+  }));
+  var routes = document.getElementById("routes");
+  routes.textContent = "";
+  (st.routes || []).forEach(function (r) {
+    var h = document.createElement("h4");
+    h.textContent = r.service + (r.override ? " (route override)" : "");
+    routes.appendChild(h);
+    var t = document.createElement("table");
+    var breakers = r.breakers || {};
+    table(t, ["servid", "lane", "zone", "weight", "disable", "state", "servs", "breaker"], r.instances.map(function (i) {
+      var broken = Object.keys(i.servs || {}).filter(function (k) { return breakers[i.servs[k].addr]; }).map(function (k) {
+        return i.servs[k].addr + (breakers[i.servs[k].addr] === 1 ? " open" : " half-open");
+      }).join(" ");
+      return [[String(i.servid)], [i.lane], [i.zone], [String(i.weight)], [String(i.disable), i.disable ? "bad" : ""],
+        [i.state || "active", i.state === "starting" ? "bad" : ""],
+        [Object.keys(i.servs || {}).sort().map(function (k) { return k + "=" + i.servs[k].addr; }).join(" ")], [broken, broken ? "bad" : ""]];
+    }));
+    routes.appendChild(t);
+  });
+}
+function request(method, url, body) {
+  var msg = document.getElementById("msg");
+  return fetch(url, {method: method, body: body, headers: {"X-Roc-Admin": "1", "Content-Type": "application/x-www-form-urlencoded"}})
+    .then(function (r) {
+      if (!r.ok) return r.text().then(function (t) { throw new Error(r.status + " " + t); });
+      msg.textContent = "";
+      return r.json();
+    }).then(render).catch(function (e) { msg.textContent = e.message; msg.className = "bad"; });
+}
+function load() { return request("GET", "/backdoor/ui/api/status"); }
+function drain(disable) {
+  if (!confirm((disable ? "drain" : "undrain") + " this instance?")) return;
+  request("POST", "/backdoor/ui/api/drain", "disable=" + disable);
+}
+load();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,52 @@
+package rocserv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminUIAuth(t *testing.T) {
+	ass := assert.New(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/backdoor/ui", nil)
+	ass.False(adminUIAuthorized(r, "secret"))
+	r.SetBasicAuth("ops", "secret")
+	ass.True(adminUIAuthorized(r, "secret"))
+	r.SetBasicAuth("ops", "wrong")
+	ass.False(adminUIAuthorized(r, "secret"))
+	r.Header.Set("Authorization", "Bearer secret")
+	ass.True(adminUIAuthorized(r, "secret"))
+	r.Header.Set("Authorization", "secret")
+	ass.False(adminUIAuthorized(r, "secret"))
+
+	// 未配置口令时不可用
+	w := httptest.NewRecorder()
+	adminUIAuth(adminUIHandler)(w, httptest.NewRequest(http.MethodGet, "/backdoor/ui", nil), nil)
+	ass.Equal(http.StatusForbidden, w.Code)
+
+	// 修改类请求必须带 header
+	w = httptest.NewRecorder()
+	adminDrainHandler(w, httptest.NewRequest(http.MethodPost, "/backdoor/ui/api/drain", strings.NewReader("disable=true")), nil)
+	ass.Equal(http.StatusForbidden, w.Code)
+}
+
+func TestAdminRoutingTable(t *testing.T) {
+	ass := assert.New(t)
+
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.upServlist(servCopyCollect{
+		2: zoneServCopy(2, "b", 100),
+		1: zoneServCopy(1, "a", 50),
+	})
+	route := cli.routingTable()
+	ass.Equal("base/account", route.Service)
+	ass.Len(route.Instances, 2)
+	ass.Equal(1, route.Instances[0].Servid)
+	ass.Equal("a", route.Instances[0].Zone)
+	ass.Equal(50, route.Instances[0].Weight)
+	ass.Equal("", route.Instances[0].Lane)
+}
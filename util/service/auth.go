@@ -0,0 +1,433 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// 配置中心中鉴权规则的配置 key 前缀, 完整 key 为 auth.{name}, 签名密钥为 keyring.{name}
+	authConfPrefix = "auth."
+
+	authHeader  = "Authorization"
+	authMetaKey = "authorization"
+	authBearer  = "Bearer "
+
+	defaultAuthLeeway      = 30 * time.Second
+	defaultServiceTokenTTL = 10 * time.Minute
+	// 服务 token 剩余有效期不足时重新签发
+	serviceTokenRenewBefore = time.Minute
+)
+
+var (
+	ErrAuthTokenMissing = errors.New("auth token missing")
+	ErrAuthTokenInvalid = errors.New("auth token invalid")
+	ErrAuthTokenExpired = errors.New("auth token expired")
+)
+
+// AuthConf rules of token validation in config center, Audience is empty means the name of this service
+//
+//	{"audience": ["base/account"], "issuers": ["sso", "base/order"], "skip": ["/health", "Ping"], "leeway_sec": 30}
+type AuthConf struct {
+	Audience []string `json:"audience"`
+	// Issuers 为空时不校验签发方
+	Issuers []string `json:"issuers"`
+	// Skip 不需要鉴权的接口, http 为 url path, grpc 为方法名, thrift 为 message 名
+	Skip []string `json:"skip"`
+	// Optional 请求不带 token 时放行, 带 token 时仍然校验
+	Optional  bool `json:"optional"`
+	LeewaySec int  `json:"leeway_sec"`
+}
+
+// AuthAudience audience of token, json value can be a string or an array
+type AuthAudience []string
+
+func (m *AuthAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*m = AuthAudience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*m = list
+	return nil
+}
+
+// AuthClaims registered claims of JWT
+type AuthClaims struct {
+	Issuer    string       `json:"iss,omitempty"`
+	Subject   string       `json:"sub,omitempty"`
+	Audience  AuthAudience `json:"aud,omitempty"`
+	ExpiresAt int64        `json:"exp,omitempty"`
+	NotBefore int64        `json:"nbf,omitempty"`
+	IssuedAt  int64        `json:"iat,omitempty"`
+	ID        string       `json:"jti,omitempty"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid"`
+}
+
+// Authenticator sign and verify JWT with HS256, signing keys come from key ring so they can be rotated
+// by adding the new key before switching primary
+type Authenticator struct {
+	name string
+	keys *KeyRing
+
+	mu   sync.RWMutex
+	conf *AuthConf
+	raw  string
+}
+
+// NewAuthenticator load keys from keyring.{name} and rules from auth.{name} in config center,
+// rules are optional, call Watch to reload both
+func NewAuthenticator(ctx context.Context, name string) (*Authenticator, error) {
+	keys, err := LoadKeyRing(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	m := NewAuthenticatorWithKeyRing(name, keys, nil)
+	if err := m.reloadConf(ctx); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// NewAuthenticatorWithKeyRing create authenticator with keys and rules, conf can be nil
+func NewAuthenticatorWithKeyRing(name string, keys *KeyRing, conf *AuthConf) *Authenticator {
+	if conf == nil {
+		conf = &AuthConf{}
+	}
+	return &Authenticator{name: name, keys: keys, conf: conf}
+}
+
+func (m *Authenticator) reloadConf(ctx context.Context) error {
+	cc := GetConfigCenter()
+	if cc == nil {
+		return fmt.Errorf("config center not init")
+	}
+	raw, ok := cc.GetString(ctx, authConfPrefix+m.name)
+	if !ok {
+		raw = ""
+	}
+
+	m.mu.RLock()
+	changed := raw != m.raw
+	m.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+
+	conf := &AuthConf{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal([]byte(raw), conf); err != nil {
+			return fmt.Errorf("auth: %s unmarshal err: %v", m.name, err)
+		}
+	}
+	m.mu.Lock()
+	m.conf, m.raw = conf, raw
+	m.mu.Unlock()
+	return nil
+}
+
+// Watch reload keys and rules from config center every interval until ctx done
+func (m *Authenticator) Watch(ctx context.Context, interval time.Duration) {
+	fun := "Authenticator.Watch -->"
+	if interval <= 0 {
+		interval = defaultKeyRingWatchInterval
+	}
+	go m.keys.Watch(ctx, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.reloadConf(ctx); err != nil {
+				// 配置有误时继续使用旧规则
+				logger().Errorf(ctx, "%s reload name: %s err: %v", fun, m.name, err)
+			}
+		}
+	}
+}
+
+func (m *Authenticator) getConf() *AuthConf {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.conf
+}
+
+// Sign sign claims with primary key
+func (m *Authenticator) Sign(claims *AuthClaims) (string, error) {
+	key := m.keys.Primary()
+	if key == nil {
+		return "", ErrKeyRingEmpty
+	}
+	header, err := json.Marshal(&jwtHeader{Alg: "HS256", Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256(key.Secret, []byte(input))), nil
+}
+
+// Verify verify signature, expiry, audience and issuer of token, token without exp is rejected
+func (m *Authenticator) Verify(token string) (*AuthClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrAuthTokenInvalid
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	// 只接受 HS256, 防止 alg 为 none 等降级
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("%v: alg %s not supported", ErrAuthTokenInvalid, header.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrAuthTokenInvalid
+	}
+	if err := m.keys.Verify(header.Kid, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrAuthTokenInvalid, err)
+	}
+	claims := &AuthClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+
+	conf := m.getConf()
+	leeway := defaultAuthLeeway
+	if conf.LeewaySec > 0 {
+		leeway = time.Duration(conf.LeewaySec) * time.Second
+	}
+	now := time.Now()
+	// 不带 exp 的 token 永不过期, 泄露后无法失效
+	if claims.ExpiresAt <= 0 {
+		return nil, fmt.Errorf("%v: exp missing", ErrAuthTokenInvalid)
+	}
+	if now.Add(-leeway).Unix() > claims.ExpiresAt {
+		return nil, ErrAuthTokenExpired
+	}
+	if claims.NotBefore > 0 && now.Add(leeway).Unix() < claims.NotBefore {
+		return nil, fmt.Errorf("%v: not valid yet", ErrAuthTokenInvalid)
+	}
+
+	audience := conf.Audience
+	if len(audience) == 0 {
+		audience = []string{GetServName()}
+	}
+	if !containsAny(claims.Audience, audience) {
+		return nil, fmt.Errorf("%v: audience %v", ErrAuthTokenInvalid, claims.Audience)
+	}
+	if len(conf.Issuers) > 0 && !containsAny([]string{claims.Issuer}, conf.Issuers) {
+		return nil, fmt.Errorf("%v: issuer %s", ErrAuthTokenInvalid, claims.Issuer)
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrAuthTokenInvalid
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrAuthTokenInvalid
+	}
+	return nil
+}
+
+func containsAny(list, expect []string) bool {
+	for _, s := range list {
+		for _, e := range expect {
+			if s == e {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type authClaimsKey struct{}
+
+// GetAuthClaims return claims of token verified by Authenticator.Middleware
+func GetAuthClaims(ctx context.Context) (*AuthClaims, bool) {
+	claims, ok := ctx.Value(authClaimsKey{}).(*AuthClaims)
+	return claims, ok
+}
+
+// Middleware verify bearer token of http and grpc requests, install it with Use;
+// thrift carries no request metadata, so thrift messages not in skip list are rejected
+func (m *Authenticator) Middleware() Middleware {
+	return func(ctx context.Context, info *CallInfo, next func(ctx context.Context) error) error {
+		conf := m.getConf()
+		for _, s := range conf.Skip {
+			if s == info.Method {
+				return next(ctx)
+			}
+		}
+
+		token := incomingAuthToken(ctx, info)
+		if len(token) == 0 {
+			if conf.Optional {
+				return next(ctx)
+			}
+			return status.Error(codes.Unauthenticated, ErrAuthTokenMissing.Error())
+		}
+		claims, err := m.Verify(token)
+		if err != nil {
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+		return next(context.WithValue(ctx, authClaimsKey{}, claims))
+	}
+}
+
+func incomingAuthToken(ctx context.Context, info *CallInfo) string {
+	var auth string
+	switch info.Type {
+	case PROCESSOR_HTTP:
+		if r, ok := info.Req.(*http.Request); ok {
+			auth = r.Header.Get(authHeader)
+		}
+	case PROCESSOR_GRPC:
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if vs := md.Get(authMetaKey); len(vs) > 0 {
+				auth = vs[0]
+			}
+		}
+	}
+	if !strings.HasPrefix(auth, authBearer) {
+		return ""
+	}
+	return strings.TrimPrefix(auth, authBearer)
+}
+
+// TokenSource provide token attached to requests to service servKey
+type TokenSource interface {
+	Token(ctx context.Context, servKey string) (string, error)
+}
+
+var (
+	muTokenSource     sync.RWMutex
+	clientTokenSource TokenSource
+)
+
+// SetClientTokenSource set token source used by grpc clients to attach bearer token automatically,
+// token set by WithAuthToken takes precedence
+func SetClientTokenSource(src TokenSource) {
+	muTokenSource.Lock()
+	defer muTokenSource.Unlock()
+	clientTokenSource = src
+}
+
+type authTokenKey struct{}
+
+// WithAuthToken attach token to calls made with ctx, e.g. forward token of end user
+func WithAuthToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, authTokenKey{}, token)
+}
+
+// GetAuthToken return token for calling service servKey, used by http clients to set Authorization header
+func GetAuthToken(ctx context.Context, servKey string) (string, error) {
+	if token, ok := ctx.Value(authTokenKey{}).(string); ok {
+		return token, nil
+	}
+	muTokenSource.RLock()
+	src := clientTokenSource
+	muTokenSource.RUnlock()
+	if src == nil {
+		return "", nil
+	}
+	return src.Token(ctx, servKey)
+}
+
+// withOutgoingAuthToken 获取 token 失败时不带 token 发起请求, 由服务端决定是否拒绝
+func withOutgoingAuthToken(ctx context.Context, servKey string) context.Context {
+	fun := "withOutgoingAuthToken -->"
+
+	token, err := GetAuthToken(ctx, servKey)
+	if err != nil {
+		logger().Warnf(ctx, "%s serv: %s get token err: %v", fun, servKey, err)
+		return ctx
+	}
+	if len(token) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, authMetaKey, authBearer+token)
+}
+
+// ServiceTokenSource sign tokens issued by this service with audience of callee, tokens are cached until near expiry,
+// ttl is 10 minutes if not positive
+func (m *Authenticator) ServiceTokenSource(ttl time.Duration) TokenSource {
+	if ttl <= 0 {
+		ttl = defaultServiceTokenTTL
+	}
+	return &serviceTokenSource{auth: m, ttl: ttl, tokens: make(map[string]*cachedToken)}
+}
+
+type cachedToken struct {
+	token    string
+	expireAt time.Time
+	keyID    string
+}
+
+type serviceTokenSource struct {
+	auth *Authenticator
+	ttl  time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+}
+
+func (m *serviceTokenSource) Token(ctx context.Context, servKey string) (string, error) {
+	key := m.auth.keys.Primary()
+	if key == nil {
+		return "", ErrKeyRingEmpty
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// 主密钥切换后重新签发
+	if c, ok := m.tokens[servKey]; ok && c.keyID == key.ID && time.Until(c.expireAt) > serviceTokenRenewBefore {
+		return c.token, nil
+	}
+
+	now := time.Now()
+	expireAt := now.Add(m.ttl)
+	servName := GetServName()
+	token, err := m.auth.Sign(&AuthClaims{
+		Issuer:    servName,
+		Subject:   servName,
+		Audience:  AuthAudience{servKey},
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expireAt.Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	m.tokens[servKey] = &cachedToken{token: token, expireAt: expireAt, keyID: key.ID}
+	return token, nil
+}
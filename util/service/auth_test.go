@@ -0,0 +1,106 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthenticator(t *testing.T) {
+	ass := assert.New(t)
+
+	kr, err := NewKeyRingFromConf("test", `{"primary":"v1","keys":{"v1":"c2VjcmV0MQ=="}}`)
+	ass.Nil(err)
+	auth := NewAuthenticatorWithKeyRing("test", kr, &AuthConf{Audience: []string{"base/account"}, Issuers: []string{"base/order"}, Skip: []string{"Ping"}})
+
+	now := time.Now()
+	token, err := auth.Sign(&AuthClaims{Issuer: "base/order", Audience: AuthAudience{"base/account"}, ExpiresAt: now.Add(time.Minute).Unix()})
+	ass.Nil(err)
+	claims, err := auth.Verify(token)
+	ass.Nil(err)
+	ass.Equal("base/order", claims.Issuer)
+
+	// 密钥轮换后旧 token 仍然有效
+	ass.Nil(kr.load(`{"primary":"v2","keys":{"v1":"c2VjcmV0MQ==","v2":"c2VjcmV0Mg=="}}`))
+	_, err = auth.Verify(token)
+	ass.Nil(err)
+	ass.Nil(kr.load(`{"primary":"v2","keys":{"v2":"c2VjcmV0Mg=="}}`))
+	_, err = auth.Verify(token)
+	ass.NotNil(err)
+
+	for _, c := range []*AuthClaims{
+		{Issuer: "base/order", Audience: AuthAudience{"base/account"}, ExpiresAt: now.Add(-time.Hour).Unix()},
+		{Issuer: "base/order", Audience: AuthAudience{"base/other"}},
+		{Issuer: "base/other", Audience: AuthAudience{"base/account"}},
+	} {
+		token, err := auth.Sign(c)
+		ass.Nil(err)
+		_, err = auth.Verify(token)
+		ass.NotNil(err)
+	}
+	_, err = auth.Verify("eyJhbGciOiJub25lIn0.e30.")
+	ass.NotNil(err)
+
+	// 签名正确但没有 exp
+	token, err = auth.Sign(&AuthClaims{Issuer: "base/order", Audience: AuthAudience{"base/account"}})
+	ass.Nil(err)
+	_, err = auth.Verify(token)
+	ass.NotNil(err)
+	ass.Contains(err.Error(), ErrAuthTokenInvalid.Error())
+
+	var aud AuthAudience
+	ass.Nil(aud.UnmarshalJSON([]byte(`"base/account"`)))
+	ass.Equal(AuthAudience{"base/account"}, aud)
+
+	// 服务 token 按被调方签发并缓存
+	src := auth.ServiceTokenSource(time.Minute)
+	token, err = src.Token(context.Background(), "base/account")
+	ass.Nil(err)
+	token2, err := src.Token(context.Background(), "base/account")
+	ass.Nil(err)
+	ass.Equal(token, token2)
+	SetClientTokenSource(src)
+	defer SetClientTokenSource(nil)
+	ctx := withOutgoingAuthToken(context.Background(), "base/account")
+	md, _ := metadata.FromOutgoingContext(ctx)
+	ass.Equal([]string{authBearer + token}, md.Get(authMetaKey))
+	ctx = withOutgoingAuthToken(WithAuthToken(context.Background(), "user"), "base/account")
+	md, _ = metadata.FromOutgoingContext(ctx)
+	ass.Equal([]string{authBearer + "user"}, md.Get(authMetaKey))
+
+	// middleware, 服务 token 的签发方为空, 放开签发方校验
+	auth.conf.Issuers = nil
+	mw := []Middleware{auth.Middleware()}
+	handler := func(ctx context.Context) error {
+		claims, ok := GetAuthClaims(ctx)
+		ass.True(ok)
+		ass.Equal(AuthAudience{"base/account"}, claims.Audience)
+		return nil
+	}
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(authMetaKey, authBearer+token))
+	called, err := runMiddlewares(ctx, &CallInfo{Type: PROCESSOR_GRPC, Method: "GetUser"}, mw, handler)
+	ass.True(called)
+	ass.Nil(err)
+
+	r, _ := http.NewRequest(http.MethodGet, "/user", nil)
+	called, err = runMiddlewares(context.Background(), &CallInfo{Type: PROCESSOR_HTTP, Method: "/user", Req: r}, mw, handler)
+	ass.False(called)
+	ass.Equal(codes.Unauthenticated, status.Code(err))
+	r.Header.Set(authHeader, authBearer+token)
+	called, err = runMiddlewares(context.Background(), &CallInfo{Type: PROCESSOR_HTTP, Method: "/user", Req: r}, mw, handler)
+	ass.True(called)
+	ass.Nil(err)
+
+	called, err = runMiddlewares(context.Background(), &CallInfo{Type: PROCESSOR_THRIFT, Method: "Ping"}, mw, func(ctx context.Context) error { return nil })
+	ass.True(called)
+	ass.Nil(err)
+	called, _ = runMiddlewares(context.Background(), &CallInfo{Type: PROCESSOR_THRIFT, Method: "GetUser"}, mw, handler)
+	ass.False(called)
+}
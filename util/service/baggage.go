@@ -0,0 +1,239 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtrace"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// well-known baggage keys
+const (
+	BaggageKeyUID    = "uid"
+	BaggageKeyTenant = "tenant"
+	// value "1" marks the request as pressure test traffic
+	BaggageKeyStressTest = "stress-test"
+)
+
+const (
+	// grpc metadata 及 span baggage 的 key 前缀, http header 前缀
+	baggageMetaPrefix   = "roc-baggage-"
+	baggageHeaderPrefix = "X-Roc-Baggage-"
+
+	// 限制条数及长度, 防止上游传入大量数据放大到整条调用链
+	baggageMaxItems    = 16
+	baggageMaxKeyLen   = 64
+	baggageMaxValueLen = 256
+)
+
+type baggageKey struct{}
+
+// baggage 不可修改, 写入时复制
+type baggage map[string]string
+
+// normalizeBaggageKey key 只允许小写字母, 数字, '-' 及 '_', grpc metadata 及 http header 都可以携带
+func normalizeBaggageKey(key string) (string, bool) {
+	key = strings.ToLower(key)
+	if len(key) == 0 || len(key) > baggageMaxKeyLen {
+		return "", false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return "", false
+		}
+	}
+	return key, true
+}
+
+func (m baggage) with(key, value string) (baggage, bool) {
+	key, ok := normalizeBaggageKey(key)
+	if !ok || len(value) > baggageMaxValueLen {
+		return m, false
+	}
+	if _, exist := m[key]; !exist && len(m) >= baggageMaxItems {
+		return m, false
+	}
+	res := make(baggage, len(m)+1)
+	for k, v := range m {
+		res[k] = v
+	}
+	res[key] = value
+	return res, true
+}
+
+func baggageFromContext(ctx context.Context) baggage {
+	if b, ok := ctx.Value(baggageKey{}).(baggage); ok {
+		return b
+	}
+	return nil
+}
+
+// WithBaggage return a context carrying key/value baggage, which is propagated to downstream services
+// in all roc client calls made with the context and its children;
+// key is lower-cased, invalid key or oversize value is dropped
+func WithBaggage(ctx context.Context, key, value string) context.Context {
+	fun := "WithBaggage -->"
+	b, ok := baggageFromContext(ctx).with(key, value)
+	if !ok {
+		logger().Warnf(ctx, "%s baggage key: %s dropped", fun, key)
+		return ctx
+	}
+	ctx = context.WithValue(ctx, baggageKey{}, b)
+	return baggageToSpan(ctx)
+}
+
+// BaggageFromContext return a copy of baggage of the request, including items set by upstream services
+func BaggageFromContext(ctx context.Context) map[string]string {
+	res := make(map[string]string)
+	// thrift 没有 header, 上游的 baggage 随 span 传递
+	if span := xtrace.SpanFromContext(ctx); span != nil {
+		span.Context().ForeachBaggageItem(func(k, v string) bool {
+			if strings.HasPrefix(k, baggageMetaPrefix) {
+				res[strings.TrimPrefix(k, baggageMetaPrefix)] = v
+			}
+			return true
+		})
+	}
+	for k, v := range baggageFromContext(ctx) {
+		res[k] = v
+	}
+	return res
+}
+
+// GetBaggage return baggage value of key, empty if not set
+func GetBaggage(ctx context.Context, key string) string {
+	key, ok := normalizeBaggageKey(key)
+	if !ok {
+		return ""
+	}
+	return BaggageFromContext(ctx)[key]
+}
+
+// IsStressTest whether the request is pressure test traffic marked by BaggageKeyStressTest
+func IsStressTest(ctx context.Context) bool {
+	return GetBaggage(ctx, BaggageKeyStressTest) == "1"
+}
+
+// baggageToSpan 同步到当前 span, thrift 调用及之后创建的子 span 可以带上
+func baggageToSpan(ctx context.Context) context.Context {
+	span := xtrace.SpanFromContext(ctx)
+	if span == nil {
+		return ctx
+	}
+	for k, v := range baggageFromContext(ctx) {
+		if span.BaggageItem(baggageMetaPrefix+k) != v {
+			span.SetBaggageItem(baggageMetaPrefix+k, v)
+		}
+	}
+	return ctx
+}
+
+// baggageFromCarrier get 返回 key 对应的 (转义后的) value
+func baggageFromCarrier(ctx context.Context, keys []string, get func(key string) string) context.Context {
+	b := baggageFromContext(ctx)
+	for _, k := range keys {
+		v, err := url.QueryUnescape(get(k))
+		if err != nil {
+			continue
+		}
+		b, _ = b.with(k, v)
+	}
+	if len(b) == 0 {
+		return ctx
+	}
+	return baggageToSpan(context.WithValue(ctx, baggageKey{}, b))
+}
+
+// InjectBaggageHeaders set baggage of ctx to http headers, used by http clients of app
+func InjectBaggageHeaders(ctx context.Context, header http.Header) {
+	for k, v := range BaggageFromContext(ctx) {
+		header.Set(baggageHeaderPrefix+k, url.QueryEscape(v))
+	}
+}
+
+func baggageHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		for k := range r.Header {
+			if len(k) > len(baggageHeaderPrefix) && strings.EqualFold(k[:len(baggageHeaderPrefix)], baggageHeaderPrefix) {
+				keys = append(keys, k[len(baggageHeaderPrefix):])
+			}
+		}
+		if len(keys) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := baggageFromCarrier(r.Context(), keys, func(key string) string {
+			return r.Header.Get(baggageHeaderPrefix + key)
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func baggageIncoming(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	var keys []string
+	for k := range md {
+		if strings.HasPrefix(k, baggageMetaPrefix) {
+			keys = append(keys, strings.TrimPrefix(k, baggageMetaPrefix))
+		}
+	}
+	if len(keys) == 0 {
+		return ctx
+	}
+	return baggageFromCarrier(ctx, keys, func(key string) string {
+		if vs := md.Get(baggageMetaPrefix + key); len(vs) > 0 {
+			return vs[0]
+		}
+		return ""
+	})
+}
+
+func baggageOutgoing(ctx context.Context) context.Context {
+	b := BaggageFromContext(ctx)
+	if len(b) == 0 {
+		return ctx
+	}
+	kv := make([]string, 0, 2*len(b))
+	for k, v := range b {
+		kv = append(kv, baggageMetaPrefix+k, url.QueryEscape(v))
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// baggageServerInterceptor 在 tracing 拦截器之后, 同步到 server span
+func baggageServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(baggageIncoming(ctx), req)
+	}
+}
+
+func baggageStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := baggageIncoming(ss.Context())
+		if ctx == ss.Context() {
+			return handler(srv, ss)
+		}
+		return handler(srv, &ctxServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func baggageClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(baggageOutgoing(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+func baggageStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(baggageOutgoing(ctx), desc, cc, method, opts...)
+	}
+}
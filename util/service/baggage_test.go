@@ -0,0 +1,51 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestBaggage(t *testing.T) {
+	ass := assert.New(t)
+
+	ctx := WithBaggage(context.Background(), "Tenant", "palfish")
+	ctx = WithBaggage(ctx, BaggageKeyStressTest, "1")
+	ctx = WithBaggage(ctx, "bad key", "x")
+	ass.Equal(map[string]string{"tenant": "palfish", "stress-test": "1"}, BaggageFromContext(ctx))
+	ass.Equal("palfish", GetBaggage(ctx, "TENANT"))
+	ass.True(IsStressTest(ctx))
+	ass.False(IsStressTest(context.Background()))
+
+	// 写入时复制, 不影响父 ctx
+	child := WithBaggage(ctx, BaggageKeyUID, "1001")
+	ass.Len(BaggageFromContext(ctx), 2)
+	ass.Len(BaggageFromContext(child), 3)
+
+	full := context.Background()
+	for i := 0; i < baggageMaxItems+2; i++ {
+		full = WithBaggage(full, fmt.Sprintf("k%d", i), "v")
+	}
+	ass.Len(BaggageFromContext(full), baggageMaxItems)
+
+	// http
+	var got map[string]string
+	h := baggageHttpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = BaggageFromContext(r.Context())
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	InjectBaggageHeaders(WithBaggage(ctx, BaggageKeyUID, "用户 1"), r.Header)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	ass.Equal(map[string]string{"tenant": "palfish", "stress-test": "1", "uid": "用户 1"}, got)
+
+	// grpc
+	md, _ := metadata.FromOutgoingContext(baggageOutgoing(child))
+	in := baggageIncoming(metadata.NewIncomingContext(context.Background(), md))
+	ass.Equal(BaggageFromContext(child), BaggageFromContext(in))
+	ass.Equal(context.Background(), baggageIncoming(context.Background()))
+}
@@ -0,0 +1,164 @@
+package rocserv
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	LB_HASH                 = "hash"
+	LB_ROUND_ROBIN          = "round_robin"
+	LB_RANDOM               = "random"
+	LB_LEAST_CONN           = "least_conn"
+	LB_WEIGHTED_ROUND_ROBIN = "weighted_round_robin"
+)
+
+// Endpoint candidate instance of load balancer
+type Endpoint struct {
+	Servid int
+	Weight int
+	Zone   string
+	Serv   *ServInfo
+}
+
+// LoadBalancer pick one of endpoints, endpoints are not empty and ordered by servid
+type LoadBalancer interface {
+	Pick(key string, endpoints []*Endpoint) *Endpoint
+}
+
+// ConnTracker implemented by load balancer which needs in-flight requests of instances
+type ConnTracker interface {
+	Acquire(s *ServInfo)
+	Release(s *ServInfo)
+}
+
+// NewLoadBalancer create load balancer of policy, nil is returned for hash which is the default of ClientEtcdV2
+func NewLoadBalancer(policy string) LoadBalancer {
+	fun := "NewLoadBalancer -->"
+
+	switch policy {
+	case LB_HASH, "":
+		return nil
+	case LB_ROUND_ROBIN:
+		return NewRoundRobinBalancer()
+	case LB_RANDOM:
+		return NewRandomBalancer()
+	case LB_LEAST_CONN:
+		return NewLeastConnBalancer()
+	case LB_WEIGHTED_ROUND_ROBIN:
+		return NewWeightedRoundRobinBalancer()
+	default:
+		logger().Errorf(context.Background(), "%s unknown policy: %s, use hash", fun, policy)
+		return nil
+	}
+}
+
+type RoundRobinBalancer struct {
+	mu   sync.Mutex
+	next int
+}
+
+func NewRoundRobinBalancer() *RoundRobinBalancer {
+	return &RoundRobinBalancer{}
+}
+
+func (m *RoundRobinBalancer) Pick(key string, endpoints []*Endpoint) *Endpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ep := endpoints[m.next%len(endpoints)]
+	m.next++
+	return ep
+}
+
+type RandomBalancer struct {
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func NewRandomBalancer() *RandomBalancer {
+	return &RandomBalancer{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (m *RandomBalancer) Pick(key string, endpoints []*Endpoint) *Endpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return endpoints[m.rand.Intn(len(endpoints))]
+}
+
+// LeastConnBalancer pick instance with least in-flight requests of current client, ties are broken in round robin
+type LeastConnBalancer struct {
+	mu      sync.Mutex
+	counter map[string]int64
+	next    int
+}
+
+func NewLeastConnBalancer() *LeastConnBalancer {
+	return &LeastConnBalancer{counter: make(map[string]int64)}
+}
+
+func (m *LeastConnBalancer) Pick(key string, endpoints []*Endpoint) *Endpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	start := m.next % len(endpoints)
+	m.next++
+
+	var best *Endpoint
+	var min int64
+	for i := 0; i < len(endpoints); i++ {
+		ep := endpoints[(start+i)%len(endpoints)]
+		count := m.counter[ep.Serv.Addr]
+		if best == nil || count < min {
+			best, min = ep, count
+		}
+	}
+	return best
+}
+
+func (m *LeastConnBalancer) Acquire(s *ServInfo) {
+	m.mu.Lock()
+	m.counter[s.Addr]++
+	m.mu.Unlock()
+}
+
+func (m *LeastConnBalancer) Release(s *ServInfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counter[s.Addr]--
+	if m.counter[s.Addr] <= 0 {
+		delete(m.counter, s.Addr)
+	}
+}
+
+// WeightedRoundRobinBalancer smooth weighted round robin by manual weight of instances, same as nginx
+type WeightedRoundRobinBalancer struct {
+	mu      sync.Mutex
+	current map[string]int
+}
+
+func NewWeightedRoundRobinBalancer() *WeightedRoundRobinBalancer {
+	return &WeightedRoundRobinBalancer{current: make(map[string]int)}
+}
+
+func (m *WeightedRoundRobinBalancer) Pick(key string, endpoints []*Endpoint) *Endpoint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total := 0
+	var best *Endpoint
+	for _, ep := range endpoints {
+		w := ep.Weight
+		if w <= 0 {
+			w = 100
+		}
+		total += w
+		m.current[ep.Serv.Addr] += w
+		if best == nil || m.current[ep.Serv.Addr] > m.current[best.Serv.Addr] {
+			best = ep
+		}
+	}
+	m.current[best.Serv.Addr] -= total
+	return best
+}
@@ -0,0 +1,50 @@
+package rocserv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEndpoints() []*Endpoint {
+	return []*Endpoint{
+		{Servid: 1, Weight: 300, Serv: &ServInfo{Addr: "a"}},
+		{Servid: 2, Weight: 100, Serv: &ServInfo{Addr: "b"}},
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	ass := assert.New(t)
+
+	lb := NewRoundRobinBalancer()
+	eps := testEndpoints()
+	ass.Equal("a", lb.Pick("", eps).Serv.Addr)
+	ass.Equal("b", lb.Pick("", eps).Serv.Addr)
+	ass.Equal("a", lb.Pick("", eps).Serv.Addr)
+}
+
+func TestLeastConnBalancer(t *testing.T) {
+	ass := assert.New(t)
+
+	lb := NewLeastConnBalancer()
+	eps := testEndpoints()
+	lb.Acquire(eps[0].Serv)
+	ass.Equal("b", lb.Pick("", eps).Serv.Addr)
+	ass.Equal("b", lb.Pick("", eps).Serv.Addr)
+
+	lb.Release(eps[0].Serv)
+	lb.Acquire(eps[1].Serv)
+	ass.Equal("a", lb.Pick("", eps).Serv.Addr)
+}
+
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	ass := assert.New(t)
+
+	lb := NewWeightedRoundRobinBalancer()
+	eps := testEndpoints()
+	count := map[string]int{}
+	for i := 0; i < 8; i++ {
+		count[lb.Pick("", eps).Serv.Addr]++
+	}
+	ass.Equal(map[string]int{"a": 6, "b": 2}, count)
+}
@@ -7,10 +7,10 @@ package rocserv
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gitlab.pri.ibanyu.com/middleware/dolphin/circuit_breaker"
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 )
 
 type ItemConf struct {
@@ -57,7 +57,7 @@ func (m *Breaker) monitor() {
 			for _, stat := range m.statCounter {
 				if stat.fail > 5 && stat.total > 5 &&
 					(float64(stat.fail)/float64(stat.total)) > 0.02 {
-					xlog.Errorf(ctx, "%s breaker stat, key:%s, total:%d, fail:%d", fun, stat.key, stat.total, stat.fail)
+					logger().Errorf(ctx, "%s breaker stat, key:%s, total:%d, fail:%d", fun, stat.key, stat.total, stat.fail)
 				}
 			}
 			m.statCounter = make(map[string]*BreakerStat)
@@ -89,7 +89,7 @@ func (m *Breaker) doStat(key string, total, fail int64) {
 	select {
 	case m.statChan <- stat:
 	default:
-		xlog.Errorf(context.Background(), "%s drop, key:%s, total:%d, fail:%d", fun, stat.key, stat.total, stat.fail)
+		logger().Errorf(context.Background(), "%s drop, key:%s, total:%d, fail:%d", fun, stat.key, stat.total, stat.fail)
 	}
 }
 
@@ -98,19 +98,29 @@ func (m *Breaker) Do(ctx context.Context, funcName string, run func(ctx context.
 	fail := int64(0)
 	// 稳定性平台，接口熔断配置的 key 形如 {servGroup}/{servName}/{funcName}。这里 m.servName 已为 {servGroup}/{servName} 形式了。
 	key := m.servName + "/" + funcName
-	err := circuit_breaker.Do(ctx, key, run, fallback)
+	// run 可能在 circuit_breaker 的 goroutine 中执行
+	var called int32
+	wrapRun := func(ctx context.Context) error {
+		atomic.StoreInt32(&called, 1)
+		return run(ctx)
+	}
+	err := circuit_breaker.Do(ctx, key, wrapRun, fallback)
 	if err == circuit_breaker.ErrCircuitBreakerRegistryNotInited {
 		// circuit_breaker 未初始化，视同无熔断。
-		xlog.Warnf(ctx, " circuit breaker registry not inited! Call `circuit_breaker.Init()` in your project's `logic.Init()` first!")
+		logger().Warnf(ctx, " circuit breaker registry not inited! Call `circuit_breaker.Init()` in your project's `logic.Init()` first!")
 		return run(ctx)
 	}
 
 	if err != nil {
-		xlog.Warnf(ctx, "%s key:%s err: %s", fun, key, err)
+		logger().Warnf(ctx, "%s key:%s err: %s", fun, key, err)
 		fail = 1
 	}
+	// run 未被调用说明请求被熔断拦截
+	if atomic.LoadInt32(&called) == 0 {
+		markCircuitOpen(ctx, m.servName)
+	}
 
-	xlog.Debugf(ctx, "Breaker key:%s fail:%d", key, fail)
+	logger().Debugf(ctx, "Breaker key:%s fail:%d", key, fail)
 	m.doStat(key, 1, fail)
 	return err
 }
@@ -0,0 +1,146 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// 配置中心 application namespace 中的路由缓存策略, json 格式, key 为注册的路由路径,
+	// Default 为未配置路由的默认策略, 如 {"/user/:id": {"max_age": 60, "surrogate_max_age": 600}}
+	cacheControlConfKey = "http_cache_control"
+	cacheControlDefault = "Default"
+
+	HeaderCacheControl     = "Cache-Control"
+	HeaderSurrogateControl = "Surrogate-Control"
+)
+
+// CachePolicy cache headers of http response, durations are in seconds;
+// Cache-Control is for browser and gateway, Surrogate-Control is only for CDN and stripped by it
+type CachePolicy struct {
+	MaxAge               int  `json:"max_age"`
+	SMaxAge              int  `json:"s_maxage"`
+	StaleWhileRevalidate int  `json:"stale_while_revalidate"`
+	StaleIfError         int  `json:"stale_if_error"`
+	Private              bool `json:"private"`
+	NoCache              bool `json:"no_cache"`
+	NoStore              bool `json:"no_store"`
+	SurrogateMaxAge      int  `json:"surrogate_max_age"`
+}
+
+// CacheControl value of Cache-Control header
+func (m *CachePolicy) CacheControl() string {
+	if m.NoStore {
+		return "no-store"
+	}
+
+	var parts []string
+	if m.Private {
+		parts = append(parts, "private")
+	} else {
+		parts = append(parts, "public")
+	}
+	if m.NoCache {
+		parts = append(parts, "no-cache")
+	}
+	parts = append(parts, "max-age="+strconv.Itoa(m.MaxAge))
+	// private 响应不允许共享缓存
+	if m.SMaxAge > 0 && !m.Private {
+		parts = append(parts, "s-maxage="+strconv.Itoa(m.SMaxAge))
+	}
+	if m.StaleWhileRevalidate > 0 {
+		parts = append(parts, "stale-while-revalidate="+strconv.Itoa(m.StaleWhileRevalidate))
+	}
+	if m.StaleIfError > 0 {
+		parts = append(parts, "stale-if-error="+strconv.Itoa(m.StaleIfError))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// SurrogateControl value of Surrogate-Control header, empty means not set
+func (m *CachePolicy) SurrogateControl() string {
+	if m.NoStore || m.Private {
+		return "no-store"
+	}
+	if m.SurrogateMaxAge <= 0 {
+		return ""
+	}
+	return "max-age=" + strconv.Itoa(m.SurrogateMaxAge)
+}
+
+// SetCacheHeaders set cache headers of policy into w, must be called before header written
+func SetCacheHeaders(w http.ResponseWriter, p *CachePolicy) {
+	if p == nil {
+		return
+	}
+	w.Header().Set(HeaderCacheControl, p.CacheControl())
+	if sc := p.SurrogateControl(); len(sc) > 0 {
+		w.Header().Set(HeaderSurrogateControl, sc)
+	}
+}
+
+// CacheControl returns a middleware setting cache headers of p, used in route handlers such as
+// s.GET("/user/:id", rocserv.CacheControl(p), handler); it overrides the policy from config center
+func CacheControl(p *CachePolicy) HandlerFunc {
+	return func(c *Context) {
+		if cacheableMethod(c.Request.Method) {
+			SetCacheHeaders(c.Writer, p)
+		}
+	}
+}
+
+func cacheableMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+type routeCachePolicies struct {
+	mu       sync.Mutex
+	raw      string
+	policies map[string]*CachePolicy
+}
+
+var defaultRouteCachePolicies = &routeCachePolicies{}
+
+// get 配置未变化时使用上次解析的结果
+func (m *routeCachePolicies) get(route string) *CachePolicy {
+	fun := "routeCachePolicies.get -->"
+
+	cc := GetConfigCenter()
+	if cc == nil {
+		return nil
+	}
+	raw, ok := cc.GetString(context.TODO(), cacheControlConfKey)
+	if !ok || len(raw) == 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if raw != m.raw {
+		policies := make(map[string]*CachePolicy)
+		if err := json.Unmarshal([]byte(raw), &policies); err != nil {
+			logger().Errorf(context.Background(), "%s unmarshal %s: %s err: %v", fun, cacheControlConfKey, raw, err)
+			policies = nil
+		}
+		m.raw, m.policies = raw, policies
+	}
+
+	if p, ok := m.policies[route]; ok {
+		return p
+	}
+	return m.policies[cacheControlDefault]
+}
+
+// applyRouteCachePolicy 在路由处理前按配置设置缓存头
+func applyRouteCachePolicy(c *gin.Context, route string) {
+	if !cacheableMethod(c.Request.Method) {
+		return
+	}
+	SetCacheHeaders(c.Writer, defaultRouteCachePolicies.get(route))
+}
@@ -0,0 +1,25 @@
+package rocserv
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachePolicy(t *testing.T) {
+	ass := assert.New(t)
+
+	p := &CachePolicy{MaxAge: 60, SMaxAge: 300, StaleIfError: 86400, SurrogateMaxAge: 600}
+	ass.Equal("public, max-age=60, s-maxage=300, stale-if-error=86400", p.CacheControl())
+	ass.Equal("max-age=600", p.SurrogateControl())
+
+	p = &CachePolicy{MaxAge: 60, SMaxAge: 300, Private: true}
+	ass.Equal("private, max-age=60", p.CacheControl())
+	ass.Equal("no-store", p.SurrogateControl())
+
+	w := httptest.NewRecorder()
+	SetCacheHeaders(w, &CachePolicy{NoStore: true})
+	ass.Equal("no-store", w.Header().Get(HeaderCacheControl))
+	ass.Equal("no-store", w.Header().Get(HeaderSurrogateControl))
+}
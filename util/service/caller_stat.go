@@ -0,0 +1,166 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xnet/xhttp"
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// 调用方版本, 未设置时使用二进制 md5 前 8 位
+	envServiceVersion = "ROC_SERVICE_VERSION"
+
+	callerVersionMetaKey   = "roc-caller-version"
+	callerVersionHeaderKey = "X-Roc-Caller-Version"
+
+	// 每个接口最多记录的调用方指纹数, 防止异常调用方撑爆内存
+	callerStatMaxPerMethod = 256
+	// http 路径可能带参数, 接口数同样需要限制
+	callerStatMaxMethods = 1024
+)
+
+// CallerStat usage of one method by one caller fingerprint
+type CallerStat struct {
+	Caller  string `json:"caller"`
+	Version string `json:"version"`
+	Count   int64  `json:"count"`
+	First   int64  `json:"first"`
+	Last    int64  `json:"last"`
+}
+
+type callerStats struct {
+	mu sync.Mutex
+	// method -> caller/version -> usage
+	stats map[string]map[string]*CallerStat
+}
+
+var defaultCallerStats = &callerStats{stats: make(map[string]map[string]*CallerStat)}
+
+// serviceVersion 当前服务版本, 随请求传给被调方
+func serviceVersion() string {
+	if v := os.Getenv(envServiceVersion); len(v) > 0 {
+		return v
+	}
+	if len(serviceMD5) >= 8 {
+		return serviceMD5[:8]
+	}
+	return ""
+}
+
+func (m *callerStats) record(method, caller, version string) {
+	if len(caller) == 0 {
+		caller = unknownCostLabel
+	}
+	if len(version) == 0 {
+		version = unknownCostLabel
+	}
+
+	// 版本不作为 label, 避免每次发布产生新的时间序列
+	group, service := GetGroupAndService()
+	_metricCallerRequest.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelAPI, method, labelCaller, caller).Inc()
+
+	now := time.Now().Unix()
+	key := caller + "/" + version
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	callers, ok := m.stats[method]
+	if !ok {
+		if len(m.stats) >= callerStatMaxMethods {
+			return
+		}
+		callers = make(map[string]*CallerStat)
+		m.stats[method] = callers
+	}
+	c, ok := callers[key]
+	if !ok {
+		if len(callers) >= callerStatMaxPerMethod {
+			return
+		}
+		c = &CallerStat{Caller: caller, Version: version, First: now}
+		callers[key] = c
+	}
+	c.Count++
+	c.Last = now
+}
+
+func (m *callerStats) snapshot() map[string][]*CallerStat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make(map[string][]*CallerStat, len(m.stats))
+	for method, callers := range m.stats {
+		list := make([]*CallerStat, 0, len(callers))
+		for _, c := range callers {
+			cp := *c
+			list = append(list, &cp)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Count > list[j].Count
+		})
+		res[method] = list
+	}
+	return res
+}
+
+// GetCallerStats return callers of each method since start, ordered by count
+func GetCallerStats() map[string][]*CallerStat {
+	return defaultCallerStats.snapshot()
+}
+
+// withCallerVersion 将当前服务版本写入 grpc metadata
+func withCallerVersion(ctx context.Context) context.Context {
+	v := serviceVersion()
+	if len(v) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, callerVersionMetaKey, v)
+}
+
+func grpcCallerVersion(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if vs := md.Get(callerVersionMetaKey); len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+func callerStatServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		defaultCallerStats.record(grpcMethodName(info.FullMethod), costCaller(ctx), grpcCallerVersion(ctx))
+		return handler(ctx, req)
+	}
+}
+
+func callerStatHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defaultCallerStats.record(r.URL.Path, costCaller(r.Context()), r.Header.Get(callerVersionHeaderKey))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ==============================
+type CallerReport struct {
+}
+
+func FactoryCallerReport() xhttp.HandleRequest {
+	return new(CallerReport)
+}
+
+func (m *CallerReport) Handle(r *xhttp.HttpRequest) xhttp.HttpResponse {
+	s, _ := json.Marshal(GetCallerStats())
+	return xhttp.NewHttpRespString(200, string(s))
+}
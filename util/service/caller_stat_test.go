@@ -0,0 +1,28 @@
+package rocserv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestCallerStats(t *testing.T) {
+	ass := assert.New(t)
+
+	m := &callerStats{stats: make(map[string]map[string]*CallerStat)}
+	m.record("GetUser", "account", "v1")
+	m.record("GetUser", "account", "v1")
+	m.record("GetUser", "order", "")
+
+	res := m.snapshot()
+	ass.Len(res["GetUser"], 2)
+	ass.Equal("account", res["GetUser"][0].Caller)
+	ass.Equal(int64(2), res["GetUser"][0].Count)
+	ass.Equal(unknownCostLabel, res["GetUser"][1].Version)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(callerVersionMetaKey, "abc"))
+	ass.Equal("abc", grpcCallerVersion(ctx))
+	ass.Equal("", grpcCallerVersion(context.Background()))
+}
@@ -0,0 +1,153 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xcontext"
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+const (
+	// DefaultCanaryGroup group label of canary instances when rule does not specify one
+	DefaultCanaryGroup = "canary"
+
+	// 规则不存在时 watch 会不断重试, 最大退避时间
+	canaryWatchBackoff = time.Second * 30
+)
+
+// CanaryRule traffic splitting rule of service, published to etcd and applied by clients without restart
+type CanaryRule struct {
+	// 灰度实例所在的分组, 为空时使用 DefaultCanaryGroup
+	Group string `json:"group"`
+	// 分到灰度分组的请求百分比, 0-100
+	Percent int `json:"percent"`
+	// 为 true 时按路由 key 分流, 同一个 key 总是落在同一侧
+	ByKey bool `json:"by_key"`
+}
+
+func (m *CanaryRule) group() string {
+	if len(m.Group) == 0 {
+		return DefaultCanaryGroup
+	}
+	return m.Group
+}
+
+func canaryPath(baseLoc, servLocation string) string {
+	return fmt.Sprintf("%s/%s/%s", baseLoc, BASE_LOC_CANARY, servLocation)
+}
+
+// PublishCanaryRule publish traffic splitting rule of servLocation, nil rule removes it
+func PublishCanaryRule(ctx context.Context, client etcd.KeysAPI, baseLoc, servLocation string, rule *CanaryRule) error {
+	path := canaryPath(baseLoc, servLocation)
+	if rule == nil {
+		_, err := client.Delete(ctx, path, nil)
+		if etcd.IsKeyNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if rule.Percent < 0 || rule.Percent > 100 {
+		return fmt.Errorf("canary percent out of range: %d", rule.Percent)
+	}
+	js, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	_, err = client.Set(ctx, path, string(js), nil)
+	return err
+}
+
+func (m *ClientEtcdV2) watchCanary() {
+	m.watch(canaryPath(m.confEtcd.useBaseloc, m.servKey), m.parseCanary, canaryWatchBackoff)
+}
+
+func (m *ClientEtcdV2) parseCanary(r *etcd.Response) {
+	fun := "ClientEtcdV2.parseCanary -->"
+	ctx := context.Background()
+
+	var rule *CanaryRule
+	if r.Node != nil && len(r.Node.Value) > 0 {
+		rule = &CanaryRule{}
+		if err := json.Unmarshal([]byte(r.Node.Value), rule); err != nil {
+			logger().Errorf(ctx, "%s servKey: %s json: %s err: %v", fun, m.servKey, r.Node.Value, err)
+			return
+		}
+	}
+	logger().Infof(ctx, "%s servKey: %s canary rule: %+v", fun, m.servKey, rule)
+	m.SetCanaryRule(rule)
+}
+
+// SetCanaryRule override traffic splitting rule locally until next update from etcd, nil disables it
+func (m *ClientEtcdV2) SetCanaryRule(rule *CanaryRule) {
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+	m.canary = rule
+}
+
+// GetCanaryRule return traffic splitting rule in use
+func (m *ClientEtcdV2) GetCanaryRule() *CanaryRule {
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+	return m.canary
+}
+
+// canaryGroup 请求未指定泳道时按规则分流到灰度分组, 灰度分组没有实例时不分流
+func (m *ClientEtcdV2) canaryGroup(group, key string) string {
+	if group != xcontext.DefaultGroup {
+		return group
+	}
+
+	m.muServlist.Lock()
+	rule := m.canary
+	if rule == nil || rule.Percent <= 0 {
+		m.muServlist.Unlock()
+		return group
+	}
+	canary := rule.group()
+	exists := false
+	for _, c := range m.servCopy {
+		if c != nil && c.containsLane(canary) {
+			exists = true
+			break
+		}
+	}
+	m.muServlist.Unlock()
+	if !exists {
+		return group
+	}
+
+	var n int
+	if rule.ByKey {
+		n = int(crc32.ChecksumIEEE([]byte(key)) % 100)
+	} else {
+		muRetryRand.Lock()
+		n = retryRand.Intn(100)
+		muRetryRand.Unlock()
+	}
+	if n >= rule.Percent {
+		return group
+	}
+
+	g, service := GetGroupAndService()
+	_metricCanaryRouted.With(xprom.LabelGroupName, g, xprom.LabelServiceName, service, xprom.LabelCalleeService, m.servKey, labelCanaryGroup, canary).Inc()
+	return canary
+}
+
+type canaryLookup interface {
+	canaryGroup(group, key string) string
+}
+
+// routeGroup 路由使用的泳道, 未指定泳道时应用灰度分流规则
+func routeGroup(ctx context.Context, cb ClientLookup, key string) string {
+	group := LaneFromContext(ctx)
+	if c, ok := cb.(canaryLookup); ok {
+		return c.canaryGroup(group, key)
+	}
+	return group
+}
@@ -0,0 +1,50 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanaryGroup(t *testing.T) {
+	ass := assert.New(t)
+
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.upServlist(servCopyCollect{
+		1: {servId: 1, reg: &RegData{}, manual: &ManualData{Ctrl: &ServCtrl{Groups: []string{""}}}},
+	})
+	ass.Equal("", cli.canaryGroup("", "k"))
+
+	// 灰度分组没有实例时不分流
+	cli.parseCanary(&etcd.Response{Node: &etcd.Node{Value: `{"percent":100}`}})
+	ass.Equal(100, cli.GetCanaryRule().Percent)
+	ass.Equal("", cli.canaryGroup("", "k"))
+
+	cli.upServlist(servCopyCollect{
+		1: {servId: 1, reg: &RegData{}, manual: &ManualData{Ctrl: &ServCtrl{Groups: []string{""}}}},
+		2: {servId: 2, reg: &RegData{}, manual: &ManualData{Ctrl: &ServCtrl{Groups: []string{DefaultCanaryGroup}}}},
+	})
+	ass.Equal(DefaultCanaryGroup, cli.canaryGroup("", "k"))
+	// 指定泳道的请求不分流
+	ass.Equal("lane1", cli.canaryGroup("lane1", "k"))
+	ass.Equal(DefaultCanaryGroup, routeGroup(context.Background(), cli, "k"))
+
+	cli.SetCanaryRule(&CanaryRule{Percent: 30, ByKey: true})
+	canary := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint(i)
+		g := cli.canaryGroup("", key)
+		ass.Equal(g, cli.canaryGroup("", key))
+		if g == DefaultCanaryGroup {
+			canary++
+		}
+	}
+	ass.InDelta(300, canary, 60)
+
+	cli.parseCanary(&etcd.Response{Node: &etcd.Node{}})
+	ass.Nil(cli.GetCanaryRule())
+	ass.Equal("", cli.canaryGroup("", "k"))
+}
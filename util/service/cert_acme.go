@@ -0,0 +1,160 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const defaultACMERenewBefore = 30 * 24 * time.Hour
+
+// ACMEConfig config of automatic certificate management,
+// DirectoryURL is empty means Let's Encrypt, or set it to an internal CA which supports ACME
+type ACMEConfig struct {
+	Domains      []string
+	Email        string
+	DirectoryURL string
+	// 证书缓存目录, 为空时使用 etcd 存储证书, 多个实例之间共享
+	CacheDir string
+	// KeyRing 配置中心中 key ring 的名字, 使用 etcd 存储时必填, 账号私钥及证书加密后写入
+	KeyRing     string
+	RenewBefore time.Duration
+}
+
+// ACMECertManager obtain and renew certificates for configured domains
+type ACMECertManager struct {
+	manager *autocert.Manager
+	// 停止 etcd 证书缓存的 key ring 监听
+	cancel context.CancelFunc
+}
+
+// NewACMECertManager create acme cert manager, cache can be nil and will be decided by config
+func NewACMECertManager(cfg *ACMEConfig, cache autocert.Cache) (*ACMECertManager, error) {
+	fun := "NewACMECertManager -->"
+	ctx := context.Background()
+
+	if cfg == nil || len(cfg.Domains) == 0 {
+		return nil, fmt.Errorf("acme domains empty")
+	}
+
+	cancel := func() {}
+	if cache == nil {
+		if len(cfg.CacheDir) > 0 {
+			cache = autocert.DirCache(cfg.CacheDir)
+		} else {
+			sb, ok := GetServBase().(*ServBaseV2)
+			if !ok || sb == nil {
+				return nil, fmt.Errorf("acme cache dir empty and servbase not init")
+			}
+			// 私钥不明文写入 etcd
+			if len(cfg.KeyRing) == 0 {
+				return nil, fmt.Errorf("acme cache dir empty and key ring not set")
+			}
+			ring, err := LoadKeyRing(ctx, cfg.KeyRing)
+			if err != nil {
+				return nil, err
+			}
+			var watchCtx context.Context
+			watchCtx, cancel = context.WithCancel(context.Background())
+			go ring.Watch(watchCtx, 0)
+			cache = newEtcdCertCache(sb.etcdClient, sb.confEtcd.useBaseloc, sb.servLocation, ring)
+		}
+	}
+
+	renewBefore := cfg.RenewBefore
+	if renewBefore <= 0 {
+		renewBefore = defaultACMERenewBefore
+	}
+
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       cache,
+		HostPolicy:  autocert.HostWhitelist(cfg.Domains...),
+		RenewBefore: renewBefore,
+		Email:       cfg.Email,
+	}
+	if len(cfg.DirectoryURL) > 0 {
+		m.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+
+	logger().Infof(ctx, "%s domains: %v, directory: %s, cache dir: %s", fun, cfg.Domains, cfg.DirectoryURL, cfg.CacheDir)
+	return &ACMECertManager{manager: m, cancel: cancel}, nil
+}
+
+// Close stop watching key ring of the etcd cert cache, VirtualHostServer closes it when the processor stops
+func (m *ACMECertManager) Close() {
+	m.cancel()
+}
+
+// GetCertificate used by tls.Config, certificates are obtained on first handshake and renewed in background
+func (m *ACMECertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.manager.GetCertificate(hello)
+}
+
+// HTTPHandler handle http-01 challenge on port 80, other requests are passed to fallback
+func (m *ACMECertManager) HTTPHandler(fallback http.Handler) http.Handler {
+	return m.manager.HTTPHandler(fallback)
+}
+
+// TLSConfig tls config supports tls-alpn-01 challenge
+func (m *ACMECertManager) TLSConfig() *tls.Config {
+	return m.manager.TLSConfig()
+}
+
+// etcdCertCache store acme account key and certificates in etcd encrypted by key ring, shared by all copies of the service
+type etcdCertCache struct {
+	client etcd.KeysAPI
+	path   string
+	ring   *KeyRing
+}
+
+func newEtcdCertCache(client etcd.KeysAPI, baseLoc, servLoc string, ring *KeyRing) *etcdCertCache {
+	return &etcdCertCache{
+		client: client,
+		path:   fmt.Sprintf("%s/%s/%s", baseLoc, BASE_LOC_CERT, servLoc),
+		ring:   ring,
+	}
+}
+
+func (m *etcdCertCache) Get(ctx context.Context, key string) ([]byte, error) {
+	r, err := m.client.Get(ctx, m.path+"/"+key, nil)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, autocert.ErrCacheMiss
+		}
+		return nil, err
+	}
+	if r.Node == nil || r.Node.Dir {
+		return nil, autocert.ErrCacheMiss
+	}
+	data, err := m.ring.Decrypt(r.Node.Value)
+	if err != nil {
+		// 无法解密的按不存在处理, 重新申请后覆盖
+		logger().Warnf(ctx, "etcdCertCache.Get --> key: %s decrypt err: %v", key, err)
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, nil
+}
+
+func (m *etcdCertCache) Put(ctx context.Context, key string, data []byte) error {
+	text, err := m.ring.Encrypt(data)
+	if err != nil {
+		return err
+	}
+	_, err = m.client.Set(ctx, m.path+"/"+key, text, nil)
+	return err
+}
+
+func (m *etcdCertCache) Delete(ctx context.Context, key string) error {
+	_, err := m.client.Delete(ctx, m.path+"/"+key, nil)
+	if err != nil && etcd.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrClientNotReady instances of callee are not loaded from registry yet
+var ErrClientNotReady = errors.New("client lookup not ready")
+
+// ClientLookupOptions options of NewClientLookupWithOptions, zero value is the same as NewClientLookup
+type ClientLookupOptions struct {
+	// 大于 0 时阻塞到首次从注册中心拿到实例列表, 最多等待该时长
+	BootstrapTimeout time.Duration
+	// 等待超时时返回 ErrClientNotReady; 否则仍返回 client, 调用方通过 Ready 检查
+	RequireReady bool
+}
+
+// NewClientLookupWithOptions same as NewClientLookup, and optionally block until the first instance list is loaded
+func NewClientLookupWithOptions(etcdaddrs []string, baseLoc string, servlocation string, opts *ClientLookupOptions) (*ClientEtcdV2, error) {
+	fun := "NewClientLookupWithOptions -->"
+
+	cli, err := NewClientLookup(etcdaddrs, baseLoc, servlocation)
+	if err != nil || opts == nil || opts.BootstrapTimeout <= 0 {
+		return cli, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opts.BootstrapTimeout)
+	defer cancel()
+	if err := cli.WaitReady(ctx); err != nil {
+		if opts.RequireReady {
+			return nil, err
+		}
+		logger().Warnf(ctx, "%s serv: %s not ready after %v, stale: %v", fun, servlocation, opts.BootstrapTimeout, cli.IsStale())
+	}
+	return cli, nil
+}
+
+func (m *ClientEtcdV2) readyChan() chan struct{} {
+	m.muReady.Lock()
+	defer m.muReady.Unlock()
+	if m.ready == nil {
+		m.ready = make(chan struct{})
+	}
+	return m.ready
+}
+
+func (m *ClientEtcdV2) markReady() {
+	ch := m.readyChan()
+	m.muReady.Lock()
+	defer m.muReady.Unlock()
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
+
+// Ready whether instances are loaded from registry, false when only local snapshot is used
+func (m *ClientEtcdV2) Ready() bool {
+	select {
+	case <-m.readyChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitReady block until instances are loaded from registry, return ErrClientNotReady when ctx is done first
+func (m *ClientEtcdV2) WaitReady(ctx context.Context) error {
+	// ctx 已结束时仍以就绪为准
+	if m.Ready() {
+		return nil
+	}
+	select {
+	case <-m.readyChan():
+		return nil
+	case <-ctx.Done():
+		return ErrClientNotReady
+	}
+}
@@ -0,0 +1,46 @@
+package rocserv
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientReady(t *testing.T) {
+	ass := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "roc_bootstrap")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+	os.Setenv(registrySnapshotDirEnv, dir)
+	defer os.Unsetenv(registrySnapshotDirEnv)
+	path := registrySnapshotPath("base/account")
+	saved := &ClientEtcdV2{servKey: "base/account", servPath: "/roc/dist2/base/account", snapshotPath: path}
+	saved.upServlist(servCopyCollect{1: zoneServCopy(1, "a", 100)})
+	ass.True(saved.Ready())
+
+	cli := &ClientEtcdV2{servKey: "base/account", servPath: "/roc/dist2/base/account", snapshotPath: path}
+	ass.False(cli.Ready())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ass.Equal(ErrClientNotReady, cli.WaitReady(ctx))
+
+	// 本地快照可以路由, 但不算就绪
+	cli.loadSnapshot()
+	ass.True(cli.IsStale())
+	ass.Len(cli.GetAllServAddr("proc_grpc"), 1)
+	ass.False(cli.Ready())
+
+	waited := make(chan error, 1)
+	go func() { waited <- cli.WaitReady(context.Background()) }()
+	cli.upServlist(servCopyCollect{})
+	ass.Nil(<-waited)
+	ass.True(cli.Ready())
+	// 之后的更新不再关闭
+	cli.upServlist(servCopyCollect{2: zoneServCopy(2, "a", 100)})
+	ass.Nil(cli.WaitReady(ctx))
+}
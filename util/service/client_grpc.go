@@ -4,16 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xcontext"
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xtrace"
 	otgrpc "gitlab.pri.ibanyu.com/tracing/go-grpc"
 
 	"github.com/uber/jaeger-client-go"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 type ServProtocol int
@@ -32,9 +33,14 @@ type ClientGrpc struct {
 	processor    string
 	breaker      *Breaker
 	router       Router
+	// stream 长期占用实例, 按进行中的 stream 数选择实例
+	streamRouter *Concurrent
 
+	muPool    sync.RWMutex
 	pool      *ClientPool
 	fnFactory func(conn *grpc.ClientConn) interface{}
+	// 限制同时进行中的镜像请求
+	shadowSem chan struct{}
 }
 
 type Provider struct {
@@ -49,7 +55,9 @@ func NewClientGrpcWithRouterType(cb ClientLookup, processor string, capacity int
 		processor:    processor,
 		breaker:      NewBreaker(cb),
 		router:       NewRouter(routerType, cb),
+		streamRouter: NewConcurrent(cb),
 		fnFactory:    fn,
+		shadowSem:    make(chan struct{}, shadowMaxInFlight),
 	}
 	// 目前为写死值，后期改为动态配置获取的方式
 	pool := NewClientPool(defaultMaxIdle, defaultMaxActive, clientGrpc.newConn, cb.ServKey())
@@ -58,6 +66,23 @@ func NewClientGrpcWithRouterType(cb ClientLookup, processor string, capacity int
 	return clientGrpc
 }
 
+// SetPoolOptions replace connection pool with options, should be called before the first rpc;
+// the old pool is not closed, since connections in use will be put back into it
+func (m *ClientGrpc) SetPoolOptions(opts *ClientPoolOptions) {
+	pool := NewClientPoolWithOptions(opts, m.newConn, m.clientLookup.ServKey())
+	m.muPool.Lock()
+	old := m.pool
+	m.pool = pool
+	m.muPool.Unlock()
+	old.stopProbe()
+}
+
+func (m *ClientGrpc) getPool() *ClientPool {
+	m.muPool.RLock()
+	defer m.muPool.RUnlock()
+	return m.pool
+}
+
 func NewClientGrpcByConcurrentRouter(cb ClientLookup, processor string, capacity int, fn func(client *grpc.ClientConn) interface{}) *ClientGrpc {
 	return NewClientGrpcWithRouterType(cb, processor, capacity, fn, 1)
 }
@@ -94,8 +119,11 @@ func (m *ClientGrpc) DirectRouteRpc(provider *Provider, fnrpc func(interface{})
 
 	funcName := GetFuncName(3)
 	var err error
+	done := startClientRPC(m.clientLookup.ServKey(), m.processor, funcName)
 	st := xtime.NewTimeStat()
 	defer func() {
+		done(err)
+		noticeDeprecatedCall(m.clientLookup, funcName)
 		collector(m.clientLookup.ServKey(), m.processor, st.Duration(), 0, si.Servid, funcName, err)
 	}()
 	err = m.breaker.Do(context.Background(), funcName, call, m.GetFallbackFunc(funcName))
@@ -118,7 +146,7 @@ func (m *ClientGrpc) getClient(provider *Provider) (*ServInfo, rpcClientConn, er
 	if serv == nil {
 		return nil, nil, errors.New(m.processor + " server provider is emtpy ")
 	}
-	conn, err := m.pool.Get(context.Background(), serv.Addr)
+	conn, err := m.getPool().Get(context.Background(), serv.Addr)
 	return serv, conn, err
 }
 
@@ -128,22 +156,21 @@ func (m *ClientGrpc) Rpc(hashKey string, fnrpc func(interface{}) error) error {
 }
 
 func (m *ClientGrpc) RpcWithContext(ctx context.Context, hashKey string, fnrpc func(interface{}) error) error {
-	var err error
 	funcName := GetFuncName(3)
 	if funcName == "grpcInvoke" {
 		funcName = GetFuncName(4)
 	}
-	retry := GetFuncRetry(m.clientLookup.ServKey(), funcName)
-	for ; retry >= 0; retry-- {
-		err = m.do(ctx, hashKey, funcName, fnrpc)
-		if err == nil {
-			return nil
-		}
-	}
-	return err
+	policy := GetRetryPolicy(m.clientLookup.ServKey(), funcName)
+	ctx = withRetryAffinity(ctx, m.clientLookup.ServKey(), funcName)
+	return policy.Do(ctx, func() error {
+		return m.do(ctx, hashKey, funcName, fnrpc)
+	})
 }
 
 func (m *ClientGrpc) do(ctx context.Context, hashKey, funcName string, fnrpc func(interface{}) error) error {
+	if err := checkFastFail(m.clientLookup, m.processor); err != nil {
+		return err
+	}
 	si, rc := m.route(ctx, hashKey)
 	if rc == nil {
 		return fmt.Errorf("not find grpc service:%s processor:%s", m.clientLookup.ServPath(), m.processor)
@@ -157,36 +184,47 @@ func (m *ClientGrpc) do(ctx context.Context, hashKey, funcName string, fnrpc fun
 	}
 
 	var err error
+	done := startClientRPC(m.clientLookup.ServKey(), m.processor, funcName)
 	st := xtime.NewTimeStat()
 	defer func() {
+		done(err)
 		dur := st.Duration()
+		noticeDeprecatedCall(m.clientLookup, funcName)
 		collector(m.clientLookup.ServKey(), m.processor, dur, 0, si.Servid, funcName, err)
 		collectAPM(ctx, m.clientLookup.ServKey(), funcName, si.Servid, dur, err)
+		addCostDownstream(ctx, dur)
+		addStatDownstream(ctx, m.clientLookup.ServKey(), funcName, dur)
 	}()
 	err = m.breaker.Do(ctx, funcName, call, m.GetFallbackFunc(funcName))
 	return err
 }
 
 func (m *ClientGrpc) RpcWithContextV2(ctx context.Context, hashKey string, fnrpc func(context.Context, interface{}) error) error {
-	var err error
 	funcName := GetFuncNameWithCtx(ctx, 3)
-	retry := GetFuncRetry(m.clientLookup.ServKey(), funcName)
-	for ; retry >= 0; retry-- {
-		err = m.doWithContext(ctx, hashKey, funcName, fnrpc)
-		if err == nil {
-			return nil
-		}
-	}
-	return err
+	policy := GetRetryPolicy(m.clientLookup.ServKey(), funcName)
+	ctx = withRetryAffinity(ctx, m.clientLookup.ServKey(), funcName)
+	return policy.Do(ctx, func() error {
+		return m.doWithContext(ctx, hashKey, funcName, fnrpc)
+	})
 }
 
 func (m *ClientGrpc) doWithContext(ctx context.Context, hashKey, funcName string, fnrpc func(context.Context, interface{}) error) error {
+	if err := checkFastFail(m.clientLookup, m.processor); err != nil {
+		return err
+	}
 	si, rc := m.route(ctx, hashKey)
 	if rc == nil {
 		return fmt.Errorf("not find grpc service:%s processor:%s", m.clientLookup.ServPath(), m.processor)
 	}
 
 	ctx = m.injectServInfo(ctx, si)
+	ctx = withOutgoingAuthToken(ctx, m.clientLookup.ServKey())
+	// grpc 不使用静态超时配置, 只在开启超时推算时设置
+	if d, ok := inferTimeout(m.clientLookup.ServKey(), funcName, getStaticFuncTimeout(m.clientLookup.ServKey(), funcName, 0)); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
 
 	m.router.Pre(si)
 	defer m.router.Post(si)
@@ -196,11 +234,16 @@ func (m *ClientGrpc) doWithContext(ctx context.Context, hashKey, funcName string
 	}
 
 	var err error
+	done := startClientRPC(m.clientLookup.ServKey(), m.processor, funcName)
 	st := xtime.NewTimeStat()
 	defer func() {
+		done(err)
 		dur := st.Duration()
+		noticeDeprecatedCall(m.clientLookup, funcName)
 		collector(m.clientLookup.ServKey(), m.processor, dur, 0, si.Servid, funcName, err)
 		collectAPM(ctx, m.clientLookup.ServKey(), funcName, si.Servid, dur, err)
+		addCostDownstream(ctx, dur)
+		addStatDownstream(ctx, m.clientLookup.ServKey(), funcName, dur)
 	}()
 	err = m.breaker.Do(ctx, funcName, call, m.GetFallbackFunc(funcName))
 	return err
@@ -209,24 +252,26 @@ func (m *ClientGrpc) doWithContext(ctx context.Context, hashKey, funcName string
 func (m *ClientGrpc) rpc(si *ServInfo, rc rpcClientConn, fnrpc func(interface{}) error) error {
 	c := rc.GetServiceClient()
 	err := fnrpc(c)
-	m.pool.Put(si.Addr, rc, err)
+	m.getPool().Put(si.Addr, rc, err)
+	reportInstance(m.clientLookup, si, err)
 	return err
 }
 
 func (m *ClientGrpc) rpcWithContext(ctx context.Context, si *ServInfo, rc rpcClientConn, fnrpc func(context.Context, interface{}) error) error {
 	c := rc.GetServiceClient()
 	err := fnrpc(ctx, c)
-	m.pool.Put(si.Addr, rc, err)
+	m.getPool().Put(si.Addr, rc, err)
+	reportInstance(m.clientLookup, si, err)
 	return err
 }
 
 func (m *ClientGrpc) route(ctx context.Context, key string) (*ServInfo, rpcClientConn) {
-	s := m.router.Route(ctx, m.processor, key)
+	s := affinityRoute(ctx, m.router, m.clientLookup, m.processor, key)
 	if s == nil {
 		return nil, nil
 	}
 	addr := s.Addr
-	conn, _ := m.pool.Get(ctx, addr)
+	conn, _ := m.getPool().Get(ctx, addr)
 	return s, conn
 }
 
@@ -240,6 +285,7 @@ func (m *ClientGrpc) injectServInfo(ctx context.Context, si *ServInfo) context.C
 	if err != nil {
 		return ctx
 	}
+	ctx = withCallerVersion(ctx)
 
 	span := xtrace.SpanFromContext(ctx)
 	if span == nil {
@@ -288,17 +334,30 @@ func (m *grpcClientConn) GetServiceClient() interface{} {
 func (m *ClientGrpc) newConn(addr string) (rpcClientConn, error) {
 	fun := "ClientGrpc.newConn-->"
 
+	// 实例注册时声明开启 TLS 时使用 TLS 连接
+	security := grpc.WithInsecure()
+	if dialTLS(m.clientLookup, addr) {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(getClientTLSConfig(m.clientLookup.ServKey())))
+	}
 	// 可加入多种拦截器
 	opts := []grpc.DialOption{
-		grpc.WithInsecure(),
-		grpc.WithUnaryInterceptor(
-			otgrpc.OpenTracingClientInterceptorWithGlobalTracer()),
-		grpc.WithStreamInterceptor(
-			otgrpc.OpenTracingStreamClientInterceptorWithGlobalTracer()),
+		security,
+		grpc.WithChainUnaryInterceptor(
+			m.shadowClientInterceptor(),
+			otgrpc.OpenTracingClientInterceptorWithGlobalTracer(),
+			otelClientInterceptor(),
+			baggageClientInterceptor(),
+			idempotencyClientInterceptor(),
+			payloadLogClientInterceptor()),
+		grpc.WithChainStreamInterceptor(
+			streamTrackClientInterceptor(),
+			otgrpc.OpenTracingStreamClientInterceptorWithGlobalTracer(),
+			otelStreamClientInterceptor(),
+			baggageStreamClientInterceptor()),
 	}
 	conn, err := grpc.Dial(addr, opts...)
 	if err != nil {
-		xlog.Errorf(context.Background(), "%s dial addr: %s failed, err: %v", fun, addr, err)
+		logger().Errorf(context.Background(), "%s dial addr: %s failed, err: %v", fun, addr, err)
 		return nil, err
 	}
 	client := m.fnFactory(conn)
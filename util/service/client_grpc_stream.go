@@ -0,0 +1,229 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// stream 保持超过该时间后断开, 重连时重置退避
+const streamReconnectResetAfter = 10 * time.Second
+
+type grpcStreamKey struct{}
+
+// grpcStreamTracker 通过 ClientGrpc 打开的一个 stream, 结束时归还连接并统计
+type grpcStreamTracker struct {
+	servKey   string
+	processor string
+	onFinish  func(err error)
+
+	once sync.Once
+	done chan struct{}
+
+	mu     sync.Mutex
+	labels []string
+}
+
+// start 由拦截器在 stream 建立后调用, api 取 grpc 方法名
+func (m *grpcStreamTracker) start(method string) {
+	if i := strings.LastIndex(method, "/"); i >= 0 {
+		method = method[i+1:]
+	}
+	group, service := GetGroupAndService()
+	labels := []string{xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, m.processor, xprom.LabelCalleeService, m.servKey, xprom.LabelAPI, method}
+	_metricRPCClientStreams.With(labels...).Add(1)
+
+	m.mu.Lock()
+	m.labels = labels
+	m.mu.Unlock()
+}
+
+func (m *grpcStreamTracker) msg(direction string) {
+	m.mu.Lock()
+	labels := m.labels
+	m.mu.Unlock()
+	if labels != nil {
+		_metricRPCClientStreamMsgs.With(append(labels, labelDirection, direction)...).Inc()
+	}
+}
+
+func (m *grpcStreamTracker) finish(err error) {
+	m.once.Do(func() {
+		close(m.done)
+		m.mu.Lock()
+		labels := m.labels
+		m.mu.Unlock()
+		if labels != nil {
+			_metricRPCClientStreams.With(labels...).Add(-1)
+			_metricRPCClientStreamHandled.With(append(labels, labelCode, rpcErrorCode(err))...).Inc()
+		}
+		m.onFinish(err)
+	})
+}
+
+// streamTrackClientInterceptor 只包装 ClientGrpc 打开的 stream, 用于判断 stream 结束
+func streamTrackClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		t, ok := ctx.Value(grpcStreamKey{}).(*grpcStreamTracker)
+		if !ok || err != nil {
+			return cs, err
+		}
+		t.start(method)
+		return &trackedClientStream{ClientStream: cs, tracker: t, serverStreams: desc.ServerStreams}, nil
+	}
+}
+
+// trackedClientStream RecvMsg 出错, 或者非 server streaming 收到响应时 stream 结束
+type trackedClientStream struct {
+	grpc.ClientStream
+	tracker       *grpcStreamTracker
+	serverStreams bool
+}
+
+func (m *trackedClientStream) SendMsg(msg interface{}) error {
+	err := m.ClientStream.SendMsg(msg)
+	if err == nil {
+		m.tracker.msg("sent")
+	}
+	// 发送失败的原因由 RecvMsg 返回
+	return err
+}
+
+func (m *trackedClientStream) RecvMsg(msg interface{}) error {
+	err := m.ClientStream.RecvMsg(msg)
+	switch {
+	case err == nil:
+		m.tracker.msg("received")
+		if !m.serverStreams {
+			m.tracker.finish(nil)
+		}
+	case err == io.EOF:
+		m.tracker.finish(nil)
+	default:
+		m.tracker.finish(err)
+	}
+	return err
+}
+
+// isClientCanceled 调用方主动取消, 连接及实例是正常的
+func isClientCanceled(err error) bool {
+	return err == context.Canceled || status.Code(err) == codes.Canceled
+}
+
+// StreamWithContext open a server streaming, client streaming or bidi stream on the instance with least active
+// streams, fnstream creates the stream with service client, such as c.(pb.XClient).Watch(ctx, req);
+// the connection is held until RecvMsg returns an error, a non server streaming call receives its response
+// or ctx is done, so cancel ctx to abandon a stream
+func (m *ClientGrpc) StreamWithContext(ctx context.Context, hashKey string, fnstream func(ctx context.Context, client interface{}) (grpc.ClientStream, error)) (grpc.ClientStream, error) {
+	return m.openStream(ctx, hashKey, GetFuncName(2), fnstream)
+}
+
+func (m *ClientGrpc) openStream(ctx context.Context, hashKey, funcName string, fnstream func(context.Context, interface{}) (grpc.ClientStream, error)) (grpc.ClientStream, error) {
+	if err := checkFastFail(m.clientLookup, m.processor); err != nil {
+		return nil, err
+	}
+	si := m.streamRouter.Route(ctx, m.processor, hashKey)
+	if si == nil {
+		return nil, fmt.Errorf("not find grpc service:%s processor:%s", m.clientLookup.ServPath(), m.processor)
+	}
+	rc, err := m.getPool().Get(ctx, si.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = m.injectServInfo(ctx, si)
+	ctx = withOutgoingAuthToken(ctx, m.clientLookup.ServKey())
+
+	m.streamRouter.Pre(si)
+	t := &grpcStreamTracker{
+		servKey:   m.clientLookup.ServKey(),
+		processor: m.processor,
+		done:      make(chan struct{}),
+	}
+	t.onFinish = func(err error) {
+		m.streamRouter.Post(si)
+		if isClientCanceled(err) {
+			err = nil
+		}
+		m.getPool().Put(si.Addr, rc, err)
+		reportInstance(m.clientLookup, si, err)
+	}
+	ctx = context.WithValue(ctx, grpcStreamKey{}, t)
+
+	var cs grpc.ClientStream
+	open := func(ctx context.Context) error {
+		var err error
+		cs, err = fnstream(ctx, rc.GetServiceClient())
+		return err
+	}
+	err = m.breaker.Do(ctx, funcName, open, nil)
+	if err == nil && cs == nil {
+		err = fmt.Errorf("grpc stream %s of service:%s not opened", funcName, m.clientLookup.ServKey())
+	}
+	if err != nil {
+		t.finish(err)
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			t.finish(ctx.Err())
+		case <-t.done:
+		}
+	}()
+	return cs, nil
+}
+
+// streamRetryable 请求本身错误时不重连
+func streamRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound, codes.AlreadyExists, codes.PermissionDenied,
+		codes.Unauthenticated, codes.Unimplemented, codes.FailedPrecondition, codes.OutOfRange:
+		return false
+	}
+	return true
+}
+
+// StreamWithReconnect keep a stream until ctx is done, open creates the stream like StreamWithContext and
+// recv reads it until it ends; the stream is opened again with backoff, possibly on another instance,
+// unless recv returns an error of the request itself such as InvalidArgument, so open should resume from
+// the last received position
+func (m *ClientGrpc) StreamWithReconnect(ctx context.Context, hashKey string, open func(ctx context.Context, client interface{}) (grpc.ClientStream, error), recv func(stream grpc.ClientStream) error) error {
+	fun := "ClientGrpc.StreamWithReconnect -->"
+
+	funcName := GetFuncName(2)
+	backoff := xtime.NewBackOffCtrl(time.Millisecond*100, time.Second*5)
+	for {
+		st := time.Now()
+		sctx, cancel := context.WithCancel(ctx)
+		stream, err := m.openStream(sctx, hashKey, funcName, open)
+		if err == nil {
+			err = recv(stream)
+		}
+		cancel()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !streamRetryable(err) {
+			return err
+		}
+		logger().Warnf(ctx, "%s service: %s stream: %s reconnect, err: %v", fun, m.clientLookup.ServKey(), funcName, err)
+		if time.Since(st) >= streamReconnectResetAfter {
+			backoff.Reset()
+		}
+		backoff.BackOff()
+	}
+}
@@ -0,0 +1,88 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeClientStream RecvMsg 依次返回 recvs 中的错误
+type fakeClientStream struct {
+	grpc.ClientStream
+	recvs []error
+}
+
+func (m *fakeClientStream) SendMsg(msg interface{}) error { return nil }
+
+func (m *fakeClientStream) RecvMsg(msg interface{}) error {
+	err := m.recvs[0]
+	m.recvs = m.recvs[1:]
+	return err
+}
+
+func newTestStreamTracker(finished *[]error) *grpcStreamTracker {
+	t := &grpcStreamTracker{servKey: "base/account", processor: "proc_grpc", done: make(chan struct{})}
+	t.onFinish = func(err error) { *finished = append(*finished, err) }
+	t.start("/account.Account/Watch")
+	return t
+}
+
+func TestTrackedClientStream(t *testing.T) {
+	ass := assert.New(t)
+
+	// server streaming 在 RecvMsg 返回 EOF 时结束
+	var finished []error
+	tracker := newTestStreamTracker(&finished)
+	cs := &trackedClientStream{ClientStream: &fakeClientStream{recvs: []error{nil, nil, io.EOF, io.EOF}}, tracker: tracker, serverStreams: true}
+	ass.Nil(cs.SendMsg(nil))
+	ass.Nil(cs.RecvMsg(nil))
+	ass.Nil(cs.RecvMsg(nil))
+	ass.Len(finished, 0)
+	ass.Equal(io.EOF, cs.RecvMsg(nil))
+	ass.Equal(io.EOF, cs.RecvMsg(nil))
+	ass.Equal([]error{nil}, finished)
+	select {
+	case <-tracker.done:
+	default:
+		t.Fatal("tracker not done")
+	}
+
+	// client streaming 收到响应即结束
+	finished = nil
+	cs = &trackedClientStream{ClientStream: &fakeClientStream{recvs: []error{nil}}, tracker: newTestStreamTracker(&finished)}
+	ass.Nil(cs.SendMsg(nil))
+	ass.Nil(cs.RecvMsg(nil))
+	ass.Equal([]error{nil}, finished)
+
+	finished = nil
+	errUnavailable := status.Error(codes.Unavailable, "transport is closing")
+	tracker = newTestStreamTracker(&finished)
+	cs = &trackedClientStream{ClientStream: &fakeClientStream{recvs: []error{errUnavailable}}, tracker: tracker, serverStreams: true}
+	ass.Equal(errUnavailable, cs.RecvMsg(nil))
+	// ctx 结束与 RecvMsg 同时发生时只结束一次
+	tracker.finish(context.Canceled)
+	ass.Equal([]error{errUnavailable}, finished)
+}
+
+func TestStreamRetryable(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.True(streamRetryable(nil))
+	ass.True(streamRetryable(io.EOF))
+	ass.True(streamRetryable(errors.New("conn reset")))
+	ass.True(streamRetryable(status.Error(codes.Unavailable, "")))
+	ass.True(streamRetryable(status.Error(codes.DeadlineExceeded, "")))
+	ass.False(streamRetryable(status.Error(codes.InvalidArgument, "")))
+	ass.False(streamRetryable(status.Error(codes.Unimplemented, "")))
+	ass.False(streamRetryable(status.Error(codes.PermissionDenied, "")))
+
+	ass.True(isClientCanceled(context.Canceled))
+	ass.True(isClientCanceled(status.Error(codes.Canceled, "")))
+	ass.False(isClientCanceled(context.DeadlineExceeded))
+}
@@ -40,21 +40,19 @@ func NewClientWrapperWithRouterType(cb ClientLookup, processor string, routerTyp
 }
 
 func (m *ClientWrapper) Do(hashKey string, timeout time.Duration, run func(addr string, timeout time.Duration) error) error {
-	var err error
 	funcName := GetFuncName(3)
-	retry := GetFuncRetry(m.clientLookup.ServKey(), funcName)
+	policy := GetRetryPolicy(m.clientLookup.ServKey(), funcName)
 	timeout = GetFuncTimeout(m.clientLookup.ServKey(), funcName, timeout)
-	for ; retry >= 0; retry-- {
-		err = m.do(hashKey, funcName, timeout, run)
-		if err == nil {
-			return nil
-		}
-	}
-	return err
+	return policy.Do(context.Background(), func() error {
+		return m.do(hashKey, funcName, timeout, run)
+	})
 }
 
 func (m *ClientWrapper) do(hashKey, funcName string, timeout time.Duration, run func(addr string, timeout time.Duration) error) error {
 	fun := "ClientWrapper.Do -->"
+	if err := checkFastFail(m.clientLookup, m.processor); err != nil {
+		return err
+	}
 	si := m.router.Route(context.TODO(), m.processor, hashKey)
 	if si == nil {
 		return fmt.Errorf("%s not find service:%s processor:%s", fun, m.clientLookup.ServPath(), m.processor)
@@ -63,12 +61,17 @@ func (m *ClientWrapper) do(hashKey, funcName string, timeout time.Duration, run
 	defer m.router.Post(si)
 
 	call := func(_ctx context.Context) error {
-		return run(si.Addr, timeout)
+		err := run(si.Addr, timeout)
+		reportInstance(m.clientLookup, si, err)
+		return err
 	}
 
 	var err error
+	done := startClientRPC(m.clientLookup.ServKey(), m.processor, funcName)
 	st := xtime.NewTimeStat()
 	defer func() {
+		done(err)
+		noticeDeprecatedCall(m.clientLookup, funcName)
 		collector(m.clientLookup.ServKey(), m.processor, st.Duration(), 0, si.Servid, funcName, err)
 	}()
 	err = m.breaker.Do(context.Background(), funcName, call, m.GetFallbackFunc(funcName))
@@ -78,6 +81,9 @@ func (m *ClientWrapper) do(hashKey, funcName string, timeout time.Duration, run
 func (m *ClientWrapper) Call(ctx context.Context, hashKey, funcName string, run func(addr string) error) error {
 	fun := "ClientWrapper.Call -->"
 
+	if err := checkFastFail(m.clientLookup, m.processor); err != nil {
+		return err
+	}
 	si := m.router.Route(ctx, m.processor, hashKey)
 	if si == nil {
 		return fmt.Errorf("%s not find service:%s processor:%s", fun, m.clientLookup.ServPath(), m.processor)
@@ -86,12 +92,17 @@ func (m *ClientWrapper) Call(ctx context.Context, hashKey, funcName string, run
 	defer m.router.Post(si)
 
 	call := func(_ctx context.Context) error {
-		return run(si.Addr)
+		err := run(si.Addr)
+		reportInstance(m.clientLookup, si, err)
+		return err
 	}
 
 	var err error
+	done := startClientRPC(m.clientLookup.ServKey(), m.processor, funcName)
 	st := xtime.NewTimeStat()
 	defer func() {
+		done(err)
+		noticeDeprecatedCall(m.clientLookup, funcName)
 		collector(m.clientLookup.ServKey(), m.processor, st.Duration(), 0, si.Servid, funcName, err)
 	}()
 	err = m.breaker.Do(ctx, funcName, call, m.GetFallbackFunc(funcName))
@@ -2,18 +2,29 @@ package rocserv
 
 import (
 	"context"
+	"net"
 	"sync"
 	"time"
-
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 )
 
 const (
 	defaultMaxIdle     = 256 // 连接池里的最大连接数,超过的连接会被关闭
 	defaultMaxActive   = 512 // 最大可建立连接数
 	defaultIdleTimeout = time.Second * 120
+
+	defaultProbeTimeout = time.Second * 1
 )
 
+// ClientPoolOptions options of connection pools of one client, zero value means default
+type ClientPoolOptions struct {
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+	// 大于 0 时定期探测各地址是否可以建立连接, 探测失败时关闭该地址的空闲连接; 默认不探测
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+}
+
 // ClientPool every addr has a connection pool, each backend server has more than one addr, in client side, it's ClientPool
 type ClientPool struct {
 	calleeServiceKey string
@@ -23,11 +34,42 @@ type ClientPool struct {
 	idleTimeout      time.Duration
 	clientPool       sync.Map
 	rpcFactory       func(addr string) (rpcClientConn, error)
+
+	probeTimeout time.Duration
+	closed       chan struct{}
+	closeOnce    sync.Once
 }
 
 // NewClientPool constructor of pool, 如果连接数过低，修正为默认值
 func NewClientPool(idle, active int, rpcFactory func(addr string) (rpcClientConn, error), calleeServiceKey string) *ClientPool {
-	return &ClientPool{idle: idle, active: active, rpcFactory: rpcFactory, calleeServiceKey: calleeServiceKey, idleTimeout: defaultIdleTimeout}
+	return NewClientPoolWithOptions(&ClientPoolOptions{MaxIdle: idle, MaxActive: active}, rpcFactory, calleeServiceKey)
+}
+
+// NewClientPoolWithOptions constructor of pool with options
+func NewClientPoolWithOptions(opts *ClientPoolOptions, rpcFactory func(addr string) (rpcClientConn, error), calleeServiceKey string) *ClientPool {
+	if opts == nil {
+		opts = &ClientPoolOptions{}
+	}
+	m := &ClientPool{
+		idle:             opts.MaxIdle,
+		active:           opts.MaxActive,
+		idleTimeout:      opts.IdleTimeout,
+		rpcFactory:       rpcFactory,
+		calleeServiceKey: calleeServiceKey,
+		probeTimeout:     opts.ProbeTimeout,
+		closed:           make(chan struct{}),
+	}
+	if m.idleTimeout == 0 {
+		m.idleTimeout = defaultIdleTimeout
+	}
+	if m.probeTimeout == 0 {
+		m.probeTimeout = defaultProbeTimeout
+	}
+
+	if opts.ProbeInterval > 0 {
+		go m.probe(opts.ProbeInterval)
+	}
+	return m
 }
 
 // Get get connection from pool, if reach max, create new connection and return
@@ -38,7 +80,7 @@ func (m *ClientPool) Get(ctx context.Context, addr string) (rpcClientConn, error
 	defer cancel()
 	c, err := cp.Get(ctx)
 	if err != nil {
-		xlog.Errorf(ctx, "%s get conn from connection pool failed, callee_service: %s, addr: %s, err: %v", fun, m.calleeServiceKey, addr, err)
+		logger().Errorf(ctx, "%s get conn from connection pool failed, callee_service: %s, addr: %s, err: %v", fun, m.calleeServiceKey, addr, err)
 		return nil, err
 	}
 	return c.(rpcClientConn), nil
@@ -50,7 +92,7 @@ func (m *ClientPool) Put(addr string, client rpcClientConn, err error) {
 	cp := m.getPool(addr)
 	// close client and don't put to pool
 	if err != nil {
-		xlog.Warnf(context.Background(), "%s put rpc client to pool with err: %v, callee_service: %s, addr: %s", fun, err, m.calleeServiceKey, addr)
+		logger().Warnf(context.Background(), "%s put rpc client to pool with err: %v, callee_service: %s, addr: %s", fun, err, m.calleeServiceKey, addr)
 		cp.Put(client, true)
 		return
 	}
@@ -59,6 +101,7 @@ func (m *ClientPool) Put(addr string, client rpcClientConn, err error) {
 
 // Close close connection pool in client pool
 func (m *ClientPool) Close() {
+	m.stopProbe()
 	closeConnectionPool := func(key, value interface{}) bool {
 		if connectionPool, ok := value.(*ConnectionPool); ok {
 			connectionPool.Close()
@@ -81,7 +124,7 @@ func (m *ClientPool) getPool(addr string) *ConnectionPool {
 		if ok == true {
 			cp = value.(*ConnectionPool)
 		} else {
-			xlog.Infof(context.Background(), "%s not found connection pool of callee_service: %s, addr: %s, create it", fun, m.calleeServiceKey, addr)
+			logger().Infof(context.Background(), "%s not found connection pool of callee_service: %s, addr: %s, create it", fun, m.calleeServiceKey, addr)
 			cp = NewConnectionPool(addr, m.idle, m.active, m.idleTimeout, m.rpcFactory, m.calleeServiceKey)
 			cp.Open()
 			m.clientPool.Store(addr, cp)
@@ -89,3 +132,44 @@ func (m *ClientPool) getPool(addr string) *ConnectionPool {
 	}
 	return cp
 }
+
+func (m *ClientPool) stopProbe() {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+	})
+}
+
+func (m *ClientPool) probe(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.closed:
+			return
+		case <-ticker.C:
+		}
+
+		m.clientPool.Range(func(key, value interface{}) bool {
+			m.probeAddr(key.(string))
+			return true
+		})
+	}
+}
+
+// probeAddr 地址不可连接时关闭其空闲连接, 避免后续请求拿到失效的连接
+func (m *ClientPool) probeAddr(addr string) {
+	fun := "ClientPool.probeAddr -->"
+
+	conn, err := net.DialTimeout("tcp", addr, m.probeTimeout)
+	if err == nil {
+		conn.Close()
+		return
+	}
+
+	value, ok := m.clientPool.Load(addr)
+	if !ok {
+		return
+	}
+	n := value.(*ConnectionPool).drainIdle(m.probeTimeout)
+	logger().Warnf(context.Background(), "%s probe failed, callee_service: %s, addr: %s, err: %v, close idle: %d", fun, m.calleeServiceKey, addr, err, n)
+}
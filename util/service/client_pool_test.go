@@ -0,0 +1,105 @@
+package rocserv
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRpcConn struct {
+	closed int32
+}
+
+func (m *fakeRpcConn) Close() error {
+	atomic.StoreInt32(&m.closed, 1)
+	return nil
+}
+func (m *fakeRpcConn) SetTimeout(timeout time.Duration) error { return nil }
+func (m *fakeRpcConn) GetServiceClient() interface{}          { return nil }
+
+func (m *fakeRpcConn) isClosed() bool {
+	return atomic.LoadInt32(&m.closed) == 1
+}
+
+func fakeRpcFactory(addr string) (rpcClientConn, error) {
+	return &fakeRpcConn{}, nil
+}
+
+// closedAddr 返回一个没有监听的本地地址
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestClientPoolGetPut(t *testing.T) {
+	ass := assert.New(t)
+
+	p := NewClientPool(2, 4, fakeRpcFactory, "test/pool")
+	defer p.Close()
+
+	c, err := p.Get(context.Background(), "127.0.0.1:1")
+	ass.Nil(err)
+	p.Put("127.0.0.1:1", c, nil)
+	c2, err := p.Get(context.Background(), "127.0.0.1:1")
+	ass.Nil(err)
+	ass.True(c == c2)
+
+	// 出错的连接不放回
+	p.Put("127.0.0.1:1", c2, context.DeadlineExceeded)
+	ass.True(c2.(*fakeRpcConn).isClosed())
+}
+
+func TestClientPoolProbeOptIn(t *testing.T) {
+	ass := assert.New(t)
+	addr := closedAddr(t)
+
+	// 默认不探测, 空闲连接保留
+	p := NewClientPoolWithOptions(&ClientPoolOptions{}, fakeRpcFactory, "test/pool")
+	c, err := p.Get(context.Background(), addr)
+	ass.Nil(err)
+	p.Put(addr, c, nil)
+	time.Sleep(50 * time.Millisecond)
+	ass.False(c.(*fakeRpcConn).isClosed())
+	p.Close()
+
+	p = NewClientPoolWithOptions(&ClientPoolOptions{ProbeInterval: 10 * time.Millisecond, ProbeTimeout: 10 * time.Millisecond}, fakeRpcFactory, "test/pool")
+	defer p.Close()
+	c, err = p.Get(context.Background(), addr)
+	ass.Nil(err)
+	p.Put(addr, c, nil)
+	deadline := time.Now().Add(time.Second)
+	for !c.(*fakeRpcConn).isClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ass.True(c.(*fakeRpcConn).isClosed())
+}
+
+func TestClientPoolSetOptionsConcurrent(t *testing.T) {
+	ass := assert.New(t)
+
+	ct := NewClientThrift(&fakeLoadLookup{}, "proc_thrift", nil, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ct.SetPoolOptions(&ClientPoolOptions{MaxIdle: 1})
+		}()
+		go func() {
+			defer wg.Done()
+			ass.NotNil(ct.getPool())
+		}()
+	}
+	wg.Wait()
+	ct.getPool().Close()
+}
@@ -3,10 +3,10 @@ package rocserv
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xcontext"
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xtrace"
 
@@ -21,6 +21,7 @@ type ClientThrift struct {
 	clientLookup ClientLookup
 	processor    string
 	fnFactory    func(thrift.TTransport, thrift.TProtocolFactory) interface{}
+	muPool       sync.RWMutex
 	pool         *ClientPool
 	breaker      *Breaker
 	router       Router
@@ -53,13 +54,30 @@ func NewClientThriftWithRouterType(cb ClientLookup, processor string, fn func(th
 	return ct
 }
 
+// SetPoolOptions replace connection pool with options, should be called before the first rpc;
+// the old pool is not closed, since connections in use will be put back into it
+func (m *ClientThrift) SetPoolOptions(opts *ClientPoolOptions) {
+	pool := NewClientPoolWithOptions(opts, m.newConn, m.clientLookup.ServKey())
+	m.muPool.Lock()
+	old := m.pool
+	m.pool = pool
+	m.muPool.Unlock()
+	old.stopProbe()
+}
+
+func (m *ClientThrift) getPool() *ClientPool {
+	m.muPool.RLock()
+	defer m.muPool.RUnlock()
+	return m.pool
+}
+
 func (m *ClientThrift) route(ctx context.Context, key string) (*ServInfo, rpcClientConn) {
-	s := m.router.Route(ctx, m.processor, key)
+	s := affinityRoute(ctx, m.router, m.clientLookup, m.processor, key)
 	if s == nil {
 		return nil, nil
 	}
 	addr := s.Addr
-	conn, _ := m.pool.Get(ctx, addr)
+	conn, _ := m.getPool().Get(ctx, addr)
 	return s, conn
 }
 
@@ -70,23 +88,22 @@ func (m *ClientThrift) Rpc(hashKey string, timeout time.Duration, fnrpc func(int
 
 // deprecated
 func (m *ClientThrift) RpcWithContext(ctx context.Context, hashKey string, timeout time.Duration, fnrpc func(interface{}) error) error {
-	var err error
 	funcName := GetFuncName(3)
 	if funcName == "rpc" {
 		funcName = GetFuncName(4)
 	}
-	retry := GetFuncRetry(m.clientLookup.ServKey(), funcName)
+	policy := GetRetryPolicy(m.clientLookup.ServKey(), funcName)
 	timeout = GetFuncTimeout(m.clientLookup.ServKey(), funcName, timeout)
-	for ; retry >= 0; retry-- {
-		err = m.do(ctx, hashKey, funcName, timeout, fnrpc)
-		if err == nil {
-			return nil
-		}
-	}
-	return err
+	ctx = withRetryAffinity(ctx, m.clientLookup.ServKey(), funcName)
+	return policy.Do(ctx, func() error {
+		return m.do(ctx, hashKey, funcName, timeout, fnrpc)
+	})
 }
 
 func (m *ClientThrift) do(ctx context.Context, hashKey, funcName string, timeout time.Duration, fnrpc func(interface{}) error) error {
+	if err := checkFastFail(m.clientLookup, m.processor); err != nil {
+		return err
+	}
 	si, rc := m.route(ctx, hashKey)
 	if rc == nil {
 		return fmt.Errorf("not find thrift service:%s processor:%s", m.clientLookup.ServPath(), m.processor)
@@ -101,31 +118,35 @@ func (m *ClientThrift) do(ctx context.Context, hashKey, funcName string, timeout
 
 	var err error
 	// record request duration
+	done := startClientRPC(m.clientLookup.ServKey(), m.processor, funcName)
 	st := xtime.NewTimeStat()
 	defer func() {
+		done(err)
 		dur := st.Duration()
+		noticeDeprecatedCall(m.clientLookup, funcName)
 		collector(m.clientLookup.ServKey(), m.processor, dur, 0, si.Servid, funcName, err)
 		collectAPM(ctx, m.clientLookup.ServKey(), funcName, si.Servid, dur, err)
+		addCostDownstream(ctx, dur)
+		addStatDownstream(ctx, m.clientLookup.ServKey(), funcName, dur)
 	}()
 	err = m.breaker.Do(ctx, funcName, call, m.GetFallbackFunc(funcName))
 	return err
 }
 
 func (m *ClientThrift) RpcWithContextV2(ctx context.Context, hashKey string, timeout time.Duration, fnrpc func(context.Context, interface{}) error) error {
-	var err error
 	funcName := GetFuncNameWithCtx(ctx, 3)
-	retry := GetFuncRetry(m.clientLookup.ServKey(), funcName)
+	policy := GetRetryPolicy(m.clientLookup.ServKey(), funcName)
 	timeout = GetFuncTimeout(m.clientLookup.ServKey(), funcName, timeout)
-	for ; retry >= 0; retry-- {
-		err = m.doWithContext(ctx, hashKey, funcName, timeout, fnrpc)
-		if err == nil {
-			return nil
-		}
-	}
-	return err
+	ctx = withRetryAffinity(ctx, m.clientLookup.ServKey(), funcName)
+	return policy.Do(ctx, func() error {
+		return m.doWithContext(ctx, hashKey, funcName, timeout, fnrpc)
+	})
 }
 
 func (m *ClientThrift) doWithContext(ctx context.Context, hashKey, funcName string, timeout time.Duration, fnrpc func(context.Context, interface{}) error) error {
+	if err := checkFastFail(m.clientLookup, m.processor); err != nil {
+		return err
+	}
 	si, rc := m.route(ctx, hashKey)
 	if rc == nil {
 		return fmt.Errorf("not find thrift service:%s processor:%s", m.clientLookup.ServPath(), m.processor)
@@ -141,11 +162,16 @@ func (m *ClientThrift) doWithContext(ctx context.Context, hashKey, funcName stri
 	}
 
 	var err error
+	done := startClientRPC(m.clientLookup.ServKey(), m.processor, funcName)
 	st := xtime.NewTimeStat()
 	defer func() {
+		done(err)
 		dur := st.Duration()
+		noticeDeprecatedCall(m.clientLookup, funcName)
 		collector(m.clientLookup.ServKey(), m.processor, dur, 0, si.Servid, funcName, err)
 		collectAPM(ctx, m.clientLookup.ServKey(), funcName, si.Servid, dur, err)
+		addCostDownstream(ctx, dur)
+		addStatDownstream(ctx, m.clientLookup.ServKey(), funcName, dur)
 	}()
 	err = m.breaker.Do(ctx, funcName, call, m.GetFallbackFunc(funcName))
 	return err
@@ -156,7 +182,8 @@ func (m *ClientThrift) rpc(si *ServInfo, rc rpcClientConn, timeout time.Duration
 	c := rc.GetServiceClient()
 
 	err := fnrpc(c)
-	m.pool.Put(si.Addr, rc, err)
+	m.getPool().Put(si.Addr, rc, err)
+	reportInstance(m.clientLookup, si, err)
 	return err
 }
 
@@ -165,7 +192,8 @@ func (m *ClientThrift) rpcWithContext(ctx context.Context, si *ServInfo, rc rpcC
 	c := rc.GetServiceClient()
 
 	err := fnrpc(ctx, c)
-	m.pool.Put(si.Addr, rc, err)
+	m.getPool().Put(si.Addr, rc, err)
+	reportInstance(m.clientLookup, si, err)
 	return err
 }
 
@@ -179,6 +207,8 @@ func (m *ClientThrift) injectServInfo(ctx context.Context, si *ServInfo) context
 	if err != nil {
 		return ctx
 	}
+	// thrift 没有 header, baggage 随 span 传递
+	ctx = baggageToSpan(ctx)
 
 	span := xtrace.SpanFromContext(ctx)
 	if span == nil {
@@ -204,8 +234,14 @@ func (m *ClientThrift) injectServInfo(ctx context.Context, si *ServInfo) context
 //	logTrafficByKV(ctx, kv)
 //}
 
+// thriftSocket TSocket 或 TSSLSocket
+type thriftSocket interface {
+	thrift.TTransport
+	SetTimeout(timeout time.Duration) error
+}
+
 type thriftClientConn struct {
-	tsock         *thrift.TSocket
+	tsock         thriftSocket
 	trans         thrift.TTransport
 	serviceClient interface{}
 }
@@ -232,24 +268,34 @@ func (m *ClientThrift) newConn(addr string) (rpcClientConn, error) {
 	fun := "ClientThrift.newConn -->"
 	ctx := context.Background()
 
-	transportFactory := thrift.NewTFramedTransportFactory(thrift.NewTTransportFactory())
-	protocolFactory := thrift.NewTBinaryProtocolFactoryDefault()
+	// 按实例注册的 transport 及 protocol 连接
+	transportFactory, protocolFactory, err := dialThriftConf(m.clientLookup, addr).factories()
+	if err != nil {
+		logger().Errorf(ctx, "%s addr: %s serv: %s err: %v", fun, addr, m.clientLookup.ServKey(), err)
+		return nil, err
+	}
 
-	transport, err := thrift.NewTSocket(addr)
+	var transport thriftSocket
+	// 实例注册时声明开启 TLS 时使用 TLS 连接
+	if dialTLS(m.clientLookup, addr) {
+		transport, err = thrift.NewTSSLSocket(addr, getClientTLSConfig(m.clientLookup.ServKey()))
+	} else {
+		transport, err = thrift.NewTSocket(addr)
+	}
 	if err != nil {
-		xlog.Errorf(ctx, "%s NetTSocket addr: %s serv: %s err: %v", fun, addr, m.clientLookup.ServKey(), err)
+		logger().Errorf(ctx, "%s NetTSocket addr: %s serv: %s err: %v", fun, addr, m.clientLookup.ServKey(), err)
 		return nil, err
 	}
 	useTransport := transportFactory.GetTransport(transport)
 
 	if err := useTransport.Open(); err != nil {
-		xlog.Errorf(ctx, "%s Open addr: %s serv: %s err: %v", fun, addr, m.clientLookup.ServKey(), err)
+		logger().Errorf(ctx, "%s Open addr: %s serv: %s err: %v", fun, addr, m.clientLookup.ServKey(), err)
 		return nil, err
 	}
 	// 必须要close么？
 	//useTransport.Close()
 
-	xlog.Infof(ctx, "%s new client addr: %s serv: %s", fun, addr, m.clientLookup.ServKey())
+	logger().Infof(ctx, "%s new client addr: %s serv: %s", fun, addr, m.clientLookup.ServKey())
 	return &thriftClientConn{
 		tsock:         transport,
 		trans:         useTransport,
@@ -0,0 +1,242 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultConfigWatchInterval = 5 * time.Second
+
+type configWatch struct {
+	key     string
+	fn      func(old, new []byte)
+	value   string
+	present bool
+}
+
+// configWatcher 轮询配置中心 application namespace 的 key, 变化时回调; 所有 key 共用一个 goroutine
+type configWatcher struct {
+	get      func(key string) (string, bool)
+	interval time.Duration
+
+	mu      sync.Mutex
+	watches map[int]*configWatch
+	nextID  int
+	started bool
+	// 关闭后不再接受新的 watch
+	closed bool
+	stop   chan struct{}
+}
+
+func newConfigWatcher(get func(key string) (string, bool), interval time.Duration) *configWatcher {
+	return &configWatcher{
+		get:      get,
+		interval: interval,
+		watches:  make(map[int]*configWatch),
+		stop:     make(chan struct{}),
+	}
+}
+
+// watch 注册时以当前值回调一次, old 为 nil; 关闭后不再回调
+func (m *configWatcher) watch(key string, fn func(old, new []byte)) func() {
+	m.mu.Lock()
+	closed := m.closed
+	m.mu.Unlock()
+	if closed {
+		logger().Warnf(context.Background(), "configWatcher.watch --> key: %s watcher closed", key)
+		return func() {}
+	}
+
+	w := &configWatch{key: key, fn: fn}
+	w.value, w.present = m.get(key)
+	if w.present {
+		m.call(w, nil, []byte(w.value))
+	}
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return func() {}
+	}
+	id := m.nextID
+	m.nextID++
+	m.watches[id] = w
+	if !m.started {
+		m.started = true
+		go m.loop()
+	}
+	m.mu.Unlock()
+
+	return func() {
+		m.mu.Lock()
+		delete(m.watches, id)
+		m.mu.Unlock()
+	}
+}
+
+func (m *configWatcher) loop() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.poll()
+		}
+	}
+}
+
+func (m *configWatcher) poll() {
+	m.mu.Lock()
+	watches := make([]*configWatch, 0, len(m.watches))
+	for _, w := range m.watches {
+		watches = append(watches, w)
+	}
+	m.mu.Unlock()
+
+	// 同一 key 只读取一次
+	values := make(map[string]string)
+	presents := make(map[string]bool)
+	for _, w := range watches {
+		if _, ok := presents[w.key]; !ok {
+			values[w.key], presents[w.key] = m.get(w.key)
+		}
+		value, present := values[w.key], presents[w.key]
+		if value == w.value && present == w.present {
+			continue
+		}
+
+		var old, cur []byte
+		if w.present {
+			old = []byte(w.value)
+		}
+		if present {
+			cur = []byte(value)
+		}
+		w.value, w.present = value, present
+		m.call(w, old, cur)
+	}
+}
+
+func (m *configWatcher) call(w *configWatch, old, cur []byte) {
+	fun := "configWatcher.call -->"
+	defer func() {
+		if err := recover(); err != nil {
+			logger().Errorf(context.Background(), "%s key: %s callback panic: %v", fun, w.key, err)
+		}
+	}()
+	w.fn(old, cur)
+}
+
+func (m *configWatcher) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.stop)
+}
+
+// WatchConfig call fn with current value of key in config center application namespace, and again
+// with old and new value whenever it changes; new is nil when key is deleted. returns func to stop watching
+func (m *ServBaseV2) WatchConfig(key string, fn func(old, new []byte)) func() {
+	m.muWatcher.Lock()
+	if m.watcher == nil {
+		m.watcher = newConfigWatcher(func(key string) (string, bool) {
+			if m.configCenter == nil {
+				return "", false
+			}
+			return m.configCenter.GetString(context.Background(), key)
+		}, defaultConfigWatchInterval)
+	}
+	w := m.watcher
+	m.muWatcher.Unlock()
+
+	return w.watch(key, fn)
+}
+
+// WatchConfig watch key in config center of this service, ErrServBaseNotInit before Serve or Init
+func WatchConfig(key string, fn func(old, new []byte)) (func(), error) {
+	sb, err := getServBaseV2()
+	if err != nil {
+		return nil, err
+	}
+	return sb.WatchConfig(key, fn), nil
+}
+
+func (m *ServBaseV2) stopConfigWatcher() {
+	m.muWatcher.Lock()
+	defer m.muWatcher.Unlock()
+	if m.watcher != nil {
+		m.watcher.close()
+	}
+}
+
+// ConfigValue json config of key kept up to date with config center
+//
+//	limits, cancel, err := rocserv.NewConfigValue(nil, "limits", &Limits{QPS: 100})
+//	qps := limits.Load().(*Limits).QPS
+type ConfigValue struct {
+	key      string
+	proto    reflect.Value
+	v        atomic.Value
+	onChange func(v interface{})
+}
+
+// NewConfigValue watch key and unmarshal json value into new copy of proto on each change,
+// proto must be pointer to struct and holds default values; invalid value is ignored and logged.
+// sb is nil means the servbase of this service
+func NewConfigValue(sb *ServBaseV2, key string, proto interface{}) (*ConfigValue, func(), error) {
+	return NewConfigValueWithCallback(sb, key, proto, nil)
+}
+
+// NewConfigValueWithCallback same as NewConfigValue, onChange is called with new value after each change
+func NewConfigValueWithCallback(sb *ServBaseV2, key string, proto interface{}, onChange func(v interface{})) (*ConfigValue, func(), error) {
+	pv := reflect.ValueOf(proto)
+	if pv.Kind() != reflect.Ptr || pv.IsNil() || pv.Elem().Kind() != reflect.Struct {
+		return nil, nil, fmt.Errorf("config value proto must be pointer to struct")
+	}
+
+	if sb == nil {
+		var err error
+		if sb, err = getServBaseV2(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	m := &ConfigValue{key: key, proto: pv.Elem(), onChange: onChange}
+	m.v.Store(proto)
+	cancel := sb.WatchConfig(key, m.update)
+	return m, cancel, nil
+}
+
+func (m *ConfigValue) update(old, cur []byte) {
+	fun := "ConfigValue.update -->"
+
+	v := reflect.New(m.proto.Type())
+	v.Elem().Set(m.proto)
+	if cur != nil {
+		if err := json.Unmarshal(cur, v.Interface()); err != nil {
+			logger().Errorf(context.Background(), "%s key: %s unmarshal: %s err: %v", fun, m.key, string(cur), err)
+			return
+		}
+	}
+	m.v.Store(v.Interface())
+	logger().Infof(context.Background(), "%s key: %s updated: %s", fun, m.key, string(cur))
+
+	if m.onChange != nil {
+		m.onChange(v.Interface())
+	}
+}
+
+// Load current value, same type as proto
+func (m *ConfigValue) Load() interface{} {
+	return m.v.Load()
+}
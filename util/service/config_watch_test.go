@@ -0,0 +1,112 @@
+package rocserv
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeConfig struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (m *fakeConfig) get(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.values[key]
+	return v, ok
+}
+
+func (m *fakeConfig) set(key, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[key] = value
+}
+
+func TestConfigWatcher(t *testing.T) {
+	ass := assert.New(t)
+
+	conf := &fakeConfig{values: map[string]string{"log_level": "info"}}
+	w := newConfigWatcher(conf.get, time.Hour)
+	defer w.close()
+
+	var changes [][2]string
+	cancel := w.watch("log_level", func(old, new []byte) {
+		changes = append(changes, [2]string{string(old), string(new)})
+	})
+	ass.Equal([][2]string{{"", "info"}}, changes)
+
+	w.poll()
+	ass.Len(changes, 1)
+
+	conf.set("log_level", "debug")
+	w.poll()
+	ass.Equal([2]string{"info", "debug"}, changes[1])
+
+	cancel()
+	conf.set("log_level", "warn")
+	w.poll()
+	ass.Len(changes, 2)
+
+	// 关闭后 watch 不生效, 重复关闭不 panic
+	w.close()
+	w.close()
+	w.watch("log_level", func(old, new []byte) {
+		ass.Fail("watch after close")
+	})
+	w.mu.Lock()
+	ass.Empty(w.watches)
+	w.mu.Unlock()
+}
+
+func TestConfigValue(t *testing.T) {
+	ass := assert.New(t)
+
+	type limits struct {
+		QPS   int `json:"qps"`
+		Burst int `json:"burst"`
+	}
+
+	conf := &fakeConfig{values: map[string]string{"limits": `{"qps": 200}`}}
+	sb := &ServBaseV2{watcher: newConfigWatcher(conf.get, time.Hour)}
+	defer sb.stopConfigWatcher()
+
+	_, _, err := NewConfigValue(sb, "limits", limits{})
+	ass.NotNil(err)
+
+	v, cancel, err := NewConfigValue(sb, "limits", &limits{QPS: 100, Burst: 10})
+	ass.Nil(err)
+	defer cancel()
+	ass.Equal(&limits{QPS: 200, Burst: 10}, v.Load())
+
+	conf.set("limits", `invalid`)
+	sb.watcher.poll()
+	ass.Equal(&limits{QPS: 200, Burst: 10}, v.Load())
+
+	conf.set("limits", `{"burst": 20}`)
+	sb.watcher.poll()
+	ass.Equal(&limits{QPS: 100, Burst: 20}, v.Load())
+
+	// nil 使用本服务的 servbase
+	old := server.sbase
+	defer func() { server.sbase = old }()
+	server.sbase = nil
+	_, _, err = NewConfigValue(nil, "limits", &limits{})
+	ass.Equal(ErrServBaseNotInit, err)
+	_, err = WatchConfig("limits", func(old, new []byte) {})
+	ass.Equal(ErrServBaseNotInit, err)
+
+	server.sbase = sb
+	var got []string
+	stop, err := WatchConfig("limits", func(old, new []byte) { got = append(got, string(new)) })
+	ass.Nil(err)
+	defer stop()
+	ass.Equal([]string{`{"burst": 20}`}, got)
+	v, cancel2, err := NewConfigValue(nil, "limits", &limits{QPS: 100})
+	ass.Nil(err)
+	defer cancel2()
+	ass.Equal(&limits{QPS: 100, Burst: 20}, v.Load())
+}
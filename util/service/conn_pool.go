@@ -7,7 +7,6 @@ import (
 	"sync"
 	"time"
 
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xutil/pool"
@@ -80,8 +79,13 @@ func (cp *ConnectionPool) stat() {
 		for !cp.closed.Get() {
 			select {
 			case <-tickC:
-				confActive, confIdle, active, idle := cp.connections.Stat()
-				xlog.Infof(context.Background(), "caller: %s, callee: %s, callee_addr: %s, conf_active: %d, conf_idle: %d, active: %d, idle: %d", GetServName(), cp.calleeServiceKey, cp.addr, confActive, confIdle, active, idle)
+				// Close 之后 connections 被置空
+				p := cp.pool()
+				if p == nil {
+					continue
+				}
+				confActive, confIdle, active, idle := p.Stat()
+				logger().Infof(context.Background(), "caller: %s, callee: %s, callee_addr: %s, conf_active: %d, conf_idle: %d, active: %d, idle: %d", GetServName(), cp.calleeServiceKey, cp.addr, confActive, confIdle, active, idle)
 				group, service := GetGroupAndService()
 				_metricRPCConnectionPool.With(xprom.LabelGroupName, group,
 					xprom.LabelServiceName, service,
@@ -105,7 +109,7 @@ func (cp *ConnectionPool) stat() {
 					connectionPoolStatType, idleType).Set(float64(idle))
 			}
 		}
-		xlog.Infof(context.Background(), "caller: %s, callee: %s, callee_addr: %s exit stat", GetServName(), cp.calleeServiceKey, cp.addr)
+		logger().Infof(context.Background(), "caller: %s, callee: %s, callee_addr: %s exit stat", GetServName(), cp.calleeServiceKey, cp.addr)
 	}()
 }
 
@@ -160,3 +164,26 @@ func (cp *ConnectionPool) Put(conn rpcClientConn, forceClose bool) {
 	}
 	p.Put(context.TODO(), conn, forceClose)
 }
+
+// drainIdle close idle connections, connections in use are not affected, return count of closed
+func (cp *ConnectionPool) drainIdle(timeout time.Duration) int {
+	p := cp.pool()
+	if p == nil {
+		return 0
+	}
+
+	_, _, _, idle := p.Stat()
+	closed := 0
+	for i := 0; i < idle; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		c, err := p.Get(ctx)
+		cancel()
+		// 没有空闲连接时会新建连接, 地址不可用时失败退出
+		if err != nil {
+			break
+		}
+		p.Put(context.TODO(), c, true)
+		closed++
+	}
+	return closed
+}
@@ -0,0 +1,226 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+const (
+	controlCmdDir    = "cmd"
+	controlResultDir = "result"
+
+	// 命令和执行结果都是临时数据, 过期后由 etcd 自动清理
+	defaultControlCmdTTL    = 10 * time.Minute
+	defaultControlResultTTL = time.Hour
+)
+
+// ControlCommand command broadcast to all copies of a service
+type ControlCommand struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Args  []string `json:"args"`
+	Ctime int64    `json:"ctime"`
+}
+
+// ControlResult result of command executed by one copy
+type ControlResult struct {
+	Servid   int    `json:"servid"`
+	Copyname string `json:"copyname"`
+	Output   string `json:"output"`
+	Err      string `json:"err"`
+	Ctime    int64  `json:"ctime"`
+}
+
+// ControlHandler handle control command, the returned output is reported back to registry
+type ControlHandler func(ctx context.Context, args []string) (string, error)
+
+var (
+	muControlHandlers sync.RWMutex
+	controlHandlers   = map[string]ControlHandler{
+		"ping":                   controlPing,
+		"gc":                     controlGC,
+		controlDeprecatedCallers: controlGetDeprecatedCallers,
+	}
+)
+
+// RegisterControlHandler register handler of control command, e.g. "flush_caches"
+func RegisterControlHandler(name string, handler ControlHandler) {
+	muControlHandlers.Lock()
+	defer muControlHandlers.Unlock()
+	controlHandlers[name] = handler
+}
+
+func getControlHandler(name string) (ControlHandler, bool) {
+	muControlHandlers.RLock()
+	defer muControlHandlers.RUnlock()
+	h, ok := controlHandlers[name]
+	return h, ok
+}
+
+func controlPing(ctx context.Context, args []string) (string, error) {
+	return "pong", nil
+}
+
+func controlGC(ctx context.Context, args []string) (string, error) {
+	runtime.GC()
+	debug.FreeOSMemory()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return fmt.Sprintf("heap_alloc: %d heap_sys: %d", ms.HeapAlloc, ms.HeapSys), nil
+}
+
+// controlPath 控制命令没有放在 dist 下, 避免命令变更触发所有调用方的服务发现重新解析
+func controlPath(baseLoc, servLocation string) string {
+	return fmt.Sprintf("%s/%s/%s", baseLoc, BASE_LOC_CONTROL, servLocation)
+}
+
+// SendControlCommand write command into registry, all copies of servLocation will execute it, used by roc-ctl
+func SendControlCommand(ctx context.Context, client etcd.KeysAPI, baseLoc, servLocation string, cmd *ControlCommand) error {
+	if cmd == nil || len(cmd.ID) == 0 || len(cmd.Name) == 0 {
+		return fmt.Errorf("control command id or name empty")
+	}
+	if cmd.Ctime == 0 {
+		cmd.Ctime = time.Now().Unix()
+	}
+
+	js, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("%s/%s/%s", controlPath(baseLoc, servLocation), controlCmdDir, cmd.ID)
+	_, err = client.Set(ctx, path, string(js), &etcd.SetOptions{
+		PrevExist: etcd.PrevNoExist,
+		TTL:       defaultControlCmdTTL,
+	})
+	return err
+}
+
+// GetControlResults get results reported by copies of servLocation for command id
+func GetControlResults(ctx context.Context, client etcd.KeysAPI, baseLoc, servLocation, id string) ([]*ControlResult, error) {
+	path := fmt.Sprintf("%s/%s/%s", controlPath(baseLoc, servLocation), controlResultDir, id)
+	r, err := client.Get(ctx, path, &etcd.GetOptions{Recursive: true, Sort: true})
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	results := make([]*ControlResult, 0, len(r.Node.Nodes))
+	for _, n := range r.Node.Nodes {
+		var res ControlResult
+		if err := json.Unmarshal([]byte(n.Value), &res); err != nil {
+			return nil, fmt.Errorf("unmarshal result key: %s err: %v", n.Key, err)
+		}
+		results = append(results, &res)
+	}
+	return results, nil
+}
+
+// watchControl watch command dir and execute commands created after start
+func (m *ServBaseV2) watchControl() {
+	fun := "ServBaseV2.watchControl -->"
+	ctx := context.Background()
+
+	path := fmt.Sprintf("%s/%s", controlPath(m.confEtcd.useBaseloc, m.servLocation), controlCmdDir)
+	backoff := xtime.NewBackOffCtrl(time.Millisecond*100, time.Second*10)
+	release := func() {}
+	defer func() { release() }()
+	for !m.isStop() {
+		// 只执行启动之后下发的命令, 历史命令不重放
+		index := uint64(0)
+		r, err := m.etcdClient.Get(ctx, path, nil)
+		release()
+		release = func() {}
+		if err == nil {
+			index = r.Index
+		} else if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+			index = e.Index
+		} else {
+			logger().Warnf(ctx, "%s get path: %s err: %v", fun, path, err)
+			backoff.BackOff()
+			continue
+		}
+
+		watcher := m.etcdClient.Watcher(path, &etcd.WatcherOptions{AfterIndex: index, Recursive: true})
+		for !m.isStop() {
+			resp, err := watcher.Next(ctx)
+			if isWatchCompacted(err) {
+				release = waitCompactedResync(ctx, watchKindControl, path)
+				break
+			}
+			if err != nil {
+				logger().Warnf(ctx, "%s watch path: %s err: %v", fun, path, err)
+				backoff.BackOff()
+				break
+			}
+			backoff.Reset()
+
+			if resp.Action != "set" && resp.Action != "create" {
+				continue
+			}
+			if resp.Node == nil || resp.Node.Dir {
+				continue
+			}
+			m.execControl(ctx, resp.Node.Value)
+		}
+	}
+	logger().Infof(ctx, "%s stop watch path: %s", fun, path)
+}
+
+func (m *ServBaseV2) execControl(ctx context.Context, value string) {
+	fun := "ServBaseV2.execControl -->"
+
+	var cmd ControlCommand
+	if err := json.Unmarshal([]byte(value), &cmd); err != nil {
+		logger().Errorf(ctx, "%s unmarshal command: %s err: %v", fun, value, err)
+		return
+	}
+
+	result := &ControlResult{
+		Servid:   m.servId,
+		Copyname: m.Copyname(),
+	}
+
+	handler, ok := getControlHandler(cmd.Name)
+	if !ok {
+		result.Err = fmt.Sprintf("command: %s not registered", cmd.Name)
+	} else {
+		logger().Infof(ctx, "%s exec id: %s name: %s args: %s", fun, cmd.ID, cmd.Name, strings.Join(cmd.Args, " "))
+		output, err := m.callControlHandler(ctx, handler, cmd.Args)
+		result.Output = output
+		if err != nil {
+			result.Err = err.Error()
+		}
+	}
+	result.Ctime = time.Now().Unix()
+
+	js, _ := json.Marshal(result)
+	path := fmt.Sprintf("%s/%s/%s/%d", controlPath(m.confEtcd.useBaseloc, m.servLocation), controlResultDir, cmd.ID, m.servId)
+	if _, err := m.etcdClient.Set(ctx, path, string(js), &etcd.SetOptions{TTL: defaultControlResultTTL}); err != nil {
+		logger().Errorf(ctx, "%s report result id: %s err: %v", fun, cmd.ID, err)
+	}
+}
+
+func (m *ServBaseV2) callControlHandler(ctx context.Context, handler ControlHandler, args []string) (output string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			buf := make([]byte, 4096)
+			buf = buf[:runtime.Stack(buf, false)]
+			ReportPanic(ctx, p, buf)
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return handler(ctx, args)
+}
@@ -0,0 +1,335 @@
+package rocserv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xcontext"
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultCostReportInterval = time.Minute
+	unknownCostLabel          = "unknown"
+	overflowCostLabel         = "other"
+
+	// 配置中心 application namespace 中 caller 及 tenant 各自最多的取值数, 超出的计入 other, 默认 100
+	costLabelLimitConfKey = "cost_label_limit"
+	defaultCostLabelLimit = 100
+)
+
+// costLabelSet caller 及 tenant 来自请求, 限制取值个数避免指标基数无限增长
+type costLabelSet struct {
+	seen  sync.Map
+	mu    sync.Mutex
+	count int
+}
+
+var (
+	costCallers costLabelSet
+	costTenants costLabelSet
+
+	// 由配置监听更新, 请求结束时不访问配置中心
+	costLabelLimitValue int64 = defaultCostLabelLimit
+)
+
+func costLabelLimit() int {
+	return int(atomic.LoadInt64(&costLabelLimitValue))
+}
+
+// updateCostLabelLimit 配置删除或无效时使用默认值
+func updateCostLabelLimit(old, cur []byte) {
+	fun := "updateCostLabelLimit -->"
+
+	n, err := strconv.Atoi(strings.TrimSpace(string(cur)))
+	if cur != nil && err != nil {
+		logger().Warnf(context.Background(), "%s invalid %s: %s, use default: %d", fun, costLabelLimitConfKey, cur, defaultCostLabelLimit)
+	}
+	if err != nil || n <= 0 {
+		n = defaultCostLabelLimit
+	}
+	atomic.StoreInt64(&costLabelLimitValue, int64(n))
+}
+
+// bound 已出现过的取值原样返回, 新取值超出 limit 时返回 other
+func (m *costLabelSet) bound(v string, limit int) string {
+	if _, ok := m.seen.Load(v); ok {
+		return v
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.seen.Load(v); ok {
+		return v
+	}
+	if m.count >= limit {
+		return overflowCostLabel
+	}
+	m.seen.Store(v, struct{}{})
+	m.count++
+	return v
+}
+
+type costContextKey struct{}
+
+// RequestCost cost of one request attributed to caller and tenant,
+// go can not measure cpu time of one goroutine, so handler wall time is used as the time cost
+type RequestCost struct {
+	Caller string
+
+	mu     sync.Mutex
+	tenant string
+
+	downstream     int64
+	downstreamTime int64
+	bytesIn        int64
+	bytesOut       int64
+}
+
+// WithRequestCost attach cost record into ctx, called by server interceptors
+func WithRequestCost(ctx context.Context, caller string) (context.Context, *RequestCost) {
+	if len(caller) == 0 {
+		caller = unknownCostLabel
+	}
+	c := &RequestCost{Caller: caller}
+	return context.WithValue(ctx, costContextKey{}, c), c
+}
+
+// CostFromContext return cost record of current request, nil if not exists
+func CostFromContext(ctx context.Context) *RequestCost {
+	c, _ := ctx.Value(costContextKey{}).(*RequestCost)
+	return c
+}
+
+// SetCostTenant set tenant label of current request, e.g. the business line or app id the request belongs to
+func SetCostTenant(ctx context.Context, tenant string) {
+	if c := CostFromContext(ctx); c != nil {
+		c.mu.Lock()
+		c.tenant = tenant
+		c.mu.Unlock()
+	}
+}
+
+// AddCostBytes add bytes received and sent of current request
+func AddCostBytes(ctx context.Context, in, out int64) {
+	if c := CostFromContext(ctx); c != nil {
+		atomic.AddInt64(&c.bytesIn, in)
+		atomic.AddInt64(&c.bytesOut, out)
+	}
+}
+
+// addCostDownstream called by clients on each downstream call
+func addCostDownstream(ctx context.Context, d time.Duration) {
+	if c := CostFromContext(ctx); c != nil {
+		atomic.AddInt64(&c.downstream, 1)
+		atomic.AddInt64(&c.downstreamTime, int64(d))
+	}
+}
+
+func (m *RequestCost) Tenant() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.tenant) == 0 {
+		return unknownCostLabel
+	}
+	return m.tenant
+}
+
+// CostStat aggregated cost of one caller and tenant in report interval
+type CostStat struct {
+	Caller   string `json:"caller"`
+	Tenant   string `json:"tenant"`
+	Requests int64  `json:"requests"`
+	// Duration handler wall time, not cpu time
+	Duration       time.Duration `json:"wall_time"`
+	Downstream     int64         `json:"downstream"`
+	DownstreamTime time.Duration `json:"downstream_time"`
+	BytesIn        int64         `json:"bytes_in"`
+	BytesOut       int64         `json:"bytes_out"`
+}
+
+// CostAccountant aggregate request costs and report periodically
+type CostAccountant struct {
+	mu    sync.Mutex
+	stats map[string]*CostStat
+}
+
+var (
+	costAccountant     *CostAccountant
+	costAccountantOnce sync.Once
+)
+
+// GetCostAccountant return default cost accountant
+func GetCostAccountant() *CostAccountant {
+	costAccountantOnce.Do(func() {
+		costAccountant = &CostAccountant{stats: make(map[string]*CostStat)}
+	})
+	return costAccountant
+}
+
+// Finish account cost of finished request
+func (m *CostAccountant) Finish(c *RequestCost, d time.Duration) {
+	if c == nil {
+		return
+	}
+	limit := costLabelLimit()
+	caller := costCallers.bound(c.Caller, limit)
+	tenant := costTenants.bound(c.Tenant(), limit)
+	downstream := atomic.LoadInt64(&c.downstream)
+	downstreamTime := time.Duration(atomic.LoadInt64(&c.downstreamTime))
+	bytesIn, bytesOut := atomic.LoadInt64(&c.bytesIn), atomic.LoadInt64(&c.bytesOut)
+
+	group, service := GetGroupAndService()
+	_metricCostRequests.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelCaller, caller, labelTenant, tenant).Inc()
+	_metricCostDuration.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelCaller, caller, labelTenant, tenant).Add(d.Seconds())
+	_metricCostDownstream.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelCaller, caller, labelTenant, tenant).Add(float64(downstream))
+	_metricCostBytes.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelCaller, caller, labelTenant, tenant).Add(float64(bytesIn + bytesOut))
+
+	key := caller + "|" + tenant
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.stats[key]
+	if !ok {
+		s = &CostStat{Caller: caller, Tenant: tenant}
+		m.stats[key] = s
+	}
+	s.Requests++
+	s.Duration += d
+	s.Downstream += downstream
+	s.DownstreamTime += downstreamTime
+	s.BytesIn += bytesIn
+	s.BytesOut += bytesOut
+}
+
+// Report return stats sorted by duration and reset
+func (m *CostAccountant) Report() []*CostStat {
+	m.mu.Lock()
+	stats := m.stats
+	m.stats = make(map[string]*CostStat)
+	m.mu.Unlock()
+
+	list := make([]*CostStat, 0, len(stats))
+	for _, s := range stats {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Duration > list[j].Duration
+	})
+	return list
+}
+
+// Run report costs into log every interval until ctx done
+func (m *CostAccountant) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultCostReportInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, s := range m.Report() {
+				js, _ := json.Marshal(s)
+				logger().Infof(ctx, "COST_REPORT\t%s", js)
+			}
+		}
+	}
+}
+
+func costCaller(ctx context.Context) string {
+	caller, _ := xcontext.GetControlCallerServerName(ctx)
+	return caller
+}
+
+type protoSizer interface {
+	XXX_Size() int
+}
+
+func protoSize(v interface{}) int64 {
+	if s, ok := v.(protoSizer); ok {
+		return int64(s.XXX_Size())
+	}
+	return 0
+}
+
+// costServerInterceptor attach cost into ctx and account it after handler
+func costServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, c := WithRequestCost(ctx, costCaller(ctx))
+		st := time.Now()
+		resp, err := handler(ctx, req)
+		AddCostBytes(ctx, protoSize(req), protoSize(resp))
+		GetCostAccountant().Finish(c, time.Since(st))
+		return resp, err
+	}
+}
+
+type costResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *costResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *costResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *costResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer not support hijack")
+	}
+	return h.Hijack()
+}
+
+func costHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, c := WithRequestCost(r.Context(), costCaller(r.Context()))
+		cw := &costResponseWriter{ResponseWriter: w}
+		st := time.Now()
+		next.ServeHTTP(cw, r.WithContext(ctx))
+		if r.ContentLength > 0 {
+			AddCostBytes(ctx, r.ContentLength, 0)
+		}
+		AddCostBytes(ctx, 0, cw.written)
+		GetCostAccountant().Finish(c, time.Since(st))
+	})
+}
+
+// costProcessor thrift 请求不携带调用方, 计入 unknown
+type costProcessor struct {
+	thrift.TProcessor
+}
+
+func (m *costProcessor) Process(in, out thrift.TProtocol) (bool, thrift.TException) {
+	rin := &messageNameProtocol{TProtocol: in}
+	_, c := WithRequestCost(context.Background(), "")
+	st := time.Now()
+	ok, err := m.TProcessor.Process(rin, out)
+	// 连接关闭时没有读到请求, 不计入
+	if len(rin.name) > 0 {
+		GetCostAccountant().Finish(c, time.Since(st))
+	}
+	return ok, err
+}
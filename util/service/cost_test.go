@@ -0,0 +1,48 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCostLabelBound(t *testing.T) {
+	ass := assert.New(t)
+
+	var set costLabelSet
+	for i := 0; i < 3; i++ {
+		ass.Equal(fmt.Sprint(i), set.bound(fmt.Sprint(i), 3))
+	}
+	ass.Equal(overflowCostLabel, set.bound("3", 3))
+	ass.Equal("1", set.bound("1", 3))
+
+	defer updateCostLabelLimit(nil, nil)
+	ass.Equal(defaultCostLabelLimit, costLabelLimit())
+	updateCostLabelLimit(nil, []byte("20"))
+	ass.Equal(20, costLabelLimit())
+	updateCostLabelLimit(nil, []byte("invalid"))
+	ass.Equal(defaultCostLabelLimit, costLabelLimit())
+	updateCostLabelLimit(nil, []byte("-1"))
+	ass.Equal(defaultCostLabelLimit, costLabelLimit())
+}
+
+func TestCostAccountant(t *testing.T) {
+	ass := assert.New(t)
+
+	m := &CostAccountant{stats: make(map[string]*CostStat)}
+	ctx, c := WithRequestCost(context.Background(), "")
+	SetCostTenant(ctx, "t1")
+	AddCostBytes(ctx, 10, 20)
+	m.Finish(c, time.Second)
+
+	list := m.Report()
+	ass.Len(list, 1)
+	ass.Equal(unknownCostLabel, list[0].Caller)
+	ass.Equal("t1", list[0].Tenant)
+	ass.Equal(int64(1), list[0].Requests)
+	ass.Equal(int64(30), list[0].BytesIn+list[0].BytesOut)
+	ass.Empty(m.Report())
+}
@@ -0,0 +1,149 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtrace"
+
+	"github.com/uber/jaeger-client-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const crashStackSize = 64 << 10
+
+// CrashReport structured report of a panic recovered in processor
+type CrashReport struct {
+	Processor string            `json:"processor"`
+	Method    string            `json:"method"`
+	TraceID   string            `json:"trace_id,omitempty"`
+	Caller    string            `json:"caller,omitempty"`
+	Panic     string            `json:"panic"`
+	Stack     string            `json:"stack"`
+	Request   map[string]string `json:"request,omitempty"`
+	Time      time.Time         `json:"time"`
+}
+
+func traceIDFromContext(ctx context.Context) string {
+	span := xtrace.SpanFromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	if sc, ok := span.Context().(jaeger.SpanContext); ok {
+		return fmt.Sprint(sc.TraceID())
+	}
+	return ""
+}
+
+// reportCrash 在 recover 之后调用, 记录崩溃报告, 计数并上报 error reporter
+func reportCrash(ctx context.Context, processor, method string, p interface{}, req map[string]string) *CrashReport {
+	fun := "reportCrash -->"
+
+	buf := make([]byte, crashStackSize)
+	buf = buf[:runtime.Stack(buf, false)]
+	r := &CrashReport{
+		Processor: processor,
+		Method:    method,
+		TraceID:   traceIDFromContext(ctx),
+		Caller:    costCaller(ctx),
+		Panic:     fmt.Sprint(p),
+		Stack:     string(buf),
+		Request:   req,
+		Time:      time.Now(),
+	}
+	js, _ := json.Marshal(r)
+	logger().Errorf(ctx, "%s crash report: %s", fun, js)
+
+	group, service := GetGroupAndService()
+	_metricPanic.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelType, processor, xprom.LabelAPI, method).Inc()
+	ReportPanic(ctx, p, buf)
+	return r
+}
+
+func httpCrashRequest(r *http.Request) map[string]string {
+	if r == nil {
+		return nil
+	}
+	return map[string]string{
+		"method":     r.Method,
+		"url":        r.URL.String(),
+		"remote":     r.RemoteAddr,
+		"user_agent": r.UserAgent(),
+	}
+}
+
+// recoveryHttpMiddleware 返回 500, http.ErrAbortHandler 按 net/http 约定继续抛出
+func recoveryHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				reportCrash(r.Context(), PROCESSOR_HTTP, r.URL.Path, p, httpCrashRequest(r))
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func recoveryUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				reportCrash(ctx, PROCESSOR_GRPC, info.FullMethod, p, map[string]string{"req": fmt.Sprintf("%v", req)})
+				err = status.Errorf(codes.Internal, "panic triggered: %v", p)
+			}
+		}()
+		return handler(ctx, req)
+	}
+}
+
+func recoveryStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				reportCrash(ss.Context(), PROCESSOR_GRPC, info.FullMethod, p, nil)
+				err = status.Errorf(codes.Internal, "panic triggered: %v", p)
+			}
+		}()
+		return handler(srv, ss)
+	}
+}
+
+// recoveryProcessor thrift 生成代码读完参数后才调用 handler, handler panic 时返回 application exception, 连接继续可用
+type recoveryProcessor struct {
+	thrift.TProcessor
+}
+
+func (m *recoveryProcessor) Process(in, out thrift.TProtocol) (ok bool, terr thrift.TException) {
+	name, typeId, seqid, err := in.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			reportCrash(context.Background(), PROCESSOR_THRIFT, name, p, map[string]string{"seqid": fmt.Sprint(seqid)})
+			x := thrift.NewTApplicationException(thrift.INTERNAL_ERROR, fmt.Sprintf("panic triggered: %v", p))
+			out.WriteMessageBegin(name, thrift.EXCEPTION, seqid)
+			x.Write(out)
+			out.WriteMessageEnd()
+			if err := out.Flush(); err != nil {
+				ok, terr = false, err
+				return
+			}
+			ok, terr = true, nil
+		}
+	}()
+	return m.TProcessor.Process(&messageBeginProtocol{TProtocol: in, name: name, typeId: typeId, seqid: seqid}, out)
+}
@@ -0,0 +1,54 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type panicProcessor struct{}
+
+func (m *panicProcessor) Process(in, out thrift.TProtocol) (bool, thrift.TException) {
+	in.ReadMessageBegin()
+	in.ReadMessageEnd()
+	panic("boom")
+}
+
+func TestRecovery(t *testing.T) {
+	ass := assert.New(t)
+
+	h := recoveryHttpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	ass.Equal(http.StatusInternalServerError, w.Code)
+
+	unary := recoveryUnaryServerInterceptor()
+	_, err := unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Serv/Panic"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	ass.Equal(codes.Internal, status.Code(err))
+
+	in := thrift.NewTBinaryProtocolTransport(thrift.NewTMemoryBuffer())
+	ass.Nil(in.WriteMessageBegin("Panic", thrift.CALL, 7))
+	ass.Nil(in.WriteMessageEnd())
+	outBuf := thrift.NewTMemoryBuffer()
+	out := thrift.NewTBinaryProtocolTransport(outBuf)
+
+	ok, terr := (&recoveryProcessor{&panicProcessor{}}).Process(in, out)
+	ass.True(ok)
+	ass.Nil(terr)
+	name, typeId, seqid, err := out.ReadMessageBegin()
+	ass.Nil(err)
+	ass.Equal("Panic", name)
+	ass.Equal(thrift.EXCEPTION, typeId)
+	ass.Equal(int32(7), seqid)
+}
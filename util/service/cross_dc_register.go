@@ -6,7 +6,6 @@ import (
 	"strconv"
 	"time"
 
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 	"gitlab.pri.ibanyu.com/middleware/util/servbase"
 
 	etcd "github.com/coreos/etcd/client"
@@ -16,19 +15,28 @@ import (
 func (m *ServBaseV2) RegisterCrossDCService(servs map[string]*ServInfo) error {
 	fun := "ServBaseV2.RegisterService -->"
 	ctx := context.Background()
+	if m.deferRegistration("cross_dc", func() error { return m.RegisterCrossDCService(servs) }) {
+		return nil
+	}
+	m.muReg.Lock()
+	m.regCrossDC = true
+	m.muReg.Unlock()
+
 	err := m.RegisterServiceV2(servs, BASE_LOC_REG_SERV, true)
 	if err != nil {
-		xlog.Errorf(ctx, "%s register server v2 failed, err: %v", fun, err)
+		logger().Errorf(ctx, "%s register server v2 failed, err: %v", fun, err)
 		return err
 	}
 
-	err = m.RegisterServiceV1(servs, true)
-	if err != nil {
-		xlog.Errorf(ctx, "%s register server v1 failed, err: %v", fun, err)
-		return err
+	if m.getRegState() == RegStateActive {
+		err = m.RegisterServiceV1(servs, true)
+		if err != nil {
+			logger().Errorf(ctx, "%s register server v1 failed, err: %v", fun, err)
+			return err
+		}
 	}
 
-	xlog.Infof(ctx, "%s register cross dc server ok", fun)
+	logger().Infof(ctx, "%s register cross dc server ok", fun)
 
 	return nil
 }
@@ -37,44 +45,12 @@ func (m *ServBaseV2) doCrossDCRegister(path, js string, refresh bool) error {
 	fun := "ServBaseV2.doCrossDCRegister -->"
 	ctx := context.Background()
 	for addr, _ := range m.crossRegisterClients {
-		// 创建完成标志
-		var isCreated bool
-
 		go func(etcdAddr string) {
-
+			// 已写入的注册信息, 为空表示未创建
+			var written string
 			for j := 0; ; j++ {
 				updateEtcd := func() {
-					var err error
-					var r *etcd.Response
-					if !isCreated {
-						xlog.Warnf(ctx, "%s create idx:%d server_info: %s", fun, j, js)
-						r, err = m.crossRegisterClients[etcdAddr].Set(context.Background(), path, js, &etcd.SetOptions{
-							TTL: time.Second * 60,
-						})
-					} else {
-						if refresh {
-							// 在刷新ttl时候，不允许变更value
-							r, err = m.crossRegisterClients[etcdAddr].Set(context.Background(), path, "", &etcd.SetOptions{
-								PrevExist: etcd.PrevExist,
-								TTL:       time.Second * 60,
-								Refresh:   true,
-							})
-						} else {
-							r, err = m.crossRegisterClients[etcdAddr].Set(context.Background(), path, js, &etcd.SetOptions{
-								TTL: time.Second * 60,
-							})
-						}
-
-					}
-
-					if err != nil {
-						isCreated = false
-						xlog.Errorf(ctx, "%s reg error, round: %d, addr: %s, resp: %v, err: %v", fun, j, etcdAddr, r, err)
-
-					} else {
-						isCreated = true
-						xlog.Infof(ctx, " %s reg success, round: %d, addr: %s", fun, j, etcdAddr)
-					}
+					written = m.crossDCRegisterRound(ctx, etcdAddr, path, js, written, refresh, j)
 				}
 
 				withRegLockRunClosureBeforeStop(m, ctx, fun, updateEtcd)
@@ -82,7 +58,7 @@ func (m *ServBaseV2) doCrossDCRegister(path, js string, refresh bool) error {
 				time.Sleep(time.Second * 20)
 
 				if m.isStop() {
-					xlog.Infof(ctx, "%s server stop, register info [%s] clear", fun, path)
+					logger().Infof(ctx, "%s server stop, register info [%s] clear", fun, path)
 					return
 				}
 			}
@@ -93,6 +69,38 @@ func (m *ServBaseV2) doCrossDCRegister(path, js string, refresh bool) error {
 	return nil
 }
 
+// crossDCRegisterRound 跨机房注册一轮, 调用方需持有 muReg; 注册信息在激活等更新后与已写入的不同,
+// 此时重新写入而不是只刷新 ttl, 返回本轮写入后节点的值, 失败时为空
+func (m *ServBaseV2) crossDCRegisterRound(ctx context.Context, etcdAddr, path, js, written string, refresh bool, round int) string {
+	fun := "ServBaseV2.crossDCRegisterRound -->"
+
+	var err error
+	var r *etcd.Response
+	js = m.getRegisterInfoLocked(path, js)
+	if refresh && written == js {
+		// 在刷新ttl时候，不允许变更value
+		r, err = m.crossRegisterClients[etcdAddr].Set(context.Background(), path, "", &etcd.SetOptions{
+			PrevExist: etcd.PrevExist,
+			TTL:       time.Second * 60,
+			Refresh:   true,
+		})
+	} else {
+		if written != js {
+			logger().Warnf(ctx, "%s create idx:%d server_info: %s", fun, round, js)
+		}
+		r, err = m.crossRegisterClients[etcdAddr].Set(context.Background(), path, js, &etcd.SetOptions{
+			TTL: time.Second * 60,
+		})
+	}
+
+	if err != nil {
+		logger().Errorf(ctx, "%s reg error, round: %d, addr: %s, resp: %v, err: %v", fun, round, etcdAddr, r, err)
+		return ""
+	}
+	logger().Infof(ctx, " %s reg success, round: %d, addr: %s", fun, round, etcdAddr)
+	return js
+}
+
 func (m *ServBaseV2) clearCrossDCRegisterInfos() {
 	fun := "ServBaseV2.clearCrossDCRegisterInfos -->"
 	ctx := context.Background()
@@ -108,7 +116,7 @@ func (m *ServBaseV2) clearCrossDCRegisterInfos() {
 				Recursive: true,
 			})
 			if err != nil {
-				xlog.Warnf(ctx, "%s path: %s, err: %v", fun, path, err)
+				logger().Warnf(ctx, "%s path: %s, err: %v", fun, path, err)
 			}
 		}
 	}
@@ -127,7 +135,7 @@ func initCrossRegisterCenter(sb *ServBaseV2) error {
 func initCrossRegisterCenterOrigin(sb *ServBaseV2) error {
 	fun := "initCrossRegisterCenterOrigin --> "
 	ctx := context.Background()
-	xlog.Infof(ctx, "%s start", fun)
+	logger().Infof(ctx, "%s start", fun)
 
 	var baseConfig BaseConfig
 	err := sb.ServConfig(&baseConfig)
@@ -135,19 +143,14 @@ func initCrossRegisterCenterOrigin(sb *ServBaseV2) error {
 		return err
 	}
 	for _, addr := range baseConfig.Base.CrossRegisterCenters {
-		baseCfg := etcd.Config{
-			Endpoints: []string{addr},
-			Transport: etcd.DefaultTransport,
-		}
-		baseClient, err := etcd.New(baseCfg)
+		baseKeysAPI, err := newEtcdKeysAPI([]string{addr}, sb.confEtcd.useBaseloc)
 		if err != nil {
-			return fmt.Errorf("create etcd client failed, config: %v, err: %v", baseCfg, err)
+			return fmt.Errorf("create etcd client failed, addr: %s, err: %v", addr, err)
 		}
-		baseKeysAPI := etcd.NewKeysAPI(baseClient) // not nil
 		sb.crossRegisterClients[addr] = baseKeysAPI
 	}
 
-	xlog.Infof(ctx, "%s success", fun)
+	logger().Infof(ctx, "%s success", fun)
 	return nil
 }
 
@@ -155,29 +158,24 @@ func initCrossRegisterCenterOrigin(sb *ServBaseV2) error {
 func initCrossRegisterCenterNew(sb *ServBaseV2) error {
 	fun := "initCrossRegisterCenterNew --> "
 	ctx := context.Background()
-	xlog.Infof(ctx, "%s start", fun)
+	logger().Infof(ctx, "%s start", fun)
 
 	for _, regionId := range sb.crossRegisterRegionIds {
 		endpoints, ok := servbase.GetCrossRegisterEndpoints(regionId)
 		if !ok {
-			xlog.Errorf(ctx, "%s region has no endpoints, id: %d", fun, regionId)
+			logger().Errorf(ctx, "%s region has no endpoints, id: %d", fun, regionId)
 			return fmt.Errorf("region has no endpoints, id: %d", regionId)
 		}
-		baseCfg := etcd.Config{
-			Endpoints: endpoints,
-			Transport: etcd.DefaultTransport,
-		}
-		baseClient, err := etcd.New(baseCfg)
+		baseKeysAPI, err := newEtcdKeysAPI(endpoints, sb.confEtcd.useBaseloc)
 		if err != nil {
-			xlog.Errorf(ctx, "%s create etcd client failed, regionId: %v, config: %v, err: %v", fun, regionId, baseCfg, err)
-			return fmt.Errorf("create etcd client failed, regionId: %v, config: %v, err: %v", regionId, baseCfg, err)
+			logger().Errorf(ctx, "%s create etcd client failed, regionId: %v, endpoints: %v, err: %v", fun, regionId, endpoints, err)
+			return fmt.Errorf("create etcd client failed, regionId: %v, endpoints: %v, err: %v", regionId, endpoints, err)
 		}
-		baseKeysAPI := etcd.NewKeysAPI(baseClient)
 
 		regionIdStr := strconv.Itoa(regionId)
 		sb.crossRegisterClients[regionIdStr] = baseKeysAPI
 	}
 
-	xlog.Infof(ctx, "%s success", fun)
+	logger().Infof(ctx, "%s success", fun)
 	return nil
 }
@@ -0,0 +1,111 @@
+package rocserv
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// /_debug/ 的访问口令及来源地址白名单, 在应用配置中设置, 都未设置时不可用
+	debugTokenKey = "debug_token"
+	// 逗号分隔的 ip 或 cidr, 只检查连接的来源地址, 不信任 X-Forwarded-For
+	debugAllowIPsKey = "debug_allow_ips"
+)
+
+// registerDebugHandlers pprof 及 expvar, 如 /_debug/pprof/heap, /_debug/vars, 以及诊断数据的采集
+func registerDebugHandlers(router *httprouter.Router) {
+	router.Handler(http.MethodGet, "/_debug/pprof/*name", debugAuth(http.HandlerFunc(pprofHandler)))
+	router.Handler(http.MethodPost, "/_debug/pprof/*name", debugAuth(http.HandlerFunc(pprofHandler)))
+	router.Handler(http.MethodGet, "/_debug/vars", debugAuth(expvar.Handler()))
+
+	// 按需采集 goroutine dump, heap profile, cpu profile 及 trace
+	router.Handler(http.MethodGet, "/backdoor/diagnostics/:kind", debugAuth(http.HandlerFunc(diagnosticsHandler)))
+}
+
+// pprofHandler pprof.Index 按 /debug/pprof/ 前缀解析 profile 名称
+func pprofHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(httprouter.ParamsFromContext(r.Context()).ByName("name"), "/")
+	r.URL.Path = "/debug/pprof/" + name
+	switch name {
+	case "cmdline":
+		pprof.Cmdline(w, r)
+	case "profile":
+		pprof.Profile(w, r)
+	case "symbol":
+		pprof.Symbol(w, r)
+	case "trace":
+		pprof.Trace(w, r)
+	default:
+		pprof.Index(w, r)
+	}
+}
+
+func debugConf() (token, allowIPs string) {
+	if server.sbase == nil || server.sbase.ConfigCenter() == nil {
+		return "", ""
+	}
+	c := server.sbase.ConfigCenter()
+	token, _ = c.GetString(context.TODO(), debugTokenKey)
+	allowIPs, _ = c.GetString(context.TODO(), debugAllowIPsKey)
+	return token, allowIPs
+}
+
+// debugAuth 来源地址在白名单中或者口令正确时允许访问, 口令的使用方式同管理页面
+func debugAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fun := "debugAuth -->"
+		token, allowIPs := debugConf()
+		if len(token) == 0 && len(allowIPs) == 0 {
+			http.Error(w, fmt.Sprintf("debug disabled, set %s or %s in config to enable", debugTokenKey, debugAllowIPsKey), http.StatusForbidden)
+			return
+		}
+
+		if debugAuthorized(r, token, allowIPs) {
+			logger().Infof(r.Context(), "%s remote: %s access: %s", fun, r.RemoteAddr, r.URL.Path)
+			h.ServeHTTP(w, r)
+			return
+		}
+		if len(token) > 0 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="roc debug"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func debugAuthorized(r *http.Request, token, allowIPs string) bool {
+	if len(allowIPs) > 0 && ipAllowed(r.RemoteAddr, allowIPs) {
+		return true
+	}
+	return len(token) > 0 && adminUIAuthorized(r, token)
+}
+
+func ipAllowed(remoteAddr, allowIPs string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, item := range strings.Split(allowIPs, ",") {
+		item = strings.TrimSpace(item)
+		if strings.Contains(item, "/") {
+			if _, ipNet, err := net.ParseCIDR(item); err == nil && ipNet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if allow := net.ParseIP(item); allow != nil && allow.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
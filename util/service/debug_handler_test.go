@@ -0,0 +1,55 @@
+package rocserv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugAuth(t *testing.T) {
+	ass := assert.New(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/_debug/vars", nil)
+	r.RemoteAddr = "10.1.2.3:5000"
+	ass.True(debugAuthorized(r, "", "10.0.0.0/8"))
+	ass.True(debugAuthorized(r, "", "127.0.0.1, 10.1.2.3"))
+	ass.False(debugAuthorized(r, "", "192.168.0.0/16,bad"))
+	ass.False(debugAuthorized(r, "secret", "192.168.0.0/16"))
+	r.Header.Set("Authorization", "Bearer secret")
+	ass.True(debugAuthorized(r, "secret", "192.168.0.0/16"))
+	// 不信任 X-Forwarded-For
+	r = httptest.NewRequest(http.MethodGet, "/_debug/vars", nil)
+	r.Header.Set("X-Forwarded-For", "10.1.2.3")
+	ass.False(debugAuthorized(r, "", "10.0.0.0/8"))
+
+	// 未配置时不可用
+	router := httprouter.New()
+	registerDebugHandlers(router)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_debug/pprof/heap", nil))
+	ass.Equal(http.StatusForbidden, w.Code)
+}
+
+func TestPprofHandler(t *testing.T) {
+	ass := assert.New(t)
+
+	router := httprouter.New()
+	router.Handler(http.MethodGet, "/_debug/pprof/*name", http.HandlerFunc(pprofHandler))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_debug/pprof/", nil))
+	ass.Equal(http.StatusOK, w.Code)
+	ass.Contains(w.Body.String(), "goroutine")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_debug/pprof/goroutine?debug=1", nil))
+	ass.Equal(http.StatusOK, w.Code)
+	ass.Contains(w.Body.String(), "goroutine profile")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/_debug/pprof/cmdline", nil))
+	ass.Equal(http.StatusOK, w.Code)
+}
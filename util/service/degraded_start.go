@@ -0,0 +1,141 @@
+package rocserv
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+// DegradedStartEnv set to 1 to start serving without registration when etcd is unavailable, same as WithDegradedStart
+const DegradedStartEnv = "ROC_DEGRADED_START"
+
+const (
+	// 降级启动时获取 servid 之前使用的 servid
+	pendingServid = -1
+	// 降级启动后获取 servid 的重试间隔
+	degradedSidRetryInterval = 5 * time.Second
+	// 重试失败的日志每分钟一条
+	degradedSidLogEvery = 12
+)
+
+func degradedStartFromEnv() bool {
+	return os.Getenv(DegradedStartEnv) == "1"
+}
+
+// pendingRegistrations 降级启动时获取 servid 之前的注册, 同名的只保留最后一次, 按首次加入的顺序执行
+type pendingRegistrations struct {
+	mu      sync.Mutex
+	waiting bool
+	since   time.Time
+	names   []string
+	fns     map[string]func() error
+}
+
+func (m *pendingRegistrations) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waiting = true
+	m.since = time.Now()
+	m.fns = make(map[string]func() error)
+}
+
+func (m *pendingRegistrations) isWaiting() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.waiting
+}
+
+// add 未在等待时返回 false, 由调用方直接注册
+func (m *pendingRegistrations) add(name string, fn func() error) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.waiting {
+		return false
+	}
+	if _, ok := m.fns[name]; !ok {
+		m.names = append(m.names, name)
+	}
+	m.fns[name] = fn
+	return true
+}
+
+// finish 结束等待, 返回等待的时长及延迟的注册, 之后的注册直接执行
+func (m *pendingRegistrations) finish() (time.Duration, []string, []func() error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waiting = false
+	fns := make([]func() error, 0, len(m.names))
+	for _, name := range m.names {
+		fns = append(fns, m.fns[name])
+	}
+	names := m.names
+	m.names, m.fns = nil, nil
+	return time.Since(m.since), names, fns
+}
+
+// deferRegistration 降级启动获取 servid 之前, fn 在获取后执行并返回 true; 注册路径包含 servid, 不能提前写入
+func (m *ServBaseV2) deferRegistration(name string, fn func() error) bool {
+	if !m.pendingRegs.add(name, fn) {
+		return false
+	}
+	logger().Infof(context.Background(), "ServBaseV2.deferRegistration --> servid pending, defer: %s", name)
+	return true
+}
+
+// RegistrationPending whether the instance started degraded without etcd and is serving unregistered,
+// registration is done in background once servid is got from etcd, see WithDegradedStart
+func (m *ServBaseV2) RegistrationPending() bool {
+	return m.pendingRegs.isWaiting()
+}
+
+// startDegraded 启动时 etcd 不可用, 先以 pendingServid 启动, 后台获取 servid 后完成注册
+func (m *ServBaseV2) startDegraded(sidPath string) {
+	m.pendingRegs.start()
+	group, service := GetGroupAndService()
+	_metricRegistrationPending.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Set(1)
+	go m.acquireServidLoop(sidPath)
+}
+
+func (m *ServBaseV2) acquireServidLoop(sidPath string) {
+	fun := "ServBaseV2.acquireServidLoop -->"
+	ctx := context.Background()
+
+	for i := 0; !m.isStop(); i++ {
+		sid, err := genSid(m.etcdClient, sidPath, m.sessKey)
+		if err == nil {
+			m.servidAcquired(sid)
+			return
+		}
+		if i%degradedSidLogEvery == 0 {
+			logger().Warnf(ctx, "%s registration pending, try: %d err: %v", fun, i, err)
+		}
+		time.Sleep(degradedSidRetryInterval)
+	}
+}
+
+// servidAcquired 初始化启动时跳过的跨机房注册中心, 再执行延迟的注册
+func (m *ServBaseV2) servidAcquired(sid int) {
+	fun := "ServBaseV2.servidAcquired -->"
+	ctx := context.Background()
+
+	m.servId = sid
+	if m.crossRegisterPending {
+		if err := initCrossRegisterCenter(m); err != nil {
+			logger().Errorf(ctx, "%s init cross register center err: %v", fun, err)
+		}
+	}
+
+	pending, names, fns := m.pendingRegs.finish()
+	logger().Infof(ctx, "%s servid: %d after degraded: %v, register: %v", fun, sid, pending, names)
+	for i, fn := range fns {
+		if err := fn(); err != nil {
+			logger().Errorf(ctx, "%s register: %s err: %v", fun, names[i], err)
+		}
+	}
+
+	group, service := GetGroupAndService()
+	_metricRegistrationPending.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Set(0)
+}
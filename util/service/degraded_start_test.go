@@ -0,0 +1,53 @@
+package rocserv
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingRegistrations(t *testing.T) {
+	ass := assert.New(t)
+
+	sb := &ServBaseV2{servId: pendingServid}
+	var calls []string
+	register := func(name string) func() error {
+		return func() error {
+			calls = append(calls, name)
+			if name == "bad" {
+				return errors.New("register failed")
+			}
+			return nil
+		}
+	}
+
+	// 未降级时直接注册
+	ass.False(sb.RegistrationPending())
+	ass.False(sb.deferRegistration("service", register("service")))
+
+	sb.pendingRegs.start()
+	ass.True(sb.RegistrationPending())
+	ass.True(sb.deferRegistration("system:backdoor", register("backdoor")))
+	ass.True(sb.deferRegistration("service", register("service-1")))
+	ass.True(sb.deferRegistration("bad", register("bad")))
+	ass.True(sb.deferRegistration("manual", register("manual")))
+	// 同名的保留最后一次, 顺序不变
+	ass.True(sb.deferRegistration("service", register("service-2")))
+	ass.Empty(calls)
+
+	old := server.sbase
+	server.sbase = sb
+	ass.True(IsDegraded())
+
+	// 失败的注册不影响之后的注册
+	sb.servidAcquired(3)
+	ass.Equal(3, sb.Servid())
+	ass.Equal([]string{"backdoor", "service-2", "bad", "manual"}, calls)
+	ass.False(sb.RegistrationPending())
+	server.sbase = old
+
+	calls = nil
+	ass.False(sb.deferRegistration("service", register("service")))
+	ass.Empty(calls)
+}
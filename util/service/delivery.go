@@ -0,0 +1,308 @@
+package rocserv
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+// delivery status
+const (
+	DeliveryPending = "pending"
+	DeliveryDone    = "done"
+	DeliveryFailed  = "failed"
+)
+
+const (
+	// 投递 worker 选主使用的局部分布式锁
+	deliveryLeaderLock = "webhook-delivery"
+
+	// HeaderDeliverySignature t=timestamp,v1=hex(hmac_sha256(secret, timestamp.body)), same as Stripe-Signature
+	HeaderDeliverySignature = "X-Roc-Signature"
+	HeaderDeliveryID        = "X-Roc-Delivery"
+
+	defaultDeliveryTimeout      = 10 * time.Second
+	defaultDeliveryPollInterval = time.Second
+	defaultDeliveryBatch        = 100
+)
+
+var ErrDeliveryNotFound = errors.New("delivery not found")
+
+// DefaultDeliverySchedule delay before each retry, delivery fails after len(schedule)+1 attempts
+var DefaultDeliverySchedule = []time.Duration{
+	10 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour, 6 * time.Hour,
+}
+
+// Delivery one outbound webhook request
+type Delivery struct {
+	ID          string      `json:"id"`
+	Destination string      `json:"destination"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	CreatedAt   time.Time   `json:"created_at"`
+
+	Status     string    `json:"status"`
+	Attempts   int       `json:"attempts"`
+	LastError  string    `json:"last_error"`
+	LastStatus int       `json:"last_status"`
+	NextAt     time.Time `json:"next_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// DeliveryStore durable store of deliveries, with several replicas it must be shared
+// such as database, since only the leader replica delivers
+type DeliveryStore interface {
+	Add(d *Delivery) error
+	Update(d *Delivery) error
+	Get(id string) (*Delivery, error)
+	// Due pending deliveries whose NextAt is not after now, at most limit
+	Due(now time.Time, limit int) ([]*Delivery, error)
+}
+
+// DeliveryDestination external url receiving deliveries
+type DeliveryDestination struct {
+	Name string
+	URL  string
+	// 签名密钥, 为空时不签名
+	Secret []byte
+	// 每秒投递数上限及突发, 0 为不限制
+	RateLimit float64
+	Burst     float64
+	// 单次请求超时, 0 为默认 10s
+	Timeout time.Duration
+}
+
+// DeliveryDispatcher send deliveries to destinations with retry schedule, signing,
+// per-destination rate limit and circuit breaker; only the replica holding leader lock delivers
+type DeliveryDispatcher struct {
+	store    DeliveryStore
+	dests    map[string]*DeliveryDestination
+	limiters map[string]*tokenBucket
+	breakers *instanceBreakers
+	client   *http.Client
+	notify   chan struct{}
+
+	// 重试间隔, 为空时使用 DefaultDeliverySchedule
+	Schedule     []time.Duration
+	PollInterval time.Duration
+}
+
+// NewDeliveryDispatcher create dispatcher with store and destinations, circuit breaker of
+// destinations uses DefaultInstanceBreakerConf
+func NewDeliveryDispatcher(store DeliveryStore, dests ...*DeliveryDestination) (*DeliveryDispatcher, error) {
+	if store == nil {
+		return nil, fmt.Errorf("delivery store nil")
+	}
+	m := &DeliveryDispatcher{
+		store:        store,
+		dests:        make(map[string]*DeliveryDestination),
+		limiters:     make(map[string]*tokenBucket),
+		breakers:     newInstanceBreakers("webhook_delivery", DefaultInstanceBreakerConf),
+		client:       &http.Client{},
+		notify:       make(chan struct{}, 1),
+		Schedule:     DefaultDeliverySchedule,
+		PollInterval: defaultDeliveryPollInterval,
+	}
+	for _, d := range dests {
+		if d == nil || len(d.Name) == 0 || len(d.URL) == 0 {
+			return nil, fmt.Errorf("delivery destination need name and url")
+		}
+		if _, ok := m.dests[d.Name]; ok {
+			return nil, fmt.Errorf("delivery destination: %s duplicated", d.Name)
+		}
+		m.dests[d.Name] = d
+		if d.RateLimit > 0 {
+			burst := d.Burst
+			if burst < 1 {
+				burst = 1
+			}
+			m.limiters[d.Name] = newTokenBucket(d.RateLimit, burst)
+		}
+	}
+	return m, nil
+}
+
+func newDeliveryID() string {
+	bs := make([]byte, 16)
+	rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
+
+// Enqueue save delivery into store, it is sent by the leader asynchronously
+func (m *DeliveryDispatcher) Enqueue(ctx context.Context, dest string, body []byte, header http.Header) (string, error) {
+	if _, ok := m.dests[dest]; !ok {
+		return "", fmt.Errorf("delivery destination: %s not found", dest)
+	}
+	now := time.Now()
+	d := &Delivery{
+		ID:          newDeliveryID(),
+		Destination: dest,
+		Header:      header,
+		Body:        body,
+		CreatedAt:   now,
+		Status:      DeliveryPending,
+		NextAt:      now,
+		UpdatedAt:   now,
+	}
+	if err := m.store.Add(d); err != nil {
+		return "", err
+	}
+	m.stat(dest, "enqueued")
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+	return d.ID, nil
+}
+
+// Redeliver reset delivery to pending, attempts are cleared
+func (m *DeliveryDispatcher) Redeliver(id string) error {
+	d, err := m.store.Get(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	d.Status, d.Attempts, d.LastError, d.NextAt, d.UpdatedAt = DeliveryPending, 0, "", now, now
+	return m.store.Update(d)
+}
+
+// Run acquire leader lock of sb then deliver until ctx done, it blocks while other replica is leader
+func (m *DeliveryDispatcher) Run(ctx context.Context, sb ServBase) error {
+	fun := "DeliveryDispatcher.Run -->"
+
+	if err := sb.Lock(deliveryLeaderLock); err != nil {
+		logger().Errorf(ctx, "%s lock err: %v", fun, err)
+		return err
+	}
+	defer sb.Unlock(deliveryLeaderLock)
+	logger().Infof(ctx, "%s become leader", fun)
+
+	ticker := time.NewTicker(m.PollInterval)
+	defer ticker.Stop()
+	for {
+		m.deliverDue(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-m.notify:
+		}
+	}
+}
+
+func (m *DeliveryDispatcher) deliverDue(ctx context.Context) {
+	fun := "DeliveryDispatcher.deliverDue -->"
+
+	due, err := m.store.Due(time.Now(), defaultDeliveryBatch)
+	if err != nil {
+		logger().Errorf(ctx, "%s due err: %v", fun, err)
+		return
+	}
+	for _, d := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		dest, ok := m.dests[d.Destination]
+		if !ok {
+			m.finish(ctx, d, 0, fmt.Errorf("destination: %s not found", d.Destination), true)
+			continue
+		}
+		// 熔断及限流时不计入重试次数, 下一轮再投递
+		if !m.breakers.acquire(dest.Name) {
+			m.stat(dest.Name, "breaker_open")
+			continue
+		}
+		if l, ok := m.limiters[dest.Name]; ok && !l.Allow() {
+			m.stat(dest.Name, "rate_limited")
+			continue
+		}
+
+		code, err := m.send(ctx, dest, d)
+		m.breakers.report(dest.Name, err != nil && (code == 0 || code >= 500))
+		m.finish(ctx, d, code, err, false)
+	}
+}
+
+func (m *DeliveryDispatcher) send(ctx context.Context, dest *DeliveryDestination, d *Delivery) (int, error) {
+	timeout := dest.Timeout
+	if timeout <= 0 {
+		timeout = defaultDeliveryTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, dest.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	for k, vs := range d.Header {
+		req.Header[k] = vs
+	}
+	if len(req.Header.Get("Content-Type")) == 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(HeaderDeliveryID, d.ID)
+	if len(dest.Secret) > 0 {
+		req.Header.Set(HeaderDeliverySignature, signDelivery(dest.Secret, time.Now(), d.Body))
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// signDelivery 与 Stripe-Signature 格式相同, 接收方可使用 StripeVerifier 校验
+func signDelivery(secret []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(hmacSHA256(secret, append([]byte(ts+"."), body...)))
+}
+
+func (m *DeliveryDispatcher) finish(ctx context.Context, d *Delivery, code int, err error, permanent bool) {
+	fun := "DeliveryDispatcher.finish -->"
+
+	now := time.Now()
+	d.Attempts++
+	d.LastStatus = code
+	d.UpdatedAt = now
+	switch {
+	case err == nil:
+		d.Status, d.LastError = DeliveryDone, ""
+	// 4xx 除 408 和 429 外重试也不会成功
+	case permanent || d.Attempts > len(m.Schedule) || (code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests):
+		logger().Errorf(ctx, "%s destination: %s id: %s failed after %d attempts err: %v", fun, d.Destination, d.ID, d.Attempts, err)
+		d.Status, d.LastError = DeliveryFailed, err.Error()
+	default:
+		logger().Warnf(ctx, "%s destination: %s id: %s attempt: %d err: %v", fun, d.Destination, d.ID, d.Attempts, err)
+		d.LastError = err.Error()
+		d.NextAt = now.Add(m.Schedule[d.Attempts-1])
+	}
+	m.stat(d.Destination, d.Status)
+
+	if err := m.store.Update(d); err != nil {
+		logger().Errorf(ctx, "%s destination: %s id: %s update err: %v", fun, d.Destination, d.ID, err)
+	}
+}
+
+func (m *DeliveryDispatcher) stat(dest, result string) {
+	group, service := GetGroupAndService()
+	_metricDelivery.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelEndpoint, dest, labelStatus, result).Inc()
+}
@@ -0,0 +1,107 @@
+package rocserv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileDeliveryStore DeliveryStore saving each delivery as a json file under dir,
+// only suitable for single replica or dir on shared volume
+type FileDeliveryStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileDeliveryStore create file store in dir, dir is created if not exist
+func NewFileDeliveryStore(dir string) (*FileDeliveryStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileDeliveryStore{dir: dir}, nil
+}
+
+func (m *FileDeliveryStore) path(id string) string {
+	return filepath.Join(m.dir, id+".json")
+}
+
+// Add implements DeliveryStore
+func (m *FileDeliveryStore) Add(d *Delivery) error {
+	return m.Update(d)
+}
+
+// Update implements DeliveryStore, write temp file then rename to avoid partial file
+func (m *FileDeliveryStore) Update(d *Delivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	bs, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	p := m.path(d.ID)
+	if err := ioutil.WriteFile(p+".tmp", bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func (m *FileDeliveryStore) read(p string) (*Delivery, error) {
+	bs, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	d := &Delivery{}
+	if err := json.Unmarshal(bs, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Get implements DeliveryStore
+func (m *FileDeliveryStore) Get(id string) (*Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, err := m.read(m.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrDeliveryNotFound
+	}
+	return d, err
+}
+
+// Due implements DeliveryStore, deliveries are sorted by NextAt
+func (m *FileDeliveryStore) Due(now time.Time, limit int) ([]*Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files, err := ioutil.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	var due []*Delivery
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		d, err := m.read(filepath.Join(m.dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if d.Status == DeliveryPending && !d.NextAt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAt.Before(due[j].NextAt)
+	})
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
@@ -0,0 +1,63 @@
+package rocserv
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryDispatcher(t *testing.T) {
+	ass := assert.New(t)
+
+	secret := []byte("s3cret")
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Header.Set("Stripe-Signature", r.Header.Get(HeaderDeliverySignature))
+		if err := StripeVerifier(0, secret).Verify(r, body); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "delivery")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+	store, err := NewFileDeliveryStore(dir)
+	ass.Nil(err)
+
+	m, err := NewDeliveryDispatcher(store, &DeliveryDestination{Name: "partner", URL: ts.URL, Secret: secret})
+	ass.Nil(err)
+	m.Schedule = []time.Duration{0}
+
+	ctx := context.Background()
+	id, err := m.Enqueue(ctx, "partner", []byte(`{"order":1}`), nil)
+	ass.Nil(err)
+	_, err = m.Enqueue(ctx, "unknown", nil, nil)
+	ass.NotNil(err)
+
+	m.deliverDue(ctx)
+	d, err := store.Get(id)
+	ass.Nil(err)
+	ass.Equal(DeliveryPending, d.Status)
+	ass.Equal(http.StatusServiceUnavailable, d.LastStatus)
+
+	m.deliverDue(ctx)
+	d, _ = store.Get(id)
+	ass.Equal(DeliveryDone, d.Status)
+	ass.Equal(2, d.Attempts)
+	ass.Equal(2, calls)
+}
@@ -0,0 +1,281 @@
+package rocserv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+const (
+	defaultDependencyLatency   = 500 * time.Millisecond
+	defaultDependencyErrorRate = 0.5
+	defaultDependencyAlpha     = 0.1
+	defaultDependencyMinSample = 20
+	// 恢复阈值为降级阈值的比例, 避免在阈值附近反复切换
+	defaultDependencyRecoverRatio = 0.8
+	// 降级后长时间没有调用时自动恢复, 让流量重新探测依赖状态
+	defaultDependencyIdleRecover = 30 * time.Second
+
+	dependencyCheckInterval = 5 * time.Second
+)
+
+// DependencyPolicy thresholds to decide whether a dependency is struggling
+type DependencyPolicy struct {
+	Latency      time.Duration
+	ErrorRate    float64
+	Alpha        float64
+	MinSamples   int
+	RecoverRatio float64
+	IdleRecover  time.Duration
+}
+
+func defaultDependencyPolicy() *DependencyPolicy {
+	return &DependencyPolicy{
+		Latency:      defaultDependencyLatency,
+		ErrorRate:    defaultDependencyErrorRate,
+		Alpha:        defaultDependencyAlpha,
+		MinSamples:   defaultDependencyMinSample,
+		RecoverRatio: defaultDependencyRecoverRatio,
+		IdleRecover:  defaultDependencyIdleRecover,
+	}
+}
+
+// DependencyState health of one downstream target
+type DependencyState struct {
+	Target    string        `json:"target"`
+	Latency   time.Duration `json:"latency"`
+	ErrorRate float64       `json:"error_rate"`
+	Samples   int           `json:"samples"`
+	Degraded  bool          `json:"degraded"`
+	Since     time.Time     `json:"since"`
+
+	lastObserve time.Time
+}
+
+// DegradeHandler notified when dependency becomes struggling or recovered,
+// handlers can switch to cached or partial responses in Degrade
+type DegradeHandler interface {
+	Degrade(state DependencyState)
+	Recovered(state DependencyState)
+}
+
+// DegradeFuncs adapter of DegradeHandler from functions
+type DegradeFuncs struct {
+	OnDegrade   func(state DependencyState)
+	OnRecovered func(state DependencyState)
+}
+
+func (m *DegradeFuncs) Degrade(state DependencyState) {
+	if m.OnDegrade != nil {
+		m.OnDegrade(state)
+	}
+}
+
+func (m *DegradeFuncs) Recovered(state DependencyState) {
+	if m.OnRecovered != nil {
+		m.OnRecovered(state)
+	}
+}
+
+// DependencyDetector track latency and error EWMA of downstream targets
+type DependencyDetector struct {
+	// target -> *dependencyTarget, 每个 target 单独加锁, 请求链路上不争用全局锁
+	states sync.Map
+
+	muConf   sync.RWMutex
+	policies map[string]*DependencyPolicy
+	handlers map[string][]DegradeHandler
+
+	// 回调串行异步执行, 不阻塞请求链路
+	notifier *WorkerPool
+}
+
+type dependencyTarget struct {
+	mu    sync.Mutex
+	state DependencyState
+}
+
+var (
+	dependencyDetector     *DependencyDetector
+	dependencyDetectorOnce sync.Once
+)
+
+// GetDependencyDetector return default detector, downstream calls of roc clients are observed automatically
+func GetDependencyDetector() *DependencyDetector {
+	dependencyDetectorOnce.Do(func() {
+		dependencyDetector = NewDependencyDetector()
+		go dependencyDetector.run()
+	})
+	return dependencyDetector
+}
+
+func NewDependencyDetector() *DependencyDetector {
+	return &DependencyDetector{
+		policies: make(map[string]*DependencyPolicy),
+		handlers: make(map[string][]DegradeHandler),
+		notifier: NewWorkerPool("dependency_notify", 1, 128),
+	}
+}
+
+// SetPolicy set policy of target, target is servkey of downstream such as "base/account"
+func (m *DependencyDetector) SetPolicy(target string, policy *DependencyPolicy) {
+	m.muConf.Lock()
+	defer m.muConf.Unlock()
+	m.policies[target] = policy
+}
+
+// RegisterHandler register handler of target, empty target means all targets
+func (m *DependencyDetector) RegisterHandler(target string, h DegradeHandler) {
+	m.muConf.Lock()
+	defer m.muConf.Unlock()
+	m.handlers[target] = append(m.handlers[target], h)
+}
+
+// IsDegraded return true if target is struggling
+func (m *DependencyDetector) IsDegraded(target string) bool {
+	v, ok := m.states.Load(target)
+	if !ok {
+		return false
+	}
+	t := v.(*dependencyTarget)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state.Degraded
+}
+
+// States return snapshot of all targets
+func (m *DependencyDetector) States() []DependencyState {
+	var states []DependencyState
+	m.states.Range(func(_, v interface{}) bool {
+		t := v.(*dependencyTarget)
+		t.mu.Lock()
+		states = append(states, t.state)
+		t.mu.Unlock()
+		return true
+	})
+	return states
+}
+
+func (m *DependencyDetector) policy(target string) *DependencyPolicy {
+	m.muConf.RLock()
+	defer m.muConf.RUnlock()
+	if p, ok := m.policies[target]; ok {
+		return p
+	}
+	return defaultDependencyPolicy()
+}
+
+// Observe record result of one call to target
+func (m *DependencyDetector) Observe(target string, d time.Duration, failed bool) {
+	v, ok := m.states.Load(target)
+	if !ok {
+		v, _ = m.states.LoadOrStore(target, &dependencyTarget{state: DependencyState{Target: target, Latency: d, Since: time.Now()}})
+	}
+	t := v.(*dependencyTarget)
+	p := m.policy(target)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &t.state
+
+	errVal := 0.0
+	if failed {
+		errVal = 1
+	}
+	s.Latency = time.Duration(p.Alpha*float64(d) + (1-p.Alpha)*float64(s.Latency))
+	s.ErrorRate = p.Alpha*errVal + (1-p.Alpha)*s.ErrorRate
+	s.Samples++
+	s.lastObserve = time.Now()
+
+	if s.Samples < p.MinSamples {
+		return
+	}
+
+	if !s.Degraded && (s.Latency > p.Latency || s.ErrorRate > p.ErrorRate) {
+		m.transit(s, true)
+	} else if s.Degraded &&
+		s.Latency < time.Duration(float64(p.Latency)*p.RecoverRatio) &&
+		s.ErrorRate < p.ErrorRate*p.RecoverRatio {
+		m.transit(s, false)
+	}
+}
+
+// transit must be called with lock of target held
+func (m *DependencyDetector) transit(s *DependencyState, degraded bool) {
+	fun := "DependencyDetector.transit -->"
+	ctx := context.Background()
+
+	s.Degraded = degraded
+	s.Since = time.Now()
+	state := *s
+
+	val := 0.0
+	if degraded {
+		val = 1
+		logger().Warnf(ctx, "%s degrade target: %s latency: %s error_rate: %.2f", fun, s.Target, s.Latency, s.ErrorRate)
+	} else {
+		logger().Infof(ctx, "%s recovered target: %s latency: %s error_rate: %.2f", fun, s.Target, s.Latency, s.ErrorRate)
+	}
+	group, service := GetGroupAndService()
+	_metricDependencyDegraded.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelCalleeService, s.Target).Set(val)
+
+	m.muConf.RLock()
+	handlers := make([]DegradeHandler, 0, len(m.handlers[s.Target])+len(m.handlers[""]))
+	handlers = append(handlers, m.handlers[s.Target]...)
+	handlers = append(handlers, m.handlers[""]...)
+	m.muConf.RUnlock()
+	if len(handlers) == 0 {
+		return
+	}
+
+	err := m.notifier.TrySubmit(ctx, func(ctx context.Context) {
+		for _, h := range handlers {
+			if degraded {
+				h.Degrade(state)
+			} else {
+				h.Recovered(state)
+			}
+		}
+	})
+	if err != nil {
+		logger().Errorf(ctx, "%s notify target: %s err: %v", fun, s.Target, err)
+	}
+}
+
+func (m *DependencyDetector) run() {
+	ticker := time.NewTicker(dependencyCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.recoverIdle()
+	}
+}
+
+func (m *DependencyDetector) recoverIdle() {
+	now := time.Now()
+	m.states.Range(func(k, v interface{}) bool {
+		t := v.(*dependencyTarget)
+		p := m.policy(k.(string))
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		s := &t.state
+		if !s.Degraded || now.Sub(s.lastObserve) < p.IdleRecover {
+			return true
+		}
+		s.Latency, s.ErrorRate, s.Samples = 0, 0, 0
+		m.transit(s, false)
+		return true
+	})
+}
+
+// IsDependencyDegraded return true if downstream target is struggling
+func IsDependencyDegraded(target string) bool {
+	return GetDependencyDetector().IsDegraded(target)
+}
+
+// RegisterDegradeHandler register degrade handler of downstream target, empty target means all targets
+func RegisterDegradeHandler(target string, h DegradeHandler) {
+	GetDependencyDetector().RegisterHandler(target, h)
+}
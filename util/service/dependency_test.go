@@ -0,0 +1,70 @@
+package rocserv
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDependencyDetector(t *testing.T) {
+	ass := assert.New(t)
+
+	d := NewDependencyDetector()
+	d.SetPolicy("base/slow", &DependencyPolicy{
+		Latency:      100 * time.Millisecond,
+		ErrorRate:    0.5,
+		Alpha:        0.5,
+		MinSamples:   3,
+		RecoverRatio: 0.8,
+		IdleRecover:  time.Minute,
+	})
+
+	degraded := make(chan DependencyState, 1)
+	recovered := make(chan DependencyState, 1)
+	d.RegisterHandler("base/slow", &DegradeFuncs{
+		OnDegrade:   func(s DependencyState) { degraded <- s },
+		OnRecovered: func(s DependencyState) { recovered <- s },
+	})
+
+	for i := 0; i < 5; i++ {
+		d.Observe("base/slow", 300*time.Millisecond, false)
+	}
+	ass.True(d.IsDegraded("base/slow"))
+	s := <-degraded
+	ass.Equal("base/slow", s.Target)
+
+	for i := 0; i < 10; i++ {
+		d.Observe("base/slow", 10*time.Millisecond, false)
+	}
+	ass.False(d.IsDegraded("base/slow"))
+	<-recovered
+}
+
+func TestDependencyDetectorConcurrent(t *testing.T) {
+	ass := assert.New(t)
+
+	m := NewDependencyDetector()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := fmt.Sprintf("base/svc%d", i%2)
+			for j := 0; j < 100; j++ {
+				m.Observe(target, time.Millisecond, false)
+				m.IsDegraded(target)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	states := m.States()
+	ass.Len(states, 2)
+	for _, s := range states {
+		ass.Equal(400, s.Samples)
+		ass.False(s.Degraded)
+	}
+}
@@ -0,0 +1,136 @@
+package rocserv
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+const (
+	deprecatedKindFlag = "flag"
+	deprecatedKindEnv  = "env"
+)
+
+// deprecatedOption option which is renamed, the old name keeps working until it is removed
+type deprecatedOption struct {
+	kind        string
+	name        string
+	replacement string
+}
+
+var (
+	muDeprecated sync.Mutex
+	// old flag name -> new flag name
+	deprecatedFlags = make(map[string]string)
+	deprecatedUsed  = make(map[string]*deprecatedOption)
+)
+
+const (
+	// crossRegionIdListEnv 跨机房注册的 region id 列表, 逗号分隔, 老名字为 CROSSREGIONIDLIST
+	crossRegionIdListEnv           = "ROC_CROSS_REGION_ID_LIST"
+	deprecatedCrossRegionIdListEnv = "CROSSREGIONIDLIST"
+)
+
+func init() {
+	// -skey 改名为 -sesskey, 与 Option WithSessKey 保持一致
+	DeprecateFlag("skey", "sesskey")
+}
+
+// DeprecateFlag declare flag old is replaced by replacement, -old keeps working as alias of -replacement,
+// and usage of it is logged and counted; must be called before Serve
+func DeprecateFlag(old, replacement string) {
+	muDeprecated.Lock()
+	defer muDeprecated.Unlock()
+	deprecatedFlags[old] = replacement
+}
+
+// GetenvCompat return value of env name, fallback to deprecated names in order and record the usage
+func GetenvCompat(name string, deprecated ...string) string {
+	if v, ok := os.LookupEnv(name); ok {
+		return v
+	}
+	for _, old := range deprecated {
+		if v, ok := os.LookupEnv(old); ok {
+			markDeprecatedUsed(deprecatedKindEnv, old, name)
+			return v
+		}
+	}
+	return ""
+}
+
+type deprecatedFlagValue struct {
+	name        string
+	replacement string
+	target      flag.Value
+}
+
+func (m *deprecatedFlagValue) String() string {
+	if m.target == nil {
+		return ""
+	}
+	return m.target.String()
+}
+
+func (m *deprecatedFlagValue) Set(s string) error {
+	markDeprecatedUsed(deprecatedKindFlag, m.name, m.replacement)
+	return m.target.Set(s)
+}
+
+// IsBoolFlag 与目标 flag 保持一致, 使 -old 可以不带值
+func (m *deprecatedFlagValue) IsBoolFlag() bool {
+	bf, ok := m.target.(interface{ IsBoolFlag() bool })
+	return ok && bf.IsBoolFlag()
+}
+
+// registerDeprecatedFlags 为废弃 flag 定义别名, 需要在新 flag 定义之后, Parse 之前调用
+func registerDeprecatedFlags(fs *flag.FlagSet) error {
+	muDeprecated.Lock()
+	defer muDeprecated.Unlock()
+
+	for old, replacement := range deprecatedFlags {
+		// 应用仍然自己定义了老 flag, 不做处理
+		if fs.Lookup(old) != nil {
+			continue
+		}
+		target := fs.Lookup(replacement)
+		if target == nil {
+			return fmt.Errorf("deprecated flag: %s replacement: %s not defined", old, replacement)
+		}
+		fs.Var(&deprecatedFlagValue{name: old, replacement: replacement, target: target.Value}, old, fmt.Sprintf("Deprecated: use -%s instead", replacement))
+	}
+	return nil
+}
+
+func markDeprecatedUsed(kind, name, replacement string) {
+	muDeprecated.Lock()
+	defer muDeprecated.Unlock()
+	deprecatedUsed[kind+"/"+name] = &deprecatedOption{kind: kind, name: name, replacement: replacement}
+}
+
+// reportDeprecatedUsage 启动时可能还没有服务信息及日志配置, 在 ServBase 初始化之后统一上报
+func reportDeprecatedUsage() {
+	fun := "reportDeprecatedUsage -->"
+	ctx := context.Background()
+
+	muDeprecated.Lock()
+	used := make([]*deprecatedOption, 0, len(deprecatedUsed))
+	for _, opt := range deprecatedUsed {
+		used = append(used, opt)
+	}
+	muDeprecated.Unlock()
+
+	sort.Slice(used, func(i, j int) bool {
+		return used[i].kind+used[i].name < used[j].kind+used[j].name
+	})
+
+	group, service := GetGroupAndService()
+	for _, opt := range used {
+		logger().Warnf(ctx, "%s %s %s is deprecated, use %s instead", fun, opt.kind, opt.name, opt.replacement)
+		_metricDeprecatedOption.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelOptionKind, opt.kind, labelOptionName, opt.name).Inc()
+	}
+}
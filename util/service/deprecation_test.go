@@ -0,0 +1,89 @@
+package rocserv
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// swapDeprecated 用空的状态替换全局的废弃配置, 返回恢复函数
+func swapDeprecated() func() {
+	muDeprecated.Lock()
+	flags, used := deprecatedFlags, deprecatedUsed
+	deprecatedFlags = make(map[string]string)
+	deprecatedUsed = make(map[string]*deprecatedOption)
+	muDeprecated.Unlock()
+	return func() {
+		muDeprecated.Lock()
+		deprecatedFlags, deprecatedUsed = flags, used
+		muDeprecated.Unlock()
+	}
+}
+
+func TestDeprecatedFlag(t *testing.T) {
+	ass := assert.New(t)
+	defer swapDeprecated()()
+
+	DeprecateFlag("oldkey", "newkey")
+	DeprecateFlag("oldlocal", "local")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	newkey := fs.String("newkey", "", "")
+	local := fs.Bool("local", false, "")
+	ass.Nil(registerDeprecatedFlags(fs))
+
+	ass.Nil(fs.Parse([]string{"-oldkey", "abc", "-oldlocal"}))
+	ass.Equal("abc", *newkey)
+	ass.True(*local)
+	ass.NotNil(deprecatedUsed[deprecatedKindFlag+"/oldkey"])
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	ass.NotNil(registerDeprecatedFlags(fs))
+}
+
+func TestDeprecatedSessKeyFlag(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.Equal("sesskey", deprecatedFlags["skey"])
+
+	flags := deprecatedFlags
+	defer swapDeprecated()()
+	deprecatedFlags = flags
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	skey := fs.String("sesskey", "", "")
+	ass.Nil(registerDeprecatedFlags(fs))
+	ass.Nil(fs.Parse([]string{"-skey", "abc"}))
+	ass.Equal("abc", *skey)
+	ass.NotNil(deprecatedUsed[deprecatedKindFlag+"/skey"])
+}
+
+func TestGetenvCompat(t *testing.T) {
+	ass := assert.New(t)
+	defer swapDeprecated()()
+
+	os.Setenv("ROC_TEST_OLD_ENV", "old")
+	defer os.Unsetenv("ROC_TEST_OLD_ENV")
+
+	ass.Equal("old", GetenvCompat("ROC_TEST_NEW_ENV", "ROC_TEST_OLD_ENV"))
+	ass.NotNil(deprecatedUsed[deprecatedKindEnv+"/ROC_TEST_OLD_ENV"])
+
+	os.Setenv("ROC_TEST_NEW_ENV", "new")
+	defer os.Unsetenv("ROC_TEST_NEW_ENV")
+	ass.Equal("new", GetenvCompat("ROC_TEST_NEW_ENV", "ROC_TEST_OLD_ENV"))
+}
+
+func TestDeprecatedCrossRegionEnv(t *testing.T) {
+	ass := assert.New(t)
+	defer swapDeprecated()()
+
+	os.Setenv(deprecatedCrossRegionIdListEnv, "1,2")
+	defer os.Unsetenv(deprecatedCrossRegionIdListEnv)
+
+	o, err := newServeOptions(WithServName("base/test"), WithSessKey("abc"), WithEtcd([]string{"127.0.0.1:2379"}, "/roc"))
+	ass.Nil(err)
+	ass.Equal("1,2", o.args.crossRegionIdList)
+	ass.NotNil(deprecatedUsed[deprecatedKindEnv+"/"+deprecatedCrossRegionIdListEnv])
+}
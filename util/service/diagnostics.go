@@ -0,0 +1,305 @@
+package rocserv
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ErrDiagnosticsRunning another capture of cpu profile or trace is running
+var ErrDiagnosticsRunning = errors.New("diagnostics capture is running")
+
+// 采集时长上限, 避免长时间的 cpu profile 及 trace 影响服务
+const maxDiagnosticsDuration = time.Minute
+
+// DiagnosticsOptions what CaptureDiagnostics collects, nil means goroutine dump and heap profile
+type DiagnosticsOptions struct {
+	Goroutine bool
+	Heap      bool
+	// 大于 0 时采集 cpu profile, 最长 1 分钟
+	CPUProfile time.Duration
+	// 大于 0 时采集 execution trace, 最长 1 分钟
+	Trace time.Duration
+}
+
+type diagnosticsMeta struct {
+	Service    string             `json:"service"`
+	Servid     int                `json:"servid"`
+	Time       time.Time          `json:"time"`
+	GoVersion  string             `json:"go_version"`
+	Goroutines int                `json:"goroutines"`
+	Options    DiagnosticsOptions `json:"options"`
+	// 文件名 -> 采集失败的原因
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// cpu profile 及 trace 在进程内只能有一个, 采集中为 1
+var diagnosticsRunning int32
+
+// CaptureDiagnostics capture runtime profiles and bundle them into a tar.gz for incident analysis, block until
+// timed profiles finish or ctx is done; failed profiles are recorded in meta.json of the bundle
+func (m *ServBaseV2) CaptureDiagnostics(ctx context.Context, opts *DiagnosticsOptions) ([]byte, error) {
+	return captureDiagnostics(ctx, m.Servname(), m.Servid(), opts)
+}
+
+// CaptureDiagnostics capture diagnostics bundle of this service, e.g. from an app alert hook
+func CaptureDiagnostics(ctx context.Context, opts *DiagnosticsOptions) ([]byte, error) {
+	sb, err := getServBaseV2()
+	if err != nil {
+		return nil, err
+	}
+	return sb.CaptureDiagnostics(ctx, opts)
+}
+
+func captureDiagnostics(ctx context.Context, service string, servid int, opts *DiagnosticsOptions) ([]byte, error) {
+	fun := "captureDiagnostics -->"
+
+	if opts == nil {
+		opts = &DiagnosticsOptions{Goroutine: true, Heap: true}
+	}
+	o := *opts
+	o.CPUProfile = clampDiagnosticsDuration(o.CPUProfile)
+	o.Trace = clampDiagnosticsDuration(o.Trace)
+
+	meta := &diagnosticsMeta{
+		Service:    service,
+		Servid:     servid,
+		Time:       time.Now(),
+		GoVersion:  runtime.Version(),
+		Goroutines: runtime.NumGoroutine(),
+		Options:    o,
+		Errors:     make(map[string]string),
+	}
+	files := make(map[string][]byte)
+	capture := func(name string, fn func(buf *bytes.Buffer) error) {
+		var buf bytes.Buffer
+		if err := fn(&buf); err != nil {
+			meta.Errors[name] = err.Error()
+			return
+		}
+		files[name] = buf.Bytes()
+	}
+
+	// 先采集时间点数据, 不受 cpu profile 及 trace 的影响
+	if o.Goroutine {
+		capture("goroutine.txt", writeGoroutineDump)
+	}
+	if o.Heap {
+		capture("heap.pb.gz", writeHeapProfile)
+	}
+	if o.CPUProfile > 0 || o.Trace > 0 {
+		cpu, tr, err := captureTimedProfiles(ctx, o.CPUProfile, o.Trace)
+		if err != nil {
+			return nil, err
+		}
+		for name, res := range map[string]*timedProfile{"cpu.pb.gz": cpu, "trace.out": tr} {
+			if res == nil {
+				continue
+			}
+			if res.err != nil {
+				meta.Errors[name] = res.err.Error()
+				continue
+			}
+			files[name] = res.data
+		}
+	}
+
+	logger().Infof(ctx, "%s files: %d errors: %v", fun, len(files), meta.Errors)
+	js, _ := json.MarshalIndent(meta, "", "  ")
+	files["meta.json"] = js
+	return tarGzip(files, meta.Time)
+}
+
+func clampDiagnosticsDuration(d time.Duration) time.Duration {
+	if d > maxDiagnosticsDuration {
+		return maxDiagnosticsDuration
+	}
+	return d
+}
+
+func writeGoroutineDump(buf *bytes.Buffer) error {
+	return pprof.Lookup("goroutine").WriteTo(buf, 2)
+}
+
+func writeHeapProfile(buf *bytes.Buffer) error {
+	return pprof.Lookup("heap").WriteTo(buf, 0)
+}
+
+type timedProfile struct {
+	data []byte
+	err  error
+}
+
+// captureTimedProfiles 同时采集 cpu profile 及 trace, ctx 结束时提前停止, 时长为 0 的返回 nil
+func captureTimedProfiles(ctx context.Context, cpuDuration, traceDuration time.Duration) (cpu, tr *timedProfile, err error) {
+	if !atomic.CompareAndSwapInt32(&diagnosticsRunning, 0, 1) {
+		return nil, nil, ErrDiagnosticsRunning
+	}
+	defer atomic.StoreInt32(&diagnosticsRunning, 0)
+
+	var wg sync.WaitGroup
+	run := func(d time.Duration, start func(*bytes.Buffer) error, stop func()) *timedProfile {
+		if d <= 0 {
+			return nil
+		}
+		res := &timedProfile{}
+		var buf bytes.Buffer
+		if res.err = start(&buf); res.err != nil {
+			return res
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+			}
+			stop()
+			res.data = buf.Bytes()
+		}()
+		return res
+	}
+	cpu = run(cpuDuration, func(buf *bytes.Buffer) error { return pprof.StartCPUProfile(buf) }, pprof.StopCPUProfile)
+	tr = run(traceDuration, func(buf *bytes.Buffer) error { return trace.Start(buf) }, trace.Stop)
+	wg.Wait()
+	return cpu, tr, nil
+}
+
+func tarGzip(files map[string][]byte, modTime time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, data := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// diagnosticsHandler /backdoor/diagnostics/:kind, kind 为 goroutine, heap, cpu, trace 或 bundle;
+// cpu 及 trace 的采集时长参数 seconds, 默认 10 秒; bundle 的参数 cpu 及 trace 为时长, 如 cpu=10s,
+// goroutine=false 或 heap=false 时不采集
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	fun := "diagnosticsHandler -->"
+	ctx := r.Context()
+	kind := httprouter.ParamsFromContext(ctx).ByName("kind")
+	query := r.URL.Query()
+
+	seconds := 10
+	if v := query.Get("seconds"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid seconds", http.StatusBadRequest)
+			return
+		}
+		seconds = n
+	}
+	d := clampDiagnosticsDuration(time.Duration(seconds) * time.Second)
+
+	var buf bytes.Buffer
+	var filename string
+	switch kind {
+	case "goroutine":
+		if err := writeGoroutineDump(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(buf.Bytes())
+		return
+	case "heap":
+		if err := writeHeapProfile(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		filename = "heap.pb.gz"
+	case "cpu", "trace":
+		var cpuDuration, traceDuration time.Duration
+		if kind == "cpu" {
+			cpuDuration, filename = d, "cpu.pb.gz"
+		} else {
+			traceDuration, filename = d, "trace.out"
+		}
+		cpu, tr, err := captureTimedProfiles(ctx, cpuDuration, traceDuration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		res := cpu
+		if res == nil {
+			res = tr
+		}
+		if res.err != nil {
+			http.Error(w, res.err.Error(), http.StatusInternalServerError)
+			return
+		}
+		buf.Write(res.data)
+	case "bundle":
+		opts := &DiagnosticsOptions{
+			Goroutine: query.Get("goroutine") != "false",
+			Heap:      query.Get("heap") != "false",
+		}
+		for key, p := range map[string]*time.Duration{"cpu": &opts.CPUProfile, "trace": &opts.Trace} {
+			if v := query.Get(key); len(v) > 0 {
+				dur, err := time.ParseDuration(v)
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid %s: %v", key, err), http.StatusBadRequest)
+					return
+				}
+				*p = dur
+			}
+		}
+		var data []byte
+		var err error
+		if sb, ok := server.sbase.(*ServBaseV2); ok && sb != nil {
+			data, err = sb.CaptureDiagnostics(ctx, opts)
+		} else {
+			data, err = captureDiagnostics(ctx, "", 0, opts)
+		}
+		if err == ErrDiagnosticsRunning {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		buf.Write(data)
+		filename = fmt.Sprintf("diagnostics-%s.tar.gz", time.Now().Format("20060102150405"))
+	default:
+		http.Error(w, "unknown kind: "+kind, http.StatusNotFound)
+		return
+	}
+
+	logger().Infof(ctx, "%s kind: %s size: %d", fun, kind, buf.Len())
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,114 @@
+package rocserv
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func untarGzip(t *testing.T, data []byte) map[string][]byte {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	files := make(map[string][]byte)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(tr)
+		files[hdr.Name] = b
+	}
+}
+
+func TestCaptureDiagnostics(t *testing.T) {
+	ass := assert.New(t)
+
+	sb := &ServBaseV2{servLocation: "base/test", servId: 3}
+	data, err := sb.CaptureDiagnostics(context.Background(), &DiagnosticsOptions{
+		Goroutine:  true,
+		Heap:       true,
+		CPUProfile: 100 * time.Millisecond,
+		Trace:      100 * time.Millisecond,
+	})
+	ass.Nil(err)
+	files := untarGzip(t, data)
+	ass.Contains(string(files["goroutine.txt"]), "goroutine")
+	for _, name := range []string{"heap.pb.gz", "cpu.pb.gz", "trace.out"} {
+		ass.NotEmpty(files[name], name)
+	}
+	var meta diagnosticsMeta
+	ass.Nil(json.Unmarshal(files["meta.json"], &meta))
+	ass.Equal("base/test", meta.Service)
+	ass.Equal(3, meta.Servid)
+	ass.Len(meta.Errors, 0)
+
+	old := server.sbase
+	defer func() { server.sbase = old }()
+	server.sbase = nil
+	_, err = CaptureDiagnostics(context.Background(), nil)
+	ass.Equal(ErrServBaseNotInit, err)
+	server.sbase = sb
+	data, err = CaptureDiagnostics(context.Background(), &DiagnosticsOptions{Goroutine: true})
+	ass.Nil(err)
+	ass.Contains(string(untarGzip(t, data)["goroutine.txt"]), "goroutine")
+
+	// ctx 结束时提前停止
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	st := time.Now()
+	data, err = captureDiagnostics(ctx, "", 0, &DiagnosticsOptions{CPUProfile: time.Hour})
+	ass.Nil(err)
+	ass.True(time.Since(st) < 10*time.Second)
+	ass.NotEmpty(untarGzip(t, data)["cpu.pb.gz"])
+
+	// 同时只能有一个采集
+	atomic.StoreInt32(&diagnosticsRunning, 1)
+	_, err = captureDiagnostics(context.Background(), "", 0, &DiagnosticsOptions{Trace: time.Second})
+	ass.Equal(ErrDiagnosticsRunning, err)
+	atomic.StoreInt32(&diagnosticsRunning, 0)
+}
+
+func TestDiagnosticsHandler(t *testing.T) {
+	ass := assert.New(t)
+
+	router := httprouter.New()
+	router.Handler(http.MethodGet, "/backdoor/diagnostics/:kind", http.HandlerFunc(diagnosticsHandler))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/backdoor/diagnostics/goroutine", nil))
+	ass.Equal(http.StatusOK, w.Code)
+	ass.Contains(w.Body.String(), "goroutine")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/backdoor/diagnostics/bundle?heap=false&trace=50ms", nil))
+	ass.Equal(http.StatusOK, w.Code)
+	ass.Contains(w.Header().Get("Content-Disposition"), "diagnostics-")
+	files := untarGzip(t, w.Body.Bytes())
+	ass.NotEmpty(files["trace.out"])
+	ass.Nil(files["heap.pb.gz"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/backdoor/diagnostics/cpu?seconds=x", nil))
+	ass.Equal(http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/backdoor/diagnostics/mem", nil))
+	ass.Equal(http.StatusNotFound, w.Code)
+}
@@ -9,7 +9,6 @@ import (
 	"fmt"
 	"time"
 
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xutil/sync2"
 
 	etcd "github.com/coreos/etcd/client"
@@ -35,6 +34,14 @@ func (m *ServBaseV2) lockValue() string {
 	return fmt.Sprintf("%s/%d:%s", m.servLocation, m.servId, m.sessKey)
 }
 
+// lockIndex 获取锁的写入 index, 作为 fencing token
+func lockIndex(r *etcd.Response) uint64 {
+	if r == nil || r.Node == nil {
+		return 0
+	}
+	return r.Node.ModifiedIndex
+}
+
 func (m *ServBaseV2) resetExistLock(path string) error {
 	fun := "ServBaseV2.resetExistLock -->"
 	ctx := context.Background()
@@ -48,10 +55,11 @@ func (m *ServBaseV2) resetExistLock(path string) error {
 	})
 
 	if err != nil {
-		xlog.Infof(ctx, "%s exist check path: %s resp: %v err: %v", fun, path, r, err)
+		logger().Infof(ctx, "%s exist check path: %s resp: %v err: %v", fun, path, r, err)
 	} else {
 		// 正常只有重启服务重新获取锁才会到这里
-		xlog.Warnf(ctx, "%s exist check path: %s resp: %v", fun, path, r)
+		logger().Warnf(ctx, "%s exist check path: %s resp: %v", fun, path, r)
+		m.setFencingToken(path, lockIndex(r))
 	}
 
 	return err
@@ -66,9 +74,10 @@ func (m *ServBaseV2) setNoExistLock(path string) error {
 	})
 
 	if err != nil {
-		xlog.Warnf(ctx, "%s noexist check path: %s resp: %v err: %v", fun, path, r, err)
+		logger().Warnf(ctx, "%s noexist check path: %s resp: %v err: %v", fun, path, r, err)
 	} else {
-		xlog.Infof(ctx, "%s noexist check path: %s resp: %v", fun, path, r)
+		logger().Infof(ctx, "%s noexist check path: %s resp: %v", fun, path, r)
+		m.setFencingToken(path, lockIndex(r))
 	}
 
 	return err
@@ -85,9 +94,11 @@ func (m *ServBaseV2) heartLock(path string) error {
 	})
 
 	if err != nil {
-		xlog.Fatalf(ctx, "%s noexist heart path: %s resp: %v err: %v", fun, path, r, err)
+		m.setFencingToken(path, 0)
+		defaultLockElections.released(path, "heart failed")
+		logger().Errorf(ctx, "%s noexist heart path: %s resp: %v err: %v", fun, path, r, err)
 	} else {
-		xlog.Infof(ctx, "%s noexist heartpath: %s resp: %v", fun, path, r)
+		logger().Infof(ctx, "%s noexist heartpath: %s resp: %v", fun, path, r)
 	}
 
 	return err
@@ -103,9 +114,9 @@ func (m *ServBaseV2) delLock(path string) error {
 	// 100: Key not found (/roc/lock/local/niubi/fuck/testlock) [7044841]
 	// 101: Compare failed ([7e07d3e6-2737-43ac-86fa-157bc1bb8943a != 332]) [7044908]
 	if err != nil {
-		xlog.Fatalf(ctx, "%s unlock path: %s resp: %v err: %v", fun, path, r, err)
+		logger().Errorf(ctx, "%s unlock path: %s resp: %v err: %v", fun, path, r, err)
 	} else {
-		xlog.Infof(ctx, "%s unlock path: %s resp: %v", fun, path, r)
+		logger().Infof(ctx, "%s unlock path: %s resp: %v", fun, path, r)
 	}
 
 	return err
@@ -122,15 +133,17 @@ func (m *ServBaseV2) getDistLock(path string) error {
 
 	for {
 
-		if err := m.setNoExistLock(path); err == nil {
+		err := m.setNoExistLock(path)
+		defaultLockElections.attempt(path, err)
+		if err == nil {
 			return nil
 		}
 
 		r, err := m.etcdClient.Get(context.Background(), path, &etcd.GetOptions{})
-		xlog.Infof(ctx, "%s get check path:%s resp:%v err:%v", fun, path, r, err)
+		logger().Infof(ctx, "%s get check path:%s resp:%v err:%v", fun, path, r, err)
 		if err != nil {
 			// 上面检查存在，这里又get不到，发生概率非常小
-			xlog.Warnf(ctx, "%s little rate get check path:%s resp:%v err:%v", fun, path, r, err)
+			logger().Warnf(ctx, "%s little rate get check path:%s resp:%v err:%v", fun, path, r, err)
 			continue
 		}
 
@@ -140,14 +153,15 @@ func (m *ServBaseV2) getDistLock(path string) error {
 		}
 		watcher := m.etcdClient.Watcher(path, wop)
 		if watcher == nil {
-			xlog.Errorf(ctx, "%s get watcher get check path:%s err:%v", fun, path, err)
+			logger().Errorf(ctx, "%s get watcher get check path:%s err:%v", fun, path, err)
 			return fmt.Errorf("get wather err")
 		}
 
-		xlog.Infof(ctx, "%s set watcher path:%s watcher:%v", fun, path, wop)
+		logger().Infof(ctx, "%s set watcher path:%s watcher:%v", fun, path, wop)
 
 		r, err = watcher.Next(context.Background())
-		xlog.Infof(ctx, "%s watchnext check path:%s resp:%v err:%v", fun, path, r, err)
+		logger().Infof(ctx, "%s watchnext check path:%s resp:%v err:%v", fun, path, r, err)
+		defaultLockElections.observe(path, r)
 
 		// 节点过期返回  expire {Key: /roc/lock/local/niubi/fuck/testlock, CreatedIndex: 7043099, ModifiedIndex: 7043144, TTL: 0
 
@@ -168,11 +182,14 @@ func (m *ServBaseV2) lock(path string) error {
 		return err
 	}
 
+	defaultLockElections.acquired(path, m.lockValue())
 	m.lookupHeart(path).start()
 	return nil
 }
 
 func (m *ServBaseV2) unlock(path string) error {
+	m.setFencingToken(path, 0)
+	defaultLockElections.released(path, "unlock")
 	m.lookupHeart(path).stop()
 	m.delLock(path)
 	m.lookupLock(path).Release()
@@ -183,17 +200,21 @@ func (m *ServBaseV2) trylock(path string) (bool, error) {
 	fun := "ServBaseV2.trylock -->"
 	ctx := context.Background()
 	islock := m.lookupLock(path).TryAcquire()
-	xlog.Infof(ctx, "%s try lock:%s r:%v", fun, path, islock)
+	logger().Infof(ctx, "%s try lock:%s r:%v", fun, path, islock)
 	if !islock {
 		return islock, nil
 	}
 
 	if err := m.resetExistLock(path); err == nil {
+		defaultLockElections.acquired(path, m.lockValue())
 		m.lookupHeart(path).start()
 		return true, nil
 	}
 
-	if err := m.setNoExistLock(path); err == nil {
+	err := m.setNoExistLock(path)
+	defaultLockElections.attempt(path, err)
+	if err == nil {
+		defaultLockElections.acquired(path, m.lockValue())
 		m.lookupHeart(path).start()
 		return true, nil
 	}
@@ -304,13 +325,13 @@ func (m *distLockHeart) loop() {
 	for {
 		select {
 		case <-tick.C:
-			xlog.Infof(ctx, "%s heart check path:%s ison:%v", fun, m.path, ison)
+			logger().Infof(ctx, "%s heart check path:%s ison:%v", fun, m.path, ison)
 			if ison {
 				m.sb.heartLock(m.path)
 			}
 
 		case v := <-m.onoff:
-			xlog.Infof(ctx, "%s onoff path:%s ison:%v", fun, m.path, v)
+			logger().Infof(ctx, "%s onoff path:%s ison:%v", fun, m.path, v)
 			ison = v
 		}
 	}
@@ -318,12 +339,12 @@ func (m *distLockHeart) loop() {
 
 func (m *distLockHeart) start() {
 	fun := "distLockHeart.start -->"
-	xlog.Infof(context.Background(), "%s heart check path:%s start", fun, m.path)
+	logger().Infof(context.Background(), "%s heart check path:%s start", fun, m.path)
 	m.onoff <- true
 }
 
 func (m *distLockHeart) stop() {
 	fun := "distLockHeart.stop -->"
-	xlog.Infof(context.Background(), "%s heart check path:%s stop", fun, m.path)
+	logger().Infof(context.Background(), "%s heart check path:%s stop", fun, m.path)
 	m.onoff <- false
 }
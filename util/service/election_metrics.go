@@ -0,0 +1,108 @@
+package rocserv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+// lockElection 单个分布式锁的选举状态, 主从模式即对 {servLoc}-master-slave 全局锁的选举
+type lockElection struct {
+	path       string
+	acquiredAt time.Time
+	// 观察到上一个持有者释放或过期的时间
+	releasedAt time.Time
+}
+
+type lockElections struct {
+	mu    sync.Mutex
+	locks map[string]*lockElection
+}
+
+var defaultLockElections = &lockElections{locks: make(map[string]*lockElection)}
+
+func (m *lockElections) with(path string, f func(e *lockElection)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.locks[path]
+	if !ok {
+		e = &lockElection{path: path}
+		m.locks[path] = e
+	}
+	f(e)
+}
+
+func (m *lockElection) labels() []string {
+	group, service := GetGroupAndService()
+	return []string{xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelLock, m.path}
+}
+
+// attempt 记录一次抢锁
+func (m *lockElections) attempt(path string, err error) {
+	status := "ok"
+	if err != nil {
+		status = "fail"
+	}
+	m.with(path, func(e *lockElection) {
+		_metricElectionAttempts.With(append(e.labels(), labelStatus, status)...).Inc()
+	})
+}
+
+// observe 等待锁时观察到持有者释放或过期
+func (m *lockElections) observe(path string, r *etcd.Response) {
+	if r == nil {
+		return
+	}
+	switch r.Action {
+	case "expire", "delete", "compareAndDelete":
+	default:
+		return
+	}
+
+	m.with(path, func(e *lockElection) {
+		e.releasedAt = time.Now()
+		holder := ""
+		if r.PrevNode != nil {
+			holder = r.PrevNode.Value
+		}
+		logger().Infow(context.Background(), "leadership vacated", "lock", path, "action", r.Action, "prev_holder", holder)
+	})
+}
+
+func (m *lockElections) acquired(path, holder string) {
+	m.with(path, func(e *lockElection) {
+		now := time.Now()
+		e.acquiredAt = now
+		labels := e.labels()
+		_metricElectionLeader.With(labels...).Set(1)
+
+		var failover time.Duration
+		if !e.releasedAt.IsZero() {
+			failover = now.Sub(e.releasedAt)
+			e.releasedAt = time.Time{}
+			_metricElectionFailover.With(labels...).Inc()
+			_metricElectionFailoverTime.With(labels...).Observe(failover.Seconds())
+		}
+		logger().Infow(context.Background(), "leadership acquired", "lock", path, "holder", holder, "failover", failover > 0, "failover_cost", failover.String())
+	})
+}
+
+// released 主动释放或心跳失败丢失锁
+func (m *lockElections) released(path, reason string) {
+	m.with(path, func(e *lockElection) {
+		if e.acquiredAt.IsZero() {
+			return
+		}
+		hold := time.Since(e.acquiredAt)
+		e.acquiredAt = time.Time{}
+		labels := e.labels()
+		_metricElectionLeader.With(labels...).Set(0)
+		_metricElectionHold.With(labels...).Observe(hold.Seconds())
+		logger().Infow(context.Background(), "leadership released", "lock", path, "reason", reason, "hold", hold.String())
+	})
+}
@@ -0,0 +1,35 @@
+package rocserv
+
+import (
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockElections(t *testing.T) {
+	ass := assert.New(t)
+
+	m := &lockElections{locks: make(map[string]*lockElection)}
+	path := "/roc/lock/global/base/account-master-slave"
+
+	m.attempt(path, nil)
+	m.acquired(path, "base/account/1:sess")
+	e := m.locks[path]
+	ass.False(e.acquiredAt.IsZero())
+	ass.True(e.releasedAt.IsZero())
+
+	m.released(path, "unlock")
+	ass.True(e.acquiredAt.IsZero())
+
+	// 非释放事件不记录
+	m.observe(path, &etcd.Response{Action: "update"})
+	ass.True(e.releasedAt.IsZero())
+
+	m.observe(path, &etcd.Response{Action: "expire", PrevNode: &etcd.Node{Value: "base/account/2:sess"}})
+	ass.False(e.releasedAt.IsZero())
+
+	m.acquired(path, "base/account/1:sess")
+	ass.True(e.releasedAt.IsZero())
+	ass.False(e.acquiredAt.IsZero())
+}
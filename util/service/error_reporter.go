@@ -0,0 +1,262 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xnet/xhttp"
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+const (
+	ErrorKindError = "error"
+	ErrorKindPanic = "panic"
+
+	// 每个上报周期内最多保留的错误指纹数, 超过后新指纹计入 dropped
+	defaultErrorReportCapacity = 1024
+	defaultErrorReportTopN     = 20
+	defaultErrorReportInterval = time.Minute
+
+	errorReportLogID = "ERROR_REPORT"
+)
+
+// ErrorStat aggregated stat of one error fingerprint
+type ErrorStat struct {
+	Fingerprint string    `json:"fingerprint"`
+	Kind        string    `json:"kind"`
+	Message     string    `json:"message"`
+	Stack       string    `json:"stack"`
+	Count       int64     `json:"count"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// ErrorCollector receive top errors periodically, such as sentry or an internal collector
+type ErrorCollector interface {
+	Collect(ctx context.Context, stats []*ErrorStat) error
+}
+
+// ErrorReporter fingerprint errors and panics by stack, aggregate them locally and report top errors periodically
+type ErrorReporter struct {
+	mu       sync.Mutex
+	stats    map[string]*ErrorStat
+	dropped  int64
+	capacity int
+	topN     int
+
+	collector ErrorCollector
+}
+
+var defaultErrorReporter = NewErrorReporter(defaultErrorReportCapacity, defaultErrorReportTopN)
+
+// NewErrorReporter create error reporter, capacity is the max fingerprints kept in one report interval
+func NewErrorReporter(capacity, topN int) *ErrorReporter {
+	if capacity <= 0 {
+		capacity = defaultErrorReportCapacity
+	}
+	if topN <= 0 {
+		topN = defaultErrorReportTopN
+	}
+	return &ErrorReporter{
+		stats:    make(map[string]*ErrorStat),
+		capacity: capacity,
+		topN:     topN,
+	}
+}
+
+// GetErrorReporter return the error reporter used by framework
+func GetErrorReporter() *ErrorReporter {
+	return defaultErrorReporter
+}
+
+// ReportError report an error with the stack of caller
+func ReportError(ctx context.Context, err error) {
+	if err == nil {
+		return
+	}
+	defaultErrorReporter.Report(ctx, ErrorKindError, err.Error(), callerStack(3))
+}
+
+// ReportPanic report a recovered panic with its stack
+func ReportPanic(ctx context.Context, p interface{}, stack []byte) {
+	defaultErrorReporter.Report(ctx, ErrorKindPanic, fmt.Sprint(p), string(stack))
+}
+
+// SetCollector set the collector which top errors are reported to
+func (m *ErrorReporter) SetCollector(collector ErrorCollector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collector = collector
+}
+
+// Report aggregate an error by fingerprint of kind and stack
+func (m *ErrorReporter) Report(ctx context.Context, kind, msg, stack string) {
+	fp := errorFingerprint(kind, stack)
+	now := time.Now()
+
+	group, service := GetGroupAndService()
+	_metricErrorReportCount.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelType, kind).Inc()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if st, ok := m.stats[fp]; ok {
+		st.Count++
+		st.LastSeen = now
+		st.Message = msg
+		return
+	}
+
+	if len(m.stats) >= m.capacity {
+		m.dropped++
+		return
+	}
+
+	m.stats[fp] = &ErrorStat{
+		Fingerprint: fp,
+		Kind:        kind,
+		Message:     msg,
+		Stack:       stack,
+		Count:       1,
+		FirstSeen:   now,
+		LastSeen:    now,
+	}
+}
+
+// Top return the top n errors order by count desc
+func (m *ErrorReporter) Top(n int) []*ErrorStat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return topErrorStats(m.stats, n)
+}
+
+// Run report top errors every interval until ctx done
+func (m *ErrorReporter) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultErrorReportInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.flush(ctx)
+		}
+	}
+}
+
+func (m *ErrorReporter) flush(ctx context.Context) {
+	fun := "ErrorReporter.flush -->"
+
+	m.mu.Lock()
+	stats := m.stats
+	dropped := m.dropped
+	collector := m.collector
+	m.stats = make(map[string]*ErrorStat)
+	m.dropped = 0
+	m.mu.Unlock()
+
+	if len(stats) == 0 {
+		return
+	}
+
+	top := topErrorStats(stats, m.topN)
+	for _, st := range top {
+		bs, _ := json.Marshal(st)
+		logger().Warnf(ctx, "%s\t%s", errorReportLogID, string(bs))
+	}
+	if dropped > 0 {
+		logger().Warnf(ctx, "%s fingerprints: %d, dropped: %d", fun, len(stats), dropped)
+	}
+
+	if collector != nil {
+		if err := collector.Collect(ctx, top); err != nil {
+			logger().Warnf(ctx, "%s collect err: %v", fun, err)
+		}
+	}
+}
+
+func topErrorStats(stats map[string]*ErrorStat, n int) []*ErrorStat {
+	ret := make([]*ErrorStat, 0, len(stats))
+	for _, st := range stats {
+		cp := *st
+		ret = append(ret, &cp)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count == ret[j].Count {
+			return ret[i].Fingerprint < ret[j].Fingerprint
+		}
+		return ret[i].Count > ret[j].Count
+	})
+	if n > 0 && len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+// errorFingerprint hash of kind and stack frames, goroutine ids, pointer args and line offsets are ignored
+func errorFingerprint(kind, stack string) string {
+	h := sha1.New()
+	h.Write([]byte(kind))
+	for _, line := range strings.Split(stack, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "goroutine ") {
+			continue
+		}
+		// go1.21 之后为 created by X in goroutine N, N 为创建方的 goroutine id
+		if strings.HasPrefix(line, "created by ") {
+			if idx := strings.Index(line, " in goroutine "); idx > 0 {
+				line = line[:idx]
+			}
+		}
+		// 去掉函数参数和 +0x 偏移量, 避免同一位置的错误生成不同的指纹
+		if idx := strings.LastIndex(line, "("); idx > 0 && strings.HasSuffix(line, ")") {
+			line = line[:idx]
+		}
+		if idx := strings.Index(line, " +0x"); idx > 0 {
+			line = line[:idx]
+		}
+		h.Write([]byte(line))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func callerStack(skip int) string {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(skip, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var sb strings.Builder
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&sb, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			break
+		}
+	}
+	return sb.String()
+}
+
+// ==============================
+type ErrorReport struct {
+}
+
+func FactoryErrorReport() xhttp.HandleRequest {
+	return new(ErrorReport)
+}
+
+func (m *ErrorReport) Handle(r *xhttp.HttpRequest) xhttp.HttpResponse {
+	s, _ := json.Marshal(defaultErrorReporter.Top(defaultErrorReportTopN))
+	return xhttp.NewHttpRespString(200, string(s))
+}
@@ -0,0 +1,68 @@
+package rocserv
+
+import (
+	"context"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorFingerprint(t *testing.T) {
+	ass := assert.New(t)
+
+	stack1 := "goroutine 1 [running]:\nmain.foo(0xc000010000, 0x1)\n\t/app/main.go:10 +0x25\n"
+	stack2 := "goroutine 7 [running]:\nmain.foo(0xc000020000, 0x2)\n\t/app/main.go:10 +0x3a\n"
+	stack3 := "goroutine 1 [running]:\nmain.bar(0xc000010000)\n\t/app/main.go:20 +0x25\n"
+
+	ass.Equal(errorFingerprint(ErrorKindPanic, stack1), errorFingerprint(ErrorKindPanic, stack2))
+	ass.NotEqual(errorFingerprint(ErrorKindPanic, stack1), errorFingerprint(ErrorKindPanic, stack3))
+	ass.NotEqual(errorFingerprint(ErrorKindPanic, stack1), errorFingerprint(ErrorKindError, stack1))
+
+	stack4 := "goroutine 9 [running]:\nmain.foo()\n\t/app/main.go:10 +0x25\ncreated by main.main in goroutine 1\n\t/app/main.go:5 +0x1a\n"
+	stack5 := "goroutine 12 [running]:\nmain.foo()\n\t/app/main.go:10 +0x25\ncreated by main.main in goroutine 8\n\t/app/main.go:5 +0x1a\n"
+	ass.Equal(errorFingerprint(ErrorKindPanic, stack4), errorFingerprint(ErrorKindPanic, stack5))
+}
+
+// recoveredStack 与 ReportPanic 的调用方一样在 recover 后取 runtime.Stack
+func recoveredStack() (stack string) {
+	defer func() {
+		recover()
+		buf := make([]byte, 64<<10)
+		stack = string(buf[:runtime.Stack(buf, false)])
+	}()
+	panic("boom")
+}
+
+func TestErrorFingerprintRuntimeStack(t *testing.T) {
+	ass := assert.New(t)
+
+	capture := func() string {
+		ch := make(chan string)
+		// 每次由不同的 goroutine 创建, stack 中 goroutine 编号不同
+		go func() {
+			go func() { ch <- recoveredStack() }()
+		}()
+		return <-ch
+	}
+	stack1, stack2 := capture(), capture()
+	ass.NotEqual(stack1, stack2)
+	ass.Equal(errorFingerprint(ErrorKindPanic, stack1), errorFingerprint(ErrorKindPanic, stack2))
+}
+
+func TestErrorReporterTop(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	r := NewErrorReporter(2, 10)
+	r.Report(ctx, ErrorKindError, "a", "stack-a")
+	r.Report(ctx, ErrorKindError, "b", "stack-b")
+	r.Report(ctx, ErrorKindError, "b", "stack-b")
+	r.Report(ctx, ErrorKindError, "c", "stack-c")
+
+	top := r.Top(10)
+	ass.Len(top, 2)
+	ass.Equal("b", top[0].Message)
+	ass.Equal(int64(2), top[0].Count)
+	ass.Equal(int64(1), r.dropped)
+}
@@ -0,0 +1,177 @@
+package rocserv
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtrace"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+// 超过该耗时的 etcd 操作打印日志, 框架的后台操作通常没有 trace
+const etcdSlowOpThreshold = 500 * time.Millisecond
+
+// tracedKeysAPI 框架所有 etcd 操作的 trace 和耗时打点, 用于定位启动慢、锁竞争等问题
+type tracedKeysAPI struct {
+	etcd.KeysAPI
+	baseLoc string
+}
+
+// tracedBatchKeysAPI 底层支持批量注册时保留该能力
+type tracedBatchKeysAPI struct {
+	*tracedKeysAPI
+	batch etcdBatchKeysAPI
+}
+
+func traceKeysAPI(client etcd.KeysAPI, baseLoc string) etcd.KeysAPI {
+	t := &tracedKeysAPI{KeysAPI: client, baseLoc: baseLoc}
+	if batch, ok := client.(etcdBatchKeysAPI); ok {
+		return &tracedBatchKeysAPI{tracedKeysAPI: t, batch: batch}
+	}
+	return t
+}
+
+// pathKind base location 下的第一级目录, 如 dist2、lock、etc, 取值有限可作为打点 label
+func (m *tracedKeysAPI) pathKind(key string) string {
+	if !strings.HasPrefix(key, m.baseLoc+"/") {
+		return "other"
+	}
+	rest := key[len(m.baseLoc)+1:]
+	if i := strings.Index(rest, "/"); i >= 0 {
+		rest = rest[:i]
+	}
+	if len(rest) == 0 {
+		return "other"
+	}
+	return rest
+}
+
+// start 返回的 done 在操作结束时调用
+func (m *tracedKeysAPI) start(ctx context.Context, op, key string) (context.Context, func(error)) {
+	kind := m.pathKind(key)
+	st := time.Now()
+
+	// 只在已有 trace 的请求中创建子 span, 避免后台心跳、刷新产生大量独立的 trace
+	var finish func(error)
+	if xtrace.SpanFromContext(ctx) != nil {
+		span, sctx := xtrace.StartSpanFromContext(ctx, "etcd."+op)
+		if span != nil {
+			ctx = sctx
+			span.SetTag("etcd.key", key)
+			span.SetTag("etcd.path", kind)
+			finish = func(err error) {
+				if err != nil && !etcd.IsKeyNotFound(err) {
+					span.SetTag("error", true)
+					span.LogKV("error", err.Error())
+				}
+				span.Finish()
+			}
+		}
+	}
+
+	return ctx, func(err error) {
+		fun := "tracedKeysAPI -->"
+		dur := time.Since(st)
+		if finish != nil {
+			finish(err)
+		}
+
+		status := "ok"
+		if etcd.IsKeyNotFound(err) {
+			status = "not_found"
+		} else if err != nil {
+			status = "error"
+		}
+		group, service := GetGroupAndService()
+		_metricEtcdOpDuration.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelEtcdOp, op, labelEtcdPath, kind, labelStatus, status).Observe(dur.Seconds())
+
+		if dur >= etcdSlowOpThreshold {
+			logger().Warnf(ctx, "%s slow etcd op: %s key: %s dur: %s err: %v", fun, op, key, dur, err)
+		}
+	}
+}
+
+func (m *tracedKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	ctx, done := m.start(ctx, "get", key)
+	r, err := m.KeysAPI.Get(ctx, key, opts)
+	done(err)
+	return r, err
+}
+
+func (m *tracedKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	op := "set"
+	if opts != nil && opts.Refresh {
+		op = "refresh"
+	}
+	ctx, done := m.start(ctx, op, key)
+	r, err := m.KeysAPI.Set(ctx, key, value, opts)
+	done(err)
+	return r, err
+}
+
+// SetShared 底层不支持共用 lease 时按普通 Set 写入
+func (m *tracedKeysAPI) SetShared(ctx context.Context, key, value string, ttl time.Duration) error {
+	ctx, done := m.start(ctx, "set", key)
+	var err error
+	if shared, ok := m.KeysAPI.(sharedLeaseKeysAPI); ok {
+		err = shared.SetShared(ctx, key, value, ttl)
+	} else {
+		_, err = m.KeysAPI.Set(ctx, key, value, &etcd.SetOptions{TTL: ttl})
+	}
+	done(err)
+	return err
+}
+
+func (m *tracedKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	ctx, done := m.start(ctx, "delete", key)
+	r, err := m.KeysAPI.Delete(ctx, key, opts)
+	done(err)
+	return r, err
+}
+
+func (m *tracedKeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	ctx, done := m.start(ctx, "create", key)
+	r, err := m.KeysAPI.Create(ctx, key, value)
+	done(err)
+	return r, err
+}
+
+func (m *tracedKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	ctx, done := m.start(ctx, "create_in_order", dir)
+	r, err := m.KeysAPI.CreateInOrder(ctx, dir, value, opts)
+	done(err)
+	return r, err
+}
+
+func (m *tracedKeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	ctx, done := m.start(ctx, "update", key)
+	r, err := m.KeysAPI.Update(ctx, key, value)
+	done(err)
+	return r, err
+}
+
+func (m *tracedBatchKeysAPI) SetBatch(ctx context.Context, kvs map[string]string, ttl time.Duration) error {
+	var key string
+	for k := range kvs {
+		key = k
+		break
+	}
+	ctx, done := m.start(ctx, "set_batch", key)
+	err := m.batch.SetBatch(ctx, kvs, ttl)
+	done(err)
+	return err
+}
+
+func (m *tracedBatchKeysAPI) RefreshBatch(ctx context.Context, keys []string) error {
+	var key string
+	if len(keys) > 0 {
+		key = keys[0]
+	}
+	ctx, done := m.start(ctx, "refresh_batch", key)
+	err := m.batch.RefreshBatch(ctx, keys)
+	done(err)
+	return err
+}
@@ -0,0 +1,62 @@
+package rocserv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceKeysAPI(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	client := traceKeysAPI(&fakeKeysAPI{}, "/roc")
+	_, ok := client.(etcdBatchKeysAPI)
+	ass.False(ok)
+	_, err := client.Set(ctx, "/roc/dist2/base/account/1/serve", "{}", &etcd.SetOptions{})
+	ass.Nil(err)
+
+	batch := &fakeBatchKeysAPI{}
+	client = traceKeysAPI(batch, "/roc")
+	b, ok := client.(etcdBatchKeysAPI)
+	ass.True(ok)
+	ass.Nil(b.RefreshBatch(ctx, []string{"/roc/dist2/base/account/1/serve"}))
+	ass.Equal([]string{"/roc/dist2/base/account/1/serve"}, batch.refreshes)
+
+	tc := &tracedKeysAPI{baseLoc: "/roc"}
+	ass.Equal("dist2", tc.pathKind("/roc/dist2/base/account/1/serve"))
+	ass.Equal("lock", tc.pathKind("/roc/lock/global/job"))
+	ass.Equal("etc", tc.pathKind("/roc/etc"))
+	ass.Equal("other", tc.pathKind("/other/dist2"))
+	ass.Equal("other", tc.pathKind("/roc/"))
+}
+
+type sharedKeysAPI struct {
+	memKeysAPI
+	shared map[string]time.Duration
+}
+
+func (m *sharedKeysAPI) SetShared(ctx context.Context, key, value string, ttl time.Duration) error {
+	m.shared[key] = ttl
+	return nil
+}
+
+func TestTraceKeysAPISetShared(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	// 底层不支持时按普通 Set 写入
+	mem := &memKeysAPI{values: map[string]*etcd.Node{}}
+	kv := newEtcdServKV(traceKeysAPI(mem, "/roc"), "/roc", "base/account")
+	ass.Nil(kv.Put(ctx, "leader", "1", time.Minute))
+	ass.Equal("1", mem.values["/roc/kv/base/account/leader"].Value)
+
+	shared := &sharedKeysAPI{memKeysAPI: memKeysAPI{values: map[string]*etcd.Node{}}, shared: map[string]time.Duration{}}
+	kv = newEtcdServKV(traceKeysAPI(shared, "/roc"), "/roc", "base/account")
+	ass.Nil(kv.Put(ctx, "leader", "1", time.Minute))
+	ass.Equal(time.Minute, shared.shared["/roc/kv/base/account/leader"])
+	ass.Empty(shared.values)
+}
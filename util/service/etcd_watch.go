@@ -0,0 +1,61 @@
+package rocserv
+
+import (
+	"context"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+// watch 类型, 用于 metric 标签
+const (
+	watchKindRegistry = "registry"
+	watchKindControl  = "control"
+	watchKindKV       = "kv"
+
+	labelWatchKind = "kind"
+
+	// 压缩后重新全量同步前的随机延迟上限
+	compactedResyncJitter = 2 * time.Second
+	// 进程内同时全量同步的 watch 数
+	compactedResyncConcurrency = 4
+)
+
+var compactedResyncSem = make(chan struct{}, compactedResyncConcurrency)
+
+// isWatchCompacted watch 的 index 已被 etcd 压缩清理, 需要重新 get 后再 watch
+func isWatchCompacted(err error) bool {
+	e, ok := err.(etcd.Error)
+	return ok && e.Code == etcd.ErrorCodeEventIndexCleared
+}
+
+// waitCompactedResync etcd 压缩后所有实例的 watch 同时失败, 同时全量 get 会打爆 etcd,
+// 随机延迟后占用一个并发名额, 调用方重新 get 后调用返回的 release 释放
+func waitCompactedResync(ctx context.Context, kind, path string) (release func()) {
+	fun := "waitCompactedResync -->"
+
+	group, service := GetGroupAndService()
+	_metricEtcdWatchCompacted.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelWatchKind, kind).Inc()
+
+	muRetryRand.Lock()
+	delay := time.Duration(retryRand.Int63n(int64(compactedResyncJitter)))
+	muRetryRand.Unlock()
+	logger().Infof(ctx, "%s kind: %s path: %s index compacted, resync after: %v", fun, kind, path, delay)
+
+	t := time.NewTimer(delay)
+	select {
+	case <-ctx.Done():
+		t.Stop()
+		return func() {}
+	case <-t.C:
+	}
+
+	select {
+	case compactedResyncSem <- struct{}{}:
+		return func() { <-compactedResyncSem }
+	case <-ctx.Done():
+		return func() {}
+	}
+}
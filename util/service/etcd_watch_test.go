@@ -0,0 +1,41 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsWatchCompacted(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.True(isWatchCompacted(etcd.Error{Code: etcd.ErrorCodeEventIndexCleared}))
+	ass.False(isWatchCompacted(etcd.Error{Code: etcd.ErrorCodeKeyNotFound}))
+	ass.False(isWatchCompacted(errors.New("cluster is unavailable")))
+	ass.False(isWatchCompacted(nil))
+}
+
+func TestWaitCompactedResyncBounded(t *testing.T) {
+	ass := assert.New(t)
+
+	ctx := context.Background()
+	var releases []func()
+	for i := 0; i < compactedResyncConcurrency; i++ {
+		releases = append(releases, waitCompactedResync(ctx, watchKindKV, "/test"))
+	}
+	ass.Len(compactedResyncSem, compactedResyncConcurrency)
+
+	// 名额用完时等待直到 ctx 结束
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	waitCompactedResync(cctx, watchKindKV, "/test")()
+	ass.Len(compactedResyncSem, compactedResyncConcurrency)
+
+	for _, release := range releases {
+		release()
+	}
+	ass.Len(compactedResyncSem, 0)
+}
@@ -0,0 +1,316 @@
+package rocserv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+const (
+	EventLogID = "EVENT"
+
+	defaultEventQueueSize     = 10240
+	defaultEventBatchSize     = 200
+	defaultEventFlushInterval = time.Second
+
+	eventStatusOK      = "1"
+	eventStatusDropped = "2"
+	eventStatusInvalid = "3"
+	eventStatusFailed  = "4"
+)
+
+var (
+	ErrEventQueueFull     = errors.New("event queue is full")
+	ErrEventSchemaInvalid = errors.New("event does not match schema")
+	ErrEventEmitterClosed = errors.New("event emitter is closed")
+)
+
+// Event structured business event
+type Event struct {
+	Name      string                 `json:"name"`
+	Version   int                    `json:"version"`
+	Service   string                 `json:"service"`
+	Timestamp int64                  `json:"ts"`
+	Fields    map[string]interface{} `json:"fields"`
+}
+
+// EventSchema registered schema of an event, fields in Required must be present
+type EventSchema struct {
+	Name     string
+	Version  int
+	Required []string
+}
+
+// EventSink write a batch of events to file or other pipelines, roc does not depend on a mq client,
+// so sinks of kafka and others are implemented by app with its own producer
+type EventSink interface {
+	Write(ctx context.Context, events []*Event) error
+}
+
+// EventEmitter batch events and write to sink asynchronously,
+// Emit return ErrEventQueueFull instead of blocking when the queue is full
+type EventEmitter struct {
+	queue         chan *Event
+	batchSize     int
+	flushInterval time.Duration
+
+	mu      sync.RWMutex
+	sink    EventSink
+	schemas map[string]*EventSchema
+	closed  bool
+	done    chan struct{}
+}
+
+var (
+	defaultEventEmitter     *EventEmitter
+	defaultEventEmitterOnce sync.Once
+)
+
+// NewEventEmitter create event emitter and start the writing loop
+func NewEventEmitter(sink EventSink, queueSize, batchSize int, flushInterval time.Duration) *EventEmitter {
+	if queueSize <= 0 {
+		queueSize = defaultEventQueueSize
+	}
+	if batchSize <= 0 {
+		batchSize = defaultEventBatchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultEventFlushInterval
+	}
+	if sink == nil {
+		sink = &logEventSink{}
+	}
+
+	m := &EventEmitter{
+		queue:         make(chan *Event, queueSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		sink:          sink,
+		schemas:       make(map[string]*EventSchema),
+		done:          make(chan struct{}),
+	}
+	go m.loop()
+	return m
+}
+
+// GetEventEmitter return the default event emitter, events are written to log until SetSink is called
+func GetEventEmitter() *EventEmitter {
+	defaultEventEmitterOnce.Do(func() {
+		defaultEventEmitter = NewEventEmitter(nil, defaultEventQueueSize, defaultEventBatchSize, defaultEventFlushInterval)
+	})
+	return defaultEventEmitter
+}
+
+func closeDefaultEventEmitter() {
+	defaultEventEmitterOnce.Do(func() {})
+	if defaultEventEmitter != nil {
+		defaultEventEmitter.Close()
+	}
+}
+
+// Emit emit event by default event emitter
+func Emit(ctx context.Context, name string, fields map[string]interface{}) error {
+	return GetEventEmitter().Emit(ctx, name, fields)
+}
+
+// RegisterEventSchema register schema on default event emitter
+func RegisterEventSchema(schema *EventSchema) {
+	GetEventEmitter().RegisterSchema(schema)
+}
+
+// SetSink replace the sink of emitter
+func (m *EventEmitter) SetSink(sink EventSink) {
+	if sink == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sink = sink
+}
+
+// RegisterSchema register or replace the schema of an event name
+func (m *EventEmitter) RegisterSchema(schema *EventSchema) {
+	if schema == nil || len(schema.Name) == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.schemas[schema.Name] = schema
+}
+
+// Emit validate event by schema and put it into queue, fields are copied so the map can be reused after Emit returns
+func (m *EventEmitter) Emit(ctx context.Context, name string, fields map[string]interface{}) error {
+	fun := "EventEmitter.Emit -->"
+
+	// 持有读锁直到入队完成, 避免与 Close 并发时向已关闭的 channel 写入
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return ErrEventEmitterClosed
+	}
+	schema := m.schemas[name]
+
+	// 异步序列化, 复制一层避免调用方修改 map
+	copied := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		copied[k] = v
+	}
+	ev := &Event{
+		Name:      name,
+		Service:   GetServName(),
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Fields:    copied,
+	}
+	if schema != nil {
+		ev.Version = schema.Version
+		for _, f := range schema.Required {
+			if _, ok := fields[f]; !ok {
+				logger().Warnf(ctx, "%s event: %s missing field: %s", fun, name, f)
+				m.stat(name, eventStatusInvalid, 1)
+				return ErrEventSchemaInvalid
+			}
+		}
+	}
+
+	select {
+	case m.queue <- ev:
+		return nil
+	default:
+		m.stat(name, eventStatusDropped, 1)
+		return ErrEventQueueFull
+	}
+}
+
+// Close flush events in queue and stop the writing loop
+func (m *EventEmitter) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	m.mu.Unlock()
+
+	close(m.queue)
+	<-m.done
+}
+
+func (m *EventEmitter) loop() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Event, 0, m.batchSize)
+	for {
+		select {
+		case ev, ok := <-m.queue:
+			if !ok {
+				m.write(batch)
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) >= m.batchSize {
+				m.write(batch)
+				batch = make([]*Event, 0, m.batchSize)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				m.write(batch)
+				batch = make([]*Event, 0, m.batchSize)
+			}
+		}
+	}
+}
+
+func (m *EventEmitter) write(batch []*Event) {
+	fun := "EventEmitter.write -->"
+	ctx := context.Background()
+	if len(batch) == 0 {
+		return
+	}
+
+	m.mu.RLock()
+	sink := m.sink
+	m.mu.RUnlock()
+
+	status := eventStatusOK
+	if err := sink.Write(ctx, batch); err != nil {
+		logger().Errorf(ctx, "%s write events: %d, err: %v", fun, len(batch), err)
+		status = eventStatusFailed
+	}
+
+	counts := make(map[string]int)
+	for _, ev := range batch {
+		counts[ev.Name]++
+	}
+	for name, n := range counts {
+		m.stat(name, status, n)
+	}
+}
+
+func (m *EventEmitter) stat(name, status string, n int) {
+	group, service := GetGroupAndService()
+	_metricEventCount.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelType, name, labelStatus, status).Add(float64(n))
+}
+
+// logEventSink default sink, write events into app log, same as traffic log
+type logEventSink struct {
+}
+
+func (m *logEventSink) Write(ctx context.Context, events []*Event) error {
+	for _, ev := range events {
+		bs, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		logger().Infof(ctx, "%s\t%s", EventLogID, string(bs))
+	}
+	return nil
+}
+
+// FileEventSink write events to file as json lines, used by log collector
+type FileEventSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileEventSink open or create file for appending events
+func NewFileEventSink(path string) (*FileEventSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open event file: %s err: %v", path, err)
+	}
+	return &FileEventSink{file: f}, nil
+}
+
+func (m *FileEventSink) Write(ctx context.Context, events []*Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w := bufio.NewWriter(m.file)
+	for _, ev := range events {
+		bs, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		w.Write(bs)
+		w.WriteByte('\n')
+	}
+	return w.Flush()
+}
+
+// Close close the underlying file
+func (m *FileEventSink) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.file.Close()
+}
@@ -0,0 +1,133 @@
+package rocserv
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memEventSink 记录每次写入的批次, block 非空时写入前等待
+type memEventSink struct {
+	mu      sync.Mutex
+	batches [][]*Event
+	started chan struct{}
+	block   chan struct{}
+}
+
+func (m *memEventSink) Write(ctx context.Context, events []*Event) error {
+	if m.block != nil {
+		m.started <- struct{}{}
+		<-m.block
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches = append(m.batches, events)
+	return nil
+}
+
+func (m *memEventSink) sizes() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sizes []int
+	for _, b := range m.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func TestEventEmitter(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	sink := &memEventSink{}
+	m := NewEventEmitter(sink, 10, 2, time.Hour)
+	m.RegisterSchema(&EventSchema{Name: "order_paid", Version: 2, Required: []string{"order_id"}})
+
+	ass.Equal(ErrEventSchemaInvalid, m.Emit(ctx, "order_paid", map[string]interface{}{"amount": 1}))
+
+	fields := map[string]interface{}{"order_id": 1}
+	ass.Nil(m.Emit(ctx, "order_paid", fields))
+	// 入队后修改 map 不影响已发送的事件
+	fields["order_id"] = 2
+	ass.Nil(m.Emit(ctx, "order_paid", fields))
+	ass.Nil(m.Emit(ctx, "user_login", nil))
+
+	// 达到 batchSize 时写入, Close 时写入剩余的事件
+	m.Close()
+	ass.Equal([]int{2, 1}, sink.sizes())
+	ass.Equal(2, sink.batches[0][0].Version)
+	ass.Equal(1, sink.batches[0][0].Fields["order_id"])
+	ass.Equal(2, sink.batches[0][1].Fields["order_id"])
+	ass.Equal(0, sink.batches[1][0].Version)
+
+	ass.Equal(ErrEventEmitterClosed, m.Emit(ctx, "user_login", nil))
+	m.Close()
+}
+
+func TestEventEmitterFlush(t *testing.T) {
+	ass := assert.New(t)
+
+	sink := &memEventSink{}
+	m := NewEventEmitter(sink, 10, 100, 10*time.Millisecond)
+	defer m.Close()
+
+	ass.Nil(m.Emit(context.Background(), "user_login", nil))
+	ass.Eventually(func() bool { return len(sink.sizes()) == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestEventEmitterQueueFull(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	sink := &memEventSink{started: make(chan struct{}, 1), block: make(chan struct{})}
+	m := NewEventEmitter(sink, 1, 1, time.Hour)
+
+	// 第一个事件写入时阻塞, 第二个占满队列
+	ass.Nil(m.Emit(ctx, "user_login", nil))
+	<-sink.started
+	ass.Nil(m.Emit(ctx, "user_login", nil))
+	ass.Equal(ErrEventQueueFull, m.Emit(ctx, "user_login", nil))
+
+	close(sink.block)
+	go func() {
+		for range sink.started {
+		}
+	}()
+	m.Close()
+	close(sink.started)
+	ass.Equal([]int{1, 1}, sink.sizes())
+}
+
+func TestFileEventSink(t *testing.T) {
+	ass := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "events")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.log")
+	sink, err := NewFileEventSink(path)
+	ass.Nil(err)
+	ass.Nil(sink.Write(context.Background(), []*Event{{Name: "a"}, {Name: "b"}}))
+	ass.Nil(sink.Close())
+
+	f, err := os.Open(path)
+	ass.Nil(err)
+	defer f.Close()
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ev Event
+		ass.Nil(json.Unmarshal(scanner.Bytes(), &ev))
+		names = append(names, ev.Name)
+	}
+	ass.Equal([]string{"a", "b"}, names)
+}
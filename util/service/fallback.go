@@ -0,0 +1,329 @@
+package rocserv
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// FallbackResponse static response served instead of error
+type FallbackResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// RouteFallback fallback of one http route, served when the circuit to a required dependency is open
+// or the handler does not finish in Timeout; Handler has priority over Static
+type RouteFallback struct {
+	Static  *FallbackResponse
+	Handler http.Handler
+	// 处理超时时间, 为 0 时不限制
+	Timeout time.Duration
+	// 必需的下游依赖 servkey, 为空时任意下游熔断都触发降级
+	Dependencies []string
+}
+
+// GrpcFallback fallback of one grpc method
+type GrpcFallback struct {
+	Handler      func(ctx context.Context, req interface{}) (interface{}, error)
+	Timeout      time.Duration
+	Dependencies []string
+}
+
+type openCircuitsKey struct{}
+
+// openCircuits downstream services whose circuit was open during current request
+type openCircuits struct {
+	mu   sync.Mutex
+	deps map[string]bool
+}
+
+func withOpenCircuits(ctx context.Context) (context.Context, *openCircuits) {
+	oc := &openCircuits{deps: make(map[string]bool)}
+	return context.WithValue(ctx, openCircuitsKey{}, oc), oc
+}
+
+// markCircuitOpen called by Breaker when request to servkey is short-circuited
+func markCircuitOpen(ctx context.Context, servkey string) {
+	if oc, ok := ctx.Value(openCircuitsKey{}).(*openCircuits); ok {
+		oc.mu.Lock()
+		oc.deps[servkey] = true
+		oc.mu.Unlock()
+	}
+}
+
+func (m *openCircuits) hit(required []string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(required) == 0 {
+		return len(m.deps) > 0
+	}
+	for _, d := range required {
+		if m.deps[d] {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackWriter buffer response of handler, so it can be replaced by fallback;
+// Flush or Hijack commits the response to w, fallback is not served after that
+type fallbackWriter struct {
+	w http.ResponseWriter
+
+	mu        sync.Mutex
+	header    http.Header
+	status    int
+	buf       bytes.Buffer
+	timeout   bool
+	committed bool
+}
+
+func (w *fallbackWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *fallbackWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timeout {
+		return 0, http.ErrHandlerTimeout
+	}
+	if w.committed {
+		return w.w.Write(b)
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.buf.Write(b)
+}
+
+func (w *fallbackWriter) WriteHeader(status int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timeout || w.committed || w.status != 0 {
+		return
+	}
+	w.status = status
+}
+
+// commitLocked 写出缓冲的响应, 之后的写入直接透传
+func (w *fallbackWriter) commitLocked() {
+	if w.committed {
+		return
+	}
+	w.committed = true
+	dst := w.w.Header()
+	for k, vv := range w.header {
+		dst[k] = vv
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.w.WriteHeader(w.status)
+	w.w.Write(w.buf.Bytes())
+	w.buf.Reset()
+}
+
+func (w *fallbackWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timeout {
+		return
+	}
+	w.commitLocked()
+	if f, ok := w.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *fallbackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timeout {
+		return nil, nil, http.ErrHandlerTimeout
+	}
+	h, ok := w.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer not support hijack")
+	}
+	w.committed = true
+	return h.Hijack()
+}
+
+// expire 超时且响应未写出时标记超时, 返回 false 表示响应已写出, 需要等待 handler 结束
+func (w *fallbackWriter) expire() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.committed {
+		return false
+	}
+	w.timeout = true
+	return true
+}
+
+type routeFallbacks struct {
+	mu     sync.RWMutex
+	routes map[string]*RouteFallback
+}
+
+func (m *routeFallbacks) set(path string, fb *RouteFallback) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.routes == nil {
+		m.routes = make(map[string]*RouteFallback)
+	}
+	m.routes[path] = fb
+}
+
+func (m *routeFallbacks) get(path string) *RouteFallback {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.routes[path]
+}
+
+func serveFallback(w http.ResponseWriter, r *http.Request, fb *RouteFallback) {
+	if fb.Handler != nil {
+		fb.Handler.ServeHTTP(w, r)
+		return
+	}
+	status := http.StatusOK
+	if fb.Static != nil {
+		if fb.Static.Status > 0 {
+			status = fb.Static.Status
+		}
+		if len(fb.Static.ContentType) > 0 {
+			w.Header().Set("Content-Type", fb.Static.ContentType)
+		}
+	}
+	w.WriteHeader(status)
+	if fb.Static != nil {
+		w.Write(fb.Static.Body)
+	}
+}
+
+// middleware serve fallback of routes configured, other routes are passed through
+func (m *routeFallbacks) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fun := "routeFallbacks.middleware -->"
+
+		fb := m.get(r.URL.Path)
+		if fb == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, oc := withOpenCircuits(r.Context())
+		var cancel context.CancelFunc
+		var timeout <-chan time.Time
+		if fb.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, fb.Timeout)
+			defer cancel()
+			timer := time.NewTimer(fb.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		fw := &fallbackWriter{w: w, header: make(http.Header)}
+		done := make(chan struct{})
+		panicChan := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicChan <- p
+				}
+			}()
+			next.ServeHTTP(fw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicChan:
+			panic(p)
+		case <-timeout:
+			if fw.expire() {
+				logger().Warnf(ctx, "%s path: %s timeout: %s, serve fallback", fun, r.URL.Path, fb.Timeout)
+				serveFallback(w, r, fb)
+				return
+			}
+			// 流式响应已开始写出, 不能替换, 等待 handler 结束后才能返回
+			select {
+			case p := <-panicChan:
+				panic(p)
+			case <-done:
+			}
+		case <-done:
+			fw.mu.Lock()
+			defer fw.mu.Unlock()
+			if fw.committed {
+				return
+			}
+			if oc.hit(fb.Dependencies) {
+				logger().Warnf(ctx, "%s path: %s dependency circuit open, serve fallback", fun, r.URL.Path)
+				serveFallback(w, r, fb)
+				return
+			}
+			fw.commitLocked()
+		}
+	})
+}
+
+// Fallback configure fallback response of route, relativePath is matched with request path exactly,
+// so routes with params are not supported; must be called before the processor is powered
+func (s *HttpServer) Fallback(relativePath string, fb *RouteFallback) {
+	if fb == nil {
+		return
+	}
+	if s.fallbacks == nil {
+		s.fallbacks = &routeFallbacks{}
+	}
+	s.fallbacks.set(relativePath, fb)
+}
+
+// RegisterFallback configure fallback of grpc method, fullMethod is like /package.service/method
+func (g *GrpcServer) RegisterFallback(fullMethod string, fb *GrpcFallback) error {
+	if fb == nil || fb.Handler == nil {
+		return fmt.Errorf("grpc fallback of method: %s has no handler", fullMethod)
+	}
+	g.fallbacks.Store(fullMethod, fb)
+	return nil
+}
+
+func (g *GrpcServer) fallbackInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		fun := "GrpcServer.fallbackInterceptor -->"
+
+		v, ok := g.fallbacks.Load(info.FullMethod)
+		if !ok {
+			return handler(ctx, req)
+		}
+		fb := v.(*GrpcFallback)
+
+		parent := ctx
+		ctx, oc := withOpenCircuits(ctx)
+		if fb.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, fb.Timeout)
+			defer cancel()
+		}
+
+		resp, err := handler(ctx, req)
+		if err == nil && !oc.hit(fb.Dependencies) {
+			return resp, err
+		}
+		if err != nil && ctx.Err() != context.DeadlineExceeded && !oc.hit(fb.Dependencies) {
+			return resp, err
+		}
+
+		logger().Warnf(ctx, "%s method: %s err: %v, serve fallback", fun, info.FullMethod, err)
+		return fb.Handler(parent, req)
+	}
+}
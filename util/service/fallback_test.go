@@ -0,0 +1,89 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestRouteFallback(t *testing.T) {
+	ass := assert.New(t)
+
+	fbs := &routeFallbacks{}
+	fbs.set("/slow", &RouteFallback{Static: &FallbackResponse{Status: http.StatusAccepted, Body: []byte("cached")}, Timeout: 20 * time.Millisecond})
+	fbs.set("/stream", &RouteFallback{Static: &FallbackResponse{Body: []byte("cached")}, Timeout: 20 * time.Millisecond})
+	fbs.set("/dep", &RouteFallback{Static: &FallbackResponse{Body: []byte("cached")}, Dependencies: []string{"base/account"}})
+
+	h := fbs.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			<-r.Context().Done()
+			w.Write([]byte("late"))
+		case "/stream":
+			w.Write([]byte("part1,"))
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("part2"))
+		case "/dep":
+			markCircuitOpen(r.Context(), "base/account")
+			w.Write([]byte("partial"))
+		default:
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte("ok"))
+		}
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+
+	rec := serve("/other")
+	ass.Equal(http.StatusCreated, rec.Code)
+	ass.Equal("ok", rec.Body.String())
+
+	rec = serve("/slow")
+	ass.Equal(http.StatusAccepted, rec.Code)
+	ass.Equal("cached", rec.Body.String())
+
+	// 已 flush 的流式响应不被替换
+	rec = serve("/stream")
+	ass.Equal("part1,part2", rec.Body.String())
+	ass.True(rec.Flushed)
+
+	rec = serve("/dep")
+	ass.Equal("cached", rec.Body.String())
+}
+
+func TestGrpcFallback(t *testing.T) {
+	ass := assert.New(t)
+
+	g := &GrpcServer{}
+	ass.NotNil(g.RegisterFallback("/pkg.Serv/Get", nil))
+	ass.NotNil(g.RegisterFallback("/pkg.Serv/Get", &GrpcFallback{}))
+	ass.Nil(g.RegisterFallback("/pkg.Serv/Get", &GrpcFallback{
+		Handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+			return "fallback", nil
+		},
+		Timeout: 10 * time.Millisecond,
+	}))
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/pkg.Serv/Get"}
+	resp, err := g.fallbackInterceptor()(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	ass.Nil(err)
+	ass.Equal("fallback", resp)
+
+	_, err = g.fallbackInterceptor()(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, errors.New("bad request")
+	})
+	ass.EqualError(err, "bad request")
+}
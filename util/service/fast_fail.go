@@ -0,0 +1,82 @@
+package rocserv
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+const (
+	// FastFail 1 enables fast failure when callee has no available instances, configured per service
+	FastFail = "fastFail"
+	// FastFailGrace time(ms) callee stays without available instances before calls fail fast, default is 3000
+	FastFailGrace = "fastFailGraceMsec"
+)
+
+const defaultFastFailGrace = 3 * time.Second
+
+// ErrNoInstances returned immediately by client calls in fast fail mode when callee has no available instances,
+// it is never retried, callers can check it with errors.Is to degrade
+var ErrNoInstances = errors.New("no available instances")
+
+// instanceAvailabler 判断实例是否可用, 不改变实例熔断器状态
+type instanceAvailabler interface {
+	AvailableInstance(s *ServInfo) bool
+}
+
+// unavailableSince servKey/processor -> 首次发现没有可用实例的时间
+var unavailableSince sync.Map
+
+func fastFailGrace(servKey string) (time.Duration, bool) {
+	if on, ok := getFuncConfInt(servKey, Default, FastFail); !ok || on != 1 {
+		return 0, false
+	}
+	if t, ok := getFuncConfInt(servKey, Default, FastFailGrace); ok && t >= 0 {
+		return time.Duration(t) * time.Millisecond, true
+	}
+	return defaultFastFailGrace, true
+}
+
+// hasAvailableInstance 注册中心没有实例或者全部实例被熔断时为 false
+func hasAvailableInstance(cb ClientLookup, processor string) bool {
+	list := cb.GetAllServAddr(processor)
+	a, ok := cb.(instanceAvailabler)
+	if !ok {
+		return len(list) > 0
+	}
+	for _, s := range list {
+		if a.AvailableInstance(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFastFail 没有可用实例超过 grace 后直接返回 ErrNoInstances, 不再路由到已熔断的实例等待连接超时
+func checkFastFail(cb ClientLookup, processor string) error {
+	grace, ok := fastFailGrace(cb.ServKey())
+	if !ok {
+		return nil
+	}
+	return fastFail(cb, processor, grace)
+}
+
+func fastFail(cb ClientLookup, processor string, grace time.Duration) error {
+	servKey := cb.ServKey()
+	key := servKey + "/" + processor
+	if hasAvailableInstance(cb, processor) {
+		unavailableSince.Delete(key)
+		return nil
+	}
+	since, _ := unavailableSince.LoadOrStore(key, time.Now())
+	if time.Since(since.(time.Time)) < grace {
+		return nil
+	}
+
+	group, service := GetGroupAndService()
+	_metricRPCClientFastFail.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, processor, xprom.LabelCalleeService, servKey).Inc()
+	return fmt.Errorf("%w, service: %s processor: %s", ErrNoInstances, cb.ServPath(), processor)
+}
@@ -0,0 +1,33 @@
+package rocserv
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFastFail(t *testing.T) {
+	ass := assert.New(t)
+
+	cli := &ClientEtcdV2{servKey: "base/fastfail"}
+	cli.SetInstanceBreaker(&InstanceBreakerConf{ConsecutiveFailures: 1, Cooldown: time.Hour})
+
+	// 注册中心没有实例, grace 内保持原有行为
+	ass.Nil(fastFail(cli, "proc_grpc", 50*time.Millisecond))
+	time.Sleep(60 * time.Millisecond)
+	err := fastFail(cli, "proc_grpc", 50*time.Millisecond)
+	ass.True(errors.Is(err, ErrNoInstances))
+	ass.False(DefaultRetryPolicy.Retryable(err))
+
+	// 有实例后恢复, 全部熔断后重新计时
+	cli.upServlist(servCopyCollect{1: zoneServCopy(1, "a", 100)})
+	ass.Nil(fastFail(cli, "proc_grpc", 0))
+	s := cli.GetAllServAddr("proc_grpc")[0]
+	cli.ReportInstance(s, errors.New("connection refused"))
+	ass.False(cli.AvailableInstance(s))
+	ass.True(errors.Is(fastFail(cli, "proc_grpc", 0), ErrNoInstances))
+	// 判断可用性不消耗 half-open 探测
+	ass.Equal(map[string]int{s.Addr: breakerOpen}, cli.GetInstanceBreakerStates())
+}
@@ -0,0 +1,53 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFencingToken(t *testing.T) {
+	ass := assert.New(t)
+
+	sb := &ServBaseV2{confEtcd: configEtcd{useBaseloc: "/roc"}, servLocation: "base/account"}
+	_, ok := sb.FencingToken("job")
+	ass.False(ok)
+
+	sb.setFencingToken(sb.localLockPath("job"), lockIndex(&etcd.Response{Node: &etcd.Node{ModifiedIndex: 42}}))
+	token, ok := sb.FencingToken("job")
+	ass.True(ok)
+	ass.Equal(uint64(42), token)
+	_, ok = sb.FencingTokenGlobal("job")
+	ass.False(ok)
+
+	sb.setFencingToken(sb.localLockPath("job"), 0)
+	_, ok = sb.FencingToken("job")
+	ass.False(ok)
+
+	ctx := WithFencingToken(context.Background(), 42)
+	token, ok = FencingTokenFromContext(ctx)
+	ass.True(ok)
+	ass.Equal(uint64(42), token)
+
+	h := http.Header{}
+	_, ok = FencingTokenFromHeader(h)
+	ass.False(ok)
+	SetFencingTokenHeader(h, 42)
+	token, ok = FencingTokenFromHeader(h)
+	ass.True(ok)
+	ass.Equal(uint64(42), token)
+}
+
+func TestFencingGuard(t *testing.T) {
+	ass := assert.New(t)
+
+	g := NewFencingGuard()
+	ass.Nil(g.Check("order", 10))
+	ass.Nil(g.Check("order", 10))
+	ass.Nil(g.Check("order", 12))
+	ass.Equal(ErrStaleFencingToken, g.Check("order", 10))
+	ass.Nil(g.Check("user", 1))
+}
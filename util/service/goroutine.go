@@ -0,0 +1,158 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xcontext"
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+var (
+	ErrGoLimited = errors.New("goroutine limit reached")
+	ErrGoStopped = errors.New("goroutines stopped by shutdown")
+)
+
+const (
+	// 崩溃报告中的 processor
+	goroutineProcessor = "goroutine"
+	// shutdown 时等待 goroutine 退出的最长时间
+	goStopTimeout = 5 * time.Second
+)
+
+type goTracker struct {
+	mu      sync.Mutex
+	stopped bool
+	seq     uint64
+	cancels map[uint64]context.CancelFunc
+	running map[string]int
+	limits  map[string]int
+	wg      sync.WaitGroup
+}
+
+var goroutines = newGoTracker()
+
+func newGoTracker() *goTracker {
+	return &goTracker{
+		cancels: make(map[uint64]context.CancelFunc),
+		running: make(map[string]int),
+		limits:  make(map[string]int),
+	}
+}
+
+// Go run fn in a goroutine tracked by name, panic in fn is recovered and reported as crash with ctx.
+// ctx of fn keeps values of ctx but is not canceled with it, so fn may outlive the request, it is canceled
+// when the service shuts down instead, before the shutdown hook of app. Return ErrGoLimited when running
+// goroutines of name reach the limit set by SetGoLimit, and ErrGoStopped after shutdown
+func Go(ctx context.Context, name string, fn func(ctx context.Context)) error {
+	return goroutines.spawn(ctx, name, fn)
+}
+
+// SetGoLimit set max running goroutines started by Go with name, 0 means unlimited
+func SetGoLimit(name string, limit int) {
+	goroutines.setLimit(name, limit)
+}
+
+// RunningGoroutines return count of running goroutines started by Go, key is name
+func RunningGoroutines() map[string]int {
+	return goroutines.list()
+}
+
+func (m *goTracker) setLimit(name string, limit int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if limit <= 0 {
+		delete(m.limits, name)
+		return
+	}
+	m.limits[name] = limit
+}
+
+func (m *goTracker) list() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]int, len(m.running))
+	for name, n := range m.running {
+		if n > 0 {
+			res[name] = n
+		}
+	}
+	return res
+}
+
+func (m *goTracker) spawn(ctx context.Context, name string, fn func(ctx context.Context)) error {
+	group, service := GetGroupAndService()
+
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return ErrGoStopped
+	}
+	if limit, ok := m.limits[name]; ok && m.running[name] >= limit {
+		m.mu.Unlock()
+		_metricGoRejected.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelPoolName, name).Inc()
+		return ErrGoLimited
+	}
+	m.seq++
+	id := m.seq
+	runCtx, cancel := context.WithCancel(xcontext.NewValueContext(ctx))
+	m.cancels[id] = cancel
+	m.running[name]++
+	running := m.running[name]
+	m.wg.Add(1)
+	m.mu.Unlock()
+	_metricGoRunning.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelPoolName, name).Set(float64(running))
+
+	go func() {
+		defer m.done(id, name)
+		defer func() {
+			if p := recover(); p != nil {
+				reportCrash(runCtx, goroutineProcessor, name, p, nil)
+			}
+		}()
+		fn(runCtx)
+	}()
+	return nil
+}
+
+func (m *goTracker) done(id uint64, name string) {
+	m.mu.Lock()
+	if cancel, ok := m.cancels[id]; ok {
+		cancel()
+		delete(m.cancels, id)
+	}
+	m.running[name]--
+	running := m.running[name]
+	m.mu.Unlock()
+	m.wg.Done()
+
+	group, service := GetGroupAndService()
+	_metricGoRunning.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelPoolName, name).Set(float64(running))
+}
+
+// stop 取消所有 goroutine 的 ctx, 之后不再启动新的 goroutine, 等待退出直到超时
+func (m *goTracker) stop(timeout time.Duration) bool {
+	fun := "goTracker.stop -->"
+
+	m.mu.Lock()
+	m.stopped = true
+	for _, cancel := range m.cancels {
+		cancel()
+	}
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		logger().Warnf(context.Background(), "%s goroutines still running after %v: %v", fun, timeout, m.list())
+		return false
+	}
+}
@@ -0,0 +1,55 @@
+package rocserv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type goTestKey struct{}
+
+func TestGo(t *testing.T) {
+	ass := assert.New(t)
+	defer func() { goroutines = newGoTracker() }()
+
+	// 请求结束后 goroutine 继续执行, 保留 ctx 中的值
+	reqCtx, cancelReq := context.WithCancel(context.WithValue(context.Background(), goTestKey{}, "v"))
+	values := make(chan interface{}, 1)
+	release := make(chan struct{})
+	ass.Nil(Go(reqCtx, "sync", func(ctx context.Context) {
+		<-release
+		values <- ctx.Value(goTestKey{})
+		<-ctx.Done()
+	}))
+	cancelReq()
+
+	SetGoLimit("sync", 1)
+	ass.Equal(ErrGoLimited, Go(context.Background(), "sync", func(context.Context) {}))
+	ass.Equal(map[string]int{"sync": 1}, RunningGoroutines())
+	close(release)
+	ass.Equal("v", <-values)
+
+	// panic 只影响该 goroutine
+	ass.Nil(Go(context.Background(), "panic", func(context.Context) {
+		panic("task bug")
+	}))
+
+	ass.True(goroutines.stop(time.Second))
+	ass.Len(RunningGoroutines(), 0)
+	ass.Equal(ErrGoStopped, Go(context.Background(), "sync", func(context.Context) {}))
+}
+
+func TestGoStopTimeout(t *testing.T) {
+	ass := assert.New(t)
+	defer func() { goroutines = newGoTracker() }()
+
+	release := make(chan struct{})
+	defer close(release)
+	ass.Nil(Go(context.Background(), "stuck", func(context.Context) {
+		<-release
+	}))
+	ass.False(goroutines.stop(10 * time.Millisecond))
+	ass.Equal(map[string]int{"stuck": 1}, RunningGoroutines())
+}
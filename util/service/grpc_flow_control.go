@@ -0,0 +1,167 @@
+package rocserv
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+)
+
+const defaultGrpcSendStallThreshold = 100 * time.Millisecond
+
+// GrpcServerConf http2 flow control and concurrency tuning of GrpcServer, zero means grpc default
+type GrpcServerConf struct {
+	// stream 及连接级别的流控窗口, 大于 64KB 时生效, 大 payload 的流式接口可调大以提升吞吐
+	InitialWindowSize     int32
+	InitialConnWindowSize int32
+	// 单连接并发 stream 数
+	MaxConcurrentStreams uint32
+	// 最大连接数, 超过后新连接等待已有连接关闭
+	MaxConnections  int
+	ReadBufferSize  int
+	WriteBufferSize int
+	MaxRecvMsgSize  int
+	MaxSendMsgSize  int
+	// 流式接口单次 SendMsg 阻塞超过该时间计为一次发送阻塞, 通常是对端流控窗口耗尽; 0 为默认 100ms
+	SendStallThreshold time.Duration
+}
+
+func (m *GrpcServerConf) serverOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if m.InitialWindowSize > 0 {
+		opts = append(opts, grpc.InitialWindowSize(m.InitialWindowSize))
+	}
+	if m.InitialConnWindowSize > 0 {
+		opts = append(opts, grpc.InitialConnWindowSize(m.InitialConnWindowSize))
+	}
+	if m.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(m.MaxConcurrentStreams))
+	}
+	if m.ReadBufferSize > 0 {
+		opts = append(opts, grpc.ReadBufferSize(m.ReadBufferSize))
+	}
+	if m.WriteBufferSize > 0 {
+		opts = append(opts, grpc.WriteBufferSize(m.WriteBufferSize))
+	}
+	if m.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(m.MaxRecvMsgSize))
+	}
+	if m.MaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(m.MaxSendMsgSize))
+	}
+	return opts
+}
+
+func (m *GrpcServerConf) sendStallThreshold() time.Duration {
+	if m == nil || m.SendStallThreshold <= 0 {
+		return defaultGrpcSendStallThreshold
+	}
+	return m.SendStallThreshold
+}
+
+// flowStatsHandler 统计活跃连接, 活跃 stream 及被 RST_STREAM 重置的 stream
+type flowStatsHandler struct{}
+
+type flowMethodKey struct{}
+
+func (m *flowStatsHandler) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	return context.WithValue(ctx, flowMethodKey{}, info.FullMethodName)
+}
+
+func (m *flowStatsHandler) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	group, service := GetGroupAndService()
+	switch st := s.(type) {
+	case *stats.Begin:
+		_metricGrpcStreams.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Add(1)
+	case *stats.End:
+		_metricGrpcStreams.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Add(-1)
+		// 客户端取消或超时时 stream 被 RST_STREAM 重置, 服务端表现为 Canceled
+		if st.Error != nil && status.Code(st.Error) == codes.Canceled {
+			method, _ := ctx.Value(flowMethodKey{}).(string)
+			_metricGrpcStreamReset.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelAPI, method).Inc()
+		}
+	}
+}
+
+// TagConn 记录连接的本地地址, 监听多个地址时据此选择该地址的拦截器
+func (m *flowStatsHandler) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	if info.LocalAddr != nil {
+		ctx = context.WithValue(ctx, localAddrKey{}, info.LocalAddr)
+	}
+	return ctx
+}
+
+func (m *flowStatsHandler) HandleConn(ctx context.Context, s stats.ConnStats) {
+	group, service := GetGroupAndService()
+	switch s.(type) {
+	case *stats.ConnBegin:
+		_metricGrpcConns.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Add(1)
+	case *stats.ConnEnd:
+		_metricGrpcConns.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Add(-1)
+	}
+}
+
+// sendStallStreamServerInterceptor grpc 不暴露流控窗口, SendMsg 在窗口耗尽时阻塞, 以阻塞时间判断窗口耗尽
+func sendStallStreamServerInterceptor(threshold time.Duration) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &stallServerStream{ServerStream: ss, method: info.FullMethod, threshold: threshold})
+	}
+}
+
+type stallServerStream struct {
+	grpc.ServerStream
+	method    string
+	threshold time.Duration
+}
+
+func (m *stallServerStream) SendMsg(msg interface{}) error {
+	st := time.Now()
+	err := m.ServerStream.SendMsg(msg)
+	if time.Since(st) >= m.threshold {
+		group, service := GetGroupAndService()
+		_metricGrpcSendStall.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelAPI, m.method).Inc()
+	}
+	return err
+}
+
+// limitListener 连接数达到上限时 Accept 阻塞, 直到有连接关闭
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func newLimitListener(l net.Listener, n int) net.Listener {
+	if n <= 0 {
+		return l
+	}
+	return &limitListener{Listener: l, sem: make(chan struct{}, n)}
+}
+
+func (m *limitListener) Accept() (net.Conn, error) {
+	m.sem <- struct{}{}
+	c, err := m.Listener.Accept()
+	if err != nil {
+		<-m.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-m.sem }}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (m *limitConn) Close() error {
+	err := m.Conn.Close()
+	m.once.Do(m.release)
+	return err
+}
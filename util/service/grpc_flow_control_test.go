@@ -0,0 +1,62 @@
+package rocserv
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrpcServerConf(t *testing.T) {
+	ass := assert.New(t)
+
+	var conf *GrpcServerConf
+	ass.Equal(defaultGrpcSendStallThreshold, conf.sendStallThreshold())
+
+	conf = &GrpcServerConf{InitialWindowSize: 1 << 20, MaxConcurrentStreams: 100, SendStallThreshold: time.Second}
+	ass.Len(conf.serverOptions(), 2)
+	ass.Equal(time.Second, conf.sendStallThreshold())
+}
+
+func TestLimitListener(t *testing.T) {
+	ass := assert.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ass.Nil(err)
+	ll := newLimitListener(l, 1)
+	defer ll.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := ll.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	c1, err := net.Dial("tcp", l.Addr().String())
+	ass.Nil(err)
+	defer c1.Close()
+	c2, err := net.Dial("tcp", l.Addr().String())
+	ass.Nil(err)
+	defer c2.Close()
+
+	first := <-accepted
+	select {
+	case <-accepted:
+		t.Fatal("second conn accepted over limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("second conn not accepted after first closed")
+	}
+}
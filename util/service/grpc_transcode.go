@@ -0,0 +1,538 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	protov1 "github.com/golang/protobuf/proto"
+	otgrpc "gitlab.pri.ibanyu.com/tracing/go-grpc"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// grpc-gateway 约定的 header 前缀, 去掉前缀后作为 grpc metadata
+const transcodeMetadataPrefix = "Grpc-Metadata-"
+
+// TranscodeGrpc add REST/JSON routes mapped by google.api.http annotations of services registered to grpcServer,
+// requests are forwarded to grpcServer through a loopback connection, so grpc interceptors such as auth and
+// metrics apply; call it after services are registered. Routes of the same method and path as registered gin
+// routes are skipped, transcoding is unavailable when grpcServer only serves with tls
+func (s *HttpServer) TranscodeGrpc(grpcServer *GrpcServer) error {
+	fun := "HttpServer.TranscodeGrpc -->"
+	ctx := context.Background()
+
+	routes, err := transcodeRoutes(grpcServer.Server.GetServiceInfo())
+	if err != nil {
+		return err
+	}
+
+	registered := make(map[string]bool)
+	for _, r := range s.Engine.Routes() {
+		registered[r.Method+" "+r.Path] = true
+	}
+	t := &grpcTranscoder{grpc: grpcServer}
+	for _, r := range routes {
+		if registered[r.method+" "+r.path] {
+			logger().Warnf(ctx, "%s %s %s conflicts with registered route, skip %s", fun, r.method, r.path, r.fullMethod)
+			continue
+		}
+		logger().Infof(ctx, "%s %s %s -> %s", fun, r.method, r.path, r.fullMethod)
+		t.routes = append(t.routes, r)
+	}
+	s.transcoder = t
+	return nil
+}
+
+type transcodeRoute struct {
+	method       string
+	path         string
+	template     *pathTemplate
+	fullMethod   string
+	input        protoreflect.MessageType
+	output       protoreflect.MessageType
+	body         string
+	responseBody string
+}
+
+// transcodeRoutes 从已注册 service 的描述符中读取 google.api.http 注解, 包括 additional_bindings
+func transcodeRoutes(services map[string]grpc.ServiceInfo) ([]*transcodeRoute, error) {
+	var routes []*transcodeRoute
+	for name := range services {
+		// 未注册描述符的 service 无法读取注解, 如手写的 ServiceDesc
+		d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			logger().Warnf(context.Background(), "transcodeRoutes --> service: %s descriptor not found: %v", name, err)
+			continue
+		}
+		sd, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a service", name)
+		}
+		methods := sd.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			md := methods.Get(i)
+			if md.IsStreamingClient() || md.IsStreamingServer() {
+				continue
+			}
+			rule := httpRuleOf(md)
+			if rule == nil {
+				continue
+			}
+			rs, err := newTranscodeRoutes(md, rule)
+			if err != nil {
+				return nil, fmt.Errorf("method: %s %v", md.FullName(), err)
+			}
+			routes = append(routes, rs...)
+		}
+	}
+	return routes, nil
+}
+
+func httpRuleOf(md protoreflect.MethodDescriptor) *annotations.HttpRule {
+	opts, ok := md.Options().(protov1.Message)
+	if !ok || opts == nil || !protov1.HasExtension(opts, annotations.E_Http) {
+		return nil
+	}
+	v, err := protov1.GetExtension(opts, annotations.E_Http)
+	if err != nil {
+		return nil
+	}
+	rule, _ := v.(*annotations.HttpRule)
+	return rule
+}
+
+func newTranscodeRoutes(md protoreflect.MethodDescriptor, rule *annotations.HttpRule) ([]*transcodeRoute, error) {
+	input, err := protoregistry.GlobalTypes.FindMessageByName(md.Input().FullName())
+	if err != nil {
+		return nil, err
+	}
+	output, err := protoregistry.GlobalTypes.FindMessageByName(md.Output().FullName())
+	if err != nil {
+		return nil, err
+	}
+
+	var method, path string
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		method, path = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		method, path = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		method, path = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		method, path = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		method, path = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		method, path = p.Custom.GetKind(), p.Custom.GetPath()
+	default:
+		return nil, fmt.Errorf("http rule without pattern")
+	}
+	template, err := parsePathTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []*transcodeRoute{{
+		method:       method,
+		path:         path,
+		template:     template,
+		fullMethod:   fmt.Sprintf("/%s/%s", md.Parent().FullName(), md.Name()),
+		input:        input,
+		output:       output,
+		body:         rule.GetBody(),
+		responseBody: rule.GetResponseBody(),
+	}}
+	for _, binding := range rule.GetAdditionalBindings() {
+		rs, err := newTranscodeRoutes(md, binding)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, rs...)
+	}
+	return routes, nil
+}
+
+// pathTemplate google.api.http 的路径模板, 如 /v1/{name=shelves/*/books/*}:publish, ** 只能在最后
+type pathTemplate struct {
+	// 字面量, "*" 或 "**"
+	segments []string
+	vars     []pathVar
+	verb     string
+}
+
+// pathVar 变量对应 segments[start:end]
+type pathVar struct {
+	field      string
+	start, end int
+}
+
+func parsePathTemplate(path string) (*pathTemplate, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path: %s must start with /", path)
+	}
+	t := &pathTemplate{}
+	rest := path[1:]
+	// verb 在最后一个 "}" 或 "/" 之后
+	if i := strings.LastIndex(rest, ":"); i >= 0 && i > strings.LastIndexAny(rest, "}/") {
+		rest, t.verb = rest[:i], rest[i+1:]
+	}
+
+	for len(rest) > 0 {
+		if rest[0] == '{' {
+			end := strings.Index(rest, "}")
+			if end < 0 {
+				return nil, fmt.Errorf("path: %s unclosed variable", path)
+			}
+			field, sub := rest[1:end], "*"
+			if i := strings.Index(field, "="); i >= 0 {
+				field, sub = field[:i], field[i+1:]
+			}
+			v := pathVar{field: field, start: len(t.segments)}
+			t.segments = append(t.segments, strings.Split(sub, "/")...)
+			v.end = len(t.segments)
+			t.vars = append(t.vars, v)
+			rest = rest[end+1:]
+		} else {
+			end := strings.Index(rest, "/")
+			if end < 0 {
+				end = len(rest)
+			}
+			t.segments = append(t.segments, rest[:end])
+			rest = rest[end:]
+		}
+		if strings.HasPrefix(rest, "/") {
+			rest = rest[1:]
+			if len(rest) == 0 {
+				return nil, fmt.Errorf("path: %s ends with /", path)
+			}
+		} else if len(rest) > 0 {
+			return nil, fmt.Errorf("path: %s invalid near: %s", path, rest)
+		}
+	}
+	for i, seg := range t.segments {
+		if seg == "**" && i != len(t.segments)-1 {
+			return nil, fmt.Errorf("path: %s ** must be the last segment", path)
+		}
+	}
+	return t, nil
+}
+
+// match 返回变量的值, 单个 segment 的变量按 url 解码
+func (m *pathTemplate) match(escapedPath string) (map[string]string, bool) {
+	path := strings.TrimPrefix(escapedPath, "/")
+	if len(m.verb) > 0 {
+		if !strings.HasSuffix(path, ":"+m.verb) {
+			return nil, false
+		}
+		path = strings.TrimSuffix(path, ":"+m.verb)
+	}
+	parts := strings.Split(path, "/")
+
+	n := len(m.segments)
+	deep := n > 0 && m.segments[n-1] == "**"
+	if (!deep && len(parts) != n) || (deep && len(parts) < n) {
+		return nil, false
+	}
+	for i, seg := range m.segments {
+		if seg != "*" && seg != "**" && seg != parts[i] {
+			return nil, false
+		}
+		if seg == "*" && len(parts[i]) == 0 {
+			return nil, false
+		}
+	}
+
+	vars := make(map[string]string, len(m.vars))
+	for _, v := range m.vars {
+		end := v.end
+		if deep && end == n {
+			end = len(parts)
+		}
+		if end-v.start == 1 {
+			s, err := url.PathUnescape(parts[v.start])
+			if err != nil {
+				return nil, false
+			}
+			vars[v.field] = s
+			continue
+		}
+		vars[v.field] = strings.Join(parts[v.start:end], "/")
+	}
+	return vars, true
+}
+
+type grpcTranscoder struct {
+	grpc   *GrpcServer
+	routes []*transcodeRoute
+
+	muConn sync.Mutex
+	conn   *grpc.ClientConn
+}
+
+func (m *grpcTranscoder) find(r *http.Request) (*transcodeRoute, map[string]string) {
+	for _, route := range m.routes {
+		if route.method != r.Method {
+			continue
+		}
+		if vars, ok := route.template.match(r.URL.EscapedPath()); ok {
+			return route, vars
+		}
+	}
+	return nil, nil
+}
+
+// middleware 与注解匹配的请求转为 grpc 调用, 其他请求交给 gin
+func (m *grpcTranscoder) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, vars := m.find(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.serve(w, r, route, vars)
+	})
+}
+
+func (m *grpcTranscoder) clientConn() (*grpc.ClientConn, error) {
+	m.muConn.Lock()
+	defer m.muConn.Unlock()
+	if m.conn != nil {
+		return m.conn, nil
+	}
+	addr := m.grpc.plainAddr()
+	if len(addr) == 0 {
+		return nil, fmt.Errorf("grpc server is not serving without tls")
+	}
+	conn, err := grpc.Dial(addr, grpc.WithInsecure(),
+		grpc.WithChainUnaryInterceptor(
+			otgrpc.OpenTracingClientInterceptorWithGlobalTracer(),
+			otelClientInterceptor(),
+			baggageClientInterceptor()))
+	if err != nil {
+		return nil, err
+	}
+	m.conn = conn
+	return conn, nil
+}
+
+func (m *grpcTranscoder) serve(w http.ResponseWriter, r *http.Request, route *transcodeRoute, vars map[string]string) {
+	fun := "grpcTranscoder.serve -->"
+	ctx := r.Context()
+
+	req := route.input.New()
+	if err := route.decodeRequest(r, req, vars); err != nil {
+		writeTranscodeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	conn, err := m.clientConn()
+	if err != nil {
+		logger().Errorf(ctx, "%s %s dial err: %v", fun, route.fullMethod, err)
+		writeTranscodeError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	resp := route.output.New()
+	ctx = metadata.NewOutgoingContext(ctx, transcodeMetadata(r.Header))
+	if err := conn.Invoke(ctx, route.fullMethod, protov1.MessageV1(req.Interface()), protov1.MessageV1(resp.Interface())); err != nil {
+		s, _ := status.FromError(err)
+		writeTranscodeError(w, httpStatusFromError(err), s.Message())
+		return
+	}
+
+	js, err := route.encodeResponse(resp)
+	if err != nil {
+		writeTranscodeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func transcodeMetadata(h http.Header) metadata.MD {
+	md := metadata.MD{}
+	for k, vs := range h {
+		switch {
+		case k == "Authorization":
+			md.Append("authorization", vs...)
+		case strings.HasPrefix(k, transcodeMetadataPrefix):
+			md.Append(strings.ToLower(strings.TrimPrefix(k, transcodeMetadataPrefix)), vs...)
+		}
+	}
+	return md
+}
+
+func writeTranscodeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "message": msg})
+}
+
+// decodeRequest 依次使用 body, 路径变量及 query, body 为 * 时不使用 query
+func (m *transcodeRoute) decodeRequest(r *http.Request, msg protoreflect.Message, vars map[string]string) error {
+	if len(m.body) > 0 {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		if len(body) > 0 {
+			// 指定字段时包装为该字段, 由 protojson 处理各种类型
+			if m.body != "*" {
+				body = []byte(fmt.Sprintf("{%q:%s}", m.body, body))
+			}
+			if err := protojson.Unmarshal(body, msg.Interface()); err != nil {
+				return fmt.Errorf("invalid body: %v", err)
+			}
+		}
+	}
+	for field, value := range vars {
+		if err := setFieldPath(msg, field, []string{value}); err != nil {
+			return err
+		}
+	}
+	if m.body == "*" {
+		return nil
+	}
+	for field, values := range r.URL.Query() {
+		if _, ok := vars[field]; ok {
+			continue
+		}
+		if err := setFieldPath(msg, field, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *transcodeRoute) encodeResponse(resp protoreflect.Message) ([]byte, error) {
+	js, err := protojson.Marshal(resp.Interface())
+	if err != nil || len(m.responseBody) == 0 {
+		return js, err
+	}
+	fd := resp.Descriptor().Fields().ByName(protoreflect.Name(m.responseBody))
+	if fd == nil {
+		return nil, fmt.Errorf("response body field: %s not found", m.responseBody)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(js, &fields); err != nil {
+		return nil, err
+	}
+	if v, ok := fields[fd.JSONName()]; ok {
+		return v, nil
+	}
+	return []byte("null"), nil
+}
+
+// setFieldPath 按 a.b.c 设置字段, 中间字段须为 message, repeated 字段追加所有值
+func setFieldPath(msg protoreflect.Message, path string, values []string) error {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fd := msg.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = msg.Descriptor().Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return fmt.Errorf("field: %s not found", path)
+		}
+		if i < len(names)-1 {
+			if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+				return fmt.Errorf("field: %s is not a message", path)
+			}
+			msg = msg.Mutable(fd).Message()
+			continue
+		}
+		if fd.IsMap() || (fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind) {
+			return fmt.Errorf("field: %s can not be set from string", path)
+		}
+		if fd.IsList() {
+			list := msg.Mutable(fd).List()
+			for _, s := range values {
+				v, err := parseScalar(fd, s)
+				if err != nil {
+					return fmt.Errorf("field: %s %v", path, err)
+				}
+				list.Append(v)
+			}
+			return nil
+		}
+		if len(values) == 0 {
+			return nil
+		}
+		v, err := parseScalar(fd, values[len(values)-1])
+		if err != nil {
+			return fmt.Errorf("field: %s %v", path, err)
+		}
+		msg.Set(fd, v)
+	}
+	return nil
+}
+
+func parseScalar(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		v, err := base64.URLEncoding.DecodeString(s)
+		if err != nil {
+			v, err = base64.StdEncoding.DecodeString(s)
+		}
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		v, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("invalid enum: %s", s)
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), nil
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported kind: %s", fd.Kind())
+}
+
+// plainAddr 非 TLS 的监听地址, 转码时连接该地址
+func (g *GrpcServer) plainAddr() string {
+	v, _ := g.servedAddr.Load().(string)
+	return v
+}
+
+// setPlainAddr 只记录第一个地址
+func (g *GrpcServer) setPlainAddr(addr string) {
+	if len(g.plainAddr()) == 0 {
+		g.servedAddr.Store(addr)
+	}
+}
@@ -0,0 +1,148 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type testOperations struct {
+	longrunning.UnimplementedOperationsServer
+	md metadata.MD
+}
+
+func (m *testOperations) GetOperation(ctx context.Context, req *longrunning.GetOperationRequest) (*longrunning.Operation, error) {
+	m.md, _ = metadata.FromIncomingContext(ctx)
+	if req.Name == "operations/missing" {
+		return nil, status.Error(codes.NotFound, "operation not found")
+	}
+	return &longrunning.Operation{Name: req.Name, Done: true}, nil
+}
+
+func (m *testOperations) ListOperations(ctx context.Context, req *longrunning.ListOperationsRequest) (*longrunning.ListOperationsResponse, error) {
+	return &longrunning.ListOperationsResponse{
+		Operations:    []*longrunning.Operation{{Name: req.Name + "/" + req.Filter}},
+		NextPageToken: req.PageToken,
+	}, nil
+}
+
+func (m *testOperations) CancelOperation(ctx context.Context, req *longrunning.CancelOperationRequest) (*empty.Empty, error) {
+	return &empty.Empty{}, nil
+}
+
+func TestParsePathTemplate(t *testing.T) {
+	ass := assert.New(t)
+
+	tpl, err := parsePathTemplate("/v1/{name=shelves/*/books/*}:publish")
+	ass.Nil(err)
+	ass.Equal("publish", tpl.verb)
+	vars, ok := tpl.match("/v1/shelves/s1/books/b%2F1:publish")
+	ass.True(ok)
+	ass.Equal("shelves/s1/books/b%2F1", vars["name"])
+	_, ok = tpl.match("/v1/shelves/s1/books/b1")
+	ass.False(ok)
+	_, ok = tpl.match("/v1/shelves/s1/notes/b1:publish")
+	ass.False(ok)
+
+	tpl, err = parsePathTemplate("/v1/users/{user_id}/{path=**}")
+	ass.Nil(err)
+	vars, ok = tpl.match("/v1/users/u%201/a/b/c")
+	ass.True(ok)
+	ass.Equal("u 1", vars["user_id"])
+	ass.Equal("a/b/c", vars["path"])
+	_, ok = tpl.match("/v1/users//a")
+	ass.False(ok)
+
+	for _, path := range []string{"v1/a", "/v1/{a", "/v1/**/a", "/v1/a/", "/v1/{a}b"} {
+		_, err := parsePathTemplate(path)
+		ass.NotNil(err, path)
+	}
+}
+
+func TestTranscodeGrpc(t *testing.T) {
+	ass := assert.New(t)
+
+	ops := &testOperations{}
+	gs := &GrpcServer{Server: grpc.NewServer()}
+	longrunning.RegisterOperationsServer(gs.Server, ops)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	ass.Nil(err)
+	go gs.Server.Serve(lis)
+	defer gs.Server.Stop()
+
+	hs := &HttpServer{Engine: gin.New()}
+	// 已注册的路由优先
+	hs.GET("/v1/:name", func(c *Context) { c.String(http.StatusOK, "gin") })
+	ass.Nil(hs.TranscodeGrpc(gs))
+	handler := hs.transcoder.middleware(hs.Engine)
+
+	do := func(method, target, body string, header http.Header) (int, string) {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, vs := range header {
+			r.Header[k] = vs
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		b, _ := ioutil.ReadAll(w.Body)
+		return w.Code, string(b)
+	}
+
+	// grpc 未启动
+	code, _ := do(http.MethodGet, "/v1/operations/a", "", nil)
+	ass.Equal(http.StatusServiceUnavailable, code)
+
+	gs.setPlainAddr(lis.Addr().String())
+	code, body := do(http.MethodGet, "/v1/operations/a/b", "", http.Header{
+		"Authorization":        {"Bearer t"},
+		"Grpc-Metadata-Tenant": {"t1"},
+		"X-Other":              {"x"},
+	})
+	ass.Equal(http.StatusOK, code)
+	op := map[string]interface{}{}
+	ass.Nil(json.Unmarshal([]byte(body), &op))
+	ass.Equal("operations/a/b", op["name"])
+	ass.Equal(true, op["done"])
+	ass.Equal([]string{"Bearer t"}, ops.md.Get("authorization"))
+	ass.Equal([]string{"t1"}, ops.md.Get("tenant"))
+	ass.Nil(ops.md.Get("x-other"))
+
+	// query 参数按 json 名称或字段名设置
+	code, body = do(http.MethodGet, "/v1/operations?filter=done&pageToken=p2", "", nil)
+	ass.Equal(http.StatusOK, code)
+	ass.Contains(body, `"name":"operations/done"`)
+	ass.Contains(body, `"nextPageToken":"p2"`)
+
+	code, body = do(http.MethodGet, "/v1/operations?page_size=x", "", nil)
+	ass.Equal(http.StatusBadRequest, code)
+
+	code, body = do(http.MethodPost, "/v1/operations/a:cancel", `{}`, nil)
+	ass.Equal(http.StatusOK, code)
+	ass.Equal("{}", body)
+
+	code, body = do(http.MethodGet, "/v1/operations/missing", "", nil)
+	ass.Equal(http.StatusNotFound, code)
+	ass.Contains(body, "operation not found")
+
+	// 未实现的方法
+	code, _ = do(http.MethodDelete, "/v1/operations/a", "", nil)
+	ass.Equal(http.StatusNotImplemented, code)
+
+	// 与注解不匹配的请求交给 gin
+	code, body = do(http.MethodGet, "/v1/other", "", nil)
+	ass.Equal(http.StatusOK, code)
+	ass.Equal("gin", body)
+}
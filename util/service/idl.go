@@ -0,0 +1,167 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+const (
+	IDL_KIND_THRIFT = "thrift"
+	IDL_KIND_PROTO  = "proto"
+	// gzip 压缩的 FileDescriptorProto, 即 protoc-gen-go 生成代码中注册的描述符
+	IDL_KIND_PROTO_DESCRIPTOR = "proto_descriptor"
+
+	idlCurrent = "current"
+)
+
+// IDLFile one interface definition file of service
+type IDLFile struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Content []byte `json:"content"`
+}
+
+// IDLBundle all idl files published by one version of service
+type IDLBundle struct {
+	Hash  string     `json:"hash"`
+	Files []*IDLFile `json:"files"`
+	Ctime int64      `json:"ctime"`
+}
+
+var (
+	muIDLFiles sync.Mutex
+	idlFiles   = make(map[string]*IDLFile)
+)
+
+// RegisterIDL register idl file of service, registered files are published into registry at startup;
+// must be called before Serve or in initfn
+func RegisterIDL(kind, name string, content []byte) {
+	muIDLFiles.Lock()
+	defer muIDLFiles.Unlock()
+	idlFiles[name] = &IDLFile{Name: name, Kind: kind, Content: content}
+}
+
+func registeredIDLFiles() []*IDLFile {
+	muIDLFiles.Lock()
+	defer muIDLFiles.Unlock()
+
+	files := make([]*IDLFile, 0, len(idlFiles))
+	for _, f := range idlFiles {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+// idlHash files 需要按名字排序
+func idlHash(files []*IDLFile) string {
+	h := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00", f.Name, f.Kind, len(f.Content))
+		h.Write(f.Content)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func idlPath(baseLoc, servLocation string) string {
+	return fmt.Sprintf("%s/%s/%s", baseLoc, BASE_LOC_IDL, servLocation)
+}
+
+// publishIDL 按内容 hash 去重, 相同版本的多个副本只写入一次
+func (m *ServBaseV2) publishIDL() error {
+	fun := "ServBaseV2.publishIDL -->"
+	ctx := context.Background()
+
+	files := registeredIDLFiles()
+	// 本地启动不发布
+	if len(files) == 0 || m.IsLocalRunning() {
+		return nil
+	}
+
+	bundle := &IDLBundle{
+		Hash:  idlHash(files),
+		Files: files,
+		Ctime: time.Now().Unix(),
+	}
+	js, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+
+	path := idlPath(m.confEtcd.useBaseloc, m.servLocation)
+	_, err = m.etcdClient.Set(ctx, path+"/"+bundle.Hash, string(js), &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+	if err != nil {
+		if e, ok := err.(etcd.Error); !ok || e.Code != etcd.ErrorCodeNodeExist {
+			return err
+		}
+	}
+
+	current, err := m.getValueFromEtcd(path + "/" + idlCurrent)
+	if err == nil && current == bundle.Hash {
+		logger().Infof(ctx, "%s idl hash: %s not changed", fun, bundle.Hash)
+		return nil
+	}
+	logger().Infof(ctx, "%s publish idl hash: %s files: %d", fun, bundle.Hash, len(files))
+	return m.setValueToEtcd(path+"/"+idlCurrent, bundle.Hash, nil)
+}
+
+// GetIDL get idl bundle of servLocation by hash, empty hash means the latest published one, used by roc-ctl
+func GetIDL(ctx context.Context, client etcd.KeysAPI, baseLoc, servLocation, hash string) (*IDLBundle, error) {
+	path := idlPath(baseLoc, servLocation)
+	if len(hash) == 0 {
+		r, err := client.Get(ctx, path+"/"+idlCurrent, nil)
+		if err != nil {
+			return nil, err
+		}
+		hash = r.Node.Value
+	}
+
+	r, err := client.Get(ctx, path+"/"+hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	var bundle IDLBundle
+	if err := json.Unmarshal([]byte(r.Node.Value), &bundle); err != nil {
+		return nil, fmt.Errorf("unmarshal idl key: %s err: %v", r.Node.Key, err)
+	}
+	return &bundle, nil
+}
+
+// ListIDLVersions list hash of all idl bundles published by servLocation, ordered by publish time
+func ListIDLVersions(ctx context.Context, client etcd.KeysAPI, baseLoc, servLocation string) ([]string, error) {
+	path := idlPath(baseLoc, servLocation)
+	r, err := client.Get(ctx, path, &etcd.GetOptions{Recursive: false})
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	nodes := make([]*etcd.Node, 0, len(r.Node.Nodes))
+	for _, n := range r.Node.Nodes {
+		if n.Key == path+"/"+idlCurrent {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].CreatedIndex < nodes[j].CreatedIndex
+	})
+
+	hashes := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		hashes = append(hashes, n.Key[len(path)+1:])
+	}
+	return hashes, nil
+}
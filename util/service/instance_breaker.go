@@ -0,0 +1,234 @@
+package rocserv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// InstanceBreakerConf thresholds of per-instance circuit breaker of ClientEtcdV2
+type InstanceBreakerConf struct {
+	// 连续失败次数达到后熔断
+	ConsecutiveFailures int64
+	// 统计窗口内请求数不少于 MinRequests 且失败率达到 ErrorRate 后熔断
+	ErrorRate   float64
+	MinRequests int64
+	Window      time.Duration
+	// 熔断后经过 Cooldown 放行一个探测请求
+	Cooldown time.Duration
+}
+
+// DefaultInstanceBreakerConf default thresholds used by ClientEtcdV2
+var DefaultInstanceBreakerConf = InstanceBreakerConf{
+	ConsecutiveFailures: 5,
+	ErrorRate:           0.5,
+	MinRequests:         20,
+	Window:              10 * time.Second,
+	Cooldown:            5 * time.Second,
+}
+
+type instanceBreakerState struct {
+	state       int
+	consecutive int64
+	total       int64
+	fail        int64
+	windowStart time.Time
+	// open 时为熔断时间, half-open 时为探测请求放行时间
+	changedAt time.Time
+}
+
+type instanceBreakers struct {
+	servKey string
+	conf    InstanceBreakerConf
+
+	mu        sync.Mutex
+	instances map[string]*instanceBreakerState
+	lastSweep time.Time
+}
+
+func newInstanceBreakers(servKey string, conf InstanceBreakerConf) *instanceBreakers {
+	return &instanceBreakers{
+		servKey:   servKey,
+		conf:      conf,
+		instances: make(map[string]*instanceBreakerState),
+	}
+}
+
+// isOpen 熔断中的实例不参与路由, 只判断不改变状态, 用于过滤候选实例
+func (m *instanceBreakers) isOpen(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st, ok := m.instances[addr]
+	if !ok || st.state == breakerClosed {
+		return false
+	}
+	// open 时冷却中, half-open 时探测请求未上报结果且未超过冷却时间
+	return time.Since(st.changedAt) < m.conf.Cooldown
+}
+
+// acquire 只对最终选中的实例调用, open 状态冷却后转为 half-open 并占用探测名额;
+// 返回 false 表示实例仍在熔断中
+func (m *instanceBreakers) acquire(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st, ok := m.instances[addr]
+	if !ok {
+		return true
+	}
+
+	now := time.Now()
+	switch st.state {
+	case breakerOpen:
+		if now.Sub(st.changedAt) < m.conf.Cooldown {
+			return false
+		}
+		m.setState(addr, st, breakerHalfOpen, now)
+		return true
+	case breakerHalfOpen:
+		// 探测请求未上报结果时, 冷却后再放行一个
+		if now.Sub(st.changedAt) < m.conf.Cooldown {
+			return false
+		}
+		st.changedAt = now
+		return true
+	}
+	return true
+}
+
+func (m *instanceBreakers) report(addr string, failed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+	st, ok := m.instances[addr]
+	if !ok {
+		st = &instanceBreakerState{windowStart: now}
+		m.instances[addr] = st
+	}
+
+	if st.state == breakerHalfOpen {
+		if failed {
+			m.setState(addr, st, breakerOpen, now)
+		} else {
+			m.setState(addr, st, breakerClosed, now)
+		}
+		return
+	}
+	if st.state == breakerOpen {
+		return
+	}
+
+	if now.Sub(st.windowStart) >= m.conf.Window {
+		st.total, st.fail, st.windowStart = 0, 0, now
+	}
+	st.total++
+	if !failed {
+		st.consecutive = 0
+		return
+	}
+	st.fail++
+	st.consecutive++
+
+	if (m.conf.ConsecutiveFailures > 0 && st.consecutive >= m.conf.ConsecutiveFailures) ||
+		(m.conf.ErrorRate > 0 && st.total >= m.conf.MinRequests && float64(st.fail)/float64(st.total) >= m.conf.ErrorRate) {
+		m.setState(addr, st, breakerOpen, now)
+	}
+}
+
+func (m *instanceBreakers) setState(addr string, st *instanceBreakerState, state int, now time.Time) {
+	fun := "instanceBreakers.setState -->"
+
+	logger().Warnf(context.Background(), "%s serv: %s addr: %s state: %d -> %d, total: %d fail: %d consecutive: %d",
+		fun, m.servKey, addr, st.state, state, st.total, st.fail, st.consecutive)
+
+	st.state = state
+	st.changedAt = now
+	st.total, st.fail, st.consecutive, st.windowStart = 0, 0, 0, now
+
+	group, service := GetGroupAndService()
+	_metricInstanceBreakerState.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelCalleeService, m.servKey, calleeAddr, addr).Set(float64(state))
+
+	// 恢复后重新统计
+	if state == breakerClosed {
+		delete(m.instances, addr)
+	}
+}
+
+// sweep 清理超过一个窗口没有请求的 closed 实例, 避免下线实例一直占用
+func (m *instanceBreakers) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < m.conf.Window {
+		return
+	}
+	m.lastSweep = now
+	for addr, st := range m.instances {
+		if st.state == breakerClosed && now.Sub(st.windowStart) >= m.conf.Window {
+			delete(m.instances, addr)
+		}
+	}
+}
+
+// states addr -> state, only instances not closed are returned
+func (m *instanceBreakers) states() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make(map[string]int, len(m.instances))
+	for addr, st := range m.instances {
+		if st.state != breakerClosed {
+			res[addr] = st.state
+		}
+	}
+	return res
+}
+
+// isInstanceFailure grpc 业务状态码不计为实例故障, 其他错误如连接和超时均计入
+func isInstanceFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal, codes.Unknown:
+			return true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type instanceReporter interface {
+	ReportInstance(s *ServInfo, err error)
+}
+
+// reportInstance 上报单次请求结果到 lookup 的实例熔断器
+func reportInstance(cb ClientLookup, s *ServInfo, err error) {
+	if r, ok := cb.(instanceReporter); ok && s != nil {
+		r.ReportInstance(s, err)
+	}
+}
+
+type instanceAllower interface {
+	AllowInstance(s *ServInfo) bool
+}
+
+// acquireInstance 对路由最终选中的实例占用熔断器的探测名额
+func acquireInstance(cb ClientLookup, s *ServInfo) {
+	if a, ok := cb.(instanceAllower); ok && s != nil {
+		a.AllowInstance(s)
+	}
+}
@@ -0,0 +1,118 @@
+package rocserv
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestInstanceBreakers(t *testing.T) {
+	ass := assert.New(t)
+
+	conf := DefaultInstanceBreakerConf
+	conf.ConsecutiveFailures = 3
+	conf.Cooldown = 50 * time.Millisecond
+	m := newInstanceBreakers("base/account", conf)
+
+	m.report("a", true)
+	m.report("a", true)
+	ass.True(m.acquire("a"))
+	m.report("a", true)
+	ass.False(m.acquire("a"))
+	ass.Equal(map[string]int{"a": breakerOpen}, m.states())
+
+	// 冷却后只放行一个探测请求
+	time.Sleep(60 * time.Millisecond)
+	ass.True(m.acquire("a"))
+	ass.False(m.acquire("a"))
+	m.report("a", false)
+	ass.True(m.acquire("a"))
+	ass.Len(m.states(), 0)
+}
+
+func TestInstanceBreakersIsOpen(t *testing.T) {
+	ass := assert.New(t)
+
+	conf := DefaultInstanceBreakerConf
+	conf.ConsecutiveFailures = 1
+	conf.Cooldown = 50 * time.Millisecond
+	m := newInstanceBreakers("base/account", conf)
+
+	ass.False(m.isOpen("a"))
+	m.report("a", true)
+	ass.True(m.isOpen("a"))
+
+	// 过滤候选实例不占用探测名额
+	time.Sleep(60 * time.Millisecond)
+	ass.False(m.isOpen("a"))
+	ass.False(m.isOpen("a"))
+	ass.Equal(map[string]int{"a": breakerOpen}, m.states())
+
+	ass.True(m.acquire("a"))
+	ass.True(m.isOpen("a"))
+	ass.Equal(map[string]int{"a": breakerHalfOpen}, m.states())
+}
+
+// breakerLookup 带实例熔断器的 lookup
+type breakerLookup struct {
+	fakeLoadLookup
+	breaker *instanceBreakers
+}
+
+func (m *breakerLookup) AvailableInstance(s *ServInfo) bool { return !m.breaker.isOpen(s.Addr) }
+func (m *breakerLookup) AllowInstance(s *ServInfo) bool     { return m.breaker.acquire(s.Addr) }
+
+func TestConcurrentRouteBreaker(t *testing.T) {
+	ass := assert.New(t)
+
+	conf := DefaultInstanceBreakerConf
+	conf.ConsecutiveFailures = 1
+	conf.Cooldown = 50 * time.Millisecond
+	cb := &breakerLookup{
+		fakeLoadLookup: fakeLoadLookup{servs: []*ServInfo{{Type: "grpc", Addr: "a"}, {Type: "grpc", Addr: "b"}}},
+		breaker:        newInstanceBreakers("test/load", conf),
+	}
+	r := NewConcurrent(cb)
+
+	cb.breaker.report("a", true)
+	ass.Equal("b", r.route("", "proc_grpc", "").Addr)
+
+	// 冷却后 a 作为候选, 只有被选中时才转为 half-open
+	time.Sleep(60 * time.Millisecond)
+	r.Pre(&ServInfo{Addr: "a"})
+	ass.Equal("b", r.route("", "proc_grpc", "").Addr)
+	ass.Equal(map[string]int{"a": breakerOpen}, cb.breaker.states())
+
+	r.Post(&ServInfo{Addr: "a"})
+	ass.Equal("a", r.route("", "proc_grpc", "").Addr)
+	ass.Equal(map[string]int{"a": breakerHalfOpen}, cb.breaker.states())
+}
+
+func TestInstanceBreakersErrorRate(t *testing.T) {
+	ass := assert.New(t)
+
+	conf := DefaultInstanceBreakerConf
+	conf.ConsecutiveFailures = 0
+	conf.MinRequests = 4
+	m := newInstanceBreakers("base/account", conf)
+
+	m.report("a", false)
+	m.report("a", true)
+	m.report("a", false)
+	ass.True(m.acquire("a"))
+	m.report("a", true)
+	ass.False(m.acquire("a"))
+}
+
+func TestIsInstanceFailure(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.False(isInstanceFailure(nil))
+	ass.True(isInstanceFailure(errors.New("connection refused")))
+	ass.True(isInstanceFailure(status.Error(codes.Unavailable, "")))
+	ass.False(isInstanceFailure(status.Error(codes.NotFound, "")))
+}
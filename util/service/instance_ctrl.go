@@ -0,0 +1,218 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/julienschmidt/httprouter"
+)
+
+// 并发修改 manual 节点冲突时的重试次数
+const manualUpdateRetry = 3
+
+func (m *ServBaseV2) manualPath(servId int) string {
+	return fmt.Sprintf("%s/%s/%s/%d/%s", m.confEtcd.useBaseloc, BASE_LOC_DIST_V2, m.servLocation, servId, BASE_LOC_REG_MANUAL)
+}
+
+// GetInstanceCtrl return manual control of instance servId of this service, default weight is 100
+func (m *ServBaseV2) GetInstanceCtrl(servId int) (*ServCtrl, error) {
+	value, err := m.getValueFromEtcd(m.manualPath(servId))
+	if err != nil && !etcd.IsKeyNotFound(err) {
+		return nil, err
+	}
+	manual := &ManualData{}
+	if len(value) > 0 {
+		if err := json.Unmarshal([]byte(value), manual); err != nil {
+			return nil, err
+		}
+	}
+	if manual.Ctrl == nil {
+		manual.Ctrl = &ServCtrl{Weight: 100}
+	}
+	return manual.Ctrl, nil
+}
+
+// SetInstanceWeight set weight of instance servId of this service, weight must be positive, default is 100
+func (m *ServBaseV2) SetInstanceWeight(servId int, weight int) error {
+	if weight <= 0 {
+		return fmt.Errorf("invalid weight: %d, use DisableInstance to drain instance", weight)
+	}
+	return m.updateManual(servId, func(ctrl *ServCtrl) {
+		ctrl.Weight = weight
+	})
+}
+
+// DisableInstance disable or enable instance servId of this service, disabled instance is removed from routing of clients
+func (m *ServBaseV2) DisableInstance(servId int, disable bool) error {
+	return m.updateManual(servId, func(ctrl *ServCtrl) {
+		ctrl.Disable = disable
+	})
+}
+
+// updateManual 按 index 做 CAS 更新, 避免覆盖实例启动时 SetGroupAndDisable 或其他运维工具的写入
+func (m *ServBaseV2) updateManual(servId int, update func(ctrl *ServCtrl)) error {
+	fun := "ServBaseV2.updateManual -->"
+	ctx := context.Background()
+
+	path := m.manualPath(servId)
+	var err error
+	for i := 0; i < manualUpdateRetry; i++ {
+		var r *etcd.Response
+		r, err = m.etcdClient.Get(ctx, path, nil)
+		if err != nil && !etcd.IsKeyNotFound(err) {
+			logger().Errorf(ctx, "%s get path: %s err: %v", fun, path, err)
+			return err
+		}
+
+		opts := &etcd.SetOptions{PrevExist: etcd.PrevNoExist}
+		manual := &ManualData{}
+		var old string
+		if err == nil && r != nil && r.Node != nil {
+			old = r.Node.Value
+			opts = &etcd.SetOptions{PrevIndex: r.Node.ModifiedIndex}
+			if len(old) > 0 {
+				if err := json.Unmarshal([]byte(old), manual); err != nil {
+					logger().Errorf(ctx, "%s unmarshal path: %s value: %s err: %v", fun, path, old, err)
+					return err
+				}
+			}
+		}
+		if manual.Ctrl == nil {
+			manual.Ctrl = &ServCtrl{Groups: []string{""}}
+		}
+		if manual.Ctrl.Weight == 0 {
+			manual.Ctrl.Weight = 100
+		}
+		update(manual.Ctrl)
+
+		js, err := json.Marshal(manual)
+		if err != nil {
+			return err
+		}
+		_, err = m.etcdClient.Set(ctx, path, string(js), opts)
+		if err == nil {
+			logger().Infof(ctx, "%s path: %s old value: %s new value: %s", fun, path, old, js)
+			m.updateRegInstance(ctx, servId, manual.Ctrl)
+			return nil
+		}
+		if !isEtcdCompareFailed(err) {
+			logger().Errorf(ctx, "%s set path: %s err: %v", fun, path, err)
+			return err
+		}
+		logger().Warnf(ctx, "%s path: %s modified concurrently, retry: %d", fun, path, i)
+	}
+	return err
+}
+
+// GetInstanceCtrl return manual control of instance servId of this service, ErrServBaseNotInit before Serve or Init
+func GetInstanceCtrl(servId int) (*ServCtrl, error) {
+	sb, err := getServBaseV2()
+	if err != nil {
+		return nil, err
+	}
+	return sb.GetInstanceCtrl(servId)
+}
+
+// SetInstanceWeight set weight of instance servId of this service, such as lowering weight of a slow instance
+func SetInstanceWeight(servId int, weight int) error {
+	sb, err := getServBaseV2()
+	if err != nil {
+		return err
+	}
+	return sb.SetInstanceWeight(servId, weight)
+}
+
+// DisableInstance disable or enable instance servId of this service, such as draining it before maintenance
+func DisableInstance(servId int, disable bool) error {
+	sb, err := getServBaseV2()
+	if err != nil {
+		return err
+	}
+	return sb.DisableInstance(servId, disable)
+}
+
+func isEtcdCompareFailed(err error) bool {
+	if e, ok := err.(etcd.Error); ok {
+		return e.Code == etcd.ErrorCodeTestFailed || e.Code == etcd.ErrorCodeNodeExist
+	}
+	return false
+}
+
+// updateRegInstance 当前实例同时注册到其他注册中心时同步更新
+func (m *ServBaseV2) updateRegInstance(ctx context.Context, servId int, ctrl *ServCtrl) {
+	fun := "ServBaseV2.updateRegInstance -->"
+
+	if servId != m.servId || m.registry == nil {
+		return
+	}
+	m.muReg.Lock()
+	if m.regInstance == nil {
+		m.muReg.Unlock()
+		return
+	}
+	ins := *m.regInstance
+	ins.Weight = ctrl.Weight
+	ins.Disable = ctrl.Disable
+	m.regInstance = &ins
+	m.muReg.Unlock()
+	if err := m.registry.Register(ctx, &ins); err != nil {
+		logger().Errorf(ctx, "%s update registry instance err: %v", fun, err)
+	}
+}
+
+// instanceCtrlHandler GET servid=N 查看实例的手动配置, POST servid=N&weight=W&disable=true|false 修改, servid 默认为当前实例
+func instanceCtrlHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	sb, ok := server.sbase.(*ServBaseV2)
+	if !ok {
+		http.Error(w, "server not init", http.StatusServiceUnavailable)
+		return
+	}
+
+	servId := sb.servId
+	if s := r.FormValue("servid"); len(s) > 0 {
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid servid: %s", s), http.StatusBadRequest)
+			return
+		}
+		servId = id
+	}
+
+	if r.Method == http.MethodPost {
+		if s := r.FormValue("weight"); len(s) > 0 {
+			weight, err := strconv.Atoi(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid weight: %s", s), http.StatusBadRequest)
+				return
+			}
+			if err := sb.SetInstanceWeight(servId, weight); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if s := r.FormValue("disable"); len(s) > 0 {
+			disable, err := strconv.ParseBool(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid disable: %s", s), http.StatusBadRequest)
+				return
+			}
+			if err := sb.DisableInstance(servId, disable); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	ctrl, err := sb.GetInstanceCtrl(servId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s, _ := json.Marshal(ctrl)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s)
+}
@@ -0,0 +1,84 @@
+package rocserv
+
+import (
+	"context"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// memKeysAPI 支持 PrevExist 及 PrevIndex 的内存 kv
+type memKeysAPI struct {
+	etcd.KeysAPI
+	index  uint64
+	values map[string]*etcd.Node
+}
+
+func (m *memKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	n, ok := m.values[key]
+	if !ok {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	}
+	return &etcd.Response{Node: n}, nil
+}
+
+func (m *memKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	n, ok := m.values[key]
+	if opts != nil && opts.PrevExist == etcd.PrevNoExist && ok {
+		return nil, etcd.Error{Code: etcd.ErrorCodeNodeExist}
+	}
+	if opts != nil && opts.PrevIndex > 0 && (!ok || n.ModifiedIndex != opts.PrevIndex) {
+		return nil, etcd.Error{Code: etcd.ErrorCodeTestFailed}
+	}
+	// 刷新 ttl 不修改值
+	if opts != nil && opts.Refresh {
+		if !ok {
+			return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+		}
+		value = n.Value
+	}
+	m.index++
+	m.values[key] = &etcd.Node{Key: key, Value: value, ModifiedIndex: m.index}
+	return &etcd.Response{Node: m.values[key]}, nil
+}
+
+func TestInstanceCtrl(t *testing.T) {
+	ass := assert.New(t)
+
+	client := &memKeysAPI{values: map[string]*etcd.Node{}}
+	sb := &ServBaseV2{etcdClient: client, confEtcd: configEtcd{useBaseloc: "/roc"}, servLocation: "base/account", servId: 1}
+
+	ctrl, err := sb.GetInstanceCtrl(2)
+	ass.Nil(err)
+	ass.Equal(100, ctrl.Weight)
+
+	ass.Nil(sb.SetInstanceWeight(2, 10))
+	ass.NotNil(sb.SetInstanceWeight(2, 0))
+	ass.Nil(sb.DisableInstance(2, true))
+	ctrl, err = sb.GetInstanceCtrl(2)
+	ass.Nil(err)
+	ass.Equal(10, ctrl.Weight)
+	ass.True(ctrl.Disable)
+	ass.Equal([]string{""}, ctrl.Groups)
+	ass.Equal(`{"ctrl":{"weight":10,"disable":true,"groups":[""]}}`, client.values["/roc/dist2/base/account/2/manual"].Value)
+
+	old := server.sbase
+	defer func() { server.sbase = old }()
+	server.sbase = nil
+	_, err = GetInstanceCtrl(2)
+	ass.Equal(ErrServBaseNotInit, err)
+	ass.Equal(ErrServBaseNotInit, SetInstanceWeight(2, 20))
+	ass.Equal(ErrServBaseNotInit, DisableInstance(2, false))
+
+	server.sbase = sb
+	ass.Nil(SetInstanceWeight(2, 20))
+	ass.Nil(DisableInstance(2, false))
+	ctrl, err = GetInstanceCtrl(2)
+	ass.Nil(err)
+	ass.Equal(20, ctrl.Weight)
+	ass.False(ctrl.Disable)
+
+	ass.True(isEtcdCompareFailed(etcd.Error{Code: etcd.ErrorCodeTestFailed}))
+	ass.False(isEtcdCompareFailed(etcd.Error{Code: etcd.ErrorCodeKeyNotFound}))
+}
@@ -0,0 +1,81 @@
+package rocserv
+
+import (
+	"sort"
+)
+
+// InstanceSnapshot one processor of registered instance at the time of the last registry update
+type InstanceSnapshot struct {
+	Servid int    `json:"servid"`
+	Type   string `json:"type"`
+	Addr   string `json:"addr"`
+	TLS    bool   `json:"tls"`
+	Weight int    `json:"weight"`
+	// 泳道, 空为基准泳道
+	Group string `json:"group"`
+	Zone  string `json:"zone"`
+	// 人工禁用或者未激活的实例不参与路由
+	Disabled bool `json:"disabled"`
+	Active   bool `json:"active"`
+}
+
+// buildInstanceSnapshots 注册中心更新时生成, 按 servid 升序
+// 返回 processor -> 可路由的地址, processor -> 全部实例
+func buildInstanceSnapshots(scopy servCopyCollect) (map[string][]*ServInfo, map[string][]InstanceSnapshot) {
+	sids := make([]int, 0, len(scopy))
+	for sid, c := range scopy {
+		if c != nil && c.reg != nil {
+			sids = append(sids, sid)
+		}
+	}
+	sort.Ints(sids)
+
+	servs := make(map[string][]*ServInfo)
+	instances := make(map[string][]InstanceSnapshot)
+	for _, sid := range sids {
+		c := scopy[sid]
+		weight, disabled := 100, false
+		group, hasLane := c.reg.GetLane()
+		if c.manual != nil && c.manual.Ctrl != nil {
+			if c.manual.Ctrl.Weight > 0 {
+				weight = c.manual.Ctrl.Weight
+			}
+			disabled = c.manual.Ctrl.Disable
+			// 老版本泳道信息在 manual 中
+			if !hasLane && len(c.manual.Ctrl.Groups) > 0 {
+				group = c.manual.Ctrl.Groups[0]
+			}
+		}
+		active := c.reg.IsActive()
+
+		for processor, s := range c.reg.Servs {
+			if s == nil {
+				continue
+			}
+			if !disabled && active {
+				servs[processor] = append(servs[processor], s)
+			}
+			instances[processor] = append(instances[processor], InstanceSnapshot{
+				Servid:   sid,
+				Type:     s.Type,
+				Addr:     s.Addr,
+				TLS:      s.TLS,
+				Weight:   weight,
+				Group:    group,
+				Zone:     c.reg.Zone,
+				Disabled: disabled,
+				Active:   active,
+			})
+		}
+	}
+	return servs, instances
+}
+
+// GetInstances return snapshots of all instances registered with processor ordered by servid,
+// including disabled and starting ones, the result is a copy and can be used by tooling and custom balancers
+func (m *ClientEtcdV2) GetInstances(processor string) []InstanceSnapshot {
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+
+	return append([]InstanceSnapshot(nil), m.instances[processor]...)
+}
@@ -0,0 +1,42 @@
+package rocserv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceSnapshot(t *testing.T) {
+	ass := assert.New(t)
+
+	lane := "feature-x"
+	feature := zoneServCopy(2, "a", 0)
+	feature.reg.Lane = &lane
+	disabled := zoneServCopy(3, "b", 50)
+	disabled.manual.Ctrl.Disable = true
+	starting := zoneServCopy(4, "b", 100)
+	starting.reg.State = RegStateStarting
+
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.upServlist(servCopyCollect{4: starting, 3: disabled, 2: feature, 1: zoneServCopy(1, "a", 100)})
+
+	ins := cli.GetInstances("proc_grpc")
+	ass.Len(ins, 4)
+	ass.Equal(InstanceSnapshot{Servid: 2, Type: PROCESSOR_GRPC, Addr: "127.0.0.2:9000", Weight: 100, Group: "feature-x", Zone: "a", Active: true}, ins[1])
+	ass.True(ins[2].Disabled)
+	ass.Equal(50, ins[2].Weight)
+	ass.False(ins[3].Active)
+	ass.Empty(cli.GetInstances("proc_thrift"))
+
+	servs := cli.GetAllServAddr("proc_grpc")
+	ass.Len(servs, 2)
+	ass.Equal("127.0.0.1:9000", servs[0].Addr)
+	ass.Equal("127.0.0.2:9000", servs[1].Addr)
+	ass.NotNil(cli.GetAllServAddr("proc_thrift"))
+
+	// 返回的是副本, 修改不影响缓存
+	ins[0].Addr = "x"
+	servs[0] = nil
+	ass.Equal("127.0.0.1:9000", cli.GetInstances("proc_grpc")[0].Addr)
+	ass.NotNil(cli.GetAllServAddr("proc_grpc")[0])
+}
@@ -0,0 +1,285 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 配置中心中 key ring 的配置 key 前缀, 完整 key 为 keyring.{name}
+	keyRingConfPrefix = "keyring."
+
+	defaultKeyRingWatchInterval = 30 * time.Second
+)
+
+var (
+	ErrKeyRingEmpty    = errors.New("key ring has no primary key")
+	ErrKeyNotFound     = errors.New("key version not found")
+	ErrKeySignMismatch = errors.New("signature mismatch")
+	ErrKeyCipherText   = errors.New("malformed cipher text")
+)
+
+// KeyRingConf config of key ring in config center, secrets are base64 encoded
+//
+//	{"primary": "v2", "keys": {"v1": "c2VjcmV0MQ==", "v2": "c2VjcmV0Mg=="}}
+type KeyRingConf struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// Key one version of key in key ring
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// KeyRing multiple active key versions, the primary one is used for signing and all of them for verification,
+// so keys can be rotated without downtime: add new key -> switch primary -> remove old key
+type KeyRing struct {
+	name string
+
+	mu      sync.RWMutex
+	primary *Key
+	keys    map[string]*Key
+	raw     string
+}
+
+// NewKeyRing create key ring with keys, primary must be one of keys
+func NewKeyRing(name string, primary string, keys ...*Key) (*KeyRing, error) {
+	m := &KeyRing{name: name}
+	if err := m.update(primary, keys); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// NewKeyRingFromConf parse key ring from json conf
+func NewKeyRingFromConf(name, conf string) (*KeyRing, error) {
+	m := &KeyRing{name: name}
+	if err := m.load(conf); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadKeyRing load key ring from config center with key keyring.{name}
+func LoadKeyRing(ctx context.Context, name string) (*KeyRing, error) {
+	conf, err := keyRingConfFromConfigCenter(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyRingFromConf(name, conf)
+}
+
+func keyRingConfFromConfigCenter(ctx context.Context, name string) (string, error) {
+	cc := GetConfigCenter()
+	if cc == nil {
+		return "", fmt.Errorf("config center not init")
+	}
+	conf, ok := cc.GetString(ctx, keyRingConfPrefix+name)
+	if !ok {
+		return "", fmt.Errorf("key ring: %s not found in config center", name)
+	}
+	return conf, nil
+}
+
+// Watch reload key ring from config center every interval until ctx done
+func (m *KeyRing) Watch(ctx context.Context, interval time.Duration) {
+	fun := "KeyRing.Watch -->"
+	if interval <= 0 {
+		interval = defaultKeyRingWatchInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			conf, err := keyRingConfFromConfigCenter(ctx, m.name)
+			if err != nil {
+				logger().Warnf(ctx, "%s name: %s err: %v", fun, m.name, err)
+				continue
+			}
+
+			m.mu.RLock()
+			changed := conf != m.raw
+			m.mu.RUnlock()
+			if !changed {
+				continue
+			}
+
+			if err := m.load(conf); err != nil {
+				logger().Errorf(ctx, "%s reload name: %s err: %v", fun, m.name, err)
+				continue
+			}
+			logger().Infof(ctx, "%s rotated name: %s primary: %s versions: %v", fun, m.name, m.Primary().ID, m.Versions())
+		}
+	}
+}
+
+func (m *KeyRing) load(conf string) error {
+	var kc KeyRingConf
+	if err := json.Unmarshal([]byte(conf), &kc); err != nil {
+		return fmt.Errorf("key ring: %s unmarshal err: %v", m.name, err)
+	}
+
+	keys := make([]*Key, 0, len(kc.Keys))
+	for id, secret := range kc.Keys {
+		bs, err := base64.StdEncoding.DecodeString(secret)
+		if err != nil {
+			return fmt.Errorf("key ring: %s key: %s decode err: %v", m.name, id, err)
+		}
+		keys = append(keys, &Key{ID: id, Secret: bs})
+	}
+
+	if err := m.update(kc.Primary, keys); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.raw = conf
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *KeyRing) update(primary string, keys []*Key) error {
+	km := make(map[string]*Key, len(keys))
+	for _, k := range keys {
+		if k == nil || len(k.ID) == 0 || len(k.Secret) == 0 {
+			return fmt.Errorf("key ring: %s has empty key", m.name)
+		}
+		km[k.ID] = k
+	}
+
+	p, ok := km[primary]
+	if !ok {
+		return fmt.Errorf("key ring: %s primary: %s not in keys", m.name, primary)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.primary = p
+	m.keys = km
+	return nil
+}
+
+// Primary return the key used for signing
+func (m *KeyRing) Primary() *Key {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.primary
+}
+
+// Lookup return key by version id
+func (m *KeyRing) Lookup(id string) (*Key, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	k, ok := m.keys[id]
+	return k, ok
+}
+
+// Versions return all key versions sorted
+func (m *KeyRing) Versions() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.keys))
+	for id := range m.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Sign sign data by primary key with hmac-sha256, return key version and signature
+func (m *KeyRing) Sign(data []byte) (string, []byte, error) {
+	p := m.Primary()
+	if p == nil {
+		return "", nil, ErrKeyRingEmpty
+	}
+	return p.ID, hmacSHA256(p.Secret, data), nil
+}
+
+// Verify verify signature by the key of version id
+func (m *KeyRing) Verify(id string, data, sig []byte) error {
+	k, ok := m.Lookup(id)
+	if !ok {
+		return ErrKeyNotFound
+	}
+	if !hmac.Equal(hmacSHA256(k.Secret, data), sig) {
+		return ErrKeySignMismatch
+	}
+	return nil
+}
+
+// Encrypt encrypt data by primary key with aes-256-gcm, result is {version}:{base64(nonce+ciphertext)}
+func (m *KeyRing) Encrypt(data []byte) (string, error) {
+	p := m.Primary()
+	if p == nil {
+		return "", ErrKeyRingEmpty
+	}
+	aead, err := keyAEAD(p.Secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, data, []byte(p.ID))
+	return p.ID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypt text returned by Encrypt with the key of its version
+func (m *KeyRing) Decrypt(text string) ([]byte, error) {
+	idx := strings.LastIndex(text, ":")
+	if idx <= 0 {
+		return nil, ErrKeyCipherText
+	}
+	id := text[:idx]
+	sealed, err := base64.StdEncoding.DecodeString(text[idx+1:])
+	if err != nil {
+		return nil, ErrKeyCipherText
+	}
+	k, ok := m.Lookup(id)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	aead, err := keyAEAD(k.Secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrKeyCipherText
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+}
+
+// keyAEAD 密钥长度不固定, 取 sha256 作为 aes-256 的密钥
+func keyAEAD(secret []byte) (cipher.AEAD, error) {
+	sum := sha256.Sum256(secret)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func hmacSHA256(secret, data []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,62 @@
+package rocserv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyRingRotate(t *testing.T) {
+	ass := assert.New(t)
+
+	kr, err := NewKeyRingFromConf("test", `{"primary":"v1","keys":{"v1":"c2VjcmV0MQ=="}}`)
+	ass.Nil(err)
+
+	data := []byte("hello")
+	id, sig, err := kr.Sign(data)
+	ass.Nil(err)
+	ass.Equal("v1", id)
+	ass.Nil(kr.Verify(id, data, sig))
+
+	// 新增 v2 并切换为 primary, v1 签名仍然可以校验
+	err = kr.load(`{"primary":"v2","keys":{"v1":"c2VjcmV0MQ==","v2":"c2VjcmV0Mg=="}}`)
+	ass.Nil(err)
+	ass.Equal("v2", kr.Primary().ID)
+	ass.Nil(kr.Verify(id, data, sig))
+	ass.Equal([]string{"v1", "v2"}, kr.Versions())
+
+	id2, sig2, err := kr.Sign(data)
+	ass.Nil(err)
+	ass.Equal("v2", id2)
+	ass.Equal(ErrKeySignMismatch, kr.Verify("v1", data, sig2))
+
+	// 移除 v1
+	err = kr.load(`{"primary":"v2","keys":{"v2":"c2VjcmV0Mg=="}}`)
+	ass.Nil(err)
+	ass.Equal(ErrKeyNotFound, kr.Verify(id, data, sig))
+
+	// primary 不存在时保持原状态
+	err = kr.load(`{"primary":"v3","keys":{"v2":"c2VjcmV0Mg=="}}`)
+	ass.NotNil(err)
+	ass.Equal("v2", kr.Primary().ID)
+}
+
+func TestKeyRingEncrypt(t *testing.T) {
+	ass := assert.New(t)
+
+	kr, err := NewKeyRingFromConf("test", `{"primary":"v1","keys":{"v1":"c2VjcmV0MQ=="}}`)
+	ass.Nil(err)
+
+	text, err := kr.Encrypt([]byte("hello"))
+	ass.Nil(err)
+	data, err := kr.Decrypt(text)
+	ass.Nil(err)
+	ass.Equal("hello", string(data))
+
+	_, err = kr.Decrypt("hello")
+	ass.Equal(ErrKeyCipherText, err)
+	_, err = kr.Decrypt("v9:" + text[3:])
+	ass.Equal(ErrKeyNotFound, err)
+	_, err = kr.Decrypt(text[:len(text)-4] + "AAAA")
+	ass.NotNil(err)
+}
@@ -0,0 +1,272 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+const (
+	// 单个 value 最大字节数, kv 只用于存放少量协调数据, 不是通用存储
+	maxKVValueSize = 16 * 1024
+	maxKVKeySize   = 256
+	maxKVTTL       = 7 * 24 * time.Hour
+
+	// 每个实例写操作的限流, 每秒 kvWriteRate 个, 允许突发 kvWriteBurst 个
+	kvWriteRate  = 10
+	kvWriteBurst = 20
+)
+
+var (
+	ErrKVNotFound     = errors.New("kv key not found")
+	ErrKVRateLimited  = errors.New("kv write rate limited")
+	ErrKVValueTooLong = errors.New("kv value too long")
+)
+
+const (
+	KVActionPut    = "put"
+	KVActionDelete = "delete"
+)
+
+// GetKV return ephemeral kv of this service, ErrServBaseNotInit before Serve or Init
+func GetKV() (ServKV, error) {
+	sb, err := getServBaseV2()
+	if err != nil {
+		return nil, err
+	}
+	return sb.KV(), nil
+}
+
+// KVEvent change of key watched
+type KVEvent struct {
+	Key    string
+	Value  string
+	Action string
+}
+
+// ServKV namespaced ephemeral key-value store of the service, shared by all copies of the service,
+// keys are stored under {baseloc}/kv/{servLocation}/, every key must have ttl
+type ServKV interface {
+	Put(ctx context.Context, key, value string, ttl time.Duration) error
+	Get(ctx context.Context, key string) (string, error)
+	Delete(ctx context.Context, key string) error
+	// Watch 返回的 chan 在 ctx done 时关闭
+	Watch(ctx context.Context, key string) (<-chan *KVEvent, error)
+}
+
+// sharedLeaseKeysAPI etcd v3 上同 ttl 的写入共用 lease, 见 etcdV3KeysAPI.SetShared
+type sharedLeaseKeysAPI interface {
+	SetShared(ctx context.Context, key, value string, ttl time.Duration) error
+}
+
+type etcdServKV struct {
+	client  etcd.KeysAPI
+	path    string
+	limiter *tokenBucket
+}
+
+func newEtcdServKV(client etcd.KeysAPI, baseLoc, servLocation string) *etcdServKV {
+	return &etcdServKV{
+		client:  client,
+		path:    fmt.Sprintf("%s/%s/%s", baseLoc, BASE_LOC_KV, servLocation),
+		limiter: newTokenBucket(kvWriteRate, kvWriteBurst),
+	}
+}
+
+func (m *etcdServKV) keyPath(key string) (string, error) {
+	if len(key) == 0 || len(key) > maxKVKeySize {
+		return "", fmt.Errorf("kv key: %s length invalid", key)
+	}
+	if strings.HasPrefix(key, "/") || strings.Contains(key, "..") {
+		return "", fmt.Errorf("kv key: %s invalid", key)
+	}
+	return m.path + "/" + key, nil
+}
+
+func (m *etcdServKV) Put(ctx context.Context, key, value string, ttl time.Duration) error {
+	path, err := m.keyPath(key)
+	if err != nil {
+		return err
+	}
+	if len(value) > maxKVValueSize {
+		return ErrKVValueTooLong
+	}
+	if ttl <= 0 || ttl > maxKVTTL {
+		return fmt.Errorf("kv ttl: %s out of range (0, %s]", ttl, maxKVTTL)
+	}
+	if !m.limiter.Allow() {
+		return ErrKVRateLimited
+	}
+
+	if shared, ok := m.client.(sharedLeaseKeysAPI); ok {
+		return shared.SetShared(ctx, path, value, ttl)
+	}
+	_, err = m.client.Set(ctx, path, value, &etcd.SetOptions{TTL: ttl})
+	return err
+}
+
+func (m *etcdServKV) Get(ctx context.Context, key string) (string, error) {
+	path, err := m.keyPath(key)
+	if err != nil {
+		return "", err
+	}
+
+	r, err := m.client.Get(ctx, path, nil)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return "", ErrKVNotFound
+		}
+		return "", err
+	}
+	if r.Node == nil || r.Node.Dir {
+		return "", ErrKVNotFound
+	}
+	return r.Node.Value, nil
+}
+
+func (m *etcdServKV) Delete(ctx context.Context, key string) error {
+	path, err := m.keyPath(key)
+	if err != nil {
+		return err
+	}
+	if !m.limiter.Allow() {
+		return ErrKVRateLimited
+	}
+
+	_, err = m.client.Delete(ctx, path, nil)
+	if err != nil && etcd.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (m *etcdServKV) Watch(ctx context.Context, key string) (<-chan *KVEvent, error) {
+	path, err := m.keyPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan *KVEvent)
+	go m.watch(ctx, key, path, ch)
+	return ch, nil
+}
+
+func (m *etcdServKV) watch(ctx context.Context, key, path string, ch chan *KVEvent) {
+	fun := "etcdServKV.watch -->"
+	defer close(ch)
+
+	backoff := xtime.NewBackOffCtrl(time.Millisecond*100, time.Second*5)
+	release := func() {}
+	defer func() { release() }()
+	for ctx.Err() == nil {
+		// 每轮重新 get 拿到最新 index, 避免 index 过期导致 watch 失败
+		index := uint64(0)
+		r, err := m.client.Get(ctx, path, nil)
+		release()
+		release = func() {}
+		if err == nil {
+			index = r.Index
+		} else if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+			index = e.Index
+		} else {
+			logger().Warnf(ctx, "%s get path: %s err: %v", fun, path, err)
+			backoff.BackOff()
+			continue
+		}
+
+		watcher := m.client.Watcher(path, &etcd.WatcherOptions{AfterIndex: index})
+		for {
+			resp, err := watcher.Next(ctx)
+			if isWatchCompacted(err) {
+				release = waitCompactedResync(ctx, watchKindKV, path)
+				break
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					logger().Warnf(ctx, "%s watch path: %s err: %v", fun, path, err)
+					backoff.BackOff()
+				}
+				break
+			}
+			backoff.Reset()
+
+			ev := &KVEvent{Key: key, Action: KVActionPut}
+			switch resp.Action {
+			case "delete", "expire", "compareAndDelete":
+				ev.Action = KVActionDelete
+			default:
+				if resp.Node != nil {
+					ev.Value = resp.Node.Value
+				}
+			}
+
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// tokenBucket simple token bucket limiter
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (m *tokenBucket) Allow() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.tokens += now.Sub(m.last).Seconds() * m.rate
+	if m.tokens > m.burst {
+		m.tokens = m.burst
+	}
+	m.last = now
+
+	if m.tokens < 1 {
+		return false
+	}
+	m.tokens--
+	return true
+}
+
+// Reserve take a token even if the bucket is empty, returns how long to wait before using it
+func (m *tokenBucket) Reserve() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.tokens += now.Sub(m.last).Seconds() * m.rate
+	if m.tokens > m.burst {
+		m.tokens = m.burst
+	}
+	m.last = now
+
+	m.tokens--
+	if m.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-m.tokens / m.rate * float64(time.Second))
+}
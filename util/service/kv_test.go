@@ -0,0 +1,24 @@
+package rocserv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetKV(t *testing.T) {
+	ass := assert.New(t)
+
+	old := server.sbase
+	defer func() { server.sbase = old }()
+
+	server.sbase = nil
+	_, err := GetKV()
+	ass.Equal(ErrServBaseNotInit, err)
+
+	kv := &etcdServKV{}
+	server.sbase = &ServBaseV2{kv: kv}
+	got, err := GetKV()
+	ass.Nil(err)
+	ass.True(got == kv)
+}
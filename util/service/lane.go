@@ -0,0 +1,25 @@
+package rocserv
+
+import (
+	"context"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xcontext"
+)
+
+// BaggageKeyLane baggage key of lane, requests with a lane are routed to instances registered with that lane
+// in every hop, and to instances of base lane when the callee has none
+const BaggageKeyLane = "lane"
+
+// WithLane tag the request with lane, e.g. "feature-x", the lane is propagated to downstream services as baggage
+func WithLane(ctx context.Context, lane string) context.Context {
+	return WithBaggage(ctx, BaggageKeyLane, lane)
+}
+
+// LaneFromContext return lane of the request, the route group in control of xcontext takes precedence over baggage,
+// empty means base lane
+func LaneFromContext(ctx context.Context) string {
+	if group := xcontext.GetControlRouteGroupWithDefault(ctx, xcontext.DefaultGroup); group != xcontext.DefaultGroup {
+		return group
+	}
+	return GetBaggage(ctx, BaggageKeyLane)
+}
@@ -0,0 +1,31 @@
+package rocserv
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLaneRouting(t *testing.T) {
+	ass := assert.New(t)
+
+	ctx := WithLane(context.Background(), "feature-x")
+	ass.Equal("feature-x", LaneFromContext(ctx))
+	ass.Equal("", LaneFromContext(context.Background()))
+
+	lane := "feature-x"
+	feature := zoneServCopy(2, "", 100)
+	feature.reg.Lane = &lane
+	feature.manual.Ctrl.Groups = []string{lane}
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.upServlist(servCopyCollect{1: zoneServCopy(1, "", 100), 2: feature})
+
+	for _, r := range []Router{NewConcurrent(cli), NewHash(cli)} {
+		ass.Equal("127.0.0.2:9000", r.Route(ctx, "proc_grpc", "k").Addr)
+		ass.Equal("127.0.0.1:9000", r.Route(context.Background(), "proc_grpc", "k").Addr)
+		// 泳道没有实例时回退到基准泳道
+		ass.Equal("127.0.0.1:9000", r.Route(WithLane(context.Background(), "feature-y"), "proc_grpc", "k").Addr)
+	}
+	ass.NotNil(NewAddr(cli).Route(WithLane(context.Background(), "feature-y"), "proc_grpc", "127.0.0.1:9000"))
+}
@@ -0,0 +1,222 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/julienschmidt/httprouter"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	lazyCold int32 = iota
+	lazyWarming
+	lazyWarm
+	lazyFailed
+)
+
+var lazyStateNames = map[int32]string{
+	lazyCold:    "cold",
+	lazyWarming: "warming",
+	lazyWarm:    "warm",
+	lazyFailed:  "failed",
+}
+
+// thrift 请求没有 ctx, 等待初始化的最长时间
+const lazyThriftWaitTimeout = 30 * time.Second
+
+// lazyProcessor 启动时只监听端口并注册, Init 在第一个请求或者 WarmProcessor 时执行
+type lazyProcessor struct {
+	Processor
+
+	state int32
+
+	mu   sync.Mutex
+	err  error
+	done chan struct{} // 本轮初始化结束时关闭, 失败后置空以便重试
+}
+
+// Lazy mark processor lazy: listener binds and registers at startup, but Init runs on first request
+// or WarmProcessor, requests wait until Init finished; Driver of p must not depend on Init
+func Lazy(p Processor) Processor {
+	return &lazyProcessor{Processor: p}
+}
+
+// Init 延迟到 warm 时执行
+func (m *lazyProcessor) Init() error {
+	return nil
+}
+
+func (m *lazyProcessor) stateName() string {
+	return lazyStateNames[atomic.LoadInt32(&m.state)]
+}
+
+func (m *lazyProcessor) startWarm() chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.done != nil {
+		return m.done
+	}
+	done := make(chan struct{})
+	m.done = done
+	atomic.StoreInt32(&m.state, lazyWarming)
+
+	go func() {
+		fun := "lazyProcessor.warm -->"
+		st := time.Now()
+		err := m.Processor.Init()
+
+		m.mu.Lock()
+		m.err = err
+		if err != nil {
+			m.done = nil
+			atomic.StoreInt32(&m.state, lazyFailed)
+		} else {
+			atomic.StoreInt32(&m.state, lazyWarm)
+		}
+		m.mu.Unlock()
+		close(done)
+
+		logger().Infof(context.Background(), "%s init cost: %s err: %v", fun, time.Since(st), err)
+	}()
+	return done
+}
+
+// wait 触发初始化并等待完成, 已完成时直接返回
+func (m *lazyProcessor) wait(ctx context.Context) error {
+	if atomic.LoadInt32(&m.state) == lazyWarm {
+		return nil
+	}
+	done := m.startWarm()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// check 未初始化时仍视为就绪, 请求到达时会触发初始化; 初始化失败时不就绪
+func (m *lazyProcessor) check() error {
+	if atomic.LoadInt32(&m.state) != lazyFailed {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return fmt.Errorf("lazy processor init err: %v", m.err)
+}
+
+func (m *lazyProcessor) httpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.wait(r.Context()); err != nil {
+			http.Error(w, fmt.Sprintf("processor not ready: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (g *GrpcServer) lazyInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if g.lazy != nil {
+			if err := g.lazy.wait(ctx); err != nil {
+				return nil, status.Errorf(codes.Unavailable, "processor not ready: %v", err)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+func (g *GrpcServer) lazyStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if g.lazy != nil {
+			if err := g.lazy.wait(ss.Context()); err != nil {
+				return status.Errorf(codes.Unavailable, "processor not ready: %v", err)
+			}
+		}
+		return handler(srv, ss)
+	}
+}
+
+type lazyThriftProcessor struct {
+	lazy *lazyProcessor
+	thrift.TProcessor
+}
+
+func (m *lazyThriftProcessor) Process(in, out thrift.TProtocol) (bool, thrift.TException) {
+	if atomic.LoadInt32(&m.lazy.state) != lazyWarm {
+		ctx, cancel := context.WithTimeout(context.Background(), lazyThriftWaitTimeout)
+		err := m.lazy.wait(ctx)
+		cancel()
+		if err != nil {
+			name, _, seqid, rerr := in.ReadMessageBegin()
+			if rerr != nil {
+				return false, rerr
+			}
+			return rejectThriftMessage(in, out, name, seqid, fmt.Sprintf("processor not ready: %v", err))
+		}
+	}
+	return m.TProcessor.Process(in, out)
+}
+
+// WarmProcessor run Init of lazy processor name and wait until finished, it is a no-op if already warm
+func WarmProcessor(name string) error {
+	return server.warmProcessor(name)
+}
+
+func (m *Server) warmProcessor(name string) error {
+	m.muProcs.Lock()
+	p, ok := m.procs[name]
+	m.muProcs.Unlock()
+	if !ok {
+		return fmt.Errorf("processor: %s not found", name)
+	}
+	if p.lazy == nil {
+		return nil
+	}
+	return p.lazy.wait(context.Background())
+}
+
+// GetLazyProcessorStates return state of lazy processors: cold, warming, warm or failed
+func GetLazyProcessorStates() map[string]string {
+	return server.lazyStates()
+}
+
+func (m *Server) lazyStates() map[string]string {
+	m.muProcs.Lock()
+	defer m.muProcs.Unlock()
+
+	states := make(map[string]string)
+	for name, p := range m.procs {
+		if p.lazy != nil {
+			states[name] = p.lazy.stateName()
+		}
+	}
+	return states
+}
+
+// warmHandler GET 查看 lazy processor 状态, POST processor=name 触发初始化并等待完成
+func warmHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if r.Method == http.MethodPost {
+		if err := WarmProcessor(r.FormValue("processor")); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	s, _ := json.Marshal(GetLazyProcessorStates())
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s)
+}
@@ -0,0 +1,77 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type countProcessor struct {
+	inits int
+	err   error
+}
+
+func (m *countProcessor) Init() error {
+	m.inits++
+	return m.err
+}
+
+func (m *countProcessor) Driver() (string, interface{}) {
+	return "", nil
+}
+
+func TestLazyProcessor(t *testing.T) {
+	ass := assert.New(t)
+
+	p := &countProcessor{err: errors.New("model not found")}
+	lazy := Lazy(p).(*lazyProcessor)
+	ass.Nil(lazy.Init())
+	ass.Equal(0, p.inits)
+	ass.Equal("cold", lazy.stateName())
+	ass.Nil(lazy.check())
+
+	h := lazy.httpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	ass.Equal(http.StatusServiceUnavailable, w.Code)
+	ass.Equal("failed", lazy.stateName())
+	ass.NotNil(lazy.check())
+
+	// 失败后下一个请求重试
+	p.err = nil
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	ass.Equal("ok", w.Body.String())
+	ass.Equal("warm", lazy.stateName())
+	ass.Nil(lazy.check())
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	ass.Equal(2, p.inits)
+}
+
+func TestLazyGrpcInterceptor(t *testing.T) {
+	ass := assert.New(t)
+
+	p := &countProcessor{err: errors.New("model not found")}
+	g := &GrpcServer{lazy: Lazy(p).(*lazyProcessor)}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	_, err := g.lazyInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Serv/Get"}, handler)
+	ass.Equal(codes.Unavailable, status.Code(err))
+
+	p.err = nil
+	resp, err := g.lazyInterceptor()(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Serv/Get"}, handler)
+	ass.Nil(err)
+	ass.Equal("ok", resp)
+	ass.Equal(2, p.inits)
+}
@@ -0,0 +1,186 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+const (
+	defaultLoadReportInterval = 30 * time.Second
+	minLoadReportInterval     = 10 * time.Second
+
+	// 负载变化小于该比例且距上次写入未超过 loadReportForceRounds 个周期时不写 etcd,
+	// 负载节点挂在 dist2 实例目录下, 每次写入都会触发调用方的服务发现, 需要控制写入频率
+	loadReportChangeRatio = 0.2
+	loadReportForceRounds = 4
+)
+
+// InstanceLoad load of one instance reported into registry
+type InstanceLoad struct {
+	// 进程 cpu 使用的核数, 1.5 表示 1.5 个核
+	CPU        float64 `json:"cpu"`
+	HeapAlloc  uint64  `json:"heap_alloc"`
+	Goroutines int     `json:"goroutines"`
+	InFlight   int64   `json:"inflight"`
+	Ctime      int64   `json:"ctime"`
+}
+
+var inFlightRequests int64
+
+func incInFlight() {
+	atomic.AddInt64(&inFlightRequests, 1)
+}
+
+func decInFlight() {
+	atomic.AddInt64(&inFlightRequests, -1)
+}
+
+// InFlightRequests return count of requests being processed by processors
+func InFlightRequests() int64 {
+	return atomic.LoadInt64(&inFlightRequests)
+}
+
+func inFlightMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		incInFlight()
+		defer decInFlight()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// GetInstanceLoads get load reported by copies of servLocation, key is servid, used by balancers and roc-ctl
+func GetInstanceLoads(ctx context.Context, client etcd.KeysAPI, baseLoc, servLocation string) (map[int]*InstanceLoad, error) {
+	path := fmt.Sprintf("%s/%s/%s", baseLoc, BASE_LOC_DIST_V2, servLocation)
+	r, err := client.Get(ctx, path, &etcd.GetOptions{Recursive: true})
+	if err != nil {
+		return nil, err
+	}
+
+	loads := make(map[int]*InstanceLoad)
+	for _, n := range r.Node.Nodes {
+		var sid int
+		if _, err := fmt.Sscanf(n.Key[len(r.Node.Key)+1:], "%d", &sid); err != nil {
+			continue
+		}
+		for _, nc := range n.Nodes {
+			if nc.Key != n.Key+"/"+BASE_LOC_REG_LOAD {
+				continue
+			}
+			var load InstanceLoad
+			if err := json.Unmarshal([]byte(nc.Value), &load); err != nil {
+				logger().Warnf(ctx, "GetInstanceLoads --> key: %s unmarshal err: %v", nc.Key, err)
+				continue
+			}
+			loads[sid] = &load
+		}
+	}
+	return loads, nil
+}
+
+type loadReporter struct {
+	sb       *ServBaseV2
+	interval time.Duration
+
+	lastCPUTime time.Duration
+	lastTime    time.Time
+	last        *InstanceLoad
+	skipped     int
+}
+
+func newLoadReporter(sb *ServBaseV2, interval time.Duration) *loadReporter {
+	if interval <= 0 {
+		interval = defaultLoadReportInterval
+	}
+	if interval < minLoadReportInterval {
+		interval = minLoadReportInterval
+	}
+	return &loadReporter{
+		sb:          sb,
+		interval:    interval,
+		lastCPUTime: processCPUTime(),
+		lastTime:    time.Now(),
+	}
+}
+
+func (m *loadReporter) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if m.sb.isStop() {
+			return
+		}
+		m.report()
+	}
+}
+
+func (m *loadReporter) collect() *InstanceLoad {
+	now := time.Now()
+	cpuTime := processCPUTime()
+	cpu := 0.0
+	if elapsed := now.Sub(m.lastTime); elapsed > 0 {
+		cpu = float64(cpuTime-m.lastCPUTime) / float64(elapsed)
+	}
+	m.lastCPUTime, m.lastTime = cpuTime, now
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	return &InstanceLoad{
+		CPU:        math.Round(cpu*100) / 100,
+		HeapAlloc:  ms.HeapAlloc,
+		Goroutines: runtime.NumGoroutine(),
+		InFlight:   InFlightRequests(),
+		Ctime:      now.Unix(),
+	}
+}
+
+func (m *loadReporter) changed(load *InstanceLoad) bool {
+	if m.last == nil || m.skipped >= loadReportForceRounds {
+		return true
+	}
+	diff := func(a, b float64) bool {
+		if a == b {
+			return false
+		}
+		return math.Abs(a-b)/math.Max(math.Abs(a), math.Abs(b)) > loadReportChangeRatio
+	}
+	return diff(load.CPU, m.last.CPU) ||
+		diff(float64(load.HeapAlloc), float64(m.last.HeapAlloc)) ||
+		diff(float64(load.InFlight), float64(m.last.InFlight))
+}
+
+func (m *loadReporter) report() {
+	fun := "loadReporter.report -->"
+	ctx := context.Background()
+
+	load := m.collect()
+	if !m.changed(load) {
+		m.skipped++
+		return
+	}
+
+	js, err := json.Marshal(load)
+	if err != nil {
+		logger().Errorf(ctx, "%s marshal err: %v", fun, err)
+		return
+	}
+
+	sb := m.sb
+	path := fmt.Sprintf("%s/%s/%s/%d/%s", sb.confEtcd.useBaseloc, BASE_LOC_DIST_V2, sb.servLocation, sb.servId, BASE_LOC_REG_LOAD)
+	// ttl 覆盖强制写入的周期, 实例异常退出后负载数据自动过期
+	ttl := m.interval * (loadReportForceRounds + 2)
+	if _, err := sb.etcdClient.Set(ctx, path, string(js), &etcd.SetOptions{TTL: ttl}); err != nil {
+		logger().Warnf(ctx, "%s set path: %s err: %v", fun, path, err)
+		return
+	}
+	m.last = load
+	m.skipped = 0
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package rocserv
+
+import (
+	"syscall"
+	"time"
+)
+
+// processCPUTime user + system cpu time of current process
+func processCPUTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
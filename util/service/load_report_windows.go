@@ -0,0 +1,8 @@
+package rocserv
+
+import "time"
+
+// processCPUTime cpu time is not supported on windows, load report only contains memory and in-flight requests
+func processCPUTime() time.Duration {
+	return 0
+}
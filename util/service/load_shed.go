@@ -0,0 +1,164 @@
+package rocserv
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// 配置中心 application namespace 中的自适应并发限制开关, 运行时生效
+	adaptiveConcurrencyEnableKey = "adaptive_concurrency_enable"
+
+	concurrencyInitialLimit = 20
+	concurrencyMinLimit     = 5
+	concurrencyMaxLimit     = 1000
+
+	// 长期平均延迟的样本窗口
+	concurrencyLongWindow = 600
+	// 短期延迟不超过长期平均的该倍数时认为没有排队
+	concurrencyRTTTolerance = 1.5
+	concurrencySmoothing    = 0.2
+)
+
+// concurrencyLimiter 参照 netflix concurrency-limits 的 gradient2 算法:
+// 延迟平稳时按 sqrt(limit) 逐步提高并发限制, 短期延迟高于长期平均时说明请求开始排队, 按比例降低限制,
+// 在途请求达到限制的新请求直接拒绝, 避免实例过载后排队导致所有请求超时
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	limit    float64
+	min      float64
+	max      float64
+	inflight int
+	// 长期平均延迟, 纳秒
+	longRTT float64
+}
+
+func newConcurrencyLimiter(initial, min, max int) *concurrencyLimiter {
+	return &concurrencyLimiter{limit: float64(initial), min: float64(min), max: float64(max)}
+}
+
+var defaultConcurrencyLimiter = newConcurrencyLimiter(concurrencyInitialLimit, concurrencyMinLimit, concurrencyMaxLimit)
+
+// acquire 超过并发限制时返回 false, 否则请求完成后需调用 release, sample 为 false 时不采样延迟
+func (m *concurrencyLimiter) acquire() (release func(sample bool), ok bool) {
+	m.mu.Lock()
+	if float64(m.inflight) >= m.limit {
+		m.mu.Unlock()
+		return nil, false
+	}
+	m.inflight++
+	inflight := m.inflight
+	m.mu.Unlock()
+
+	st := time.Now()
+	return func(sample bool) {
+		m.release(inflight, time.Since(st), sample)
+	}, true
+}
+
+func (m *concurrencyLimiter) release(inflight int, rtt time.Duration, sample bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.inflight--
+	if !sample || rtt <= 0 {
+		return
+	}
+
+	short := float64(rtt)
+	if m.longRTT == 0 {
+		m.longRTT = short
+	} else {
+		m.longRTT += (short - m.longRTT) / concurrencyLongWindow
+	}
+	// 长期延迟会随限制提高而漂移, 短期延迟明显下降后向其靠拢
+	if m.longRTT/short > 2 {
+		m.longRTT *= 0.95
+	}
+
+	// 在途请求远小于限制时延迟不能反映容量, 不调整
+	if float64(inflight) < m.limit/2 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, concurrencyRTTTolerance*m.longRTT/short))
+	newLimit := m.limit*gradient + math.Sqrt(m.limit)
+	m.limit = m.limit*(1-concurrencySmoothing) + newLimit*concurrencySmoothing
+	m.limit = math.Max(m.min, math.Min(m.max, m.limit))
+
+	group, service := GetGroupAndService()
+	_metricConcurrencyLimit.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Set(m.limit)
+}
+
+func adaptiveConcurrencyEnabled() bool {
+	cc := GetConfigCenter()
+	if cc == nil {
+		return false
+	}
+	enable, _ := cc.GetBool(context.TODO(), adaptiveConcurrencyEnableKey)
+	return enable
+}
+
+// shedRequest 未开启时不限制
+func shedRequest(api string) (release func(sample bool), shed bool) {
+	if !adaptiveConcurrencyEnabled() {
+		return func(bool) {}, false
+	}
+	release, ok := defaultConcurrencyLimiter.acquire()
+	if !ok {
+		group, service := GetGroupAndService()
+		_metricLoadShed.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelAPI, api).Inc()
+		return nil, true
+	}
+	return release, false
+}
+
+func loadShedInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		release, shed := shedRequest(grpcMethodName(info.FullMethod))
+		if shed {
+			return nil, status.Error(codes.ResourceExhausted, "server overloaded")
+		}
+		defer release(true)
+		return handler(ctx, req)
+	}
+}
+
+// loadShedStreamServerInterceptor 流的时长不反映处理能力, 只计入在途数不采样延迟
+func loadShedStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		release, shed := shedRequest(grpcMethodName(info.FullMethod))
+		if shed {
+			return status.Error(codes.ResourceExhausted, "server overloaded")
+		}
+		defer release(false)
+		return handler(srv, ss)
+	}
+}
+
+// loadShedProcessor thrift 过载保护
+type loadShedProcessor struct {
+	thrift.TProcessor
+}
+
+func (m *loadShedProcessor) Process(in, out thrift.TProtocol) (bool, thrift.TException) {
+	name, typeId, seqid, err := in.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+	release, shed := shedRequest(name)
+	if shed {
+		return rejectThriftMessage(in, out, name, seqid, "server overloaded: "+name)
+	}
+	defer release(true)
+	return m.TProcessor.Process(&messageBeginProtocol{TProtocol: in, name: name, typeId: typeId, seqid: seqid}, out)
+}
@@ -0,0 +1,46 @@
+package rocserv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	ass := assert.New(t)
+
+	m := newConcurrencyLimiter(2, 1, 100)
+	r1, ok := m.acquire()
+	ass.True(ok)
+	_, ok = m.acquire()
+	ass.True(ok)
+	_, ok = m.acquire()
+	ass.False(ok)
+	r1(false)
+	ass.Equal(1, m.inflight)
+	ass.Equal(float64(2), m.limit)
+
+	// 并发打满且延迟平稳时提高限制
+	m = newConcurrencyLimiter(10, 5, 100)
+	for i := 0; i < 50; i++ {
+		m.inflight++
+		m.release(int(m.limit), 10*time.Millisecond, true)
+	}
+	ass.True(m.limit > 30)
+	grown := m.limit
+
+	// 延迟升高时降低限制
+	for i := 0; i < 50; i++ {
+		m.inflight++
+		m.release(int(m.limit), 100*time.Millisecond, true)
+	}
+	ass.True(m.limit < grown)
+
+	// 在途请求较少时不调整
+	limit := m.limit
+	m.inflight++
+	m.release(1, time.Second, true)
+	ass.Equal(limit, m.limit)
+	ass.Equal(0, m.inflight)
+}
@@ -0,0 +1,135 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// logLevelState xlog 只在启动时初始化一次, 运行时调整的级别由框架的 logger 过滤
+type logLevelState struct {
+	mu     sync.Mutex
+	inited bool
+	// 配置的日志级别, 运行时设置删除或过期后恢复
+	base    string
+	current string
+
+	// 当前级别及初始化 xlog 的级别, 存储 xlog.Level+1, 0 表示未初始化
+	level     int32
+	xlogLevel int32
+}
+
+var appLogLevel = &logLevelState{}
+
+// initAppLog 测试中替换, 避免修改全局的 xlog
+var initAppLog = xlog.InitAppLogV2
+
+func validLogLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "debug", "info", "warn", "error", "fatal", "panic":
+		return true
+	}
+	return false
+}
+
+// init 按配置的级别初始化 xlog, 运行时调整的级别由 runtime settings 恢复
+func (m *logLevelState) init(dir string, headers map[string]interface{}, level string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inited, m.base, m.current = true, level, level
+	l := convertLevel(level)
+	initAppLog(dir, "serv.log", l, headers)
+	atomic.StoreInt32(&m.xlogLevel, int32(l)+1)
+	atomic.StoreInt32(&m.level, int32(l)+1)
+}
+
+// set 空 level 表示恢复配置的级别
+func (m *logLevelState) set(level string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(level) == 0 {
+		level = m.base
+	}
+	if !validLogLevel(level) {
+		return fmt.Errorf("invalid log level: %s", level)
+	}
+	if !m.inited {
+		return fmt.Errorf("log not inited")
+	}
+	level = strings.ToLower(level)
+	m.current = level
+	atomic.StoreInt32(&m.level, int32(convertLevel(level))+1)
+	return nil
+}
+
+// output 返回级别为 l 的日志是否输出及输出到 xlog 的级别,
+// 运行时级别比初始化 xlog 的级别更详细时按初始化的级别输出
+func (m *logLevelState) output(l xlog.Level) (xlog.Level, bool) {
+	cur := atomic.LoadInt32(&m.level)
+	if cur == 0 {
+		return l, true
+	}
+	if l < xlog.Level(cur-1) {
+		return l, false
+	}
+	if base := xlog.Level(atomic.LoadInt32(&m.xlogLevel) - 1); l < base {
+		return base, true
+	}
+	return l, true
+}
+
+// SetLogLevel change app log level of this instance at runtime, it is kept after restart;
+// ttl > 0 reverts to the configured level after ttl, so debug log is not left on by mistake;
+// it applies to logs written by GetAppLogger, logs written by xlog directly keep the configured level
+func SetLogLevel(level string, ttl time.Duration) error {
+	if !validLogLevel(level) {
+		return fmt.Errorf("invalid log level: %s", level)
+	}
+	// 调整回配置的级别时不需要保存
+	appLogLevel.mu.Lock()
+	base := appLogLevel.base
+	appLogLevel.mu.Unlock()
+	if strings.EqualFold(level, base) {
+		level = ""
+	}
+	return SetRuntimeSetting(context.Background(), RuntimeSettingLogLevel, strings.ToLower(level), ttl, true)
+}
+
+// GetLogLevel current app log level
+func GetLogLevel() string {
+	appLogLevel.mu.Lock()
+	defer appLogLevel.mu.Unlock()
+	return appLogLevel.current
+}
+
+// logLevelHandler GET 返回当前级别, POST ?level=debug&ttl=30m 调整级别
+func logLevelHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if r.Method == http.MethodPost {
+		var ttl time.Duration
+		if s := r.FormValue("ttl"); len(s) > 0 {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid ttl: %s", s), http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		if err := SetLogLevel(r.FormValue("level"), ttl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s, _ := json.Marshal(map[string]string{"level": GetLogLevel()})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s)
+}
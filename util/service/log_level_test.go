@@ -0,0 +1,73 @@
+package rocserv
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogLevelOverride(t *testing.T) {
+	ass := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "loglevel")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// 不初始化全局的 xlog, 临时目录在测试结束后删除
+	var inits int
+	initAppLog = func(dir, name string, l xlog.Level, h map[string]interface{}) { inits++ }
+	defer func() { initAppLog = xlog.InitAppLogV2 }()
+
+	ctx := context.Background()
+	path := filepath.Join(dir, runtimeSettingFile)
+
+	m := &logLevelState{}
+	ass.NotNil(m.set("debug"))
+
+	m.init(dir, nil, "info")
+	ass.NotNil(m.set("verbose"))
+
+	rs := newRuntimeSettings()
+	rs.appliers[RuntimeSettingLogLevel] = m.set
+	rs.init(ctx, NewFileRuntimeSettingStore(path))
+	ass.Nil(rs.set(ctx, RuntimeSettingLogLevel, "DEBUG", time.Hour, true))
+	ass.Equal("debug", m.current)
+	_, err = os.Stat(path)
+	ass.Nil(err)
+
+	// 只调整级别, 不重新初始化 xlog; 比初始化的级别详细时按初始化的级别输出
+	ass.Equal(1, inits)
+	l, ok := m.output(xlog.DebugLevel)
+	ass.True(ok)
+	ass.Equal(xlog.InfoLevel, l)
+	ass.Nil(m.set("warn"))
+	_, ok = m.output(xlog.InfoLevel)
+	ass.False(ok)
+	l, ok = m.output(xlog.ErrorLevel)
+	ass.True(ok)
+	ass.Equal(xlog.ErrorLevel, l)
+	ass.Equal(1, inits)
+
+	// 重启后恢复
+	m2 := &logLevelState{}
+	m2.init(dir, nil, "info")
+	rs2 := newRuntimeSettings()
+	rs2.appliers[RuntimeSettingLogLevel] = m2.set
+	rs2.init(ctx, NewFileRuntimeSettingStore(path))
+	ass.Equal("debug", m2.current)
+
+	ass.Nil(rs2.set(ctx, RuntimeSettingLogLevel, "warn", 20*time.Millisecond, true))
+	time.Sleep(100 * time.Millisecond)
+	m2.mu.Lock()
+	ass.Equal("info", m2.current)
+	m2.mu.Unlock()
+	_, err = os.Stat(path)
+	ass.True(os.IsNotExist(err))
+}
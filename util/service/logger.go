@@ -0,0 +1,251 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
+
+	"github.com/rs/zerolog"
+)
+
+// AppLogger leveled logger used by the framework, default writes app log by xlog,
+// set it with SetAppLogger or WithAppLogger to use structured loggers such as zap or zerolog;
+// startup failures still panic by xlog.Panicf, since the app logger may not be set yet
+type AppLogger interface {
+	Debugf(ctx context.Context, format string, args ...interface{})
+	Infof(ctx context.Context, format string, args ...interface{})
+	Warnf(ctx context.Context, format string, args ...interface{})
+	Errorf(ctx context.Context, format string, args ...interface{})
+	// Infow 结构化日志, keysAndValues 为 key value 交替
+	Infow(ctx context.Context, msg string, keysAndValues ...interface{})
+}
+
+// appLogger 每次 Store 的具体类型需一致
+type loggerHolder struct {
+	AppLogger
+}
+
+var appLogger atomic.Value
+
+func init() {
+	appLogger.Store(loggerHolder{xlogLogger{}})
+}
+
+// SetAppLogger replace logger of the framework, nil restores xlog, runtime log level of backdoor only applies to xlog
+func SetAppLogger(l AppLogger) {
+	if l == nil {
+		l = xlogLogger{}
+	}
+	appLogger.Store(loggerHolder{l})
+}
+
+// GetAppLogger return logger of the framework
+func GetAppLogger() AppLogger {
+	return logger()
+}
+
+func logger() AppLogger {
+	return appLogger.Load().(loggerHolder).AppLogger
+}
+
+// xlogLogger 按运行时的日志级别过滤, 见 SetLogLevel
+type xlogLogger struct{}
+
+func (xlogLogger) Debugf(ctx context.Context, format string, args ...interface{}) {
+	xlogf(ctx, xlog.DebugLevel, format, args...)
+}
+
+func (xlogLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	xlogf(ctx, xlog.InfoLevel, format, args...)
+}
+
+func (xlogLogger) Warnf(ctx context.Context, format string, args ...interface{}) {
+	xlogf(ctx, xlog.WarnLevel, format, args...)
+}
+
+func (xlogLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	xlogf(ctx, xlog.ErrorLevel, format, args...)
+}
+
+func (xlogLogger) Infow(ctx context.Context, msg string, keysAndValues ...interface{}) {
+	out, ok := appLogLevel.output(xlog.InfoLevel)
+	if !ok {
+		return
+	}
+	if out == xlog.InfoLevel {
+		xlog.Infow(ctx, msg, keysAndValues...)
+		return
+	}
+	xlogf(ctx, xlog.InfoLevel, "%s %v", msg, keysAndValues)
+}
+
+// xlogf 以高于原级别输出时在日志中标明原级别
+func xlogf(ctx context.Context, l xlog.Level, format string, args ...interface{}) {
+	out, ok := appLogLevel.output(l)
+	if !ok {
+		return
+	}
+	if out != l {
+		format = "[" + levelName(l) + "] " + format
+	}
+	switch out {
+	case xlog.DebugLevel:
+		xlog.Debugf(ctx, format, args...)
+	case xlog.InfoLevel:
+		xlog.Infof(ctx, format, args...)
+	case xlog.WarnLevel:
+		xlog.Warnf(ctx, format, args...)
+	default:
+		xlog.Errorf(ctx, format, args...)
+	}
+}
+
+func levelName(l xlog.Level) string {
+	switch l {
+	case xlog.DebugLevel:
+		return "debug"
+	case xlog.InfoLevel:
+		return "info"
+	case xlog.WarnLevel:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ZapSugaredLogger methods of *zap.SugaredLogger used by NewZapLogger
+type ZapSugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// NewZapLogger adapt *zap.SugaredLogger, trace id in ctx is logged as field trace_id
+func NewZapLogger(l ZapSugaredLogger) AppLogger {
+	return &zapLogger{l: l}
+}
+
+type zapLogger struct {
+	l ZapSugaredLogger
+}
+
+func (m *zapLogger) Debugf(ctx context.Context, format string, args ...interface{}) {
+	m.l.Debugw(fmt.Sprintf(format, args...), logTraceFields(ctx)...)
+}
+
+func (m *zapLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	m.l.Infow(fmt.Sprintf(format, args...), logTraceFields(ctx)...)
+}
+
+func (m *zapLogger) Warnf(ctx context.Context, format string, args ...interface{}) {
+	m.l.Warnw(fmt.Sprintf(format, args...), logTraceFields(ctx)...)
+}
+
+func (m *zapLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	m.l.Errorw(fmt.Sprintf(format, args...), logTraceFields(ctx)...)
+}
+
+func (m *zapLogger) Infow(ctx context.Context, msg string, keysAndValues ...interface{}) {
+	m.l.Infow(msg, append(keysAndValues, logTraceFields(ctx)...)...)
+}
+
+// NewZerologLogger adapt zerolog.Logger, trace id in ctx is logged as field trace_id
+func NewZerologLogger(l zerolog.Logger) AppLogger {
+	return &zerologLogger{l: l}
+}
+
+type zerologLogger struct {
+	l zerolog.Logger
+}
+
+func (m *zerologLogger) Debugf(ctx context.Context, format string, args ...interface{}) {
+	m.logf(ctx, zerolog.DebugLevel, format, args...)
+}
+
+func (m *zerologLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	m.logf(ctx, zerolog.InfoLevel, format, args...)
+}
+
+func (m *zerologLogger) Warnf(ctx context.Context, format string, args ...interface{}) {
+	m.logf(ctx, zerolog.WarnLevel, format, args...)
+}
+
+func (m *zerologLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	m.logf(ctx, zerolog.ErrorLevel, format, args...)
+}
+
+func (m *zerologLogger) Infow(ctx context.Context, msg string, keysAndValues ...interface{}) {
+	e := m.l.WithLevel(zerolog.InfoLevel)
+	if e == nil {
+		return
+	}
+	zerologFields(e, append(keysAndValues, logTraceFields(ctx)...)).Msg(msg)
+}
+
+// logf 级别未开启时 WithLevel 返回 nil, 不格式化日志
+func (m *zerologLogger) logf(ctx context.Context, level zerolog.Level, format string, args ...interface{}) {
+	e := m.l.WithLevel(level)
+	if e == nil {
+		return
+	}
+	zerologFields(e, logTraceFields(ctx)).Msg(fmt.Sprintf(format, args...))
+}
+
+// zerologFields 奇数个时最后一个值的 key 为 !BADKEY, 同 zap
+func zerologFields(e *zerolog.Event, keysAndValues []interface{}) *zerolog.Event {
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		e = e.Interface(fmt.Sprint(keysAndValues[i]), keysAndValues[i+1])
+	}
+	if len(keysAndValues)%2 == 1 {
+		e = e.Interface("!BADKEY", keysAndValues[len(keysAndValues)-1])
+	}
+	return e
+}
+
+// LogLevel level passed to LogFunc, values are the same as zerolog.Level
+type LogLevel int8
+
+// levels of LogFunc
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+// LogFunc adapt other loggers by a single function, trace id in ctx is appended to keysAndValues as trace_id
+type LogFunc func(ctx context.Context, level LogLevel, msg string, keysAndValues ...interface{})
+
+func (f LogFunc) Debugf(ctx context.Context, format string, args ...interface{}) {
+	f(ctx, LogLevelDebug, fmt.Sprintf(format, args...), logTraceFields(ctx)...)
+}
+
+func (f LogFunc) Infof(ctx context.Context, format string, args ...interface{}) {
+	f(ctx, LogLevelInfo, fmt.Sprintf(format, args...), logTraceFields(ctx)...)
+}
+
+func (f LogFunc) Warnf(ctx context.Context, format string, args ...interface{}) {
+	f(ctx, LogLevelWarn, fmt.Sprintf(format, args...), logTraceFields(ctx)...)
+}
+
+func (f LogFunc) Errorf(ctx context.Context, format string, args ...interface{}) {
+	f(ctx, LogLevelError, fmt.Sprintf(format, args...), logTraceFields(ctx)...)
+}
+
+func (f LogFunc) Infow(ctx context.Context, msg string, keysAndValues ...interface{}) {
+	f(ctx, LogLevelInfo, msg, append(keysAndValues, logTraceFields(ctx)...)...)
+}
+
+// logTraceFields xlog 从 ctx 中取 trace id, 其他 logger 作为字段输出
+func logTraceFields(ctx context.Context) []interface{} {
+	if ctx == nil {
+		return nil
+	}
+	if tid := traceIDFromContext(ctx); len(tid) > 0 {
+		return []interface{}{"trace_id", tid}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package rocserv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSugaredLogger struct {
+	lines []string
+}
+
+func (m *fakeSugaredLogger) log(level, msg string, kv ...interface{}) {
+	m.lines = append(m.lines, fmt.Sprint(level, " ", msg, kv))
+}
+
+func (m *fakeSugaredLogger) Debugw(msg string, kv ...interface{}) { m.log("debug", msg, kv...) }
+func (m *fakeSugaredLogger) Infow(msg string, kv ...interface{})  { m.log("info", msg, kv...) }
+func (m *fakeSugaredLogger) Warnw(msg string, kv ...interface{})  { m.log("warn", msg, kv...) }
+func (m *fakeSugaredLogger) Errorw(msg string, kv ...interface{}) { m.log("error", msg, kv...) }
+
+func TestAppLogger(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+	defer SetAppLogger(nil)
+
+	zl := &fakeSugaredLogger{}
+	SetAppLogger(NewZapLogger(zl))
+	logger().Infof(ctx, "%s start", "serv")
+	logger().Errorf(ctx, "err: %v", "timeout")
+	logger().Infow(ctx, "leadership acquired", "lock", "/roc/lock")
+	ass.Equal([]string{"info serv start[]", "error err: timeout[]", "info leadership acquired[lock /roc/lock]"}, zl.lines)
+
+	var levels []LogLevel
+	var msgs []string
+	SetAppLogger(LogFunc(func(ctx context.Context, level LogLevel, msg string, kv ...interface{}) {
+		levels = append(levels, level)
+		msgs = append(msgs, msg)
+	}))
+	GetAppLogger().Debugf(ctx, "a")
+	GetAppLogger().Warnf(ctx, "b %d", 1)
+	ass.Equal([]LogLevel{LogLevelDebug, LogLevelWarn}, levels)
+	ass.Equal([]string{"a", "b 1"}, msgs)
+
+	buf := &bytes.Buffer{}
+	SetAppLogger(NewZerologLogger(zerolog.New(buf).Level(zerolog.InfoLevel)))
+	logger().Debugf(ctx, "hidden")
+	logger().Warnf(ctx, "retry %d", 2)
+	logger().Infow(ctx, "leadership acquired", "lock", "/roc/lock", "odd")
+	ass.Equal(`{"level":"warn","message":"retry 2"}`+"\n"+
+		`{"level":"info","lock":"/roc/lock","!BADKEY":"odd","message":"leadership acquired"}`+"\n", buf.String())
+
+	SetAppLogger(nil)
+	_, ok := GetAppLogger().(xlogLogger)
+	ass.True(ok)
+}
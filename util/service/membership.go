@@ -0,0 +1,106 @@
+package rocserv
+
+import (
+	"context"
+	"runtime/debug"
+	"sort"
+)
+
+type membershipKey struct {
+	servid    int
+	processor string
+}
+
+// OnChange register fn called when routable instances of the service change, e.g. long-lived streams can
+// reconnect and sharded consumers can rebalance; instances are copies with Servid set, updated ones have
+// the same servid and processor but different address. fn is called in order by the goroutine updating
+// routes and should not block, the returned func cancels it
+func (m *ClientEtcdV2) OnChange(fn func(added, removed, updated []*ServInfo)) func() {
+	m.muChange.Lock()
+	defer m.muChange.Unlock()
+
+	if m.changeFns == nil {
+		m.changeFns = make(map[int]func(added, removed, updated []*ServInfo))
+	}
+	id := m.changeID
+	m.changeID++
+	m.changeFns[id] = fn
+
+	return func() {
+		m.muChange.Lock()
+		defer m.muChange.Unlock()
+		delete(m.changeFns, id)
+	}
+}
+
+// routableInstances 未禁用且已激活的实例
+func routableInstances(instances map[string][]InstanceSnapshot) map[membershipKey]*ServInfo {
+	res := make(map[membershipKey]*ServInfo)
+	for processor, list := range instances {
+		for _, ins := range list {
+			if ins.Disabled || !ins.Active {
+				continue
+			}
+			res[membershipKey{ins.Servid, processor}] = &ServInfo{Type: ins.Type, Addr: ins.Addr, Servid: ins.Servid, TLS: ins.TLS}
+		}
+	}
+	return res
+}
+
+func diffInstances(old, new map[string][]InstanceSnapshot) (added, removed, updated []*ServInfo) {
+	before, after := routableInstances(old), routableInstances(new)
+	for k, s := range after {
+		p, ok := before[k]
+		if !ok {
+			added = append(added, s)
+		} else if *p != *s {
+			updated = append(updated, s)
+		}
+	}
+	for k, s := range before {
+		if _, ok := after[k]; !ok {
+			removed = append(removed, s)
+		}
+	}
+	for _, list := range [][]*ServInfo{added, removed, updated} {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Servid < list[j].Servid || list[i].Servid == list[j].Servid && list[i].Addr < list[j].Addr
+		})
+	}
+	return
+}
+
+func (m *ClientEtcdV2) notifyChange(old, new map[string][]InstanceSnapshot) {
+	fun := "ClientEtcdV2.notifyChange -->"
+
+	m.muChange.Lock()
+	fns := make([]func(added, removed, updated []*ServInfo), 0, len(m.changeFns))
+	ids := make([]int, 0, len(m.changeFns))
+	for id := range m.changeFns {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fns = append(fns, m.changeFns[id])
+	}
+	m.muChange.Unlock()
+	if len(fns) == 0 {
+		return
+	}
+
+	added, removed, updated := diffInstances(old, new)
+	if len(added) == 0 && len(removed) == 0 && len(updated) == 0 {
+		return
+	}
+	logger().Infof(context.Background(), "%s servkey: %s added: %d removed: %d updated: %d", fun, m.servKey, len(added), len(removed), len(updated))
+	for _, fn := range fns {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logger().Errorf(context.Background(), "%s servkey: %s callback panic: %v, stack: %s", fun, m.servKey, r, debug.Stack())
+				}
+			}()
+			fn(added, removed, updated)
+		}()
+	}
+}
@@ -0,0 +1,47 @@
+package rocserv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnChange(t *testing.T) {
+	ass := assert.New(t)
+
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.upServlist(servCopyCollect{1: zoneServCopy(1, "a", 100)})
+
+	var added, removed, updated []*ServInfo
+	calls := 0
+	cancel := cli.OnChange(func(a, r, u []*ServInfo) {
+		calls++
+		added, removed, updated = a, r, u
+	})
+	cli.OnChange(func(a, r, u []*ServInfo) {
+		panic("bad callback")
+	})
+
+	moved := zoneServCopy(1, "a", 100)
+	moved.reg.Servs["proc_grpc"] = &ServInfo{Type: PROCESSOR_GRPC, Addr: "127.0.0.1:9100"}
+	disabled := zoneServCopy(3, "a", 100)
+	disabled.manual.Ctrl.Disable = true
+	cli.upServlist(servCopyCollect{1: moved, 2: zoneServCopy(2, "a", 100), 3: disabled})
+	ass.Equal(1, calls)
+	ass.Equal([]*ServInfo{{Type: PROCESSOR_GRPC, Addr: "127.0.0.2:9000", Servid: 2}}, added)
+	ass.Empty(removed)
+	ass.Equal([]*ServInfo{{Type: PROCESSOR_GRPC, Addr: "127.0.0.1:9100", Servid: 1}}, updated)
+
+	// 没有变化时不回调
+	cli.upServlist(servCopyCollect{1: moved, 2: zoneServCopy(2, "a", 100), 3: disabled})
+	ass.Equal(1, calls)
+
+	cli.upServlist(servCopyCollect{2: zoneServCopy(2, "a", 100)})
+	ass.Equal(2, calls)
+	ass.Empty(added)
+	ass.Equal(1, removed[0].Servid)
+
+	cancel()
+	cli.upServlist(servCopyCollect{})
+	ass.Equal(2, calls)
+}
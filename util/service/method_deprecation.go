@@ -0,0 +1,207 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	// 调用方对同一个废弃接口的告警日志间隔
+	deprecatedCallLogInterval = time.Minute
+
+	controlDeprecatedCallers = "deprecated_callers"
+)
+
+// MethodDeprecation deprecated method published in registration data of server
+type MethodDeprecation struct {
+	Method string `json:"method"`
+	// 下线时间, unix 秒
+	Sunset  int64  `json:"sunset"`
+	Message string `json:"message"`
+}
+
+// DeprecatedCaller caller still using deprecated method
+type DeprecatedCaller struct {
+	Caller string `json:"caller"`
+	Count  int64  `json:"count"`
+	Last   int64  `json:"last"`
+}
+
+var (
+	muMethodDeprecations sync.RWMutex
+	methodDeprecations   = make(map[string]*MethodDeprecation)
+
+	muDeprecatedCallers sync.Mutex
+	// method -> caller -> usage
+	deprecatedCallers = make(map[string]map[string]*DeprecatedCaller)
+
+	muDeprecatedCallLog sync.Mutex
+	deprecatedCallLog   = make(map[string]time.Time)
+)
+
+// DeprecateMethod mark method deprecated, method is name of grpc method or path of http route;
+// it is published with registration, so callers get warned, must be called before Serve or in initfn
+func DeprecateMethod(method string, sunset time.Time, message string) {
+	muMethodDeprecations.Lock()
+	defer muMethodDeprecations.Unlock()
+	methodDeprecations[method] = &MethodDeprecation{Method: method, Sunset: sunset.Unix(), Message: message}
+}
+
+func getMethodDeprecations() []*MethodDeprecation {
+	muMethodDeprecations.RLock()
+	defer muMethodDeprecations.RUnlock()
+	if len(methodDeprecations) == 0 {
+		return nil
+	}
+	list := make([]*MethodDeprecation, 0, len(methodDeprecations))
+	for _, d := range methodDeprecations {
+		list = append(list, d)
+	}
+	return list
+}
+
+func getMethodDeprecation(method string) *MethodDeprecation {
+	muMethodDeprecations.RLock()
+	defer muMethodDeprecations.RUnlock()
+	return methodDeprecations[method]
+}
+
+// GetMethodDeprecation return deprecation of method published by copies of service
+func (m *ClientEtcdV2) GetMethodDeprecation(method string) *MethodDeprecation {
+	deprecations, _ := m.deprecations.Load().(map[string]*MethodDeprecation)
+	return deprecations[method]
+}
+
+// buildMethodDeprecations 汇总各副本声明的废弃接口, 多个副本声明同一接口时取先遍历到的
+func buildMethodDeprecations(scopy servCopyCollect) map[string]*MethodDeprecation {
+	deprecations := make(map[string]*MethodDeprecation)
+	for _, c := range scopy {
+		if c == nil || c.reg == nil {
+			continue
+		}
+		for _, d := range c.reg.Deprecations {
+			if _, ok := deprecations[d.Method]; !ok {
+				deprecations[d.Method] = d
+			}
+		}
+	}
+	return deprecations
+}
+
+type deprecationLookup interface {
+	GetMethodDeprecation(method string) *MethodDeprecation
+}
+
+// noticeDeprecatedCall 调用方发现调用了废弃接口时打点, 日志按时间间隔限流
+func noticeDeprecatedCall(cb ClientLookup, funcName string) {
+	fun := "noticeDeprecatedCall -->"
+
+	dl, ok := cb.(deprecationLookup)
+	if !ok {
+		return
+	}
+	d := dl.GetMethodDeprecation(funcName)
+	if d == nil {
+		return
+	}
+
+	group, service := GetGroupAndService()
+	_metricDeprecatedCall.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelCalleeService, cb.ServKey(), xprom.LabelAPI, funcName).Inc()
+
+	key := cb.ServKey() + "/" + funcName
+	now := time.Now()
+	muDeprecatedCallLog.Lock()
+	last := deprecatedCallLog[key]
+	if now.Sub(last) >= deprecatedCallLogInterval {
+		deprecatedCallLog[key] = now
+	}
+	muDeprecatedCallLog.Unlock()
+	if now.Sub(last) >= deprecatedCallLogInterval {
+		logger().Warnf(context.Background(), "%s callee: %s method: %s is deprecated, sunset: %s, message: %s",
+			fun, cb.ServKey(), funcName, time.Unix(d.Sunset, 0).Format("2006-01-02"), d.Message)
+	}
+}
+
+// recordDeprecatedCaller 服务端记录仍在调用废弃接口的调用方
+func recordDeprecatedCaller(ctx context.Context, method string) {
+	if getMethodDeprecation(method) == nil {
+		return
+	}
+
+	caller := costCaller(ctx)
+	if len(caller) == 0 {
+		caller = unknownCostLabel
+	}
+
+	group, service := GetGroupAndService()
+	_metricDeprecatedServed.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelAPI, method, labelCaller, caller).Inc()
+
+	muDeprecatedCallers.Lock()
+	defer muDeprecatedCallers.Unlock()
+	callers, ok := deprecatedCallers[method]
+	if !ok {
+		callers = make(map[string]*DeprecatedCaller)
+		deprecatedCallers[method] = callers
+	}
+	c, ok := callers[caller]
+	if !ok {
+		c = &DeprecatedCaller{Caller: caller}
+		callers[caller] = c
+	}
+	c.Count++
+	c.Last = time.Now().Unix()
+}
+
+// GetDeprecatedCallers return callers of deprecated methods since start, key is method
+func GetDeprecatedCallers() map[string][]*DeprecatedCaller {
+	muDeprecatedCallers.Lock()
+	defer muDeprecatedCallers.Unlock()
+
+	res := make(map[string][]*DeprecatedCaller, len(deprecatedCallers))
+	for method, callers := range deprecatedCallers {
+		for _, c := range callers {
+			cp := *c
+			res[method] = append(res[method], &cp)
+		}
+	}
+	return res
+}
+
+// controlGetDeprecatedCallers roc-ctl 通过控制命令汇总各副本的调用方
+func controlGetDeprecatedCallers(ctx context.Context, args []string) (string, error) {
+	js, err := json.Marshal(GetDeprecatedCallers())
+	if err != nil {
+		return "", err
+	}
+	return string(js), nil
+}
+
+// grpcMethodName /package.service/method 中的 method
+func grpcMethodName(fullMethod string) string {
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[i+1:]
+	}
+	return fullMethod
+}
+
+func deprecationServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		recordDeprecatedCaller(ctx, grpcMethodName(info.FullMethod))
+		return handler(ctx, req)
+	}
+}
+
+func deprecationHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recordDeprecatedCaller(r.Context(), r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,47 @@
+package rocserv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMethodDeprecation(t *testing.T) {
+	ass := assert.New(t)
+
+	DeprecateMethod("GetUserV1", time.Now().Add(30*24*time.Hour), "use GetUser")
+	defer delete(methodDeprecations, "GetUserV1")
+
+	muDeprecatedCallers.Lock()
+	callersBefore := deprecatedCallers
+	deprecatedCallers = make(map[string]map[string]*DeprecatedCaller)
+	muDeprecatedCallers.Unlock()
+	defer func() {
+		muDeprecatedCallers.Lock()
+		deprecatedCallers = callersBefore
+		muDeprecatedCallers.Unlock()
+	}()
+
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.upServlist(servCopyCollect{
+		1: {servId: 1, reg: &RegData{Deprecations: getMethodDeprecations()}},
+	})
+	ass.NotNil(cli.GetMethodDeprecation("GetUserV1"))
+	ass.Nil(cli.GetMethodDeprecation("GetUser"))
+
+	// 路由更新后缓存随之更新
+	cli.upServlist(servCopyCollect{
+		1: {servId: 1, reg: &RegData{}},
+	})
+	ass.Nil(cli.GetMethodDeprecation("GetUserV1"))
+	ass.Nil((&ClientEtcdV2{}).GetMethodDeprecation("GetUserV1"))
+
+	recordDeprecatedCaller(context.Background(), "GetUserV1")
+	recordDeprecatedCaller(context.Background(), "GetUser")
+	callers := GetDeprecatedCallers()
+	ass.Len(callers, 1)
+	ass.Equal(int64(1), callers["GetUserV1"][0].Count)
+	ass.Equal("GetUserV1", grpcMethodName("/pkg.Account/GetUserV1"))
+}
@@ -5,7 +5,6 @@ import (
 	"strconv"
 	"time"
 
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric"
 	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xtrace"
@@ -31,6 +30,36 @@ const (
 	dbType  = "db"
 	rpcType = "rpc"
 
+	errorType = "error"
+	eventType = "event"
+	poolType  = "worker_pool"
+	costType  = "cost"
+	depType   = "dependency"
+	confType  = "config"
+	electType = "election"
+	etcdType  = "etcd"
+
+	labelPoolName  = "pool"
+	labelPoolStage = "stage"
+
+	labelCaller    = "caller"
+	labelProcessor = "processor"
+	labelCode      = "code"
+	labelTenant    = "tenant"
+
+	labelOptionKind = "kind"
+	labelOptionName = "option"
+
+	labelChainVersion = "chain_version"
+	labelLayer        = "layer"
+
+	labelEndpoint    = "endpoint"
+	labelLock        = "lock"
+	labelCanaryGroup = "canary_group"
+	labelEtcdOp      = "op"
+	labelEtcdPath    = "path"
+	labelReason      = "reason"
+
 	calleeAddr             = "callee_addr"
 	connectionPoolStatType = "stat_type"
 	confActiveType         = "1" // 配置的可建立连接数
@@ -42,6 +71,7 @@ const (
 var (
 	buckets   = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
 	msBuckets = []float64{1, 3, 5, 10, 25, 50, 100, 200, 300, 500, 1000, 3000, 5000, 10000, 15000}
+	usBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
 	// 目前只用作sla统计，后续通过修改标签作为所有微服务的耗时统计
 	_metricRequestDuration = xprom.NewHistogram(&xprom.HistogramVecOpts{
 		Namespace:  namespacePalfish,
@@ -116,6 +146,559 @@ var (
 		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelSource},
 	})
 
+	_metricErrorReportCount = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  errorType,
+		Name:       "report_count",
+		Help:       "reported error and panic count",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelType},
+	})
+
+	_metricPanic = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  errorType,
+		Name:       "panic_count",
+		Help:       "panics recovered in processors",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelType, xprom.LabelAPI},
+	})
+
+	_metricEventCount = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  eventType,
+		Name:       "emit_count",
+		Help:       "business event count by status",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelType, labelStatus},
+	})
+
+	_metricWorkerPoolQueue = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  poolType,
+		Name:       "queue_length",
+		Help:       "worker pool queued task count",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelPoolName},
+	})
+
+	_metricWorkerPoolDuration = xprom.NewHistogram(&xprom.HistogramVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  poolType,
+		Name:       "task_duration",
+		Buckets:    buckets,
+		Help:       "worker pool task wait and run time",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelPoolName, labelPoolStage},
+	})
+
+	_metricWorkerPoolRejected = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  poolType,
+		Name:       "rejected_count",
+		Help:       "worker pool rejected task count",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelPoolName},
+	})
+
+	_metricWorkerPoolPanic = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  poolType,
+		Name:       "panic_count",
+		Help:       "worker pool task panic count",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelPoolName},
+	})
+
+	_metricGoRunning = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  poolType,
+		Name:       "go_running",
+		Help:       "running goroutines started by rocserv.Go",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelPoolName},
+	})
+
+	_metricGoRejected = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  poolType,
+		Name:       "go_rejected_count",
+		Help:       "goroutines rejected by limit of rocserv.Go",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelPoolName},
+	})
+
+	_metricMiddlewareDuration = xprom.NewHistogram(&xprom.HistogramVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "middleware_duration_us",
+		Buckets:    usBuckets,
+		Help:       "self time of each framework middleware layer in microseconds",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, labelChainVersion, labelLayer},
+	})
+
+	_metricMiddlewareOverhead = xprom.NewHistogram(&xprom.HistogramVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "middleware_overhead_us",
+		Buckets:    usBuckets,
+		Help:       "sum of self time of framework middleware layers per request in microseconds",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, labelChainVersion},
+	})
+
+	_metricMiddlewareOverBudget = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "middleware_over_budget_count",
+		Help:       "requests whose framework middleware overhead exceeds middleware_overhead_budget_us",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, labelChainVersion},
+	})
+
+	_metricMiddlewareChainLayers = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "middleware_chain_layers",
+		Help:       "layer count of framework middleware chain by version",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, labelChainVersion},
+	})
+
+	_metricCostRequests = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  costType,
+		Name:       "requests",
+		Help:       "request count by caller and tenant",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelCaller, labelTenant},
+	})
+
+	_metricCostDuration = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  costType,
+		Name:       "wall_seconds",
+		Help:       "request handler wall time seconds by caller and tenant, not cpu time",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelCaller, labelTenant},
+	})
+
+	_metricCostDownstream = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  costType,
+		Name:       "downstream_calls",
+		Help:       "downstream call count by caller and tenant",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelCaller, labelTenant},
+	})
+
+	_metricCostBytes = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  costType,
+		Name:       "bytes",
+		Help:       "request and response bytes by caller and tenant",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelCaller, labelTenant},
+	})
+
+	_metricDependencyDegraded = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  depType,
+		Name:       "degraded",
+		Help:       "downstream dependency degraded status",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelCalleeService},
+	})
+
+	_metricDeprecatedOption = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  confType,
+		Name:       "deprecated_option",
+		Help:       "deprecated flag or env used at startup",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelOptionKind, labelOptionName},
+	})
+
+	_metricDeprecatedCall = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "deprecated_call",
+		Help:       "client calls of methods deprecated by callee",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelCalleeService, xprom.LabelAPI},
+	})
+
+	_metricDeprecatedServed = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  apiType,
+		Name:       "deprecated_served",
+		Help:       "requests of deprecated methods by caller",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelAPI, labelCaller},
+	})
+
+	_metricCallerRequest = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  apiType,
+		Name:       "caller_request",
+		Help:       "api requests by caller service",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelAPI, labelCaller},
+	})
+
+	_metricInstanceBreakerState = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "instance_breaker_state",
+		Help:       "per-instance circuit breaker state of callee, 0 closed 1 open 2 half-open",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelCalleeService, calleeAddr},
+	})
+
+	_metricWebSocketConns = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  apiType,
+		Name:       "websocket_connections",
+		Help:       "active websocket connections",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricWebSocketAccepted = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  apiType,
+		Name:       "websocket_accepted",
+		Help:       "websocket upgrade requests accepted",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricWebhookReceived = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  apiType,
+		Name:       "webhook_received",
+		Help:       "webhook events received and handled by endpoint and result",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelEndpoint, labelStatus},
+	})
+
+	_metricDelivery = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "webhook_delivery",
+		Help:       "outbound webhook deliveries by destination and result",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelEndpoint, labelStatus},
+	})
+
+	_metricGrpcConns = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "grpc_server_connections",
+		Help:       "active grpc server connections",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricGrpcStreams = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "grpc_server_streams",
+		Help:       "active grpc server streams",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricGrpcStreamReset = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "grpc_server_stream_reset",
+		Help:       "grpc server streams reset by client",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelAPI},
+	})
+
+	_metricGrpcSendStall = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "grpc_server_send_stall",
+		Help:       "grpc server stream sends blocked longer than threshold, usually flow control window exhausted",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelAPI},
+	})
+
+	_metricThriftConns = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "thrift_server_connections",
+		Help:       "open thrift server connections",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricThriftConnBytes = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "thrift_server_bytes",
+		Help:       "thrift server connection bytes by direction in or out",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelDirection},
+	})
+
+	_metricThriftConnIdle = xprom.NewHistogram(&xprom.HistogramVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "thrift_server_conn_idle",
+		Buckets:    []float64{.01, .1, 1, 10, 60, 300, 600, 1800},
+		Help:       "thrift server connection idle seconds waiting for next request",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricThriftConnReaped = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "thrift_server_conn_reaped",
+		Help:       "idle thrift server connections closed",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricEtcdWatchCompacted = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  confType,
+		Name:       "etcd_watch_compacted",
+		Help:       "etcd watches restarted because watch index was compacted",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelWatchKind},
+	})
+
+	_metricServerRateLimited = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  apiType,
+		Name:       "server_rate_limited",
+		Help:       "server requests rejected by rate limit",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelAPI},
+	})
+
+	_metricConcurrencyLimit = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  apiType,
+		Name:       "adaptive_concurrency_limit",
+		Help:       "adaptive concurrency limit of server",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricLoadShed = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  apiType,
+		Name:       "load_shed",
+		Help:       "server requests rejected by adaptive concurrency limit",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelAPI},
+	})
+
+	_metricRegistryReadThrottled = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  confType,
+		Name:       "registry_read_throttled",
+		Help:       "service discovery etcd reads delayed by registry read qps limit",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricRegistrySnapshotStale = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  confType,
+		Name:       "registry_snapshot_stale_seconds",
+		Help:       "age of local registry snapshot used while etcd is unreachable, 0 after watch recovers",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelCalleeService},
+	})
+
+	_metricRegistryEtcdCluster = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  confType,
+		Name:       "registry_etcd_cluster",
+		Help:       "index of etcd cluster service discovery reads from, 0 is the primary, others are fallbacks",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricSystemProcessorUp = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  confType,
+		Name:       "system_processor_up",
+		Help:       "whether internal processor such as backdoor is serving, 0 means the instance is degraded",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor},
+	})
+
+	_metricRegisterHeartbeatAge = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  confType,
+		Name:       "register_heartbeat_age_seconds",
+		Help:       "seconds since registry nodes of this instance were last written or refreshed",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricRegisterHeartbeatFailures = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  confType,
+		Name:       "register_heartbeat_failures_total",
+		Help:       "failed rounds of writing or refreshing registry nodes of this instance",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricRegisterRepairs = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  confType,
+		Name:       "register_repair_total",
+		Help:       "registry nodes of this instance found missing or changed and re-written, reason is missing or mismatch",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelReason},
+	})
+
+	_metricRegistrationPending = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  confType,
+		Name:       "registration_pending",
+		Help:       "1 while the instance started degraded without etcd and is serving unregistered",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricElectionLeader = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  electType,
+		Name:       "leader",
+		Help:       "1 if this instance holds the lock",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelLock},
+	})
+
+	_metricElectionAttempts = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  electType,
+		Name:       "attempts",
+		Help:       "lock acquire attempts",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelLock, labelStatus},
+	})
+
+	_metricElectionHold = xprom.NewHistogram(&xprom.HistogramVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  electType,
+		Name:       "hold_seconds",
+		Buckets:    []float64{1, 10, 60, 600, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600},
+		Help:       "seconds the lock is held before released or lost",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelLock},
+	})
+
+	_metricElectionFailover = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  electType,
+		Name:       "failover",
+		Help:       "lock taken over by this instance after previous holder released or expired",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelLock},
+	})
+
+	_metricElectionFailoverTime = xprom.NewHistogram(&xprom.HistogramVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  electType,
+		Name:       "failover_seconds",
+		Buckets:    []float64{.01, .1, .5, 1, 5, 10, 30, 60, 180},
+		Help:       "seconds from previous holder released or expired to this instance acquired the lock",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelLock},
+	})
+
+	_metricCanaryRouted = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "canary_routed",
+		Help:       "client requests routed to canary group by traffic splitting rule",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelCalleeService, labelCanaryGroup},
+	})
+
+	_metricShadowRequest = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "shadow_request",
+		Help:       "client requests mirrored to shadow instances, status is ok, error or dropped",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelCalleeService, xprom.LabelAPI, labelStatus},
+	})
+
+	_metricEtcdOpDuration = xprom.NewHistogram(&xprom.HistogramVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  etcdType,
+		Name:       "op_duration_seconds",
+		Buckets:    []float64{.001, .005, .01, .05, .1, .5, 1, 3, 5},
+		Help:       "duration of etcd operations performed by framework, path is the first segment under base location such as dist2, lock, etc",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelEtcdOp, labelEtcdPath, labelStatus},
+	})
+
+	_metricZoneSpillover = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "zone_spillover",
+		Help:       "client requests routed across zones because healthy capacity of local zone is insufficient",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelCalleeService},
+	})
+
+	_metricInferredTimeout = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "inferred_timeout_seconds",
+		Help:       "client timeout inferred from latency percentile of downstream method",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, xprom.LabelCalleeService, xprom.LabelAPI},
+	})
+
+	_metricIdentityCertExpire = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "identity_cert_expire_seconds",
+		Help:       "seconds until service identity certificate expires",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName},
+	})
+
+	_metricRPCServerDuration = xprom.NewHistogram(&xprom.HistogramVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "server_handling_seconds",
+		Help:       "latency of incoming requests in seconds",
+		Buckets:    buckets,
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, xprom.LabelAPI, labelCaller},
+	})
+
+	_metricRPCServerHandled = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "server_handled_total",
+		Help:       "incoming requests completed by code",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, xprom.LabelAPI, labelCaller, labelCode},
+	})
+
+	_metricRPCServerInFlight = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "server_in_flight",
+		Help:       "incoming requests being handled",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, xprom.LabelAPI},
+	})
+
+	_metricRPCClientDuration = xprom.NewHistogram(&xprom.HistogramVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "client_handling_seconds",
+		Help:       "latency of outgoing requests in seconds",
+		Buckets:    buckets,
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, xprom.LabelCalleeService, xprom.LabelAPI},
+	})
+
+	_metricRPCClientHandled = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "client_handled_total",
+		Help:       "outgoing requests completed by code",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, xprom.LabelCalleeService, xprom.LabelAPI, labelCode},
+	})
+
+	_metricRPCClientInFlight = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "client_in_flight",
+		Help:       "outgoing requests waiting for response",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, xprom.LabelCalleeService, xprom.LabelAPI},
+	})
+
+	_metricRPCClientFastFail = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "client_fast_fail_total",
+		Help:       "outgoing requests failed fast because callee has no available instances",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, xprom.LabelCalleeService},
+	})
+
+	_metricRPCClientStreams = xprom.NewGauge(&xprom.GaugeVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "client_streams",
+		Help:       "active outgoing grpc streams opened through client",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, xprom.LabelCalleeService, xprom.LabelAPI},
+	})
+
+	_metricRPCClientStreamHandled = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "client_stream_handled_total",
+		Help:       "outgoing grpc streams finished by code",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, xprom.LabelCalleeService, xprom.LabelAPI, labelCode},
+	})
+
+	_metricRPCClientStreamMsgs = xprom.NewCounter(&xprom.CounterVecOpts{
+		Namespace:  namespacePalfish,
+		Subsystem:  rpcType,
+		Name:       "client_stream_msgs_total",
+		Help:       "messages sent and received on outgoing grpc streams",
+		LabelNames: []string{xprom.LabelGroupName, xprom.LabelServiceName, labelProcessor, xprom.LabelCalleeService, xprom.LabelAPI, labelDirection},
+	})
+
 	_metricRPCConnectionPool = xprom.NewGauge(&xprom.GaugeVecOpts{
 		Namespace:  namespacePalfish,
 		Subsystem:  rpcType,
@@ -185,6 +768,11 @@ func collector(servkey string, processor string, duration time.Duration, source
 		xprom.LabelSource, sourceVal,
 		xprom.LabelType, processor,
 		labelStatus, statusVal).Inc()
+
+	GetDependencyDetector().Observe(servkey, duration, err != nil)
+	if err == nil {
+		getTimeoutInferrer().observe(servkey, funcName, duration)
+	}
 }
 
 func collectAPM(ctx context.Context, calleeService, calleeEndpoint string, servID int, duration time.Duration, requestErr error) {
@@ -200,7 +788,7 @@ func collectAPM(ctx context.Context, calleeService, calleeEndpoint string, servI
 	if jspan, ok := span.(*jaeger.Span); ok {
 		callerEndpoint = jspan.OperationName()
 	} else {
-		xlog.Debugf(ctx, "%s unsupported span %T %v", fun, span, span)
+		logger().Debugf(ctx, "%s unsupported span %T %v", fun, span, span)
 		return
 	}
 
@@ -0,0 +1,103 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// 配置中心 application namespace 中按路由跳过的中间件, json 格式, key 为注册的路由路径,
+	// value 为 UseNamed 注册的中间件名, 如 {"/upload": ["body_limit"], "/webhook/:id": ["auth"]}
+	middlewareBypassConfKey = "http_middleware_bypass"
+)
+
+type namedMiddleware struct {
+	name     string
+	handlers []gin.HandlerFunc
+}
+
+// UseNamed attachs a global middleware with name, which can be skipped per route by config
+// http_middleware_bypass; like Use, it only takes effect on routes registered after it.
+// Routes skipping it when registered never run it, routes including it check config
+// on each request, so it can be bypassed at runtime but restart is needed to enable it again
+func (s *HttpServer) UseNamed(name string, middleware ...HandlerFunc) {
+	s.checkUseOrder(name)
+	s.named = append(s.named, &namedMiddleware{name: name, handlers: mutilWrap(middleware...)})
+}
+
+// routeHandlers 路由注册时组合 pathHook, 未被跳过的命名中间件和路由处理函数
+func (s *HttpServer) routeHandlers(relativePath string, handlers ...HandlerFunc) []gin.HandlerFunc {
+	fun := "HttpServer.routeHandlers -->"
+
+	ws := []gin.HandlerFunc{pathHook(relativePath), rateLimitHandler(relativePath)}
+	for _, m := range s.named {
+		if defaultMiddlewareBypass.bypass(relativePath, m.name) {
+			logger().Infof(context.Background(), "%s route: %s skip middleware: %s", fun, relativePath, m.name)
+			continue
+		}
+		for _, h := range m.handlers {
+			ws = append(ws, bypassable(relativePath, m.name, h))
+		}
+	}
+	return append(ws, mutilWrap(handlers...)...)
+}
+
+// bypassable 运行时配置跳过时直接返回, gin 会继续执行后续 handler
+func bypassable(route, name string, h gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if defaultMiddlewareBypass.bypass(route, name) {
+			return
+		}
+		h(c)
+	}
+}
+
+type middlewareBypass struct {
+	mu     sync.Mutex
+	raw    string
+	routes map[string]map[string]bool
+}
+
+var defaultMiddlewareBypass = &middlewareBypass{}
+
+// bypass 配置未变化时使用上次解析的结果
+func (m *middlewareBypass) bypass(route, name string) bool {
+	fun := "middlewareBypass.bypass -->"
+
+	cc := GetConfigCenter()
+	if cc == nil {
+		return false
+	}
+	raw, ok := cc.GetString(context.TODO(), middlewareBypassConfKey)
+	if !ok || len(raw) == 0 {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if raw != m.raw {
+		m.raw, m.routes = raw, parseMiddlewareBypass(raw)
+		if m.routes == nil {
+			logger().Errorf(context.Background(), "%s unmarshal %s: %s err", fun, middlewareBypassConfKey, raw)
+		}
+	}
+	return m.routes[route][name]
+}
+
+func parseMiddlewareBypass(raw string) map[string]map[string]bool {
+	var conf map[string][]string
+	if err := json.Unmarshal([]byte(raw), &conf); err != nil {
+		return nil
+	}
+	routes := make(map[string]map[string]bool, len(conf))
+	for route, names := range conf {
+		routes[route] = make(map[string]bool, len(names))
+		for _, name := range names {
+			routes[route][name] = true
+		}
+	}
+	return routes
+}
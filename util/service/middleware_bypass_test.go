@@ -0,0 +1,38 @@
+package rocserv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMiddlewareBypass(t *testing.T) {
+	ass := assert.New(t)
+
+	routes := parseMiddlewareBypass(`{"/upload": ["body_limit"], "/webhook/:id": ["auth", "body_limit"]}`)
+	ass.True(routes["/upload"]["body_limit"])
+	ass.False(routes["/upload"]["auth"])
+	ass.True(routes["/webhook/:id"]["auth"])
+	ass.False(routes["/other"]["auth"])
+
+	ass.Nil(parseMiddlewareBypass(`["auth"]`))
+}
+
+func TestHttpServerUseNamed(t *testing.T) {
+	ass := assert.New(t)
+
+	s := &HttpServer{Engine: gin.New(), fallbacks: &routeFallbacks{}}
+	s.UseNamed("auth", func(c *Context) {
+		c.AbortWithStatus(http.StatusUnauthorized)
+	})
+	s.GET("/private", func(c *Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/private", nil))
+	ass.Equal(http.StatusUnauthorized, w.Code)
+}
@@ -0,0 +1,198 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CallInfo describes the call passed to Middleware
+type CallInfo struct {
+	// Type is PROCESSOR_HTTP, PROCESSOR_GRPC or PROCESSOR_THRIFT
+	Type string
+	// Method is url path for http, method name for grpc, message name for thrift
+	Method string
+	// Req is *http.Request for http, request message for grpc unary call, nil for grpc stream and thrift
+	Req interface{}
+}
+
+// Middleware is cross-cutting logic installed to all http, grpc and thrift processors by Use.
+// Call next to continue, the ctx passed to next is used by http and grpc handlers;
+// returning without calling next rejects the call, a grpc status error is converted to http status
+type Middleware func(ctx context.Context, info *CallInfo, next func(ctx context.Context) error) error
+
+var globalMiddlewares struct {
+	mu   sync.Mutex
+	list []Middleware
+}
+
+// Use install middlewares to all processors, the first one is the outermost
+func Use(mws ...Middleware) {
+	globalMiddlewares.mu.Lock()
+	defer globalMiddlewares.mu.Unlock()
+	globalMiddlewares.list = append(globalMiddlewares.list, mws...)
+}
+
+func middlewareChain() []Middleware {
+	globalMiddlewares.mu.Lock()
+	defer globalMiddlewares.mu.Unlock()
+	return globalMiddlewares.list
+}
+
+// runMiddlewares 依次执行 middleware, 最后执行 handler, 返回 handler 是否被执行
+func runMiddlewares(ctx context.Context, info *CallInfo, mws []Middleware, handler func(ctx context.Context) error) (bool, error) {
+	var called bool
+	var next func(i int) func(ctx context.Context) error
+	next = func(i int) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			if i == len(mws) {
+				called = true
+				return handler(ctx)
+			}
+			return mws[i](ctx, info, next(i+1))
+		}
+	}
+	err := next(0)(ctx)
+	return called, err
+}
+
+var errRejectedByMiddleware = status.Error(codes.PermissionDenied, "rejected by middleware")
+
+func httpStatusFromError(err error) int {
+	s, _ := status.FromError(err)
+	switch s.Code() {
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// chainHttpMiddleware gin, HttpServer 及 httprouter 都通过 decorateHttpMiddleware 安装
+func chainHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mws := middlewareChain()
+		if len(mws) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		info := &CallInfo{Type: PROCESSOR_HTTP, Method: r.URL.Path, Req: r}
+		called, err := runMiddlewares(r.Context(), info, mws, func(ctx context.Context) error {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return nil
+		})
+		if !called {
+			if err == nil {
+				err = errRejectedByMiddleware
+			}
+			s, _ := status.FromError(err)
+			http.Error(w, s.Message(), httpStatusFromError(err))
+		}
+	})
+}
+
+func chainUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		mws := middlewareChain()
+		if len(mws) == 0 {
+			return handler(ctx, req)
+		}
+
+		var resp interface{}
+		ci := &CallInfo{Type: PROCESSOR_GRPC, Method: grpcMethodName(info.FullMethod), Req: req}
+		called, err := runMiddlewares(ctx, ci, mws, func(ctx context.Context) error {
+			var herr error
+			resp, herr = handler(ctx, req)
+			return herr
+		})
+		if !called && err == nil {
+			err = errRejectedByMiddleware
+		}
+		return resp, err
+	}
+}
+
+type ctxServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (m *ctxServerStream) Context() context.Context {
+	return m.ctx
+}
+
+func chainStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		mws := middlewareChain()
+		if len(mws) == 0 {
+			return handler(srv, ss)
+		}
+
+		ci := &CallInfo{Type: PROCESSOR_GRPC, Method: grpcMethodName(info.FullMethod)}
+		called, err := runMiddlewares(ss.Context(), ci, mws, func(ctx context.Context) error {
+			return handler(srv, &ctxServerStream{ServerStream: ss, ctx: ctx})
+		})
+		if !called && err == nil {
+			err = errRejectedByMiddleware
+		}
+		return err
+	}
+}
+
+// chainProcessor thrift 的 handler 没有 ctx, middleware 传给 next 的 ctx 不会传递到 handler
+type chainProcessor struct {
+	thrift.TProcessor
+}
+
+func (m *chainProcessor) Process(in, out thrift.TProtocol) (bool, thrift.TException) {
+	mws := middlewareChain()
+	if len(mws) == 0 {
+		return m.TProcessor.Process(in, out)
+	}
+
+	name, typeId, seqid, err := in.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+
+	var ok bool
+	var terr thrift.TException
+	info := &CallInfo{Type: PROCESSOR_THRIFT, Method: name}
+	called, err := runMiddlewares(context.Background(), info, mws, func(ctx context.Context) error {
+		ok, terr = m.TProcessor.Process(&messageBeginProtocol{TProtocol: in, name: name, typeId: typeId, seqid: seqid}, out)
+		if terr != nil {
+			return terr
+		}
+		return nil
+	})
+	if !called {
+		if err == nil {
+			err = errRejectedByMiddleware
+		}
+		s, _ := status.FromError(err)
+		return rejectThriftMessage(in, out, name, seqid, s.Message())
+	}
+	return ok, terr
+}
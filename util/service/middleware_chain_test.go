@@ -0,0 +1,54 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type middlewareKey struct{}
+
+func TestMiddlewareChain(t *testing.T) {
+	ass := assert.New(t)
+	defer func() { globalMiddlewares.list = nil }()
+
+	var order []string
+	Use(func(ctx context.Context, info *CallInfo, next func(ctx context.Context) error) error {
+		order = append(order, "outer:"+info.Type)
+		return next(context.WithValue(ctx, middlewareKey{}, "v"))
+	}, func(ctx context.Context, info *CallInfo, next func(ctx context.Context) error) error {
+		order = append(order, "auth:"+info.Method)
+		if info.Method == "/deny" || info.Method == "Deny" {
+			return status.Error(codes.Unauthenticated, "no token")
+		}
+		return next(ctx)
+	})
+
+	h := chainHttpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Context().Value(middlewareKey{}).(string)))
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/allow", nil))
+	ass.Equal("v", w.Body.String())
+	ass.Equal([]string{"outer:http", "auth:/allow"}, order)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/deny", nil))
+	ass.Equal(http.StatusUnauthorized, w.Code)
+
+	unary := chainUnaryServerInterceptor()
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return ctx.Value(middlewareKey{}), nil
+	}
+	resp, err := unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Serv/Allow"}, handler)
+	ass.Nil(err)
+	ass.Equal("v", resp)
+	_, err = unary(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Serv/Deny"}, handler)
+	ass.Equal(codes.Unauthenticated, status.Code(err))
+}
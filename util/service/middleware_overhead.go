@@ -0,0 +1,194 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+	"google.golang.org/grpc"
+)
+
+const (
+	// 框架中间件自身耗时之和(us)的预算, 超过时计数 middleware_over_budget_count, 0 表示不检查
+	middlewareBudgetKey = "middleware_overhead_budget_us"
+	// 关闭每层中间件的耗时统计
+	middlewareMetricsDisableKey = "middleware_metrics_disable"
+
+	// 超出预算的日志最多每分钟一条
+	middlewareBudgetLogInterval = int64(time.Minute)
+)
+
+// middlewareChainInfo 中间件的层及版本, 版本为层名称的 hash, 框架升级增减中间件后版本随之变化
+type middlewareChainInfo struct {
+	processor string
+	layers    []string
+	version   string
+}
+
+func newMiddlewareChainInfo(processor string, layers []string) *middlewareChainInfo {
+	h := fnv.New32a()
+	h.Write([]byte(strings.Join(layers, ",")))
+	info := &middlewareChainInfo{
+		processor: processor,
+		layers:    layers,
+		version:   fmt.Sprintf("%08x", h.Sum32()),
+	}
+	group, service := GetGroupAndService()
+	_metricMiddlewareChainLayers.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, processor, labelChainVersion, info.version).Set(float64(len(layers)))
+	return info
+}
+
+type middlewareTimerKey struct{}
+
+// middlewareTimer 记录请求进入及离开每一层的时间, 下标 len(layers) 为 handler;
+// 层的自身耗时为进入下一层之前及下一层返回之后的时间
+type middlewareTimer struct {
+	chain *middlewareChainInfo
+	enter []time.Time
+	exit  []time.Time
+}
+
+func newMiddlewareTimer(chain *middlewareChainInfo) *middlewareTimer {
+	return &middlewareTimer{
+		chain: chain,
+		enter: make([]time.Time, len(chain.layers)+1),
+		exit:  make([]time.Time, len(chain.layers)+1),
+	}
+}
+
+func middlewareTimerFrom(ctx context.Context) *middlewareTimer {
+	t, _ := ctx.Value(middlewareTimerKey{}).(*middlewareTimer)
+	return t
+}
+
+// selfDurations 未进入的层为 0; 中止请求的层, 自身耗时为该层的全部耗时
+func (m *middlewareTimer) selfDurations() []time.Duration {
+	res := make([]time.Duration, len(m.chain.layers))
+	for i := range m.chain.layers {
+		if m.enter[i].IsZero() || m.exit[i].IsZero() {
+			continue
+		}
+		if m.enter[i+1].IsZero() || m.exit[i+1].IsZero() {
+			res[i] = m.exit[i].Sub(m.enter[i])
+			continue
+		}
+		res[i] = m.enter[i+1].Sub(m.enter[i]) + m.exit[i].Sub(m.exit[i+1])
+	}
+	return res
+}
+
+var middlewareBudgetLogged int64
+
+func (m *middlewareTimer) observe(ctx context.Context) {
+	fun := "middlewareTimer.observe -->"
+	var budget time.Duration
+	if cc := GetConfigCenter(); cc != nil {
+		if disable, _ := cc.GetBool(ctx, middlewareMetricsDisableKey); disable {
+			return
+		}
+		if n, ok := cc.GetInt(ctx, middlewareBudgetKey); ok && n > 0 {
+			budget = time.Duration(n) * time.Microsecond
+		}
+	}
+
+	group, service := GetGroupAndService()
+	chain := m.chain
+	var total time.Duration
+	for i, d := range m.selfDurations() {
+		if m.enter[i].IsZero() {
+			continue
+		}
+		total += d
+		_metricMiddlewareDuration.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, chain.processor, labelChainVersion, chain.version, labelLayer, chain.layers[i]).Observe(float64(d) / float64(time.Microsecond))
+	}
+	_metricMiddlewareOverhead.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, chain.processor, labelChainVersion, chain.version).Observe(float64(total) / float64(time.Microsecond))
+
+	if budget > 0 && total > budget {
+		_metricMiddlewareOverBudget.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, chain.processor, labelChainVersion, chain.version).Inc()
+		now := time.Now().UnixNano()
+		last := atomic.LoadInt64(&middlewareBudgetLogged)
+		if now-last >= middlewareBudgetLogInterval && atomic.CompareAndSwapInt64(&middlewareBudgetLogged, last, now) {
+			logger().Warnf(ctx, "%s processor: %s chain: %s overhead: %v over budget: %v, layers: %v", fun, chain.processor, chain.version, total, budget, m.selfDurations())
+		}
+	}
+}
+
+type httpLayer struct {
+	name string
+	mw   middleware
+}
+
+// timedHttpLayers 在每一层之前插入计时, 第一个计时创建 timer 并在请求结束后统计
+func timedHttpLayers(layers []httpLayer, handler http.Handler) http.Handler {
+	names := make([]string, 0, len(layers))
+	for _, l := range layers {
+		names = append(names, l.name)
+	}
+	chain := newMiddlewareChainInfo(PROCESSOR_HTTP, names)
+
+	h := httpLayerProbe(chain, len(layers), handler)
+	for i := len(layers) - 1; i >= 0; i-- {
+		h = httpLayerProbe(chain, i, layers[i].mw(h))
+	}
+	return h
+}
+
+func httpLayerProbe(chain *middlewareChainInfo, i int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var t *middlewareTimer
+		if i == 0 {
+			t = newMiddlewareTimer(chain)
+			r = r.WithContext(context.WithValue(r.Context(), middlewareTimerKey{}, t))
+			defer t.observe(r.Context())
+		} else if t = middlewareTimerFrom(r.Context()); t == nil || t.chain != chain {
+			// 中间件替换了 ctx 时不再统计
+			next.ServeHTTP(w, r)
+			return
+		}
+		t.enter[i] = time.Now()
+		next.ServeHTTP(w, r)
+		t.exit[i] = time.Now()
+	})
+}
+
+type grpcLayer struct {
+	name        string
+	interceptor grpc.UnaryServerInterceptor
+}
+
+// timedUnaryInterceptors 返回插入计时后的拦截器, 最后一个计时作用于 handler
+func timedUnaryInterceptors(layers []grpcLayer) []grpc.UnaryServerInterceptor {
+	names := make([]string, 0, len(layers))
+	for _, l := range layers {
+		names = append(names, l.name)
+	}
+	chain := newMiddlewareChainInfo(PROCESSOR_GRPC, names)
+
+	res := make([]grpc.UnaryServerInterceptor, 0, 2*len(layers)+1)
+	for i, l := range layers {
+		res = append(res, grpcLayerProbe(chain, i), l.interceptor)
+	}
+	return append(res, grpcLayerProbe(chain, len(layers)))
+}
+
+func grpcLayerProbe(chain *middlewareChainInfo, i int) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var t *middlewareTimer
+		if i == 0 {
+			t = newMiddlewareTimer(chain)
+			ctx = context.WithValue(ctx, middlewareTimerKey{}, t)
+			defer t.observe(ctx)
+		} else if t = middlewareTimerFrom(ctx); t == nil || t.chain != chain {
+			return handler(ctx, req)
+		}
+		t.enter[i] = time.Now()
+		resp, err := handler(ctx, req)
+		t.exit[i] = time.Now()
+		return resp, err
+	}
+}
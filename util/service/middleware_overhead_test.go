@@ -0,0 +1,99 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func sleepHttpLayer(d time.Duration) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(d)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestMiddlewareTimer(t *testing.T) {
+	ass := assert.New(t)
+
+	chain := newMiddlewareChainInfo(PROCESSOR_HTTP, []string{"a", "b"})
+	ass.Len(chain.version, 8)
+	ass.NotEqual(chain.version, newMiddlewareChainInfo(PROCESSOR_HTTP, []string{"a", "b", "c"}).version)
+
+	base := time.Now()
+	at := func(ms int) time.Time { return base.Add(time.Duration(ms) * time.Millisecond) }
+	tm := newMiddlewareTimer(chain)
+	// a: 0-1 进入 b, 9-10 离开; b: 1-3 进入 handler, 8-9 离开
+	tm.enter[0], tm.enter[1], tm.enter[2] = at(0), at(1), at(3)
+	tm.exit[2], tm.exit[1], tm.exit[0] = at(8), at(9), at(10)
+	ass.Equal([]time.Duration{2 * time.Millisecond, 3 * time.Millisecond}, tm.selfDurations())
+
+	// b 中止请求
+	tm = newMiddlewareTimer(chain)
+	tm.enter[0], tm.enter[1] = at(0), at(1)
+	tm.exit[1], tm.exit[0] = at(4), at(5)
+	ass.Equal([]time.Duration{2 * time.Millisecond, 3 * time.Millisecond}, tm.selfDurations())
+}
+
+func TestTimedHttpLayers(t *testing.T) {
+	ass := assert.New(t)
+
+	var got *middlewareTimer
+	capture := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = middlewareTimerFrom(r.Context())
+			next.ServeHTTP(w, r)
+		})
+	}
+	h := timedHttpLayers([]httpLayer{{"capture", capture}, {"slow", sleepHttpLayer(20 * time.Millisecond)}}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	ass.NotNil(got)
+	self := got.selfDurations()
+	ass.True(self[1] >= 20*time.Millisecond)
+	ass.True(self[0] < 20*time.Millisecond)
+}
+
+func TestTimedUnaryInterceptors(t *testing.T) {
+	ass := assert.New(t)
+
+	var got *middlewareTimer
+	slow := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		got = middlewareTimerFrom(ctx)
+		time.Sleep(20 * time.Millisecond)
+		return handler(ctx, req)
+	}
+	reject := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return nil, errRejectedByMiddleware
+	}
+	interceptors := timedUnaryInterceptors([]grpcLayer{{"slow", slow}, {"reject", reject}})
+	ass.Len(interceptors, 5)
+
+	// 按 ChainUnaryServer 的方式依次调用
+	var call func(i int, ctx context.Context, req interface{}) (interface{}, error)
+	call = func(i int, ctx context.Context, req interface{}) (interface{}, error) {
+		if i == len(interceptors) {
+			return "resp", nil
+		}
+		return interceptors[i](ctx, req, &grpc.UnaryServerInfo{FullMethod: "/a.B/C"}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(i+1, ctx, req)
+		})
+	}
+	_, err := call(0, context.Background(), nil)
+	ass.Equal(errRejectedByMiddleware, err)
+
+	ass.NotNil(got)
+	self := got.selfDurations()
+	ass.True(self[0] >= 20*time.Millisecond)
+	// handler 未执行
+	ass.True(got.enter[2].IsZero())
+}
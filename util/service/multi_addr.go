@@ -0,0 +1,193 @@
+package rocserv
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	"google.golang.org/grpc"
+)
+
+// ListenAddr an additional address the driver of a processor serves on
+type ListenAddr struct {
+	// Name 注册名为 processor 名 + "_" + Name
+	Name string
+	Addr string
+	// HttpMiddlewares only apply to requests received on this address, e.g. auth for the external address
+	HttpMiddlewares []func(http.Handler) http.Handler
+	// UnaryInterceptors only apply to grpc requests received on this address
+	UnaryInterceptors []grpc.UnaryServerInterceptor
+	// TLS 非空时该地址开启 TLS, 与 processor 的 TLSConf 无关
+	TLS *TLSConf
+	// Class 非空时客户端按所在位置选用该地址代替 processor 的主地址, 见 AddrClassCrossRegion
+	Class string
+}
+
+const (
+	// AddrClassCrossRegion address used by clients in other regions, e.g. the cross-DC NIC
+	AddrClassCrossRegion = "cross_region"
+	// AddrClassCrossZone address used by clients in other zones of the same region
+	AddrClassCrossZone = "cross_zone"
+)
+
+// MultiAddrProcessor processor serving the same driver on several addresses, each address is registered separately,
+// thrift driver is served on all addresses but per address middlewares are not supported
+type MultiAddrProcessor interface {
+	Processor
+	ListenAddrs() []ListenAddr
+}
+
+func listenAddrsOf(p Processor) []ListenAddr {
+	if lazy, ok := p.(*lazyProcessor); ok {
+		p = lazy.Processor
+	}
+	if mp, ok := p.(MultiAddrProcessor); ok {
+		return mp.ListenAddrs()
+	}
+	return nil
+}
+
+func listenAddrName(n, name string) string {
+	return n + "_" + name
+}
+
+// addrClassFor 调用方访问实例应使用的地址类别, 同可用区或位置未知时为空, 使用主地址
+func addrClassFor(reg *RegData, region, zone string) string {
+	if len(reg.Region) > 0 && len(region) > 0 && reg.Region != region {
+		return AddrClassCrossRegion
+	}
+	if len(reg.Zone) > 0 && len(zone) > 0 && reg.Zone != zone {
+		return AddrClassCrossZone
+	}
+	return ""
+}
+
+// localityRegData 用实例为调用方位置注册的地址替换 processor 的主地址, 没有对应类别的地址时返回 reg 本身
+func localityRegData(reg *RegData, region, zone string) *RegData {
+	class := addrClassFor(reg, region, zone)
+	if len(class) == 0 {
+		return reg
+	}
+
+	var servs map[string]*ServInfo
+	for _, s := range reg.Servs {
+		if s == nil || s.Class != class || len(s.Of) == 0 {
+			continue
+		}
+		if _, ok := reg.Servs[s.Of]; !ok {
+			continue
+		}
+		if servs == nil {
+			servs = make(map[string]*ServInfo, len(reg.Servs))
+			for n, v := range reg.Servs {
+				servs[n] = v
+			}
+		}
+		info := *s
+		servs[s.Of] = &info
+	}
+	if servs == nil {
+		return reg
+	}
+	r := *reg
+	r.Servs = servs
+	return &r
+}
+
+// localitySelect 按调用方位置选取各实例的地址, 不修改 scopy
+func localitySelect(scopy servCopyCollect, region, zone string) servCopyCollect {
+	var res servCopyCollect
+	for sid, c := range scopy {
+		if c == nil || c.reg == nil {
+			continue
+		}
+		reg := localityRegData(c.reg, region, zone)
+		if reg == c.reg {
+			continue
+		}
+		if res == nil {
+			res = make(servCopyCollect, len(scopy))
+			for k, v := range scopy {
+				res[k] = v
+			}
+		}
+		cp := *c
+		cp.reg = reg
+		res[sid] = &cp
+	}
+	if res == nil {
+		return scopy
+	}
+	return res
+}
+
+// clientLocality 调用方所在地区及可用区, 与注册的一致
+func clientLocality() (region, zone string) {
+	if server.sbase != nil {
+		region = server.sbase.Region()
+	}
+	if len(region) == 0 {
+		region = getRegionFromEnvOrDefault()
+	}
+	return region, getZoneFromEnv()
+}
+
+// combineStoppers 依次停止, 返回第一个错误
+func combineStoppers(stops []processorStopper) processorStopper {
+	return func(ctx context.Context) error {
+		var first error
+		for _, stop := range stops {
+			if err := stop(ctx); err != nil && first == nil {
+				first = err
+			}
+		}
+		return first
+	}
+}
+
+type localAddrKey struct{}
+
+// listenKey 监听未指定 ip 时只按端口匹配
+func listenKey(addr net.Addr) string {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		return ":" + port
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (g *GrpcServer) addListenInterceptors(addr net.Addr, interceptors []grpc.UnaryServerInterceptor) {
+	g.listenInterceptors.Store(listenKey(addr), grpc_middleware.ChainUnaryServer(interceptors...))
+}
+
+func (g *GrpcServer) interceptorOf(ctx context.Context) grpc.UnaryServerInterceptor {
+	addr, ok := ctx.Value(localAddrKey{}).(net.Addr)
+	if !ok {
+		return nil
+	}
+	if v, ok := g.listenInterceptors.Load(addr.String()); ok {
+		return v.(grpc.UnaryServerInterceptor)
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	if v, ok := g.listenInterceptors.Load(":" + port); ok {
+		return v.(grpc.UnaryServerInterceptor)
+	}
+	return nil
+}
+
+func (g *GrpcServer) listenAddrInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		interceptor := g.interceptorOf(ctx)
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		return interceptor(ctx, req, info, handler)
+	}
+}
@@ -0,0 +1,97 @@
+package rocserv
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type multiAddrProcessor struct {
+	countProcessor
+}
+
+func (m *multiAddrProcessor) ListenAddrs() []ListenAddr {
+	return []ListenAddr{{Name: "external", Addr: ":0"}}
+}
+
+func TestListenAddrsOf(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.Nil(listenAddrsOf(&countProcessor{}))
+	ass.Len(listenAddrsOf(&multiAddrProcessor{}), 1)
+	ass.Len(listenAddrsOf(Lazy(&multiAddrProcessor{})), 1)
+	ass.Equal("proc_external", listenAddrName("proc", "external"))
+}
+
+func TestListenAddrInterceptor(t *testing.T) {
+	ass := assert.New(t)
+
+	g := &GrpcServer{}
+	auth := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return nil, status.Error(codes.Unauthenticated, "no token")
+	}
+	g.addListenInterceptors(&net.TCPAddr{IP: net.IPv6zero, Port: 9001}, []grpc.UnaryServerInterceptor{auth})
+	g.addListenInterceptors(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9002}, []grpc.UnaryServerInterceptor{auth})
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+	call := func(local net.Addr) error {
+		ctx := context.Background()
+		if local != nil {
+			ctx = context.WithValue(ctx, localAddrKey{}, local)
+		}
+		_, err := g.listenAddrInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/pkg.Serv/Get"}, handler)
+		return err
+	}
+
+	ass.Nil(call(nil))
+	ass.Nil(call(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9000}))
+	ass.Equal(codes.Unauthenticated, status.Code(call(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9001})))
+	ass.Equal(codes.Unauthenticated, status.Code(call(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9002})))
+}
+
+func TestLocalityRegData(t *testing.T) {
+	ass := assert.New(t)
+
+	reg := &RegData{
+		Region: "cn",
+		Zone:   "z1",
+		Servs: map[string]*ServInfo{
+			"proc":         {Type: PROCESSOR_GRPC, Addr: "10.0.0.1:9000"},
+			"proc_crossdc": {Type: PROCESSOR_GRPC, Addr: "172.16.0.1:9001", Class: AddrClassCrossRegion, Of: "proc"},
+			"proc_other":   {Type: PROCESSOR_GRPC, Addr: "10.0.0.1:9002", Class: AddrClassCrossZone, Of: "missing"},
+		},
+	}
+
+	ass.Equal("", addrClassFor(reg, "cn", "z1"))
+	ass.Equal("", addrClassFor(reg, "cn", ""))
+	ass.Equal(AddrClassCrossZone, addrClassFor(reg, "cn", "z2"))
+	ass.Equal(AddrClassCrossRegion, addrClassFor(reg, "us", "z1"))
+	ass.Equal("", addrClassFor(&RegData{}, "us", "z2"))
+
+	// 同地区或没有对应类别的地址时使用主地址
+	ass.True(reg == localityRegData(reg, "cn", "z1"))
+	ass.True(reg == localityRegData(reg, "cn", "z2"))
+
+	r := localityRegData(reg, "us", "")
+	ass.Equal("172.16.0.1:9001", r.Servs["proc"].Addr)
+	ass.Equal("172.16.0.1:9001", r.Servs["proc_crossdc"].Addr)
+	ass.Equal("10.0.0.1:9000", reg.Servs["proc"].Addr)
+
+	scopy := servCopyCollect{
+		1: {servId: 1, reg: reg},
+		2: {servId: 2, reg: &RegData{Region: "us", Servs: map[string]*ServInfo{"proc": {Addr: "10.1.0.1:9000"}}}},
+	}
+	res := localitySelect(scopy, "us", "")
+	ass.Equal("172.16.0.1:9001", res[1].reg.Servs["proc"].Addr)
+	ass.Equal("10.1.0.1:9000", res[2].reg.Servs["proc"].Addr)
+	ass.True(scopy[2] == res[2])
+	ass.Equal("10.0.0.1:9000", scopy[1].reg.Servs["proc"].Addr)
+	ass.Equal(1, res[1].servId)
+}
@@ -0,0 +1,553 @@
+package rocserv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtrace"
+
+	"github.com/uber/jaeger-client-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// 传播格式
+const (
+	PropagatorTraceContext = "tracecontext"
+	PropagatorB3           = "b3"
+	// PropagatorB3Multi b3 in x-b3-* headers, accepted the same as b3
+	PropagatorB3Multi = "b3multi"
+	// PropagatorJaeger uber-trace-id, always sent since jaeger is the tracer of roc
+	PropagatorJaeger = "jaeger"
+)
+
+const (
+	// 未通过 WithOpenTelemetry 配置时从标准环境变量读取
+	otelEndpointEnv = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	otelHeadersEnv  = "OTEL_EXPORTER_OTLP_HEADERS"
+
+	otelTracesPath           = "/v1/traces"
+	otelDefaultBatchSize     = 512
+	otelDefaultQueueSize     = 4096
+	otelDefaultFlushInterval = 5 * time.Second
+	otelDefaultTimeout       = 10 * time.Second
+
+	traceparentHeader = "traceparent"
+	b3Header          = "b3"
+	b3TraceIDHeader   = "x-b3-traceid"
+	b3SpanIDHeader    = "x-b3-spanid"
+	b3SampledHeader   = "x-b3-sampled"
+	b3FlagsHeader     = "x-b3-flags"
+
+	// otlp span kind
+	otelSpanKindServer = 2
+	otelSpanKindClient = 3
+	// otlp status code
+	otelStatusError = 2
+)
+
+// OTelConf OpenTelemetry support, spans of the existing tracer are exported by OTLP/HTTP json
+// with the same trace and span ids, so traces continue across services using either tracer
+type OTelConf struct {
+	// Endpoint OTLP/HTTP endpoint such as http://otel-collector:4318, spans are posted to {Endpoint}/v1/traces
+	Endpoint string
+	Headers  map[string]string
+	// Propagators formats accepted from and sent to other services, see SetTracePropagators;
+	// default is env OTEL_PROPAGATORS or tracecontext and b3
+	Propagators   []string
+	BatchSize     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+}
+
+// otelConfFromEnv 未设置 endpoint 时返回 nil
+func otelConfFromEnv() *OTelConf {
+	endpoint := os.Getenv(otelEndpointEnv)
+	if len(endpoint) == 0 {
+		return nil
+	}
+	conf := &OTelConf{Endpoint: endpoint, Headers: make(map[string]string)}
+	for _, kv := range strings.Split(os.Getenv(otelHeadersEnv), ",") {
+		if i := strings.Index(kv, "="); i > 0 {
+			conf.Headers[strings.TrimSpace(kv[:i])] = strings.TrimSpace(kv[i+1:])
+		}
+	}
+	return conf
+}
+
+type otelTracer struct {
+	exporter *otlpExporter
+}
+
+var (
+	muOTel     sync.RWMutex
+	globalOTel *otelTracer
+)
+
+func getOTel() *otelTracer {
+	muOTel.RLock()
+	defer muOTel.RUnlock()
+	return globalOTel
+}
+
+// initOpenTelemetry conf 为空时读取环境变量, 都未配置时不开启
+func initOpenTelemetry(servLoc string, conf *OTelConf) {
+	fun := "initOpenTelemetry -->"
+	if conf == nil {
+		conf = otelConfFromEnv()
+	}
+	initTracePropagation(conf)
+	if conf == nil || len(conf.Endpoint) == 0 {
+		return
+	}
+	t := newOTelTracer(servLoc, conf)
+	go t.exporter.run()
+
+	muOTel.Lock()
+	globalOTel = t
+	muOTel.Unlock()
+	logger().Infof(context.Background(), "%s endpoint: %s propagators: %v", fun, conf.Endpoint, conf.Propagators)
+}
+
+func newOTelTracer(servLoc string, conf *OTelConf) *otelTracer {
+	return &otelTracer{exporter: newOTLPExporter(servLoc, conf)}
+}
+
+// remoteTrace 从 W3C 或 B3 头中解析出的调用方 span
+type remoteTrace struct {
+	traceID string
+	spanID  string
+	sampled bool
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return strings.Trim(s, "0") != ""
+}
+
+// parseTraceparent version-traceid-parentid-flags, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(v string) (*remoteTrace, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return nil, false
+	}
+	if !isHex(parts[1], 32) || !isHex(parts[2], 16) || len(parts[3]) != 2 {
+		return nil, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return nil, false
+	}
+	return &remoteTrace{traceID: parts[1], spanID: parts[2], sampled: flags&1 == 1}, true
+}
+
+// parseB3 支持单头 b3: traceid-spanid-sampled-parentid 及 x-b3-* 多头, 64 位 trace id 左侧补 0
+func parseB3(get func(key string) string) (*remoteTrace, bool) {
+	var traceID, spanID, sampled string
+	if v := get(b3Header); len(v) > 0 {
+		parts := strings.Split(strings.TrimSpace(v), "-")
+		if len(parts) < 2 {
+			return nil, false
+		}
+		traceID, spanID = parts[0], parts[1]
+		if len(parts) > 2 {
+			sampled = parts[2]
+		}
+	} else {
+		traceID, spanID, sampled = get(b3TraceIDHeader), get(b3SpanIDHeader), get(b3SampledHeader)
+		if get(b3FlagsHeader) == "1" {
+			sampled = "d"
+		}
+	}
+	traceID, spanID = strings.ToLower(traceID), strings.ToLower(spanID)
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	if !isHex(traceID, 32) || !isHex(spanID, 16) {
+		return nil, false
+	}
+	return &remoteTrace{traceID: traceID, spanID: spanID, sampled: sampled == "1" || sampled == "d" || sampled == "true"}, true
+}
+
+// jaegerHeader 转为 jaeger 的 uber-trace-id, 由现有 tracer 继续该 trace
+func (m *remoteTrace) jaegerHeader() string {
+	flags := 0
+	if m.sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("%s:%s:0:%d", m.traceID, m.spanID, flags)
+}
+
+func otelTraceID(id jaeger.TraceID) string {
+	return fmt.Sprintf("%016x%016x", id.High, id.Low)
+}
+
+func otelSpanID(id jaeger.SpanID) string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// InjectTraceHeaders set uber-trace-id and headers in formats configured by SetTracePropagators of current span,
+// used by http clients of app
+func InjectTraceHeaders(ctx context.Context, header http.Header) {
+	span, ok := xtrace.SpanFromContext(ctx).(*jaeger.Span)
+	if !ok {
+		return
+	}
+	header.Set(jaeger.TraceContextHeaderName, span.SpanContext().String())
+	getTracePropagation().inject(span.SpanContext(), header.Set)
+}
+
+// record 导出 jaeger span, span 在 handler 返回后才结束, 结束时间取当前时间
+func (m *otelTracer) record(ctx context.Context, kind int, failed bool, attrs map[string]interface{}) {
+	span, ok := xtrace.SpanFromContext(ctx).(*jaeger.Span)
+	if !ok {
+		return
+	}
+	sc := span.SpanContext()
+	if !sc.IsSampled() {
+		return
+	}
+	s := &otlpSpan{
+		TraceID:           otelTraceID(sc.TraceID()),
+		SpanID:            otelSpanID(sc.SpanID()),
+		Name:              span.OperationName(),
+		Kind:              kind,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime().UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+	if sc.ParentID() != 0 {
+		s.ParentSpanID = otelSpanID(sc.ParentID())
+	}
+	for k, v := range span.Tags() {
+		s.Attributes = append(s.Attributes, otlpAttribute(k, v))
+	}
+	for k, v := range attrs {
+		s.Attributes = append(s.Attributes, otlpAttribute(k, v))
+	}
+	if failed {
+		s.Status.Code = otelStatusError
+	}
+	m.exporter.add(s)
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttribute(key string, v interface{}) otlpKeyValue {
+	kv := otlpKeyValue{Key: key}
+	switch t := v.(type) {
+	case string:
+		kv.Value.StringValue = &t
+	case bool:
+		kv.Value.BoolValue = &t
+	case int, int32, int64, uint16, uint32, uint64:
+		s := fmt.Sprint(t)
+		kv.Value.IntValue = &s
+	case float32:
+		f := float64(t)
+		kv.Value.DoubleValue = &f
+	case float64:
+		kv.Value.DoubleValue = &t
+	default:
+		s := fmt.Sprint(t)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code int `json:"code,omitempty"`
+	} `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []*otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlpExporter 异步批量导出, 队列满时丢弃
+type otlpExporter struct {
+	url       string
+	headers   map[string]string
+	resource  []otlpKeyValue
+	client    *http.Client
+	batchSize int
+	interval  time.Duration
+	queue     chan *otlpSpan
+	dropped   int64
+}
+
+func newOTLPExporter(servLoc string, conf *OTelConf) *otlpExporter {
+	m := &otlpExporter{
+		url:       strings.TrimRight(conf.Endpoint, "/") + otelTracesPath,
+		headers:   conf.Headers,
+		resource:  []otlpKeyValue{otlpAttribute("service.name", servLoc)},
+		client:    &http.Client{Timeout: conf.Timeout},
+		batchSize: conf.BatchSize,
+		interval:  conf.FlushInterval,
+		queue:     make(chan *otlpSpan, otelDefaultQueueSize),
+	}
+	if host, err := os.Hostname(); err == nil {
+		m.resource = append(m.resource, otlpAttribute("host.name", host))
+	}
+	if m.client.Timeout <= 0 {
+		m.client.Timeout = otelDefaultTimeout
+	}
+	if m.batchSize <= 0 {
+		m.batchSize = otelDefaultBatchSize
+	}
+	if m.interval <= 0 {
+		m.interval = otelDefaultFlushInterval
+	}
+	return m
+}
+
+func (m *otlpExporter) add(s *otlpSpan) {
+	select {
+	case m.queue <- s:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+	}
+}
+
+func (m *otlpExporter) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	batch := make([]*otlpSpan, 0, m.batchSize)
+	for {
+		select {
+		case s := <-m.queue:
+			batch = append(batch, s)
+			if len(batch) < m.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if len(batch) > 0 {
+			m.export(batch)
+			batch = make([]*otlpSpan, 0, m.batchSize)
+		}
+	}
+}
+
+func (m *otlpExporter) export(spans []*otlpSpan) error {
+	fun := "otlpExporter.export -->"
+	ctx := context.Background()
+
+	if n := atomic.SwapInt64(&m.dropped, 0); n > 0 {
+		logger().Warnf(ctx, "%s queue full, dropped spans: %d", fun, n)
+	}
+
+	rs := otlpResourceSpans{ScopeSpans: make([]otlpScopeSpans, 1)}
+	rs.Resource.Attributes = m.resource
+	rs.ScopeSpans[0].Scope.Name = "roc"
+	rs.ScopeSpans[0].Spans = spans
+	body, err := json.Marshal(&otlpExportRequest{ResourceSpans: []otlpResourceSpans{rs}})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range m.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		logger().Warnf(ctx, "%s url: %s spans: %d err: %v", fun, m.url, len(spans), err)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		err = fmt.Errorf("otlp export status: %d", resp.StatusCode)
+		logger().Warnf(ctx, "%s url: %s spans: %d err: %v", fun, m.url, len(spans), err)
+	}
+	return err
+}
+
+// traceContextHttpMiddleware 在 tracing middleware 之前将接受的其他格式的头转为 jaeger 头
+func traceContextHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rt := getTracePropagation().extract(r.Header.Get); rt != nil {
+			r.Header.Set(jaeger.TraceContextHeaderName, rt.jaegerHeader())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// otelHttpMiddleware 在 tracing middleware 之后导出 span
+func otelHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := getOTel()
+		if t == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		aw := &accessResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+		code := aw.status
+		if code == 0 {
+			code = http.StatusOK
+		}
+		t.record(r.Context(), otelSpanKindServer, code >= http.StatusInternalServerError, map[string]interface{}{
+			"http.method": r.Method, "http.target": r.URL.Path, "http.status_code": code,
+		})
+	})
+}
+
+func grpcMetadataGetter(md metadata.MD) func(key string) string {
+	return func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+}
+
+// traceContextIncoming 将接受的其他格式转为 jaeger 头, 需在 tracing 拦截器之前
+func traceContextIncoming(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	rt := getTracePropagation().extract(grpcMetadataGetter(md))
+	if rt == nil {
+		return ctx
+	}
+	md = md.Copy()
+	md.Set(jaeger.TraceContextHeaderName, rt.jaegerHeader())
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+func traceContextServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(traceContextIncoming(ctx), req)
+	}
+}
+
+func traceContextStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := traceContextIncoming(ss.Context())
+		if ctx == ss.Context() {
+			return handler(srv, ss)
+		}
+		return handler(srv, &ctxServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+func otelServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if t := getOTel(); t != nil {
+			t.record(ctx, otelSpanKindServer, err != nil, map[string]interface{}{
+				"rpc.system": "grpc", "rpc.method": info.FullMethod, "rpc.grpc.status_code": int(status.Code(err)),
+			})
+		}
+		return resp, err
+	}
+}
+
+func otelStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := handler(srv, ss)
+		if t := getOTel(); t != nil {
+			t.record(ss.Context(), otelSpanKindServer, err != nil, map[string]interface{}{
+				"rpc.system": "grpc", "rpc.method": info.FullMethod, "rpc.grpc.status_code": int(status.Code(err)),
+			})
+		}
+		return err
+	}
+}
+
+// traceContextOutgoing 在 tracing 拦截器之后, ctx 中为 client span, uber-trace-id 已由 tracing 拦截器发送
+func traceContextOutgoing(ctx context.Context) context.Context {
+	p := getTracePropagation()
+	if len(p.send) == 0 {
+		return ctx
+	}
+	span, ok := xtrace.SpanFromContext(ctx).(*jaeger.Span)
+	if !ok {
+		return ctx
+	}
+	var kv []string
+	p.inject(span.SpanContext(), func(key, value string) {
+		kv = append(kv, key, value)
+	})
+	if len(kv) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+func otelClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		t := getOTel()
+		if t == nil {
+			return invoker(traceContextOutgoing(ctx), method, req, reply, cc, opts...)
+		}
+		err := invoker(traceContextOutgoing(ctx), method, req, reply, cc, opts...)
+		t.record(ctx, otelSpanKindClient, err != nil, map[string]interface{}{
+			"rpc.system": "grpc", "rpc.method": method, "net.peer.name": cc.Target(), "rpc.grpc.status_code": int(status.Code(err)),
+		})
+		return err
+	}
+}
+
+// otelStreamClientInterceptor 只传播, stream 的 client span 不导出
+func otelStreamClientInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(traceContextOutgoing(ctx), desc, cc, method, opts...)
+	}
+}
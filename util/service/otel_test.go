@@ -0,0 +1,81 @@
+package rocserv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-client-go"
+)
+
+func TestTraceContextPropagation(t *testing.T) {
+	ass := assert.New(t)
+
+	r, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ass.True(ok)
+	ass.Equal("4bf92f3577b34da6a3ce929d0e0e4736:00f067aa0ba902b7:0:1", r.jaegerHeader())
+	for _, v := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"} {
+		_, ok = parseTraceparent(v)
+		ass.False(ok, v)
+	}
+
+	h := http.Header{}
+	h.Set("b3", "a3ce929d0e0e4736-00f067aa0ba902b7-1")
+	r, ok = parseB3(h.Get)
+	ass.True(ok)
+	ass.Equal("0000000000000000a3ce929d0e0e4736", r.traceID)
+	ass.True(r.sampled)
+	h = http.Header{}
+	h.Set("X-B3-TraceId", "4bf92f3577b34da6a3ce929d0e0e4736")
+	h.Set("X-B3-SpanId", "00f067aa0ba902b7")
+	r, ok = parseB3(h.Get)
+	ass.True(ok)
+	ass.False(r.sampled)
+
+	// 只开启 b3 时忽略 traceparent, 没有 b3 时使用 jaeger 头
+	tr := newTracePropagation([]string{PropagatorB3}, true)
+	h.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ass.Equal("4bf92f3577b34da6a3ce929d0e0e4736", tr.extract(h.Get).traceID)
+	h.Del("X-B3-TraceId")
+	ass.Nil(tr.extract(h.Get))
+	h.Set(jaeger.TraceContextHeaderName, "1:2:0:1")
+	ass.Nil(tr.extract(h.Get))
+
+	tr = newTracePropagation([]string{PropagatorTraceContext, PropagatorB3}, true)
+	sc := jaeger.NewSpanContext(jaeger.TraceID{High: 1, Low: 2}, jaeger.SpanID(3), 0, true, nil)
+	out := http.Header{}
+	tr.inject(sc, out.Set)
+	ass.Equal("00-00000000000000010000000000000002-0000000000000003-01", out.Get(traceparentHeader))
+	ass.Equal("00000000000000010000000000000002-0000000000000003-1", out.Get(b3Header))
+}
+
+func TestOTLPExporter(t *testing.T) {
+	ass := assert.New(t)
+
+	var got otlpExportRequest
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ass.Equal(otelTracesPath, r.URL.Path)
+		auth = r.Header.Get("Authorization")
+		body, _ := ioutil.ReadAll(r.Body)
+		ass.Nil(json.Unmarshal(body, &got))
+	}))
+	defer ts.Close()
+
+	e := newOTLPExporter("base/account", &OTelConf{Endpoint: ts.URL + "/", Headers: map[string]string{"Authorization": "Bearer x"}})
+	s := &otlpSpan{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Name: "GetUser", Kind: otelSpanKindServer}
+	s.Attributes = append(s.Attributes, otlpAttribute("rpc.grpc.status_code", 5))
+	ass.Nil(e.export([]*otlpSpan{s}))
+
+	ass.Equal("Bearer x", auth)
+	ass.Len(got.ResourceSpans, 1)
+	ass.Equal("service.name", got.ResourceSpans[0].Resource.Attributes[0].Key)
+	ass.Equal("base/account", *got.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	ass.Len(spans, 1)
+	ass.Equal("GetUser", spans[0].Name)
+	ass.Equal("5", *spans[0].Attributes[0].Value.IntValue)
+}
@@ -0,0 +1,431 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+
+	"google.golang.org/grpc"
+)
+
+const (
+	// 配置中心 application namespace 中的配置, 运行时生效
+	// 逗号分隔的接口名, grpc 为方法名, thrift 为 message 名
+	payloadLogMethodsKey = "payload_log_methods"
+	// 采样百分比, 默认 10
+	payloadLogSampleKey = "payload_log_sample_rate"
+	// 逗号分隔的脱敏字段名, 只对 grpc 生效
+	payloadLogRedactKey = "payload_log_redact"
+	// thrift 二进制协议中没有字段名, 需按接口配置脱敏的字段 id 路径, 逗号分隔, 形如 Login:1.2,Login:1.3;
+	// 接口没有敏感字段时配置为 GetUser: , 未配置的接口不记录 thrift 请求日志
+	payloadLogThriftRedactKey = "payload_log_thrift_redact"
+	// 单条日志最大字节数
+	payloadLogMaxBytesKey = "payload_log_max_bytes"
+
+	payloadLogDefaultSample   = 10
+	payloadLogDefaultMaxBytes = 1024
+	// 配置的最大字节数不能超过该值
+	payloadLogLimitBytes = 16 * 1024
+
+	payloadRedacted = "***"
+)
+
+// 总是脱敏的字段
+var payloadDefaultRedact = []string{"password", "passwd", "token", "secret", "authorization", "cookie"}
+
+type payloadLogConf struct {
+	sample   int
+	redact   map[string]bool
+	maxBytes int
+	// thrift 按字段 id 路径脱敏, grpc 时为 nil
+	redactPaths map[string]bool
+}
+
+var (
+	muPayloadRand sync.Mutex
+	payloadRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	// 未配置字段 id 脱敏的 thrift 接口只告警一次
+	payloadThriftWarned sync.Map
+)
+
+// getPayloadLogConf 接口未开启时返回 nil
+func getPayloadLogConf(method string) *payloadLogConf {
+	cc := GetConfigCenter()
+	if cc == nil {
+		return nil
+	}
+	ctx := context.TODO()
+	methods, ok := cc.GetString(ctx, payloadLogMethodsKey)
+	if !ok || !containsItem(methods, method) {
+		return nil
+	}
+
+	conf := &payloadLogConf{
+		sample:   payloadLogDefaultSample,
+		redact:   make(map[string]bool),
+		maxBytes: payloadLogDefaultMaxBytes,
+	}
+	if n, ok := cc.GetInt(ctx, payloadLogSampleKey); ok {
+		conf.sample = n
+	}
+	if n, ok := cc.GetInt(ctx, payloadLogMaxBytesKey); ok && n > 0 {
+		conf.maxBytes = n
+	}
+	if conf.maxBytes > payloadLogLimitBytes {
+		conf.maxBytes = payloadLogLimitBytes
+	}
+	for _, f := range payloadDefaultRedact {
+		conf.redact[f] = true
+	}
+	if s, ok := cc.GetString(ctx, payloadLogRedactKey); ok {
+		for _, f := range strings.Split(s, ",") {
+			if f = strings.TrimSpace(f); len(f) > 0 {
+				conf.redact[strings.ToLower(f)] = true
+			}
+		}
+	}
+	return conf
+}
+
+func containsItem(list, item string) bool {
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == item {
+			return true
+		}
+	}
+	return false
+}
+
+// sampledPayloadLogConf 接口开启且命中采样时返回配置
+func sampledPayloadLogConf(method string) *payloadLogConf {
+	conf := getPayloadLogConf(method)
+	if conf == nil || conf.sample <= 0 {
+		return nil
+	}
+	muPayloadRand.Lock()
+	n := payloadRand.Intn(100)
+	muPayloadRand.Unlock()
+	if n >= conf.sample {
+		return nil
+	}
+	return conf
+}
+
+// getThriftRedactPaths 返回接口配置的字段 id 路径, 未配置时 ok 为 false
+func getThriftRedactPaths(method string) (map[string]bool, bool) {
+	cc := GetConfigCenter()
+	if cc == nil {
+		return nil, false
+	}
+	s, ok := cc.GetString(context.TODO(), payloadLogThriftRedactKey)
+	if !ok {
+		return nil, false
+	}
+	return parseThriftRedactPaths(s, method)
+}
+
+func parseThriftRedactPaths(s, method string) (map[string]bool, bool) {
+	paths := make(map[string]bool)
+	found := false
+	for _, item := range strings.Split(s, ",") {
+		i := strings.Index(item, ":")
+		if i < 0 || strings.TrimSpace(item[:i]) != method {
+			continue
+		}
+		found = true
+		if path := strings.TrimSpace(item[i+1:]); len(path) > 0 {
+			paths[path] = true
+		}
+	}
+	return paths, found
+}
+
+// sampledThriftPayloadLogConf 与 sampledPayloadLogConf 相同, 但接口未配置字段 id 脱敏时不记录
+func sampledThriftPayloadLogConf(method string) *payloadLogConf {
+	fun := "sampledThriftPayloadLogConf -->"
+
+	conf := sampledPayloadLogConf(method)
+	if conf == nil {
+		return nil
+	}
+	paths, ok := getThriftRedactPaths(method)
+	if !ok {
+		if _, warned := payloadThriftWarned.LoadOrStore(method, true); !warned {
+			logger().Warnf(context.Background(), "%s method: %s not in %s, thrift payload is not logged", fun, method, payloadLogThriftRedactKey)
+		}
+		return nil
+	}
+	conf.redactPaths = paths
+	return conf
+}
+
+// redactThriftFields 字段 id 路径及其子字段替换为脱敏值
+func redactThriftFields(fields map[string]interface{}, paths map[string]bool) map[string]interface{} {
+	res := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		res[k] = v
+		for p := range paths {
+			if k == p || strings.HasPrefix(k, p+".") {
+				res[k] = payloadRedacted
+				break
+			}
+		}
+	}
+	return res
+}
+
+// redactPayload 递归替换脱敏字段的值, 字段名忽略大小写
+func redactPayload(v interface{}, redact map[string]bool) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, iv := range t {
+			if redact[strings.ToLower(k)] {
+				t[k] = payloadRedacted
+				continue
+			}
+			t[k] = redactPayload(iv, redact)
+		}
+	case []interface{}:
+		for i, iv := range t {
+			t[i] = redactPayload(iv, redact)
+		}
+	}
+	return v
+}
+
+func (m *payloadLogConf) format(v interface{}) string {
+	if fields, ok := v.(map[string]interface{}); ok && m.redactPaths != nil {
+		v = redactThriftFields(fields, m.redactPaths)
+	}
+	js, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("marshal err: %v", err)
+	}
+	var generic interface{}
+	if err := json.Unmarshal(js, &generic); err == nil {
+		js, _ = json.Marshal(redactPayload(generic, m.redact))
+	}
+	if len(js) > m.maxBytes {
+		return fmt.Sprintf("%s...(truncated %d bytes)", js[:m.maxBytes], len(js)-m.maxBytes)
+	}
+	return string(js)
+}
+
+func (m *payloadLogConf) log(ctx context.Context, side, method string, req, resp interface{}, err error, dur time.Duration) {
+	logger().Infof(ctx, "payload side: %s method: %s caller: %s dur: %s err: %v req: %s resp: %s",
+		side, method, costCaller(ctx), dur, err, m.format(req), m.format(resp))
+}
+
+func payloadLogServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		method := grpcMethodName(info.FullMethod)
+		conf := sampledPayloadLogConf(method)
+		if conf == nil {
+			return handler(ctx, req)
+		}
+		st := time.Now()
+		resp, err := handler(ctx, req)
+		conf.log(ctx, "server", method, req, resp, err, time.Since(st))
+		return resp, err
+	}
+}
+
+func payloadLogClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, fullMethod string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		method := grpcMethodName(fullMethod)
+		conf := sampledPayloadLogConf(method)
+		if conf == nil {
+			return invoker(ctx, fullMethod, req, reply, cc, opts...)
+		}
+		st := time.Now()
+		err := invoker(ctx, fullMethod, req, reply, cc, opts...)
+		conf.log(ctx, "client", method, req, reply, err, time.Since(st))
+		return err
+	}
+}
+
+// payloadLogProcessor thrift 服务端请求日志, 二进制协议中没有字段名, 按字段 id 路径记录
+type payloadLogProcessor struct {
+	thrift.TProcessor
+}
+
+func (m *payloadLogProcessor) Process(in, out thrift.TProtocol) (bool, thrift.TException) {
+	rin := &payloadRecordProtocol{TProtocol: in}
+	rout := &payloadRecordProtocol{TProtocol: out, req: rin}
+	st := time.Now()
+	ok, err := m.TProcessor.Process(rin, rout)
+	if rin.conf != nil {
+		rin.conf.log(context.Background(), "server", rin.method, rin.fields, rout.fields, err, time.Since(st))
+	}
+	return ok, err
+}
+
+// payloadRecordProtocol 命中采样时记录读写的字段值, key 形如 1.2 即字段 1 中的字段 2
+type payloadRecordProtocol struct {
+	thrift.TProtocol
+
+	method string
+	conf   *payloadLogConf
+	// 响应的 protocol 指向对应的请求
+	req    *payloadRecordProtocol
+	record bool
+	path   []string
+	fields map[string]interface{}
+}
+
+func (m *payloadRecordProtocol) add(v interface{}) {
+	if !m.record || len(m.path) == 0 {
+		return
+	}
+	key := strings.Join(m.path, ".")
+	if old, ok := m.fields[key]; ok {
+		if list, ok := old.([]interface{}); ok {
+			m.fields[key] = append(list, v)
+		} else {
+			m.fields[key] = []interface{}{old, v}
+		}
+		return
+	}
+	m.fields[key] = v
+}
+
+func (m *payloadRecordProtocol) ReadMessageBegin() (string, thrift.TMessageType, int32, error) {
+	name, typeId, seqid, err := m.TProtocol.ReadMessageBegin()
+	if err == nil {
+		m.method = name
+		m.conf = sampledThriftPayloadLogConf(name)
+		m.record = m.conf != nil
+		m.fields = make(map[string]interface{})
+	}
+	return name, typeId, seqid, err
+}
+
+func (m *payloadRecordProtocol) WriteMessageBegin(name string, typeId thrift.TMessageType, seqid int32) error {
+	// 仅在请求命中采样时记录响应
+	m.record = m.req != nil && m.req.record
+	m.fields = make(map[string]interface{})
+	return m.TProtocol.WriteMessageBegin(name, typeId, seqid)
+}
+
+func (m *payloadRecordProtocol) ReadFieldBegin() (string, thrift.TType, int16, error) {
+	name, typeId, id, err := m.TProtocol.ReadFieldBegin()
+	if err == nil && typeId != thrift.STOP {
+		m.path = append(m.path, strconv.Itoa(int(id)))
+	}
+	return name, typeId, id, err
+}
+
+func (m *payloadRecordProtocol) ReadFieldEnd() error {
+	if len(m.path) > 0 {
+		m.path = m.path[:len(m.path)-1]
+	}
+	return m.TProtocol.ReadFieldEnd()
+}
+
+func (m *payloadRecordProtocol) WriteFieldBegin(name string, typeId thrift.TType, id int16) error {
+	m.path = append(m.path, strconv.Itoa(int(id)))
+	return m.TProtocol.WriteFieldBegin(name, typeId, id)
+}
+
+func (m *payloadRecordProtocol) WriteFieldEnd() error {
+	if len(m.path) > 0 {
+		m.path = m.path[:len(m.path)-1]
+	}
+	return m.TProtocol.WriteFieldEnd()
+}
+
+func (m *payloadRecordProtocol) ReadBool() (bool, error) {
+	v, err := m.TProtocol.ReadBool()
+	m.add(v)
+	return v, err
+}
+
+func (m *payloadRecordProtocol) ReadByte() (byte, error) {
+	v, err := m.TProtocol.ReadByte()
+	m.add(v)
+	return v, err
+}
+
+func (m *payloadRecordProtocol) ReadI16() (int16, error) {
+	v, err := m.TProtocol.ReadI16()
+	m.add(v)
+	return v, err
+}
+
+func (m *payloadRecordProtocol) ReadI32() (int32, error) {
+	v, err := m.TProtocol.ReadI32()
+	m.add(v)
+	return v, err
+}
+
+func (m *payloadRecordProtocol) ReadI64() (int64, error) {
+	v, err := m.TProtocol.ReadI64()
+	m.add(v)
+	return v, err
+}
+
+func (m *payloadRecordProtocol) ReadDouble() (float64, error) {
+	v, err := m.TProtocol.ReadDouble()
+	m.add(v)
+	return v, err
+}
+
+func (m *payloadRecordProtocol) ReadString() (string, error) {
+	v, err := m.TProtocol.ReadString()
+	m.add(v)
+	return v, err
+}
+
+func (m *payloadRecordProtocol) ReadBinary() ([]byte, error) {
+	v, err := m.TProtocol.ReadBinary()
+	m.add(v)
+	return v, err
+}
+
+func (m *payloadRecordProtocol) WriteBool(v bool) error {
+	m.add(v)
+	return m.TProtocol.WriteBool(v)
+}
+
+func (m *payloadRecordProtocol) WriteByte(v byte) error {
+	m.add(v)
+	return m.TProtocol.WriteByte(v)
+}
+
+func (m *payloadRecordProtocol) WriteI16(v int16) error {
+	m.add(v)
+	return m.TProtocol.WriteI16(v)
+}
+
+func (m *payloadRecordProtocol) WriteI32(v int32) error {
+	m.add(v)
+	return m.TProtocol.WriteI32(v)
+}
+
+func (m *payloadRecordProtocol) WriteI64(v int64) error {
+	m.add(v)
+	return m.TProtocol.WriteI64(v)
+}
+
+func (m *payloadRecordProtocol) WriteDouble(v float64) error {
+	m.add(v)
+	return m.TProtocol.WriteDouble(v)
+}
+
+func (m *payloadRecordProtocol) WriteString(v string) error {
+	m.add(v)
+	return m.TProtocol.WriteString(v)
+}
+
+func (m *payloadRecordProtocol) WriteBinary(v []byte) error {
+	m.add(v)
+	return m.TProtocol.WriteBinary(v)
+}
@@ -0,0 +1,53 @@
+package rocserv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPayloadLogFormat(t *testing.T) {
+	ass := assert.New(t)
+
+	conf := &payloadLogConf{
+		redact:   map[string]bool{"password": true},
+		maxBytes: 64,
+	}
+	req := map[string]interface{}{
+		"name":     "foo",
+		"Password": "bar",
+		"items":    []interface{}{map[string]interface{}{"password": "baz"}},
+	}
+	ass.Equal(`{"Password":"***","items":[{"password":"***"}],"name":"foo"}`, conf.format(req))
+
+	// thrift 按完整的字段 id 路径脱敏, 包括其子字段
+	conf.redactPaths = map[string]bool{"1.3": true}
+	ass.Equal(`{"1.2":1,"1.3":"***","1.3.1":"***","2.3":"x"}`,
+		conf.format(map[string]interface{}{"1.2": 1, "1.3": "secret", "1.3.1": "s", "2.3": "x"}))
+	conf.redactPaths = nil
+
+	conf.maxBytes = 8
+	ass.Equal(`{"name":...(truncated 6 bytes)`, conf.format(map[string]string{"name": "foo"}))
+}
+
+func TestContainsItem(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.True(containsItem("GetUser, ListUser", "ListUser"))
+	ass.False(containsItem("GetUser", "Get"))
+}
+
+func TestParseThriftRedactPaths(t *testing.T) {
+	ass := assert.New(t)
+
+	paths, ok := parseThriftRedactPaths("Login:1.2, Login:1.3,GetUser:", "Login")
+	ass.True(ok)
+	ass.Equal(map[string]bool{"1.2": true, "1.3": true}, paths)
+
+	paths, ok = parseThriftRedactPaths("Login:1.2,GetUser:", "GetUser")
+	ass.True(ok)
+	ass.Len(paths, 0)
+
+	_, ok = parseThriftRedactPaths("Login:1.2", "ListUser")
+	ass.False(ok)
+}
@@ -6,6 +6,7 @@ package rocserv
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
@@ -31,6 +32,8 @@ const (
 	PROCESSOR_THRIFT = "thrift"
 	PROCESSOR_GRPC   = "grpc"
 	PROCESSOR_GIN    = "gin"
+	PROCESSOR_HTTPS  = "https"
+	PROCESSOR_WS     = "ws"
 )
 
 const disableContextCancelKey = "disable_context_cancel"
@@ -57,115 +60,347 @@ func (dr *driverBuilder) isDisableContextCancel(ctx context.Context) bool {
 	return use
 }
 
-func (dr *driverBuilder) powerProcessorDriver(ctx context.Context, n string, p Processor) (*ServInfo, error) {
+// powerProcessorDriver 在 Driver 返回的地址及 ListenAddrs 上启动监听, extras 为额外地址的注册信息, key 为注册名
+func (dr *driverBuilder) powerProcessorDriver(ctx context.Context, n string, p Processor) (*ServInfo, map[string]*ServInfo, processorStopper, error) {
 	fun := "driverBuilder.powerProcessorDriver -> "
 	addr, driver := p.Driver()
 	if driver == nil {
-		return nil, errNilDriver
+		return nil, nil, nil, errNilDriver
 	}
+	if err := checkStartupIssues(ctx, n, validateDriver(driver)); err != nil {
+		return nil, nil, nil, err
+	}
+
+	lazy, _ := p.(*lazyProcessor)
+	servInfo, stop, err := dr.powerDriver(ctx, n, addr, driver, lazy, nil, tlsConfOf(p), thriftConfOf(p))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	extras := make(map[string]*ServInfo)
+	stops := []processorStopper{stop}
+	if gs, ok := driver.(*GatewayServer); ok {
+		info, gwStop, err := dr.powerGateway(ctx, n, gs, servInfo.Addr)
+		if err != nil {
+			logger().Errorf(ctx, "%s processor: %s gateway addr: %s err: %v", fun, n, gs.HTTPAddr, err)
+			stop(ctx)
+			return nil, nil, nil, err
+		}
+		extras[listenAddrName(n, gatewayListenName)] = info
+		// 先停止网关, 转发中的请求可以完成
+		stops = []processorStopper{gwStop, stop}
+	}
+	for _, la := range listenAddrsOf(p) {
+		la := la
+		info, stop, err := dr.powerDriver(ctx, n, la.Addr, driver, lazy, &la, la.TLS, thriftConfOf(p))
+		if err != nil {
+			logger().Errorf(ctx, "%s processor: %s listen addr: %s err: %v", fun, n, la.Addr, err)
+			combineStoppers(stops)(ctx)
+			return nil, nil, nil, err
+		}
+		if len(la.Class) > 0 {
+			info.Class, info.Of = la.Class, n
+		}
+		extras[listenAddrName(n, la.Name)] = info
+		stops = append(stops, stop)
+	}
+	return servInfo, extras, combineStoppers(stops), nil
+}
+
+// powerDriver la 非空时为额外地址, 使用该地址独有的中间件; tlsConf 非空时监听开启 TLS; thriftConf 只用于 thrift
+func (dr *driverBuilder) powerDriver(ctx context.Context, n, addr string, driver interface{}, lazy *lazyProcessor, la *ListenAddr, tlsConf *TLSConf, thriftConf *ThriftConf) (*ServInfo, processorStopper, error) {
+	fun := "driverBuilder.powerDriver -> "
 
-	xlog.Infof(ctx, "%s processor: %s type: %s addr: %s", fun, reflect.TypeOf(driver), addr)
+	logger().Infof(ctx, "%s processor: %s type: %s addr: %s tls: %v", fun, n, reflect.TypeOf(driver), addr, tlsConf != nil)
+
+	tlsConfig, err := tlsConf.serverConfig()
+	if err != nil {
+		logger().Errorf(ctx, "%s processor: %s tls config err: %v", fun, n, err)
+		return nil, nil, err
+	}
+	httpType := PROCESSOR_HTTP
+	if tlsConfig != nil {
+		httpType = PROCESSOR_HTTPS
+	}
+
+	// lazy 在内层, 额外地址的鉴权等中间件先执行
+	var procHttpMiddlewares []middleware
+	if lazy != nil {
+		procHttpMiddlewares = append(procHttpMiddlewares, lazy.httpMiddleware)
+	}
+	var procUnaryInterceptors []grpc.UnaryServerInterceptor
+	if la != nil {
+		for _, mw := range la.HttpMiddlewares {
+			procHttpMiddlewares = append(procHttpMiddlewares, mw)
+		}
+		procUnaryInterceptors = la.UnaryInterceptors
+	}
+
+	// 内部 processor 只统计请求及访问日志
+	if h, ok := driver.(http.Handler); ok && isSystemProcessor(n) {
+		servType := httpType
+		if _, ok := driver.(*gin.Engine); ok {
+			servType = PROCESSOR_GIN
+		}
+		sa, stop, err := powerSystemHttp(n, addr, tlsConfig, h)
+		if err != nil {
+			return nil, nil, err
+		}
+		servInfo := &ServInfo{
+			Type: servType,
+			Addr: sa,
+			TLS:  tlsConfig != nil,
+		}
+		return servInfo, stop, nil
+	}
 
 	switch d := driver.(type) {
 	case *httprouter.Router:
 		var extraHttpMiddlewares []middleware
 		disableContextCancel := dr.isDisableContextCancel(ctx)
-		xlog.Infof(ctx, "%s disableContextCancel: %v, processor: %s", fun, disableContextCancel, n)
+		logger().Infof(ctx, "%s disableContextCancel: %v, processor: %s", fun, disableContextCancel, n)
 		if disableContextCancel {
 			extraHttpMiddlewares = append(extraHttpMiddlewares, disableContextCancelMiddleware)
 		}
-		sa, err := powerHttp(addr, d, extraHttpMiddlewares...)
+		extraHttpMiddlewares = append(extraHttpMiddlewares, procHttpMiddlewares...)
+		sa, stop, err := powerHttp(addr, tlsConfig, d, extraHttpMiddlewares...)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		servInfo := &ServInfo{
-			Type: PROCESSOR_HTTP,
+			Type: httpType,
 			Addr: sa,
+			TLS:  tlsConfig != nil,
 		}
-		return servInfo, nil
+		return servInfo, stop, nil
 
 	case thrift.TProcessor:
-		sa, err := powerThrift(addr, d)
+		if lazy != nil {
+			d = &lazyThriftProcessor{lazy: lazy, TProcessor: d}
+		}
+		sa, stop, err := powerThrift(addr, tlsConfig, thriftConf, d)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		servInfo := &ServInfo{
 			Type: PROCESSOR_THRIFT,
 			Addr: sa,
+			TLS:  tlsConfig != nil,
 		}
-		return servInfo, nil
+		// 默认配置不写入, 与老版本注册信息一致
+		if c := thriftConf.normalize(); c != nil {
+			servInfo.ThriftTransport, servInfo.ThriftProtocol = c.Transport, c.Protocol
+		}
+		return servInfo, stop, nil
 
 	case *GrpcServer:
 		// 添加内部拦截器的操作必须放到NewServer中, 否则无法在服务代码中完成service注册
-		sa, err := powerGrpc(addr, d)
+		d.lazy = lazy
+		sa, stop, err := powerGrpc(addr, tlsConfig, d, procUnaryInterceptors...)
+		if err != nil {
+			return nil, nil, err
+		}
+		servInfo := &ServInfo{
+			Type: PROCESSOR_GRPC,
+			Addr: sa,
+			TLS:  tlsConfig != nil,
+		}
+		return servInfo, stop, nil
+
+	case *MuxServer:
+		if tlsConfig != nil {
+			return nil, nil, fmt.Errorf("processor: %s mux server does not support tls", n)
+		}
+		var extraHttpMiddlewares []middleware
+		if hs, ok := d.HTTP.(*HttpServer); ok && hs.fallbacks != nil {
+			extraHttpMiddlewares = append(extraHttpMiddlewares, hs.fallbacks.middleware)
+		}
+		if hs, ok := d.HTTP.(*HttpServer); ok && hs.transcoder != nil {
+			extraHttpMiddlewares = append(extraHttpMiddlewares, hs.transcoder.middleware)
+		}
+		disableContextCancel := dr.isDisableContextCancel(ctx)
+		logger().Infof(ctx, "%s disableContextCancel: %v, processor: %s", fun, disableContextCancel, n)
+		if disableContextCancel {
+			extraHttpMiddlewares = append(extraHttpMiddlewares, disableContextCancelMiddleware)
+		}
+		extraHttpMiddlewares = append(extraHttpMiddlewares, procHttpMiddlewares...)
+		d.Grpc.lazy = lazy
+		sa, stop, err := powerMux(addr, d, procUnaryInterceptors, extraHttpMiddlewares...)
+		if err != nil {
+			return nil, nil, err
+		}
+		// grpc 客户端按 processor 名称路由, 类型仍为 grpc
+		servInfo := &ServInfo{
+			Type:      PROCESSOR_GRPC,
+			Addr:      sa,
+			Multiplex: PROCESSOR_GRPC + "," + PROCESSOR_HTTP,
+		}
+		return servInfo, stop, nil
+
+	case *GatewayServer:
+		// 额外地址只监听 grpc, 网关地址见 powerGateway
+		if tlsConfig != nil {
+			return nil, nil, fmt.Errorf("processor: %s gateway server does not support tls", n)
+		}
+		d.Grpc.lazy = lazy
+		sa, stop, err := powerGrpc(addr, nil, d.Grpc, procUnaryInterceptors...)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		servInfo := &ServInfo{
 			Type: PROCESSOR_GRPC,
 			Addr: sa,
 		}
-		return servInfo, nil
+		return servInfo, stop, nil
 
 	case *gin.Engine:
 		var extraHttpMiddlewares []middleware
 		disableContextCancel := dr.isDisableContextCancel(ctx)
-		xlog.Infof(ctx, "%s disableContextCancel: %v, processor: %s", fun, disableContextCancel, n)
+		logger().Infof(ctx, "%s disableContextCancel: %v, processor: %s", fun, disableContextCancel, n)
 		if disableContextCancel {
 			extraHttpMiddlewares = append(extraHttpMiddlewares, disableContextCancelMiddleware)
 		}
-		sa, err := powerGin(addr, d, extraHttpMiddlewares...)
+		extraHttpMiddlewares = append(extraHttpMiddlewares, procHttpMiddlewares...)
+		sa, stop, err := powerGin(addr, tlsConfig, d, extraHttpMiddlewares...)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		servInfo := &ServInfo{
 			Type: PROCESSOR_GIN,
 			Addr: sa,
+			TLS:  tlsConfig != nil,
 		}
-		return servInfo, nil
+		return servInfo, stop, nil
 
 	case *HttpServer:
 		var extraHttpMiddlewares []middleware
+		if d.fallbacks != nil {
+			extraHttpMiddlewares = append(extraHttpMiddlewares, d.fallbacks.middleware)
+		}
+		if d.transcoder != nil {
+			extraHttpMiddlewares = append(extraHttpMiddlewares, d.transcoder.middleware)
+		}
 		disableContextCancel := dr.isDisableContextCancel(ctx)
-		xlog.Infof(ctx, "%s disableContextCancel: %v, processor: %s", fun, disableContextCancel, n)
+		logger().Infof(ctx, "%s disableContextCancel: %v, processor: %s", fun, disableContextCancel, n)
 		if disableContextCancel {
 			extraHttpMiddlewares = append(extraHttpMiddlewares, disableContextCancelMiddleware)
 		}
-		sa, err := powerGin(addr, d.Engine, extraHttpMiddlewares...)
+		extraHttpMiddlewares = append(extraHttpMiddlewares, procHttpMiddlewares...)
+		sa, stop, err := powerGin(addr, tlsConfig, d.Engine, extraHttpMiddlewares...)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		servInfo := &ServInfo{
 			Type: PROCESSOR_GIN,
 			Addr: sa,
+			TLS:  tlsConfig != nil,
+		}
+		return servInfo, stop, nil
+
+	case *VirtualHostServer:
+		// 证书按 host 配置, 见 VirtualHost
+		if tlsConfig != nil {
+			return nil, nil, fmt.Errorf("processor: %s virtual host server configures tls by host", n)
+		}
+		var extraHttpMiddlewares []middleware
+		disableContextCancel := dr.isDisableContextCancel(ctx)
+		logger().Infof(ctx, "%s disableContextCancel: %v, processor: %s", fun, disableContextCancel, n)
+		if disableContextCancel {
+			extraHttpMiddlewares = append(extraHttpMiddlewares, disableContextCancelMiddleware)
+		}
+		extraHttpMiddlewares = append(extraHttpMiddlewares, procHttpMiddlewares...)
+		sa, useTLS, stop, err := powerVirtualHost(addr, d, extraHttpMiddlewares...)
+		if err != nil {
+			return nil, nil, err
+		}
+		servType := PROCESSOR_HTTP
+		if useTLS {
+			servType = PROCESSOR_HTTPS
+		}
+		servInfo := &ServInfo{
+			Type: servType,
+			Addr: sa,
+			TLS:  useTLS,
+		}
+		return servInfo, stop, nil
+
+	case *WebhookReceiver:
+		var extraHttpMiddlewares []middleware
+		disableContextCancel := dr.isDisableContextCancel(ctx)
+		logger().Infof(ctx, "%s disableContextCancel: %v, processor: %s", fun, disableContextCancel, n)
+		if disableContextCancel {
+			extraHttpMiddlewares = append(extraHttpMiddlewares, disableContextCancelMiddleware)
+		}
+		extraHttpMiddlewares = append(extraHttpMiddlewares, procHttpMiddlewares...)
+		sa, stop, err := powerWebhook(addr, tlsConfig, d, extraHttpMiddlewares...)
+		if err != nil {
+			return nil, nil, err
+		}
+		servInfo := &ServInfo{
+			Type: httpType,
+			Addr: sa,
+			TLS:  tlsConfig != nil,
 		}
-		return servInfo, nil
+		return servInfo, stop, nil
+
+	case *WebSocketServer:
+		if tlsConfig != nil {
+			return nil, nil, fmt.Errorf("processor: %s websocket server does not support tls", n)
+		}
+		// websocket 连接建立后不经过中间件, 启动时直接初始化
+		if lazy != nil {
+			if err := lazy.wait(ctx); err != nil {
+				return nil, nil, err
+			}
+		}
+		sa, stop, err := powerWebSocket(addr, d)
+		if err != nil {
+			return nil, nil, err
+		}
+		servInfo := &ServInfo{
+			Type: PROCESSOR_WS,
+			Addr: sa,
+		}
+		return servInfo, stop, nil
 
 	default:
-		return nil, fmt.Errorf("processor: %s driver not recognition", n)
+		return nil, nil, fmt.Errorf("processor: %s driver not recognition", n)
 	}
 }
 
-func powerHttp(addr string, router *httprouter.Router, middlewares ...middleware) (string, error) {
+// processorStopper 停止 processor 的监听, http 及 grpc 会在 ctx 结束前等待处理中的请求
+type processorStopper func(ctx context.Context) error
+
+func powerHttp(addr string, tlsConfig *tls.Config, router *httprouter.Router, middlewares ...middleware) (string, processorStopper, error) {
 	fun := "powerHttp -->"
 	ctx := context.Background()
 
 	netListen, laddr, err := listenServAddr(ctx, addr)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	// tracing
 	mw := decorateHttpMiddleware(router, middlewares...)
 
+	serv := &http.Server{Handler: mw}
 	go func() {
-		err := http.Serve(netListen, mw)
-		if err != nil {
+		err := serveHttp(serv, netListen, tlsConfig)
+		if err != nil && err != http.ErrServerClosed {
 			xlog.Panicf(ctx, "%s laddr[%s]", fun, laddr)
 		}
 	}()
 
-	return laddr, nil
+	return laddr, serv.Shutdown, nil
+}
+
+// serveHttp tlsConfig 非空时使用 ServeTLS, 通过 ALPN 支持 http2
+func serveHttp(serv *http.Server, lis net.Listener, tlsConfig *tls.Config) error {
+	if tlsConfig == nil {
+		return serv.Serve(lis)
+	}
+	serv.TLSConfig = tlsConfig
+	return serv.ServeTLS(lis, "", "")
 }
 
 // 打开端口监听, 并返回服务地址
@@ -176,7 +411,7 @@ func listenServAddr(ctx context.Context, addr string) (net.Listener, string, err
 		return nil, "", err
 	}
 
-	xlog.Infof(ctx, "%s config addr[%s]", fun, paddr)
+	logger().Infof(ctx, "%s config addr[%s]", fun, paddr)
 
 	tcpAddr, err := net.ResolveTCPAddr("tcp", paddr)
 	if err != nil {
@@ -194,63 +429,86 @@ func listenServAddr(ctx context.Context, addr string) (net.Listener, string, err
 		return nil, "", err
 	}
 
-	xlog.Infof(ctx, "%s listen addr[%s]", fun, laddr)
+	logger().Infof(ctx, "%s listen addr[%s]", fun, laddr)
 	return netListen, laddr, nil
 }
 
 // 添加http middleware
 func decorateHttpMiddleware(router http.Handler, middlewares ...middleware) http.Handler {
-	r := router
-	for _, m := range middlewares {
-		r = m(r)
+	layers := []httpLayer{
+		{"baggage", baggageHttpMiddleware},
+		{"otel", otelHttpMiddleware},
+		{"access_log", accessLogHttpMiddleware},
+		{"rpc_metric", rpcMetricHttpMiddleware},
+		{"traffic_log", httpTrafficLogMiddleware},
+		{"in_flight", inFlightMiddleware},
+		{"cost", costHttpMiddleware},
+		{"request_stat", requestStatHttpMiddleware},
+		{"caller_stat", callerStatHttpMiddleware},
+		{"deprecation", deprecationHttpMiddleware},
+		{"recovery", recoveryHttpMiddleware},
+		{"chain", chainHttpMiddleware},
+	}
+	// processor 的中间件作为一层
+	if len(middlewares) > 0 {
+		layers = append(layers, httpLayer{"processor", func(next http.Handler) http.Handler {
+			r := next
+			for _, m := range middlewares {
+				r = m(r)
+			}
+			return r
+		}})
 	}
 	// tracing
 	mw := nethttp.MiddlewareWithGlobalTracer(
-		// add logging middleware
-		httpTrafficLogMiddleware(r),
+		// add logging middleware, 每层的耗时见 timedHttpLayers
+		timedHttpLayers(layers, router),
 		nethttp.OperationNameFunc(func(r *http.Request) string {
 			return "HTTP " + r.Method + ": " + r.URL.Path
 		}),
 		nethttp.MWSpanFilter(xtrace.UrlSpanFilter))
 
-	return mw
+	return traceContextHttpMiddleware(mw)
 }
 
-func powerThrift(addr string, processor thrift.TProcessor) (string, error) {
+func powerThrift(addr string, tlsConfig *tls.Config, conf *ThriftConf, processor thrift.TProcessor) (string, processorStopper, error) {
 	fun := "powerThrift -->"
 	ctx := context.Background()
 
 	paddr, err := xnet.GetListenAddr(addr)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	xlog.Infof(ctx, "%s config addr[%s]", fun, paddr)
+	logger().Infof(ctx, "%s config addr[%s]", fun, paddr)
 
-	transportFactory := thrift.NewTFramedTransportFactory(thrift.NewTTransportFactory())
-	protocolFactory := thrift.NewTBinaryProtocolFactoryDefault()
-	//protocolFactory := thrift.NewTCompactProtocolFactory()
+	transportFactory, protocolFactory, err := conf.factories()
+	if err != nil {
+		return "", nil, err
+	}
 
 	serverTransport, err := thrift.NewTServerSocket(paddr)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	server := thrift.NewTSimpleServer4(processor, serverTransport, transportFactory, protocolFactory)
+	conns := newThriftConns()
+	connTransport := &thriftConnServerTransport{TServerSocket: serverTransport, conns: conns, tlsConfig: tlsConfig}
+	server := thrift.NewTSimpleServer4(&accessLogProcessor{&rpcMetricProcessor{&costProcessor{&loadShedProcessor{&rateLimitProcessor{&chainProcessor{&recoveryProcessor{&payloadLogProcessor{processor}}}}}}}}, connTransport, transportFactory, protocolFactory)
 
 	// Listen后就可以拿到端口了
 	//err = server.Listen()
 	err = serverTransport.Listen()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	laddr, err := xnet.GetServAddr(serverTransport.Addr())
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	xlog.Infof(ctx, "%s listen addr[%s]", fun, laddr)
+	logger().Infof(ctx, "%s listen addr[%s]", fun, laddr)
 
 	go func() {
 		err := server.Serve()
@@ -259,43 +517,78 @@ func powerThrift(addr string, processor thrift.TProcessor) (string, error) {
 		}
 	}()
 
-	return laddr, nil
+	reapStop := make(chan struct{})
+	go conns.loop(reapStop)
 
+	stop := func(ctx context.Context) error {
+		close(reapStop)
+		return server.Stop()
+	}
+	return laddr, stop, nil
 }
 
 //启动grpc ，并返回端口信息
-func powerGrpc(addr string, server *GrpcServer) (string, error) {
+// 同一个 server 可以在多个地址上监听, interceptors 只作用于该地址
+func powerGrpc(addr string, tlsConfig *tls.Config, server *GrpcServer, interceptors ...grpc.UnaryServerInterceptor) (string, processorStopper, error) {
 	fun := "powerGrpc -->"
 	ctx := context.Background()
 	paddr, err := xnet.GetListenAddr(addr)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
-	xlog.Infof(ctx, "%s config addr[%s]", fun, paddr)
+	logger().Infof(ctx, "%s config addr[%s]", fun, paddr)
 	lis, err := net.Listen("tcp", paddr)
 	if err != nil {
-		return "", fmt.Errorf("grpc tcp Listen err:%v", err)
+		return "", nil, fmt.Errorf("grpc tcp Listen err:%v", err)
 	}
 	laddr, err := xnet.GetServAddr(lis.Addr())
 	if err != nil {
-		return "", fmt.Errorf(" GetServAddr err:%v", err)
+		return "", nil, fmt.Errorf(" GetServAddr err:%v", err)
+	}
+	logger().Infof(ctx, "%s listen grpc addr[%s]", fun, laddr)
+	if len(interceptors) > 0 {
+		server.addListenInterceptors(lis.Addr(), interceptors)
+	}
+	if server.conf != nil {
+		lis = newLimitListener(lis, server.conf.MaxConnections)
+	}
+	if tlsConfig != nil {
+		lis = grpcTLSListener(lis, tlsConfig)
+	} else {
+		server.setPlainAddr(laddr)
 	}
-	xlog.Infof(ctx, "%s listen grpc addr[%s]", fun, laddr)
 	go func() {
 		if err := server.Server.Serve(lis); err != nil {
 			xlog.Panicf(ctx, "%s grpc laddr[%s]", fun, laddr)
 		}
 	}()
-	return laddr, nil
+	return laddr, grpcStopper(server.Server), nil
+}
+
+// grpcStopper GracefulStop 等待处理中的请求结束, ctx 结束时强制停止
+func grpcStopper(s *grpc.Server) processorStopper {
+	return func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			s.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			s.Stop()
+		}
+		return nil
+	}
 }
 
-func powerGin(addr string, router *gin.Engine, middlewares ...middleware) (string, error) {
+func powerGin(addr string, tlsConfig *tls.Config, router *gin.Engine, middlewares ...middleware) (string, processorStopper, error) {
 	fun := "powerGin -->"
 	ctx := context.Background()
 
 	netListen, laddr, err := listenServAddr(ctx, addr)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	// tracing
@@ -303,13 +596,13 @@ func powerGin(addr string, router *gin.Engine, middlewares ...middleware) (strin
 
 	serv := &http.Server{Handler: mw}
 	go func() {
-		err := serv.Serve(netListen)
-		if err != nil {
+		err := serveHttp(serv, netListen, tlsConfig)
+		if err != nil && err != http.ErrServerClosed {
 			xlog.Panicf(ctx, "%s laddr[%s]", fun, laddr)
 		}
 	}()
 
-	return laddr, nil
+	return laddr, serv.Shutdown, nil
 }
 
 func reloadRouter(processor string, server interface{}, driver interface{}) error {
@@ -328,7 +621,7 @@ func reloadRouter(processor string, server interface{}, driver interface{}) erro
 				return "HTTP " + r.Method + ": " + r.URL.Path
 			}))
 		s.Handler = mw
-		xlog.Infof(context.Background(), "%s reload ok, processors:%s", fun, processor)
+		logger().Infof(context.Background(), "%s reload ok, processors:%s", fun, processor)
 	default:
 		return fmt.Errorf("processor:%s driver not recognition", processor)
 	}
@@ -0,0 +1,252 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSConf tls config of processor listener, certificate is loaded from files or from config center
+type TLSConf struct {
+	CertFile string
+	KeyFile  string
+	// CertConfKey KeyConfKey 配置中心 application namespace 中 PEM 格式证书及私钥的 key, 配置变更后新连接使用新证书
+	CertConfKey string
+	KeyConfKey  string
+	// ClientCAFile 或 ClientCAConfKey 非空时开启双向认证, 校验客户端证书
+	ClientCAFile    string
+	ClientCAConfKey string
+	// ClientAuthOptional 双向认证时允许客户端不提供证书
+	ClientAuthOptional bool
+	// Identity 使用服务身份证书开启双向认证, 见 WithServiceIdentity, 此时忽略以上证书配置
+	Identity bool
+}
+
+// TLSProcessor processor whose listener serves TLS, the scheme is advertised in ServInfo
+// so that clients dial with transport security; extra addresses use ListenAddr.TLS instead
+type TLSProcessor interface {
+	Processor
+	TLSConf() *TLSConf
+}
+
+func tlsConfOf(p Processor) *TLSConf {
+	if lazy, ok := p.(*lazyProcessor); ok {
+		p = lazy.Processor
+	}
+	if tp, ok := p.(TLSProcessor); ok {
+		return tp.TLSConf()
+	}
+	return nil
+}
+
+// serverConfig m 为 nil 时返回 nil, 表示不开启 TLS
+func (m *TLSConf) serverConfig() (*tls.Config, error) {
+	if m == nil {
+		return nil, nil
+	}
+	if m.Identity {
+		identity := getServiceIdentity()
+		if identity == nil {
+			return nil, errors.New("service identity not enabled")
+		}
+		return identity.serverConfig(m.ClientAuthOptional), nil
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch {
+	case len(m.CertFile) > 0:
+		cert, err := tls.LoadX509KeyPair(m.CertFile, m.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load cert file: %s err: %v", m.CertFile, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	case len(m.CertConfKey) > 0:
+		loader := &confCertLoader{certKey: m.CertConfKey, keyKey: m.KeyConfKey}
+		if _, err := loader.load(); err != nil {
+			return nil, err
+		}
+		cfg.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return loader.load()
+		}
+	default:
+		return nil, errors.New("tls cert not configured")
+	}
+
+	var caPEM []byte
+	switch {
+	case len(m.ClientCAFile) > 0:
+		b, err := ioutil.ReadFile(m.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca file: %s err: %v", m.ClientCAFile, err)
+		}
+		caPEM = b
+	case len(m.ClientCAConfKey) > 0:
+		s, err := getConfString(m.ClientCAConfKey)
+		if err != nil {
+			return nil, err
+		}
+		caPEM = []byte(s)
+	}
+	if len(caPEM) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("invalid client ca")
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		if m.ClientAuthOptional {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return cfg, nil
+}
+
+func getConfString(key string) (string, error) {
+	cc := GetConfigCenter()
+	if cc == nil {
+		return "", fmt.Errorf("config center not init, key: %s", key)
+	}
+	s, ok := cc.GetString(context.TODO(), key)
+	if !ok || len(s) == 0 {
+		return "", fmt.Errorf("config key: %s not found", key)
+	}
+	return s, nil
+}
+
+// confCertLoader 握手时读取配置, 内容变化时重新解析
+type confCertLoader struct {
+	certKey string
+	keyKey  string
+
+	mu   sync.Mutex
+	pem  string
+	cert *tls.Certificate
+}
+
+func (m *confCertLoader) load() (*tls.Certificate, error) {
+	fun := "confCertLoader.load -->"
+
+	certPEM, err := getConfString(m.certKey)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := getConfString(m.keyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cert != nil && m.pem == certPEM+keyPEM {
+		return m.cert, nil
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		// 新配置有误时继续使用旧证书
+		logger().Errorf(context.Background(), "%s parse cert key: %s err: %v", fun, m.certKey, err)
+		if m.cert != nil {
+			return m.cert, nil
+		}
+		return nil, err
+	}
+	logger().Infof(context.Background(), "%s cert key: %s loaded", fun, m.certKey)
+	m.pem, m.cert = certPEM+keyPEM, &cert
+	return m.cert, nil
+}
+
+// grpcTLSListener 握手在 listenerCreds 中完成
+func grpcTLSListener(lis net.Listener, tlsConfig *tls.Config) net.Listener {
+	cfg := tlsConfig.Clone()
+	cfg.NextProtos = []string{"h2"}
+	return tls.NewListener(lis, cfg)
+}
+
+// listenerCreds 开启 TLS 的监听地址 accept 的连接为 *tls.Conn, 在此完成握手以便通过 peer 获取客户端证书, 其他连接不做处理
+type listenerCreds struct{}
+
+func (listenerCreds) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("listenerCreds is server only")
+}
+
+func (listenerCreds) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, ok := rawConn.(*tls.Conn)
+	if !ok {
+		return rawConn, nil, nil
+	}
+	if err := conn.Handshake(); err != nil {
+		return nil, nil, err
+	}
+	return conn, credentials.TLSInfo{State: conn.ConnectionState()}, nil
+}
+
+func (listenerCreds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{}
+}
+
+func (m listenerCreds) Clone() credentials.TransportCredentials {
+	return m
+}
+
+func (listenerCreds) OverrideServerName(string) error {
+	return nil
+}
+
+var (
+	muClientTLS     sync.Mutex
+	clientTLSConfig *tls.Config
+)
+
+// SetClientTLSConfig set tls config used by grpc and thrift clients to dial instances registered with TLS,
+// default verifies server certificate with system roots, or with service identity if enabled
+func SetClientTLSConfig(cfg *tls.Config) {
+	muClientTLS.Lock()
+	defer muClientTLS.Unlock()
+	clientTLSConfig = cfg
+}
+
+// getClientTLSConfig 开启服务身份时校验对端身份为 servKey
+func getClientTLSConfig(servKey string) *tls.Config {
+	muClientTLS.Lock()
+	defer muClientTLS.Unlock()
+	if clientTLSConfig != nil {
+		return clientTLSConfig.Clone()
+	}
+	if identity := getServiceIdentity(); identity != nil {
+		return identity.clientConfig(servKey)
+	}
+	return &tls.Config{}
+}
+
+type tlsLookup interface {
+	isTLSAddr(addr string) bool
+}
+
+// isTLSAddr addr 对应的实例注册时是否声明开启 TLS
+func (m *ClientEtcdV2) isTLSAddr(addr string) bool {
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+
+	for _, c := range m.servCopy {
+		if c == nil || c.reg == nil {
+			continue
+		}
+		for _, s := range c.reg.Servs {
+			if s.Addr == addr {
+				return s.TLS
+			}
+		}
+	}
+	return false
+}
+
+func dialTLS(cb ClientLookup, addr string) bool {
+	l, ok := cb.(tlsLookup)
+	return ok && l.isTLSAddr(addr)
+}
@@ -0,0 +1,129 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+)
+
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "roc"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestProcessorTLS(t *testing.T) {
+	ass := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "roc_tls")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	cfg, err := (*TLSConf)(nil).serverConfig()
+	ass.Nil(err)
+	ass.Nil(cfg)
+	_, err = (&TLSConf{}).serverConfig()
+	ass.NotNil(err)
+	_, err = (&TLSConf{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}).serverConfig()
+	ass.NotNil(err)
+	cfg, err = (&TLSConf{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile}).serverConfig()
+	ass.Nil(err)
+	ass.Equal(tls.RequireAndVerifyClientCert, cfg.ClientAuth)
+	cfg, err = (&TLSConf{CertFile: certFile, KeyFile: keyFile}).serverConfig()
+	ass.Nil(err)
+
+	clientCfg := &tls.Config{InsecureSkipVerify: true}
+
+	router := httprouter.New()
+	router.GET("/ping", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Write([]byte("pong"))
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	ass.Nil(err)
+	serv := &http.Server{Handler: router}
+	go serveHttp(serv, lis, cfg)
+	defer serv.Close()
+	addr := lis.Addr().String()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientCfg}}
+	resp, err := client.Get("https://" + addr + "/ping")
+	ass.Nil(err)
+	if err == nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		ass.Equal("pong", string(body))
+	}
+
+	var tlsPeer bool
+	srv := grpc.NewServer(grpc.Creds(listenerCreds{}), grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if p, ok := peer.FromContext(ctx); ok {
+			_, tlsPeer = p.AuthInfo.(credentials.TLSInfo)
+		}
+		return handler(ctx, req)
+	}))
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	lis, err = net.Listen("tcp", "127.0.0.1:0")
+	ass.Nil(err)
+	go srv.Serve(grpcTLSListener(lis, cfg))
+	defer srv.Stop()
+	addr = lis.Addr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(credentials.NewTLS(clientCfg)), grpc.WithBlock())
+	ass.Nil(err)
+	if err == nil {
+		defer conn.Close()
+		_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		ass.Nil(err)
+		ass.True(tlsPeer)
+	}
+
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.upServlist(servCopyCollect{
+		1: {servId: 1, reg: &RegData{Servs: map[string]*ServInfo{"proc_grpc": {Type: PROCESSOR_GRPC, Addr: addr, TLS: true}}}, manual: &ManualData{Ctrl: &ServCtrl{Groups: []string{""}}}},
+	})
+	ass.True(dialTLS(cli, addr))
+	ass.False(dialTLS(cli, "127.0.0.1:1"))
+}
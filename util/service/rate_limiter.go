@@ -1,6 +1,15 @@
 package rocserv
 
-import "gitlab.pri.ibanyu.com/middleware/dolphin/rate_limit/registry"
+import (
+	"context"
+	"net/http"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/gin-gonic/gin"
+	"gitlab.pri.ibanyu.com/middleware/dolphin/rate_limit"
+	"gitlab.pri.ibanyu.com/middleware/dolphin/rate_limit/registry"
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
 
 var (
 	rateLimitRegistry registry.InterfaceRateLimitRegistry
@@ -9,7 +18,83 @@ var (
 const UNSPECIFIED_CALLER = "NULL"
 
 // 获取接口限流的 registry 管理对象。
-// thrift 服务，无法直接在 roc 里面统一搞定限流。暴露这个函数，以供 codegen 使用。
+// thrift 服务已经由 rateLimitProcessor 统一限流, codegen 不需要再调用。
 func GetInterfaceRateLimitRegistry() registry.InterfaceRateLimitRegistry {
 	return rateLimitRegistry
 }
+
+// interfaceRateLimit 按接口限流, 接口名 http 为路由, grpc 为方法名, thrift 为 message 名
+func interfaceRateLimit(ctx context.Context, interfaceName string) error {
+	// 降级启动时可能未初始化
+	if rateLimitRegistry == nil {
+		return nil
+	}
+	// 暂时不支持按照调用方限流
+	caller := UNSPECIFIED_CALLER
+	err := rateLimitRegistry.InterfaceRateLimit(ctx, interfaceName, caller)
+	if err == rate_limit.ErrRateLimited {
+		group, service := GetGroupAndService()
+		_metricServerRateLimited.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelAPI, interfaceName).Inc()
+		logger().Warnf(ctx, "rate limited: method=%s, caller=%s", interfaceName, caller)
+	}
+	return err
+}
+
+// rateLimitHandler http 路由限流, 被限流时返回 429
+func rateLimitHandler(route string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := interfaceRateLimit(c.Request.Context(), route)
+		if err == rate_limit.ErrRateLimited {
+			c.AbortWithStatus(http.StatusTooManyRequests)
+		} else if err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+}
+
+// rateLimitProcessor thrift 限流
+type rateLimitProcessor struct {
+	thrift.TProcessor
+}
+
+func (m *rateLimitProcessor) Process(in, out thrift.TProtocol) (bool, thrift.TException) {
+	name, typeId, seqid, err := in.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+	if err := interfaceRateLimit(context.Background(), name); err != nil {
+		return rejectThriftMessage(in, out, name, seqid, err.Error())
+	}
+	return m.TProcessor.Process(&messageBeginProtocol{TProtocol: in, name: name, typeId: typeId, seqid: seqid}, out)
+}
+
+// rejectThriftMessage 跳过请求参数并返回 application exception, 连接继续可用
+func rejectThriftMessage(in, out thrift.TProtocol, name string, seqid int32, msg string) (bool, thrift.TException) {
+	in.Skip(thrift.STRUCT)
+	in.ReadMessageEnd()
+	x := thrift.NewTApplicationException(thrift.INTERNAL_ERROR, msg)
+	out.WriteMessageBegin(name, thrift.EXCEPTION, seqid)
+	x.Write(out)
+	out.WriteMessageEnd()
+	if err := out.Flush(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// messageBeginProtocol 返回已读取的 message 头, 之后读取原 protocol
+type messageBeginProtocol struct {
+	thrift.TProtocol
+	name   string
+	typeId thrift.TMessageType
+	seqid  int32
+	read   bool
+}
+
+func (m *messageBeginProtocol) ReadMessageBegin() (string, thrift.TMessageType, int32, error) {
+	if m.read {
+		return m.TProtocol.ReadMessageBegin()
+	}
+	m.read = true
+	return m.name, m.typeId, m.seqid, nil
+}
@@ -0,0 +1,110 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gitlab.pri.ibanyu.com/middleware/dolphin/rate_limit"
+)
+
+// limitedRegistry 对 limited 中的接口限流
+type limitedRegistry struct {
+	limited map[string]bool
+}
+
+func (m *limitedRegistry) InterfaceRateLimit(ctx context.Context, iface, caller string) error {
+	if m.limited[iface] {
+		return rate_limit.ErrRateLimited
+	}
+	return nil
+}
+
+type echoProcessor struct {
+	name string
+}
+
+func (m *echoProcessor) Process(in, out thrift.TProtocol) (bool, thrift.TException) {
+	name, _, _, err := in.ReadMessageBegin()
+	if err != nil {
+		return false, err
+	}
+	m.name = name
+	return true, nil
+}
+
+func TestInterfaceRateLimit(t *testing.T) {
+	ass := assert.New(t)
+
+	old := rateLimitRegistry
+	defer func() { rateLimitRegistry = old }()
+
+	rateLimitRegistry = nil
+	ass.Nil(interfaceRateLimit(context.Background(), "GetUser"))
+
+	rateLimitRegistry = &limitedRegistry{limited: map[string]bool{"/api/user": true, "GetUser": true}}
+	ass.Equal(rate_limit.ErrRateLimited, interfaceRateLimit(context.Background(), "GetUser"))
+	ass.Nil(interfaceRateLimit(context.Background(), "GetOrder"))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/user", rateLimitHandler("/api/user"), func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/api/order", rateLimitHandler("/api/order"), func(c *gin.Context) { c.Status(http.StatusOK) })
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/user", nil))
+	ass.Equal(http.StatusTooManyRequests, w.Code)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/order", nil))
+	ass.Equal(http.StatusOK, w.Code)
+
+	writeCall := func(name string, seqid int32) thrift.TProtocol {
+		in := thrift.NewTBinaryProtocolTransport(thrift.NewTMemoryBuffer())
+		ass.Nil(in.WriteMessageBegin(name, thrift.CALL, seqid))
+		ass.Nil(in.WriteStructBegin("args"))
+		ass.Nil(in.WriteFieldStop())
+		ass.Nil(in.WriteStructEnd())
+		ass.Nil(in.WriteMessageEnd())
+		return in
+	}
+
+	next := &echoProcessor{}
+	out := thrift.NewTBinaryProtocolTransport(thrift.NewTMemoryBuffer())
+	ok, terr := (&rateLimitProcessor{next}).Process(writeCall("GetUser", 3), out)
+	ass.True(ok)
+	ass.Nil(terr)
+	ass.Equal("", next.name)
+	name, typeId, seqid, err := out.ReadMessageBegin()
+	ass.Nil(err)
+	ass.Equal("GetUser", name)
+	ass.Equal(thrift.EXCEPTION, typeId)
+	ass.Equal(int32(3), seqid)
+
+	ok, terr = (&rateLimitProcessor{next}).Process(writeCall("GetOrder", 4), out)
+	ass.True(ok)
+	ass.Nil(terr)
+	ass.Equal("GetOrder", next.name)
+}
+
+func TestMessageBeginProtocol(t *testing.T) {
+	ass := assert.New(t)
+
+	buf := thrift.NewTMemoryBuffer()
+	p := thrift.NewTBinaryProtocolTransport(buf)
+	ass.Nil(p.WriteMessageBegin("Second", thrift.CALL, 2))
+	ass.Nil(p.WriteMessageEnd())
+
+	m := &messageBeginProtocol{TProtocol: p, name: "First", typeId: thrift.CALL, seqid: 1}
+	name, _, seqid, err := m.ReadMessageBegin()
+	ass.Nil(err)
+	ass.Equal("First", name)
+	ass.Equal(int32(1), seqid)
+
+	name, _, seqid, err = m.ReadMessageBegin()
+	ass.Nil(err)
+	ass.Equal("Second", name)
+	ass.Equal(int32(2), seqid)
+}
@@ -0,0 +1,134 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xnet/xhttp"
+)
+
+// 启动阶段, 全部完成后才 ready
+const (
+	readyStageInit       = "init"
+	readyStageListening  = "listening"
+	readyStageRegistered = "registered"
+)
+
+var readyStages = []string{readyStageInit, readyStageListening, readyStageRegistered}
+
+// readiness 零值可用
+type readiness struct {
+	mu     sync.Mutex
+	stages map[string]bool
+	checks map[string]func() error
+}
+
+func (m *readiness) setStage(stage string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stages == nil {
+		m.stages = make(map[string]bool)
+	}
+	m.stages[stage] = true
+}
+
+func (m *readiness) addCheck(name string, check func() error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.checks == nil {
+		m.checks = make(map[string]func() error)
+	}
+	m.checks[name] = check
+}
+
+// check name -> 未就绪原因, 空表示就绪
+func (m *readiness) check() map[string]string {
+	m.mu.Lock()
+	res := make(map[string]string)
+	for _, stage := range readyStages {
+		if !m.stages[stage] {
+			res[stage] = "not completed"
+		}
+	}
+	checks := make(map[string]func() error, len(m.checks))
+	for name, check := range m.checks {
+		checks[name] = check
+	}
+	m.mu.Unlock()
+
+	// 自定义检查在锁外执行, 避免慢检查阻塞其他请求
+	for name, check := range checks {
+		if err := check(); err != nil {
+			res[name] = err.Error()
+		}
+	}
+	return res
+}
+
+// AddReadinessCheck add app readiness check reported by /readyz of backdoor,
+// service is not ready while check returns error; check with the same name is replaced
+func (m *ServBaseV2) AddReadinessCheck(name string, check func() error) {
+	m.readiness.addCheck(name, check)
+}
+
+// AddReadinessCheck add readiness check on the servbase, usually in initLogic such as warming up caches
+func AddReadinessCheck(name string, check func() error) error {
+	sb, err := getServBaseV2()
+	if err != nil {
+		return err
+	}
+	sb.AddReadinessCheck(name, check)
+	return nil
+}
+
+// ==============================
+// Healthz liveness probe, ok as long as backdoor is serving
+type Healthz struct {
+}
+
+func FactoryHealthz() xhttp.HandleRequest {
+	return new(Healthz)
+}
+
+func (m *Healthz) Handle(r *xhttp.HttpRequest) xhttp.HttpResponse {
+	return xhttp.NewHttpRespString(200, "ok")
+}
+
+// ==============================
+// Readyz readiness probe, 503 with not ready reasons until init func returned,
+// processors listening, registration completed and app checks passed
+type Readyz struct {
+}
+
+func FactoryReadyz() xhttp.HandleRequest {
+	return new(Readyz)
+}
+
+func (m *Readyz) Handle(r *xhttp.HttpRequest) xhttp.HttpResponse {
+	fun := "Readyz -->"
+
+	sb, ok := server.sbase.(*ServBaseV2)
+	var failed map[string]string
+	if !ok || sb == nil {
+		failed = map[string]string{readyStageInit: "not completed"}
+	} else if sb.isStop() {
+		failed = map[string]string{"stop": "server stopping"}
+	} else {
+		failed = sb.readiness.check()
+	}
+	if len(failed) == 0 {
+		return xhttp.NewHttpRespString(200, "ok")
+	}
+
+	names := make([]string, 0, len(failed))
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	logger().Infof(context.Background(), "%s not ready: %v", fun, names)
+
+	s, _ := json.Marshal(failed)
+	return xhttp.NewHttpRespString(503, string(s))
+}
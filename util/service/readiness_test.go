@@ -0,0 +1,35 @@
+package rocserv
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadiness(t *testing.T) {
+	ass := assert.New(t)
+
+	sb := &ServBaseV2{}
+	ass.Len(sb.readiness.check(), len(readyStages))
+
+	for _, stage := range readyStages {
+		sb.readiness.setStage(stage)
+	}
+	ass.Empty(sb.readiness.check())
+
+	dbErr := errors.New("db not connected")
+	sb.AddReadinessCheck("db", func() error { return dbErr })
+	ass.Equal(map[string]string{"db": "db not connected"}, sb.readiness.check())
+
+	dbErr = nil
+	ass.Empty(sb.readiness.check())
+
+	old := server.sbase
+	defer func() { server.sbase = old }()
+	server.sbase = nil
+	ass.Equal(ErrServBaseNotInit, AddReadinessCheck("cache", func() error { return nil }))
+	server.sbase = sb
+	ass.Nil(AddReadinessCheck("cache", func() error { return errors.New("cache warming") }))
+	ass.Equal(map[string]string{"cache": "cache warming"}, sb.readiness.check())
+}
@@ -0,0 +1,227 @@
+package rocserv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+const (
+	// 配置中心 application namespace 中首次注册前的最大随机延迟毫秒数, 0 为不延迟;
+	// 大量实例同时发布重启时, 打散注册写入及 client 端的重新解析
+	registerJitterConfKey = "register_jitter_ms"
+
+	registerTTL             = 60 * time.Second
+	registerRefreshInterval = 20 * time.Second
+	// 同一时间发起的多个路径注册合并为一次写入
+	registerCoalesce = 100 * time.Millisecond
+)
+
+// etcdBatchKeysAPI 支持在一个事务内写入多个 key 的 etcd, 由 etcd v3 实现
+type etcdBatchKeysAPI interface {
+	// SetBatch 在一个事务中写入所有 key, 共用一个 ttl lease
+	SetBatch(ctx context.Context, kvs map[string]string, ttl time.Duration) error
+	// RefreshBatch 刷新所有 key 的 ttl, 不修改 value, 任一 key 不存在时返回 key not found
+	RefreshBatch(ctx context.Context, keys []string) error
+}
+
+// registerEntry 单个注册路径
+type registerEntry struct {
+	path    string
+	js      string
+	refresh bool
+	created bool
+}
+
+// registerBatch 实例的所有注册路径由一个协程统一创建及刷新
+type registerBatch struct {
+	mu      sync.Mutex
+	entries []*registerEntry
+	kick    chan struct{}
+	once    sync.Once
+}
+
+func (m *registerBatch) add(e *registerEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, old := range m.entries {
+		if old.path == e.path {
+			m.entries[i] = e
+			e = nil
+			break
+		}
+	}
+	if e != nil {
+		m.entries = append(m.entries, e)
+	}
+	m.notifyLocked()
+}
+
+// notify 通知注册协程立即写入未创建的节点
+func (m *registerBatch) notify() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.notifyLocked()
+}
+
+func (m *registerBatch) notifyLocked() {
+	if m.kick == nil {
+		m.kick = make(chan struct{}, 1)
+	}
+	select {
+	case m.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (m *registerBatch) list() []*registerEntry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*registerEntry(nil), m.entries...)
+}
+
+func (m *registerBatch) kicked() <-chan struct{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.kick
+}
+
+func registerJitter() time.Duration {
+	cc := GetConfigCenter()
+	if cc == nil {
+		return 0
+	}
+	ms, ok := cc.GetInt(context.TODO(), registerJitterConfKey)
+	if !ok || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// randDuration [0, d) 的随机时长
+func randDuration(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	muRetryRand.Lock()
+	defer muRetryRand.Unlock()
+	return time.Duration(retryRand.Int63n(int64(d)))
+}
+
+// registerLoop 首次注册前随机延迟, 之后刷新间隔也加入随机量, 避免同时重启的实例一直同步写入
+func (m *ServBaseV2) registerLoop() {
+	fun := "ServBaseV2.registerLoop -->"
+	ctx := context.Background()
+
+	if jitter := randDuration(registerJitter()); jitter > 0 {
+		logger().Infof(ctx, "%s register after jitter: %v", fun, jitter)
+		time.Sleep(jitter)
+	}
+
+	for i := 0; ; i++ {
+		time.Sleep(registerCoalesce)
+		// 本轮会写入所有路径, 丢弃之前的通知
+		select {
+		case <-m.regBatch.kicked():
+		default:
+		}
+		withRegLockRunClosureBeforeStop(m, ctx, fun, func() {
+			m.flushRegister(ctx, i)
+		})
+
+		interval := registerRefreshInterval - registerRefreshInterval/10 + randDuration(registerRefreshInterval/5)
+		select {
+		case <-m.regBatch.kicked():
+		case <-time.After(interval):
+		}
+
+		if m.isStop() {
+			logger().Infof(ctx, "%s server stop, register loop exit", fun)
+			return
+		}
+	}
+}
+
+// flushRegister 创建未创建的节点, 刷新已创建节点的 ttl, 调用方需持有 muReg
+func (m *ServBaseV2) flushRegister(ctx context.Context, round int) {
+	fun := "ServBaseV2.flushRegister -->"
+
+	entries := m.regBatch.list()
+	var roundErr error
+	mark := func(err error, entries ...*registerEntry) {
+		if err != nil && roundErr == nil {
+			roundErr = err
+		}
+		m.markRegistered(ctx, round, err, entries...)
+	}
+	defer func() {
+		m.heartbeat.record(len(entries), roundErr)
+		// 首次全部写入成功后才算注册完成
+		if roundErr == nil && len(entries) > 0 {
+			m.readiness.setStage(readyStageRegistered)
+		}
+	}()
+
+	var writes, refreshes []*registerEntry
+	for _, e := range entries {
+		// 在刷新ttl时候，不允许变更value
+		if e.created && e.refresh {
+			refreshes = append(refreshes, e)
+		} else {
+			writes = append(writes, e)
+		}
+	}
+
+	batch, ok := m.etcdClient.(etcdBatchKeysAPI)
+	if !ok {
+		for _, e := range writes {
+			js := m.getRegisterInfoLocked(e.path, e.js)
+			if !e.created {
+				logger().Warnf(ctx, "%s create node, round: %d path: %s server_info: %s", fun, round, e.path, js)
+			}
+			_, err := m.etcdClient.Set(ctx, e.path, js, &etcd.SetOptions{TTL: registerTTL})
+			mark(err, e)
+		}
+		for _, e := range refreshes {
+			_, err := m.etcdClient.Set(ctx, e.path, "", &etcd.SetOptions{
+				PrevExist: etcd.PrevExist,
+				TTL:       registerTTL,
+				Refresh:   true,
+			})
+			mark(err, e)
+		}
+		return
+	}
+
+	if len(writes) > 0 {
+		kvs := make(map[string]string, len(writes))
+		for _, e := range writes {
+			kvs[e.path] = m.getRegisterInfoLocked(e.path, e.js)
+		}
+		logger().Infof(ctx, "%s batch write, round: %d keys: %d", fun, round, len(kvs))
+		err := batch.SetBatch(ctx, kvs, registerTTL)
+		mark(err, writes...)
+	}
+	if len(refreshes) > 0 {
+		keys := make([]string, 0, len(refreshes))
+		for _, e := range refreshes {
+			keys = append(keys, e.path)
+		}
+		err := batch.RefreshBatch(ctx, keys)
+		mark(err, refreshes...)
+	}
+}
+
+func (m *ServBaseV2) markRegistered(ctx context.Context, round int, err error, entries ...*registerEntry) {
+	fun := "ServBaseV2.markRegistered -->"
+
+	for _, e := range entries {
+		if err != nil {
+			logger().Warnf(ctx, "%s register need create node, round: %d, path: %s err: %v", fun, round, e.path, err)
+		}
+		e.created = err == nil
+	}
+}
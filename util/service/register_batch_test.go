@@ -0,0 +1,80 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeKeysAPI struct {
+	etcd.KeysAPI
+	sets      []string
+	refreshes []string
+	err       error
+}
+
+func (m *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	if opts.Refresh {
+		m.refreshes = append(m.refreshes, key)
+	} else {
+		m.sets = append(m.sets, key+"="+value)
+	}
+	return &etcd.Response{}, m.err
+}
+
+type fakeBatchKeysAPI struct {
+	fakeKeysAPI
+	batches []map[string]string
+}
+
+func (m *fakeBatchKeysAPI) SetBatch(ctx context.Context, kvs map[string]string, ttl time.Duration) error {
+	m.batches = append(m.batches, kvs)
+	return m.err
+}
+
+func (m *fakeBatchKeysAPI) RefreshBatch(ctx context.Context, keys []string) error {
+	m.refreshes = append(m.refreshes, keys...)
+	return m.err
+}
+
+func TestFlushRegister(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	client := &fakeKeysAPI{}
+	sb := &ServBaseV2{etcdClient: client, regInfos: map[string]string{}}
+	sb.regBatch.add(&registerEntry{path: "/a", js: "1", refresh: true})
+	sb.regBatch.add(&registerEntry{path: "/b", js: "2", refresh: false})
+
+	sb.flushRegister(ctx, 0)
+	ass.Equal([]string{"/a=1", "/b=2"}, client.sets)
+
+	sb.regInfos["/b"] = "3"
+	sb.flushRegister(ctx, 1)
+	ass.Equal([]string{"/a"}, client.refreshes)
+	ass.Equal([]string{"/a=1", "/b=2", "/b=3"}, client.sets)
+
+	batch := &fakeBatchKeysAPI{}
+	sb = &ServBaseV2{etcdClient: batch, regInfos: map[string]string{}}
+	sb.regBatch.add(&registerEntry{path: "/a", js: "1", refresh: true})
+	sb.regBatch.add(&registerEntry{path: "/c", js: "2", refresh: true})
+
+	batch.err = fmt.Errorf("etcd down")
+	sb.flushRegister(ctx, 0)
+	// 首次写入成功后才注册完成
+	ass.Contains(sb.readiness.check(), readyStageRegistered)
+	batch.err = nil
+	sb.flushRegister(ctx, 1)
+	ass.NotContains(sb.readiness.check(), readyStageRegistered)
+	ass.Len(batch.batches, 2)
+	ass.Equal(map[string]string{"/a": "1", "/c": "2"}, batch.batches[1])
+	ass.Empty(batch.sets)
+
+	sb.flushRegister(ctx, 2)
+	ass.Len(batch.batches, 2)
+	ass.Equal([]string{"/a", "/c"}, batch.refreshes)
+}
@@ -0,0 +1,93 @@
+package rocserv
+
+import (
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+// HeartbeatStatus health of registration heartbeat, registry nodes of the instance expire after TTL
+// without being refreshed, so a crashed instance disappears from discovery
+type HeartbeatStatus struct {
+	TTL      string `json:"ttl"`
+	Interval string `json:"interval"`
+	Keys     int    `json:"keys"`
+	// 最近一次全部节点写入或刷新成功的时间
+	LastSuccess time.Time `json:"last_success"`
+	LastError   string    `json:"last_error,omitempty"`
+	// 连续失败的轮数
+	Failures int `json:"failures"`
+	// 最近一次成功在 TTL 内, 节点仍然可以被发现
+	Healthy bool `json:"healthy"`
+	// 回读时发现丢失或被修改并重新写入的次数, 见 reconcileRegister
+	Repairs    int       `json:"repairs"`
+	LastRepair time.Time `json:"last_repair,omitempty"`
+}
+
+type registerHeartbeat struct {
+	mu          sync.Mutex
+	keys        int
+	lastSuccess time.Time
+	lastErr     error
+	failures    int
+	repairs     int
+	lastRepair  time.Time
+}
+
+// record 一轮写入或刷新的结果, err 为本轮第一个错误
+func (m *registerHeartbeat) record(keys int, err error) {
+	m.mu.Lock()
+	m.keys = keys
+	if err != nil {
+		m.lastErr = err
+		m.failures++
+	} else {
+		m.lastSuccess = time.Now()
+		m.failures = 0
+	}
+	lastSuccess := m.lastSuccess
+	m.mu.Unlock()
+
+	group, service := GetGroupAndService()
+	if err != nil {
+		_metricRegisterHeartbeatFailures.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Inc()
+	}
+	if !lastSuccess.IsZero() {
+		_metricRegisterHeartbeatAge.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Set(time.Since(lastSuccess).Seconds())
+	}
+}
+
+func (m *registerHeartbeat) recordRepair(reason string) {
+	m.mu.Lock()
+	m.repairs++
+	m.lastRepair = time.Now()
+	m.mu.Unlock()
+
+	group, service := GetGroupAndService()
+	_metricRegisterRepairs.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelReason, reason).Inc()
+}
+
+func (m *registerHeartbeat) status() *HeartbeatStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := &HeartbeatStatus{
+		TTL:         registerTTL.String(),
+		Interval:    registerRefreshInterval.String(),
+		Keys:        m.keys,
+		LastSuccess: m.lastSuccess,
+		Failures:    m.failures,
+		Healthy:     !m.lastSuccess.IsZero() && time.Since(m.lastSuccess) < registerTTL,
+		Repairs:     m.repairs,
+		LastRepair:  m.lastRepair,
+	}
+	if m.lastErr != nil {
+		st.LastError = m.lastErr.Error()
+	}
+	return st
+}
+
+// HeartbeatStatus return health of registration heartbeat of the instance
+func (m *ServBaseV2) HeartbeatStatus() *HeartbeatStatus {
+	return m.heartbeat.status()
+}
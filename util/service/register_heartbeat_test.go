@@ -0,0 +1,50 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterHeartbeat(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	batch := &fakeBatchKeysAPI{}
+	sb := &ServBaseV2{etcdClient: batch, regInfos: map[string]string{}}
+	st := sb.HeartbeatStatus()
+	ass.False(st.Healthy)
+	ass.Equal("1m0s", st.TTL)
+
+	sb.regBatch.add(&registerEntry{path: "/a", js: "1", refresh: true})
+	sb.regBatch.add(&registerEntry{path: "/c", js: "2", refresh: true})
+	batch.err = fmt.Errorf("etcd down")
+	sb.flushRegister(ctx, 0)
+	sb.flushRegister(ctx, 1)
+	st = sb.HeartbeatStatus()
+	ass.False(st.Healthy)
+	ass.Equal(2, st.Failures)
+	ass.Equal(2, st.Keys)
+	ass.Equal("etcd down", st.LastError)
+
+	batch.err = nil
+	sb.flushRegister(ctx, 2)
+	st = sb.HeartbeatStatus()
+	ass.True(st.Healthy)
+	ass.Equal(0, st.Failures)
+	ass.WithinDuration(time.Now(), st.LastSuccess, time.Second)
+
+	// 刷新失败但仍在 ttl 内
+	batch.err = fmt.Errorf("etcd down")
+	sb.flushRegister(ctx, 3)
+	st = sb.HeartbeatStatus()
+	ass.True(st.Healthy)
+	ass.Equal(1, st.Failures)
+
+	// 超过 ttl 未刷新成功, 节点已过期
+	sb.heartbeat.lastSuccess = time.Now().Add(-registerTTL)
+	ass.False(sb.HeartbeatStatus().Healthy)
+}
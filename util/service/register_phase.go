@@ -0,0 +1,84 @@
+package rocserv
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// 等待就绪检查通过的间隔
+	regActivateInterval = time.Second
+	// 未就绪时每隔多少次检查输出一次原因
+	regActivateLogEvery = 30
+)
+
+// getRegState 未开启两阶段注册时为 active
+func (m *ServBaseV2) getRegState() string {
+	m.muReg.Lock()
+	defer m.muReg.Unlock()
+	if m.regState == RegStateStarting {
+		return RegStateStarting
+	}
+	return RegStateActive
+}
+
+// announce 之后的注册以 starting 状态写入, 客户端不路由, 需调用 ActivateService 激活
+func (m *ServBaseV2) announce() {
+	m.muReg.Lock()
+	defer m.muReg.Unlock()
+	m.regState = RegStateStarting
+}
+
+// ActivateService switch registration of this instance from starting to active, clients start routing to it;
+// cross dc nodes failed to update are written again by the cross dc register loop;
+// nothing is done if the instance is already active
+func (m *ServBaseV2) ActivateService() error {
+	fun := "ServBaseV2.ActivateService -->"
+	ctx := context.Background()
+
+	m.muReg.Lock()
+	if m.regState != RegStateStarting {
+		m.muReg.Unlock()
+		return nil
+	}
+	servs, crossDC := m.regServs, m.regCrossDC
+	m.regState = RegStateActive
+	m.muReg.Unlock()
+
+	if err := m.UpdateService(servs); err != nil {
+		logger().Errorf(ctx, "%s update service err: %v", fun, err)
+		m.announce()
+		return err
+	}
+	// v1 在 announce 时未注册, 这里注册后由注册协程刷新
+	if err := m.RegisterServiceV1(servs, false); err != nil {
+		logger().Errorf(ctx, "%s register server v1 err: %v", fun, err)
+		return err
+	}
+	if crossDC {
+		if err := m.RegisterServiceV1(servs, true); err != nil {
+			logger().Errorf(ctx, "%s register cross dc server v1 err: %v", fun, err)
+			return err
+		}
+	}
+	logger().Infof(ctx, "%s servid: %d activated", fun, m.servId)
+	return nil
+}
+
+// activateWhenReady 就绪检查全部通过后激活, 一直未就绪的实例保持 starting, 平台可以看到预热失败的实例
+func (m *ServBaseV2) activateWhenReady() {
+	fun := "ServBaseV2.activateWhenReady -->"
+	ctx := context.Background()
+
+	st := time.Now()
+	for i := 0; !m.isStop(); i++ {
+		if res := m.readiness.check(); len(res) > 0 {
+			if i%regActivateLogEvery == 0 {
+				logger().Warnf(ctx, "%s not ready after %v: %v", fun, time.Since(st), res)
+			}
+		} else if err := m.ActivateService(); err == nil {
+			return
+		}
+		time.Sleep(regActivateInterval)
+	}
+}
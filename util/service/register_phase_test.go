@@ -0,0 +1,92 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterPhase(t *testing.T) {
+	ass := assert.New(t)
+
+	// 老版本服务端没有 state, 视为 active
+	var rd RegData
+	ass.Nil(json.Unmarshal([]byte(`{"servs":{"proc_grpc":{"type":"grpc","addr":"127.0.0.1:9000"}},"lane":""}`), &rd))
+	ass.True(rd.IsActive())
+
+	sb := &ServBaseV2{}
+	ass.Equal(RegStateActive, sb.getRegState())
+	sb.announce()
+	ass.Equal(RegStateStarting, sb.getRegState())
+
+	starting := zoneServCopy(2, "a", 100)
+	starting.reg.State = RegStateStarting
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.upServlist(servCopyCollect{
+		1: zoneServCopy(1, "a", 100),
+		2: starting,
+	})
+	servs := cli.GetAllServAddr("proc_grpc")
+	ass.Len(servs, 1)
+	ass.Equal("127.0.0.1:9000", servs[0].Addr)
+	ass.Nil(cli.GetServAddrWithServid(2, "proc_grpc", ""))
+	ass.Len(cli.GetAllServAddrWithGroup("", "proc_grpc"), 1)
+
+	// 平台及管理页面可以看到 starting 的实例
+	route := cli.routingTable()
+	ass.Len(route.Instances, 2)
+	ass.Equal(RegStateStarting, route.Instances[1].State)
+}
+
+func TestActivateCrossDC(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	local := &memKeysAPI{values: map[string]*etcd.Node{}}
+	cross := &memKeysAPI{values: map[string]*etcd.Node{}}
+	sb := &ServBaseV2{
+		etcdClient:           local,
+		crossRegisterClients: map[string]etcd.KeysAPI{"1": cross},
+		confEtcd:             configEtcd{useBaseloc: "/roc"},
+		servLocation:         "base/account",
+		servId:               1,
+		regInfos:             map[string]string{},
+	}
+	pathV2 := fmt.Sprintf("/roc/%s/base/account/1/%s", BASE_LOC_DIST_V2, BASE_LOC_REG_SERV)
+	pathV1 := fmt.Sprintf("/roc/%s/base/account/1", BASE_LOC_DIST)
+	state := func(kv *memKeysAPI) string {
+		var rd RegData
+		ass.Nil(json.Unmarshal([]byte(kv.values[pathV2].Value), &rd))
+		return rd.State
+	}
+
+	// 跨机房节点以 starting 创建, 之后只刷新 ttl
+	sb.announce()
+	starting := `{"state":"starting"}`
+	sb.regInfos[pathV2] = starting
+	written := sb.crossDCRegisterRound(ctx, "1", pathV2, starting, "", true, 0)
+	ass.Equal(starting, written)
+	ass.Equal(written, sb.crossDCRegisterRound(ctx, "1", pathV2, starting, written, true, 1))
+	ass.Equal(RegStateStarting, state(cross))
+
+	// 激活时未写入成功的跨机房节点, 下一轮以新的注册信息重新写入
+	sb.regInfos[pathV2] = `{"state":"active"}`
+	ass.Equal(`{"state":"active"}`, sb.crossDCRegisterRound(ctx, "1", pathV2, starting, written, true, 2))
+	ass.Equal(RegStateActive, state(cross))
+
+	// 激活时直接更新本机房及跨机房节点, 停止后注册协程不再写入
+	sb.setStatusToStop()
+	sb.announce()
+	cross.values[pathV2].Value = starting
+	sb.regServs = map[string]*ServInfo{"proc_grpc": {Type: PROCESSOR_GRPC, Addr: "127.0.0.1:9000"}}
+	sb.regCrossDC = true
+	ass.Nil(sb.ActivateService())
+	ass.Equal(RegStateActive, sb.getRegState())
+	ass.Equal(RegStateActive, state(local))
+	ass.Equal(RegStateActive, state(cross))
+	ass.NotNil(cross.values[pathV1])
+}
@@ -0,0 +1,121 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+const (
+	// 配置中心 application namespace 中回读校验注册节点的间隔秒数, 小于 0 关闭, 默认 60 秒
+	registerReconcileConfKey = "register_reconcile_interval_s"
+
+	registerReconcileInterval = time.Minute
+
+	registerRepairMissing  = "missing"
+	registerRepairMismatch = "mismatch"
+)
+
+func registerReconcileConf() time.Duration {
+	cc := GetConfigCenter()
+	if cc == nil {
+		return registerReconcileInterval
+	}
+	n, ok := cc.GetInt(context.TODO(), registerReconcileConfKey)
+	if !ok || n == 0 {
+		return registerReconcileInterval
+	}
+	if n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// reconcileLoop 刷新 ttl 不检查内容, etcd 压缩或从备份恢复后节点的值可能与注册的不一致, 定期回读校验
+func (m *ServBaseV2) reconcileLoop() {
+	fun := "ServBaseV2.reconcileLoop -->"
+	ctx := context.Background()
+
+	for {
+		interval := registerReconcileConf()
+		if interval <= 0 {
+			// 关闭时按默认间隔检查配置
+			time.Sleep(registerReconcileInterval)
+		} else {
+			time.Sleep(interval)
+		}
+		if m.isStop() {
+			logger().Infof(ctx, "%s server stop, reconcile loop exit", fun)
+			return
+		}
+		if interval > 0 {
+			m.reconcileRegister(ctx)
+		}
+	}
+}
+
+// reconcileRegister 回读已创建的节点, 丢失或内容不一致时标记为未创建, 由注册协程重新写入; 返回修复的节点数
+func (m *ServBaseV2) reconcileRegister(ctx context.Context) int {
+	fun := "ServBaseV2.reconcileRegister -->"
+
+	repaired := 0
+	for _, e := range m.regBatch.list() {
+		m.muReg.Lock()
+		created := e.created
+		m.muReg.Unlock()
+		// 未创建的节点由注册协程重试
+		if !created {
+			continue
+		}
+
+		r, err := m.etcdClient.Get(ctx, e.path, nil)
+		var reason string
+		if etcd.IsKeyNotFound(err) {
+			reason = registerRepairMissing
+		} else if err != nil {
+			logger().Warnf(ctx, "%s get path: %s err: %v", fun, e.path, err)
+			continue
+		}
+
+		m.muReg.Lock()
+		expected := m.getRegisterInfoLocked(e.path, e.js)
+		if len(reason) == 0 && (r == nil || r.Node == nil || !sameRegisterValue(r.Node.Value, expected)) {
+			reason = registerRepairMismatch
+		}
+		if len(reason) > 0 {
+			e.created = false
+		}
+		m.muReg.Unlock()
+		if len(reason) == 0 {
+			continue
+		}
+
+		var actual string
+		if r != nil && r.Node != nil {
+			actual = r.Node.Value
+		}
+		logger().Warnf(ctx, "%s repair path: %s reason: %s actual: %s expected: %s", fun, e.path, reason, actual, expected)
+		m.heartbeat.recordRepair(reason)
+		repaired++
+	}
+
+	if repaired > 0 {
+		m.regBatch.notify()
+	}
+	return repaired
+}
+
+// sameRegisterValue 注册的值为 json, 忽略格式差异
+func sameRegisterValue(actual, expected string) bool {
+	if actual == expected {
+		return true
+	}
+	var a, b interface{}
+	if json.Unmarshal([]byte(actual), &a) != nil || json.Unmarshal([]byte(expected), &b) != nil {
+		return false
+	}
+	return reflect.DeepEqual(a, b)
+}
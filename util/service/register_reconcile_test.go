@@ -0,0 +1,56 @@
+package rocserv
+
+import (
+	"context"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileRegister(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	client := &memKeysAPI{values: map[string]*etcd.Node{}}
+	sb := &ServBaseV2{etcdClient: client, regInfos: map[string]string{}}
+	for path, js := range map[string]string{"/a": `{"x":1,"y":[1,2]}`, "/b": `{"x":2}`, "/c": `{"x":3}`} {
+		sb.addRegisterInfo(path, js)
+		sb.regBatch.add(&registerEntry{path: path, js: js, refresh: true})
+	}
+	// 未创建的节点不校验
+	ass.Equal(0, sb.reconcileRegister(ctx))
+
+	sb.flushRegister(ctx, 0)
+	ass.Equal(0, sb.reconcileRegister(ctx))
+	<-sb.regBatch.kicked()
+
+	// 只有格式不同的视为一致
+	client.values["/a"].Value = `{"y": [1, 2], "x": 1}`
+	delete(client.values, "/b")
+	client.values["/c"].Value = `{"x":0}`
+	ass.Equal(2, sb.reconcileRegister(ctx))
+	select {
+	case <-sb.regBatch.kicked():
+	default:
+		ass.Fail("register loop not notified")
+	}
+	st := sb.HeartbeatStatus()
+	ass.Equal(2, st.Repairs)
+	ass.False(st.LastRepair.IsZero())
+
+	for _, e := range sb.regBatch.list() {
+		ass.Equal(e.path == "/a", e.created, e.path)
+	}
+	sb.flushRegister(ctx, 1)
+	ass.Equal(`{"x":2}`, client.values["/b"].Value)
+	ass.Equal(`{"x":3}`, client.values["/c"].Value)
+
+	// UpdateService 等更新的值为准
+	sb.addRegisterInfo("/c", `{"x":4}`)
+	ass.Equal(1, sb.reconcileRegister(ctx))
+
+	ass.True(sameRegisterValue(`{"a":1}`, `{ "a" : 1 }`))
+	ass.False(sameRegisterValue(`{"a":1}`, `{"a":2}`))
+	ass.False(sameRegisterValue("", `{"a":1}`))
+}
@@ -9,14 +9,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
-
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
 
 	etcd "github.com/coreos/etcd/client"
@@ -27,12 +27,14 @@ type servCopyStr struct {
 	servId int
 	reg    string
 	manual string
+	load   string
 }
 
 type servCopyData struct {
 	servId int
 	reg    *RegData
 	manual *ManualData
+	load   *InstanceLoad
 }
 
 type servCopyCollect map[int]*servCopyData
@@ -50,9 +52,43 @@ type ClientEtcdV2 struct {
 	// 缓存地址列表，按照service id 降序的顺序存储
 	// 按照processor 进行分组
 
+	// 串行更新路由, 注册中心变更与覆盖文件变更可能并发
+	muUpServlist sync.Mutex
+
 	muServlist sync.Mutex
 	servCopy   servCopyCollect
-	servHash   map[string]*consistent.Consistent
+	// 注册中心的实例列表, 人工覆盖时 servCopy 为覆盖的地址
+	registryCopy servCopyCollect
+	overridden   bool
+	// 本地快照文件, 为空时不保存; 使用快照时为快照的保存时间
+	snapshotPath string
+	staleSince   time.Time
+	servHash     map[string]*consistent.Consistent
+	// group -> zone -> hash, 只包含声明了可用区的实例
+	zoneHash map[string]map[string]*consistent.Consistent
+	// processor -> 可路由的地址及全部实例, 注册中心更新时生成
+	servList  map[string][]*ServInfo
+	instances map[string][]InstanceSnapshot
+	// method -> 服务端声明的废弃信息, 更新路由时生成, 每次调用时查询不加锁
+	deprecations atomic.Value
+
+	// 实例变更回调, 在更新路由的协程中依次调用
+	muChange  sync.Mutex
+	changeID  int
+	changeFns map[int]func(added, removed, updated []*ServInfo)
+
+	// 为空时使用一致性 hash
+	balancer LoadBalancer
+	// 为空时不做实例熔断
+	breaker *instanceBreakers
+	// 为空时不做灰度分流
+	canary *CanaryRule
+	// 为空时不区分可用区
+	zone *ZoneConf
+
+	// 首次从注册中心拿到实例列表时关闭, 本地快照不算
+	muReady sync.Mutex
+	ready   chan struct{}
 }
 
 func checkDistVersion(client etcd.KeysAPI, prefloc, servlocation string) string {
@@ -61,9 +97,10 @@ func checkDistVersion(client etcd.KeysAPI, prefloc, servlocation string) string
 
 	path := fmt.Sprintf("%s/%s/%s", prefloc, BASE_LOC_DIST_V2, servlocation)
 
+	waitRegistryRead(ctx, path)
 	r, err := client.Get(context.Background(), path, &etcd.GetOptions{Recursive: true, Sort: false})
 	if err == nil {
-		xlog.Infof(ctx, "%s check dist v2 ok path:%s", fun, path)
+		logger().Infof(ctx, "%s check dist v2 ok path:%s", fun, path)
 		for _, n := range r.Node.Nodes {
 			for _, nc := range n.Nodes {
 				if nc.Key == n.Key+"/"+BASE_LOC_REG_SERV && len(nc.Value) > 0 {
@@ -73,19 +110,20 @@ func checkDistVersion(client etcd.KeysAPI, prefloc, servlocation string) string
 		}
 	}
 
-	xlog.Warnf(ctx, "%s check dist v2 path: %s err: %v", fun, path, err)
+	logger().Warnf(ctx, "%s check dist v2 path: %s err: %v", fun, path, err)
 
 	path = fmt.Sprintf("%s/%s/%s", prefloc, BASE_LOC_DIST, servlocation)
 
+	waitRegistryRead(ctx, path)
 	r, err = client.Get(context.Background(), path, &etcd.GetOptions{Recursive: true, Sort: false})
 	if err == nil {
-		xlog.Infof(ctx, "%s check dist v1 ok path:%s", fun, path)
+		logger().Infof(ctx, "%s check dist v1 ok path:%s", fun, path)
 		if len(r.Node.Nodes) > 0 {
 			return BASE_LOC_DIST
 		}
 	}
 
-	xlog.Warnf(ctx, "%s use v2 if check dist v1 path: %s err: %v", fun, path, err)
+	logger().Warnf(ctx, "%s use v2 if check dist v1 path: %s err: %v", fun, path, err)
 
 	return BASE_LOC_DIST_V2
 }
@@ -93,44 +131,52 @@ func checkDistVersion(client etcd.KeysAPI, prefloc, servlocation string) string
 func NewClientEtcdV2(confEtcd configEtcd, servlocation string) (*ClientEtcdV2, error) {
 	//fun := "NewClientEtcdV2 -->"
 
-	cfg := etcd.Config{
-		Endpoints: confEtcd.etcdAddrs,
-		Transport: etcd.DefaultTransport,
-	}
-
-	c, err := etcd.New(cfg)
+	confEtcd = confEtcd.resolve(servlocation)
+	client, err := newDiscoveryKeysAPI(confEtcd.etcdAddrs, confEtcd.useBaseloc)
 	if err != nil {
-		return nil, fmt.Errorf("create etchd client cfg error")
+		return nil, err
 	}
 
-	client := etcd.NewKeysAPI(c)
-	if client == nil {
-		return nil, fmt.Errorf("create etchd api error")
+	// 存在拓扑快照时不需要获取全部实例节点检查版本
+	distloc := BASE_LOC_DIST_V2
+	if !hasTopologySnapshot(context.Background(), client, topologySnapshotPath(confEtcd.useBaseloc, servlocation)) {
+		distloc = checkDistVersion(client, confEtcd.useBaseloc, servlocation)
 	}
 
-	distloc := checkDistVersion(client, confEtcd.useBaseloc, servlocation)
-
 	cli := &ClientEtcdV2{
 		confEtcd: confEtcd,
 		servKey:  servlocation,
 		distLoc:  distloc,
 		servPath: fmt.Sprintf("%s/%s/%s", confEtcd.useBaseloc, distloc, servlocation),
 
-		etcdClient: client,
+		etcdClient:   client,
+		breaker:      newInstanceBreakers(servlocation, DefaultInstanceBreakerConf),
+		zone:         defaultZoneConf(),
+		snapshotPath: registrySnapshotPath(servlocation),
 	}
 
-	cli.watch(cli.servPath, cli.parseResponse, time.Second*5)
+	cli.watchServ()
+	// etcd 不可用时使用本地快照, watch 恢复后替换
+	cli.loadSnapshot()
+	cli.watchCanary()
+	registerClientLookup(cli)
+	watchRouteOverride()
 	return cli, nil
 }
 
 func (m *ClientEtcdV2) startWatch(chg chan *etcd.Response, path string) {
 	fun := "ClientEtcdV2.startWatch -->"
 	ctx := context.Background()
+	release := func() {}
+	defer func() { release() }()
 	for i := 0; ; i++ {
+		waitRegistryRead(ctx, path)
 		r, err := m.etcdClient.Get(context.Background(), path, &etcd.GetOptions{Recursive: true, Sort: false})
+		release()
+		release = func() {}
 		if err != nil {
 			// TODO 因为目前breaker都报错key not found，所以用info，这里继续保持info的方式，后续再优化吧
-			xlog.Infof(ctx, "%s get path: %s err: %v", fun, path, err)
+			logger().Infof(ctx, "%s get path: %s err: %v", fun, path, err)
 			close(chg)
 			return
 
@@ -150,19 +196,30 @@ func (m *ClientEtcdV2) startWatch(chg chan *etcd.Response, path string) {
 		}
 		watcher := m.etcdClient.Watcher(path, wop)
 		if watcher == nil {
-			xlog.Errorf(ctx, "%s new watcher path:%s", fun, path)
+			logger().Errorf(ctx, "%s new watcher path:%s", fun, path)
 			close(chg)
 			return
 		}
 
 		resp, err := watcher.Next(context.Background())
+		// index 被压缩时重新 get 全量数据, 不需要重建 watch 循环
+		if isWatchCompacted(err) {
+			release = waitCompactedResync(ctx, watchKindRegistry, path)
+			continue
+		}
+		// 备用集群上的 watch 到期, 重新 Get 时尝试主集群
+		if err == errFallbackWatchExpired {
+			logger().Infof(ctx, "%s watch path: %s %v", fun, path, err)
+			close(chg)
+			return
+		}
 		// etcd 关闭时候会返回
 		if err != nil {
-			xlog.Errorf(ctx, "%s watch path: %s err: %v", fun, path, err)
+			logger().Errorf(ctx, "%s watch path: %s err: %v", fun, path, err)
 			close(chg)
 			return
 		} else {
-			xlog.Infof(ctx, "%s next get idx: %d action: %s nodes: %d index: %d after: %d servPath: %s", fun, i, resp.Action, len(resp.Node.Nodes), resp.Index, wop.AfterIndex, path)
+			logger().Infof(ctx, "%s next get idx: %d action: %s nodes: %d index: %d after: %d servPath: %s", fun, i, resp.Action, len(resp.Node.Nodes), resp.Index, wop.AfterIndex, path)
 			// 测试发现next获取到的返回，index，重新获取总有问题，触发两次，不确定，为什么？为什么？
 			// 所以这里每次next前使用的afterindex都重新get了
 		}
@@ -181,10 +238,10 @@ func (m *ClientEtcdV2) watch(path string, handler func(*etcd.Response), d time.D
 
 	var chg chan *etcd.Response
 	go func() {
-		xlog.Infof(ctx, "%s start watch:%s", fun, path)
+		logger().Infof(ctx, "%s start watch:%s", fun, path)
 		for {
 			if chg == nil {
-				xlog.Infof(ctx, "%s loop watch new receiver:%s", fun, path)
+				logger().Infof(ctx, "%s loop watch new receiver:%s", fun, path)
 				chg = make(chan *etcd.Response)
 				go m.startWatch(chg, path)
 			}
@@ -199,7 +256,7 @@ func (m *ClientEtcdV2) watch(path string, handler func(*etcd.Response), d time.D
 
 				backoff.BackOff()
 			} else {
-				xlog.Infof(ctx, "%s update v:%s serv:%s", fun, r.Node.Key, path)
+				logger().Infof(ctx, "%s update v:%s serv:%s", fun, r.Node.Key, path)
 				handler(r)
 
 				firstOnce.Do(func() {
@@ -213,10 +270,10 @@ func (m *ClientEtcdV2) watch(path string, handler func(*etcd.Response), d time.D
 
 	select {
 	case <-firstSync:
-		xlog.Infof(ctx, "%s init ok, serv:%s", fun, path)
+		logger().Infof(ctx, "%s init ok, serv:%s", fun, path)
 		return
 	case <-time.After(time.Second):
-		xlog.Warnf(ctx, "%s init timeout, serv:%s", fun, path)
+		logger().Warnf(ctx, "%s init timeout, serv:%s", fun, path)
 		return
 	}
 }
@@ -225,7 +282,7 @@ func (m *ClientEtcdV2) parseResponse(r *etcd.Response) {
 	fun := "ClientEtcdV2.parseResponse -->"
 	ctx := context.Background()
 	if !r.Node.Dir {
-		xlog.Errorf(ctx, "%s not dir %s", fun, r.Node.Key)
+		logger().Errorf(ctx, "%s not dir %s", fun, r.Node.Key)
 		return
 	}
 
@@ -234,51 +291,63 @@ func (m *ClientEtcdV2) parseResponse(r *etcd.Response) {
 	} else if m.distLoc == BASE_LOC_DIST_V2 {
 		m.parseResponseV2(r)
 	} else {
-		xlog.Errorf(ctx, "%s not support:%s dir:%s", fun, m.distLoc, r.Node.Key)
+		logger().Errorf(ctx, "%s not support:%s dir:%s", fun, m.distLoc, r.Node.Key)
 	}
 
 }
 
 func (m *ClientEtcdV2) parseResponseV2(r *etcd.Response) {
-	fun := "ClientEtcdV2.parseResponseV2 -->"
+	servCopy, ok := parseServCopyV2(m.servPath, r)
+	if !ok {
+		return
+	}
+	m.upServlist(servCopy)
+}
+
+// parseServCopyV2 解析 dist2 下服务的全部实例节点, 返回 false 时数据不完整, 不更新路由
+func parseServCopyV2(servPath string, r *etcd.Response) (servCopyCollect, bool) {
+	fun := "parseServCopyV2 -->"
 	ctx := context.Background()
 
 	idServ := make(map[int]*servCopyStr)
 	ids := make([]int, 0)
 	for _, n := range r.Node.Nodes {
 		if !n.Dir {
-			xlog.Errorf(context.Background(), "%s not dir %s", fun, n.Key)
-			return
+			logger().Errorf(context.Background(), "%s not dir %s", fun, n.Key)
+			return nil, false
 		}
 
 		sid := n.Key[len(r.Node.Key)+1:]
 		id, err := strconv.Atoi(sid)
 		if err != nil || id < 0 {
-			xlog.Errorf(context.Background(), "%s sid error key:%s", fun, n.Key)
+			logger().Errorf(context.Background(), "%s sid error key:%s", fun, n.Key)
 			continue
 		}
 		ids = append(ids, id)
 
-		var reg, manual string
+		var reg, manual, load string
 		for _, nc := range n.Nodes {
 			if nc.Key == n.Key+"/"+BASE_LOC_REG_SERV {
 				reg = nc.Value
 			} else if nc.Key == n.Key+"/"+BASE_LOC_REG_MANUAL {
 				manual = nc.Value
+			} else if nc.Key == n.Key+"/"+BASE_LOC_REG_LOAD {
+				load = nc.Value
 			}
 		}
 		idServ[id] = &servCopyStr{
 			servId: id,
 			reg:    reg,
 			manual: manual,
+			load:   load,
 		}
 
 	}
 	sort.Ints(ids)
 
-	xlog.Infof(ctx, "%s chg action:%s nodes:%d index:%d servPath:%s len:%d", fun, r.Action, len(r.Node.Nodes), r.Index, m.servPath, len(ids))
+	logger().Infof(ctx, "%s chg action:%s nodes:%d index:%d servPath:%s len:%d", fun, r.Action, len(r.Node.Nodes), r.Index, servPath, len(ids))
 	if len(ids) == 0 {
-		xlog.Errorf(ctx, "%s not found service path:%s please check deploy", fun, m.servPath)
+		logger().Errorf(ctx, "%s not found service path:%s please check deploy", fun, servPath)
 	}
 
 	servCopy := make(servCopyCollect)
@@ -286,7 +355,7 @@ func (m *ClientEtcdV2) parseResponseV2(r *etcd.Response) {
 	for _, i := range ids {
 		is := idServ[i]
 		if is == nil {
-			xlog.Warnf(ctx, "%s serv not found idx:%d servpath:%s", fun, i, m.servPath)
+			logger().Warnf(ctx, "%s serv not found idx:%d servpath:%s", fun, i, servPath)
 			continue
 		}
 
@@ -294,10 +363,10 @@ func (m *ClientEtcdV2) parseResponseV2(r *etcd.Response) {
 		if len(is.reg) > 0 {
 			err := json.Unmarshal([]byte(is.reg), &regd)
 			if err != nil {
-				xlog.Warnf(ctx, "%s servpath: %s sid: %d json: %s error: %v", fun, m.servPath, i, is.reg, err)
+				logger().Warnf(ctx, "%s servpath: %s sid: %d json: %s error: %v", fun, servPath, i, is.reg, err)
 			}
 			if len(regd.Servs) == 0 {
-				xlog.Warnf(ctx, "%s not found copy path: %s sid: %d info: %s please check deploy", fun, m.servPath, i, is.reg)
+				logger().Warnf(ctx, "%s not found copy path: %s sid: %d info: %s please check deploy", fun, servPath, i, is.reg)
 			}
 		}
 
@@ -305,7 +374,7 @@ func (m *ClientEtcdV2) parseResponseV2(r *etcd.Response) {
 		if len(is.manual) > 0 {
 			err := json.Unmarshal([]byte(is.manual), &manual)
 			if err != nil {
-				xlog.Errorf(ctx, "%s servpath: %s json: %s err: %v", fun, m.servPath, is.manual, err)
+				logger().Errorf(ctx, "%s servpath: %s json: %s err: %v", fun, servPath, is.manual, err)
 			}
 		}
 
@@ -317,15 +386,25 @@ func (m *ClientEtcdV2) parseResponseV2(r *etcd.Response) {
 			manual.Ctrl.Groups = append(manual.Ctrl.Groups, "")
 		}
 
+		var load *InstanceLoad
+		if len(is.load) > 0 {
+			load = &InstanceLoad{}
+			if err := json.Unmarshal([]byte(is.load), load); err != nil {
+				logger().Warnf(ctx, "%s servpath: %s load: %s err: %v", fun, servPath, is.load, err)
+				load = nil
+			}
+		}
+
 		servCopy[i] = &servCopyData{
 			servId: i,
 			reg:    &regd,
 			manual: &manual,
+			load:   load,
 		}
 
 	}
 
-	m.upServlist(servCopy)
+	return servCopy, true
 }
 
 func (m *ClientEtcdV2) parseResponseV1(r *etcd.Response) {
@@ -338,18 +417,18 @@ func (m *ClientEtcdV2) parseResponseV1(r *etcd.Response) {
 		sid := n.Key[len(r.Node.Key)+1:]
 		id, err := strconv.Atoi(sid)
 		if err != nil || id < 0 {
-			xlog.Errorf(ctx, "%s sid error key:%s", fun, n.Key)
+			logger().Errorf(ctx, "%s sid error key:%s", fun, n.Key)
 		} else {
-			xlog.Infof(ctx, "%s dist key:%s value:%s", fun, n.Key, n.Value)
+			logger().Infof(ctx, "%s dist key:%s value:%s", fun, n.Key, n.Value)
 			ids = append(ids, id)
 			idServ[id] = n.Value
 		}
 	}
 	sort.Ints(ids)
 
-	xlog.Infof(ctx, "%s chg action:%s nodes:%d index:%d servPath:%s len:%d", fun, r.Action, len(r.Node.Nodes), r.Index, m.servPath, len(ids))
+	logger().Infof(ctx, "%s chg action:%s nodes:%d index:%d servPath:%s len:%d", fun, r.Action, len(r.Node.Nodes), r.Index, m.servPath, len(ids))
 	if len(ids) == 0 {
-		xlog.Errorf(ctx, "%s not found service path:%s please check deploy", fun, m.servPath)
+		logger().Errorf(ctx, "%s not found service path:%s please check deploy", fun, m.servPath)
 	}
 
 	servCopy := make(servCopyCollect)
@@ -360,11 +439,11 @@ func (m *ClientEtcdV2) parseResponseV1(r *etcd.Response) {
 		var servs map[string]*ServInfo
 		err := json.Unmarshal([]byte(s), &servs)
 		if err != nil {
-			xlog.Errorf(ctx, "%s servpath: %s json: %s err: %v", fun, m.servPath, s, err)
+			logger().Errorf(ctx, "%s servpath: %s json: %s err: %v", fun, m.servPath, s, err)
 		}
 
 		if len(servs) == 0 {
-			xlog.Errorf(ctx, "%s not found copy path:%s info:%s please check deploy", fun, m.servPath, s)
+			logger().Errorf(ctx, "%s not found copy path:%s info:%s please check deploy", fun, m.servPath, s)
 		}
 
 		servCopy[i] = &servCopyData{
@@ -387,24 +466,63 @@ func (m *ClientEtcdV2) parseResponseV1(r *etcd.Response) {
 	m.upServlist(servCopy)
 }
 
+// upServlist 记录注册中心的实例列表, 存在人工覆盖时使用覆盖的地址
 func (m *ClientEtcdV2) upServlist(scopy map[int]*servCopyData) {
-	fun := "ClientEtcdV2.upServlist -->"
+	m.muUpServlist.Lock()
+	defer m.muUpServlist.Unlock()
+
+	m.muServlist.Lock()
+	m.registryCopy = scopy
+	stale := m.staleSince
+	m.staleSince = time.Time{}
+	m.muServlist.Unlock()
+	m.applyServlist(scopy)
+	m.markReady()
+
+	if !stale.IsZero() {
+		m.recoverFromSnapshot()
+	}
+	m.saveSnapshot(scopy)
+}
+
+// reapplyRouteOverride 覆盖文件变更后重新生成路由
+func (m *ClientEtcdV2) reapplyRouteOverride() {
+	m.muUpServlist.Lock()
+	defer m.muUpServlist.Unlock()
+
+	m.muServlist.Lock()
+	scopy := m.registryCopy
+	m.muServlist.Unlock()
+	m.applyServlist(scopy)
+}
+
+func (m *ClientEtcdV2) applyServlist(scopy servCopyCollect) {
+	fun := "ClientEtcdV2.applyServlist -->"
 	ctx := context.Background()
 
+	override := getRouteOverride(m.servKey)
+	if override != nil {
+		logger().Warnf(ctx, "%s servkey: %s use route override, instances: %d, registry instances: %d", fun, m.servKey, len(override), len(scopy))
+		scopy = override
+	}
+	// 跨地区或可用区的实例使用其为该类调用方注册的地址
+	region, zone := clientLocality()
+	scopy = localitySelect(scopy, region, zone)
+
 	slist := make(map[string][]string)
 	for sid, c := range scopy {
 		if c == nil {
-			xlog.Infof(ctx, "%s not found copy path:%s sid:%d", fun, m.servPath, sid)
+			logger().Infof(ctx, "%s not found copy path:%s sid:%d", fun, m.servPath, sid)
 			continue
 		}
 
 		if c.reg == nil {
-			xlog.Infof(ctx, "%s not found regdata path:%s sid:%d", fun, m.servPath, sid)
+			logger().Infof(ctx, "%s not found regdata path:%s sid:%d", fun, m.servPath, sid)
 			continue
 		}
 
 		if len(c.reg.Servs) == 0 {
-			xlog.Infof(ctx, "%s not found servs path:%s sid:%d", fun, m.servPath, sid)
+			logger().Infof(ctx, "%s not found servs path:%s sid:%d", fun, m.servPath, sid)
 			continue
 		}
 
@@ -413,7 +531,12 @@ func (m *ClientEtcdV2) upServlist(scopy map[int]*servCopyData) {
 		}
 
 		if c.manual.Ctrl.Disable {
-			xlog.Infof(ctx, "%s disable path:%s sid:%d", fun, m.servPath, sid)
+			logger().Infof(ctx, "%s disable path:%s sid:%d", fun, m.servPath, sid)
+			continue
+		}
+
+		if !c.reg.IsActive() {
+			logger().Infof(ctx, "%s starting path:%s sid:%d", fun, m.servPath, sid)
 			continue
 		}
 
@@ -426,7 +549,7 @@ func (m *ClientEtcdV2) upServlist(scopy map[int]*servCopyData) {
 		lane, ok := c.reg.GetLane()
 		if ok {
 			// 如果lane不为nil, 说明服务端已注册新版本lane元数据, 使用新版本更新泳道实例路由表
-			xlog.Debugf(ctx, "%v use v2 lane metadata, lane: %v, servKey: %s, servPath: %s, sid: %d", fun, lane, m.servKey, m.servPath, c.servId)
+			logger().Debugf(ctx, "%v use v2 lane metadata, lane: %v, servKey: %s, servPath: %s, sid: %d", fun, lane, m.servKey, m.servPath, c.servId)
 			var tmpList []string
 			if _, ok2 := slist[lane]; ok2 {
 				tmpList = slist[lane]
@@ -441,7 +564,7 @@ func (m *ClientEtcdV2) upServlist(scopy map[int]*servCopyData) {
 		// 否则, 说明服务端还是老版本lane元数据 (在manual中), 退回老版本更新泳道路由表
 		var tmpList []string
 		for _, g := range c.manual.Ctrl.Groups {
-			xlog.Debugf(ctx, "%v use v1 lane metadata, lane: %v, servKey: %s, servPath: %s, sid: %d", fun, g, m.servKey, m.servPath, c.servId)
+			logger().Debugf(ctx, "%v use v1 lane metadata, lane: %v, servKey: %s, servPath: %s, sid: %d", fun, g, m.servKey, m.servPath, c.servId)
 			if _, ok := slist[g]; ok {
 				tmpList = slist[g]
 			}
@@ -453,6 +576,8 @@ func (m *ClientEtcdV2) upServlist(scopy map[int]*servCopyData) {
 		}
 	}
 
+	servList, instances := buildInstanceSnapshots(scopy)
+
 	shash := make(map[string]*consistent.Consistent)
 	for group, list := range slist {
 		hash := consistent.NewWithElts(list)
@@ -462,11 +587,16 @@ func (m *ClientEtcdV2) upServlist(scopy map[int]*servCopyData) {
 	}
 
 	m.muServlist.Lock()
-	defer m.muServlist.Unlock()
-
 	m.servHash = shash
+	m.zoneHash = buildZoneHash(slist, scopy)
 	m.servCopy = scopy
-	return
+	old := m.instances
+	m.servList, m.instances = servList, instances
+	m.overridden = override != nil
+	m.muServlist.Unlock()
+	m.deprecations.Store(buildMethodDeprecations(scopy))
+
+	m.notifyChange(old, instances)
 }
 
 func (m *ClientEtcdV2) GetServAddr(processor, key string) *ServInfo {
@@ -475,18 +605,47 @@ func (m *ClientEtcdV2) GetServAddr(processor, key string) *ServInfo {
 }
 
 func (m *ClientEtcdV2) GetServAddrWithGroup(group string, processor, key string) *ServInfo {
-	fun := "ClientEtcdV2.GetServAddrWithGroup-->"
-	ctx := context.Background()
 	m.muServlist.Lock()
 	defer m.muServlist.Unlock()
 
+	s := m.routeWithGroup(group, processor, key)
+	// 候选实例只按熔断状态过滤, 探测名额只由最终选中的实例占用
+	if s != nil && m.breaker != nil {
+		m.breaker.acquire(s.Addr)
+	}
+	return s
+}
+
+func (m *ClientEtcdV2) routeWithGroup(group string, processor, key string) *ServInfo {
+	if m.balancer != nil {
+		return m.pickWithGroup(group, processor, key)
+	}
+
+	if s := m.hashInZone(group, processor, key); s != nil {
+		return s
+	}
+	s := m.hashWithGroup(group, processor, key)
+	if s == nil || m.breaker == nil || !m.breaker.isOpen(s.Addr) {
+		return s
+	}
+	// 实例已熔断, 在其余实例中按 key 选取
+	if h := m.pickHealthy(group, processor, key); h != nil {
+		return h
+	}
+	return s
+}
+
+func (m *ClientEtcdV2) hashWithGroup(group string, processor, key string) *ServInfo {
+	fun := "ClientEtcdV2.GetServAddrWithGroup-->"
+	ctx := context.Background()
+
 	if m.servHash == nil {
-		xlog.Errorf(ctx, "%s m.servHash == nil, serv path:%s hash circle processor:%s key:%s", fun, m.servPath, processor, key)
+		logger().Errorf(ctx, "%s m.servHash == nil, serv path:%s hash circle processor:%s key:%s", fun, m.servPath, processor, key)
 		return nil
 	}
 
 	if m.servHash[""] == nil {
-		xlog.Errorf(ctx, "%s m.servHash[\"\"] == nil, serv path:%s hash circle processor:%s key:%s", fun, m.servPath, processor, key)
+		logger().Errorf(ctx, "%s m.servHash[\"\"] == nil, serv path:%s hash circle processor:%s key:%s", fun, m.servPath, processor, key)
 		return nil
 	}
 
@@ -495,32 +654,185 @@ func (m *ClientEtcdV2) GetServAddrWithGroup(group string, processor, key string)
 		shash = m.servHash[""]
 	}
 
+	return m.getFromHash(shash, processor, key)
+}
+
+func (m *ClientEtcdV2) getFromHash(shash *consistent.Consistent, processor, key string) *ServInfo {
+	fun := "ClientEtcdV2.getFromHash -->"
+	ctx := context.Background()
+
 	s, err := shash.Get(key)
 	if err != nil {
-		xlog.Errorf(ctx, "%s get serv path: %s processor: %s key: %s err: %v", fun, m.servPath, processor, key, err)
+		logger().Errorf(ctx, "%s get serv path: %s processor: %s key: %s err: %v", fun, m.servPath, processor, key, err)
 		return nil
 	}
 
 	idx := strings.Index(s, "-")
 	if idx == -1 {
-		xlog.Fatalf(ctx, "%s servid path: %s, processor: %s, key: %s, sid: %s", fun, m.servPath, processor, key, s)
+		logger().Errorf(ctx, "%s servid path: %s, processor: %s, key: %s, sid: %s", fun, m.servPath, processor, key, s)
 		return nil
 	}
 
 	sid, err := strconv.Atoi(s[:idx])
 	if err != nil || sid < 0 {
-		xlog.Fatalf(ctx, "%s servid path:%s processor:%s key: %s, sid: %s, id: %d, err: %v", fun, m.servPath, processor, key, s, sid, err)
+		logger().Errorf(ctx, "%s servid path:%s processor:%s key: %s, sid: %s, id: %d, err: %v", fun, m.servPath, processor, key, s, sid, err)
 		return nil
 	}
 	return m.getServAddrWithServid(sid, processor, key)
 }
 
+// SetLoadBalancer set load balance policy of GetServAddr, nil means consistent hash
+func (m *ClientEtcdV2) SetLoadBalancer(lb LoadBalancer) {
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+	m.balancer = lb
+}
+
+// pickWithGroup 与一致性 hash 一致, 泳道没有实例时退回到默认泳道
+func (m *ClientEtcdV2) pickWithGroup(group, processor, key string) *ServInfo {
+	fun := "ClientEtcdV2.pickWithGroup -->"
+
+	endpoints := m.endpoints(group, processor)
+	if len(endpoints) == 0 && group != "" {
+		endpoints = m.endpoints("", processor)
+	}
+	if len(endpoints) == 0 {
+		logger().Errorf(context.Background(), "%s no endpoint, serv path: %s processor: %s group: %s", fun, m.servPath, processor, group)
+		return nil
+	}
+	if local := m.localEndpoints(endpoints); len(local) > 0 {
+		return m.balancer.Pick(key, local).Serv
+	}
+	// 全部实例熔断时不过滤, 避免完全不可用
+	if healthy := m.healthyEndpoints(endpoints); len(healthy) > 0 {
+		endpoints = healthy
+	}
+	return m.balancer.Pick(key, endpoints).Serv
+}
+
+func (m *ClientEtcdV2) healthyEndpoints(endpoints []*Endpoint) []*Endpoint {
+	if m.breaker == nil {
+		return endpoints
+	}
+	healthy := make([]*Endpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		if !m.breaker.isOpen(ep.Serv.Addr) {
+			healthy = append(healthy, ep)
+		}
+	}
+	return healthy
+}
+
+// pickHealthy 一致性 hash 选中的实例熔断时使用, 同一 key 尽量落到同一实例
+func (m *ClientEtcdV2) pickHealthy(group, processor, key string) *ServInfo {
+	endpoints := m.endpoints(group, processor)
+	if len(endpoints) == 0 && group != "" {
+		endpoints = m.endpoints("", processor)
+	}
+	healthy := m.healthyEndpoints(endpoints)
+	if len(healthy) == 0 {
+		return nil
+	}
+	return healthy[crc32.ChecksumIEEE([]byte(key))%uint32(len(healthy))].Serv
+}
+
+// SetInstanceBreaker set thresholds of per-instance circuit breaker, nil disables it
+func (m *ClientEtcdV2) SetInstanceBreaker(conf *InstanceBreakerConf) {
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+	if conf == nil {
+		m.breaker = nil
+		return
+	}
+	m.breaker = newInstanceBreakers(m.servKey, *conf)
+}
+
+// ReportInstance report result of request to s, used by per-instance circuit breaker
+func (m *ClientEtcdV2) ReportInstance(s *ServInfo, err error) {
+	m.muServlist.Lock()
+	b := m.breaker
+	m.muServlist.Unlock()
+	if b != nil {
+		b.report(s.Addr, isInstanceFailure(err))
+	}
+}
+
+// AllowInstance whether s is not broken by per-instance circuit breaker, the half-open probe of breaker is consumed,
+// so call it only on the instance picked; use AvailableInstance to filter candidates
+func (m *ClientEtcdV2) AllowInstance(s *ServInfo) bool {
+	m.muServlist.Lock()
+	b := m.breaker
+	m.muServlist.Unlock()
+	return b == nil || b.acquire(s.Addr)
+}
+
+// AvailableInstance whether s is not broken by per-instance circuit breaker, the state of breaker is not changed
+func (m *ClientEtcdV2) AvailableInstance(s *ServInfo) bool {
+	m.muServlist.Lock()
+	b := m.breaker
+	m.muServlist.Unlock()
+	return b == nil || !b.isOpen(s.Addr)
+}
+
+// GetInstanceBreakerStates return addr -> state of broken instances, 1 is open and 2 is half-open
+func (m *ClientEtcdV2) GetInstanceBreakerStates() map[string]int {
+	m.muServlist.Lock()
+	b := m.breaker
+	m.muServlist.Unlock()
+	if b == nil {
+		return nil
+	}
+	return b.states()
+}
+
+func (m *ClientEtcdV2) endpoints(group, processor string) []*Endpoint {
+	var endpoints []*Endpoint
+	for sid, c := range m.servCopy {
+		if c.reg == nil || c.manual == nil || c.manual.Ctrl == nil || c.manual.Ctrl.Disable || !c.reg.IsActive() {
+			continue
+		}
+		if !c.containsLane(group) {
+			continue
+		}
+		if p := c.reg.Servs[processor]; p != nil {
+			endpoints = append(endpoints, &Endpoint{Servid: sid, Weight: c.manual.Ctrl.Weight, Zone: c.reg.Zone, Serv: p})
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Servid < endpoints[j].Servid
+	})
+	return endpoints
+}
+
+// Acquire called before request to s, used by load balancer tracking in-flight requests
+func (m *ClientEtcdV2) Acquire(s *ServInfo) {
+	m.muServlist.Lock()
+	lb := m.balancer
+	m.muServlist.Unlock()
+	if t, ok := lb.(ConnTracker); ok {
+		t.Acquire(s)
+	}
+}
+
+// Release called after request to s finished
+func (m *ClientEtcdV2) Release(s *ServInfo) {
+	m.muServlist.Lock()
+	lb := m.balancer
+	m.muServlist.Unlock()
+	if t, ok := lb.(ConnTracker); ok {
+		t.Release(s)
+	}
+}
+
 func (m *ClientEtcdV2) getServAddrWithServid(servid int, processor, key string) *ServInfo {
 	if c := m.servCopy[servid]; c != nil {
 		if c.reg != nil {
 			if c.manual != nil && c.manual.Ctrl != nil && c.manual.Ctrl.Disable {
 				return nil
 			}
+			if !c.reg.IsActive() {
+				return nil
+			}
 			if p := c.reg.Servs[processor]; p != nil {
 				return p
 			}
@@ -537,23 +849,13 @@ func (m *ClientEtcdV2) GetServAddrWithServid(servid int, processor, key string)
 	return m.getServAddrWithServid(servid, processor, key)
 }
 
+// GetAllServAddr return addrs of processor which can be routed to, ordered by servid,
+// the list is cached on registry update
 func (m *ClientEtcdV2) GetAllServAddr(processor string) []*ServInfo {
 	m.muServlist.Lock()
 	defer m.muServlist.Unlock()
 
-	servs := make([]*ServInfo, 0)
-	for _, c := range m.servCopy {
-		if c.reg != nil {
-			if c.manual != nil && c.manual.Ctrl != nil && c.manual.Ctrl.Disable {
-				continue
-			}
-			if p := c.reg.Servs[processor]; p != nil {
-				servs = append(servs, p)
-			}
-		}
-	}
-
-	return servs
+	return append(make([]*ServInfo, 0, len(m.servList[processor])), m.servList[processor]...)
 }
 
 func (m *ClientEtcdV2) GetAllServAddrWithGroup(group, processor string) []*ServInfo {
@@ -566,6 +868,9 @@ func (m *ClientEtcdV2) GetAllServAddrWithGroup(group, processor string) []*ServI
 			if c.manual != nil && c.manual.Ctrl != nil && c.manual.Ctrl.Disable {
 				continue
 			}
+			if !c.reg.IsActive() {
+				continue
+			}
 
 			if !c.containsLane(group) {
 				continue
@@ -580,6 +885,23 @@ func (m *ClientEtcdV2) GetAllServAddrWithGroup(group, processor string) []*ServI
 	return servs
 }
 
+// GetAllServLoadWithGroup return load reported by instances, key is addr of processor
+func (m *ClientEtcdV2) GetAllServLoadWithGroup(group, processor string) map[string]*InstanceLoad {
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+
+	loads := make(map[string]*InstanceLoad)
+	for _, c := range m.servCopy {
+		if c.reg == nil || c.load == nil || !c.containsLane(group) {
+			continue
+		}
+		if p := c.reg.Servs[processor]; p != nil {
+			loads[p.Addr] = c.load
+		}
+	}
+	return loads
+}
+
 func (m *ClientEtcdV2) ServKey() string {
 	return m.servKey
 }
@@ -596,7 +918,7 @@ func (m *ClientEtcdV2) String() string {
 func (s *servCopyData) containsLane(lane string) bool {
 	if s.reg != nil {
 		l, ok := s.reg.GetLane()
-		xlog.Debugf(context.Background(), "containsLane get v2 lane metadata, ok: %v, regInfo: %v, expect: %s, actual: %s", ok, s.reg.Servs, lane, l)
+		logger().Debugf(context.Background(), "containsLane get v2 lane metadata, ok: %v, regInfo: %v, expect: %s, actual: %s", ok, s.reg.Servs, lane, l)
 		if ok {
 			if l == lane {
 				return true
@@ -604,7 +926,7 @@ func (s *servCopyData) containsLane(lane string) bool {
 		}
 	}
 
-	xlog.Debugf(context.Background(), "containsLane get v1 lane metadata, servId: %d, expect: %s", s.servId, lane)
+	logger().Debugf(context.Background(), "containsLane get v1 lane metadata, servId: %d, expect: %s", s.servId, lane)
 	if s.manual == nil || s.manual.Ctrl == nil {
 		return false
 	}
@@ -0,0 +1,418 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
+)
+
+const (
+	// DefaultAgentSocket unix socket of local discovery agent used when ROC_REGISTRY=agent and ROC_REGISTRY_ADDRS is not set
+	DefaultAgentSocket = "/var/run/roc/discovery.sock"
+
+	agentPathInstances = "/v1/instances"
+	agentPathWatch     = "/v1/watch"
+	agentPathStatus    = "/v1/status"
+
+	agentRequestTimeout = 3 * time.Second
+	// 没有 client 使用后保留 watch 的时间, 避免进程重启时反复创建 etcd watch
+	agentIdleTimeout = time.Minute
+)
+
+// DiscoveryAgent keeps one watch per service for all processes on a host and serves topology over unix socket,
+// processes use it by setting ROC_REGISTRY=agent, so etcd connections do not grow with the number of processes
+type DiscoveryAgent struct {
+	reg Registry
+
+	mu     sync.Mutex
+	topics map[string]*agentTopic
+}
+
+// agentTopic 一个服务的 watch, 由连接到 agent 的 client 共享, 字段由 DiscoveryAgent.mu 保护
+type agentTopic struct {
+	servKey string
+	cancel  context.CancelFunc
+
+	refs    int
+	idle    *time.Timer
+	list    []*Instance
+	version uint64
+	// 每次更新时关闭并替换, 通知等待中的 client
+	changed chan struct{}
+	done    bool
+}
+
+// AgentTopicStatus watch of one service in discovery agent
+type AgentTopicStatus struct {
+	ServKey   string `json:"servkey"`
+	Clients   int    `json:"clients"`
+	Instances int    `json:"instances"`
+	Version   uint64 `json:"version"`
+}
+
+// NewDiscoveryAgent create agent discovering services from reg
+func NewDiscoveryAgent(reg Registry) *DiscoveryAgent {
+	return &DiscoveryAgent{
+		reg:    reg,
+		topics: make(map[string]*agentTopic),
+	}
+}
+
+// RunDiscoveryAgent serve discovery agent on unix socket sock until ctx is done, services are discovered from etcd,
+// fallback clusters of ROC_ETCD_FALLBACK_ADDRS are also used
+func RunDiscoveryAgent(ctx context.Context, sock string, etcdAddrs []string, baseLoc string) error {
+	client, err := newDiscoveryKeysAPI(etcdAddrs, baseLoc)
+	if err != nil {
+		return err
+	}
+	return NewDiscoveryAgent(newEtcdRegistry(client, baseLoc)).Serve(ctx, sock)
+}
+
+// Serve listen on unix socket sock and serve until ctx is done
+func (m *DiscoveryAgent) Serve(ctx context.Context, sock string) error {
+	fun := "DiscoveryAgent.Serve -->"
+
+	if err := os.MkdirAll(filepath.Dir(sock), 0755); err != nil {
+		return err
+	}
+	// 上次退出时遗留的 socket 文件
+	if err := os.Remove(sock); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return err
+	}
+	// 本机不同用户的进程都可以连接
+	if err := os.Chmod(sock, 0666); err != nil {
+		l.Close()
+		return err
+	}
+
+	srv := &http.Server{Handler: m.handler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logger().Infof(ctx, "%s serve on: %s", fun, sock)
+	err = srv.Serve(l)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (m *DiscoveryAgent) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(agentPathInstances, m.serveInstances)
+	mux.HandleFunc(agentPathWatch, m.serveWatch)
+	mux.HandleFunc(agentPathStatus, m.serveStatus)
+	return mux
+}
+
+// Status watches in agent sorted by servkey
+func (m *DiscoveryAgent) Status() []AgentTopicStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := make([]AgentTopicStatus, 0, len(m.topics))
+	for _, t := range m.topics {
+		st = append(st, AgentTopicStatus{ServKey: t.servKey, Clients: t.refs, Instances: len(t.list), Version: t.version})
+	}
+	sort.Slice(st, func(i, j int) bool {
+		return st[i].ServKey < st[j].ServKey
+	})
+	return st
+}
+
+// acquire 获取服务的 watch, 不存在时创建
+func (m *DiscoveryAgent) acquire(servKey string) *agentTopic {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if t, ok := m.topics[servKey]; ok {
+		if t.idle != nil {
+			t.idle.Stop()
+			t.idle = nil
+		}
+		t.refs++
+		return t
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &agentTopic{
+		servKey: servKey,
+		cancel:  cancel,
+		refs:    1,
+		changed: make(chan struct{}),
+	}
+	m.topics[servKey] = t
+	go m.watch(ctx, t)
+	return t
+}
+
+// release 最后一个 client 断开后保留 agentIdleTimeout 再停止 watch
+func (m *DiscoveryAgent) release(t *agentTopic) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t.refs--
+	if t.refs > 0 || t.done {
+		return
+	}
+	t.idle = time.AfterFunc(agentIdleTimeout, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if t.refs > 0 || m.topics[t.servKey] != t {
+			return
+		}
+		delete(m.topics, t.servKey)
+		t.cancel()
+	})
+}
+
+func (m *DiscoveryAgent) watch(ctx context.Context, t *agentTopic) {
+	fun := "DiscoveryAgent.watch -->"
+
+	defer func() {
+		m.mu.Lock()
+		if m.topics[t.servKey] == t {
+			delete(m.topics, t.servKey)
+		}
+		t.done = true
+		close(t.changed)
+		m.mu.Unlock()
+		t.cancel()
+	}()
+
+	ch, err := m.reg.Watch(ctx, t.servKey)
+	if err != nil {
+		logger().Warnf(ctx, "%s watch serv: %s err: %v", fun, t.servKey, err)
+		return
+	}
+	for list := range ch {
+		m.mu.Lock()
+		t.list = list
+		t.version++
+		close(t.changed)
+		t.changed = make(chan struct{})
+		m.mu.Unlock()
+	}
+	if ctx.Err() == nil {
+		logger().Warnf(ctx, "%s watch serv: %s closed", fun, t.servKey)
+	}
+}
+
+func (m *DiscoveryAgent) snapshot(t *agentTopic) ([]*Instance, uint64, chan struct{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return t.list, t.version, t.changed, t.done
+}
+
+// serveInstances 已有 watch 时直接返回, 否则查询注册中心
+func (m *DiscoveryAgent) serveInstances(w http.ResponseWriter, r *http.Request) {
+	servKey := r.URL.Query().Get("servkey")
+	if len(servKey) == 0 {
+		http.Error(w, "servkey required", http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	t, ok := m.topics[servKey]
+	var list []*Instance
+	if ok && t.version > 0 {
+		list = t.list
+	} else {
+		ok = false
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		var err error
+		list, err = m.reg.GetInstances(r.Context(), servKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// serveWatch 每次变更输出一行完整的实例列表, watch 结束时断开, 由 client 重新连接
+func (m *DiscoveryAgent) serveWatch(w http.ResponseWriter, r *http.Request) {
+	servKey := r.URL.Query().Get("servkey")
+	if len(servKey) == 0 {
+		http.Error(w, "servkey required", http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	t := m.acquire(servKey)
+	defer m.release(t)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	var sent uint64
+	for {
+		list, version, changed, done := m.snapshot(t)
+		if version > sent {
+			if err := enc.Encode(list); err != nil {
+				return
+			}
+			flusher.Flush()
+			sent = version
+		}
+		if done {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (m *DiscoveryAgent) serveStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.Status())
+}
+
+// agentRegistry 通过本机 discovery agent 发现服务; 注册仍由 ServBaseV2 直接写 etcd, Register 和 Deregister 不做处理
+type agentRegistry struct {
+	sock   string
+	client *http.Client
+}
+
+// newAgentRegistry 未指定 ROC_REGISTRY_ADDRS 时 addrs 为 etcd 地址, 只使用路径形式的地址, 如 /var/run/roc/discovery.sock 或 unix:///var/run/roc/discovery.sock
+func newAgentRegistry(addrs []string) *agentRegistry {
+	sock := DefaultAgentSocket
+	if len(addrs) > 0 {
+		if a := strings.TrimPrefix(strings.TrimSpace(addrs[0]), "unix://"); strings.HasPrefix(a, "/") {
+			sock = a
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: time.Second}
+	return &agentRegistry{
+		sock: sock,
+		client: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", sock)
+			},
+		}},
+	}
+}
+
+// NewClientAgent create client lookup of servlocation, instances are discovered from local discovery agent on sock
+func NewClientAgent(sock, servlocation string) (*ClientEtcdV2, error) {
+	reg, err := getRegistry(configRegistry{backend: REGISTRY_AGENT, addrs: []string{sock}})
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithRegistry(reg, servlocation)
+}
+
+func (m *agentRegistry) get(ctx context.Context, path, servKey string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://agent"+path+"?"+url.Values{"servkey": {servKey}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("discovery agent %s %s status: %d body: %s", m.sock, path, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+func (m *agentRegistry) Register(ctx context.Context, ins *Instance) error {
+	return nil
+}
+
+func (m *agentRegistry) Deregister(ctx context.Context, ins *Instance) error {
+	return nil
+}
+
+func (m *agentRegistry) GetInstances(ctx context.Context, servKey string) ([]*Instance, error) {
+	ctx, cancel := context.WithTimeout(ctx, agentRequestTimeout)
+	defer cancel()
+
+	resp, err := m.get(ctx, agentPathInstances, servKey)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list []*Instance
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list, err
+}
+
+func (m *agentRegistry) Watch(ctx context.Context, servKey string) (<-chan []*Instance, error) {
+	fun := "agentRegistry.Watch -->"
+
+	ch := make(chan []*Instance)
+	go func() {
+		defer close(ch)
+		backoff := xtime.NewBackOffCtrl(time.Millisecond*100, time.Second*5)
+		for {
+			err := m.watch(ctx, servKey, ch, backoff)
+			if ctx.Err() != nil {
+				return
+			}
+			logger().Warnf(ctx, "%s watch serv: %s from agent: %s err: %v", fun, servKey, m.sock, err)
+			backoff.BackOff()
+		}
+	}()
+	return ch, nil
+}
+
+// watch 每行为一次完整的实例列表, 收到数据后重置退避
+func (m *agentRegistry) watch(ctx context.Context, servKey string, ch chan<- []*Instance, backoff *xtime.BackOffCtrl) error {
+	resp, err := m.get(ctx, agentPathWatch, servKey)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var list []*Instance
+		if err := dec.Decode(&list); err != nil {
+			return err
+		}
+		backoff.Reset()
+
+		select {
+		case ch <- list:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
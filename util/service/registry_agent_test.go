@@ -0,0 +1,143 @@
+package rocserv
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chanRegistry 通过 push 推送实例列表, 记录 Watch 次数
+type chanRegistry struct {
+	mu      sync.Mutex
+	watches int
+	subs    []chan []*Instance
+	list    []*Instance
+}
+
+func (m *chanRegistry) Register(ctx context.Context, ins *Instance) error   { return nil }
+func (m *chanRegistry) Deregister(ctx context.Context, ins *Instance) error { return nil }
+
+func (m *chanRegistry) GetInstances(ctx context.Context, servKey string) ([]*Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.list, nil
+}
+
+func (m *chanRegistry) Watch(ctx context.Context, servKey string) (<-chan []*Instance, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watches++
+	ch := make(chan []*Instance, 8)
+	ch <- m.list
+	m.subs = append(m.subs, ch)
+	return ch, nil
+}
+
+func (m *chanRegistry) push(list []*Instance) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.list = list
+	for _, ch := range m.subs {
+		ch <- list
+	}
+}
+
+func recvInstances(t *testing.T, ch <-chan []*Instance) []*Instance {
+	select {
+	case list := <-ch:
+		return list
+	case <-time.After(3 * time.Second):
+		t.Fatal("no instance list received")
+	}
+	return nil
+}
+
+func TestDiscoveryAgent(t *testing.T) {
+	ass := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "roc-agent")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "discovery.sock")
+
+	ins := &Instance{ServKey: "base/account", Servid: 1, Servs: map[string]*ServInfo{"proc_grpc": {Type: "grpc", Addr: "10.0.0.1:9000"}}}
+	reg := &chanRegistry{list: []*Instance{ins}}
+	agent := NewDiscoveryAgent(reg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() { served <- agent.Serve(ctx, sock) }()
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(sock); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client := newAgentRegistry([]string{"unix://" + sock})
+	list, err := client.GetInstances(ctx, "base/account")
+	ass.Nil(err)
+	ass.Equal([]*Instance{ins}, list)
+
+	// 两个 client 共享一个注册中心的 watch
+	wctx1, cancel1 := context.WithCancel(ctx)
+	ch1, _ := client.Watch(wctx1, "base/account")
+	ass.Equal([]*Instance{ins}, recvInstances(t, ch1))
+	wctx2, cancel2 := context.WithCancel(ctx)
+	ch2, _ := client.Watch(wctx2, "base/account")
+	ass.Equal([]*Instance{ins}, recvInstances(t, ch2))
+	ass.Equal(1, reg.watches)
+	ass.Equal([]AgentTopicStatus{{ServKey: "base/account", Clients: 2, Instances: 1, Version: 1}}, agent.Status())
+
+	ins2 := &Instance{ServKey: "base/account", Servid: 2, Servs: map[string]*ServInfo{"proc_grpc": {Type: "grpc", Addr: "10.0.0.2:9000"}}}
+	reg.push([]*Instance{ins, ins2})
+	ass.Len(recvInstances(t, ch1), 2)
+	ass.Len(recvInstances(t, ch2), 2)
+
+	// client 全部断开后 watch 保留到空闲超时
+	cancel1()
+	cancel2()
+	for i := 0; i < 100 && agent.Status()[0].Clients > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ass.Equal(0, agent.Status()[0].Clients)
+	ch3, _ := client.Watch(ctx, "base/account")
+	ass.Len(recvInstances(t, ch3), 2)
+	ass.Equal(1, reg.watches)
+
+	cancel()
+	ass.Nil(<-served)
+}
+
+func TestDiscoveryAgentIdleRelease(t *testing.T) {
+	ass := assert.New(t)
+
+	reg := &chanRegistry{}
+	agent := NewDiscoveryAgent(reg)
+	topic := agent.acquire("base/account")
+	agent.release(topic)
+	ass.Len(agent.Status(), 1)
+
+	agent.mu.Lock()
+	topic.idle.Reset(time.Millisecond)
+	agent.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	ass.Len(agent.Status(), 0)
+}
+
+func TestNewAgentRegistry(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.Equal(DefaultAgentSocket, newAgentRegistry(nil).sock)
+	// 未指定 ROC_REGISTRY_ADDRS 时为 etcd 地址
+	ass.Equal(DefaultAgentSocket, newAgentRegistry([]string{"http://127.0.0.1:2379"}).sock)
+	ass.Equal("/tmp/agent.sock", newAgentRegistry([]string{"/tmp/agent.sock"}).sock)
+	ass.Equal("/tmp/agent.sock", newAgentRegistry([]string{"unix:///tmp/agent.sock"}).sock)
+}
@@ -0,0 +1,396 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+const (
+	REGISTRY_ETCD   = "etcd"
+	REGISTRY_CONSUL = "consul"
+	// kubernetes 只支持服务发现
+	REGISTRY_KUBERNETES = "kubernetes"
+	// agent 只支持服务发现, 地址为本机 discovery agent 的 unix socket
+	REGISTRY_AGENT = "agent"
+
+	// 环境变量指定注册中心类型及地址, 不指定时使用 etcd
+	registryBackendEnv = "ROC_REGISTRY"
+	registryAddrsEnv   = "ROC_REGISTRY_ADDRS"
+
+	// 与 doRegister 保持一致
+	registryTTL       = 60 * time.Second
+	registryHeartbeat = 20 * time.Second
+)
+
+// Instance one copy of service in registry backend
+type Instance struct {
+	ServKey string               `json:"servkey"` // 形如 {servGroup}/{servName}
+	Servid  int                  `json:"servid"`
+	Lane    string               `json:"lane"`
+	Servs   map[string]*ServInfo `json:"servs"`
+	Weight  int                  `json:"weight"`
+	Disable bool                 `json:"disable"`
+	Region  string               `json:"region,omitempty"`
+	Zone    string               `json:"zone,omitempty"`
+	// 注册阶段, 见 RegStateStarting
+	State string `json:"state,omitempty"`
+}
+
+// Registry backend of service registration and discovery
+type Registry interface {
+	// Register register instance and keep it alive until Deregister, register again to update it
+	Register(ctx context.Context, ins *Instance) error
+	Deregister(ctx context.Context, ins *Instance) error
+	GetInstances(ctx context.Context, servKey string) ([]*Instance, error)
+	// Watch send full instance list of servKey on every change, channel is closed when ctx is done
+	Watch(ctx context.Context, servKey string) (<-chan []*Instance, error)
+}
+
+type configRegistry struct {
+	backend    string
+	addrs      []string
+	useBaseloc string
+}
+
+// loadConfigRegistry 默认使用 etcd 配置, 可通过环境变量切换到其他注册中心
+func loadConfigRegistry(confEtcd configEtcd) configRegistry {
+	conf := configRegistry{
+		backend:    REGISTRY_ETCD,
+		addrs:      confEtcd.etcdAddrs,
+		useBaseloc: confEtcd.useBaseloc,
+	}
+
+	backend := strings.ToLower(os.Getenv(registryBackendEnv))
+	if len(backend) > 0 {
+		conf.backend = backend
+	}
+	if addrs := os.Getenv(registryAddrsEnv); len(addrs) > 0 {
+		conf.addrs = strings.Split(addrs, ",")
+	}
+	return conf
+}
+
+var registries sync.Map
+
+// NewRegistry create registry of backend, baseLoc is only used by etcd
+func NewRegistry(backend string, addrs []string, baseLoc string) (Registry, error) {
+	switch backend {
+	case REGISTRY_ETCD:
+		client, err := newEtcdKeysAPI(addrs, baseLoc)
+		if err != nil {
+			return nil, err
+		}
+		return newEtcdRegistry(client, baseLoc), nil
+	case REGISTRY_CONSUL:
+		return newConsulRegistry(addrs)
+	case REGISTRY_KUBERNETES:
+		return newKubernetesRegistry(addrs)
+	case REGISTRY_AGENT:
+		return newAgentRegistry(addrs), nil
+	default:
+		return nil, fmt.Errorf("registry backend: %s not support", backend)
+	}
+}
+
+// getRegistry 相同配置共享一个 registry
+func getRegistry(conf configRegistry) (Registry, error) {
+	key := fmt.Sprintf("%s|%s|%s", conf.backend, strings.Join(conf.addrs, ","), conf.useBaseloc)
+	if r, ok := registries.Load(key); ok {
+		return r.(Registry), nil
+	}
+
+	r, err := NewRegistry(conf.backend, conf.addrs, conf.useBaseloc)
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := registries.LoadOrStore(key, r)
+	return actual.(Registry), nil
+}
+
+func (m *Instance) servCopy() *servCopyData {
+	weight := m.Weight
+	if weight == 0 {
+		weight = 100
+	}
+	reg := NewRegData(m.Servs, m.Lane)
+	reg.Region = m.Region
+	reg.Zone = m.Zone
+	reg.State = m.State
+	return &servCopyData{
+		servId: m.Servid,
+		reg:    reg,
+		manual: &ManualData{Ctrl: &ServCtrl{
+			Weight:  weight,
+			Disable: m.Disable,
+			Groups:  []string{m.Lane},
+		}},
+	}
+}
+
+// NewClientWithRegistry create client lookup of servlocation, instances are discovered from registry backend
+func NewClientWithRegistry(reg Registry, servlocation string) (*ClientEtcdV2, error) {
+	fun := "NewClientWithRegistry -->"
+	ctx := context.Background()
+
+	cli := &ClientEtcdV2{
+		servKey:  servlocation,
+		distLoc:  BASE_LOC_DIST_V2,
+		servPath: servlocation,
+		breaker:  newInstanceBreakers(servlocation, DefaultInstanceBreakerConf),
+		zone:     defaultZoneConf(),
+	}
+
+	ch, err := reg.Watch(context.Background(), servlocation)
+	if err != nil {
+		return nil, err
+	}
+	registerClientLookup(cli)
+	watchRouteOverride()
+
+	firstSync := make(chan bool)
+	go func() {
+		var firstOnce sync.Once
+		for list := range ch {
+			scopy := make(servCopyCollect, len(list))
+			for _, ins := range list {
+				scopy[ins.Servid] = ins.servCopy()
+			}
+			logger().Infof(ctx, "%s update serv: %s len: %d", fun, servlocation, len(scopy))
+			cli.upServlist(scopy)
+
+			firstOnce.Do(func() {
+				close(firstSync)
+			})
+		}
+	}()
+
+	select {
+	case <-firstSync:
+		logger().Infof(ctx, "%s init ok, serv: %s", fun, servlocation)
+	case <-time.After(time.Second):
+		logger().Warnf(ctx, "%s init timeout, serv: %s", fun, servlocation)
+	}
+	return cli, nil
+}
+
+// etcdRegistry 使用与 ServBaseV2 相同的 dist2 目录结构
+type etcdRegistry struct {
+	client  etcd.KeysAPI
+	baseLoc string
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+func newEtcdRegistry(client etcd.KeysAPI, baseLoc string) *etcdRegistry {
+	return &etcdRegistry{
+		client:  client,
+		baseLoc: baseLoc,
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+func (m *etcdRegistry) servPath(servKey string) string {
+	return fmt.Sprintf("%s/%s/%s", m.baseLoc, BASE_LOC_DIST_V2, servKey)
+}
+
+func (m *etcdRegistry) instancePath(ins *Instance) string {
+	return fmt.Sprintf("%s/%d", m.servPath(ins.ServKey), ins.Servid)
+}
+
+func (m *etcdRegistry) Register(ctx context.Context, ins *Instance) error {
+	path := m.instancePath(ins)
+	c := ins.servCopy()
+
+	manual, err := json.Marshal(c.manual)
+	if err != nil {
+		return err
+	}
+	_, err = m.client.Set(ctx, path+"/"+BASE_LOC_REG_MANUAL, string(manual), nil)
+	if err != nil {
+		return err
+	}
+
+	reg, err := json.Marshal(c.reg)
+	if err != nil {
+		return err
+	}
+	_, err = m.client.Set(ctx, path+"/"+BASE_LOC_REG_SERV, string(reg), &etcd.SetOptions{TTL: registryTTL})
+	if err != nil {
+		return err
+	}
+
+	kctx, cancel := context.WithCancel(context.Background())
+	m.mu.Lock()
+	if old, ok := m.cancels[path]; ok {
+		old()
+	}
+	m.cancels[path] = cancel
+	m.mu.Unlock()
+
+	go m.keepAlive(kctx, path+"/"+BASE_LOC_REG_SERV, string(reg))
+	return nil
+}
+
+func (m *etcdRegistry) keepAlive(ctx context.Context, path, value string) {
+	fun := "etcdRegistry.keepAlive -->"
+
+	ticker := time.NewTicker(registryHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		_, err := m.client.Set(ctx, path, "", &etcd.SetOptions{
+			PrevExist: etcd.PrevExist,
+			TTL:       registryTTL,
+			Refresh:   true,
+		})
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		logger().Warnf(ctx, "%s refresh path: %s err: %v, create again", fun, path, err)
+		_, err = m.client.Set(ctx, path, value, &etcd.SetOptions{TTL: registryTTL})
+		if err != nil {
+			logger().Errorf(ctx, "%s create path: %s err: %v", fun, path, err)
+		}
+	}
+}
+
+func (m *etcdRegistry) Deregister(ctx context.Context, ins *Instance) error {
+	path := m.instancePath(ins)
+
+	m.mu.Lock()
+	if cancel, ok := m.cancels[path]; ok {
+		cancel()
+		delete(m.cancels, path)
+	}
+	m.mu.Unlock()
+
+	_, err := m.client.Delete(ctx, path, &etcd.DeleteOptions{Recursive: true})
+	if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+func (m *etcdRegistry) GetInstances(ctx context.Context, servKey string) ([]*Instance, error) {
+	list, _, err := m.get(ctx, servKey)
+	return list, err
+}
+
+func (m *etcdRegistry) get(ctx context.Context, servKey string) ([]*Instance, uint64, error) {
+	fun := "etcdRegistry.get -->"
+
+	waitRegistryRead(ctx, m.servPath(servKey))
+	r, err := m.client.Get(ctx, m.servPath(servKey), &etcd.GetOptions{Recursive: true, Sort: false})
+	if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+		return nil, e.Index, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var list []*Instance
+	for _, n := range r.Node.Nodes {
+		sid, err := strconv.Atoi(n.Key[len(r.Node.Key)+1:])
+		if err != nil || sid < 0 {
+			continue
+		}
+
+		ins := &Instance{ServKey: servKey, Servid: sid}
+		var reg RegData
+		var manual ManualData
+		for _, nc := range n.Nodes {
+			switch nc.Key {
+			case n.Key + "/" + BASE_LOC_REG_SERV:
+				if err := json.Unmarshal([]byte(nc.Value), &reg); err != nil {
+					logger().Warnf(ctx, "%s key: %s err: %v", fun, nc.Key, err)
+				}
+			case n.Key + "/" + BASE_LOC_REG_MANUAL:
+				if err := json.Unmarshal([]byte(nc.Value), &manual); err != nil {
+					logger().Warnf(ctx, "%s key: %s err: %v", fun, nc.Key, err)
+				}
+			}
+		}
+		if len(reg.Servs) == 0 {
+			continue
+		}
+
+		ins.Servs = reg.Servs
+		ins.Lane, _ = reg.GetLane()
+		ins.State = reg.State
+		if manual.Ctrl != nil {
+			ins.Weight = manual.Ctrl.Weight
+			ins.Disable = manual.Ctrl.Disable
+		}
+		list = append(list, ins)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Servid < list[j].Servid
+	})
+	return list, r.Index, nil
+}
+
+func (m *etcdRegistry) Watch(ctx context.Context, servKey string) (<-chan []*Instance, error) {
+	fun := "etcdRegistry.Watch -->"
+
+	ch := make(chan []*Instance)
+	go func() {
+		defer close(ch)
+		backoff := xtime.NewBackOffCtrl(time.Millisecond*100, time.Second*5)
+		release := func() {}
+		defer func() { release() }()
+		for {
+			list, index, err := m.get(ctx, servKey)
+			release()
+			release = func() {}
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logger().Warnf(ctx, "%s get serv: %s err: %v", fun, servKey, err)
+				backoff.BackOff()
+				continue
+			}
+
+			select {
+			case ch <- list:
+			case <-ctx.Done():
+				return
+			}
+
+			watcher := m.client.Watcher(m.servPath(servKey), &etcd.WatcherOptions{Recursive: true, AfterIndex: index})
+			_, err = watcher.Next(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if isWatchCompacted(err) {
+				release = waitCompactedResync(ctx, watchKindRegistry, m.servPath(servKey))
+				continue
+			}
+			if err != nil {
+				logger().Warnf(ctx, "%s watch serv: %s err: %v", fun, servKey, err)
+				backoff.BackOff()
+				continue
+			}
+			backoff.Reset()
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,353 @@
+package rocserv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
+)
+
+const (
+	// consul acl token, 与 consul 官方客户端一致
+	consulTokenEnv = "CONSUL_HTTP_TOKEN"
+
+	consulWatchWait = 5 * time.Minute
+	// 实例心跳长时间失败后由 consul 自动摘除
+	consulDeregisterAfter = "10m"
+
+	consulMetaServKey = "roc_servkey"
+	consulMetaServid  = "roc_servid"
+	consulMetaLane    = "roc_lane"
+	consulMetaServs   = "roc_servs"
+	consulMetaWeight  = "roc_weight"
+	consulMetaDisable = "roc_disable"
+	consulMetaState   = "roc_state"
+)
+
+type consulCheck struct {
+	TTL                            string `json:"TTL"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+type consulService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Service string            `json:"Service,omitempty"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Meta    map[string]string `json:"Meta"`
+	Check   *consulCheck      `json:"Check,omitempty"`
+}
+
+type consulServiceEntry struct {
+	Service *consulService `json:"Service"`
+}
+
+// consulRegistry 通过 consul http api 注册和发现服务, 实例信息保存在 service meta 中
+type consulRegistry struct {
+	addrs  []string
+	token  string
+	client *http.Client
+
+	mu         sync.Mutex
+	heartbeats map[string]context.CancelFunc
+}
+
+func newConsulRegistry(addrs []string) (*consulRegistry, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("consul addrs empty")
+	}
+
+	m := &consulRegistry{
+		token:      os.Getenv(consulTokenEnv),
+		client:     &http.Client{Timeout: consulWatchWait + time.Minute},
+		heartbeats: make(map[string]context.CancelFunc),
+	}
+	for _, addr := range addrs {
+		if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+			addr = "http://" + addr
+		}
+		m.addrs = append(m.addrs, strings.TrimSuffix(addr, "/"))
+	}
+	return m, nil
+}
+
+// consulServiceName consul 服务名不支持 /, 替换为 -
+func consulServiceName(servKey string) string {
+	return strings.Replace(servKey, "/", "-", -1)
+}
+
+func consulServiceID(ins *Instance) string {
+	return fmt.Sprintf("%s-%d", consulServiceName(ins.ServKey), ins.Servid)
+}
+
+// do 依次尝试各个地址, 返回 X-Consul-Index
+func (m *consulRegistry) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) (uint64, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var lastErr error
+	for _, addr := range m.addrs {
+		u := addr + path
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return 0, err
+		}
+		req = req.WithContext(ctx)
+		if len(m.token) > 0 {
+			req.Header.Set("X-Consul-Token", m.token)
+		}
+
+		resp, err := m.client.Do(req)
+		if err != nil {
+			lastErr = err
+			if ctx.Err() != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("consul %s %s status: %d body: %s", method, path, resp.StatusCode, data)
+		}
+
+		index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+		if out != nil {
+			if err := json.Unmarshal(data, out); err != nil {
+				return 0, err
+			}
+		}
+		return index, nil
+	}
+	return 0, lastErr
+}
+
+func (m *consulRegistry) Register(ctx context.Context, ins *Instance) error {
+	fun := "consulRegistry.Register -->"
+
+	servs, err := json.Marshal(ins.Servs)
+	if err != nil {
+		return err
+	}
+
+	svc := &consulService{
+		ID:   consulServiceID(ins),
+		Name: consulServiceName(ins.ServKey),
+		Meta: map[string]string{
+			consulMetaServKey: ins.ServKey,
+			consulMetaServid:  strconv.Itoa(ins.Servid),
+			consulMetaLane:    ins.Lane,
+			consulMetaServs:   string(servs),
+			consulMetaWeight:  strconv.Itoa(ins.Weight),
+			consulMetaDisable: strconv.FormatBool(ins.Disable),
+			consulMetaState:   ins.State,
+		},
+		Check: &consulCheck{
+			TTL:                            registryTTL.String(),
+			DeregisterCriticalServiceAfter: consulDeregisterAfter,
+		},
+	}
+
+	// consul 每个服务只有一个地址, 取 processor 名排序后的第一个, 完整信息在 meta 中
+	procs := make([]string, 0, len(ins.Servs))
+	for proc := range ins.Servs {
+		procs = append(procs, proc)
+	}
+	sort.Strings(procs)
+	if len(procs) > 0 {
+		host, port, err := net.SplitHostPort(ins.Servs[procs[0]].Addr)
+		if err == nil {
+			svc.Address = host
+			svc.Port, _ = strconv.Atoi(port)
+		}
+	}
+
+	_, err = m.do(ctx, http.MethodPut, "/v1/agent/service/register", nil, svc, nil)
+	if err != nil {
+		return err
+	}
+	if err := m.pass(ctx, svc.ID); err != nil {
+		logger().Warnf(ctx, "%s pass check id: %s err: %v", fun, svc.ID, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cancel, ok := m.heartbeats[svc.ID]; ok {
+		cancel()
+	}
+	hctx, cancel := context.WithCancel(context.Background())
+	m.heartbeats[svc.ID] = cancel
+	go m.heartbeat(hctx, svc)
+
+	logger().Infof(ctx, "%s register id: %s name: %s", fun, svc.ID, svc.Name)
+	return nil
+}
+
+func (m *consulRegistry) pass(ctx context.Context, id string) error {
+	_, err := m.do(ctx, http.MethodPut, "/v1/agent/check/pass/service:"+id, nil, nil, nil)
+	return err
+}
+
+func (m *consulRegistry) heartbeat(ctx context.Context, svc *consulService) {
+	fun := "consulRegistry.heartbeat -->"
+
+	ticker := time.NewTicker(registryHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := m.pass(ctx, svc.ID)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		// agent 重启后服务信息丢失, 需要重新注册
+		logger().Warnf(ctx, "%s pass check id: %s err: %v, register again", fun, svc.ID, err)
+		_, err = m.do(ctx, http.MethodPut, "/v1/agent/service/register", nil, svc, nil)
+		if err != nil {
+			logger().Errorf(ctx, "%s register id: %s err: %v", fun, svc.ID, err)
+		}
+	}
+}
+
+func (m *consulRegistry) Deregister(ctx context.Context, ins *Instance) error {
+	id := consulServiceID(ins)
+
+	m.mu.Lock()
+	if cancel, ok := m.heartbeats[id]; ok {
+		cancel()
+		delete(m.heartbeats, id)
+	}
+	m.mu.Unlock()
+
+	_, err := m.do(ctx, http.MethodPut, "/v1/agent/service/deregister/"+id, nil, nil, nil)
+	return err
+}
+
+func (m *consulRegistry) GetInstances(ctx context.Context, servKey string) ([]*Instance, error) {
+	list, _, err := m.health(ctx, servKey, 0)
+	return list, err
+}
+
+// health 查询通过健康检查的实例, index 大于 0 时为阻塞查询
+func (m *consulRegistry) health(ctx context.Context, servKey string, index uint64) ([]*Instance, uint64, error) {
+	fun := "consulRegistry.health -->"
+
+	query := url.Values{}
+	query.Set("passing", "true")
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", consulWatchWait.String())
+	}
+
+	var entries []*consulServiceEntry
+	newIndex, err := m.do(ctx, http.MethodGet, "/v1/health/service/"+consulServiceName(servKey), query, nil, &entries)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var list []*Instance
+	for _, e := range entries {
+		if e.Service == nil || e.Service.Meta[consulMetaServKey] != servKey {
+			continue
+		}
+		meta := e.Service.Meta
+
+		sid, err := strconv.Atoi(meta[consulMetaServid])
+		if err != nil {
+			logger().Warnf(ctx, "%s id: %s servid: %s err: %v", fun, e.Service.ID, meta[consulMetaServid], err)
+			continue
+		}
+		ins := &Instance{
+			ServKey: servKey,
+			Servid:  sid,
+			Lane:    meta[consulMetaLane],
+		}
+		if err := json.Unmarshal([]byte(meta[consulMetaServs]), &ins.Servs); err != nil {
+			logger().Warnf(ctx, "%s id: %s servs: %s err: %v", fun, e.Service.ID, meta[consulMetaServs], err)
+			continue
+		}
+		ins.Weight, _ = strconv.Atoi(meta[consulMetaWeight])
+		ins.Disable, _ = strconv.ParseBool(meta[consulMetaDisable])
+		ins.State = meta[consulMetaState]
+		list = append(list, ins)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Servid < list[j].Servid
+	})
+	return list, newIndex, nil
+}
+
+func (m *consulRegistry) Watch(ctx context.Context, servKey string) (<-chan []*Instance, error) {
+	fun := "consulRegistry.Watch -->"
+
+	ch := make(chan []*Instance)
+	go func() {
+		defer close(ch)
+		backoff := xtime.NewBackOffCtrl(time.Millisecond*100, time.Second*5)
+		var index uint64
+		for {
+			list, newIndex, err := m.health(ctx, servKey, index)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logger().Warnf(ctx, "%s serv: %s index: %d err: %v", fun, servKey, index, err)
+				index = 0
+				backoff.BackOff()
+				continue
+			}
+			backoff.Reset()
+
+			// 阻塞查询超时返回时 index 不变
+			if index > 0 && newIndex == index {
+				continue
+			}
+			// index 回退时需要重新开始, 见 consul blocking queries 文档
+			if newIndex < index {
+				newIndex = 0
+			} else if newIndex == 0 {
+				newIndex = 1
+			}
+			index = newIndex
+
+			select {
+			case ch <- list:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
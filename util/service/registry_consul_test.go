@@ -0,0 +1,75 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeConsul struct {
+	mu       sync.Mutex
+	services map[string]*consulService
+}
+
+func (m *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/v1/agent/service/register":
+		svc := &consulService{}
+		json.NewDecoder(r.Body).Decode(svc)
+		svc.Service = svc.Name
+		m.services[svc.ID] = svc
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		delete(m.services, strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/"))
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/pass/"):
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+		var entries []*consulServiceEntry
+		for _, svc := range m.services {
+			if svc.Service == name {
+				entries = append(entries, &consulServiceEntry{Service: svc})
+			}
+		}
+		w.Header().Set("X-Consul-Index", "1")
+		json.NewEncoder(w).Encode(entries)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestConsulRegistry(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	srv := httptest.NewServer(&fakeConsul{services: make(map[string]*consulService)})
+	defer srv.Close()
+
+	reg, err := newConsulRegistry([]string{strings.TrimPrefix(srv.URL, "http://")})
+	ass.Nil(err)
+
+	ins := &Instance{
+		ServKey: "base/account",
+		Servid:  3,
+		Lane:    "pre",
+		Servs:   map[string]*ServInfo{PROCESSOR_GRPC_PROPERTY_NAME: {Type: "grpc", Addr: "127.0.0.1:9000"}},
+		Weight:  50,
+	}
+	ass.Nil(reg.Register(ctx, ins))
+
+	list, err := reg.GetInstances(ctx, "base/account")
+	ass.Nil(err)
+	ass.Equal([]*Instance{ins}, list)
+
+	ass.Nil(reg.Deregister(ctx, ins))
+	list, err = reg.GetInstances(ctx, "base/account")
+	ass.Nil(err)
+	ass.Len(list, 0)
+}
@@ -0,0 +1,88 @@
+package rocserv
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+)
+
+// EtcdGroupAddrsEnv etcd endpoints of registry per service group, such as "ops=http://a:2379,http://b:2379;pay=http://c:2379",
+// services of other groups are discovered from the default endpoints; it is used when SetEtcdResolver is not called
+const EtcdGroupAddrsEnv = "ROC_ETCD_GROUP_ADDRS"
+
+// EtcdResolver return etcd endpoints of the registry where service servGroup/servName is discovered, e.g. a client
+// running in cloud discovers on-prem services through another registry; ok false means the default endpoints are used
+type EtcdResolver func(servGroup, servName string) (addrs []string, ok bool)
+
+var (
+	muEtcdResolver sync.RWMutex
+	etcdResolver   EtcdResolver
+)
+
+// SetEtcdResolver set resolver of etcd endpoints used by clients created after it, nil restores the default
+func SetEtcdResolver(r EtcdResolver) {
+	muEtcdResolver.Lock()
+	defer muEtcdResolver.Unlock()
+	etcdResolver = r
+}
+
+func getEtcdResolver() EtcdResolver {
+	muEtcdResolver.RLock()
+	r := etcdResolver
+	muEtcdResolver.RUnlock()
+	if r != nil {
+		return r
+	}
+	if groups := parseEtcdGroupAddrs(os.Getenv(EtcdGroupAddrsEnv)); len(groups) > 0 {
+		return EtcdEndpointsByGroup(groups)
+	}
+	return nil
+}
+
+// EtcdEndpointsByGroup resolver of static etcd endpoints per service group
+func EtcdEndpointsByGroup(groups map[string][]string) EtcdResolver {
+	return func(servGroup, servName string) ([]string, bool) {
+		addrs, ok := groups[servGroup]
+		return addrs, ok && len(addrs) > 0
+	}
+}
+
+func parseEtcdGroupAddrs(v string) map[string][]string {
+	groups := make(map[string][]string)
+	for _, g := range strings.Split(v, ";") {
+		i := strings.Index(g, "=")
+		if i <= 0 {
+			continue
+		}
+		var addrs []string
+		for _, a := range strings.Split(g[i+1:], ",") {
+			if a = strings.TrimSpace(a); len(a) > 0 {
+				addrs = append(addrs, a)
+			}
+		}
+		if len(addrs) > 0 {
+			groups[strings.TrimSpace(g[:i])] = addrs
+		}
+	}
+	return groups
+}
+
+// resolve 按服务分组替换 etcd 地址, servlocation 形如 {servGroup}/{servName}
+func (m configEtcd) resolve(servlocation string) configEtcd {
+	fun := "configEtcd.resolve -->"
+	if m.resolver == nil {
+		return m
+	}
+	group, name := servlocation, ""
+	if i := strings.Index(servlocation, "/"); i >= 0 {
+		group, name = servlocation[:i], servlocation[i+1:]
+	}
+	addrs, ok := m.resolver(group, name)
+	if !ok || len(addrs) == 0 {
+		return m
+	}
+	logger().Infof(context.Background(), "%s service: %s discovered from etcd: %v", fun, servlocation, addrs)
+	m.etcdAddrs = addrs
+	return m
+}
@@ -0,0 +1,62 @@
+package rocserv
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEtcdGroupAddrs(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.Empty(parseEtcdGroupAddrs(""))
+	ass.Equal(map[string][]string{
+		"ops": {"http://a:2379", "http://b:2379"},
+		"pay": {"http://c:2379"},
+	}, parseEtcdGroupAddrs("ops=http://a:2379, http://b:2379;pay=http://c:2379;bad;empty="))
+}
+
+func TestConfigEtcdResolve(t *testing.T) {
+	ass := assert.New(t)
+
+	conf := configEtcd{etcdAddrs: []string{"http://cloud:2379"}, useBaseloc: "/roc"}
+	ass.Equal(conf, conf.resolve("ops/account"))
+
+	var gotGroup, gotName string
+	conf.resolver = func(servGroup, servName string) ([]string, bool) {
+		gotGroup, gotName = servGroup, servName
+		if servGroup == "ops" {
+			return []string{"http://onprem:2379"}, true
+		}
+		return nil, false
+	}
+	ass.Equal([]string{"http://onprem:2379"}, conf.resolve("ops/account").etcdAddrs)
+	ass.Equal("ops", gotGroup)
+	ass.Equal("account", gotName)
+	ass.Equal("/roc", conf.resolve("ops/account").useBaseloc)
+	ass.Equal([]string{"http://cloud:2379"}, conf.resolve("base/account").etcdAddrs)
+	// 原配置不变
+	ass.Equal([]string{"http://cloud:2379"}, conf.etcdAddrs)
+}
+
+func TestGetEtcdResolver(t *testing.T) {
+	ass := assert.New(t)
+	defer os.Unsetenv(EtcdGroupAddrsEnv)
+	defer SetEtcdResolver(nil)
+
+	ass.Nil(getEtcdResolver())
+
+	os.Setenv(EtcdGroupAddrsEnv, "ops=http://a:2379")
+	addrs, ok := getEtcdResolver()("ops", "account")
+	ass.True(ok)
+	ass.Equal([]string{"http://a:2379"}, addrs)
+	_, ok = getEtcdResolver()("base", "account")
+	ass.False(ok)
+
+	// SetEtcdResolver 优先于环境变量
+	SetEtcdResolver(EtcdEndpointsByGroup(map[string][]string{"base": {"http://b:2379"}}))
+	addrs, ok = getEtcdResolver()("base", "account")
+	ass.True(ok)
+	ass.Equal([]string{"http://b:2379"}, addrs)
+}
@@ -0,0 +1,104 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+const (
+	// 环境变量指定 etcd api 版本: v2(默认) v3 auto
+	etcdAPIVersionEnv = "ROC_ETCD_API"
+
+	etcdAPIV2   = "v2"
+	etcdAPIV3   = "v3"
+	etcdAPIAuto = "auto"
+
+	etcdAPIDetectTimeout = 3 * time.Second
+)
+
+func etcdAPIVersion() string {
+	v := strings.ToLower(os.Getenv(etcdAPIVersionEnv))
+	switch v {
+	case etcdAPIV3, etcdAPIAuto:
+		return v
+	default:
+		return etcdAPIV2
+	}
+}
+
+func newEtcdV2KeysAPI(addrs []string) (etcd.KeysAPI, error) {
+	cfg := etcd.Config{
+		Endpoints: addrs,
+		Transport: etcd.DefaultTransport,
+	}
+
+	c, err := etcd.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("create etchd client cfg error")
+	}
+
+	client := etcd.NewKeysAPI(c)
+	if client == nil {
+		return nil, fmt.Errorf("create etchd api error")
+	}
+	return client, nil
+}
+
+// newEtcdKeysAPI create keys api of v2 or v3 cluster, checkPath is used to detect api version in auto mode
+func newEtcdKeysAPI(addrs []string, checkPath string) (etcd.KeysAPI, error) {
+	fun := "newEtcdKeysAPI -->"
+	ctx := context.Background()
+
+	version := etcdAPIVersion()
+	logger().Infof(ctx, "%s addrs: %v api version: %s", fun, addrs, version)
+
+	var client etcd.KeysAPI
+	var err error
+	switch version {
+	case etcdAPIV3:
+		client, err = newEtcdV3KeysAPI(addrs)
+	case etcdAPIAuto:
+		client, err = detectEtcdKeysAPI(addrs, checkPath)
+	default:
+		client, err = newEtcdV2KeysAPI(addrs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return traceKeysAPI(client, checkPath), nil
+}
+
+// detectEtcdKeysAPI 集群支持 v2 接口时优先使用 v2, 保持与老版本注册数据一致; 否则使用 v3
+func detectEtcdKeysAPI(addrs []string, checkPath string) (etcd.KeysAPI, error) {
+	fun := "detectEtcdKeysAPI -->"
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdAPIDetectTimeout)
+	defer cancel()
+
+	v2, err := newEtcdV2KeysAPI(addrs)
+	if err != nil {
+		return nil, err
+	}
+	_, err = v2.Get(ctx, checkPath, nil)
+	if _, ok := err.(etcd.Error); err == nil || ok {
+		logger().Infof(ctx, "%s use v2, addrs: %v", fun, addrs)
+		return v2, nil
+	}
+	logger().Warnf(ctx, "%s v2 check path: %s err: %v, try v3", fun, checkPath, err)
+
+	v3, err := newEtcdV3KeysAPI(addrs)
+	if err != nil {
+		return nil, err
+	}
+	_, err = v3.Get(ctx, checkPath, nil)
+	if _, ok := err.(etcd.Error); err != nil && !ok {
+		return nil, fmt.Errorf("detect etcd api version failed, addrs: %v err: %v", addrs, err)
+	}
+	logger().Infof(ctx, "%s use v3, addrs: %v", fun, addrs)
+	return v3, nil
+}
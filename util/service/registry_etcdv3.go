@@ -0,0 +1,483 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+const etcdV3DialTimeout = 5 * time.Second
+
+// etcdV3KeysAPI implement etcd v2 KeysAPI on etcd v3 cluster, so that registration, discovery,
+// locks and config of roc work on v3 without changing the v2 key layout:
+// directories are emulated by key prefix, ttl by lease, index by revision
+type etcdV3KeysAPI struct {
+	client *clientv3.Client
+
+	muShared sync.Mutex
+	// ttl 秒数 -> SetShared 共用的 lease
+	shared map[int64]*v3SharedLease
+
+	muBatch sync.Mutex
+	// ttl 秒数 -> SetBatch 复用的 lease, 每轮写入时续约, 不再续约后到期回收
+	batch map[int64]clientv3.LeaseID
+}
+
+type v3SharedLease struct {
+	id      clientv3.LeaseID
+	granted time.Time
+}
+
+func newEtcdV3KeysAPI(addrs []string) (etcd.KeysAPI, error) {
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   addrs,
+		DialTimeout: etcdV3DialTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdV3KeysAPI{client: c}, nil
+}
+
+func dirPrefix(key string) string {
+	return strings.TrimSuffix(key, "/") + "/"
+}
+
+func v3Error(code int, key string, rev int64) error {
+	msg := "Key not found"
+	switch code {
+	case etcd.ErrorCodeNodeExist:
+		msg = "Key already exists"
+	case etcd.ErrorCodeTestFailed:
+		msg = "Compare failed"
+	case etcd.ErrorCodeEventIndexCleared:
+		msg = "The event in requested index is outdated and cleared"
+	}
+	return etcd.Error{Code: code, Message: msg, Cause: key, Index: uint64(rev)}
+}
+
+func v3Node(kv *mvccpb.KeyValue) *etcd.Node {
+	return &etcd.Node{
+		Key:           string(kv.Key),
+		Value:         string(kv.Value),
+		CreatedIndex:  uint64(kv.CreateRevision),
+		ModifiedIndex: uint64(kv.ModRevision),
+	}
+}
+
+// v3Tree build v2 directory node from kvs under prefix of key
+func v3Tree(key string, kvs []*mvccpb.KeyValue, recursive bool) *etcd.Node {
+	root := &etcd.Node{Key: strings.TrimSuffix(key, "/"), Dir: true}
+	dirs := map[string]*etcd.Node{root.Key: root}
+	prefix := dirPrefix(key)
+
+	for _, kv := range kvs {
+		parts := strings.Split(strings.TrimPrefix(string(kv.Key), prefix), "/")
+		cur := root
+		for i, part := range parts[:len(parts)-1] {
+			dk := cur.Key + "/" + part
+			d, ok := dirs[dk]
+			if !ok {
+				d = &etcd.Node{Key: dk, Dir: true}
+				dirs[dk] = d
+				cur.Nodes = append(cur.Nodes, d)
+			}
+			if kv.ModRevision > int64(d.ModifiedIndex) {
+				d.ModifiedIndex = uint64(kv.ModRevision)
+			}
+			// 非递归只返回直接子节点
+			if !recursive && i == 0 {
+				cur = nil
+				break
+			}
+			cur = d
+		}
+		if cur != nil {
+			cur.Nodes = append(cur.Nodes, v3Node(kv))
+		}
+	}
+	return root
+}
+
+func (m *etcdV3KeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	r, err := m.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Kvs) > 0 {
+		return &etcd.Response{Action: "get", Node: v3Node(r.Kvs[0]), Index: uint64(r.Header.Revision)}, nil
+	}
+
+	r, err = m.client.Get(ctx, dirPrefix(key), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Kvs) == 0 {
+		return nil, v3Error(etcd.ErrorCodeKeyNotFound, key, r.Header.Revision)
+	}
+
+	recursive := opts != nil && opts.Recursive
+	return &etcd.Response{Action: "get", Node: v3Tree(key, r.Kvs, recursive), Index: uint64(r.Header.Revision)}, nil
+}
+
+func (m *etcdV3KeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	if opts == nil {
+		opts = &etcd.SetOptions{}
+	}
+	// v3 没有目录, 目录由前缀隐式表示
+	if opts.Dir {
+		return &etcd.Response{Action: "set", Node: &etcd.Node{Key: key, Dir: true}}, nil
+	}
+	if opts.Refresh {
+		return m.refresh(ctx, key)
+	}
+
+	var cmps []clientv3.Cmp
+	failCode := etcd.ErrorCodeTestFailed
+	switch opts.PrevExist {
+	case etcd.PrevNoExist:
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), "=", 0))
+		failCode = etcd.ErrorCodeNodeExist
+	case etcd.PrevExist:
+		cmps = append(cmps, clientv3.Compare(clientv3.CreateRevision(key), ">", 0))
+		failCode = etcd.ErrorCodeKeyNotFound
+	}
+	if len(opts.PrevValue) > 0 {
+		cmps = append(cmps, clientv3.Compare(clientv3.Value(key), "=", opts.PrevValue))
+	}
+	if opts.PrevIndex > 0 {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", int64(opts.PrevIndex)))
+	}
+
+	var putOpts []clientv3.OpOption
+	if opts.TTL > 0 {
+		lease, err := m.client.Grant(ctx, int64(opts.TTL/time.Second))
+		if err != nil {
+			return nil, err
+		}
+		putOpts = append(putOpts, clientv3.WithLease(lease.ID))
+	}
+
+	r, err := m.client.Txn(ctx).If(cmps...).Then(clientv3.OpPut(key, value, putOpts...)).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !r.Succeeded {
+		return nil, v3Error(failCode, key, r.Header.Revision)
+	}
+
+	rev := r.Header.Revision
+	return &etcd.Response{
+		Action: "set",
+		Node:   &etcd.Node{Key: key, Value: value, ModifiedIndex: uint64(rev), TTL: int64(opts.TTL / time.Second)},
+		Index:  uint64(rev),
+	}, nil
+}
+
+// refresh 刷新 key 绑定的 lease, 不修改 value
+func (m *etcdV3KeysAPI) refresh(ctx context.Context, key string) (*etcd.Response, error) {
+	r, err := m.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Kvs) == 0 || r.Kvs[0].Lease == 0 {
+		return nil, v3Error(etcd.ErrorCodeKeyNotFound, key, r.Header.Revision)
+	}
+
+	ka, err := m.client.KeepAliveOnce(ctx, clientv3.LeaseID(r.Kvs[0].Lease))
+	if err != nil {
+		if err == rpctypes.ErrLeaseNotFound {
+			return nil, v3Error(etcd.ErrorCodeKeyNotFound, key, r.Header.Revision)
+		}
+		return nil, err
+	}
+
+	node := v3Node(r.Kvs[0])
+	node.TTL = ka.TTL
+	return &etcd.Response{Action: "update", Node: node, Index: uint64(r.Header.Revision)}, nil
+}
+
+func (m *etcdV3KeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	if opts == nil {
+		opts = &etcd.DeleteOptions{}
+	}
+
+	var cmps []clientv3.Cmp
+	if len(opts.PrevValue) > 0 {
+		cmps = append(cmps, clientv3.Compare(clientv3.Value(key), "=", opts.PrevValue))
+	}
+	if opts.PrevIndex > 0 {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", int64(opts.PrevIndex)))
+	}
+
+	ops := []clientv3.Op{clientv3.OpDelete(key)}
+	if opts.Recursive {
+		ops = append(ops, clientv3.OpDelete(dirPrefix(key), clientv3.WithPrefix()))
+	}
+
+	r, err := m.client.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !r.Succeeded {
+		return nil, v3Error(etcd.ErrorCodeTestFailed, key, r.Header.Revision)
+	}
+
+	var deleted int64
+	for _, resp := range r.Responses {
+		if d := resp.GetResponseDeleteRange(); d != nil {
+			deleted += d.Deleted
+		}
+	}
+	if deleted == 0 {
+		return nil, v3Error(etcd.ErrorCodeKeyNotFound, key, r.Header.Revision)
+	}
+
+	return &etcd.Response{Action: "delete", Node: &etcd.Node{Key: key, ModifiedIndex: uint64(r.Header.Revision)}, Index: uint64(r.Header.Revision)}, nil
+}
+
+func (m *etcdV3KeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return m.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevNoExist})
+}
+
+func (m *etcdV3KeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	return nil, fmt.Errorf("etcd v3 keys api not support create in order")
+}
+
+func (m *etcdV3KeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	return m.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevExist})
+}
+
+// SetShared put key with ttl without compare, keys of the same ttl written within ttl/10 share one lease,
+// so frequent writes do not pile up leases; key may expire up to ttl/10 earlier and must not be refreshed
+func (m *etcdV3KeysAPI) SetShared(ctx context.Context, key, value string, ttl time.Duration) error {
+	id, err := m.sharedLease(ctx, ttl)
+	if err != nil {
+		return err
+	}
+	_, err = m.client.Put(ctx, key, value, clientv3.WithLease(id))
+	return err
+}
+
+func (m *etcdV3KeysAPI) sharedLease(ctx context.Context, ttl time.Duration) (clientv3.LeaseID, error) {
+	sec := int64(ttl / time.Second)
+	if sec <= 0 {
+		sec = 1
+	}
+
+	m.muShared.Lock()
+	defer m.muShared.Unlock()
+	if l, ok := m.shared[sec]; ok && time.Since(l.granted) < ttl/10 {
+		return l.id, nil
+	}
+	lease, err := m.client.Grant(ctx, sec)
+	if err != nil {
+		return 0, err
+	}
+	if m.shared == nil {
+		m.shared = make(map[int64]*v3SharedLease)
+	}
+	// 旧的 lease 到期后自动回收
+	m.shared[sec] = &v3SharedLease{id: lease.ID, granted: time.Now()}
+	return lease.ID, nil
+}
+
+// batchLease 注册协程每轮都会写入, 复用同一个 lease 并续约, 避免每轮新建 lease
+func (m *etcdV3KeysAPI) batchLease(ctx context.Context, ttl time.Duration) (clientv3.LeaseID, error) {
+	sec := int64(ttl / time.Second)
+	if sec <= 0 {
+		sec = 1
+	}
+
+	m.muBatch.Lock()
+	defer m.muBatch.Unlock()
+	if id, ok := m.batch[sec]; ok {
+		_, err := m.client.KeepAliveOnce(ctx, id)
+		if err == nil {
+			return id, nil
+		}
+		if err != rpctypes.ErrLeaseNotFound {
+			return 0, err
+		}
+		// 已到期, 关联的 key 已被删除, 重新申请
+		delete(m.batch, sec)
+	}
+	lease, err := m.client.Grant(ctx, sec)
+	if err != nil {
+		return 0, err
+	}
+	if m.batch == nil {
+		m.batch = make(map[int64]clientv3.LeaseID)
+	}
+	m.batch[sec] = lease.ID
+	return lease.ID, nil
+}
+
+func (m *etcdV3KeysAPI) SetBatch(ctx context.Context, kvs map[string]string, ttl time.Duration) error {
+	id, err := m.batchLease(ctx, ttl)
+	if err != nil {
+		return err
+	}
+
+	ops := make([]clientv3.Op, 0, len(kvs))
+	for k, v := range kvs {
+		ops = append(ops, clientv3.OpPut(k, v, clientv3.WithLease(id)))
+	}
+	_, err = m.client.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+func (m *etcdV3KeysAPI) RefreshBatch(ctx context.Context, keys []string) error {
+	ops := make([]clientv3.Op, 0, len(keys))
+	for _, k := range keys {
+		ops = append(ops, clientv3.OpGet(k))
+	}
+	r, err := m.client.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+
+	// 同一批写入的 key 共用 lease, 每个 lease 只需续约一次
+	leases := make(map[clientv3.LeaseID]bool)
+	for i, resp := range r.Responses {
+		g := resp.GetResponseRange()
+		if g == nil || len(g.Kvs) == 0 || g.Kvs[0].Lease == 0 {
+			return v3Error(etcd.ErrorCodeKeyNotFound, keys[i], r.Header.Revision)
+		}
+		leases[clientv3.LeaseID(g.Kvs[0].Lease)] = true
+	}
+
+	for id := range leases {
+		if _, err := m.client.KeepAliveOnce(ctx, id); err != nil {
+			if err == rpctypes.ErrLeaseNotFound {
+				return v3Error(etcd.ErrorCodeKeyNotFound, "", r.Header.Revision)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *etcdV3KeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	w := &etcdV3Watcher{client: m.client, key: strings.TrimSuffix(key, "/")}
+	if opts != nil {
+		w.recursive = opts.Recursive
+		if opts.AfterIndex > 0 {
+			w.rev = int64(opts.AfterIndex) + 1
+		}
+	}
+	return w
+}
+
+// etcdV3Watcher v2 watcher on one long-lived v3 watch stream, the stream is opened by first Next and
+// kept across Next calls; it is closed on error or when ctx of Next is done, and reopened from rev by next Next
+type etcdV3Watcher struct {
+	client    *clientv3.Client
+	key       string
+	recursive bool
+	rev       int64
+
+	pending []*etcd.Response
+
+	wch    clientv3.WatchChan
+	cancel context.CancelFunc
+}
+
+func (m *etcdV3Watcher) open() {
+	opts := []clientv3.OpOption{clientv3.WithPrevKV()}
+	if m.recursive {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	if m.rev > 0 {
+		opts = append(opts, clientv3.WithRev(m.rev))
+	}
+
+	// stream 的生命周期跨越多次 Next, 不能绑定单次 Next 的 ctx
+	wctx, cancel := context.WithCancel(context.Background())
+	m.wch = m.client.Watch(wctx, m.key, opts...)
+	m.cancel = cancel
+}
+
+func (m *etcdV3Watcher) close() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.wch, m.cancel = nil, nil
+}
+
+func (m *etcdV3Watcher) match(key string) bool {
+	if key == m.key {
+		return true
+	}
+	return m.recursive && strings.HasPrefix(key, m.key+"/")
+}
+
+func (m *etcdV3Watcher) Next(ctx context.Context) (*etcd.Response, error) {
+	if len(m.pending) > 0 {
+		r := m.pending[0]
+		m.pending = m.pending[1:]
+		return r, nil
+	}
+
+	if m.wch == nil {
+		m.open()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			m.close()
+			return nil, ctx.Err()
+		case wr, ok := <-m.wch:
+			if !ok {
+				m.close()
+				return nil, fmt.Errorf("etcd v3 watch key: %s closed", m.key)
+			}
+			if wr.CompactRevision > 0 {
+				m.close()
+				return nil, v3Error(etcd.ErrorCodeEventIndexCleared, m.key, wr.CompactRevision)
+			}
+			if err := wr.Err(); err != nil {
+				m.close()
+				return nil, err
+			}
+
+			for _, ev := range wr.Events {
+				m.rev = ev.Kv.ModRevision + 1
+				if !m.match(string(ev.Kv.Key)) {
+					continue
+				}
+				m.pending = append(m.pending, v3Response(ev))
+			}
+			if len(m.pending) > 0 {
+				r := m.pending[0]
+				m.pending = m.pending[1:]
+				return r, nil
+			}
+		}
+	}
+}
+
+func v3Response(ev *clientv3.Event) *etcd.Response {
+	r := &etcd.Response{
+		Action: "set",
+		Node:   v3Node(ev.Kv),
+		Index:  uint64(ev.Kv.ModRevision),
+	}
+	if ev.Type == clientv3.EventTypeDelete {
+		// v3 中 lease 过期和主动删除都是 delete 事件
+		r.Action = "delete"
+	} else if ev.IsCreate() {
+		r.Action = "create"
+	}
+	if ev.PrevKv != nil {
+		r.PrevNode = v3Node(ev.PrevKv)
+	}
+	return r
+}
@@ -0,0 +1,230 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+const (
+	// EtcdFallbackEnv fallback etcd clusters of service discovery used when the primary cluster is down,
+	// clusters are separated by ';' and endpoints of a cluster by ',', such as "http://a:2379,http://b:2379;http://c:2379"
+	EtcdFallbackEnv = "ROC_ETCD_FALLBACK_ADDRS"
+
+	// 使用备用集群时, 间隔该时间后重新尝试主集群
+	etcdPrimaryRetryInterval = 30 * time.Second
+)
+
+var errFallbackWatchExpired = errors.New("watch on fallback etcd cluster expired, retry primary")
+
+func etcdFallbackAddrs() [][]string {
+	var clusters [][]string
+	for _, c := range strings.Split(os.Getenv(EtcdFallbackEnv), ";") {
+		var addrs []string
+		for _, a := range strings.Split(c, ",") {
+			if a = strings.TrimSpace(a); len(a) > 0 {
+				addrs = append(addrs, a)
+			}
+		}
+		if len(addrs) > 0 {
+			clusters = append(clusters, addrs)
+		}
+	}
+	return clusters
+}
+
+// newDiscoveryKeysAPI 配置了备用集群时读取失败自动切换集群, 否则同 newEtcdKeysAPI
+func newDiscoveryKeysAPI(addrs []string, checkPath string) (etcd.KeysAPI, error) {
+	fallbacks := etcdFallbackAddrs()
+	if len(fallbacks) == 0 {
+		return newEtcdKeysAPI(addrs, checkPath)
+	}
+	return newFailoverKeysAPI(append([][]string{addrs}, fallbacks...), checkPath, newEtcdKeysAPI), nil
+}
+
+type etcdCluster struct {
+	addrs []string
+	api   etcd.KeysAPI
+}
+
+// failoverKeysAPI 服务发现使用, 读请求在集群不可用时依次切换到备用集群, 写请求只发往主集群;
+// Get 和 Watcher 使用同一个集群, watch 循环重新 Get 时完成切换
+type failoverKeysAPI struct {
+	checkPath string
+	create    func(addrs []string, checkPath string) (etcd.KeysAPI, error)
+
+	mu       sync.Mutex
+	clusters []*etcdCluster
+	current  int
+	// 最近一次主集群不可用的时间
+	failedAt time.Time
+}
+
+func newFailoverKeysAPI(clusters [][]string, checkPath string, create func([]string, string) (etcd.KeysAPI, error)) *failoverKeysAPI {
+	m := &failoverKeysAPI{checkPath: checkPath, create: create}
+	for _, addrs := range clusters {
+		m.clusters = append(m.clusters, &etcdCluster{addrs: addrs})
+	}
+	return m
+}
+
+// cluster 集群 client 延迟创建, 启动时主集群不可用不影响使用备用集群
+func (m *failoverKeysAPI) cluster(i int) (etcd.KeysAPI, error) {
+	fun := "failoverKeysAPI.cluster -->"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.clusters[i]
+	if c.api == nil {
+		api, err := m.create(c.addrs, m.checkPath)
+		if err != nil {
+			logger().Warnf(context.Background(), "%s create client of etcd cluster: %v err: %v", fun, c.addrs, err)
+			return nil, err
+		}
+		c.api = api
+	}
+	return c.api, nil
+}
+
+// start 使用备用集群超过重试间隔后先尝试主集群
+func (m *failoverKeysAPI) start() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.current != 0 && time.Since(m.failedAt) >= etcdPrimaryRetryInterval {
+		return 0
+	}
+	return m.current
+}
+
+// use primaryFailed 为 true 时本次尝试过主集群并失败, 重新计算重试间隔
+func (m *failoverKeysAPI) use(i int, primaryFailed bool) {
+	fun := "failoverKeysAPI.use -->"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if primaryFailed {
+		m.failedAt = time.Now()
+	}
+	if i == m.current {
+		return
+	}
+	logger().Warnf(context.Background(), "%s service discovery switch etcd cluster from: %v to: %v", fun, m.clusters[m.current].addrs, m.clusters[i].addrs)
+	m.current = i
+	group, service := GetGroupAndService()
+	_metricRegistryEtcdCluster.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Set(float64(i))
+}
+
+// isClusterError key 不存在等 etcd 返回的错误说明集群可用
+func isClusterError(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	_, ok := err.(etcd.Error)
+	return !ok
+}
+
+func (m *failoverKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	fun := "failoverKeysAPI.Get -->"
+
+	start := m.start()
+	var err error
+	for i := 0; i < len(m.clusters); i++ {
+		idx := (start + i) % len(m.clusters)
+		var api etcd.KeysAPI
+		api, err = m.cluster(idx)
+		if err != nil {
+			continue
+		}
+		var r *etcd.Response
+		r, err = api.Get(ctx, key, opts)
+		if !isClusterError(ctx, err) {
+			m.use(idx, start == 0 && idx != 0)
+			return r, err
+		}
+		logger().Warnf(ctx, "%s get key: %s from etcd cluster: %v err: %v", fun, key, m.clusters[idx].addrs, err)
+	}
+	return nil, err
+}
+
+// Watcher 使用最近一次 Get 成功的集群, 在备用集群上的 watch 到达重试间隔后失败, 使 watch 循环重新尝试主集群
+func (m *failoverKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	m.mu.Lock()
+	idx, failedAt := m.current, m.failedAt
+	m.mu.Unlock()
+
+	api, err := m.cluster(idx)
+	if err != nil {
+		return nil
+	}
+	w := api.Watcher(key, opts)
+	if idx == 0 || w == nil {
+		return w
+	}
+	return &expiringWatcher{Watcher: w, deadline: failedAt.Add(etcdPrimaryRetryInterval)}
+}
+
+type expiringWatcher struct {
+	etcd.Watcher
+	deadline time.Time
+}
+
+func (m *expiringWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	ctx, cancel := context.WithDeadline(ctx, m.deadline)
+	defer cancel()
+	r, err := m.Watcher.Next(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, errFallbackWatchExpired
+	}
+	return r, err
+}
+
+func (m *failoverKeysAPI) primary() (etcd.KeysAPI, error) {
+	return m.cluster(0)
+}
+
+func (m *failoverKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	api, err := m.primary()
+	if err != nil {
+		return nil, err
+	}
+	return api.Set(ctx, key, value, opts)
+}
+
+func (m *failoverKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	api, err := m.primary()
+	if err != nil {
+		return nil, err
+	}
+	return api.Delete(ctx, key, opts)
+}
+
+func (m *failoverKeysAPI) Create(ctx context.Context, key, value string) (*etcd.Response, error) {
+	api, err := m.primary()
+	if err != nil {
+		return nil, err
+	}
+	return api.Create(ctx, key, value)
+}
+
+func (m *failoverKeysAPI) CreateInOrder(ctx context.Context, dir, value string, opts *etcd.CreateInOrderOptions) (*etcd.Response, error) {
+	api, err := m.primary()
+	if err != nil {
+		return nil, err
+	}
+	return api.CreateInOrder(ctx, dir, value, opts)
+}
+
+func (m *failoverKeysAPI) Update(ctx context.Context, key, value string) (*etcd.Response, error) {
+	api, err := m.primary()
+	if err != nil {
+		return nil, err
+	}
+	return api.Update(ctx, key, value)
+}
@@ -0,0 +1,130 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// clusterKeysAPI down 时模拟集群不可用
+type clusterKeysAPI struct {
+	etcd.KeysAPI
+	name string
+	down bool
+	sets int
+}
+
+func (m *clusterKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	if m.down {
+		return nil, errors.New("client: etcd cluster is unavailable or misconfigured")
+	}
+	if key == "/missing" {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	}
+	return &etcd.Response{Node: &etcd.Node{Key: key, Value: m.name}}, nil
+}
+
+func (m *clusterKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	m.sets++
+	return &etcd.Response{}, nil
+}
+
+func (m *clusterKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	return &blockingWatcher{}
+}
+
+type blockingWatcher struct{}
+
+func (m *blockingWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestEtcdFallbackAddrs(t *testing.T) {
+	ass := assert.New(t)
+	defer os.Unsetenv(EtcdFallbackEnv)
+
+	os.Setenv(EtcdFallbackEnv, "")
+	ass.Nil(etcdFallbackAddrs())
+
+	os.Setenv(EtcdFallbackEnv, "http://a:2379, http://b:2379;;http://c:2379")
+	ass.Equal([][]string{{"http://a:2379", "http://b:2379"}, {"http://c:2379"}}, etcdFallbackAddrs())
+}
+
+func TestFailoverKeysAPI(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	clusters := map[string]*clusterKeysAPI{
+		"primary":  {name: "primary"},
+		"fallback": {name: "fallback"},
+	}
+	create := func(addrs []string, checkPath string) (etcd.KeysAPI, error) {
+		return clusters[addrs[0]], nil
+	}
+	api := newFailoverKeysAPI([][]string{{"primary"}, {"fallback"}}, "/roc", create)
+
+	r, err := api.Get(ctx, "/roc/a", nil)
+	ass.Nil(err)
+	ass.Equal("primary", r.Node.Value)
+	// key 不存在不切换集群
+	_, err = api.Get(ctx, "/missing", nil)
+	ass.IsType(etcd.Error{}, err)
+	ass.Equal(0, api.current)
+	_, ok := api.Watcher("/roc/a", nil).(*blockingWatcher)
+	ass.True(ok)
+
+	clusters["primary"].down = true
+	r, err = api.Get(ctx, "/roc/a", nil)
+	ass.Nil(err)
+	ass.Equal("fallback", r.Node.Value)
+	ass.Equal(1, api.current)
+
+	// 写请求只发往主集群
+	_, err = api.Set(ctx, "/roc/a", "v", nil)
+	ass.Nil(err)
+	ass.Equal(1, clusters["primary"].sets)
+	ass.Equal(0, clusters["fallback"].sets)
+
+	// 备用集群上的 watch 到期后返回, watch 循环重新 Get
+	api.failedAt = time.Now().Add(-etcdPrimaryRetryInterval + 50*time.Millisecond)
+	_, err = api.Watcher("/roc/a", nil).Next(ctx)
+	ass.Equal(errFallbackWatchExpired, err)
+
+	// 主集群恢复后, 到达重试间隔时切回
+	clusters["primary"].down = false
+	r, err = api.Get(ctx, "/roc/a", nil)
+	ass.Nil(err)
+	ass.Equal("primary", r.Node.Value)
+	ass.Equal(0, api.current)
+
+	// 全部不可用时返回错误
+	clusters["primary"].down = true
+	clusters["fallback"].down = true
+	_, err = api.Get(ctx, "/roc/a", nil)
+	ass.NotNil(err)
+}
+
+func TestFailoverKeysAPIPrimaryCreateErr(t *testing.T) {
+	ass := assert.New(t)
+
+	fallback := &clusterKeysAPI{name: "fallback"}
+	create := func(addrs []string, checkPath string) (etcd.KeysAPI, error) {
+		if addrs[0] == "primary" {
+			return nil, errors.New("dial timeout")
+		}
+		return fallback, nil
+	}
+	api := newFailoverKeysAPI([][]string{{"primary"}, {"fallback"}}, "/roc", create)
+
+	r, err := api.Get(context.Background(), "/roc/a", nil)
+	ass.Nil(err)
+	ass.Equal("fallback", r.Node.Value)
+	_, ok := api.Watcher("/roc/a", nil).(*expiringWatcher)
+	ass.True(ok)
+}
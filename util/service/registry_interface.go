@@ -10,6 +10,17 @@ type ClientLookup interface {
 	ServPath() string
 }
 
+// NewClientLookup 默认通过 etcd 发现服务, 环境变量 ROC_REGISTRY 指定其他注册中心时从该注册中心发现
 func NewClientLookup(etcdaddrs []string, baseLoc string, servlocation string) (*ClientEtcdV2, error) {
-	return NewClientEtcdV2(configEtcd{etcdaddrs, baseLoc}, servlocation)
+	confEtcd := configEtcd{etcdAddrs: etcdaddrs, useBaseloc: baseLoc, resolver: getEtcdResolver()}
+	conf := loadConfigRegistry(confEtcd)
+	if conf.backend == REGISTRY_ETCD {
+		return NewClientEtcdV2(confEtcd, servlocation)
+	}
+
+	reg, err := getRegistry(conf)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithRegistry(reg, servlocation)
 }
@@ -0,0 +1,561 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
+)
+
+const (
+	k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	k8sWatchTimeout      = 5 * time.Minute
+)
+
+type k8sEndpointAddress struct {
+	IP        string `json:"ip"`
+	TargetRef *struct {
+		Name string `json:"name"`
+	} `json:"targetRef"`
+}
+
+type k8sEndpointPort struct {
+	Name        string `json:"name"`
+	Port        int    `json:"port"`
+	AppProtocol string `json:"appProtocol"`
+}
+
+type k8sEndpoints struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Subsets []struct {
+		Addresses []*k8sEndpointAddress `json:"addresses"`
+		Ports     []*k8sEndpointPort    `json:"ports"`
+	} `json:"subsets"`
+}
+
+// k8sEndpointSlice discovery.k8s.io/v1 EndpointSlice, 一个 Service 可能有多个
+type k8sEndpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			// 为空表示未知, 按 ready 处理
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+		TargetRef *struct {
+			Name string `json:"name"`
+		} `json:"targetRef"`
+		Zone string `json:"zone"`
+	} `json:"endpoints"`
+	Ports []*k8sEndpointPort `json:"ports"`
+}
+
+type k8sEndpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []*k8sEndpointSlice `json:"items"`
+}
+
+// k8sAddress 从 Endpoints 或 EndpointSlice 中解析出的一个 ready 地址
+type k8sAddress struct {
+	ip    string
+	ref   string
+	zone  string
+	ports []*k8sEndpointPort
+}
+
+const (
+	k8sSliceUnknown int32 = iota
+	k8sSliceSupported
+	k8sSliceUnsupported
+)
+
+type k8sWatchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// kubernetesRegistry 通过 kubernetes EndpointSlice 发现服务, 集群不支持 discovery.k8s.io/v1 时使用 Endpoints,
+// 实例由 kubernetes 根据 readiness 维护, 不需要注册;
+// 服务 {servGroup}/{servName} 对应 namespace 为 servGroup 下名为 servName 的 Service,
+// Service 端口名为 processor 名, 其中 _ 替换为 -, 如 proc-grpc
+type kubernetesRegistry struct {
+	host      string
+	tokenFile string
+	client    *http.Client
+	// 是否支持 EndpointSlice, 首次 list 时探测
+	slices int32
+}
+
+// newKubernetesRegistry addrs 为空时使用 in-cluster 配置, 否则使用第一个地址, 如 kubectl proxy 的地址
+func newKubernetesRegistry(addrs []string) (*kubernetesRegistry, error) {
+	m := &kubernetesRegistry{
+		client: &http.Client{Timeout: k8sWatchTimeout + time.Minute},
+	}
+
+	if len(addrs) > 0 {
+		m.host = strings.TrimSuffix(addrs[0], "/")
+		return m, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) == 0 || len(port) == 0 {
+		return nil, fmt.Errorf("not running in kubernetes cluster")
+	}
+	m.host = "https://" + net.JoinHostPort(host, port)
+	m.tokenFile = k8sServiceAccountDir + "/token"
+
+	ca, err := ioutil.ReadFile(k8sServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("kubernetes ca cert invalid")
+	}
+	m.client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return m, nil
+}
+
+// NewClientKubernetes create client lookup of servlocation, instances are discovered from kubernetes endpoints in cluster
+func NewClientKubernetes(servlocation string) (*ClientEtcdV2, error) {
+	reg, err := getRegistry(configRegistry{backend: REGISTRY_KUBERNETES})
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithRegistry(reg, servlocation)
+}
+
+func k8sServiceRef(servKey string) (namespace, name string) {
+	parts := strings.SplitN(servKey, "/", 2)
+	if len(parts) != 2 {
+		return "default", strings.Replace(servKey, "_", "-", -1)
+	}
+	return parts[0], strings.Replace(parts[1], "_", "-", -1)
+}
+
+func (m *kubernetesRegistry) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := m.host + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	// service account token 会定期轮换, 每次请求重新读取
+	if len(m.tokenFile) > 0 {
+		token, err := ioutil.ReadFile(m.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	return m.client.Do(req)
+}
+
+func (m *kubernetesRegistry) Register(ctx context.Context, ins *Instance) error {
+	return nil
+}
+
+func (m *kubernetesRegistry) Deregister(ctx context.Context, ins *Instance) error {
+	return nil
+}
+
+func (m *kubernetesRegistry) GetInstances(ctx context.Context, servKey string) ([]*Instance, error) {
+	if m.useSlices(ctx, servKey) {
+		slices, _, err := m.listSlices(ctx, servKey)
+		return parseK8sEndpointSlices(servKey, slices), err
+	}
+	list, _, err := m.list(ctx, servKey)
+	return list, err
+}
+
+// useSlices 未探测时 list 一次 EndpointSlice, 返回 404 说明集群不支持 discovery.k8s.io/v1
+func (m *kubernetesRegistry) useSlices(ctx context.Context, servKey string) bool {
+	switch atomic.LoadInt32(&m.slices) {
+	case k8sSliceSupported:
+		return true
+	case k8sSliceUnsupported:
+		return false
+	}
+
+	ns, _ := k8sServiceRef(servKey)
+	resp, err := m.get(ctx, fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", ns), url.Values{"limit": []string{"1"}})
+	if err != nil {
+		// 网络错误时下次再探测, 本次使用 Endpoints
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		logger().Infof(ctx, "kubernetesRegistry.useSlices --> endpointslice not supported, use endpoints")
+		atomic.StoreInt32(&m.slices, k8sSliceUnsupported)
+		return false
+	}
+	atomic.StoreInt32(&m.slices, k8sSliceSupported)
+	return true
+}
+
+func k8sSliceQuery(name string) url.Values {
+	query := url.Values{}
+	query.Set("labelSelector", "kubernetes.io/service-name="+name)
+	return query
+}
+
+// listSlices 返回 slice 名到 slice 的映射, 用于之后按 watch 事件更新
+func (m *kubernetesRegistry) listSlices(ctx context.Context, servKey string) (map[string]*k8sEndpointSlice, string, error) {
+	ns, name := k8sServiceRef(servKey)
+	resp, err := m.get(ctx, fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", ns), k8sSliceQuery(name))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("kubernetes list endpointslices %s/%s status: %d body: %s", ns, name, resp.StatusCode, data)
+	}
+
+	var sl k8sEndpointSliceList
+	if err := json.Unmarshal(data, &sl); err != nil {
+		return nil, "", err
+	}
+	slices := make(map[string]*k8sEndpointSlice, len(sl.Items))
+	for _, item := range sl.Items {
+		slices[item.Metadata.Name] = item
+	}
+	return slices, sl.Metadata.ResourceVersion, nil
+}
+
+func (m *kubernetesRegistry) list(ctx context.Context, servKey string) ([]*Instance, string, error) {
+	ns, name := k8sServiceRef(servKey)
+	resp, err := m.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/endpoints/%s", ns, name), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("kubernetes get endpoints %s/%s status: %d body: %s", ns, name, resp.StatusCode, data)
+	}
+
+	var ep k8sEndpoints
+	if err := json.Unmarshal(data, &ep); err != nil {
+		return nil, "", err
+	}
+	return parseK8sEndpoints(servKey, &ep), ep.Metadata.ResourceVersion, nil
+}
+
+// parseK8sEndpoints 只使用 ready 的地址
+func parseK8sEndpoints(servKey string, ep *k8sEndpoints) []*Instance {
+	var addrs []*k8sAddress
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			a := &k8sAddress{ip: addr.IP, ports: subset.Ports}
+			if addr.TargetRef != nil {
+				a.ref = addr.TargetRef.Name
+			}
+			addrs = append(addrs, a)
+		}
+	}
+	return buildK8sInstances(servKey, addrs)
+}
+
+// parseK8sEndpointSlices 合并 Service 的所有 slice, 只使用 ready 的地址
+func parseK8sEndpointSlices(servKey string, slices map[string]*k8sEndpointSlice) []*Instance {
+	var addrs []*k8sAddress
+	for _, slice := range slices {
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, ip := range ep.Addresses {
+				a := &k8sAddress{ip: ip, zone: ep.Zone, ports: slice.Ports}
+				if ep.TargetRef != nil {
+					a.ref = ep.TargetRef.Name
+				}
+				addrs = append(addrs, a)
+			}
+		}
+	}
+	return buildK8sInstances(servKey, addrs)
+}
+
+// buildK8sInstances 同一 ip 为一个实例; kubernetes 中没有 servid, 由 pod 名 hash 得到
+func buildK8sInstances(servKey string, addrs []*k8sAddress) []*Instance {
+	byIP := make(map[string]*Instance)
+	for _, addr := range addrs {
+		ins, ok := byIP[addr.ip]
+		if !ok {
+			key := addr.ip
+			if len(addr.ref) > 0 {
+				key = addr.ref
+			}
+			ins = &Instance{
+				ServKey: servKey,
+				Servid:  int(crc32.ChecksumIEEE([]byte(key)) & 0x7fffffff),
+				Servs:   make(map[string]*ServInfo),
+				Zone:    addr.zone,
+			}
+			byIP[addr.ip] = ins
+		}
+
+		for _, port := range addr.ports {
+			if port == nil || port.Port == 0 {
+				continue
+			}
+			proc := strings.Replace(port.Name, "-", "_", -1)
+			ins.Servs[proc] = &ServInfo{
+				Type: k8sPortType(port),
+				Addr: net.JoinHostPort(addr.ip, fmt.Sprint(port.Port)),
+			}
+		}
+	}
+
+	list := make([]*Instance, 0, len(byIP))
+	for _, ins := range byIP {
+		list = append(list, ins)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Servid < list[j].Servid
+	})
+	// hash 冲突时顺延
+	for i := 1; i < len(list); i++ {
+		if list[i].Servid <= list[i-1].Servid {
+			list[i].Servid = list[i-1].Servid + 1
+		}
+	}
+	return list
+}
+
+// k8sPortType 优先使用 appProtocol, 否则按端口名后缀推断, 如 proc-grpc
+func k8sPortType(port *k8sEndpointPort) string {
+	if len(port.AppProtocol) > 0 {
+		return port.AppProtocol
+	}
+	name := port.Name
+	if i := strings.LastIndex(name, "-"); i >= 0 {
+		name = name[i+1:]
+	}
+	switch name {
+	case PROCESSOR_GRPC, PROCESSOR_THRIFT, PROCESSOR_HTTP:
+		return name
+	}
+	return ""
+}
+
+func (m *kubernetesRegistry) Watch(ctx context.Context, servKey string) (<-chan []*Instance, error) {
+	fun := "kubernetesRegistry.Watch -->"
+
+	ch := make(chan []*Instance)
+	go func() {
+		defer close(ch)
+		backoff := xtime.NewBackOffCtrl(time.Millisecond*100, time.Second*5)
+		for {
+			if m.useSlices(ctx, servKey) {
+				err := m.listWatchSlices(ctx, servKey, ch)
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					logger().Warnf(ctx, "%s list watch endpointslices serv: %s err: %v", fun, servKey, err)
+					backoff.BackOff()
+					continue
+				}
+				backoff.Reset()
+				continue
+			}
+
+			list, version, err := m.list(ctx, servKey)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logger().Warnf(ctx, "%s list serv: %s err: %v", fun, servKey, err)
+				backoff.BackOff()
+				continue
+			}
+
+			select {
+			case ch <- list:
+			case <-ctx.Done():
+				return
+			}
+
+			err = m.watch(ctx, servKey, version, ch)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logger().Warnf(ctx, "%s watch serv: %s version: %s err: %v", fun, servKey, version, err)
+				backoff.BackOff()
+				continue
+			}
+			backoff.Reset()
+		}
+	}()
+	return ch, nil
+}
+
+// watch 处理 watch 流直到超时或出错, 之后由调用方重新 list
+func (m *kubernetesRegistry) watch(ctx context.Context, servKey, version string, ch chan<- []*Instance) error {
+	ns, name := k8sServiceRef(servKey)
+
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("fieldSelector", "metadata.name="+name)
+	query.Set("timeoutSeconds", fmt.Sprint(int(k8sWatchTimeout/time.Second)))
+	if len(version) > 0 {
+		query.Set("resourceVersion", version)
+	}
+
+	resp, err := m.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/endpoints", ns), query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("kubernetes watch endpoints %s/%s status: %d body: %s", ns, name, resp.StatusCode, data)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev k8sWatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var list []*Instance
+		switch ev.Type {
+		case "ADDED", "MODIFIED":
+			var ep k8sEndpoints
+			if err := json.Unmarshal(ev.Object, &ep); err != nil {
+				return err
+			}
+			list = parseK8sEndpoints(servKey, &ep)
+		case "DELETED":
+		case "ERROR":
+			// 一般为 410 Gone, resourceVersion 过期需要重新 list
+			return fmt.Errorf("kubernetes watch error: %s", ev.Object)
+		default:
+			continue
+		}
+
+		select {
+		case ch <- list:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// listWatchSlices list 并发送当前实例, 然后处理 watch 流直到超时或出错
+func (m *kubernetesRegistry) listWatchSlices(ctx context.Context, servKey string, ch chan<- []*Instance) error {
+	slices, version, err := m.listSlices(ctx, servKey)
+	if err != nil {
+		return err
+	}
+	select {
+	case ch <- parseK8sEndpointSlices(servKey, slices):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	ns, name := k8sServiceRef(servKey)
+	query := k8sSliceQuery(name)
+	query.Set("watch", "true")
+	query.Set("timeoutSeconds", fmt.Sprint(int(k8sWatchTimeout/time.Second)))
+	if len(version) > 0 {
+		query.Set("resourceVersion", version)
+	}
+
+	resp, err := m.get(ctx, fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", ns), query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("kubernetes watch endpointslices %s/%s status: %d body: %s", ns, name, resp.StatusCode, data)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev k8sWatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if applyK8sSliceEvent(slices, &ev) {
+			select {
+			case ch <- parseK8sEndpointSlices(servKey, slices):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if ev.Type == "ERROR" {
+			// 一般为 410 Gone, resourceVersion 过期需要重新 list
+			return fmt.Errorf("kubernetes watch error: %s", ev.Object)
+		}
+	}
+}
+
+// applyK8sSliceEvent 按 watch 事件更新 slices, 返回实例列表是否需要重新生成
+func applyK8sSliceEvent(slices map[string]*k8sEndpointSlice, ev *k8sWatchEvent) bool {
+	switch ev.Type {
+	case "ADDED", "MODIFIED", "DELETED":
+	default:
+		return false
+	}
+	var slice k8sEndpointSlice
+	if err := json.Unmarshal(ev.Object, &slice); err != nil {
+		return false
+	}
+	if ev.Type == "DELETED" {
+		delete(slices, slice.Metadata.Name)
+	} else {
+		slices[slice.Metadata.Name] = &slice
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseK8sEndpoints(t *testing.T) {
+	ass := assert.New(t)
+
+	data := `{
+		"metadata": {"resourceVersion": "12"},
+		"subsets": [{
+			"addresses": [{"ip": "10.0.0.1", "targetRef": {"name": "account-0"}}, {"ip": "10.0.0.2"}],
+			"ports": [{"name": "proc-grpc", "port": 9000}, {"name": "proc-http", "port": 8080, "appProtocol": "http"}]
+		}]
+	}`
+	var ep k8sEndpoints
+	ass.Nil(json.Unmarshal([]byte(data), &ep))
+
+	list := parseK8sEndpoints("base/account", &ep)
+	ass.Len(list, 2)
+	ass.True(list[0].Servid < list[1].Servid)
+
+	addrs := map[string]bool{}
+	for _, ins := range list {
+		ass.Equal("grpc", ins.Servs["proc_grpc"].Type)
+		ass.Equal("http", ins.Servs["proc_http"].Type)
+		addrs[ins.Servs["proc_grpc"].Addr] = true
+	}
+	ass.Equal(map[string]bool{"10.0.0.1:9000": true, "10.0.0.2:9000": true}, addrs)
+
+	ns, name := k8sServiceRef("base/account_v2")
+	ass.Equal("base", ns)
+	ass.Equal("account-v2", name)
+}
+
+func TestParseK8sEndpointSlices(t *testing.T) {
+	ass := assert.New(t)
+
+	list := `{
+		"metadata": {"resourceVersion": "20"},
+		"items": [{
+			"metadata": {"name": "account-abc"},
+			"endpoints": [
+				{"addresses": ["10.0.0.1"], "conditions": {"ready": true}, "targetRef": {"name": "account-0"}, "zone": "z1"},
+				{"addresses": ["10.0.0.3"], "conditions": {"ready": false}}
+			],
+			"ports": [{"name": "proc-grpc", "port": 9000}]
+		}, {
+			"metadata": {"name": "account-def"},
+			"endpoints": [{"addresses": ["10.0.0.2"], "zone": "z2"}],
+			"ports": [{"name": "proc-grpc", "port": 9000}]
+		}]
+	}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/base/endpointslices" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(list))
+	}))
+	defer srv.Close()
+
+	m, err := newKubernetesRegistry([]string{srv.URL})
+	ass.Nil(err)
+	ctx := context.Background()
+	ass.True(m.useSlices(ctx, "base/account"))
+
+	slices, version, err := m.listSlices(ctx, "base/account")
+	ass.Nil(err)
+	ass.Equal("20", version)
+	ass.Len(slices, 2)
+
+	ins, err := m.GetInstances(ctx, "base/account")
+	ass.Nil(err)
+	zones := map[string]string{}
+	for _, i := range ins {
+		zones[i.Servs["proc_grpc"].Addr] = i.Zone
+	}
+	ass.Equal(map[string]string{"10.0.0.1:9000": "z1", "10.0.0.2:9000": "z2"}, zones)
+
+	// watch 事件按 slice 名更新
+	ass.True(applyK8sSliceEvent(slices, &k8sWatchEvent{Type: "DELETED", Object: json.RawMessage(`{"metadata": {"name": "account-def"}}`)}))
+	ass.Len(parseK8sEndpointSlices("base/account", slices), 1)
+	ass.True(applyK8sSliceEvent(slices, &k8sWatchEvent{Type: "ADDED", Object: json.RawMessage(`{"metadata": {"name": "account-xyz"}, "endpoints": [{"addresses": ["10.0.0.4"]}], "ports": [{"name": "proc-grpc", "port": 9000}]}`)}))
+	ass.Len(parseK8sEndpointSlices("base/account", slices), 2)
+	ass.False(applyK8sSliceEvent(slices, &k8sWatchEvent{Type: "BOOKMARK"}))
+
+	// 不支持 EndpointSlice 的集群使用 Endpoints
+	old, err := newKubernetesRegistry([]string{srv.URL})
+	ass.Nil(err)
+	ass.False(old.useSlices(ctx, "other/account"))
+	ass.Equal(k8sSliceUnsupported, old.slices)
+}
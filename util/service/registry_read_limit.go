@@ -0,0 +1,87 @@
+package rocserv
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+const (
+	// 配置中心 application namespace 中进程内所有服务发现 client 读取 etcd 的总 qps 及突发上限, 运行时生效,
+	// qps 小于 0 为不限制; 网关等订阅大量服务的进程启动或 etcd 压缩后全量同步时, 避免同时读取打爆 etcd
+	registryReadQPSConfKey   = "registry_read_qps"
+	registryReadBurstConfKey = "registry_read_burst"
+
+	defaultRegistryReadQPS   = 200
+	defaultRegistryReadBurst = 200
+)
+
+// registryReadLimiter 所有 ClientEtcdV2 共用, 超过上限时等待而不是失败
+type registryReadLimiter struct {
+	mu     sync.Mutex
+	qps    int
+	burst  int
+	bucket *tokenBucket
+}
+
+var defaultRegistryReadLimiter = &registryReadLimiter{}
+
+func registryReadConf() (qps, burst int) {
+	qps, burst = defaultRegistryReadQPS, defaultRegistryReadBurst
+	cc := GetConfigCenter()
+	if cc == nil {
+		return
+	}
+	ctx := context.TODO()
+	if n, ok := cc.GetInt(ctx, registryReadQPSConfKey); ok && n != 0 {
+		qps = n
+	}
+	if n, ok := cc.GetInt(ctx, registryReadBurstConfKey); ok && n > 0 {
+		burst = n
+	}
+	return
+}
+
+// reserve 配置变化时重建 token bucket, 返回需要等待的时长
+func (m *registryReadLimiter) reserve(qps, burst int) time.Duration {
+	m.mu.Lock()
+	if qps <= 0 {
+		m.bucket = nil
+		m.mu.Unlock()
+		return 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if m.bucket == nil || m.qps != qps || m.burst != burst {
+		m.qps, m.burst = qps, burst
+		m.bucket = newTokenBucket(float64(qps), float64(burst))
+	}
+	b := m.bucket
+	m.mu.Unlock()
+
+	return b.Reserve()
+}
+
+// waitRegistryRead 服务发现读取 etcd 前调用
+func waitRegistryRead(ctx context.Context, path string) {
+	fun := "waitRegistryRead -->"
+
+	d := defaultRegistryReadLimiter.reserve(registryReadConf())
+	if d <= 0 {
+		return
+	}
+
+	group, service := GetGroupAndService()
+	_metricRegistryReadThrottled.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Inc()
+	logger().Infof(ctx, "%s path: %s throttled: %v", fun, path, d)
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
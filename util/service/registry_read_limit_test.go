@@ -0,0 +1,26 @@
+package rocserv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryReadLimiter(t *testing.T) {
+	ass := assert.New(t)
+
+	m := &registryReadLimiter{}
+	ass.Equal(time.Duration(0), m.reserve(-1, 10))
+	ass.Nil(m.bucket)
+
+	ass.Equal(time.Duration(0), m.reserve(10, 2))
+	ass.Equal(time.Duration(0), m.reserve(10, 2))
+	d := m.reserve(10, 2)
+	ass.True(d > 50*time.Millisecond && d <= 100*time.Millisecond)
+	d = m.reserve(10, 2)
+	ass.True(d > 150*time.Millisecond && d <= 200*time.Millisecond)
+
+	// 配置变化时重建
+	ass.Equal(time.Duration(0), m.reserve(20, 2))
+}
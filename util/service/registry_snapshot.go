@@ -0,0 +1,157 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+const (
+	// 快照目录, 设置为 "-" 时不保存
+	registrySnapshotDirEnv     = "ROC_REGISTRY_SNAPSHOT_DIR"
+	registrySnapshotDefaultDir = "/tmp/roc/registry"
+	// 使用快照期间更新过期时长指标的间隔
+	registrySnapshotStaleInterval = 10 * time.Second
+)
+
+type registrySnapshotInstance struct {
+	Reg    *RegData    `json:"reg"`
+	Manual *ManualData `json:"manual"`
+}
+
+// registrySnapshot 最近一次从注册中心获取的实例列表
+type registrySnapshot struct {
+	ServPath  string                            `json:"serv_path"`
+	SavedAt   int64                             `json:"saved_at"`
+	Instances map[int]*registrySnapshotInstance `json:"instances"`
+}
+
+func registrySnapshotPath(servKey string) string {
+	dir := os.Getenv(registrySnapshotDirEnv)
+	if dir == "-" {
+		return ""
+	}
+	if len(dir) == 0 {
+		dir = registrySnapshotDefaultDir
+	}
+	return filepath.Join(dir, strings.Replace(servKey, "/", "_", -1)+".json")
+}
+
+// saveSnapshot 空列表不保存, 避免覆盖上一次的有效数据
+func (m *ClientEtcdV2) saveSnapshot(scopy servCopyCollect) {
+	fun := "ClientEtcdV2.saveSnapshot -->"
+	if len(m.snapshotPath) == 0 || len(scopy) == 0 {
+		return
+	}
+
+	snap := &registrySnapshot{ServPath: m.servPath, SavedAt: time.Now().Unix(), Instances: make(map[int]*registrySnapshotInstance, len(scopy))}
+	for sid, c := range scopy {
+		if c != nil && c.reg != nil {
+			snap.Instances[sid] = &registrySnapshotInstance{Reg: c.reg, Manual: c.manual}
+		}
+	}
+	bs, _ := json.Marshal(snap)
+	err := os.MkdirAll(filepath.Dir(m.snapshotPath), 0755)
+	if err == nil {
+		tmp := m.snapshotPath + ".tmp"
+		if err = ioutil.WriteFile(tmp, bs, 0644); err == nil {
+			err = os.Rename(tmp, m.snapshotPath)
+		}
+	}
+	if err != nil {
+		logger().Warnf(context.Background(), "%s path: %s err: %v", fun, m.snapshotPath, err)
+	}
+}
+
+// loadSnapshot 首次同步没有拿到注册中心数据时加载快照
+func (m *ClientEtcdV2) loadSnapshot() {
+	fun := "ClientEtcdV2.loadSnapshot -->"
+	ctx := context.Background()
+	if len(m.snapshotPath) == 0 {
+		return
+	}
+
+	m.muUpServlist.Lock()
+	defer m.muUpServlist.Unlock()
+
+	m.muServlist.Lock()
+	synced := m.registryCopy != nil
+	m.muServlist.Unlock()
+	if synced {
+		return
+	}
+
+	bs, err := ioutil.ReadFile(m.snapshotPath)
+	if err != nil {
+		logger().Warnf(ctx, "%s registry unavailable and no snapshot, path: %s err: %v", fun, m.snapshotPath, err)
+		return
+	}
+	var snap registrySnapshot
+	if err := json.Unmarshal(bs, &snap); err != nil {
+		logger().Errorf(ctx, "%s path: %s err: %v", fun, m.snapshotPath, err)
+		return
+	}
+	if snap.ServPath != m.servPath {
+		logger().Warnf(ctx, "%s path: %s serv path: %s mismatch: %s", fun, m.snapshotPath, snap.ServPath, m.servPath)
+		return
+	}
+
+	scopy := make(servCopyCollect, len(snap.Instances))
+	for sid, ins := range snap.Instances {
+		if ins == nil || ins.Reg == nil {
+			continue
+		}
+		if ins.Manual == nil || ins.Manual.Ctrl == nil {
+			ins.Manual = &ManualData{Ctrl: &ServCtrl{Groups: []string{""}}}
+		}
+		scopy[sid] = &servCopyData{servId: sid, reg: ins.Reg, manual: ins.Manual}
+	}
+	savedAt := time.Unix(snap.SavedAt, 0)
+	logger().Warnf(ctx, "%s registry unavailable, use snapshot saved at %v, serv path: %s instances: %d", fun, savedAt, m.servPath, len(scopy))
+
+	m.muServlist.Lock()
+	m.registryCopy = scopy
+	m.staleSince = savedAt
+	m.muServlist.Unlock()
+	m.applyServlist(scopy)
+
+	group, service := GetGroupAndService()
+	go m.reportStale(group, service)
+}
+
+// IsStale whether instances are loaded from local snapshot because registry is unavailable
+func (m *ClientEtcdV2) IsStale() bool {
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+	return !m.staleSince.IsZero()
+}
+
+func (m *ClientEtcdV2) reportStale(group, service string) {
+	for {
+		// 持有锁设置, 避免恢复后又被设置为过期时长
+		m.muServlist.Lock()
+		since := m.staleSince
+		if since.IsZero() {
+			m.muServlist.Unlock()
+			return
+		}
+		_metricRegistrySnapshotStale.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelCalleeService, m.servKey).Set(time.Since(since).Seconds())
+		m.muServlist.Unlock()
+		time.Sleep(registrySnapshotStaleInterval)
+	}
+}
+
+func (m *ClientEtcdV2) recoverFromSnapshot() {
+	fun := "ClientEtcdV2.recoverFromSnapshot -->"
+	logger().Infof(context.Background(), "%s registry recovered, serv path: %s", fun, m.servPath)
+	group, service := GetGroupAndService()
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+	_metricRegistrySnapshotStale.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelCalleeService, m.servKey).Set(0)
+}
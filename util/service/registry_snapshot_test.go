@@ -0,0 +1,53 @@
+package rocserv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistrySnapshot(t *testing.T) {
+	ass := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "roc_snapshot")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+	os.Setenv(registrySnapshotDirEnv, dir)
+	defer os.Unsetenv(registrySnapshotDirEnv)
+	path := registrySnapshotPath("base/account")
+	ass.Equal(filepath.Join(dir, "base_account.json"), path)
+
+	lane := "feature-x"
+	feature := zoneServCopy(2, "a", 50)
+	feature.reg.Lane = &lane
+	cli := &ClientEtcdV2{servKey: "base/account", servPath: "/roc/dist2/base/account", snapshotPath: path}
+	cli.upServlist(servCopyCollect{1: zoneServCopy(1, "a", 100), 2: feature})
+	// 空列表不覆盖快照
+	cli.upServlist(servCopyCollect{})
+	ass.False(cli.IsStale())
+
+	// 注册中心不可用时使用快照
+	stale := &ClientEtcdV2{servKey: "base/account", servPath: "/roc/dist2/base/account", snapshotPath: path}
+	stale.loadSnapshot()
+	ass.True(stale.IsStale())
+	ins := stale.GetInstances("proc_grpc")
+	ass.Len(ins, 2)
+	ass.Equal("feature-x", ins[1].Group)
+	ass.Equal(50, ins[1].Weight)
+	ass.Len(stale.GetAllServAddr("proc_grpc"), 2)
+
+	// watch 恢复后使用注册中心数据
+	stale.upServlist(servCopyCollect{3: zoneServCopy(3, "a", 100)})
+	ass.False(stale.IsStale())
+	ass.Equal("127.0.0.3:9000", stale.GetAllServAddr("proc_grpc")[0].Addr)
+
+	// 已同步过注册中心时不加载, 路径不一致时不加载
+	stale.loadSnapshot()
+	ass.Len(stale.GetAllServAddr("proc_grpc"), 1)
+	other := &ClientEtcdV2{servKey: "base/account", servPath: "/roc/dist/base/account", snapshotPath: path}
+	other.loadSnapshot()
+	ass.False(other.IsStale())
+}
@@ -0,0 +1,200 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// 配置中心 application namespace 中的配置, 开启后每个请求结束时输出一条汇总记录
+	requestStatEnableKey = "request_stat_enable"
+
+	// 下游调用耗时的 timer 名前缀, 完整名为 downstream.{servKey}.{funcName}
+	requestStatDownstreamPrefix = "downstream."
+)
+
+// StatTimer aggregated durations of one kind of operation in a request
+type StatTimer struct {
+	Count int64         `json:"count"`
+	Total time.Duration `json:"total"`
+	Max   time.Duration `json:"max"`
+}
+
+// RequestStat per-request stats aggregated in ctx, e.g. db calls, cache hits and downstream latencies,
+// available in http, gin and grpc handlers, thrift handlers have no ctx
+type RequestStat struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	timers   map[string]*StatTimer
+}
+
+// RequestStatRecord emitted at the end of request
+type RequestStatRecord struct {
+	Type     string                `json:"type"`
+	Method   string                `json:"method"`
+	Caller   string                `json:"caller"`
+	Code     string                `json:"code"`
+	Duration time.Duration         `json:"duration"`
+	Counters map[string]int64      `json:"counters"`
+	Timers   map[string]*StatTimer `json:"timers"`
+}
+
+type requestStatKey struct{}
+
+// RequestStatFromContext return stats of current request, nil if request stat is not enabled
+func RequestStatFromContext(ctx context.Context) *RequestStat {
+	s, _ := ctx.Value(requestStatKey{}).(*RequestStat)
+	return s
+}
+
+// StatIncr add n to counter name of current request, e.g. StatIncr(ctx, "cache_hit", 1)
+func StatIncr(ctx context.Context, name string, n int64) {
+	if s := RequestStatFromContext(ctx); s != nil {
+		s.mu.Lock()
+		s.counters[name] += n
+		s.mu.Unlock()
+	}
+}
+
+// StatTime account one operation of timer name of current request, e.g. defer StatSince(ctx, "mysql", time.Now())
+func StatTime(ctx context.Context, name string, d time.Duration) {
+	if s := RequestStatFromContext(ctx); s != nil {
+		s.mu.Lock()
+		t, ok := s.timers[name]
+		if !ok {
+			t = &StatTimer{}
+			s.timers[name] = t
+		}
+		t.Count++
+		t.Total += d
+		if d > t.Max {
+			t.Max = d
+		}
+		s.mu.Unlock()
+	}
+}
+
+// StatSince same as StatTime with duration since st
+func StatSince(ctx context.Context, name string, st time.Time) {
+	StatTime(ctx, name, time.Since(st))
+}
+
+// addStatDownstream called by clients on each downstream call
+func addStatDownstream(ctx context.Context, servKey, funcName string, d time.Duration) {
+	StatTime(ctx, requestStatDownstreamPrefix+servKey+"."+funcName, d)
+}
+
+var (
+	muRequestStatSink sync.RWMutex
+	requestStatSink   = logRequestStat
+)
+
+// SetRequestStatSink set where request stat records go, default is the app logger
+func SetRequestStatSink(sink func(ctx context.Context, r *RequestStatRecord)) {
+	muRequestStatSink.Lock()
+	defer muRequestStatSink.Unlock()
+	if sink == nil {
+		sink = logRequestStat
+	}
+	requestStatSink = sink
+}
+
+func logRequestStat(ctx context.Context, r *RequestStatRecord) {
+	logger().Infow(ctx, "request_stat", "type", r.Type, "method", r.Method, "caller", r.Caller, "code", r.Code,
+		"cost_ms", float64(r.Duration)/float64(time.Millisecond), "counters", r.Counters, "timers", r.Timers)
+}
+
+func requestStatEnabled() bool {
+	cc := GetConfigCenter()
+	if cc == nil {
+		return false
+	}
+	enable, _ := cc.GetBool(context.TODO(), requestStatEnableKey)
+	return enable
+}
+
+// startRequestStat 未开启时返回 nil, 此时 StatIncr 等为空操作
+func startRequestStat(ctx context.Context) (context.Context, *RequestStat) {
+	if !requestStatEnabled() {
+		return ctx, nil
+	}
+	s := &RequestStat{counters: make(map[string]int64), timers: make(map[string]*StatTimer)}
+	return context.WithValue(ctx, requestStatKey{}, s), s
+}
+
+func (m *RequestStat) finish(ctx context.Context, typ, method, code string, d time.Duration) {
+	r := &RequestStatRecord{
+		Type:     typ,
+		Method:   method,
+		Caller:   costCaller(ctx),
+		Code:     code,
+		Duration: d,
+		Counters: make(map[string]int64),
+		Timers:   make(map[string]*StatTimer),
+	}
+	// handler 中启动的 goroutine 可能在请求结束后继续写入, 输出副本
+	m.mu.Lock()
+	for k, v := range m.counters {
+		r.Counters[k] = v
+	}
+	for k, v := range m.timers {
+		t := *v
+		r.Timers[k] = &t
+	}
+	m.mu.Unlock()
+
+	muRequestStatSink.RLock()
+	sink := requestStatSink
+	muRequestStatSink.RUnlock()
+	sink(ctx, r)
+}
+
+func requestStatHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, s := startRequestStat(r.Context())
+		if s == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		aw := &accessResponseWriter{ResponseWriter: w}
+		st := time.Now()
+		next.ServeHTTP(aw, r.WithContext(ctx))
+		code := aw.status
+		if code == 0 {
+			code = http.StatusOK
+		}
+		s.finish(ctx, PROCESSOR_HTTP, r.Method+" "+r.URL.Path, strconv.Itoa(code), time.Since(st))
+	})
+}
+
+func requestStatServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, s := startRequestStat(ctx)
+		if s == nil {
+			return handler(ctx, req)
+		}
+		st := time.Now()
+		resp, err := handler(ctx, req)
+		s.finish(ctx, PROCESSOR_GRPC, grpcMethodName(info.FullMethod), status.Code(err).String(), time.Since(st))
+		return resp, err
+	}
+}
+
+func requestStatStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, s := startRequestStat(ss.Context())
+		if s == nil {
+			return handler(srv, ss)
+		}
+		st := time.Now()
+		err := handler(srv, &ctxServerStream{ServerStream: ss, ctx: ctx})
+		s.finish(ctx, PROCESSOR_GRPC, grpcMethodName(info.FullMethod), status.Code(err).String(), time.Since(st))
+		return err
+	}
+}
@@ -0,0 +1,43 @@
+package rocserv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestStat(t *testing.T) {
+	ass := assert.New(t)
+
+	// 未开启时为空操作
+	ctx, s := startRequestStat(context.Background())
+	ass.Nil(s)
+	StatIncr(ctx, "cache_hit", 1)
+	ass.Nil(RequestStatFromContext(ctx))
+
+	s = &RequestStat{counters: make(map[string]int64), timers: make(map[string]*StatTimer)}
+	ctx = context.WithValue(context.Background(), requestStatKey{}, s)
+	StatIncr(ctx, "cache_hit", 1)
+	StatIncr(ctx, "cache_hit", 2)
+	StatTime(ctx, "mysql", 10*time.Millisecond)
+	StatTime(ctx, "mysql", 30*time.Millisecond)
+	addStatDownstream(ctx, "base/account", "GetUser", 5*time.Millisecond)
+
+	var got *RequestStatRecord
+	SetRequestStatSink(func(ctx context.Context, r *RequestStatRecord) {
+		got = r
+	})
+	defer SetRequestStatSink(nil)
+	s.finish(ctx, PROCESSOR_GRPC, "GetUser", "OK", 50*time.Millisecond)
+
+	ass.Equal("GetUser", got.Method)
+	ass.Equal(int64(3), got.Counters["cache_hit"])
+	ass.Equal(&StatTimer{Count: 2, Total: 40 * time.Millisecond, Max: 30 * time.Millisecond}, got.Timers["mysql"])
+	ass.Equal(int64(1), got.Timers["downstream.base/account.GetUser"].Count)
+
+	// 输出的是副本
+	StatIncr(ctx, "cache_hit", 1)
+	ass.Equal(int64(3), got.Counters["cache_hit"])
+}
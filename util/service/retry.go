@@ -0,0 +1,169 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xutil"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// RetryBackoff base backoff(ms) of retry, doubled every attempt
+	RetryBackoff = "retryBackoffMsec"
+	// RetryMaxBackoff max backoff(ms) of retry
+	RetryMaxBackoff = "retryMaxBackoffMsec"
+	// RetryOn comma separated grpc codes which are retryable, such as Unavailable,DeadlineExceeded;
+	// not configured means all errors are retryable
+	RetryOn = "retryOn"
+)
+
+// RetryPolicy retry policy of one method of service
+type RetryPolicy struct {
+	// 重试次数, 不含首次请求
+	Retry      int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// 可重试的 grpc 状态码, 为 nil 时与之前一致重试所有错误; 非 grpc 状态错误如连接错误均可重试
+	RetryOn map[codes.Code]bool
+}
+
+// DefaultRetryPolicy used when no config of method, service or global found
+var DefaultRetryPolicy = RetryPolicy{
+	Retry:      0,
+	Backoff:    20 * time.Millisecond,
+	MaxBackoff: 500 * time.Millisecond,
+}
+
+var (
+	muRetryRand sync.Mutex
+	retryRand   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// getFuncConfInt 按 {servKey}.{funcName}, {servKey}.Default, Default.Default 的顺序查找配置
+func getFuncConfInt(servKey, funcName, name string) (int, bool) {
+	confCenter := GetConfigCenter()
+	if confCenter == nil {
+		return 0, false
+	}
+	for _, key := range funcConfKeys(servKey, funcName, name) {
+		if t, ok := confCenter.GetIntWithNamespace(context.TODO(), RPCConfNamespace, key); ok {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func getFuncConfString(servKey, funcName, name string) (string, bool) {
+	confCenter := GetConfigCenter()
+	if confCenter == nil {
+		return "", false
+	}
+	for _, key := range funcConfKeys(servKey, funcName, name) {
+		if s, ok := confCenter.GetStringWithNamespace(context.TODO(), RPCConfNamespace, key); ok {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+func funcConfKeys(servKey, funcName, name string) []string {
+	return []string{
+		xutil.Concat(servKey, ".", funcName, ".", name),
+		xutil.Concat(servKey, ".", Default, ".", name),
+		xutil.Concat(Default, ".", Default, ".", name),
+	}
+}
+
+// parseRetryCodes 解析逗号分隔的 grpc 状态码名字, 忽略大小写
+func parseRetryCodes(s string) map[codes.Code]bool {
+	names := make(map[string]codes.Code)
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		names[strings.ToLower(c.String())] = c
+	}
+
+	res := make(map[codes.Code]bool)
+	for _, name := range strings.Split(s, ",") {
+		if c, ok := names[strings.ToLower(strings.TrimSpace(name))]; ok {
+			res[c] = true
+		}
+	}
+	return res
+}
+
+// GetRetryPolicy get retry policy of method from config center, fields not configured use DefaultRetryPolicy
+func GetRetryPolicy(servKey, funcName string) *RetryPolicy {
+	p := DefaultRetryPolicy
+	if t, ok := getFuncConfInt(servKey, funcName, Retry); ok {
+		p.Retry = t
+	}
+	if t, ok := getFuncConfInt(servKey, funcName, RetryBackoff); ok {
+		p.Backoff = time.Duration(t) * time.Millisecond
+	}
+	if t, ok := getFuncConfInt(servKey, funcName, RetryMaxBackoff); ok {
+		p.MaxBackoff = time.Duration(t) * time.Millisecond
+	}
+	if s, ok := getFuncConfString(servKey, funcName, RetryOn); ok {
+		p.RetryOn = parseRetryCodes(s)
+	}
+	return &p
+}
+
+// Retryable whether err can be retried
+func (m *RetryPolicy) Retryable(err error) bool {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded || errors.Is(err, ErrNoInstances) {
+		return false
+	}
+	if m.RetryOn == nil {
+		return true
+	}
+	if s, ok := status.FromError(err); ok {
+		return m.RetryOn[s.Code()]
+	}
+	return true
+}
+
+// backoff 指数退避加抖动, 在 [d/2, d) 之间随机
+func (m *RetryPolicy) backoff(attempt int) time.Duration {
+	if m.Backoff <= 0 {
+		return 0
+	}
+	d := m.Backoff
+	for i := 0; i < attempt && (m.MaxBackoff <= 0 || d < m.MaxBackoff); i++ {
+		d *= 2
+	}
+	if m.MaxBackoff > 0 && d > m.MaxBackoff {
+		d = m.MaxBackoff
+	}
+
+	half := int64(d / 2)
+	muRetryRand.Lock()
+	jitter := retryRand.Int63n(half + 1)
+	muRetryRand.Unlock()
+	return time.Duration(half + jitter)
+}
+
+// Do call fn until success, error not retryable, retry exhausted or ctx done
+func (m *RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= m.Retry || !m.Retryable(err) {
+			return err
+		}
+
+		t := time.NewTimer(m.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
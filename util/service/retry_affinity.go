@@ -0,0 +1,116 @@
+package rocserv
+
+import (
+	"context"
+	"sort"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// RetryAffinity 1 makes retries of requests with idempotency key go to the instance of the first attempt once,
+	// so it can hit its dedup cache, before moving to other instances
+	RetryAffinity = "retryAffinity"
+
+	// IdempotencyKeyHeader http header of idempotency key, http clients of app set it by themselves
+	IdempotencyKeyHeader = "Idempotency-Key"
+	idempotencyMetaKey   = "idempotency-key"
+)
+
+type idempotencyKeyCtx struct{}
+
+type retryAffinityCtx struct{}
+
+// retryAffinity 一次调用所有尝试共享, 尝试是串行的
+type retryAffinity struct {
+	first   *ServInfo
+	attempt int
+}
+
+// WithIdempotencyKey mark the request as idempotent write identified by key, the key is sent to callee
+// in grpc metadata, only the next hop sees it
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtx{}, key)
+}
+
+// IdempotencyKeyFromContext return idempotency key set by WithIdempotencyKey or sent by grpc caller
+func IdempotencyKeyFromContext(ctx context.Context) string {
+	if key, ok := ctx.Value(idempotencyKeyCtx{}).(string); ok {
+		return key
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if vs := md.Get(idempotencyMetaKey); len(vs) > 0 {
+			return vs[0]
+		}
+	}
+	return ""
+}
+
+// withRetryAffinity 带幂等 key 且开启配置时, 本次调用的重试优先路由到首次请求的实例
+func withRetryAffinity(ctx context.Context, servKey, funcName string) context.Context {
+	if key, ok := ctx.Value(idempotencyKeyCtx{}).(string); !ok || len(key) == 0 {
+		return ctx
+	}
+	if on, ok := getFuncConfInt(servKey, funcName, RetryAffinity); !ok || on != 1 {
+		return ctx
+	}
+	return context.WithValue(ctx, retryAffinityCtx{}, &retryAffinity{})
+}
+
+// affinityRoute 首次请求正常路由, 第一次重试回到首次请求的实例, 之后轮流选择其他实例
+func affinityRoute(ctx context.Context, router Router, cb ClientLookup, processor, key string) *ServInfo {
+	a, ok := ctx.Value(retryAffinityCtx{}).(*retryAffinity)
+	if !ok {
+		return router.Route(ctx, processor, key)
+	}
+
+	a.attempt++
+	if a.first == nil {
+		a.first = router.Route(ctx, processor, key)
+		return a.first
+	}
+
+	group := LaneFromContext(ctx)
+	list := cb.GetAllServAddrWithGroup(group, processor)
+	if len(list) == 0 && group != "" {
+		list = cb.GetAllServAddrWithGroup("", processor)
+	}
+	avail, _ := cb.(instanceAvailabler)
+	var first *ServInfo
+	others := make([]*ServInfo, 0, len(list))
+	for _, s := range list {
+		if avail != nil && !avail.AvailableInstance(s) {
+			continue
+		}
+		if s.Addr == a.first.Addr {
+			first = s
+		} else {
+			others = append(others, s)
+		}
+	}
+
+	if a.attempt == 2 && first != nil {
+		return first
+	}
+	if len(others) > 0 {
+		// 实例列表无序, 排序后轮流选择
+		sort.Slice(others, func(i, j int) bool {
+			return others[i].Addr < others[j].Addr
+		})
+		return others[(a.attempt-2)%len(others)]
+	}
+	if first != nil {
+		return first
+	}
+	return router.Route(ctx, processor, key)
+}
+
+func idempotencyClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if key, ok := ctx.Value(idempotencyKeyCtx{}).(string); ok && len(key) > 0 {
+			ctx = metadata.AppendToOutgoingContext(ctx, idempotencyMetaKey, key)
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
@@ -0,0 +1,43 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRetryAffinity(t *testing.T) {
+	ass := assert.New(t)
+
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.SetInstanceBreaker(&InstanceBreakerConf{ConsecutiveFailures: 1, Cooldown: time.Hour})
+	cli.upServlist(servCopyCollect{1: zoneServCopy(1, "", 100), 2: zoneServCopy(2, "", 100), 3: zoneServCopy(3, "", 100)})
+	router := NewHash(cli)
+
+	ctx := WithIdempotencyKey(context.Background(), "order-1")
+	ass.Equal("order-1", IdempotencyKeyFromContext(ctx))
+	ass.Equal("order-1", IdempotencyKeyFromContext(metadata.NewIncomingContext(context.Background(), metadata.Pairs(idempotencyMetaKey, "order-1"))))
+
+	// 未开启时不影响路由
+	plain := affinityRoute(ctx, router, cli, "proc_grpc", "k")
+	ass.Equal(plain, affinityRoute(ctx, router, cli, "proc_grpc", "k"))
+
+	ctx = context.WithValue(ctx, retryAffinityCtx{}, &retryAffinity{})
+	first := affinityRoute(ctx, router, cli, "proc_grpc", "k")
+	ass.Equal(first, affinityRoute(ctx, router, cli, "proc_grpc", "k"))
+	second := affinityRoute(ctx, router, cli, "proc_grpc", "k")
+	third := affinityRoute(ctx, router, cli, "proc_grpc", "k")
+	ass.NotEqual(first.Addr, second.Addr)
+	ass.NotEqual(first.Addr, third.Addr)
+	ass.NotEqual(second.Addr, third.Addr)
+
+	// 首次请求的实例熔断后直接选择其他实例
+	ctx = context.WithValue(ctx, retryAffinityCtx{}, &retryAffinity{})
+	first = affinityRoute(ctx, router, cli, "proc_grpc", "k")
+	cli.ReportInstance(first, errors.New("connection refused"))
+	ass.NotEqual(first.Addr, affinityRoute(ctx, router, cli, "proc_grpc", "k").Addr)
+}
@@ -0,0 +1,63 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	ass := assert.New(t)
+
+	p := DefaultRetryPolicy
+	p.Retry = 2
+	p.Backoff = time.Millisecond
+
+	calls := 0
+	err := p.Do(context.Background(), func() error {
+		calls++
+		return status.Error(codes.Unavailable, "")
+	})
+	ass.Error(err)
+	ass.Equal(3, calls)
+
+	// 默认重试所有错误
+	ass.True(p.Retryable(status.Error(codes.InvalidArgument, "")))
+	ass.True(p.Retryable(errors.New("broken pipe")))
+	ass.False(p.Retryable(context.Canceled))
+	ass.False(p.Retryable(ErrNoInstances))
+
+	// 配置 retryOn 后只重试其中的状态码
+	p.RetryOn = parseRetryCodes("Unavailable")
+	calls = 0
+	err = p.Do(context.Background(), func() error {
+		calls++
+		return status.Error(codes.InvalidArgument, "")
+	})
+	ass.Error(err)
+	ass.Equal(1, calls)
+	ass.True(p.Retryable(status.Error(codes.Unavailable, "")))
+	ass.True(p.Retryable(errors.New("broken pipe")))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	ass := assert.New(t)
+
+	p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}
+	for i := 0; i < 10; i++ {
+		d := p.backoff(i)
+		ass.True(d >= 5*time.Millisecond && d <= 30*time.Millisecond, d)
+	}
+}
+
+func TestParseRetryCodes(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.Equal(map[codes.Code]bool{codes.Unavailable: true, codes.DeadlineExceeded: true},
+		parseRetryCodes("unavailable, DeadlineExceeded,unknown_code"))
+}
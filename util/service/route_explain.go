@@ -0,0 +1,179 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RouteCandidate instance registered with the processor and why it is filtered out
+type RouteCandidate struct {
+	Servid int    `json:"servid"`
+	Addr   string `json:"addr"`
+	Weight int    `json:"weight"`
+	Lane   string `json:"lane"`
+	Zone   string `json:"zone"`
+	// 为空时参与路由
+	Filtered string `json:"filtered,omitempty"`
+}
+
+// RouteExplain how a request with key is routed by ClientEtcdV2, steps are filters applied in order
+type RouteExplain struct {
+	Service   string `json:"service"`
+	Processor string `json:"processor"`
+	Key       string `json:"key"`
+	// 请求的泳道及灰度分流后实际路由的泳道
+	Lane       string            `json:"lane"`
+	Group      string            `json:"group"`
+	Strategy   string            `json:"strategy"`
+	Override   bool              `json:"override"`
+	Steps      []string          `json:"steps"`
+	Candidates []*RouteCandidate `json:"candidates"`
+	Chosen     *ServInfo         `json:"chosen"`
+}
+
+// ExplainRoute explain the routing decision of processor and key with lane of ctx, chosen instance is picked
+// the same way as GetServAddrWithGroup, so it may take the half-open probe of per-instance circuit breaker
+func (m *ClientEtcdV2) ExplainRoute(ctx context.Context, processor, key string) *RouteExplain {
+	lane := LaneFromContext(ctx)
+	group := routeGroup(ctx, m, key)
+	res := &RouteExplain{Service: m.servKey, Processor: processor, Key: key, Lane: lane, Group: group}
+	if group != lane {
+		res.Steps = append(res.Steps, fmt.Sprintf("canary rule routes request to group %q", group))
+	}
+
+	m.muServlist.Lock()
+	res.Override = m.overridden
+	if m.overridden {
+		res.Steps = append(res.Steps, "route override file is used instead of registry")
+	}
+	res.Strategy = "consistent hash"
+	if m.balancer != nil {
+		res.Strategy = fmt.Sprintf("balancer %T", m.balancer)
+	}
+	// 与路由相同, 泳道没有实例时使用基准泳道
+	routed := group
+	if len(m.endpoints(group, processor)) == 0 && group != "" {
+		routed = ""
+		res.Steps = append(res.Steps, fmt.Sprintf("lane %q has no instance, fall back to base lane", group))
+	}
+	var breakers map[string]int
+	if m.breaker != nil {
+		breakers = m.breaker.states()
+	}
+	zone := m.zone
+
+	var remain []*RouteCandidate
+	for sid, c := range m.servCopy {
+		if c == nil || c.reg == nil || c.reg.Servs[processor] == nil {
+			continue
+		}
+		rc := &RouteCandidate{Servid: sid, Addr: c.reg.Servs[processor].Addr, Weight: 100, Zone: c.reg.Zone}
+		rc.Lane, _ = c.reg.GetLane()
+		res.Candidates = append(res.Candidates, rc)
+
+		switch {
+		case c.manual == nil || c.manual.Ctrl == nil:
+			rc.Filtered = "no manual data"
+		case c.manual.Ctrl.Disable:
+			rc.Filtered = "disabled"
+		case !c.reg.IsActive():
+			rc.Filtered = "starting"
+		case !c.containsLane(routed):
+			rc.Filtered = "lane"
+		default:
+			remain = append(remain, rc)
+		}
+		if c.manual != nil && c.manual.Ctrl != nil && c.manual.Ctrl.Weight > 0 {
+			rc.Weight = c.manual.Ctrl.Weight
+		}
+	}
+	m.muServlist.Unlock()
+
+	sort.Slice(res.Candidates, func(i, j int) bool {
+		return res.Candidates[i].Servid < res.Candidates[j].Servid
+	})
+	res.Steps = append(res.Steps, fmt.Sprintf("%d of %d instances are routable in lane %q", len(remain), len(res.Candidates), routed))
+
+	// 全部熔断时不过滤
+	var healthy []*RouteCandidate
+	for _, rc := range remain {
+		if breakers[rc.Addr] != breakerOpen {
+			healthy = append(healthy, rc)
+		}
+	}
+	if len(healthy) == 0 && len(remain) > 0 {
+		res.Steps = append(res.Steps, "all instances are broken, circuit breaker filter is skipped")
+	} else {
+		for _, rc := range remain {
+			if breakers[rc.Addr] == breakerOpen {
+				rc.Filtered = "circuit breaker open"
+			}
+		}
+		remain = healthy
+	}
+
+	if zone != nil {
+		var local []*RouteCandidate
+		var localWeight, totalWeight int
+		for _, rc := range remain {
+			totalWeight += rc.Weight
+			if rc.Zone == zone.Zone {
+				local = append(local, rc)
+				localWeight += rc.Weight
+			}
+		}
+		if len(local) == 0 || localWeight*100 < totalWeight*zone.MinLocalPercent {
+			res.Steps = append(res.Steps, fmt.Sprintf("zone %s has %d of %d weight, below %d%%, spill over to all zones", zone.Zone, localWeight, totalWeight, zone.MinLocalPercent))
+		} else {
+			for _, rc := range remain {
+				if rc.Zone != zone.Zone {
+					rc.Filtered = "zone"
+				}
+			}
+			res.Steps = append(res.Steps, fmt.Sprintf("prefer %d instances in zone %s", len(local), zone.Zone))
+		}
+	}
+
+	res.Chosen = m.GetServAddrWithGroup(group, processor, key)
+	if res.Chosen == nil {
+		res.Steps = append(res.Steps, "no instance chosen")
+	}
+	return res
+}
+
+// ExplainRoute explain routing decision of client of servKey created in this process
+func ExplainRoute(ctx context.Context, servKey, processor, key string) (*RouteExplain, error) {
+	var cli *ClientEtcdV2
+	clientLookups.Range(func(k, _ interface{}) bool {
+		if c := k.(*ClientEtcdV2); c.servKey == servKey {
+			cli = c
+			return false
+		}
+		return true
+	})
+	if cli == nil {
+		return nil, fmt.Errorf("no client of service: %s", servKey)
+	}
+	return cli.ExplainRoute(ctx, processor, key), nil
+}
+
+// routeExplainHandler GET service=&processor=&key=&lane=
+func routeExplainHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+	if lane := r.FormValue("lane"); len(lane) > 0 {
+		ctx = WithLane(ctx, lane)
+	}
+	res, err := ExplainRoute(ctx, r.FormValue("service"), r.FormValue("processor"), r.FormValue("key"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	s, _ := json.Marshal(res)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s)
+}
@@ -0,0 +1,47 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplainRoute(t *testing.T) {
+	ass := assert.New(t)
+
+	disabled := zoneServCopy(3, "b", 100)
+	disabled.manual.Ctrl.Disable = true
+	cli := &ClientEtcdV2{servKey: "base/explain"}
+	cli.SetInstanceBreaker(&InstanceBreakerConf{ConsecutiveFailures: 1, Cooldown: time.Hour})
+	cli.upServlist(servCopyCollect{1: zoneServCopy(1, "a", 100), 2: zoneServCopy(2, "a", 100), 3: disabled})
+	cli.ReportInstance(&ServInfo{Addr: "127.0.0.2:9000"}, errors.New("connection refused"))
+
+	res := cli.ExplainRoute(WithLane(context.Background(), "feature-x"), "proc_grpc", "k")
+	ass.Equal("feature-x", res.Lane)
+	ass.Equal("consistent hash", res.Strategy)
+	ass.Len(res.Candidates, 3)
+	ass.Equal("", res.Candidates[0].Filtered)
+	ass.Equal("circuit breaker open", res.Candidates[1].Filtered)
+	ass.Equal("disabled", res.Candidates[2].Filtered)
+	ass.Contains(res.Steps[0], "fall back to base lane")
+	ass.Equal("127.0.0.1:9000", res.Chosen.Addr)
+
+	registerClientLookup(cli)
+	defer clientLookups.Delete(cli)
+	w := httptest.NewRecorder()
+	routeExplainHandler(w, httptest.NewRequest(http.MethodGet, "/backdoor/route/explain?service=base/explain&processor=proc_grpc&key=k", nil), nil)
+	ass.Equal(http.StatusOK, w.Code)
+	var got RouteExplain
+	ass.Nil(json.Unmarshal(w.Body.Bytes(), &got))
+	ass.Equal("127.0.0.1:9000", got.Chosen.Addr)
+
+	w = httptest.NewRecorder()
+	routeExplainHandler(w, httptest.NewRequest(http.MethodGet, "/backdoor/route/explain?service=base/none", nil), nil)
+	ass.Equal(http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,163 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// 覆盖文件路径, 未设置时使用 routeOverrideDefaultFile, 文件不存在时不覆盖
+	routeOverrideFileEnv     = "ROC_ROUTE_OVERRIDE_FILE"
+	routeOverrideDefaultFile = "/etc/roc/route_override.json"
+	routeOverrideInterval    = 5 * time.Second
+)
+
+// RouteOverride static addresses of a processor in route override file, e.g.
+//
+//	{"base/account": {"proc_grpc": {"type": "grpc", "addrs": ["10.0.0.1:9000", "10.0.0.2:9000"]}}}
+//
+// services in the file are routed to these addresses instead of instances from the registry,
+// it is a break-glass mechanism when the registry has bad data, remove the service from the file to restore
+type RouteOverride struct {
+	Type  string   `json:"type"`
+	Addrs []string `json:"addrs"`
+	TLS   bool     `json:"tls"`
+}
+
+type routeOverrideState struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	size    int64
+	// servKey -> 生成的实例列表
+	servs map[string]servCopyCollect
+}
+
+var (
+	routeOverrides         = &routeOverrideState{}
+	onceRouteOverrideWatch sync.Once
+)
+
+func getRouteOverride(servKey string) servCopyCollect {
+	routeOverrides.mu.RLock()
+	defer routeOverrides.mu.RUnlock()
+	return routeOverrides.servs[servKey]
+}
+
+// parseRouteOverride 同一 processor 的第 i 个地址属于 servid 为 i+1 的实例
+func parseRouteOverride(data []byte) (map[string]servCopyCollect, error) {
+	var conf map[string]map[string]*RouteOverride
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]servCopyCollect, len(conf))
+	for servKey, procs := range conf {
+		scopy := make(servCopyCollect)
+		for proc, o := range procs {
+			if o == nil || len(o.Addrs) == 0 {
+				return nil, fmt.Errorf("servkey: %s processor: %s has no addrs", servKey, proc)
+			}
+			for i, addr := range o.Addrs {
+				sid := i + 1
+				c, ok := scopy[sid]
+				if !ok {
+					c = &servCopyData{
+						servId: sid,
+						reg:    &RegData{Servs: make(map[string]*ServInfo)},
+						manual: &ManualData{Ctrl: &ServCtrl{Weight: 100, Groups: []string{""}}},
+					}
+					scopy[sid] = c
+				}
+				c.reg.Servs[proc] = &ServInfo{Type: o.Type, Addr: addr, Servid: sid, TLS: o.TLS}
+			}
+		}
+		if len(scopy) == 0 {
+			return nil, fmt.Errorf("servkey: %s has no processors", servKey)
+		}
+		res[servKey] = scopy
+	}
+	return res, nil
+}
+
+// reload 文件未变化时返回 false, 文件内容错误时保留之前的覆盖
+func (m *routeOverrideState) reload() bool {
+	fun := "routeOverrideState.reload -->"
+	ctx := context.Background()
+
+	fi, err := os.Stat(m.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger().Warnf(ctx, "%s path: %s err: %v", fun, m.path, err)
+			return false
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.servs == nil {
+			return false
+		}
+		logger().Warnf(ctx, "%s path: %s removed, route override cleared", fun, m.path)
+		m.servs, m.modTime, m.size = nil, time.Time{}, 0
+		return true
+	}
+
+	m.mu.RLock()
+	unchanged := fi.ModTime().Equal(m.modTime) && fi.Size() == m.size
+	m.mu.RUnlock()
+	if unchanged {
+		return false
+	}
+
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		logger().Warnf(ctx, "%s path: %s err: %v", fun, m.path, err)
+		return false
+	}
+	servs, err := parseRouteOverride(data)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.modTime, m.size = fi.ModTime(), fi.Size()
+	if err != nil {
+		logger().Errorf(ctx, "%s path: %s invalid, keep previous override, err: %v", fun, m.path, err)
+		return false
+	}
+	keys := make([]string, 0, len(servs))
+	for k := range servs {
+		keys = append(keys, k)
+	}
+	logger().Warnf(ctx, "%s path: %s route override services: %v", fun, m.path, keys)
+	m.servs = servs
+	return true
+}
+
+// watchRouteOverride 创建第一个客户端时启动, 覆盖文件变更后所有客户端重新生成路由
+func watchRouteOverride() {
+	onceRouteOverrideWatch.Do(func() {
+		routeOverrides.path = os.Getenv(routeOverrideFileEnv)
+		if len(routeOverrides.path) == 0 {
+			routeOverrides.path = routeOverrideDefaultFile
+		}
+		routeOverrides.reload()
+
+		go func() {
+			for range time.Tick(routeOverrideInterval) {
+				if routeOverrides.reload() {
+					reapplyRouteOverrides()
+				}
+			}
+		}()
+	})
+}
+
+func reapplyRouteOverrides() {
+	clientLookups.Range(func(key, _ interface{}) bool {
+		key.(*ClientEtcdV2).reapplyRouteOverride()
+		return true
+	})
+}
@@ -0,0 +1,53 @@
+package rocserv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteOverride(t *testing.T) {
+	ass := assert.New(t)
+
+	_, err := parseRouteOverride([]byte(`{"base/account": {"proc_grpc": {"type": "grpc"}}}`))
+	ass.NotNil(err)
+	_, err = parseRouteOverride([]byte(`{"base/account": {}}`))
+	ass.NotNil(err)
+
+	servs, err := parseRouteOverride([]byte(`{"base/account": {
+		"proc_grpc": {"type": "grpc", "addrs": ["10.0.0.1:9000", "10.0.0.2:9000"]},
+		"proc_thrift": {"type": "thrift", "addrs": ["10.0.0.1:9001"]}}}`))
+	ass.Nil(err)
+	ass.Len(servs["base/account"], 2)
+	ass.Len(servs["base/account"][1].reg.Servs, 2)
+	ass.Len(servs["base/account"][2].reg.Servs, 1)
+
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.upServlist(servCopyCollect{1: zoneServCopy(1, "a", 100)})
+	ass.Equal("127.0.0.1:9000", cli.GetAllServAddr("proc_grpc")[0].Addr)
+
+	// 覆盖优先于注册中心, 注册中心的更新不影响覆盖
+	routeOverrides.mu.Lock()
+	routeOverrides.servs = servs
+	routeOverrides.mu.Unlock()
+	defer func() {
+		routeOverrides.mu.Lock()
+		routeOverrides.servs = nil
+		routeOverrides.mu.Unlock()
+	}()
+	cli.reapplyRouteOverride()
+	ass.Len(cli.GetAllServAddr("proc_grpc"), 2)
+	ass.Equal("10.0.0.1:9001", cli.GetServAddrWithServid(1, "proc_thrift", "").Addr)
+	cli.upServlist(servCopyCollect{1: zoneServCopy(1, "a", 100), 3: zoneServCopy(3, "a", 100)})
+	ass.Len(cli.GetAllServAddr("proc_grpc"), 2)
+	ass.True(cli.routingTable().Override)
+
+	// 删除覆盖后恢复最近一次注册中心的数据
+	routeOverrides.mu.Lock()
+	routeOverrides.servs = nil
+	routeOverrides.mu.Unlock()
+	cli.reapplyRouteOverride()
+	ass.Len(cli.GetAllServAddr("proc_grpc"), 2)
+	ass.Equal("127.0.0.3:9000", cli.GetServAddrWithServid(3, "proc_grpc", "").Addr)
+	ass.False(cli.routingTable().Override)
+}
@@ -9,10 +9,9 @@ import (
 	"sync"
 
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xcontext"
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 )
 
-// Router router include consistent hash、load of concurrent、concrete addr
+// Router router include consistent hash、load of concurrent、concrete addr、reported load of instance
 type Router interface {
 	Route(ctx context.Context, processor, key string) *ServInfo
 	Pre(s *ServInfo) error
@@ -29,8 +28,10 @@ func NewRouter(routerType int, cb ClientLookup) Router {
 		return NewConcurrent(cb)
 	case 2:
 		return NewAddr(cb)
+	case 3:
+		return NewLoadAware(cb)
 	default:
-		xlog.Errorf(context.Background(), "%s err routerType: %d", fun, routerType)
+		logger().Errorf(context.Background(), "%s err routerType: %d", fun, routerType)
 		return NewHash(cb)
 	}
 }
@@ -45,18 +46,25 @@ func NewHash(cb ClientLookup) *Hash {
 	}
 }
 
+// Pre 通知 lookup 的负载均衡策略, 如最少连接数
 func (m *Hash) Pre(s *ServInfo) error {
+	if t, ok := m.cb.(ConnTracker); ok && s != nil {
+		t.Acquire(s)
+	}
 	return nil
 }
 
 func (m *Hash) Post(s *ServInfo) error {
+	if t, ok := m.cb.(ConnTracker); ok && s != nil {
+		t.Release(s)
+	}
 	return nil
 }
 
 func (m *Hash) Route(ctx context.Context, processor, key string) *ServInfo {
 	//fun := "Hash.Route -->"
 
-	group := xcontext.GetControlRouteGroupWithDefault(ctx, xcontext.DefaultGroup)
+	group := routeGroup(ctx, m.cb, key)
 	s := m.cb.GetServAddrWithGroup(group, processor, key)
 
 	return s
@@ -94,15 +102,15 @@ func (m *Concurrent) Post(s *ServInfo) error {
 func (m *Concurrent) Route(ctx context.Context, processor, key string) *ServInfo {
 	fun := "Concurrent.Route -->"
 
-	group := xcontext.GetControlRouteGroupWithDefault(ctx, xcontext.DefaultGroup)
+	group := routeGroup(ctx, m.cb, key)
 	s := m.route(group, processor, key)
 	if s != nil {
-		xlog.Debugf(ctx, "%s group: %s, processor: %s, key: %s, router: %v", fun, group, processor, key, s)
+		logger().Debugf(ctx, "%s group: %s, processor: %s, key: %s, router: %v", fun, group, processor, key, s)
 		return s
 	}
 
 	s = m.route("", processor, key)
-	xlog.Warnf(ctx, "%s route to group error and back to default, group: %s, processor: %s, key: %s, router: %v", fun, group, processor, key, s)
+	logger().Warnf(ctx, "%s route to group error and back to default, group: %s, processor: %s, key: %s, router: %v", fun, group, processor, key, s)
 	return s
 }
 
@@ -111,7 +119,7 @@ func (m *Concurrent) route(group, processor, key string) *ServInfo {
 
 	list := m.cb.GetAllServAddrWithGroup(group, processor)
 	if list == nil {
-		xlog.Infof(context.Background(), "%s processor: %s, key: %s, group: %s, servKey: %s, servPath: %s, server info list is nil",
+		logger().Infof(context.Background(), "%s processor: %s, key: %s, group: %s, servKey: %s, servPath: %s, server info list is nil",
 			fun, processor, key, group, m.cb.ServKey(), m.cb.ServPath())
 		return nil
 	}
@@ -119,6 +127,22 @@ func (m *Concurrent) route(group, processor, key string) *ServInfo {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	// 跳过已熔断的实例, 全部熔断时不过滤
+	if a, ok := m.cb.(instanceAvailabler); ok {
+		healthy := make([]*ServInfo, 0, len(list))
+		for _, serv := range list {
+			if a.AvailableInstance(serv) {
+				healthy = append(healthy, serv)
+			}
+		}
+		if len(healthy) > 0 {
+			list = healthy
+		}
+	}
+	if z, ok := m.cb.(zonePreferer); ok {
+		list = z.preferZone(group, processor, list)
+	}
+
 	min := int64(0)
 	var s *ServInfo
 	for _, serv := range list {
@@ -136,8 +160,9 @@ func (m *Concurrent) route(group, processor, key string) *ServInfo {
 		}
 	}
 	if s != nil {
+		acquireInstance(m.cb, s)
 	} else {
-		xlog.Errorf(context.Background(), "%s processor: %s, key: %s, group: %s, servKey: %s, servPath: %s, route fail",
+		logger().Errorf(context.Background(), "%s processor: %s, key: %s, group: %s, servKey: %s, servPath: %s, route fail",
 			fun, processor, key, group, m.cb.ServKey(), m.cb.ServPath())
 	}
 
@@ -164,11 +189,15 @@ func (m *Addr) Post(s *ServInfo) error {
 func (m *Addr) Route(ctx context.Context, processor, addr string) (si *ServInfo) {
 	fun := "Addr.Route -->"
 
-	group := xcontext.GetControlRouteGroupWithDefault(ctx, xcontext.DefaultGroup)
+	group := LaneFromContext(ctx)
 	servList := m.cb.GetAllServAddrWithGroup(group, processor)
+	// 泳道没有实例时使用基准泳道
+	if len(servList) == 0 && group != xcontext.DefaultGroup {
+		servList = m.cb.GetAllServAddrWithGroup(xcontext.DefaultGroup, processor)
+	}
 
 	if servList == nil {
-		xlog.Infof(context.Background(), "%s processor: %s, group: %s, servKey: %s, servPath: %s, server info list is nil",
+		logger().Infof(context.Background(), "%s processor: %s, group: %s, servKey: %s, servPath: %s, server info list is nil",
 			fun, processor, group, m.cb.ServKey(), m.cb.ServPath())
 		return
 	}
@@ -181,9 +210,9 @@ func (m *Addr) Route(ctx context.Context, processor, addr string) (si *ServInfo)
 	}
 
 	if si != nil {
-		xlog.Infof(ctx, "%s processor:%s, addr:%s", fun, processor, addr)
+		logger().Infof(ctx, "%s processor:%s, addr:%s", fun, processor, addr)
 	} else {
-		xlog.Errorf(ctx, "%s processor: %s, addr: %s, group: %s, servKey: %s, servPath: %s, route failed",
+		logger().Errorf(ctx, "%s processor: %s, addr: %s, group: %s, servKey: %s, servPath: %s, route failed",
 			fun, processor, addr, group, m.cb.ServKey(), m.cb.ServPath())
 	}
 
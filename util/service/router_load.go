@@ -0,0 +1,180 @@
+package rocserv
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// 上报负载的平滑系数, 越小越平滑
+	loadAwareEWMAAlpha = 0.3
+	// 负载系数的上下限, 避免热点实例流量被完全摘除后负载骤降, 流量又全部打回来造成振荡
+	loadAwareMinFactor = 0.5
+	loadAwareMaxFactor = 2.0
+	// 超过该时间未更新的上报数据视为无效
+	loadAwareStaleTime = 5 * time.Minute
+)
+
+// loadLookup implemented by ClientEtcdV2, key of result is addr
+type loadLookup interface {
+	GetAllServLoadWithGroup(group, processor string) map[string]*InstanceLoad
+}
+
+type smoothedLoad struct {
+	ctime    int64
+	cpu      float64
+	inFlight float64
+}
+
+// LoadAware route by reported load of instances and in-flight requests of current client,
+// two random candidates are compared and the lighter one is selected (power of two choices),
+// falls back to Concurrent when instances do not report load
+type LoadAware struct {
+	cb ClientLookup
+
+	mutex   sync.Mutex
+	counter map[string]int64
+	loads   map[string]*smoothedLoad
+	rand    *rand.Rand
+}
+
+func NewLoadAware(cb ClientLookup) *LoadAware {
+	return &LoadAware{
+		cb:      cb,
+		counter: make(map[string]int64),
+		loads:   make(map[string]*smoothedLoad),
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (m *LoadAware) Pre(s *ServInfo) error {
+	m.mutex.Lock()
+	m.counter[s.Addr] += 1
+	m.mutex.Unlock()
+
+	return nil
+}
+
+func (m *LoadAware) Post(s *ServInfo) error {
+	m.mutex.Lock()
+	m.counter[s.Addr] -= 1
+	m.mutex.Unlock()
+
+	return nil
+}
+
+func (m *LoadAware) Route(ctx context.Context, processor, key string) *ServInfo {
+	fun := "LoadAware.Route -->"
+
+	group := routeGroup(ctx, m.cb, key)
+	s := m.route(group, processor)
+	if s != nil {
+		logger().Debugf(ctx, "%s group: %s, processor: %s, key: %s, router: %v", fun, group, processor, key, s)
+		return s
+	}
+
+	s = m.route("", processor)
+	logger().Warnf(ctx, "%s route to group error and back to default, group: %s, processor: %s, key: %s, router: %v", fun, group, processor, key, s)
+	return s
+}
+
+func (m *LoadAware) route(group, processor string) *ServInfo {
+	list := m.cb.GetAllServAddrWithGroup(group, processor)
+	if len(list) == 0 {
+		return nil
+	}
+
+	var reported map[string]*InstanceLoad
+	if ll, ok := m.cb.(loadLookup); ok {
+		reported = ll.GetAllServLoadWithGroup(group, processor)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.updateLoads(reported)
+	if len(list) == 1 {
+		return list[0]
+	}
+
+	a := list[m.rand.Intn(len(list))]
+	b := list[m.rand.Intn(len(list))]
+	for i := 0; i < 3 && a == b; i++ {
+		b = list[m.rand.Intn(len(list))]
+	}
+
+	factors := m.factors(list)
+	if m.score(b, factors) < m.score(a, factors) {
+		return b
+	}
+	return a
+}
+
+func (m *LoadAware) updateLoads(reported map[string]*InstanceLoad) {
+	now := time.Now().Unix()
+	for addr, r := range reported {
+		if now-r.Ctime > int64(loadAwareStaleTime/time.Second) {
+			delete(m.loads, addr)
+			continue
+		}
+		l, ok := m.loads[addr]
+		if !ok {
+			m.loads[addr] = &smoothedLoad{ctime: r.Ctime, cpu: r.CPU, inFlight: float64(r.InFlight)}
+			continue
+		}
+		if l.ctime == r.Ctime {
+			continue
+		}
+		l.ctime = r.Ctime
+		l.cpu = loadAwareEWMAAlpha*r.CPU + (1-loadAwareEWMAAlpha)*l.cpu
+		l.inFlight = loadAwareEWMAAlpha*float64(r.InFlight) + (1-loadAwareEWMAAlpha)*l.inFlight
+	}
+	for addr := range m.loads {
+		if _, ok := reported[addr]; !ok {
+			delete(m.loads, addr)
+		}
+	}
+}
+
+// factors 负载系数取相对候选实例均值的比例, 没有上报的实例系数为 1
+func (m *LoadAware) factors(list []*ServInfo) map[string]float64 {
+	var sumCPU, sumInFlight float64
+	var n int
+	for _, s := range list {
+		if l, ok := m.loads[s.Addr]; ok {
+			sumCPU += l.cpu
+			sumInFlight += l.inFlight
+			n++
+		}
+	}
+
+	factors := make(map[string]float64, len(list))
+	if n == 0 {
+		return factors
+	}
+	avgCPU, avgInFlight := sumCPU/float64(n), sumInFlight/float64(n)
+	rel := func(v, avg float64) float64 {
+		if avg == 0 {
+			return 1
+		}
+		return v / avg
+	}
+	for _, s := range list {
+		if l, ok := m.loads[s.Addr]; ok {
+			f := (rel(l.cpu, avgCPU) + rel(l.inFlight, avgInFlight)) / 2
+			factors[s.Addr] = math.Min(math.Max(f, loadAwareMinFactor), loadAwareMaxFactor)
+		}
+	}
+	return factors
+}
+
+func (m *LoadAware) score(s *ServInfo, factors map[string]float64) float64 {
+	f, ok := factors[s.Addr]
+	if !ok {
+		f = 1
+	}
+	return float64(m.counter[s.Addr]+1) * f
+}
@@ -0,0 +1,58 @@
+package rocserv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeLoadLookup struct {
+	servs []*ServInfo
+	loads map[string]*InstanceLoad
+}
+
+func (m *fakeLoadLookup) GetServAddr(processor, key string) *ServInfo { return nil }
+func (m *fakeLoadLookup) GetServAddrWithServid(servid int, processor, key string) *ServInfo {
+	return nil
+}
+func (m *fakeLoadLookup) GetServAddrWithGroup(group string, processor, key string) *ServInfo {
+	return nil
+}
+func (m *fakeLoadLookup) GetAllServAddr(processor string) []*ServInfo { return m.servs }
+func (m *fakeLoadLookup) GetAllServAddrWithGroup(group, processor string) []*ServInfo {
+	return m.servs
+}
+func (m *fakeLoadLookup) GetAllServLoadWithGroup(group, processor string) map[string]*InstanceLoad {
+	return m.loads
+}
+func (m *fakeLoadLookup) ServKey() string  { return "test/load" }
+func (m *fakeLoadLookup) ServPath() string { return "/roc/dist2/test/load" }
+
+func TestLoadAwareRoute(t *testing.T) {
+	ass := assert.New(t)
+
+	now := time.Now().Unix()
+	cb := &fakeLoadLookup{
+		servs: []*ServInfo{{Type: "grpc", Addr: "hot"}, {Type: "grpc", Addr: "cold"}},
+		loads: map[string]*InstanceLoad{
+			"hot":  {CPU: 4, InFlight: 100, Ctime: now},
+			"cold": {CPU: 1, InFlight: 10, Ctime: now},
+		},
+	}
+	r := NewLoadAware(cb)
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		s := r.Route(context.Background(), "proc_grpc", "")
+		counts[s.Addr]++
+	}
+	ass.True(counts["cold"] > counts["hot"])
+
+	// 上报过期后退化为按本地并发路由
+	cb.loads["hot"].Ctime = now - 3600
+	cb.loads["cold"].Ctime = now - 3600
+	r.route("", "proc_grpc")
+	ass.Equal(0, len(r.loads))
+}
@@ -0,0 +1,125 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	rpcCodeOK    = "OK"
+	rpcCodeError = "ERROR"
+)
+
+// rpcErrorCode grpc 错误取 status code, 其他错误统一为 ERROR
+func rpcErrorCode(err error) string {
+	if err == nil {
+		return rpcCodeOK
+	}
+	if s, ok := status.FromError(err); ok {
+		return s.Code().String()
+	}
+	return rpcCodeError
+}
+
+// startServerRPC 进入 handler 前调用, 返回的函数在 handler 结束后调用
+func startServerRPC(ctx context.Context, processor, method string) func(code string) {
+	group, service := GetGroupAndService()
+	inFlight := _metricRPCServerInFlight.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, processor, xprom.LabelAPI, method)
+	inFlight.Add(1)
+	st := time.Now()
+	return func(code string) {
+		inFlight.Add(-1)
+		caller := costCaller(ctx)
+		if caller == "" {
+			caller = unknownCostLabel
+		}
+		_metricRPCServerDuration.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, processor, xprom.LabelAPI, method, labelCaller, caller).Observe(time.Since(st).Seconds())
+		_metricRPCServerHandled.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, processor, xprom.LabelAPI, method, labelCaller, caller, labelCode, code).Inc()
+	}
+}
+
+// startClientRPC 下游调用前调用, processor 为被调方的 processor 名
+func startClientRPC(servKey, processor, funcName string) func(err error) {
+	group, service := GetGroupAndService()
+	inFlight := _metricRPCClientInFlight.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, processor, xprom.LabelCalleeService, servKey, xprom.LabelAPI, funcName)
+	inFlight.Add(1)
+	st := xtime.NewTimeStat()
+	return func(err error) {
+		inFlight.Add(-1)
+		_metricRPCClientDuration.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, processor, xprom.LabelCalleeService, servKey, xprom.LabelAPI, funcName).Observe(st.Duration().Seconds())
+		_metricRPCClientHandled.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, processor, xprom.LabelCalleeService, servKey, xprom.LabelAPI, funcName, labelCode, rpcErrorCode(err)).Inc()
+	}
+}
+
+// rpcMetricHttpMiddleware gin 与 http processor 共用, code 为响应状态码
+func rpcMetricHttpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done := startServerRPC(r.Context(), PROCESSOR_HTTP, r.URL.Path)
+		aw := &accessResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, r)
+		code := aw.status
+		if code == 0 {
+			code = http.StatusOK
+		}
+		done(strconv.Itoa(code))
+	})
+}
+
+func rpcMetricServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		done := startServerRPC(ctx, PROCESSOR_GRPC, grpcMethodName(info.FullMethod))
+		resp, err := handler(ctx, req)
+		done(status.Code(err).String())
+		return resp, err
+	}
+}
+
+func rpcMetricStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		done := startServerRPC(ss.Context(), PROCESSOR_GRPC, grpcMethodName(info.FullMethod))
+		err := handler(srv, ss)
+		done(status.Code(err).String())
+		return err
+	}
+}
+
+// rpcMetricProcessor thrift 的 handler 没有 ctx, 调用方为 unknown, 方法名在读到 message 后才能确定,
+// 因此 in-flight 从读到 message 开始计数
+type rpcMetricProcessor struct {
+	thrift.TProcessor
+}
+
+func (m *rpcMetricProcessor) Process(in, out thrift.TProtocol) (bool, thrift.TException) {
+	rin := &rpcMetricProtocol{TProtocol: in}
+	ok, err := m.TProcessor.Process(rin, out)
+	if rin.done != nil {
+		code := rpcCodeOK
+		if err != nil {
+			code = rpcCodeError
+		}
+		rin.done(code)
+	}
+	return ok, err
+}
+
+type rpcMetricProtocol struct {
+	thrift.TProtocol
+	done func(code string)
+}
+
+func (m *rpcMetricProtocol) ReadMessageBegin() (string, thrift.TMessageType, int32, error) {
+	name, typeId, seqid, err := m.TProtocol.ReadMessageBegin()
+	if err == nil && m.done == nil {
+		m.done = startServerRPC(context.Background(), PROCESSOR_THRIFT, name)
+	}
+	return name, typeId, seqid, err
+}
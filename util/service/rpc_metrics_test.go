@@ -0,0 +1,42 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRPCErrorCode(t *testing.T) {
+	ass := assert.New(t)
+	ass.Equal("OK", rpcErrorCode(nil))
+	ass.Equal("ERROR", rpcErrorCode(errors.New("broken pipe")))
+	ass.Equal(codes.Unavailable.String(), rpcErrorCode(status.Error(codes.Unavailable, "unavailable")))
+}
+
+func TestRPCMetricHooks(t *testing.T) {
+	ass := assert.New(t)
+
+	h := rpcMetricHttpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	ass.Equal(http.StatusTeapot, w.Code)
+
+	resp, err := rpcMetricServerInterceptor()(context.Background(), "req", &grpc.UnaryServerInfo{FullMethod: "/pkg.Svc/Ping"},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, status.Error(codes.NotFound, "not found")
+		})
+	ass.Nil(resp)
+	ass.Equal(codes.NotFound, status.Code(err))
+
+	done := startClientRPC("base/account", "proc_grpc", "Ping")
+	done(nil)
+}
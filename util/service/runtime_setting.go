@@ -0,0 +1,459 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/julienschmidt/httprouter"
+)
+
+// 内置的运行时开关
+const (
+	// RuntimeSettingLogLevel app log level, see SetLogLevel
+	RuntimeSettingLogLevel = "log_level"
+	// RuntimeSettingDrain true removes this instance from routing of clients
+	RuntimeSettingDrain = "drain"
+	// RuntimeSettingAccessLogSample enable access log with sample rate 0-100, ignoring access_log_enable of config center
+	RuntimeSettingAccessLogSample = "access_log_sample_rate"
+)
+
+// 默认保存在日志目录下, 日志输出到 console 时不保存
+const runtimeSettingFile = "runtime_settings.json"
+
+// RuntimeSetting operator toggle set at runtime, zero ExpireAt means never expires
+type RuntimeSetting struct {
+	Value    string    `json:"value"`
+	ExpireAt time.Time `json:"expire_at"`
+	// Persist 为 false 时只在当前进程生效
+	Persist bool `json:"persist"`
+}
+
+func (m *RuntimeSetting) expired(now time.Time) bool {
+	return !m.ExpireAt.IsZero() && !now.Before(m.ExpireAt)
+}
+
+// RuntimeSettingStore where persisted runtime settings are kept across restarts of the instance
+type RuntimeSettingStore interface {
+	Load(ctx context.Context) (map[string]*RuntimeSetting, error)
+	Save(ctx context.Context, key string, s *RuntimeSetting) error
+	Delete(ctx context.Context, key string) error
+}
+
+// NewFileRuntimeSettingStore store settings in a json file on local disk
+func NewFileRuntimeSettingStore(path string) RuntimeSettingStore {
+	return &fileSettingStore{path: path}
+}
+
+type fileSettingStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (m *fileSettingStore) read() (map[string]*RuntimeSetting, error) {
+	settings := make(map[string]*RuntimeSetting)
+	bs, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bs, &settings); err != nil {
+		return nil, fmt.Errorf("invalid runtime setting file: %s err: %v", m.path, err)
+	}
+	return settings, nil
+}
+
+// write 先写临时文件再 rename, 避免进程退出时留下不完整的文件
+func (m *fileSettingStore) write(settings map[string]*RuntimeSetting) error {
+	if len(settings) == 0 {
+		if err := os.Remove(m.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	bs, _ := json.Marshal(settings)
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+func (m *fileSettingStore) Load(ctx context.Context) (map[string]*RuntimeSetting, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.read()
+}
+
+func (m *fileSettingStore) Save(ctx context.Context, key string, s *RuntimeSetting) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	settings, err := m.read()
+	if err != nil {
+		// 文件损坏时覆盖
+		settings = make(map[string]*RuntimeSetting)
+	}
+	settings[key] = s
+	return m.write(settings)
+}
+
+func (m *fileSettingStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	settings, err := m.read()
+	if err != nil {
+		return m.write(nil)
+	}
+	if _, ok := settings[key]; !ok {
+		return nil
+	}
+	delete(settings, key)
+	return m.write(settings)
+}
+
+// NewEtcdRuntimeSettingStore store settings of instance servId in etcd under {baseloc}/settings/{servLocation}/{servId}/,
+// expiration is done by ttl of etcd, servId is kept across restarts as long as sess key is not changed
+func NewEtcdRuntimeSettingStore(sb *ServBaseV2) RuntimeSettingStore {
+	return &etcdSettingStore{
+		client: sb.etcdClient,
+		path:   fmt.Sprintf("%s/%s/%s/%d", sb.confEtcd.useBaseloc, BASE_LOC_SETTINGS, sb.servLocation, sb.servId),
+	}
+}
+
+type etcdSettingStore struct {
+	client etcd.KeysAPI
+	path   string
+}
+
+func (m *etcdSettingStore) Load(ctx context.Context) (map[string]*RuntimeSetting, error) {
+	settings := make(map[string]*RuntimeSetting)
+	r, err := m.client.Get(ctx, m.path, &etcd.GetOptions{Recursive: true})
+	if etcd.IsKeyNotFound(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Node == nil {
+		return settings, nil
+	}
+	for _, n := range r.Node.Nodes {
+		if n.Dir {
+			continue
+		}
+		s := &RuntimeSetting{Value: n.Value, Persist: true}
+		if n.Expiration != nil {
+			s.ExpireAt = *n.Expiration
+		}
+		settings[n.Key[len(r.Node.Key)+1:]] = s
+	}
+	return settings, nil
+}
+
+func (m *etcdSettingStore) Save(ctx context.Context, key string, s *RuntimeSetting) error {
+	opts := &etcd.SetOptions{}
+	if !s.ExpireAt.IsZero() {
+		ttl := time.Until(s.ExpireAt)
+		if ttl < time.Second {
+			ttl = time.Second
+		}
+		opts.TTL = ttl
+	}
+	_, err := m.client.Set(ctx, m.path+"/"+key, s.Value, opts)
+	return err
+}
+
+func (m *etcdSettingStore) Delete(ctx context.Context, key string) error {
+	_, err := m.client.Delete(ctx, m.path+"/"+key, nil)
+	if etcd.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+type runtimeSettings struct {
+	mu       sync.Mutex
+	store    RuntimeSettingStore
+	appliers map[string]func(value string) error
+	values   map[string]*RuntimeSetting
+	timers   map[string]*time.Timer
+}
+
+func newRuntimeSettings() *runtimeSettings {
+	return &runtimeSettings{
+		appliers: make(map[string]func(value string) error),
+		values:   make(map[string]*RuntimeSetting),
+		timers:   make(map[string]*time.Timer),
+	}
+}
+
+var appRuntimeSettings = newRuntimeSettings()
+
+func init() {
+	RegisterRuntimeSetting(RuntimeSettingLogLevel, applyLogLevelSetting)
+	RegisterRuntimeSetting(RuntimeSettingDrain, applyDrainSetting)
+	RegisterRuntimeSetting(RuntimeSettingAccessLogSample, applyAccessLogSampleSetting)
+}
+
+// RegisterRuntimeSetting add a runtime toggle settable by backdoor, apply is called with the new value,
+// empty value means the setting is removed or expired and the default should be restored
+func RegisterRuntimeSetting(key string, apply func(value string) error) {
+	appRuntimeSettings.mu.Lock()
+	defer appRuntimeSettings.mu.Unlock()
+	appRuntimeSettings.appliers[key] = apply
+}
+
+// SetRuntimeSetting apply value of toggle key, ttl > 0 restores the default after ttl,
+// persist keeps the setting across restarts of the instance until it expires, empty value restores the default
+func SetRuntimeSetting(ctx context.Context, key, value string, ttl time.Duration, persist bool) error {
+	return appRuntimeSettings.set(ctx, key, value, ttl, persist)
+}
+
+// GetRuntimeSettings settings currently in effect
+func GetRuntimeSettings() map[string]RuntimeSetting {
+	return appRuntimeSettings.snapshot()
+}
+
+// init 切换存储并恢复未过期的设置, 重启期间过期的设置恢复默认值
+func (m *runtimeSettings) init(ctx context.Context, store RuntimeSettingStore) {
+	fun := "runtimeSettings.init -->"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store = store
+	if store == nil {
+		return
+	}
+	settings, err := store.Load(ctx)
+	if err != nil {
+		logger().Warnf(ctx, "%s load err: %v", fun, err)
+		return
+	}
+
+	now := time.Now()
+	for key, s := range settings {
+		apply, ok := m.appliers[key]
+		if !ok {
+			logger().Warnf(ctx, "%s unknown setting: %s", fun, key)
+			continue
+		}
+		s.Persist = true
+		if s.expired(now) {
+			if err := apply(""); err != nil {
+				logger().Warnf(ctx, "%s reset key: %s err: %v", fun, key, err)
+			}
+			store.Delete(ctx, key)
+			continue
+		}
+		if err := apply(s.Value); err != nil {
+			logger().Warnf(ctx, "%s restore key: %s value: %s err: %v", fun, key, s.Value, err)
+			continue
+		}
+		logger().Infof(ctx, "%s restore key: %s value: %s expire at: %v", fun, key, s.Value, s.ExpireAt)
+		m.put(key, s)
+	}
+}
+
+func (m *runtimeSettings) set(ctx context.Context, key, value string, ttl time.Duration, persist bool) error {
+	fun := "runtimeSettings.set -->"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	apply, ok := m.appliers[key]
+	if !ok {
+		return fmt.Errorf("unknown runtime setting: %s", key)
+	}
+	if err := apply(value); err != nil {
+		return err
+	}
+	logger().Infof(ctx, "%s key: %s value: %s ttl: %v persist: %v", fun, key, value, ttl, persist)
+
+	if len(value) == 0 {
+		m.remove(ctx, key)
+		return nil
+	}
+	s := &RuntimeSetting{Value: value, Persist: persist}
+	if ttl > 0 {
+		s.ExpireAt = time.Now().Add(ttl)
+	}
+	m.put(key, s)
+
+	if m.store == nil {
+		return nil
+	}
+	// 未持久化的设置需删除之前保存的值, 否则重启后恢复的是旧值
+	var err error
+	if persist {
+		err = m.store.Save(ctx, key, s)
+	} else {
+		err = m.store.Delete(ctx, key)
+	}
+	if err != nil {
+		logger().Warnf(ctx, "%s store key: %s err: %v", fun, key, err)
+	}
+	return nil
+}
+
+// put 需持有锁
+func (m *runtimeSettings) put(key string, s *RuntimeSetting) {
+	if t, ok := m.timers[key]; ok {
+		t.Stop()
+		delete(m.timers, key)
+	}
+	m.values[key] = s
+	if !s.ExpireAt.IsZero() {
+		m.timers[key] = time.AfterFunc(time.Until(s.ExpireAt), func() {
+			m.expire(key, s)
+		})
+	}
+}
+
+// remove 需持有锁
+func (m *runtimeSettings) remove(ctx context.Context, key string) {
+	if t, ok := m.timers[key]; ok {
+		t.Stop()
+		delete(m.timers, key)
+	}
+	delete(m.values, key)
+	if m.store != nil {
+		if err := m.store.Delete(ctx, key); err != nil {
+			logger().Warnf(ctx, "runtimeSettings.remove --> key: %s err: %v", key, err)
+		}
+	}
+}
+
+func (m *runtimeSettings) expire(key string, s *RuntimeSetting) {
+	ctx := context.Background()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// 期间被重新设置过
+	if m.values[key] != s {
+		return
+	}
+	if err := m.appliers[key](""); err != nil {
+		logger().Warnf(ctx, "runtimeSettings.expire --> key: %s err: %v", key, err)
+	}
+	logger().Infof(ctx, "runtimeSettings.expire --> key: %s value: %s expired", key, s.Value)
+	m.remove(ctx, key)
+}
+
+func (m *runtimeSettings) snapshot() map[string]RuntimeSetting {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := make(map[string]RuntimeSetting, len(m.values))
+	for k, v := range m.values {
+		r[k] = *v
+	}
+	return r
+}
+
+func (m *runtimeSettings) get(key string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.values[key]; ok {
+		return s.Value, true
+	}
+	return "", false
+}
+
+// initRuntimeSettings 日志初始化之后调用, 默认保存在日志目录下
+func initRuntimeSettings(ctx context.Context, sb *ServBaseV2, logdir string, inEtcd bool) {
+	var store RuntimeSettingStore
+	// 降级启动时 servid 未知, 使用日志目录下的文件
+	if inEtcd && !sb.RegistrationPending() {
+		store = NewEtcdRuntimeSettingStore(sb)
+	} else if len(logdir) > 0 {
+		store = NewFileRuntimeSettingStore(filepath.Join(logdir, runtimeSettingFile))
+	}
+	appRuntimeSettings.init(ctx, store)
+}
+
+func applyLogLevelSetting(value string) error {
+	return appLogLevel.set(value)
+}
+
+func applyDrainSetting(value string) error {
+	disable := false
+	if len(value) > 0 {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid drain: %s", value)
+		}
+		disable = b
+	}
+	sb, ok := server.sbase.(*ServBaseV2)
+	if !ok {
+		return fmt.Errorf("server not init")
+	}
+	return sb.DisableInstance(sb.servId, disable)
+}
+
+func applyAccessLogSampleSetting(value string) error {
+	if len(value) == 0 {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > 100 {
+		return fmt.Errorf("invalid access log sample rate: %s", value)
+	}
+	return nil
+}
+
+// runtimeSettingsHandler GET 返回当前生效的设置, POST key=K&value=V&ttl=30m&persist=true 修改, value 为空时恢复默认
+func runtimeSettingsHandler(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if r.Method == http.MethodPost {
+		var ttl time.Duration
+		if s := r.FormValue("ttl"); len(s) > 0 {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid ttl: %s", s), http.StatusBadRequest)
+				return
+			}
+			ttl = d
+		}
+		persist := true
+		if s := r.FormValue("persist"); len(s) > 0 {
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid persist: %s", s), http.StatusBadRequest)
+				return
+			}
+			persist = b
+		}
+		if err := SetRuntimeSetting(r.Context(), r.FormValue("key"), strings.TrimSpace(r.FormValue("value")), ttl, persist); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	settings := GetRuntimeSettings()
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	type item struct {
+		Key string `json:"key"`
+		RuntimeSetting
+	}
+	items := make([]item, 0, len(keys))
+	for _, k := range keys {
+		items = append(items, item{Key: k, RuntimeSetting: settings[k]})
+	}
+	s, _ := json.Marshal(items)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s)
+}
@@ -0,0 +1,98 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeSettings(t *testing.T) {
+	ass := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "settings")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	store := NewFileRuntimeSettingStore(filepath.Join(dir, runtimeSettingFile))
+
+	applied := make(map[string]string)
+	rs := newRuntimeSettings()
+	rs.appliers["sample"] = func(v string) error {
+		applied["sample"] = v
+		return nil
+	}
+	rs.appliers["trace"] = func(v string) error {
+		applied["trace"] = v
+		return nil
+	}
+	rs.init(ctx, store)
+	ass.NotNil(rs.set(ctx, "unknown", "1", 0, true))
+
+	// 只在当前进程生效的设置不保存
+	ass.Nil(rs.set(ctx, "sample", "10", 0, true))
+	ass.Nil(rs.set(ctx, "trace", "on", 0, false))
+	settings, err := store.Load(ctx)
+	ass.Nil(err)
+	ass.Equal("10", settings["sample"].Value)
+	ass.Nil(settings["trace"])
+	v, ok := rs.get("trace")
+	ass.True(ok)
+	ass.Equal("on", v)
+
+	// 重启期间过期的设置恢复默认值
+	ass.Nil(store.Save(ctx, "trace", &RuntimeSetting{Value: "on", ExpireAt: time.Now().Add(-time.Second)}))
+	applied = make(map[string]string)
+	rs2 := newRuntimeSettings()
+	rs2.appliers = rs.appliers
+	rs2.init(ctx, store)
+	ass.Equal(map[string]string{"sample": "10", "trace": ""}, applied)
+	settings, _ = store.Load(ctx)
+	ass.Len(settings, 1)
+
+	ass.Nil(rs2.set(ctx, "sample", "", 0, true))
+	ass.Equal("", applied["sample"])
+	_, ok = rs2.get("sample")
+	ass.False(ok)
+	settings, _ = store.Load(ctx)
+	ass.Len(settings, 0)
+}
+
+func TestRuntimeSettingsHandler(t *testing.T) {
+	ass := assert.New(t)
+
+	defer SetRuntimeSetting(context.Background(), RuntimeSettingAccessLogSample, "", 0, false)
+
+	r := httptest.NewRequest(http.MethodPost, "/backdoor/settings", strings.NewReader("key=access_log_sample_rate&value=200"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	runtimeSettingsHandler(w, r, nil)
+	ass.Equal(http.StatusBadRequest, w.Code)
+
+	r = httptest.NewRequest(http.MethodPost, "/backdoor/settings", strings.NewReader("key=access_log_sample_rate&value=30&ttl=1m&persist=false"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	runtimeSettingsHandler(w, r, nil)
+	ass.Equal(http.StatusOK, w.Code)
+	var items []struct {
+		Key string `json:"key"`
+		RuntimeSetting
+	}
+	ass.Nil(json.Unmarshal(w.Body.Bytes(), &items))
+	ass.Len(items, 1)
+	ass.Equal("30", items[0].Value)
+	ass.False(items[0].Persist)
+
+	// 运行时设置的采样率优先于配置中心
+	conf := getAccessLogConf()
+	ass.NotNil(conf)
+	ass.Equal(30, conf.sample)
+}
@@ -0,0 +1,64 @@
+package rocserv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// reasons why LookupServAddr finds no instance, check with errors.Is;
+// ErrClientNotReady is returned before the first instance list is loaded
+var (
+	ErrProcessorNotFound  = errors.New("no instance registers the processor")
+	ErrInstancesDisabled  = errors.New("all instances of the processor are disabled")
+	ErrInstancesStarting  = errors.New("all instances of the processor are starting")
+	ErrNoRoutableInstance = errors.New("no routable instance of the processor")
+)
+
+// LookupServAddr same as GetServAddr, and return the reason when no instance is found
+func (m *ClientEtcdV2) LookupServAddr(processor, key string) (*ServInfo, error) {
+	return m.LookupServAddrWithGroup("", processor, key)
+}
+
+// LookupServAddrWithGroup same as GetServAddrWithGroup, and return the reason when no instance is found
+func (m *ClientEtcdV2) LookupServAddrWithGroup(group, processor, key string) (*ServInfo, error) {
+	if s := m.GetServAddrWithGroup(group, processor, key); s != nil {
+		return s, nil
+	}
+
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+	// 与 GetServAddrWithGroup 之间实例列表可能已更新, 按当前列表判断
+	return nil, fmt.Errorf("%w, service: %s processor: %s group: %s", m.servAddrErr(group, processor), m.servPath, processor, group)
+}
+
+// servAddrErr 按 applyServlist 的过滤顺序判断没有实例的原因
+func (m *ClientEtcdV2) servAddrErr(group, processor string) error {
+	if m.servCopy == nil {
+		return ErrClientNotReady
+	}
+
+	var registered, disabled, starting int
+	for _, c := range m.servCopy {
+		if c == nil || c.reg == nil || c.reg.Servs[processor] == nil {
+			continue
+		}
+		registered++
+		switch {
+		case c.manual == nil || c.manual.Ctrl == nil || c.manual.Ctrl.Disable:
+			disabled++
+		case !c.reg.IsActive():
+			starting++
+		}
+	}
+
+	switch {
+	case registered == 0:
+		return ErrProcessorNotFound
+	case disabled == registered:
+		return ErrInstancesDisabled
+	case disabled+starting == registered:
+		return ErrInstancesStarting
+	}
+	// 泳道没有实例, 或者 hash 选中的实例没有注册该 processor
+	return ErrNoRoutableInstance
+}
@@ -0,0 +1,44 @@
+package rocserv
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookupServAddr(t *testing.T) {
+	ass := assert.New(t)
+
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	_, err := cli.LookupServAddr("proc_grpc", "k")
+	ass.True(errors.Is(err, ErrClientNotReady))
+
+	disabled := zoneServCopy(1, "a", 100)
+	disabled.manual.Ctrl.Disable = true
+	cli.upServlist(servCopyCollect{1: disabled})
+	_, err = cli.LookupServAddr("proc_thrift", "k")
+	ass.True(errors.Is(err, ErrProcessorNotFound))
+	_, err = cli.LookupServAddr("proc_grpc", "k")
+	ass.True(errors.Is(err, ErrInstancesDisabled))
+
+	starting := zoneServCopy(2, "a", 100)
+	starting.reg.State = RegStateStarting
+	cli.upServlist(servCopyCollect{1: disabled, 2: starting})
+	_, err = cli.LookupServAddr("proc_grpc", "k")
+	ass.True(errors.Is(err, ErrInstancesStarting))
+	ass.Nil(cli.GetServAddr("proc_grpc", "k"))
+
+	// 只有其他泳道的实例
+	lane := "feature-x"
+	feature := zoneServCopy(3, "a", 100)
+	feature.reg.Lane = &lane
+	cli.upServlist(servCopyCollect{1: disabled, 3: feature})
+	_, err = cli.LookupServAddr("proc_grpc", "k")
+	ass.True(errors.Is(err, ErrNoRoutableInstance))
+
+	cli.upServlist(servCopyCollect{1: zoneServCopy(1, "a", 100), 3: feature})
+	s, err := cli.LookupServAddrWithGroup(lane, "proc_grpc", "k")
+	ass.Nil(err)
+	ass.Equal("127.0.0.3:9000", s.Addr)
+}
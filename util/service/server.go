@@ -14,7 +14,9 @@ import (
 	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"gitlab.pri.ibanyu.com/middleware/dolphin/circuit_breaker"
 	"gitlab.pri.ibanyu.com/middleware/dolphin/rate_limit/registry"
@@ -38,6 +40,24 @@ var server = NewServer()
 // Server ...
 type Server struct {
 	sbase ServBase
+
+	muProcs sync.Mutex
+	// 运行中的 processor, 包含 backdoor 及 metrics
+	procs map[string]*runningProcessor
+
+	// 主从模式选举的全局锁
+	masterSlaveLock string
+	// 收到 SIGTERM 删除注册节点后, 停止 processor 之前等待的时间
+	preStopDelay time.Duration
+}
+
+type runningProcessor struct {
+	info *ServInfo
+	// ListenAddrs 额外监听地址的注册信息, key 为注册名
+	extras map[string]*ServInfo
+	stop   processorStopper
+	// 非空时为 lazy processor
+	lazy *lazyProcessor
 }
 
 // NewServer create new server
@@ -58,6 +78,15 @@ type cmdArgs struct {
 	startType         string // 启动方式：local - 不注册至etcd
 	crossRegionIdList string
 	region            string
+	zone              string
+	supervisor        *SupervisorConf // 非空时在 supervisor 模式下等待停止
+	identity          *IdentityConf   // 非空时开启服务身份
+	settingsInEtcd    bool            // 运行时设置保存在 etcd, 默认保存在日志目录下
+	otel              *OTelConf       // 为空时从 OTEL_EXPORTER_OTLP_ENDPOINT 读取
+	preStopDelay      *time.Duration  // 为空时从 ROC_PRE_STOP_DELAY 读取
+	strictValidation  bool            // 启动校验发现问题时启动失败
+	topologySnapshot  bool            // 参与维护服务的拓扑快照
+	degradedStart     bool            // etcd 不可用时不注册启动, 后台重试注册
 }
 
 func (m *Server) parseFlag() (*cmdArgs, error) {
@@ -67,12 +96,16 @@ func (m *Server) parseFlag() (*cmdArgs, error) {
 	flag.IntVar(&logMaxBackups, "logmaxbackups", 0, "logmaxbackups is the maximum number of old log files to retain")
 	flag.StringVar(&serv, "serv", "", "servic name")
 	flag.StringVar(&logDir, "logdir", "", "serice log dir")
-	flag.StringVar(&skey, "skey", "", "service session key")
+	flag.StringVar(&skey, "sesskey", "", "service session key")
 	flag.IntVar(&sidOffset, "sidoffset", 0, "service id offset for different data center")
 	flag.StringVar(&group, "group", "", "service group")
 	// 启动方式：local - 不注册至etcd
 	flag.StringVar(&startType, "stype", "", "start up type, local is not register to etcd")
 
+	// 改名的 flag 保留老名字作为别名
+	if err := registerDeprecatedFlags(flag.CommandLine); err != nil {
+		return nil, err
+	}
 	flag.Parse()
 
 	if len(serv) == 0 {
@@ -80,12 +113,13 @@ func (m *Server) parseFlag() (*cmdArgs, error) {
 	}
 
 	if len(skey) == 0 {
-		return nil, fmt.Errorf("skey args need!")
+		return nil, fmt.Errorf("sesskey args need!")
 	}
 
-	crossRegionIdList := os.Getenv("CROSSREGIONIDLIST")
+	crossRegionIdList := GetenvCompat(crossRegionIdListEnv, deprecatedCrossRegionIdListEnv)
 
 	region := getRegionFromEnvOrDefault()
+	zone := getZoneFromEnv()
 
 	return &cmdArgs{
 		logMaxSize:        logMaxSize,
@@ -98,6 +132,7 @@ func (m *Server) parseFlag() (*cmdArgs, error) {
 		startType:         startType,
 		crossRegionIdList: crossRegionIdList,
 		region:            region,
+		zone:              zone,
 	}, nil
 }
 
@@ -109,18 +144,27 @@ func (m *Server) loadDriver(procs map[string]Processor) (map[string]*ServInfo, e
 
 	for name, processor := range procs {
 		driverBuilder := newDriverBuilder(m.sbase.ConfigCenter())
-		servInfo, err := driverBuilder.powerProcessorDriver(ctx, name, processor)
+		servInfo, extras, stop, err := driverBuilder.powerProcessorDriver(ctx, name, processor)
 		if err == errNilDriver {
-			xlog.Infof(ctx, "%s processor: %s no driver, skip", fun, name)
+			logger().Infof(ctx, "%s processor: %s no driver, skip", fun, name)
 			continue
 		}
 		if err != nil {
-			xlog.Errorf(ctx, "%s load error, processor: %s, err: %v", fun, name, err)
+			logger().Errorf(ctx, "%s load error, processor: %s, err: %v", fun, name, err)
 			return nil, err
 		}
 
 		infos[name] = servInfo
-		xlog.Infof(ctx, "%s load ok, processor: %s, serv addr: %s", fun, name, servInfo.Addr)
+		for n, info := range extras {
+			infos[n] = info
+			logger().Infof(ctx, "%s load ok, processor: %s, listen addr: %s, serv addr: %s", fun, name, n, info.Addr)
+		}
+		lazy, _ := processor.(*lazyProcessor)
+		if sb, ok := m.sbase.(*ServBaseV2); ok && lazy != nil {
+			sb.AddReadinessCheck("lazy:"+name, lazy.check)
+		}
+		m.addRunningProcessor(name, &runningProcessor{info: servInfo, extras: extras, stop: stop, lazy: lazy})
+		logger().Infof(ctx, "%s load ok, processor: %s, serv addr: %s", fun, name, servInfo.Addr)
 	}
 
 	return infos, nil
@@ -153,7 +197,7 @@ func (m *Server) initLog(sb *ServBaseV2, args *cmdArgs) error {
 
 	err := sb.ServConfig(&logConfig)
 	if err != nil {
-		xlog.Errorf(context.Background(), "%s serv config err: %v", fun, err)
+		logger().Errorf(context.Background(), "%s serv config err: %v", fun, err)
 		return err
 	}
 
@@ -170,7 +214,7 @@ func (m *Server) initLog(sb *ServBaseV2, args *cmdArgs) error {
 		logdir = ""
 	}
 
-	xlog.Infof(context.Background(), "%s init log dir:%s name:%s level:%s", fun, logdir, args.servLoc, logConfig.Log.Level)
+	logger().Infof(context.Background(), "%s init log dir:%s name:%s level:%s", fun, logdir, args.servLoc, logConfig.Log.Level)
 
 	// 最终根据Apollo中配置的log level决定日志级别， TODO 后续将从etcd获取日志配置的逻辑去掉，统一在Apollo内配置
 	logLevel, ok := m.sbase.ConfigCenter().GetString(context.TODO(), "log_level")
@@ -182,7 +226,8 @@ func (m *Server) initLog(sb *ServBaseV2, args *cmdArgs) error {
 		"lane":   sb.Lane(),
 		"ip":     sb.ServIp(),
 	}
-	xlog.InitAppLogV2(logdir, "serv.log", convertLevel(logConfig.Log.Level), extraHeaders)
+	appLogLevel.init(logdir, extraHeaders, logConfig.Log.Level)
+	initRuntimeSettings(context.Background(), sb, logdir, args.settingsInEtcd)
 	xlog.InitStatLog(logdir, "stat.log")
 	xlog.SetStatLogService(args.servLoc)
 	return nil
@@ -199,88 +244,138 @@ func (m *Server) Init(confEtcd configEtcd, args *cmdArgs, initfn func(ServBase)
 		xlog.Panicf(ctx, "%s parse cross region id list error, arg: %v, err: %v", fun, args.crossRegionIdList, err)
 		return err
 	}
-	xlog.Infof(ctx, "%s new ServBaseV2 start", fun)
+	logger().Infof(ctx, "%s new ServBaseV2 start", fun)
 	sb, err := newServBaseV2WithCmdArgs(confEtcd, servLoc, sessKey, args.group, args.sidOffset, crossRegionIdList, args)
 	if err != nil {
 		xlog.Panicf(ctx, "%s init servbase loc: %s key: %s err: %v", fun, servLoc, sessKey, err)
 		return err
 	}
 	m.sbase = sb
-	xlog.Infof(ctx, "%s new ServBaseV2 end", fun)
+	logger().Infof(ctx, "%s new ServBaseV2 end", fun)
 
 	//将ip存储
 	if err := sb.setIp(); err != nil {
-		xlog.Errorf(ctx, "%s set ip error: %v", fun, err)
+		logger().Errorf(ctx, "%s set ip error: %v", fun, err)
 	}
 
 	// 初始化日志
-	xlog.Infof(ctx, "%s initLog start", fun)
+	logger().Infof(ctx, "%s initLog start", fun)
 	m.initLog(sb, args)
-	xlog.Infof(ctx, "%s initLog end", fun)
+	logger().Infof(ctx, "%s initLog end", fun)
+
+	reportDeprecatedUsage()
 
 	// 初始化服务进程打点
-	xlog.Infof(ctx, "%s init stat start", fun)
+	logger().Infof(ctx, "%s init stat start", fun)
 	stat.Init(sb.servGroup, sb.servName, "")
-	xlog.Infof(ctx, "%s init stat end", fun)
+	logger().Infof(ctx, "%s init stat end", fun)
 
 	defer xlog.AppLogSync()
 	defer xlog.StatLogSync()
 
 	// NOTE: initBackdoor会启动http服务，但由于health check的http请求不需要追踪，且它是判断服务启动与否的关键，所以initTracer可以放在它之后进行
-	xlog.Infof(ctx, "%s init backdoor start", fun)
+	logger().Infof(ctx, "%s init backdoor start", fun)
 	m.initBackdoor(sb)
-	xlog.Infof(ctx, "%s init backdoor end", fun)
+	logger().Infof(ctx, "%s init backdoor end", fun)
+
+	logger().Infof(ctx, "%s init system processors start", fun)
+	m.initSystemProcessors(sb)
+	logger().Infof(ctx, "%s init system processors end", fun)
+
+	logger().Infof(ctx, "%s init error reporter start", fun)
+	m.initErrorReporter(sb)
+	logger().Infof(ctx, "%s init error reporter end", fun)
 
-	xlog.Infof(ctx, "%s init handleModel start", fun)
+	logger().Infof(ctx, "%s init load report start", fun)
+	m.initLoadReport(sb)
+	logger().Infof(ctx, "%s init load report end", fun)
+
+	logger().Infof(ctx, "%s init handleModel start", fun)
 	err = m.handleModel(sb, servLoc, args.model)
 	if err != nil {
 		xlog.Panicf(ctx, "%s handleModel err: %v", fun, err)
 		return err
 	}
-	xlog.Infof(ctx, "%s init handleModel end", fun)
+	logger().Infof(ctx, "%s init handleModel end", fun)
 
-	xlog.Infof(ctx, "%s init dolphin start", fun)
+	logger().Infof(ctx, "%s init dolphin start", fun)
 	err = m.initDolphin(sb)
-	if err != nil {
-		xlog.Errorf(ctx, "%s initDolphin() failed, error: %v", fun, err)
+	if err != nil && sb.RegistrationPending() {
+		// 限流配置同样在 etcd 中, 降级启动时不限流
+		logger().Errorf(ctx, "%s initDolphin() failed in degraded start, rate limit disabled, error: %v", fun, err)
+	} else if err != nil {
+		logger().Errorf(ctx, "%s initDolphin() failed, error: %v", fun, err)
 		return err
 	}
-	xlog.Infof(ctx, "%s init dolphin end", fun)
+	logger().Infof(ctx, "%s init dolphin end", fun)
 
 	// App层初始化
-	xlog.Infof(ctx, "%s init initfn start", fun)
+	logger().Infof(ctx, "%s init initfn start", fun)
 	err = initfn(sb)
 	if err != nil {
 		xlog.Panicf(ctx, "%s callInitFunc err: %v", fun, err)
 		return err
 	}
-	xlog.Infof(ctx, "%s init initfn end", fun)
+	logger().Infof(ctx, "%s init initfn end", fun)
+	sb.readiness.setStage(readyStageInit)
+
+	// 控制命令 handler 在 initfn 中注册, 之后再开始监听
+	logger().Infof(ctx, "%s init control start", fun)
+	go sb.watchControl()
+	logger().Infof(ctx, "%s init control end", fun)
+
+	// idl 可在 initfn 中注册, 发布失败不影响启动
+	logger().Infof(ctx, "%s publish idl start", fun)
+	if err := sb.publishIDL(); err != nil {
+		logger().Errorf(ctx, "%s publish idl err: %v", fun, err)
+	}
+	logger().Infof(ctx, "%s publish idl end", fun)
 
 	// NOTE: processor 在初始化 trace middleware 前需要保证 xtrace.GlobalTracer() 初始化完毕
-	xlog.Infof(ctx, "%s init tracer start", fun)
+	logger().Infof(ctx, "%s init tracer start", fun)
 	m.initTracer(servLoc)
-	xlog.Infof(ctx, "%s init tracer end", fun)
+	initOpenTelemetry(servLoc, args.otel)
+	logger().Infof(ctx, "%s init tracer end", fun)
 
-	xlog.Infof(ctx, "%s init processor start", fun)
+	// processor 及 client 使用服务身份证书建立双向认证
+	logger().Infof(ctx, "%s init service identity start", fun)
+	if err := initServiceIdentity(servLoc, args.identity); err != nil {
+		xlog.Panicf(ctx, "%s init service identity err: %v", fun, err)
+		return err
+	}
+	logger().Infof(ctx, "%s init service identity end", fun)
+
+	logger().Infof(ctx, "%s init processor start", fun)
+	strictValidation = args.strictValidation || strictValidationFromEnv()
 	err = m.initProcessor(sb, procs, args.startType)
 	if err != nil {
 		xlog.Panicf(ctx, "%s initProcessor err: %v", fun, err)
 		return err
 	}
-	xlog.Infof(ctx, "%s init processor end", fun)
+	logger().Infof(ctx, "%s init processor end", fun)
 
-	xlog.Infof(ctx, "%s init SetGroupAndDisable start", fun)
+	logger().Infof(ctx, "%s init SetGroupAndDisable start", fun)
 	sb.SetGroupAndDisable(args.group, args.disable)
-	xlog.Infof(ctx, "%s init SetGroupAndDisable end", fun)
+	logger().Infof(ctx, "%s init SetGroupAndDisable end", fun)
 
-	xlog.Infof(ctx, "%s init metric start", fun)
+	logger().Infof(ctx, "%s init metric start", fun)
 	m.initMetric(sb)
-	xlog.Infof(ctx, "%s init metric end", fun)
+	logger().Infof(ctx, "%s init metric end", fun)
 
-	xlog.Infof(ctx, "server start success, grpc: [%s], thrift: [%s]", GetProcessorAddress(PROCESSOR_GRPC_PROPERTY_NAME), GetProcessorAddress(PROCESSOR_THRIFT_PROPERTY_NAME))
+	logger().Infof(ctx, "server start success, grpc: [%s], thrift: [%s]", GetProcessorAddress(PROCESSOR_GRPC_PROPERTY_NAME), GetProcessorAddress(PROCESSOR_THRIFT_PROPERTY_NAME))
 
-	m.awaitSignal(sb)
+	m.preStopDelay = resolvePreStopDelay(args.preStopDelay)
+	return m.await(sb, args.supervisor)
+}
 
+// await 启动完成后阻塞等待停止信号
+func (m *Server) await(sb *ServBaseV2, conf *SupervisorConf) error {
+	if conf != nil {
+		s := newSupervisor(sb, *conf)
+		s.srv = m
+		return s.run()
+	}
+	m.awaitSignal(sb)
 	return nil
 }
 
@@ -316,12 +411,13 @@ func (m *Server) awaitSignal(sb *ServBaseV2) {
 	for {
 		select {
 		case s := <-c:
-			xlog.Infof(ctx, "receive a signal:%s", s.String())
+			logger().Infof(ctx, "receive a signal:%s", s.String())
 
 			if s.String() == syscall.SIGTERM.String() {
-				xlog.Infof(ctx, "receive a signal: %s, stop server", s.String())
-				sb.Stop()
-				<-(chan int)(nil)
+				logger().Infof(ctx, "receive a signal: %s, stop server", s.String())
+				m.gracefulStop(sb, defaultDrainTimeout)
+				signal.Stop(c)
+				return
 			}
 		}
 	}
@@ -334,12 +430,13 @@ func (m *Server) handleModel(sb *ServBaseV2, servLoc string, model int) error {
 
 	if model == MODEL_MASTERSLAVE {
 		lockKey := fmt.Sprintf("%s-master-slave", servLoc)
+		m.masterSlaveLock = lockKey
 		if err := sb.LockGlobal(lockKey); err != nil {
-			xlog.Errorf(ctx, "%s LockGlobal key: %s, err: %v", fun, lockKey, err)
+			logger().Errorf(ctx, "%s LockGlobal key: %s, err: %v", fun, lockKey, err)
 			return err
 		}
 
-		xlog.Infof(ctx, "%s LockGlobal succ, key: %s", fun, lockKey)
+		logger().Infof(ctx, "%s LockGlobal succ, key: %s", fun, lockKey)
 	}
 
 	return nil
@@ -351,22 +448,22 @@ func (m *Server) initProcessor(sb *ServBaseV2, procs map[string]Processor, start
 
 	for n, p := range procs {
 		if len(n) == 0 {
-			xlog.Errorf(ctx, "%s processor name empty", fun)
+			logger().Errorf(ctx, "%s processor name empty", fun)
 			return fmt.Errorf("processor name empty")
 		}
 
 		if n[0] == '_' {
-			xlog.Errorf(ctx, "%s processor name can not prefix '_'", fun)
+			logger().Errorf(ctx, "%s processor name can not prefix '_'", fun)
 			return fmt.Errorf("processor name can not prefix '_'")
 		}
 
 		if p == nil {
-			xlog.Errorf(ctx, "%s processor:%s is nil", fun, n)
+			logger().Errorf(ctx, "%s processor:%s is nil", fun, n)
 			return fmt.Errorf("processor:%s is nil", n)
 		} else {
 			err := p.Init()
 			if err != nil {
-				xlog.Errorf(ctx, "%s processor: %s init err: %v", fun, n, err)
+				logger().Errorf(ctx, "%s processor: %s init err: %v", fun, n, err)
 				return fmt.Errorf("processor:%s init err:%s", n, err)
 			}
 		}
@@ -374,27 +471,33 @@ func (m *Server) initProcessor(sb *ServBaseV2, procs map[string]Processor, start
 
 	infos, err := m.loadDriver(procs)
 	if err != nil {
-		xlog.Errorf(ctx, "%s load driver err: %v", fun, err)
+		logger().Errorf(ctx, "%s load driver err: %v", fun, err)
 		return err
 	}
+	sb.readiness.setStage(readyStageListening)
 
 	// 本地启动不注册至etcd
 	if sb.IsLocalRunning() {
+		sb.readiness.setStage(readyStageRegistered)
 		return nil
 	}
 
+	// 先以 starting 注册, 就绪后激活
+	sb.announce()
 	err = sb.RegisterService(infos)
 	if err != nil {
-		xlog.Errorf(ctx, "%s register service err: %v", fun, err)
+		logger().Errorf(ctx, "%s register service err: %v", fun, err)
 		return err
 	}
 
 	// 注册跨机房服务
 	err = sb.RegisterCrossDCService(infos)
 	if err != nil {
-		xlog.Errorf(ctx, "%s register cross dc failed, err: %v", fun, err)
+		logger().Errorf(ctx, "%s register cross dc failed, err: %v", fun, err)
 		return err
 	}
+	// readyStageRegistered 在注册协程首次写入成功后设置
+	go sb.activateWhenReady()
 
 	return nil
 }
@@ -405,63 +508,51 @@ func (m *Server) initTracer(servLoc string) error {
 
 	err := xtrace.InitDefaultTracer(servLoc)
 	if err != nil {
-		xlog.Errorf(ctx, "%s init tracer err: %v", fun, err)
+		logger().Errorf(ctx, "%s init tracer err: %v", fun, err)
 	}
 
 	err = xtrace.InitTraceSpanFilter()
 	if err != nil {
-		xlog.Errorf(ctx, "%s init trace span filter fail: %s", fun, err.Error())
+		logger().Errorf(ctx, "%s init trace span filter fail: %s", fun, err.Error())
 	}
 
 	return err
 }
 
 func (m *Server) initBackdoor(sb *ServBaseV2) error {
-	fun := "Server.initBackdoor -->"
-	ctx := context.Background()
+	return m.loadSystemProcessor("_PROC_BACKDOOR", &backDoorHttp{}, sb.RegisterBackDoor)
+}
 
-	backdoor := &backDoorHttp{}
-	err := backdoor.Init()
-	if err != nil {
-		xlog.Errorf(ctx, "%s init backdoor err: %v", fun, err)
-		return err
-	}
+func (m *Server) initLoadReport(sb *ServBaseV2) {
+	fun := "Server.initLoadReport -->"
+	ctx := context.Background()
 
-	binfos, err := m.loadDriver(map[string]Processor{"_PROC_BACKDOOR": backdoor})
-	if err == nil {
-		err = sb.RegisterBackDoor(binfos)
-		if err != nil {
-			xlog.Errorf(ctx, "%s register backdoor err: %v", fun, err)
+	var loadConfig struct {
+		LoadReport struct {
+			Enable bool
+			// 上报周期, 单位秒
+			Interval int
 		}
-
-	} else {
-		xlog.Warnf(ctx, "%s load backdoor driver err: %v", fun, err)
+	}
+	if err := sb.ServConfig(&loadConfig); err != nil {
+		logger().Warnf(ctx, "%s serv config err: %v", fun, err)
+		return
+	}
+	if !loadConfig.LoadReport.Enable || sb.IsLocalRunning() {
+		return
 	}
 
-	return err
+	go newLoadReporter(sb, time.Duration(loadConfig.LoadReport.Interval)*time.Second).run()
 }
 
-func (m *Server) initMetric(sb *ServBaseV2) error {
-	fun := "Server.initMetric -->"
-	ctx := context.Background()
-
-	metrics := xprom.NewMetricProcessor()
-	err := metrics.Init()
-	if err != nil {
-		xlog.Warnf(ctx, "%s init metrics err: %v", fun, err)
-	}
-
-	metricInfo, err := m.loadDriver(map[string]Processor{"_PROC_METRICS": metrics})
-	if err == nil {
-		err = sb.RegisterMetrics(metricInfo)
-		if err != nil {
-			xlog.Warnf(ctx, "%s register backdoor err: %v", fun, err)
-		}
+func (m *Server) initErrorReporter(sb *ServBaseV2) {
+	go GetErrorReporter().Run(context.Background(), defaultErrorReportInterval)
+	sb.WatchConfig(costLabelLimitConfKey, updateCostLabelLimit)
+	go GetCostAccountant().Run(context.Background(), defaultCostReportInterval)
+}
 
-	} else {
-		xlog.Warnf(ctx, "%s load metrics driver err: %v", fun, err)
-	}
-	return err
+func (m *Server) initMetric(sb *ServBaseV2) error {
+	return m.loadSystemProcessor("_PROC_METRICS", xprom.NewMetricProcessor(), sb.RegisterMetrics)
 }
 
 func (m *Server) initDolphin(sb *ServBaseV2) error {
@@ -469,14 +560,14 @@ func (m *Server) initDolphin(sb *ServBaseV2) error {
 	// circuit breaker
 	err := circuit_breaker.Init(sb.servGroup, sb.servName)
 	if err != nil {
-		xlog.Errorf(context.Background(), "%s: circuit_breaker.Init() failed, error: %+v", fun, err)
+		logger().Errorf(context.Background(), "%s: circuit_breaker.Init() failed, error: %+v", fun, err)
 		return err
 	}
 
 	// rate limiter
 	etcdInterfaceRateLimitRegistry, err := registry.NewEtcdInterfaceRateLimitRegistry(sb.servGroup, sb.servName, servbase.ETCDS_CLUSTER_0)
 	if err != nil {
-		xlog.Errorf(context.Background(), "%s: registry.NewEtcdInterfaceRateLimitRegistry() failed, error: %+v", fun, err)
+		logger().Errorf(context.Background(), "%s: registry.NewEtcdInterfaceRateLimitRegistry() failed, error: %+v", fun, err)
 		return err
 	}
 	rateLimitRegistry = etcdInterfaceRateLimitRegistry
@@ -486,14 +577,15 @@ func (m *Server) initDolphin(sb *ServBaseV2) error {
 	return nil
 }
 
-// Serve app call Serve to start server, initLogic is the init func in app, logic.InitLogic,
+// Serve app call Serve to start server, initLogic is the init func in app, logic.InitLogic;
+// on SIGTERM it deregisters, drains processors and returns instead of blocking forever, so the app exits then
 func Serve(etcdAddrs []string, baseLoc string, initLogic func(ServBase) error, processors map[string]Processor) error {
-	return server.Serve(configEtcd{etcdAddrs, baseLoc}, initLogic, processors)
+	return server.Serve(configEtcd{etcdAddrs: etcdAddrs, useBaseloc: baseLoc}, initLogic, processors)
 }
 
-// MasterSlave Leader-Follower模式，通过etcd distribute lock进行选举
+// MasterSlave Leader-Follower模式，通过etcd distribute lock进行选举, 同 Serve 收到 SIGTERM 停止后返回
 func MasterSlave(etcdAddrs []string, baseLoc string, initLogic func(ServBase) error, processors map[string]Processor) error {
-	return server.MasterSlave(configEtcd{etcdAddrs, baseLoc}, initLogic, processors)
+	return server.MasterSlave(configEtcd{etcdAddrs: etcdAddrs, useBaseloc: baseLoc}, initLogic, processors)
 }
 
 func (m *Server) MasterSlave(confEtcd configEtcd, initLogic func(ServBase) error, processors map[string]Processor) error {
@@ -510,7 +602,7 @@ func (m *Server) MasterSlave(confEtcd configEtcd, initLogic func(ServBase) error
 	return m.Init(confEtcd, args, initLogic, processors)
 }
 
-// Init use in test of application
+// Init use in test of application, like Serve it blocks until SIGTERM and returns after graceful stop
 func Init(etcdAddrs []string, baseLoc string, servLoc, servKey, logDir string, initLogic func(ServBase) error, processors map[string]Processor) error {
 	args := &cmdArgs{
 		logMaxSize:    0,
@@ -519,13 +611,25 @@ func Init(etcdAddrs []string, baseLoc string, servLoc, servKey, logDir string, i
 		logDir:        logDir,
 		sessKey:       servKey,
 	}
-	return server.Init(configEtcd{etcdAddrs, baseLoc}, args, initLogic, processors)
+	return server.Init(configEtcd{etcdAddrs: etcdAddrs, useBaseloc: baseLoc}, args, initLogic, processors)
 }
 
 func GetServBase() ServBase {
 	return server.sbase
 }
 
+// ErrServBaseNotInit returned by package level functions of ServBaseV2 features called before Serve or Init
+var ErrServBaseNotInit = errors.New("servbase not init")
+
+// getServBaseV2 功能不在 ServBase 接口中, 包级函数通过它调用
+func getServBaseV2() (*ServBaseV2, error) {
+	sb, ok := server.sbase.(*ServBaseV2)
+	if !ok || sb == nil {
+		return nil, ErrServBaseNotInit
+	}
+	return sb, nil
+}
+
 func GetServName() (servName string) {
 	if server.sbase != nil {
 		servName = server.sbase.Servname()
@@ -570,7 +674,7 @@ func GetProcessorAddress(processorName string) (addr string) {
 		data := new(RegData)
 		err := json.Unmarshal([]byte(val), data)
 		if err != nil {
-			xlog.Warnf(ctx, "GetProcessorAddress unmarshal, val = %s, err = %s", val, err.Error())
+			logger().Warnf(ctx, "GetProcessorAddress unmarshal, val = %s, err = %s", val, err.Error())
 			continue
 		}
 		if servInfo, ok := data.Servs[processorName]; ok {
@@ -600,5 +704,5 @@ func Test(etcdAddrs []string, baseLoc, servLoc string, initLogic func(ServBase)
 		logDir:        "console",
 		disable:       true,
 	}
-	return server.Init(configEtcd{etcdAddrs, baseLoc}, args, initLogic, nil)
+	return server.Init(configEtcd{etcdAddrs: etcdAddrs, useBaseloc: baseLoc}, args, initLogic, nil)
 }
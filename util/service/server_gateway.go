@@ -0,0 +1,92 @@
+package rocserv
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
+	"google.golang.org/grpc"
+)
+
+// 网关 http 地址的注册名为 processor 名 + "_gateway"
+const gatewayListenName = "gateway"
+
+// GatewayRegisterFunc registers handlers of grpc-gateway which proxy to grpc endpoint, such as
+// pb.RegisterXxxHandlerFromEndpoint(ctx, mux, endpoint, opts); ctx is canceled when the processor stops
+type GatewayRegisterFunc func(ctx context.Context, endpoint string, opts []grpc.DialOption) error
+
+// GatewayServer processor driver serving Grpc on the processor address, and REST/JSON endpoints
+// mapped by grpc-gateway on HTTPAddr; both addresses are registered, the gateway one as
+// processor name + "_gateway" with type http. tls is not supported
+type GatewayServer struct {
+	Grpc *GrpcServer
+	// *runtime.ServeMux of grpc-gateway
+	Gateway http.Handler
+	// 为空时使用随机端口
+	HTTPAddr string
+	Register GatewayRegisterFunc
+}
+
+// NewGatewayServer create driver serving grpcServer, and gateway on httpAddr, register is called after grpc is listening
+func NewGatewayServer(grpcServer *GrpcServer, gateway http.Handler, httpAddr string, register GatewayRegisterFunc) *GatewayServer {
+	return &GatewayServer{
+		Grpc:     grpcServer,
+		Gateway:  gateway,
+		HTTPAddr: httpAddr,
+		Register: register,
+	}
+}
+
+// powerGateway 启动网关的 http 监听, endpoint 为 grpc 的注册地址, 网关请求同样经过 grpc 的拦截器
+func (dr *driverBuilder) powerGateway(ctx context.Context, n string, server *GatewayServer, endpoint string) (*ServInfo, processorStopper, error) {
+	fun := "driverBuilder.powerGateway -->"
+
+	var middlewares []middleware
+	disableContextCancel := dr.isDisableContextCancel(ctx)
+	logger().Infof(ctx, "%s disableContextCancel: %v, processor: %s", fun, disableContextCancel, n)
+	if disableContextCancel {
+		middlewares = append(middlewares, disableContextCancelMiddleware)
+	}
+
+	lis, laddr, err := listenServAddr(ctx, server.HTTPAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop, err := serveGateway(lis, laddr, server, endpoint, middlewares...)
+	if err != nil {
+		lis.Close()
+		return nil, nil, err
+	}
+	logger().Infof(ctx, "%s processor: %s gateway addr[%s] grpc endpoint[%s]", fun, n, laddr, endpoint)
+
+	servInfo := &ServInfo{
+		Type: PROCESSOR_HTTP,
+		Addr: laddr,
+	}
+	return servInfo, stop, nil
+}
+
+func serveGateway(lis net.Listener, laddr string, server *GatewayServer, endpoint string, middlewares ...middleware) (processorStopper, error) {
+	fun := "serveGateway -->"
+
+	// 网关到 grpc 的连接在停止时关闭
+	regCtx, cancel := context.WithCancel(context.Background())
+	if err := server.Register(regCtx, endpoint, []grpc.DialOption{grpc.WithInsecure()}); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	serv := &http.Server{Handler: decorateHttpMiddleware(server.Gateway, middlewares...)}
+	go func() {
+		err := serv.Serve(lis)
+		if err != nil && err != http.ErrServerClosed {
+			xlog.Panicf(context.Background(), "%s laddr[%s]", fun, laddr)
+		}
+	}()
+
+	return func(ctx context.Context) error {
+		defer cancel()
+		return serv.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,83 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestServeGateway(t *testing.T) {
+	ass := assert.New(t)
+
+	gs := &GrpcServer{Server: grpc.NewServer()}
+	grpc_health_v1.RegisterHealthServer(gs.Server, health.NewServer())
+	grpcLis, err := net.Listen("tcp", "127.0.0.1:0")
+	ass.Nil(err)
+	go gs.Server.Serve(grpcLis)
+	defer gs.Server.Stop()
+
+	// 与 grpc-gateway 生成的 RegisterXxxHandlerFromEndpoint 相同, 连接 endpoint 并转发
+	mux := http.NewServeMux()
+	var regCtx context.Context
+	register := func(ctx context.Context, endpoint string, opts []grpc.DialOption) error {
+		regCtx = ctx
+		conn, err := grpc.Dial(endpoint, opts...)
+		if err != nil {
+			return err
+		}
+		mux.HandleFunc("/v1/health", func(w http.ResponseWriter, r *http.Request) {
+			resp, err := grpc_health_v1.NewHealthClient(conn).Check(r.Context(), &grpc_health_v1.HealthCheckRequest{})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte(resp.Status.String()))
+		})
+		return nil
+	}
+
+	d := NewGatewayServer(gs, mux, "", register)
+	ass.Len(validateDriver(d), 0)
+	ass.Len(validateDriver(&GatewayServer{Grpc: gs, Gateway: mux}), 1)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	ass.Nil(err)
+	addr := lis.Addr().String()
+	stop, err := serveGateway(lis, addr, d, grpcLis.Addr().String())
+	ass.Nil(err)
+
+	resp, err := http.Get("http://" + addr + "/v1/health")
+	ass.Nil(err)
+	if err == nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		ass.Equal(http.StatusOK, resp.StatusCode)
+		ass.Equal("SERVING", string(body))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	ass.Nil(stop(ctx))
+	ass.NotNil(regCtx.Err())
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	ass.NotNil(err)
+
+	// 注册失败时不启动
+	d.Register = func(context.Context, string, []grpc.DialOption) error {
+		return errors.New("bad endpoint")
+	}
+	lis, err = net.Listen("tcp", "127.0.0.1:0")
+	ass.Nil(err)
+	defer lis.Close()
+	_, err = serveGateway(lis, lis.Addr().String(), d, grpcLis.Addr().String())
+	ass.NotNil(err)
+}
@@ -2,27 +2,33 @@ package rocserv
 
 import (
 	"context"
-	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
-	grpc_recovery "github.com/grpc-ecosystem/go-grpc-middleware/recovery"
-	"gitlab.pri.ibanyu.com/middleware/dolphin/rate_limit"
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
 	otgrpc "gitlab.pri.ibanyu.com/tracing/go-grpc"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 type GrpcServer struct {
 	userUnaryInterceptors  []grpc.UnaryServerInterceptor
 	extraUnaryInterceptors []grpc.UnaryServerInterceptor // 服务启动之前, 内部添加的拦截器, 在所有拦截器之后添加
 	Server                 *grpc.Server
+	conf                   *GrpcServerConf
+
+	// fullMethod -> *GrpcFallback
+	fallbacks sync.Map
+	// 非空时请求等待 lazy processor 初始化完成
+	lazy *lazyProcessor
+	// listen addr -> grpc.UnaryServerInterceptor, 只作用于该地址上的请求
+	listenInterceptors sync.Map
+	// 非 TLS 的监听地址, 转码 REST 请求时连接, 见 TranscodeGrpc
+	servedAddr atomic.Value
 }
 
 type FunInterceptor func(ctx context.Context, req interface{}, fun string) error
@@ -60,7 +66,7 @@ func NewGrpcServer(fns ...FunInterceptor) *GrpcServer {
 //		st := xtime.NewTimeStat()
 //		defer func() {
 //			dur := st.Duration()
-//			xlog.Infof(ctx, "monitor example, func: %s, req: %v, ctx: %v, duration: %v", info.FullMethod, req, ctx, dur)
+//			logger().Infof(ctx, "monitor example, func: %s, req: %v, ctx: %v, duration: %v", info.FullMethod, req, ctx, dur)
 //		}()
 //
 //		// gRPC接口调用 (固定写法)
@@ -69,7 +75,7 @@ func NewGrpcServer(fns ...FunInterceptor) *GrpcServer {
 //		// 这里添加接口调用后的拦截器处理逻辑
 //		// e.g. 接口调用出错时打error日志
 //		if err != nil {
-//			xlog.Warnf(ctx, "call grpc error, func: %s, req: %v, err: %v", info.FullMethod, req, err)
+//			logger().Warnf(ctx, "call grpc error, func: %s, req: %v, err: %v", info.FullMethod, req, err)
 //		}
 //
 //		return ret, err
@@ -80,10 +86,19 @@ func NewGrpcServer(fns ...FunInterceptor) *GrpcServer {
 //	return "", serv
 //}
 func NewGrpcServerWithUnaryInterceptors(interceptors ...UnaryServerInterceptor) *GrpcServer {
+	return NewGrpcServerWithConf(&GrpcServerConf{}, interceptors...)
+}
+
+// NewGrpcServerWithConf 创建GrpcServer, 使用 conf 中的流控及并发配置, 其他同 NewGrpcServerWithUnaryInterceptors
+func NewGrpcServerWithConf(conf *GrpcServerConf, interceptors ...UnaryServerInterceptor) *GrpcServer {
 	userUnaryInterceptors := convertUnaryInterceptors(interceptors...)
+	if conf == nil {
+		conf = &GrpcServerConf{}
+	}
 
 	gserv := &GrpcServer{
 		userUnaryInterceptors: userUnaryInterceptors,
+		conf:                  conf,
 	}
 
 	// gRPC注册服务是在服务模板代码中的, 所以只能在NewServer时添加拦截器, 才能保证模板代码不需要调整
@@ -104,7 +119,7 @@ func (g *GrpcServer) addExtraContextCancelInterceptor() {
 
 	dr := newDriverBuilder(GetConfigCenter())
 	disableContextCancel := dr.isDisableContextCancel(ctx)
-	xlog.Infof(ctx, "%s disableContextCancel: %v", f, disableContextCancel)
+	logger().Infof(ctx, "%s disableContextCancel: %v", f, disableContextCancel)
 	if disableContextCancel {
 		contextCancelInterceptor := newDisableContextCancelGrpcUnaryInterceptor()
 		g.internalAddExtraInterceptors(contextCancelInterceptor)
@@ -120,19 +135,44 @@ func (g *GrpcServer) buildServer() (*grpc.Server, error) {
 	var streamInterceptors []grpc.StreamServerInterceptor
 
 	// add tracer、monitor、recovery interceptor
-	recoveryOpts := []grpc_recovery.Option{
-		grpc_recovery.WithRecoveryHandler(recoveryFunc),
+	// 每层的耗时见 timedUnaryInterceptors
+	layers := []grpcLayer{
+		{"rate_limit", rateLimitInterceptor()},
+		{"load_shed", loadShedInterceptor()},
+		{"listen_addr", g.listenAddrInterceptor()},
+		{"lazy", g.lazyInterceptor()},
+		{"trace_context", traceContextServerInterceptor()},
+		{"opentracing", otgrpc.OpenTracingServerInterceptorWithGlobalTracer()},
+		{"baggage", baggageServerInterceptor()},
+		{"otel", otelServerInterceptor()},
+		{"access_log", accessLogServerInterceptor()},
+		{"rpc_metric", rpcMetricServerInterceptor()},
+		{"monitor", monitorServerInterceptor()},
+		{"cost", costServerInterceptor()},
+		{"request_stat", requestStatServerInterceptor()},
+		{"caller_stat", callerStatServerInterceptor()},
+		{"deprecation", deprecationServerInterceptor()},
+		{"payload_log", payloadLogServerInterceptor()},
+		{"chain", chainUnaryServerInterceptor()},
+		{"fallback", g.fallbackInterceptor()},
+		{"recovery", recoveryUnaryServerInterceptor()},
 	}
-	unaryInterceptors = append(unaryInterceptors, rateLimitInterceptor(), otgrpc.OpenTracingServerInterceptorWithGlobalTracer(), monitorServerInterceptor(), grpc_recovery.UnaryServerInterceptor(recoveryOpts...))
-	userUnaryInterceptors := g.userUnaryInterceptors
-	unaryInterceptors = append(unaryInterceptors, userUnaryInterceptors...)
-	unaryInterceptors = append(unaryInterceptors, g.extraUnaryInterceptors...)
+	// 业务及内部添加的拦截器作为一层
+	if appInterceptors := append(append([]grpc.UnaryServerInterceptor(nil), g.userUnaryInterceptors...), g.extraUnaryInterceptors...); len(appInterceptors) > 0 {
+		layers = append(layers, grpcLayer{"app", grpc_middleware.ChainUnaryServer(appInterceptors...)})
+	}
+	unaryInterceptors = timedUnaryInterceptors(layers)
 
-	streamInterceptors = append(streamInterceptors, rateLimitStreamServerInterceptor(), otgrpc.OpenTracingStreamServerInterceptorWithGlobalTracer(), monitorStreamServerInterceptor(), grpc_recovery.StreamServerInterceptor(recoveryOpts...))
+	streamInterceptors = append(streamInterceptors, rateLimitStreamServerInterceptor(), loadShedStreamServerInterceptor(), g.lazyStreamInterceptor(), traceContextStreamServerInterceptor(), otgrpc.OpenTracingStreamServerInterceptorWithGlobalTracer(), baggageStreamServerInterceptor(), otelStreamServerInterceptor(), accessLogStreamServerInterceptor(), rpcMetricStreamServerInterceptor(), monitorStreamServerInterceptor(), requestStatStreamServerInterceptor(), sendStallStreamServerInterceptor(g.conf.sendStallThreshold()), chainStreamServerInterceptor(), recoveryStreamServerInterceptor())
 
 	var opts []grpc.ServerOption
 	opts = append(opts, grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)))
 	opts = append(opts, grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)))
+	opts = append(opts, grpc.StatsHandler(&flowStatsHandler{}))
+	opts = append(opts, grpc.Creds(listenerCreds{}))
+	if g.conf != nil {
+		opts = append(opts, g.conf.serverOptions()...)
+	}
 
 	// 实例化grpc Server
 	server := grpc.NewServer(opts...)
@@ -170,13 +210,8 @@ func rateLimitInterceptor() grpc.UnaryServerInterceptor {
 		parts := strings.Split(info.FullMethod, "/")
 		interfaceName := parts[len(parts)-1]
 
-		// 暂时不支持按照调用方限流
-		caller := UNSPECIFIED_CALLER
-		err = rateLimitRegistry.InterfaceRateLimit(ctx, interfaceName, caller)
+		err = interfaceRateLimit(ctx, interfaceName)
 		if err != nil {
-			if err == rate_limit.ErrRateLimited {
-				xlog.Warnf(ctx, "rate limited: method=%s, caller=%s", info.FullMethod, caller)
-			}
 			return nil, err
 		} else {
 			return handler(ctx, req)
@@ -190,9 +225,11 @@ func monitorServerInterceptor() grpc.UnaryServerInterceptor {
 		group, service := GetGroupAndService()
 		fun := info.FullMethod
 		_metricAPIRequestCount.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelAPI, fun).Inc()
+		incInFlight()
+		defer decInFlight()
 		st := xtime.NewTimeStat()
 		resp, err = handler(ctx, req)
-		xlog.Infow(ctx, "", "func", fun, "req", req, "err", err, "cost", st.Millisecond())
+		logger().Infow(ctx, "", "func", fun, "req", req, "err", err, "cost", st.Millisecond())
 		_metricAPIRequestTime.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelAPI, fun).Observe(float64(st.Millisecond()))
 		return resp, err
 	}
@@ -205,16 +242,11 @@ func rateLimitStreamServerInterceptor() grpc.StreamServerInterceptor {
 		parts := strings.Split(info.FullMethod, "/")
 		interfaceName := parts[len(parts)-1]
 
-		// 暂时不支持按照调用方限流
-		caller := UNSPECIFIED_CALLER
-		err := rateLimitRegistry.InterfaceRateLimit(ctx, interfaceName, caller)
+		err := interfaceRateLimit(ctx, interfaceName)
 		if err != nil {
-			if err == rate_limit.ErrRateLimited {
-				xlog.Warnf(ctx, "rate limited: method=%s, caller=%s", info.FullMethod, caller)
-			}
 			return err
 		} else {
-			return handler(ctx, ss)
+			return handler(srv, ss)
 		}
 	}
 }
@@ -225,19 +257,13 @@ func monitorStreamServerInterceptor() grpc.StreamServerInterceptor {
 		fun := info.FullMethod
 		group, service := GetGroupAndService()
 		_metricAPIRequestCount.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelAPI, fun).Inc()
+		incInFlight()
+		defer decInFlight()
 		st := xtime.NewTimeStat()
 		err := handler(srv, ss)
-		xlog.Infow(ss.Context(), "", "func", fun, "req", srv, "err", err, "cost", st.Millisecond())
+		logger().Infow(ss.Context(), "", "func", fun, "req", srv, "err", err, "cost", st.Millisecond())
 		_metricAPIRequestTime.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelAPI, fun).Observe(float64(st.Millisecond()))
 		return err
 	}
 }
 
-func recoveryFunc(p interface{}) (err error) {
-	ctx := context.Background()
-	const size = 4096
-	buf := make([]byte, size)
-	buf = buf[:runtime.Stack(buf, false)]
-	xlog.Errorf(ctx, "%v catch panic, stack: %s", p, string(buf))
-	return status.Errorf(codes.Internal, "panic triggered: %v", p)
-}
@@ -2,8 +2,7 @@ package rocserv
 
 import (
 	"fmt"
-	"net/http/httputil"
-	"runtime"
+	"net/http"
 	"strings"
 	"time"
 
@@ -26,6 +25,15 @@ const (
 // HttpServer is the http server, Create an instance of GinServer, by using NewGinServer()
 type HttpServer struct {
 	*gin.Engine
+
+	fallbacks *routeFallbacks
+	// 可按路由配置跳过的中间件
+	named []*namedMiddleware
+	// 已注册的路由及注册时发现的问题, 启动时校验
+	routes []registeredRoute
+	issues []string
+	// google.api.http 注解的转码路由, 见 TranscodeGrpc
+	transcoder *grpcTranscoder
 }
 
 // Context warp gin Context
@@ -42,17 +50,21 @@ func NewHttpServer() *HttpServer {
 	router := gin.New()
 	router.Use(Recovery(), Metric(), Trace())
 
-	return &HttpServer{router}
+	return &HttpServer{Engine: router, fallbacks: &routeFallbacks{}}
 }
 
 // Use attachs a global middleware to the router
 func (s *HttpServer) Use(middleware ...HandlerFunc) {
+	s.checkUseOrder("Use")
 	s.Engine.Use(mutilWrap(middleware...)...)
 }
 
 // GET is a shortcut for router.Handle("GET", path, handle).
 func (s *HttpServer) GET(relativePath string, handlers ...HandlerFunc) {
-	ws := append([]gin.HandlerFunc{pathHook(relativePath)}, mutilWrap(handlers...)...)
+	if !s.addRoute(relativePath, http.MethodGet) {
+		return
+	}
+	ws := s.routeHandlers(relativePath, handlers...)
 	s.Engine.GET(relativePath, ws...)
 }
 
@@ -63,7 +75,10 @@ func (s *HttpServer) WGET(relativePath string, handlers ...httprouter.Handle) {
 
 // POST is a shortcut for router.Handle("POST", path, handle).
 func (s *HttpServer) POST(relativePath string, handlers ...HandlerFunc) {
-	ws := append([]gin.HandlerFunc{pathHook(relativePath)}, mutilWrap(handlers...)...)
+	if !s.addRoute(relativePath, http.MethodPost) {
+		return
+	}
+	ws := s.routeHandlers(relativePath, handlers...)
 	s.Engine.POST(relativePath, ws...)
 }
 
@@ -74,7 +89,10 @@ func (s *HttpServer) WPOST(relativePath string, handlers ...httprouter.Handle) {
 
 // PUT is a shortcut for router.Handle("PUT", path, handle).
 func (s *HttpServer) PUT(relativePath string, handlers ...HandlerFunc) {
-	ws := append([]gin.HandlerFunc{pathHook(relativePath)}, mutilWrap(handlers...)...)
+	if !s.addRoute(relativePath, http.MethodPut) {
+		return
+	}
+	ws := s.routeHandlers(relativePath, handlers...)
 	s.Engine.PUT(relativePath, ws...)
 }
 
@@ -85,7 +103,10 @@ func (s *HttpServer) WPUT(relativePath string, handlers ...httprouter.Handle) {
 
 // Any registers a route that matches all the HTTP methods.
 func (s *HttpServer) Any(relativePath string, handlers ...HandlerFunc) {
-	ws := append([]gin.HandlerFunc{pathHook(relativePath)}, mutilWrap(handlers...)...)
+	if !s.addRoute(relativePath, anyMethods...) {
+		return
+	}
+	ws := s.routeHandlers(relativePath, handlers...)
 	s.Engine.Any(relativePath, ws...)
 }
 
@@ -96,7 +117,10 @@ func (s *HttpServer) WAny(relativePath string, handlers ...httprouter.Handle) {
 
 // DELETE is a shortcut for router.Handle("DELETE", path, handle).
 func (s *HttpServer) DELETE(relativePath string, handlers ...HandlerFunc) {
-	ws := append([]gin.HandlerFunc{pathHook(relativePath)}, mutilWrap(handlers...)...)
+	if !s.addRoute(relativePath, http.MethodDelete) {
+		return
+	}
+	ws := s.routeHandlers(relativePath, handlers...)
 	s.Engine.DELETE(relativePath, ws...)
 }
 
@@ -107,7 +131,10 @@ func (s *HttpServer) WDELETE(relativePath string, handlers ...httprouter.Handle)
 
 // PATCH is a shortcut for router.Handle("PATCH", path, handle).
 func (s *HttpServer) PATCH(relativePath string, handlers ...HandlerFunc) {
-	ws := append([]gin.HandlerFunc{pathHook(relativePath)}, mutilWrap(handlers...)...)
+	if !s.addRoute(relativePath, http.MethodPatch) {
+		return
+	}
+	ws := s.routeHandlers(relativePath, handlers...)
 	s.Engine.PATCH(relativePath, ws...)
 }
 
@@ -118,7 +145,10 @@ func (s *HttpServer) WPATCH(relativePath string, handlers ...httprouter.Handle)
 
 // OPTIONS is a shortcut for router.Handle("OPTIONS", path, handle).
 func (s *HttpServer) OPTIONS(relativePath string, handlers ...HandlerFunc) {
-	ws := append([]gin.HandlerFunc{pathHook(relativePath)}, mutilWrap(handlers...)...)
+	if !s.addRoute(relativePath, http.MethodOptions) {
+		return
+	}
+	ws := s.routeHandlers(relativePath, handlers...)
 	s.Engine.OPTIONS(relativePath, ws...)
 }
 
@@ -129,7 +159,10 @@ func (s *HttpServer) WOPTIONS(relativePath string, handlers ...httprouter.Handle
 
 // HEAD is a shortcut for router.Handle("HEAD", path, handle).
 func (s *HttpServer) HEAD(relativePath string, handlers ...HandlerFunc) {
-	ws := append([]gin.HandlerFunc{pathHook(relativePath)}, mutilWrap(handlers...)...)
+	if !s.addRoute(relativePath, http.MethodHead) {
+		return
+	}
+	ws := s.routeHandlers(relativePath, handlers...)
 	s.Engine.HEAD(relativePath, ws...)
 }
 
@@ -183,16 +216,12 @@ func Trace() gin.HandlerFunc {
 func Recovery() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		defer func() {
-			var rawReq []byte
 			if err := recover(); err != nil {
-				const size = 64 << 10
-				buf := make([]byte, size)
-				buf = buf[:runtime.Stack(buf, false)]
-				if c.Request != nil {
-					rawReq, _ = httputil.DumpRequest(c.Request, false)
+				method := c.Request.URL.Path
+				if path, ok := c.Get(RoutePath); ok {
+					method = fmt.Sprint(path)
 				}
-				pl := fmt.Sprintf("http call panic: %s\n%v\n%s\n", string(rawReq), err, buf)
-				fmt.Println(pl)
+				reportCrash(c.Request.Context(), PROCESSOR_HTTP, method, err, httpCrashRequest(c.Request))
 				c.AbortWithStatus(500)
 			}
 		}()
@@ -204,6 +233,7 @@ func pathHook(relativePath string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		values := strings.Split(relativePath, WildCharacter)
 		c.Set(RoutePath, values[0])
+		applyRouteCachePolicy(c, relativePath)
 	}
 }
 
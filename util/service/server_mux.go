@@ -0,0 +1,226 @@
+package rocserv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
+	"google.golang.org/grpc"
+)
+
+// 客户端连接后发送首个请求的超时时间, 超时关闭连接
+const muxSniffTimeout = 10 * time.Second
+
+var (
+	errMuxListenerClosed = errors.New("mux listener closed")
+	http2Preface         = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+)
+
+// MuxServer processor driver serving grpc and http on one port, connections starting with
+// http2 connection preface are served by Grpc, others by HTTP as http/1.x; so http handlers
+// can not be reached with h2c, and tls is not supported
+type MuxServer struct {
+	Grpc *GrpcServer
+	// *gin.Engine, *HttpServer or other http handlers
+	HTTP http.Handler
+}
+
+// NewMuxServer create driver serving grpcServer and httpHandler on the same port
+func NewMuxServer(grpcServer *GrpcServer, httpHandler http.Handler) *MuxServer {
+	return &MuxServer{Grpc: grpcServer, HTTP: httpHandler}
+}
+
+// powerMux 启动同一端口的 grpc 及 http, 并返回端口信息
+func powerMux(addr string, server *MuxServer, interceptors []grpc.UnaryServerInterceptor, middlewares ...middleware) (string, processorStopper, error) {
+	fun := "powerMux -->"
+	ctx := context.Background()
+
+	lis, laddr, err := listenServAddr(ctx, addr)
+	if err != nil {
+		return "", nil, err
+	}
+	logger().Infof(ctx, "%s listen grpc and http addr[%s]", fun, laddr)
+	return laddr, serveMux(lis, laddr, server, interceptors, middlewares...), nil
+}
+
+func serveMux(lis net.Listener, laddr string, server *MuxServer, interceptors []grpc.UnaryServerInterceptor, middlewares ...middleware) processorStopper {
+	fun := "serveMux -->"
+	ctx := context.Background()
+
+	if len(interceptors) > 0 {
+		server.Grpc.addListenInterceptors(lis.Addr(), interceptors)
+	}
+	if server.Grpc.conf != nil {
+		lis = newLimitListener(lis, server.Grpc.conf.MaxConnections)
+	}
+
+	server.Grpc.setPlainAddr(laddr)
+	mux := newConnMux(lis)
+	httpServ := &http.Server{Handler: decorateHttpMiddleware(server.HTTP, middlewares...)}
+	go func() {
+		if err := server.Grpc.Server.Serve(mux.grpc); err != nil {
+			xlog.Panicf(ctx, "%s grpc laddr[%s]", fun, laddr)
+		}
+	}()
+	go func() {
+		err := httpServ.Serve(mux.http)
+		if err != nil && err != http.ErrServerClosed {
+			xlog.Panicf(ctx, "%s http laddr[%s]", fun, laddr)
+		}
+	}()
+	go mux.serve()
+
+	return func(ctx context.Context) error {
+		// http 及 grpc 分别等待处理中的请求结束
+		var wg sync.WaitGroup
+		var httpErr error
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			httpErr = httpServ.Shutdown(ctx)
+		}()
+		grpcErr := grpcStopper(server.Grpc.Server)(ctx)
+		wg.Wait()
+		mux.close()
+		if grpcErr != nil {
+			return grpcErr
+		}
+		return httpErr
+	}
+}
+
+// connMux 按连接的首部字节分发到 grpc 或 http 的 listener
+type connMux struct {
+	root net.Listener
+	grpc *muxListener
+	http *muxListener
+}
+
+func newConnMux(root net.Listener) *connMux {
+	return &connMux{
+		root: root,
+		grpc: newMuxListener(root.Addr()),
+		http: newMuxListener(root.Addr()),
+	}
+}
+
+func (m *connMux) serve() {
+	fun := "connMux.serve -->"
+	for {
+		c, err := m.root.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			logger().Infof(context.Background(), "%s addr: %s accept err: %v", fun, m.root.Addr(), err)
+			m.close()
+			return
+		}
+		go m.dispatch(c)
+	}
+}
+
+func (m *connMux) dispatch(c net.Conn) {
+	isGrpc, buf, err := sniffHTTP2(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+	l := m.http
+	if isGrpc {
+		l = m.grpc
+	}
+	l.push(&sniffedConn{Conn: c, buf: buf})
+}
+
+func (m *connMux) close() {
+	m.root.Close()
+	m.grpc.Close()
+	m.http.Close()
+}
+
+// sniffHTTP2 读取到与 http2 preface 不一致或者完整读取 preface, 返回已读取的字节
+func sniffHTTP2(c net.Conn) (bool, []byte, error) {
+	c.SetReadDeadline(time.Now().Add(muxSniffTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, len(http2Preface))
+	n := 0
+	for n < len(buf) {
+		k, err := c.Read(buf[n:])
+		n += k
+		if !bytes.HasPrefix(http2Preface, buf[:n]) {
+			return false, buf[:n], nil
+		}
+		if err != nil {
+			// 连接关闭前发送的数据交给 http 处理
+			if err == io.EOF && n > 0 {
+				return false, buf[:n], nil
+			}
+			return false, nil, err
+		}
+	}
+	return true, buf, nil
+}
+
+// sniffedConn 先返回分发时读取的字节
+type sniffedConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (m *sniffedConn) Read(p []byte) (int, error) {
+	if len(m.buf) > 0 {
+		n := copy(p, m.buf)
+		m.buf = m.buf[n:]
+		return n, nil
+	}
+	return m.Conn.Read(p)
+}
+
+// muxListener grpc 及 http server 使用的 listener, 关闭后丢弃分发的连接
+type muxListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newMuxListener(addr net.Addr) *muxListener {
+	return &muxListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (m *muxListener) push(c net.Conn) {
+	select {
+	case m.conns <- c:
+	case <-m.done:
+		c.Close()
+	}
+}
+
+func (m *muxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-m.conns:
+		return c, nil
+	case <-m.done:
+		return nil, errMuxListenerClosed
+	}
+}
+
+func (m *muxListener) Close() error {
+	m.once.Do(func() {
+		close(m.done)
+	})
+	return nil
+}
+
+func (m *muxListener) Addr() net.Addr {
+	return m.addr
+}
@@ -0,0 +1,88 @@
+package rocserv
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestPowerMux(t *testing.T) {
+	ass := assert.New(t)
+
+	gs := &GrpcServer{Server: grpc.NewServer()}
+	grpc_health_v1.RegisterHealthServer(gs.Server, health.NewServer())
+	engine := gin.New()
+	engine.GET("/ping", func(c *gin.Context) {
+		c.String(http.StatusOK, "pong")
+	})
+	ass.Len(validateDriver(NewMuxServer(gs, engine)), 0)
+	ass.Len(validateDriver(&MuxServer{Grpc: gs}), 1)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	ass.Nil(err)
+	addr := lis.Addr().String()
+	stop := serveMux(lis, addr, NewMuxServer(gs, engine), nil)
+
+	resp, err := http.Get("http://" + addr + "/ping")
+	ass.Nil(err)
+	if err == nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		ass.Equal("pong", string(body))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock())
+	ass.Nil(err)
+	if err == nil {
+		_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		ass.Nil(err)
+		conn.Close()
+	}
+
+	// 未发送数据即关闭的连接不影响服务
+	c, err := net.Dial("tcp", addr)
+	ass.Nil(err)
+	c.Close()
+
+	ass.Nil(stop(ctx))
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	ass.NotNil(err)
+}
+
+func TestSniffHTTP2(t *testing.T) {
+	ass := assert.New(t)
+
+	for _, c := range []struct {
+		data   string
+		isGrpc bool
+	}{
+		{string(http2Preface) + "frames", true},
+		{"GET /ping HTTP/1.1\r\n\r\n", false},
+		{"PRI * HTTP/1.1\r\n\r\n", false},
+		{"P", false},
+	} {
+		server, client := net.Pipe()
+		go func() {
+			client.Write([]byte(c.data))
+			client.Close()
+		}()
+		isGrpc, buf, err := sniffHTTP2(server)
+		ass.Nil(err)
+		ass.Equal(c.isGrpc, isGrpc)
+
+		// 读取的字节不丢失
+		all, _ := ioutil.ReadAll(&sniffedConn{Conn: server, buf: buf})
+		ass.Equal(c.data, string(all))
+	}
+}
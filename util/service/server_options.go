@@ -0,0 +1,208 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Option option of ServeWithOptions
+type Option func(*serveOptions)
+
+type serveOptions struct {
+	confEtcd configEtcd
+	args     cmdArgs
+	initfn   func(ServBase) error
+	procs    map[string]Processor
+}
+
+// WithServName set service location such as base/account, same as flag -serv
+func WithServName(servLoc string) Option {
+	return func(o *serveOptions) {
+		o.args.servLoc = servLoc
+	}
+}
+
+// WithSessKey set service session key, same as flag -sesskey
+func WithSessKey(skey string) Option {
+	return func(o *serveOptions) {
+		o.args.sessKey = skey
+	}
+}
+
+// WithGroup set lane group of service, same as flag -group
+func WithGroup(group string) Option {
+	return func(o *serveOptions) {
+		o.args.group = group
+	}
+}
+
+// WithLogDir set log dir, console means stdout, same as flag -logdir
+func WithLogDir(logDir string) Option {
+	return func(o *serveOptions) {
+		o.args.logDir = logDir
+	}
+}
+
+// WithLogRotate set max size in megabytes and max backups of log file
+func WithLogRotate(maxSize, maxBackups int) Option {
+	return func(o *serveOptions) {
+		o.args.logMaxSize = maxSize
+		o.args.logMaxBackups = maxBackups
+	}
+}
+
+// WithSidOffset set service id offset for different data center, same as flag -sidoffset
+func WithSidOffset(offset int) Option {
+	return func(o *serveOptions) {
+		o.args.sidOffset = offset
+	}
+}
+
+// WithEtcd set etcd addrs and base location of registry
+func WithEtcd(addrs []string, baseLoc string) Option {
+	return func(o *serveOptions) {
+		o.confEtcd = configEtcd{etcdAddrs: addrs, useBaseloc: baseLoc}
+	}
+}
+
+// WithProcessors set processors served, processors with the same name are replaced
+func WithProcessors(procs map[string]Processor) Option {
+	return func(o *serveOptions) {
+		for name, p := range procs {
+			o.procs[name] = p
+		}
+	}
+}
+
+// WithInitLogic set init func of application, called before processors start
+func WithInitLogic(initfn func(ServBase) error) Option {
+	return func(o *serveOptions) {
+		o.initfn = initfn
+	}
+}
+
+// WithDisableRegistration do not register service into registry, same as flag -stype local
+func WithDisableRegistration() Option {
+	return func(o *serveOptions) {
+		o.args.startType = START_TYPE_LOCAL
+	}
+}
+
+// WithMasterSlave start in Leader-Follower model, same as MasterSlave
+func WithMasterSlave() Option {
+	return func(o *serveOptions) {
+		o.args.model = MODEL_MASTERSLAVE
+	}
+}
+
+// WithSupervisor run under process supervisor, see RunUnderSupervisor
+func WithSupervisor(conf SupervisorConf) Option {
+	return func(o *serveOptions) {
+		o.args.supervisor = &conf
+	}
+}
+
+// WithServiceIdentity enable service identity, processors with TLSConf.Identity serve mTLS
+// and clients verify that peers are the services they dial
+func WithServiceIdentity(conf IdentityConf) Option {
+	return func(o *serveOptions) {
+		o.args.identity = &conf
+	}
+}
+
+// WithAppLogger use l as logger of the framework, see SetAppLogger
+func WithAppLogger(l AppLogger) Option {
+	return func(o *serveOptions) {
+		SetAppLogger(l)
+	}
+}
+
+// WithEtcdRuntimeSettings keep runtime settings set by backdoor in etcd instead of log dir,
+// so they survive when the instance is rescheduled to another host with the same sess key
+func WithEtcdRuntimeSettings() Option {
+	return func(o *serveOptions) {
+		o.args.settingsInEtcd = true
+	}
+}
+
+// WithOpenTelemetry export spans to OTLP endpoint and accept W3C and B3 trace headers,
+// without it OpenTelemetry is enabled by env OTEL_EXPORTER_OTLP_ENDPOINT
+func WithOpenTelemetry(conf OTelConf) Option {
+	return func(o *serveOptions) {
+		o.args.otel = &conf
+	}
+}
+
+// WithStrictValidation fail startup when duplicate or conflicting routes, middlewares added after routes
+// or processors without handlers are found, they are only warned without it, same as env ROC_STRICT_VALIDATION=1
+func WithStrictValidation() Option {
+	return func(o *serveOptions) {
+		o.args.strictValidation = true
+	}
+}
+
+// WithTopologySnapshot let one instance of the service maintain a compressed and delta encoded topology snapshot in etcd,
+// clients read it instead of every instance node, suitable for services with thousands of instances
+func WithTopologySnapshot() Option {
+	return func(o *serveOptions) {
+		o.args.topologySnapshot = true
+	}
+}
+
+// WithDegradedStart start serving on processor addresses without registration when etcd is unavailable
+// at startup, instead of failing; servid is -1 until it is got from etcd in background, then the instance
+// registers itself. Set fixed addresses for processors so callers can reach it unregistered. Degraded state
+// is reported by IsDegraded, /backdoor/health/check and metric registration_pending; same as env ROC_DEGRADED_START=1
+func WithDegradedStart() Option {
+	return func(o *serveOptions) {
+		o.args.degradedStart = true
+	}
+}
+
+// WithPreStopDelay time to wait on SIGTERM after registry nodes are removed, so clients stop routing to
+// the instance before its processors are stopped; default is env ROC_PRE_STOP_DELAY, no delay if it is unset
+func WithPreStopDelay(d time.Duration) Option {
+	return func(o *serveOptions) {
+		o.args.preStopDelay = &d
+	}
+}
+
+func newServeOptions(opts ...Option) (*serveOptions, error) {
+	o := &serveOptions{
+		args: cmdArgs{
+			crossRegionIdList: GetenvCompat(crossRegionIdListEnv, deprecatedCrossRegionIdListEnv),
+			region:            getRegionFromEnvOrDefault(),
+			zone:              getZoneFromEnv(),
+		},
+		initfn: func(ServBase) error { return nil },
+		procs:  make(map[string]Processor),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if len(o.args.servLoc) == 0 {
+		return nil, fmt.Errorf("serv name need")
+	}
+	if len(o.args.sessKey) == 0 {
+		return nil, fmt.Errorf("sess key need")
+	}
+	if len(o.confEtcd.etcdAddrs) == 0 {
+		return nil, fmt.Errorf("etcd addrs need")
+	}
+	return o, nil
+}
+
+// ServeWithOptions start server configured by options instead of command line flags,
+// flag.Parse is not called so the service can be embedded into other programs
+func ServeWithOptions(opts ...Option) error {
+	fun := "ServeWithOptions -->"
+
+	o, err := newServeOptions(opts...)
+	if err != nil {
+		logger().Errorf(context.Background(), "%s options err: %v", fun, err)
+		return err
+	}
+	return server.Init(o.confEtcd, &o.args, o.initfn, o.procs)
+}
@@ -0,0 +1,29 @@
+package rocserv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewServeOptions(t *testing.T) {
+	ass := assert.New(t)
+
+	_, err := newServeOptions(WithServName("base/account"))
+	ass.Error(err)
+
+	o, err := newServeOptions(
+		WithServName("base/account"),
+		WithSessKey("key"),
+		WithGroup("lane1"),
+		WithEtcd([]string{"http://127.0.0.1:2379"}, "/roc"),
+		WithProcessors(map[string]Processor{"proc_grpc": nil}),
+		WithDisableRegistration(),
+	)
+	ass.NoError(err)
+	ass.Equal("lane1", o.args.group)
+	ass.Equal(START_TYPE_LOCAL, o.args.startType)
+	ass.Equal("/roc", o.confEtcd.useBaseloc)
+	ass.Len(o.procs, 1)
+	ass.NotNil(o.initfn)
+}
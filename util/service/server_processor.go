@@ -0,0 +1,139 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 摘除注册后等待调用方感知的时间, 之后再停止监听
+const removeProcessorDelay = 5 * time.Second
+
+func (m *Server) addRunningProcessor(name string, p *runningProcessor) {
+	m.muProcs.Lock()
+	defer m.muProcs.Unlock()
+	if m.procs == nil {
+		m.procs = make(map[string]*runningProcessor)
+	}
+	m.procs[name] = p
+}
+
+// servInfos 注册到 etcd 的 processor, 不含 backdoor 等内部 processor
+func (m *Server) servInfos() map[string]*ServInfo {
+	m.muProcs.Lock()
+	defer m.muProcs.Unlock()
+
+	infos := make(map[string]*ServInfo, len(m.procs))
+	for name, p := range m.procs {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		infos[name] = p.info
+		for n, info := range p.extras {
+			infos[n] = info
+		}
+	}
+	return infos
+}
+
+func (m *Server) updateRegistration() error {
+	sb, ok := m.sbase.(*ServBaseV2)
+	if !ok {
+		return fmt.Errorf("server not init")
+	}
+	// 本地启动不注册至etcd
+	if sb.IsLocalRunning() {
+		return nil
+	}
+	return sb.UpdateService(m.servInfos())
+}
+
+// AddProcessor start processor at runtime and register it, name rules are same as processors of Serve
+func (m *Server) AddProcessor(name string, p Processor) error {
+	fun := "Server.AddProcessor -->"
+	ctx := context.Background()
+
+	if m.sbase == nil {
+		return fmt.Errorf("server not init")
+	}
+	if len(name) == 0 || name[0] == '_' {
+		return fmt.Errorf("processor name: %s invalid", name)
+	}
+	if p == nil {
+		return fmt.Errorf("processor: %s is nil", name)
+	}
+	m.muProcs.Lock()
+	_, ok := m.procs[name]
+	m.muProcs.Unlock()
+	if ok {
+		return fmt.Errorf("processor: %s already exists", name)
+	}
+
+	if err := p.Init(); err != nil {
+		logger().Errorf(ctx, "%s processor: %s init err: %v", fun, name, err)
+		return fmt.Errorf("processor:%s init err:%s", name, err)
+	}
+	infos, err := m.loadDriver(map[string]Processor{name: p})
+	if err != nil {
+		logger().Errorf(ctx, "%s processor: %s load driver err: %v", fun, name, err)
+		return err
+	}
+	if len(infos) == 0 {
+		logger().Infof(ctx, "%s processor: %s no driver, skip register", fun, name)
+		return nil
+	}
+
+	if err := m.updateRegistration(); err != nil {
+		logger().Errorf(ctx, "%s processor: %s update registration err: %v", fun, name, err)
+		return err
+	}
+	logger().Infof(ctx, "%s processor: %s addr: %s added", fun, name, infos[name].Addr)
+	return nil
+}
+
+// RemoveProcessor deregister processor and stop its listener after callers are notified,
+// in-flight requests of http and grpc are waited until ctx done; a stopped grpc server can not be added again
+func (m *Server) RemoveProcessor(ctx context.Context, name string) error {
+	fun := "Server.RemoveProcessor -->"
+
+	if len(name) == 0 || name[0] == '_' {
+		return fmt.Errorf("processor name: %s invalid", name)
+	}
+	m.muProcs.Lock()
+	p, ok := m.procs[name]
+	delete(m.procs, name)
+	m.muProcs.Unlock()
+	if !ok {
+		return fmt.Errorf("processor: %s not found", name)
+	}
+
+	if err := m.updateRegistration(); err != nil {
+		logger().Errorf(ctx, "%s processor: %s update registration err: %v", fun, name, err)
+	}
+
+	select {
+	case <-time.After(removeProcessorDelay):
+	case <-ctx.Done():
+	}
+
+	if p.stop == nil {
+		return nil
+	}
+	if err := p.stop(ctx); err != nil {
+		logger().Errorf(ctx, "%s processor: %s stop err: %v", fun, name, err)
+		return err
+	}
+	logger().Infof(ctx, "%s processor: %s addr: %s removed", fun, name, p.info.Addr)
+	return nil
+}
+
+// AddProcessor start processor at runtime, see Server.AddProcessor
+func AddProcessor(name string, p Processor) error {
+	return server.AddProcessor(name, p)
+}
+
+// RemoveProcessor stop processor at runtime, see Server.RemoveProcessor
+func RemoveProcessor(ctx context.Context, name string) error {
+	return server.RemoveProcessor(ctx, name)
+}
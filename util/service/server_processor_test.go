@@ -0,0 +1,37 @@
+package rocserv
+
+import (
+	"context"
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+type testThriftProcessor struct{}
+
+func (m *testThriftProcessor) Init() error {
+	return nil
+}
+
+func (m *testThriftProcessor) Driver() (string, interface{}) {
+	return "127.0.0.1:0", thrift.NewTMultiplexedProcessor()
+}
+
+func TestAddRemoveProcessor(t *testing.T) {
+	ass := assert.New(t)
+
+	m := &Server{sbase: &ServBaseV2{isLocalRunning: true}}
+	ass.Error(m.AddProcessor("_proc", &testThriftProcessor{}))
+
+	ass.NoError(m.AddProcessor("proc_thrift", &testThriftProcessor{}))
+	ass.Error(m.AddProcessor("proc_thrift", &testThriftProcessor{}))
+	ass.Len(m.servInfos(), 1)
+
+	// 取消的 ctx 不等待调用方感知
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ass.NoError(m.RemoveProcessor(ctx, "proc_thrift"))
+	ass.Len(m.servInfos(), 0)
+	ass.Error(m.RemoveProcessor(ctx, "proc_thrift"))
+}
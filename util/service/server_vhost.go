@@ -0,0 +1,248 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
+
+	"github.com/gin-gonic/gin"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/acme"
+)
+
+// VirtualHost one host served by VirtualHostServer, Host can be exact "a.example.com" or wildcard "*.example.com"
+type VirtualHost struct {
+	Host string
+	// Handler can be *gin.Engine, *HttpServer, *httprouter.Router or any http.Handler
+	Handler interface{}
+
+	// 证书, Certificate 优先, 否则从 CertFile/KeyFile 加载; 都为空时该 host 不提供 TLS
+	Certificate *tls.Certificate
+	CertFile    string
+	KeyFile     string
+}
+
+// VirtualHostServer http processor driver serving several hosts on one listener,
+// certificates are selected by TLS SNI and requests are dispatched by Host header
+type VirtualHostServer struct {
+	mu           sync.RWMutex
+	hosts        map[string]http.Handler
+	certs        map[string]*tls.Certificate
+	defaultHost  string
+	hasTLSConfig bool
+
+	// 没有静态证书的 host 通过 acme 自动申请证书
+	acme *ACMECertManager
+}
+
+// NewVirtualHostServer create virtual host server, the first host is used when no host matches
+func NewVirtualHostServer(hosts ...*VirtualHost) (*VirtualHostServer, error) {
+	m := &VirtualHostServer{
+		hosts: make(map[string]http.Handler),
+		certs: make(map[string]*tls.Certificate),
+	}
+	for _, h := range hosts {
+		if err := m.AddHost(h); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// AddHost add or replace a virtual host
+func (m *VirtualHostServer) AddHost(vh *VirtualHost) error {
+	if vh == nil || len(vh.Host) == 0 {
+		return fmt.Errorf("virtual host empty")
+	}
+
+	handler, err := vhostHandler(vh.Handler)
+	if err != nil {
+		return fmt.Errorf("virtual host: %s %v", vh.Host, err)
+	}
+
+	cert := vh.Certificate
+	if cert == nil && len(vh.CertFile) > 0 {
+		c, err := tls.LoadX509KeyPair(vh.CertFile, vh.KeyFile)
+		if err != nil {
+			return fmt.Errorf("virtual host: %s load cert err: %v", vh.Host, err)
+		}
+		cert = &c
+	}
+
+	host := strings.ToLower(vh.Host)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.defaultHost) == 0 {
+		m.defaultHost = host
+	}
+	m.hosts[host] = handler
+	if cert != nil {
+		m.certs[host] = cert
+		m.hasTLSConfig = true
+	}
+	return nil
+}
+
+// SetACMECertManager certificates of hosts without static certificate are obtained by acme,
+// the manager replaced is closed, and the manager is closed when the processor stops
+func (m *VirtualHostServer) SetACMECertManager(mgr *ACMECertManager) {
+	m.mu.Lock()
+	old := m.acme
+	m.acme = mgr
+	if mgr != nil {
+		m.hasTLSConfig = true
+	}
+	m.mu.Unlock()
+
+	if old != nil && old != mgr {
+		old.Close()
+	}
+}
+
+// closeACME processor 停止时关闭 acme manager
+func (m *VirtualHostServer) closeACME() {
+	m.mu.RLock()
+	mgr := m.acme
+	m.mu.RUnlock()
+	if mgr != nil {
+		mgr.Close()
+	}
+}
+
+func vhostHandler(h interface{}) (http.Handler, error) {
+	switch d := h.(type) {
+	case *HttpServer:
+		return d.Engine, nil
+	case *gin.Engine:
+		return d, nil
+	case *httprouter.Router:
+		return d, nil
+	case http.Handler:
+		return d, nil
+	default:
+		return nil, fmt.Errorf("handler type: %T not support", h)
+	}
+}
+
+// match 精确匹配优先, 其次匹配 *.domain 通配
+func vhostMatch(host string, lookup func(string) bool) (string, bool) {
+	host = strings.ToLower(host)
+	if lookup(host) {
+		return host, true
+	}
+	if idx := strings.Index(host, "."); idx > 0 {
+		wildcard := "*" + host[idx:]
+		if lookup(wildcard) {
+			return wildcard, true
+		}
+	}
+	return "", false
+}
+
+func (m *VirtualHostServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	m.mu.RLock()
+	key, ok := vhostMatch(host, func(k string) bool {
+		_, ok := m.hosts[k]
+		return ok
+	})
+	if !ok {
+		key = m.defaultHost
+	}
+	handler := m.hosts[key]
+	m.mu.RUnlock()
+
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+func (m *VirtualHostServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	key, ok := vhostMatch(hello.ServerName, func(k string) bool {
+		_, ok := m.certs[k]
+		return ok
+	})
+	if ok {
+		cert := m.certs[key]
+		m.mu.RUnlock()
+		return cert, nil
+	}
+	mgr := m.acme
+	cert := m.certs[m.defaultHost]
+	m.mu.RUnlock()
+
+	if mgr != nil {
+		acmeCert, err := mgr.GetCertificate(hello)
+		if err == nil || cert == nil {
+			return acmeCert, err
+		}
+		// 域名不在 acme 列表或申请失败时使用默认 host 的证书
+		logger().Warnf(context.Background(), "VirtualHostServer.getCertificate --> server name: %s acme err: %v, use cert of default host: %s", hello.ServerName, err, m.defaultHost)
+		return cert, nil
+	}
+	if cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate for server name: %s", hello.ServerName)
+}
+
+func (m *VirtualHostServer) tlsConfig() *tls.Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if !m.hasTLSConfig {
+		return nil
+	}
+	cfg := &tls.Config{
+		GetCertificate: m.getCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+	if m.acme != nil {
+		cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+	}
+	return cfg
+}
+
+func powerVirtualHost(addr string, server *VirtualHostServer, middlewares ...middleware) (string, bool, processorStopper, error) {
+	fun := "powerVirtualHost -->"
+	ctx := context.Background()
+
+	netListen, laddr, err := listenServAddr(ctx, addr)
+	if err != nil {
+		return "", false, nil, err
+	}
+
+	tlsConfig := server.tlsConfig()
+	if tlsConfig != nil {
+		netListen = tls.NewListener(netListen, tlsConfig)
+	}
+
+	mw := decorateHttpMiddleware(server, middlewares...)
+
+	serv := &http.Server{Handler: mw}
+	go func() {
+		err := serv.Serve(netListen)
+		if err != nil && err != http.ErrServerClosed {
+			xlog.Panicf(ctx, "%s laddr[%s]", fun, laddr)
+		}
+	}()
+
+	stop := func(ctx context.Context) error {
+		defer server.closeACME()
+		return serv.Shutdown(ctx)
+	}
+	return laddr, tlsConfig != nil, stop, nil
+}
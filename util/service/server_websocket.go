@@ -0,0 +1,112 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+// WebSocketHandler serves one websocket connection, the upgrade is done by the handler with
+// library such as gorilla/websocket; the connection is counted as active until ServeWebSocket returns,
+// so handler should block on its read loop
+type WebSocketHandler interface {
+	ServeWebSocket(w http.ResponseWriter, r *http.Request)
+}
+
+// WebSocketHandlerFunc adapter of func to WebSocketHandler
+type WebSocketHandlerFunc func(w http.ResponseWriter, r *http.Request)
+
+// ServeWebSocket calls f(w, r)
+func (f WebSocketHandlerFunc) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	f(w, r)
+}
+
+// WebSocketServer websocket processor driver, registered in etcd as type ws
+type WebSocketServer struct {
+	handler WebSocketHandler
+	active  int64
+}
+
+// NewWebSocketServer create websocket processor driver with handler
+func NewWebSocketServer(handler WebSocketHandler) *WebSocketServer {
+	return &WebSocketServer{handler: handler}
+}
+
+// ActiveConns number of connections being served
+func (m *WebSocketServer) ActiveConns() int64 {
+	return atomic.LoadInt64(&m.active)
+}
+
+// ServeHTTP 非 websocket 升级请求返回 400, http middleware 会包装 ResponseWriter 导致无法 Hijack, 这里不使用
+func (m *WebSocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fun := "WebSocketServer.ServeHTTP -->"
+
+	if !isWebSocketUpgrade(r) {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+
+	group, service := GetGroupAndService()
+	_metricWebSocketAccepted.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Inc()
+	gauge := _metricWebSocketConns.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service)
+	atomic.AddInt64(&m.active, 1)
+	gauge.Add(1)
+	defer func() {
+		atomic.AddInt64(&m.active, -1)
+		gauge.Add(-1)
+		if err := recover(); err != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			logger().Errorf(r.Context(), "%s path: %s panic: %v\n%s", fun, r.URL.Path, err, buf)
+			ReportPanic(context.Background(), err, buf)
+		}
+	}()
+
+	m.handler.ServeWebSocket(w, r)
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header.Get("Connection"), "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func headerContainsToken(v, token string) bool {
+	for _, s := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(s), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// powerWebSocket 被 Hijack 的连接不受 Shutdown 管理, 由 handler 自行在读写出错时退出
+func powerWebSocket(addr string, ws *WebSocketServer) (string, processorStopper, error) {
+	fun := "powerWebSocket -->"
+	ctx := context.Background()
+
+	if ws.handler == nil {
+		return "", nil, fmt.Errorf("websocket handler nil")
+	}
+
+	netListen, laddr, err := listenServAddr(ctx, addr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	serv := &http.Server{Handler: ws}
+	go func() {
+		err := serv.Serve(netListen)
+		if err != nil && err != http.ErrServerClosed {
+			xlog.Panicf(ctx, "%s laddr[%s]", fun, laddr)
+		}
+	}()
+
+	return laddr, serv.Shutdown, nil
+}
@@ -0,0 +1,45 @@
+package rocserv
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketServer(t *testing.T) {
+	ass := assert.New(t)
+
+	done := make(chan struct{})
+	ws := NewWebSocketServer(WebSocketHandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		<-done
+	}))
+	ts := httptest.NewServer(ws)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	ass.Nil(err)
+	ass.Equal(http.StatusBadRequest, resp.StatusCode)
+	resp.Body.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	ass.Nil(err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n"))
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	ass.Nil(err)
+	ass.Equal(http.StatusSwitchingProtocols, resp.StatusCode)
+	ass.Equal(int64(1), ws.ActiveConns())
+
+	close(done)
+}
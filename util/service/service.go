@@ -48,11 +48,33 @@ const (
 	// thrift 服务注册的位置
 	BASE_LOC_REG_SERV = "serve"
 
+	// acme 自动申请的证书存储位置
+	BASE_LOC_CERT = "cert"
+
+	// 服务级别的临时 kv 存储位置
+	BASE_LOC_KV = "kv"
+
+	// 控制命令下发及执行结果位置
+	BASE_LOC_CONTROL = "control"
+
+	// 服务接口定义发布位置
+	BASE_LOC_IDL = "idl"
+
+	// 灰度分流规则位置
+	BASE_LOC_CANARY = "canary"
+
+	// 大规模服务的压缩拓扑快照位置, 由服务的一个实例维护, 客户端优先使用
+	BASE_LOC_DIST_SNAPSHOT = "dist2_snapshot"
+
 	// 后门注册的位置
 	BASE_LOC_REG_BACKDOOR = "backdoor"
 
 	// 服务手动配置位置
 	BASE_LOC_REG_MANUAL = "manual"
+	// 实例运行时设置位置
+	BASE_LOC_SETTINGS = "settings"
+	// 实例负载上报位置
+	BASE_LOC_REG_LOAD = "load"
 	// sla metrics注册的位置
 	BASE_LOC_REG_METRICS = "metrics"
 
@@ -73,6 +95,8 @@ const (
 type configEtcd struct {
 	etcdAddrs  []string
 	useBaseloc string
+	// 非空时按服务分组选择发现使用的 etcd 地址
+	resolver EtcdResolver
 }
 
 type ServBaseV2 struct {
@@ -87,6 +111,7 @@ type ServBaseV2 struct {
 	copyName     string
 	sessKey      string
 	region       string // 地区, 与PaaS一致
+	zone         string // 可用区, 注册后客户端优先调用同可用区的实例
 
 	isLocalRunning bool
 
@@ -97,11 +122,15 @@ type ServBaseV2 struct {
 	// 跨机房服务注册
 	crossRegisterClients   map[string]etcd.KeysAPI
 	crossRegisterRegionIds []int
+	// 降级启动时未初始化跨机房注册中心, 获取 servid 后初始化
+	crossRegisterPending bool
 
 	servId int
 
 	muLocks sync.Mutex
 	locks   map[string]*sync2.Semaphore
+	// 持有的锁的 fencing token
+	fencing map[string]uint64
 
 	muHearts sync.Mutex
 	hearts   map[string]*distLockHeart
@@ -111,6 +140,31 @@ type ServBaseV2 struct {
 
 	muReg    sync.Mutex
 	regInfos map[string]string
+	regBatch registerBatch
+	// 注册节点 ttl 刷新的结果
+	heartbeat registerHeartbeat
+
+	kv ServKV
+
+	// 非 etcd 注册中心, 服务同时注册到 etcd 及该注册中心
+	registry    Registry
+	regInstance *Instance
+
+	// 降级启动时获取 servid 之前的注册
+	pendingRegs pendingRegistrations
+
+	// 两阶段注册状态, 为空表示直接注册为 active
+	regState   string
+	regServs   map[string]*ServInfo
+	regCrossDC bool
+
+	readiness readiness
+
+	// 非空时参与拓扑快照的 leader 选举
+	topology *topologyPublisher
+
+	muWatcher sync.Mutex
+	watcher   *configWatcher
 }
 
 func (m *ServBaseV2) isStop() bool {
@@ -120,10 +174,25 @@ func (m *ServBaseV2) isStop() bool {
 
 // Stop server stop
 func (m *ServBaseV2) Stop() {
+	m.deregister()
+	m.shutdown()
+}
+
+// deregister 停止刷新并删除注册节点
+func (m *ServBaseV2) deregister() {
 	m.setStatusToStop()
+	m.stopTopologySnapshot()
 	m.clearRegisterInfos()
 	m.clearCrossDCRegisterInfos()
+	m.deregisterInstance()
+}
+
+// shutdown 停止配置监听, 取消 Go 启动的 goroutine 后执行 app 的 shutdown hook
+func (m *ServBaseV2) shutdown() {
+	m.stopConfigWatcher()
+	goroutines.stop(goStopTimeout)
 	m.onShutdown()
+	closeDefaultEventEmitter()
 }
 
 // SetOnShutdown add shutdown hook in app
@@ -142,6 +211,15 @@ func (m *ServBaseV2) addRegisterInfo(path, regInfo string) {
 	m.regInfos[path] = regInfo
 }
 
+// getRegisterInfoLocked 注册信息可能在运行时被 UpdateService 更新, 重新创建节点时使用最新的值,
+// 调用方需持有 muReg
+func (m *ServBaseV2) getRegisterInfoLocked(path, defaultInfo string) string {
+	if regInfo, ok := m.regInfos[path]; ok {
+		return regInfo
+	}
+	return defaultInfo
+}
+
 func (m *ServBaseV2) clearRegisterInfos() {
 	fun := "ServBaseV2.clearRegisterInfos -->"
 
@@ -156,29 +234,30 @@ func (m *ServBaseV2) clearRegisterInfos() {
 			Recursive: true,
 		})
 		if err != nil {
-			xlog.Warnf(context.Background(), "%s path: %s, err: %v", fun, path, err)
+			logger().Warnf(context.Background(), "%s path: %s, err: %v", fun, path, err)
 		}
 	}
 }
 
 func (m *ServBaseV2) RegisterBackDoor(servs map[string]*ServInfo) error {
-	rd := NewRegData(servs, m.envGroup)
-	js, err := json.Marshal(rd)
-	if err != nil {
-		return err
-	}
-	path := fmt.Sprintf("%s/%s/%s/%d/%s", m.confEtcd.useBaseloc, BASE_LOC_DIST_V2, m.servLocation, m.servId, BASE_LOC_REG_BACKDOOR)
-
-	return m.doRegister(path, string(js), true)
+	return m.registerSystem(BASE_LOC_REG_BACKDOOR, servs)
 }
 
 func (m *ServBaseV2) RegisterMetrics(servs map[string]*ServInfo) error {
+	return m.registerSystem(BASE_LOC_REG_METRICS, servs)
+}
+
+// registerSystem 内部 processor 注册在实例目录下的 category 节点
+func (m *ServBaseV2) registerSystem(category string, servs map[string]*ServInfo) error {
+	if m.deferRegistration("system:"+category, func() error { return m.registerSystem(category, servs) }) {
+		return nil
+	}
 	rd := NewRegData(servs, m.envGroup)
 	js, err := json.Marshal(rd)
 	if err != nil {
 		return err
 	}
-	path := fmt.Sprintf("%s/%s/%s/%d/%s", m.confEtcd.useBaseloc, BASE_LOC_DIST_V2, m.servLocation, m.servId, BASE_LOC_REG_METRICS)
+	path := fmt.Sprintf("%s/%s/%s/%d/%s", m.confEtcd.useBaseloc, BASE_LOC_DIST_V2, m.servLocation, m.servId, category)
 
 	return m.doRegister(path, string(js), true)
 }
@@ -201,25 +280,45 @@ func (m *ServBaseV2) RegisterService(servs map[string]*ServInfo) error {
 	fun := "ServBaseV2.RegisterService -->"
 	ctx := context.Background()
 
+	if m.deferRegistration("service", func() error { return m.RegisterService(servs) }) {
+		return nil
+	}
+	m.muReg.Lock()
+	m.regServs = servs
+	m.muReg.Unlock()
+
 	err := m.RegisterServiceV2(servs, BASE_LOC_REG_SERV, false)
 	if err != nil {
-		xlog.Errorf(ctx, "%s register server v2 failed, err: %v", fun, err)
+		logger().Errorf(ctx, "%s register server v2 failed, err: %v", fun, err)
 		return err
 	}
 
-	err = m.RegisterServiceV1(servs, false)
+	// v1 没有注册阶段, 激活时再注册
+	if m.getRegState() == RegStateActive {
+		err = m.RegisterServiceV1(servs, false)
+		if err != nil {
+			logger().Errorf(ctx, "%s register server v1 failed, err: %v", fun, err)
+			return err
+		}
+	}
+
+	err = m.registerInstance(servs)
 	if err != nil {
-		xlog.Errorf(ctx, "%s register server v1 failed, err: %v", fun, err)
+		logger().Errorf(ctx, "%s register instance failed, err: %v", fun, err)
 		return err
 	}
 
-	xlog.Infof(ctx, "%s register server ok", fun)
+	logger().Infof(ctx, "%s register server ok", fun)
 
 	return nil
 }
 
 func (m *ServBaseV2) RegisterServiceV2(servs map[string]*ServInfo, dir string, crossDC bool) error {
 	rd := NewRegData(servs, m.envGroup)
+	rd.Deprecations = getMethodDeprecations()
+	rd.Region = m.region
+	rd.Zone = m.zone
+	rd.State = m.getRegState()
 	js, err := json.Marshal(rd)
 	if err != nil {
 		return err
@@ -234,16 +333,89 @@ func (m *ServBaseV2) RegisterServiceV2(servs map[string]*ServInfo, dir string, c
 	return m.doCrossDCRegister(path, string(js), true)
 }
 
+// UpdateService update registration of processors at runtime, e.g. processor added or removed;
+// the registration must have been done by RegisterService
+func (m *ServBaseV2) UpdateService(servs map[string]*ServInfo) error {
+	fun := "ServBaseV2.UpdateService -->"
+	ctx := context.Background()
+
+	// 延迟的注册使用最新的 servs
+	if m.deferRegistration("service", func() error { return m.RegisterService(servs) }) {
+		return nil
+	}
+	rd := NewRegData(servs, m.envGroup)
+	rd.Deprecations = getMethodDeprecations()
+	rd.Region = m.region
+	rd.Zone = m.zone
+	rd.State = m.getRegState()
+	jsV2, err := json.Marshal(rd)
+	if err != nil {
+		return err
+	}
+	jsV1, err := json.Marshal(servs)
+	if err != nil {
+		return err
+	}
+
+	pathV2 := fmt.Sprintf("%s/%s/%s/%d/%s", m.confEtcd.useBaseloc, BASE_LOC_DIST_V2, m.servLocation, m.servId, BASE_LOC_REG_SERV)
+	pathV1 := fmt.Sprintf("%s/%s/%s/%d", m.confEtcd.useBaseloc, BASE_LOC_DIST, m.servLocation, m.servId)
+	regs := map[string]string{
+		pathV2: string(jsV2),
+	}
+	if rd.State == RegStateActive {
+		regs[pathV1] = string(jsV1)
+	}
+	for path, js := range regs {
+		// 刷新协程只刷新 ttl, 这里直接写入新值
+		m.addRegisterInfo(path, js)
+		_, err := m.etcdClient.Set(ctx, path, js, &etcd.SetOptions{TTL: time.Second * 60})
+		if err != nil {
+			logger().Errorf(ctx, "%s update path: %s err: %v", fun, path, err)
+			return err
+		}
+		for addr, client := range m.crossRegisterClients {
+			_, err := client.Set(ctx, path, js, &etcd.SetOptions{TTL: time.Second * 60})
+			if err != nil {
+				logger().Warnf(ctx, "%s update cross dc addr: %s path: %s err: %v", fun, addr, path, err)
+			}
+		}
+	}
+
+	m.muReg.Lock()
+	m.regServs = servs
+	var ins *Instance
+	if m.regInstance != nil {
+		cp := *m.regInstance
+		cp.Servs = servs
+		cp.State = rd.State
+		m.regInstance = &cp
+		ins = &cp
+	}
+	m.muReg.Unlock()
+	if m.registry != nil && ins != nil {
+		if err := m.registry.Register(ctx, ins); err != nil {
+			logger().Errorf(ctx, "%s update registry instance err: %v", fun, err)
+			return err
+		}
+	}
+
+	logger().Infof(ctx, "%s update service ok, servs: %s", fun, jsV1)
+	return nil
+}
+
 // 为兼容老的client发现服务，保留的
 func (m *ServBaseV2) RegisterServiceV1(servs map[string]*ServInfo, crossDC bool) error {
 	fun := "ServBaseV2.RegisterServiceV1 -->"
 
+	if m.deferRegistration(fmt.Sprintf("v1:%v", crossDC), func() error { return m.RegisterServiceV1(servs, crossDC) }) {
+		return nil
+	}
 	js, err := json.Marshal(servs)
 	if err != nil {
 		return err
 	}
 
-	xlog.Infof(context.Background(), "%s servs:%s", fun, js)
+	logger().Infof(context.Background(), "%s servs:%s", fun, js)
 
 	path := fmt.Sprintf("%s/%s/%s/%d", m.confEtcd.useBaseloc, BASE_LOC_DIST, m.servLocation, m.servId)
 
@@ -259,16 +431,19 @@ func (m *ServBaseV2) SetGroupAndDisable(group string, disable bool) error {
 	fun := "ServBaseV2.SetGroupAndDisable -->"
 	ctx := context.Background()
 
+	if m.deferRegistration("manual", func() error { return m.SetGroupAndDisable(group, disable) }) {
+		return nil
+	}
 	path := fmt.Sprintf("%s/%s/%s/%d/%s", m.confEtcd.useBaseloc, BASE_LOC_DIST_V2, m.servLocation, m.servId, BASE_LOC_REG_MANUAL)
 	value, err := m.getValueFromEtcd(path)
 	if err != nil {
-		xlog.Warnf(ctx, "%s getValueFromEtcd err, path:%s, err:%v", fun, path, err)
+		logger().Warnf(ctx, "%s getValueFromEtcd err, path:%s, err:%v", fun, path, err)
 	}
 
 	manual := &ManualData{}
 	err = json.Unmarshal([]byte(value), manual)
 	if len(value) > 0 && err != nil {
-		xlog.Errorf(ctx, "%s unmarshal err, value:%s, err:%v", fun, value, err)
+		logger().Errorf(ctx, "%s unmarshal err, value:%s, err:%v", fun, value, err)
 		return err
 	}
 
@@ -294,26 +469,67 @@ func (m *ServBaseV2) SetGroupAndDisable(group string, disable bool) error {
 
 	newValue, err := json.Marshal(manual)
 	if err != nil {
-		xlog.Errorf(ctx, "%s marshal err, manual:%v, err:%v", fun, manual, err)
+		logger().Errorf(ctx, "%s marshal err, manual:%v, err:%v", fun, manual, err)
 		return err
 	}
 
-	xlog.Infof(ctx, "%s path:%s old value:%s new value:%s", fun, path, value, newValue)
+	logger().Infof(ctx, "%s path:%s old value:%s new value:%s", fun, path, value, newValue)
 	err = m.setValueToEtcd(path, string(newValue), nil)
 	if err != nil {
-		xlog.Errorf(ctx, "%s setValueToEtcd err, path:%s value:%s", fun, path, newValue)
+		logger().Errorf(ctx, "%s setValueToEtcd err, path:%s value:%s", fun, path, newValue)
 	}
 
+	m.updateRegInstance(ctx, m.servId, manual.Ctrl)
+
 	return err
 }
 
+// registerInstance 注册到非 etcd 注册中心
+func (m *ServBaseV2) registerInstance(servs map[string]*ServInfo) error {
+	if m.registry == nil {
+		return nil
+	}
+
+	ins := &Instance{
+		ServKey: m.servLocation,
+		Servid:  m.servId,
+		Lane:    m.envGroup,
+		Servs:   servs,
+		Weight:  100,
+		Region:  m.region,
+		Zone:    m.zone,
+		State:   m.getRegState(),
+	}
+	m.muReg.Lock()
+	m.regInstance = ins
+	m.muReg.Unlock()
+
+	return m.registry.Register(context.Background(), ins)
+}
+
+func (m *ServBaseV2) deregisterInstance() {
+	fun := "ServBaseV2.deregisterInstance -->"
+
+	m.muReg.Lock()
+	ins := m.regInstance
+	m.muReg.Unlock()
+	if m.registry == nil || ins == nil {
+		return
+	}
+
+	err := m.registry.Deregister(context.Background(), ins)
+	if err != nil {
+		logger().Warnf(context.Background(), "%s servkey: %s servid: %d err: %v", fun, ins.ServKey, ins.Servid, err)
+	}
+}
+
 func (m *ServBaseV2) getValueFromEtcd(path string) (value string, err error) {
 	fun := "ServBaseV2.getValueFromEtcd -->"
 	ctx := context.Background()
 
 	r, err := m.etcdClient.Get(context.Background(), path, &etcd.GetOptions{Recursive: false, Sort: false})
 	if err != nil {
-		xlog.Warnf(ctx, "%s path:%s err:%v", fun, path, err)
+		logger().Warnf(ctx, "%s path:%s err:%v", fun, path, err)
 		return "", err
 	}
 	if r != nil && r.Node != nil {
@@ -328,65 +544,20 @@ func (m *ServBaseV2) setValueToEtcd(path, value string, opts *etcd.SetOptions) e
 
 	_, err := m.etcdClient.Set(context.Background(), path, value, opts)
 	if err != nil {
-		xlog.Errorf(context.Background(), "%s path:%s value:%s opts:%v", fun, path, value, opts)
+		logger().Errorf(context.Background(), "%s path:%s value:%s opts:%v", fun, path, value, opts)
 	}
 
 	return err
 }
 
 func (m *ServBaseV2) doRegister(path, js string, refresh bool) error {
-	fun := "ServBaseV2.doRegister -->"
-	ctx := context.Background()
 	m.addRegisterInfo(path, js)
-
-	// 创建完成标志
-	var isCreated bool
-
-	go func() {
-		for i := 0; ; i++ {
-			updateEtcd := func() {
-				var err error
-				if !isCreated {
-					xlog.Warnf(ctx, "%s create node, round: %d server_info: %s", fun, i, js)
-					_, err = m.etcdClient.Set(context.Background(), path, js, &etcd.SetOptions{
-						TTL: time.Second * 60,
-					})
-				} else {
-					if refresh {
-						// 在刷新ttl时候，不允许变更value
-						_, err = m.etcdClient.Set(context.Background(), path, "", &etcd.SetOptions{
-							PrevExist: etcd.PrevExist,
-							TTL:       time.Second * 60,
-							Refresh:   true,
-						})
-					} else {
-						_, err = m.etcdClient.Set(context.Background(), path, js, &etcd.SetOptions{
-							TTL: time.Second * 60,
-						})
-					}
-
-				}
-
-				if err != nil {
-					isCreated = false
-					xlog.Warnf(ctx, "%s register need create node, round: %d, err: %v", fun, i, err)
-
-				} else {
-					isCreated = true
-				}
-			}
-
-			withRegLockRunClosureBeforeStop(m, ctx, fun, updateEtcd)
-
-			time.Sleep(time.Second * 20)
-
-			if m.isStop() {
-				xlog.Infof(ctx, "%s server stop, register path [%s] clear", fun, path)
-				return
-			}
-		}
-
-	}()
+	// 所有路径由同一个协程合并写入
+	m.regBatch.add(&registerEntry{path: path, js: js, refresh: refresh})
+	m.regBatch.once.Do(func() {
+		go m.registerLoop()
+		go m.reconcileLoop()
+	})
 
 	return nil
 }
@@ -413,6 +584,11 @@ func (m *ServBaseV2) ConfigCenter() xconfig.ConfigCenter {
 	return m.configCenter
 }
 
+// KV service scoped ephemeral kv, see GetKV
+func (m *ServBaseV2) KV() ServKV {
+	return m.kv
+}
+
 // RegInfos ...
 func (m *ServBaseV2) RegInfos() map[string]string {
 	m.muReg.Lock()
@@ -432,14 +608,14 @@ func (m *ServBaseV2) ServConfig(cfg interface{}) error {
 	path := fmt.Sprintf("%s/%s", m.confEtcd.useBaseloc, BASE_LOC_ETC_GLOBAL)
 	scfg_global, err := getValue(m.etcdClient, path)
 	if err != nil {
-		xlog.Warnf(ctx, "%s serv config global value path: %s err: %v", fun, path, err)
+		logger().Warnf(ctx, "%s serv config global value path: %s err: %v", fun, path, err)
 	}
-	xlog.Infof(ctx, "%s global cfg:%s path:%s", fun, scfg_global, path)
+	logger().Infof(ctx, "%s global cfg:%s path:%s", fun, scfg_global, path)
 
 	path = fmt.Sprintf("%s/%s/%s", m.confEtcd.useBaseloc, BASE_LOC_ETC, m.servLocation)
 	scfg, err := getValue(m.etcdClient, path)
 	if err != nil {
-		xlog.Warnf(context.Background(), "%s serv config value path: %s err: %v", fun, path, err)
+		logger().Warnf(context.Background(), "%s serv config value path: %s err: %v", fun, path, err)
 	}
 
 	tf := xconfig.NewTierConf()
@@ -462,44 +638,44 @@ func (m *ServBaseV2) ServConfig(cfg interface{}) error {
 }
 
 // Deprecated
-// etcd v2 接口
+// etcd v2 接口, 环境变量 ROC_ETCD_API=v3 时通过 v3 接口访问 etcd
 func NewServBaseV2(confEtcd configEtcd, servLocation, skey, envGroup string, sidOffset int, crossRegionIdList []int) (*ServBaseV2, error) {
+	return newServBaseV2(confEtcd, servLocation, skey, envGroup, crossRegionIdList, false)
+}
+
+// newServBaseV2 degradedStart 为 true 时, 获取 servid 失败不影响启动, 见 WithDegradedStart
+func newServBaseV2(confEtcd configEtcd, servLocation, skey, envGroup string, crossRegionIdList []int, degradedStart bool) (*ServBaseV2, error) {
 	fun := "NewServBaseV2 -->"
 	ctx := context.Background()
 
-	cfg := etcd.Config{
-		Endpoints: confEtcd.etcdAddrs,
-		Transport: etcd.DefaultTransport,
-	}
-
-	xlog.Infof(ctx, "%s create etcd client start, cfg: %v", fun, cfg)
-	c, err := etcd.New(cfg)
+	logger().Infof(ctx, "%s create etcd client start, addrs: %v", fun, confEtcd.etcdAddrs)
+	client, err := newEtcdKeysAPI(confEtcd.etcdAddrs, confEtcd.useBaseloc)
 	if err != nil {
-		return nil, fmt.Errorf("create etchd client cfg error")
-	}
-
-	client := etcd.NewKeysAPI(c)
-	if client == nil {
-		return nil, fmt.Errorf("create etchd api error")
+		return nil, err
 	}
 
 	path := fmt.Sprintf("%s/%s/%s", confEtcd.useBaseloc, BASE_LOC_SKEY, servLocation)
 
-	xlog.Infof(ctx, "%s retryGenSid start", fun)
+	logger().Infof(ctx, "%s retryGenSid start", fun)
 	sid, err := retryGenSid(client, path, skey, 3)
+	degraded := false
 	if err != nil {
-		return nil, err
+		if !degradedStart {
+			return nil, err
+		}
+		logger().Errorf(ctx, "%s gen sid err: %v, start degraded without registration", fun, err)
+		sid, degraded = pendingServid, true
 	}
 
-	xlog.Infof(ctx, "%s retryGenSid end, path: %s, sid: %d, skey: %s, envGroup: %s", fun, path, sid, skey, envGroup)
+	logger().Infof(ctx, "%s retryGenSid end, path: %s, sid: %d, skey: %s, envGroup: %s", fun, path, sid, skey, envGroup)
 
 	// init global config center
-	xlog.Infof(ctx, " %s init configcenter start", fun)
+	logger().Infof(ctx, " %s init configcenter start", fun)
 	configCenter, err := xconfig.NewConfigCenter(context.TODO(), apollo.ConfigTypeApollo, servLocation, []string{ApplicationNamespace, RPCConfNamespace, xsql.MysqlConfNamespace, xmgo.MongoConfNamespace})
 	if err != nil {
 		return nil, err
 	}
-	xlog.Infof(ctx, " %s init configcenter end", fun)
+	logger().Infof(ctx, " %s init configcenter end", fun)
 
 	reg := &ServBaseV2{
 		confEtcd:               confEtcd,
@@ -514,6 +690,7 @@ func NewServBaseV2(confEtcd configEtcd, servLocation, skey, envGroup string, sid
 		regInfos:               make(map[string]string),
 
 		configCenter: configCenter,
+		kv:           newEtcdServKV(client, confEtcd.useBaseloc, servLocation),
 
 		envGroup:   envGroup,
 		onShutdown: func() { xlog.Info(context.TODO(), "app shutdown") },
@@ -523,31 +700,50 @@ func NewServBaseV2(confEtcd configEtcd, servLocation, skey, envGroup string, sid
 		reg.servGroup = svrInfo[0]
 		reg.servName = svrInfo[1]
 	} else {
-		xlog.Warnf(ctx, "%s servLocation:%s do not match group/service format", fun, servLocation)
+		logger().Warnf(ctx, "%s servLocation:%s do not match group/service format", fun, servLocation)
+	}
+
+	if conf := loadConfigRegistry(confEtcd); conf.backend != REGISTRY_ETCD {
+		logger().Infof(ctx, "%s init registry backend: %s addrs: %v", fun, conf.backend, conf.addrs)
+		reg.registry, err = getRegistry(conf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if degraded {
+		// 跨机房注册中心的配置同样在 etcd 中
+		reg.crossRegisterPending = true
+		reg.startDegraded(path)
+		return reg, nil
 	}
 
 	// init cross register clients
-	xlog.Infof(ctx, " %s init CrossRegisterCenter start", fun)
+	logger().Infof(ctx, " %s init CrossRegisterCenter start", fun)
 	err = initCrossRegisterCenter(reg)
 	if err != nil {
 		return nil, err
 	}
-	xlog.Infof(ctx, " %s init CrossRegisterCenter end", fun)
+	logger().Infof(ctx, " %s init CrossRegisterCenter end", fun)
 
 	return reg, nil
 }
 
 func newServBaseV2WithCmdArgs(confEtcd configEtcd, servLocation, skey, envGroup string, sidOffset int, crossRegionIdList []int, args *cmdArgs) (*ServBaseV2, error) {
-	sb, err := NewServBaseV2(confEtcd, servLocation, skey, envGroup, sidOffset, crossRegionIdList)
+	sb, err := newServBaseV2(confEtcd, servLocation, skey, envGroup, crossRegionIdList, args.degradedStart || degradedStartFromEnv())
 	if err != nil {
 		return nil, err
 	}
 
 	sb.region = args.region
+	sb.zone = args.zone
 
 	if args.startType == START_TYPE_LOCAL {
 		sb.setLocalRunning(true)
 	}
+	if args.topologySnapshot && !sb.isLocalRunning {
+		sb.startTopologySnapshot()
+	}
 
 	return sb, nil
 }
@@ -588,15 +784,15 @@ func (m *ServBaseV2) createControlWithLaneInfo() *thriftutil.Control {
 func withRegLockRunClosureBeforeStop(m *ServBaseV2, ctx context.Context, funcName string, f func()) {
 	startTime := time.Now()
 	m.muReg.Lock()
-	xlog.Infof(ctx, "%s lock muReg for update", funcName)
+	logger().Infof(ctx, "%s lock muReg for update", funcName)
 	defer func() {
 		m.muReg.Unlock()
 		duration := time.Since(startTime)
-		xlog.Infof(ctx, "%s unlock muReq for update, duration: %v", funcName, duration)
+		logger().Infof(ctx, "%s unlock muReq for update, duration: %v", funcName, duration)
 	}()
 
 	if m.isStop() {
-		xlog.Infof(ctx, "%s server stop, do not run function", funcName)
+		logger().Infof(ctx, "%s server stop, do not run function", funcName)
 		return
 	}
 
@@ -613,13 +809,13 @@ func genSid(client etcd.KeysAPI, path, skey string) (int, error) {
 
 	js, _ := json.Marshal(r)
 
-	xlog.Infof(ctx, "%s", js)
+	logger().Infof(ctx, "%s", js)
 
 	if r.Node == nil || !r.Node.Dir {
 		return -1, fmt.Errorf("node error location:%s", path)
 	}
 
-	xlog.Infof(ctx, "%s serv:%s len:%d", fun, r.Node.Key, r.Node.Nodes.Len())
+	logger().Infof(ctx, "%s serv:%s len:%d", fun, r.Node.Key, r.Node.Nodes.Len())
 
 	// 获取已有的servid，按从小到大排列
 	ids := make([]int, 0)
@@ -627,7 +823,7 @@ func genSid(client etcd.KeysAPI, path, skey string) (int, error) {
 		sid := n.Key[len(r.Node.Key)+1:]
 		id, err := strconv.Atoi(sid)
 		if err != nil || id < 0 {
-			xlog.Errorf(ctx, "%s sid error key:%s", fun, n.Key)
+			logger().Errorf(ctx, "%s sid error key:%s", fun, n.Key)
 		} else {
 			ids = append(ids, id)
 			if n.Value == skey {
@@ -655,7 +851,7 @@ func genSid(client etcd.KeysAPI, path, skey string) (int, error) {
 	}
 
 	jr, _ := json.Marshal(r)
-	xlog.Infof(ctx, "%s newserv:%s resp:%s", fun, nserv, jr)
+	logger().Infof(ctx, "%s newserv:%s resp:%s", fun, nserv, jr)
 
 	return sid, nil
 
@@ -668,7 +864,7 @@ func retryGenSid(client etcd.KeysAPI, path, skey string, try int) (int, error) {
 		// 重试3次
 		sid, err := genSid(client, path, skey)
 		if err != nil {
-			xlog.Errorf(ctx, "%s gensid try: %d path: %s err: %v", fun, i, path, err)
+			logger().Errorf(ctx, "%s gensid try: %d path: %s err: %v", fun, i, path, err)
 		} else {
 			return sid, nil
 		}
@@ -692,3 +888,8 @@ func (m *ServBaseV2) Lane() string {
 func (m *ServBaseV2) Region() string {
 	return m.region
 }
+
+// Zone return availability zone of instance, it is empty if env ZONE is not set
+func (m *ServBaseV2) Zone() string {
+	return m.zone
+}
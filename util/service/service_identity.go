@@ -0,0 +1,415 @@
+package rocserv
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	defaultIdentityTrustDomain = "roc"
+	defaultIdentityTTL         = 24 * time.Hour
+	identityCheckInterval      = time.Minute
+)
+
+// IdentityConf service identity of instance, the identity is the SPIFFE ID spiffe://<TrustDomain>/<service name>
+// carried as URI SAN of certificate. Certificate is loaded from CertFile/KeyFile, e.g. SVID written by SPIFFE
+// agent or SDS helper, or issued by the instance itself with CACertFile/CAKeyFile
+type IdentityConf struct {
+	TrustDomain string
+
+	CertFile string
+	KeyFile  string
+	// BundleFile 信任的根证书, 使用 CA 签发时可为空, 此时信任 CACertFile
+	BundleFile string
+
+	CACertFile string
+	CAKeyFile  string
+	// TTL 自签发证书的有效期, 默认 24h
+	TTL time.Duration
+
+	// RotateBefore 证书到期前多久轮换, 默认为有效期的 1/3
+	RotateBefore time.Duration
+}
+
+type serviceIdentity struct {
+	conf IdentityConf
+	id   string
+
+	// 签发证书的 CA, 仅 CA 模式
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	leaf   *x509.Certificate
+	bundle *x509.CertPool
+	// 文件模式下上次加载的文件内容
+	files []byte
+}
+
+var (
+	muIdentity      sync.RWMutex
+	defaultIdentity *serviceIdentity
+)
+
+func getServiceIdentity() *serviceIdentity {
+	muIdentity.RLock()
+	defer muIdentity.RUnlock()
+	return defaultIdentity
+}
+
+// initServiceIdentity 加载或签发证书并在后台轮换, 在 processor 启动前调用
+func initServiceIdentity(servLoc string, conf *IdentityConf) error {
+	fun := "initServiceIdentity -->"
+
+	if conf == nil {
+		return nil
+	}
+	m, err := newServiceIdentity(servLoc, *conf)
+	if err != nil {
+		return err
+	}
+	muIdentity.Lock()
+	defaultIdentity = m
+	muIdentity.Unlock()
+
+	logger().Infof(context.Background(), "%s identity: %s expire: %v", fun, m.id, m.leaf.NotAfter)
+	go m.run()
+	return nil
+}
+
+func newServiceIdentity(servLoc string, conf IdentityConf) (*serviceIdentity, error) {
+	if len(conf.TrustDomain) == 0 {
+		conf.TrustDomain = defaultIdentityTrustDomain
+	}
+	m := &serviceIdentity{conf: conf}
+	m.id = m.idOf(servLoc)
+
+	switch {
+	case len(conf.CertFile) > 0:
+		if len(conf.BundleFile) == 0 {
+			return nil, errors.New("identity bundle file not configured")
+		}
+	case len(conf.CACertFile) > 0:
+		ca, err := tls.LoadX509KeyPair(conf.CACertFile, conf.CAKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load ca file: %s err: %v", conf.CACertFile, err)
+		}
+		signer, ok := ca.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("ca key: %s can not sign", conf.CAKeyFile)
+		}
+		if m.caCert, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return nil, err
+		}
+		m.caKey = signer
+	default:
+		return nil, errors.New("identity cert not configured")
+	}
+
+	if err := m.rotate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *serviceIdentity) idOf(servLoc string) string {
+	return fmt.Sprintf("spiffe://%s/%s", m.conf.TrustDomain, strings.Trim(servLoc, "/"))
+}
+
+func (m *serviceIdentity) run() {
+	fun := "serviceIdentity.run -->"
+
+	ticker := time.NewTicker(identityCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := m.rotate(); err != nil {
+			// 轮换失败时继续使用旧证书, 下个周期重试
+			logger().Errorf(context.Background(), "%s identity: %s rotate err: %v", fun, m.id, err)
+		}
+	}
+}
+
+// rotate 文件模式下文件内容变化时重新加载, CA 模式下临近过期时重新签发
+func (m *serviceIdentity) rotate() error {
+	fun := "serviceIdentity.rotate -->"
+
+	var err error
+	if m.caCert != nil {
+		err = m.issue()
+	} else {
+		err = m.loadFiles()
+	}
+	if err != nil {
+		return err
+	}
+
+	m.mu.RLock()
+	leaf := m.leaf
+	m.mu.RUnlock()
+	group, service := GetGroupAndService()
+	_metricIdentityCertExpire.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Set(time.Until(leaf.NotAfter).Seconds())
+	if time.Until(leaf.NotAfter) < m.rotateBefore(leaf) {
+		logger().Warnf(context.Background(), "%s identity: %s cert expire at: %v", fun, m.id, leaf.NotAfter)
+	}
+	return nil
+}
+
+func (m *serviceIdentity) rotateBefore(leaf *x509.Certificate) time.Duration {
+	if m.conf.RotateBefore > 0 {
+		return m.conf.RotateBefore
+	}
+	return leaf.NotAfter.Sub(leaf.NotBefore) / 3
+}
+
+func (m *serviceIdentity) loadFiles() error {
+	fun := "serviceIdentity.loadFiles -->"
+
+	var content []byte
+	for _, f := range []string{m.conf.CertFile, m.conf.KeyFile, m.conf.BundleFile} {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return fmt.Errorf("read identity file: %s err: %v", f, err)
+		}
+		content = append(content, b...)
+	}
+	m.mu.RLock()
+	unchanged := bytes.Equal(content, m.files)
+	m.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	// 证书与私钥分别写入, 读到不匹配的中间状态时报错, 下个周期重新加载
+	cert, err := tls.LoadX509KeyPair(m.conf.CertFile, m.conf.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load identity cert: %s err: %v", m.conf.CertFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if id := spiffeIDOf(leaf); id != m.id {
+		return fmt.Errorf("identity cert: %s id: %s not match: %s", m.conf.CertFile, id, m.id)
+	}
+	bundlePEM, err := ioutil.ReadFile(m.conf.BundleFile)
+	if err != nil {
+		return err
+	}
+	bundle := x509.NewCertPool()
+	if !bundle.AppendCertsFromPEM(bundlePEM) {
+		return fmt.Errorf("invalid identity bundle: %s", m.conf.BundleFile)
+	}
+	cert.Leaf = leaf
+
+	m.mu.Lock()
+	m.cert, m.leaf, m.bundle, m.files = &cert, leaf, bundle, content
+	m.mu.Unlock()
+	logger().Infof(context.Background(), "%s identity: %s loaded, expire: %v", fun, m.id, leaf.NotAfter)
+	return nil
+}
+
+func (m *serviceIdentity) issue() error {
+	fun := "serviceIdentity.issue -->"
+
+	m.mu.RLock()
+	leaf := m.leaf
+	m.mu.RUnlock()
+	if leaf != nil && time.Until(leaf.NotAfter) > m.rotateBefore(leaf) {
+		return nil
+	}
+
+	ttl := m.conf.TTL
+	if ttl <= 0 {
+		ttl = defaultIdentityTTL
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	uri, err := url.Parse(m.id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	notAfter := now.Add(ttl)
+	if notAfter.After(m.caCert.NotAfter) {
+		notAfter = m.caCert.NotAfter
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: uri.Path[1:]},
+		URIs:         []*url.URL{uri},
+		// 容忍实例之间的时钟偏差
+		NotBefore:   now.Add(-time.Minute),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, m.caCert, &key.PublicKey, m.caKey)
+	if err != nil {
+		return err
+	}
+	if leaf, err = x509.ParseCertificate(der); err != nil {
+		return err
+	}
+
+	bundle := x509.NewCertPool()
+	bundle.AddCert(m.caCert)
+	if len(m.conf.BundleFile) > 0 {
+		// 轮换 CA 时 bundle 中同时包含新旧 CA
+		b, err := ioutil.ReadFile(m.conf.BundleFile)
+		if err != nil {
+			return err
+		}
+		bundle.AppendCertsFromPEM(b)
+	}
+
+	m.mu.Lock()
+	// 附带签发 CA, CA 为中间证书时对端只需信任根证书
+	m.cert = &tls.Certificate{Certificate: [][]byte{der, m.caCert.Raw}, PrivateKey: key, Leaf: leaf}
+	m.leaf, m.bundle = leaf, bundle
+	m.mu.Unlock()
+	logger().Infof(context.Background(), "%s identity: %s issued, expire: %v", fun, m.id, leaf.NotAfter)
+	return nil
+}
+
+func (m *serviceIdentity) certificate() (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.cert, nil
+}
+
+// verify 校验证书链属于信任域, expect 非空时校验对端身份
+func (m *serviceIdentity) verify(rawCerts [][]byte, expect string) (string, error) {
+	if len(rawCerts) == 0 {
+		return "", errors.New("peer cert not provided")
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return "", err
+		}
+		certs = append(certs, c)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+
+	m.mu.RLock()
+	bundle := m.bundle
+	m.mu.RUnlock()
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         bundle,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return "", err
+	}
+
+	id := spiffeIDOf(certs[0])
+	if !strings.HasPrefix(id, fmt.Sprintf("spiffe://%s/", m.conf.TrustDomain)) {
+		return "", fmt.Errorf("peer id: %s not in trust domain: %s", id, m.conf.TrustDomain)
+	}
+	if len(expect) > 0 && id != expect {
+		return "", fmt.Errorf("peer id: %s expect: %s", id, expect)
+	}
+	return id, nil
+}
+
+// serverConfig 要求客户端提供信任域内的证书, optional 时允许不提供
+func (m *serviceIdentity) serverConfig(optional bool) *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.certificate()
+		},
+		ClientAuth: tls.RequireAnyClientCert,
+		// 根证书可能轮换, 不使用 ClientCAs 而是在此校验
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if optional && len(rawCerts) == 0 {
+				return nil
+			}
+			_, err := m.verify(rawCerts, "")
+			return err
+		},
+	}
+	if optional {
+		cfg.ClientAuth = tls.RequestClientCert
+	}
+	return cfg
+}
+
+// clientConfig 校验服务端身份为 servKey
+func (m *serviceIdentity) clientConfig(servKey string) *tls.Config {
+	expect := m.idOf(servKey)
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return m.certificate()
+		},
+		// 身份证书不包含主机名, 证书链及身份在 VerifyPeerCertificate 中校验
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := m.verify(rawCerts, expect)
+			return err
+		},
+	}
+}
+
+func spiffeIDOf(cert *x509.Certificate) string {
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			return u.String()
+		}
+	}
+	return ""
+}
+
+// GetServiceIdentity return SPIFFE ID of this instance, empty if service identity is not enabled
+func GetServiceIdentity() string {
+	if m := getServiceIdentity(); m != nil {
+		return m.id
+	}
+	return ""
+}
+
+// GetPeerIdentity return SPIFFE ID of grpc caller authenticated by mTLS
+func GetPeerIdentity(ctx context.Context) (string, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return "", false
+	}
+	id := spiffeIDOf(info.State.PeerCertificates[0])
+	return id, len(id) > 0
+}
@@ -0,0 +1,130 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func writeTestCA(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "roc ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca_key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestServiceIdentity(t *testing.T) {
+	ass := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "roc_identity")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+	caFile, caKeyFile := writeTestCA(t, dir)
+
+	_, err = newServiceIdentity("base/account", IdentityConf{})
+	ass.NotNil(err)
+	servIdentity, err := newServiceIdentity("base/account", IdentityConf{CACertFile: caFile, CAKeyFile: caKeyFile, TTL: time.Hour})
+	ass.Nil(err)
+	ass.Equal("spiffe://roc/base/account", servIdentity.id)
+	cliIdentity, err := newServiceIdentity("base/order", IdentityConf{CACertFile: caFile, CAKeyFile: caKeyFile})
+	ass.Nil(err)
+
+	// 未临近过期时不重新签发
+	serial := servIdentity.leaf.SerialNumber
+	ass.Nil(servIdentity.rotate())
+	ass.Equal(serial, servIdentity.leaf.SerialNumber)
+	servIdentity.conf.RotateBefore = 2 * time.Hour
+	ass.Nil(servIdentity.rotate())
+	ass.NotEqual(serial, servIdentity.leaf.SerialNumber)
+
+	var peerID string
+	srv := grpc.NewServer(grpc.Creds(listenerCreds{}), grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		peerID, _ = GetPeerIdentity(ctx)
+		return handler(ctx, req)
+	}))
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	ass.Nil(err)
+	go srv.Serve(grpcTLSListener(lis, servIdentity.serverConfig(false)))
+	defer srv.Stop()
+	addr := lis.Addr().String()
+
+	check := func(servKey string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(credentials.NewTLS(cliIdentity.clientConfig(servKey))))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		return err
+	}
+	ass.Nil(check("base/account"))
+	ass.Equal("spiffe://roc/base/order", peerID)
+	// 对端身份与注册的服务不一致
+	ass.NotNil(check("base/other"))
+
+	// 文件模式, 证书身份需与服务一致
+	certFile, keyFile := filepath.Join(dir, "svid.pem"), filepath.Join(dir, "svid_key.pem")
+	writeIdentityFiles := func(m *serviceIdentity) {
+		keyDer, err := x509.MarshalECPrivateKey(m.cert.PrivateKey.(*ecdsa.PrivateKey))
+		ass.Nil(err)
+		ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: m.cert.Certificate[0]}), 0600)
+		ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	}
+	writeIdentityFiles(servIdentity)
+	conf := IdentityConf{CertFile: certFile, KeyFile: keyFile, BundleFile: caFile}
+	fileIdentity, err := newServiceIdentity("base/account", conf)
+	ass.Nil(err)
+	ass.Equal(servIdentity.leaf.SerialNumber, fileIdentity.leaf.SerialNumber)
+	_, err = newServiceIdentity("base/order", conf)
+	ass.NotNil(err)
+
+	// 文件更新后重新加载
+	servIdentity.conf.RotateBefore = 2 * time.Hour
+	ass.Nil(servIdentity.rotate())
+	writeIdentityFiles(servIdentity)
+	ass.Nil(fileIdentity.rotate())
+	ass.Equal(servIdentity.leaf.SerialNumber, fileIdentity.leaf.SerialNumber)
+	_, err = fileIdentity.verify(cliIdentity.cert.Certificate, "")
+	ass.Nil(err)
+}
@@ -16,6 +16,16 @@ type ServInfo struct {
 	Type   string `json:"type"`
 	Addr   string `json:"addr"`
 	Servid int    `json:"-"`
+	// 监听开启 TLS, 客户端需要使用 TLS 连接
+	TLS bool `json:"tls,omitempty"`
+	// thrift 的 transport 及 protocol, 为空时为 framed 及 binary
+	ThriftTransport string `json:"thrift_transport,omitempty"`
+	ThriftProtocol  string `json:"thrift_protocol,omitempty"`
+	// 同一端口提供的协议, 逗号分隔, 见 MuxServer
+	Multiplex string `json:"multiplex,omitempty"`
+	// 额外地址的类别及所属的 processor, 调用方按位置选用, 见 ListenAddr.Class
+	Class string `json:"class,omitempty"`
+	Of    string `json:"of,omitempty"`
 	//Processor string    `json:"processor"`
 }
 
@@ -26,6 +36,24 @@ func (m *ServInfo) String() string {
 type RegData struct {
 	Servs map[string]*ServInfo `json:"servs"`
 	Lane  *string              `json:"lane"`
+	// 服务端标记为废弃的接口
+	Deprecations []*MethodDeprecation `json:"deprecations,omitempty"`
+	// 实例所在地区及可用区, 客户端优先调用同可用区的实例
+	Region string `json:"region,omitempty"`
+	Zone   string `json:"zone,omitempty"`
+	// 注册阶段, 为空表示老版本服务端, 视为 active
+	State string `json:"state,omitempty"`
+}
+
+// 两阶段注册: 端口监听后以 starting 注册, 平台可见但客户端不路由, 就绪后切换为 active
+const (
+	RegStateStarting = "starting"
+	RegStateActive   = "active"
+)
+
+// IsActive whether clients should route to the instance
+func (r *RegData) IsActive() bool {
+	return r.State != RegStateStarting
 }
 
 type ServCtrl struct {
@@ -0,0 +1,170 @@
+package rocserv
+
+import (
+	"context"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// ShadowPercent percent(0-100) of requests of method mirrored to shadow instances
+	ShadowPercent = "shadowPercent"
+	// ShadowGroup group label of shadow instances, default is DefaultShadowGroup
+	ShadowGroup = "shadowGroup"
+
+	// DefaultShadowGroup group label of shadow instances when not configured
+	DefaultShadowGroup = "shadow"
+
+	// 镜像请求的 metadata 标记, 服务端通过 IsShadowRequest 判断, 避免产生副作用
+	shadowMetadataKey = "x-roc-shadow"
+
+	// 每个 client 同时进行中的镜像请求上限, 超出时丢弃
+	shadowMaxInFlight = 100
+	// 原请求没有 deadline 时镜像请求的超时时间
+	defaultShadowTimeout = time.Second
+)
+
+// IsShadowRequest whether request is mirrored by client for validation, response of it is ignored,
+// handlers should avoid side effects such as writing to production storage
+func IsShadowRequest(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && len(md.Get(shadowMetadataKey)) > 0
+}
+
+func isShadowOutgoing(ctx context.Context) bool {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	return ok && len(md.Get(shadowMetadataKey)) > 0
+}
+
+// shadowCodec 请求在发起镜像前已序列化, 响应直接丢弃
+type shadowCodec struct{}
+
+func (shadowCodec) Marshal(v interface{}) ([]byte, error) {
+	return v.([]byte), nil
+}
+
+func (shadowCodec) Unmarshal(data []byte, v interface{}) error {
+	return nil
+}
+
+func (shadowCodec) Name() string {
+	return "proto"
+}
+
+func (m *ClientGrpc) shadowPercent(method string) int {
+	p, _ := getFuncConfInt(m.clientLookup.ServKey(), method, ShadowPercent)
+	return p
+}
+
+func (m *ClientGrpc) shadowTarget(method string) *ServInfo {
+	group, ok := getFuncConfString(m.clientLookup.ServKey(), method, ShadowGroup)
+	if !ok || len(group) == 0 {
+		group = DefaultShadowGroup
+	}
+	list := m.clientLookup.GetAllServAddrWithGroup(group, m.processor)
+	if len(list) == 0 {
+		return nil
+	}
+	muRetryRand.Lock()
+	i := retryRand.Intn(len(list))
+	muRetryRand.Unlock()
+	return list[i]
+}
+
+// shadowClientInterceptor 按配置比例将请求复制一份发到 shadow 分组的实例, 不影响原请求的结果和耗时
+func (m *ClientGrpc) shadowClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if !isShadowOutgoing(ctx) {
+			m.mirror(ctx, method, req)
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+func (m *ClientGrpc) mirror(ctx context.Context, fullMethod string, req interface{}) {
+	fun := "ClientGrpc.mirror -->"
+
+	api := grpcMethodName(fullMethod)
+	percent := m.shadowPercent(api)
+	if percent <= 0 {
+		return
+	}
+	muRetryRand.Lock()
+	n := retryRand.Intn(100)
+	muRetryRand.Unlock()
+	if n >= percent {
+		return
+	}
+
+	si := m.shadowTarget(api)
+	if si == nil {
+		return
+	}
+
+	// 同步序列化, 原请求返回后调用方可能修改 req
+	data, err := encoding.GetCodec("proto").Marshal(req)
+	if err != nil {
+		logger().Warnf(ctx, "%s method: %s marshal err: %v", fun, fullMethod, err)
+		return
+	}
+
+	select {
+	case m.shadowSem <- struct{}{}:
+	default:
+		m.collectShadow(api, "dropped")
+		return
+	}
+
+	timeout := defaultShadowTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = metadata.Join(md, metadata.Pairs(shadowMetadataKey, "1"))
+
+	go func() {
+		defer func() { <-m.shadowSem }()
+
+		// 原请求返回后 ctx 会被取消, 镜像请求使用独立的 ctx
+		sctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), md), timeout)
+		defer cancel()
+
+		err := m.shadowInvoke(sctx, si, fullMethod, data)
+		if err != nil {
+			logger().Infof(sctx, "%s method: %s shadow: %s err: %v", fun, fullMethod, si.Addr, err)
+			m.collectShadow(api, "error")
+			return
+		}
+		m.collectShadow(api, "ok")
+	}()
+}
+
+func (m *ClientGrpc) shadowInvoke(ctx context.Context, si *ServInfo, fullMethod string, data []byte) error {
+	rc, err := m.getPool().Get(ctx, si.Addr)
+	if err != nil {
+		return err
+	}
+	gc, ok := rc.(*grpcClientConn)
+	if !ok || gc.conn == nil {
+		m.getPool().Put(si.Addr, rc, nil)
+		return nil
+	}
+	err = shadowCall(ctx, gc.conn, fullMethod, data)
+	m.getPool().Put(si.Addr, rc, err)
+	return err
+}
+
+func shadowCall(ctx context.Context, conn *grpc.ClientConn, fullMethod string, data []byte) error {
+	var reply []byte
+	return conn.Invoke(ctx, fullMethod, data, &reply, grpc.ForceCodec(shadowCodec{}))
+}
+
+func (m *ClientGrpc) collectShadow(api, status string) {
+	group, service := GetGroupAndService()
+	_metricShadowRequest.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelCalleeService, m.clientLookup.ServKey(), xprom.LabelAPI, api, labelStatus, status).Inc()
+}
@@ -0,0 +1,49 @@
+package rocserv
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestShadowInvoke(t *testing.T) {
+	ass := assert.New(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	ass.Nil(err)
+	shadowed := make(chan bool, 1)
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		shadowed <- IsShadowRequest(ctx)
+		return handler(ctx, req)
+	}))
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	si := &ServInfo{Type: "grpc", Addr: lis.Addr().String()}
+	cb := &fakeLoadLookup{servs: []*ServInfo{si}}
+	cli := NewClientGrpc(cb, "proc_grpc", 1, func(conn *grpc.ClientConn) interface{} {
+		return grpc_health_v1.NewHealthClient(conn)
+	})
+	ass.Equal(si, cli.shadowTarget("Check"))
+
+	data, err := encoding.GetCodec("proto").Marshal(&grpc_health_v1.HealthCheckRequest{})
+	ass.Nil(err)
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), metadata.Pairs(shadowMetadataKey, "1")), time.Second)
+	defer cancel()
+	ass.True(isShadowOutgoing(ctx))
+	conn, err := grpc.Dial(si.Addr, grpc.WithInsecure())
+	ass.Nil(err)
+	defer conn.Close()
+	ass.Nil(shadowCall(ctx, conn, "/grpc.health.v1.Health/Check", data))
+	ass.True(<-shadowed)
+	ass.False(IsShadowRequest(context.Background()))
+}
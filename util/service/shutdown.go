@@ -0,0 +1,85 @@
+package rocserv
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PreStopDelayEnv time to wait after deregistration before draining on SIGTERM, such as 5s, same as WithPreStopDelay
+	PreStopDelayEnv = "ROC_PRE_STOP_DELAY"
+
+	// 默认不等待, 需要时通过环境变量或 WithPreStopDelay 开启
+	defaultPreStopDelay = time.Duration(0)
+	// 停止 processor 后等待处理中请求结束的最长时间
+	defaultDrainTimeout = 10 * time.Second
+)
+
+// resolvePreStopDelay 优先使用 WithPreStopDelay, 其次环境变量
+func resolvePreStopDelay(d *time.Duration) time.Duration {
+	fun := "resolvePreStopDelay -->"
+	if d != nil {
+		return *d
+	}
+	if v := os.Getenv(PreStopDelayEnv); len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err == nil {
+			return d
+		}
+		logger().Warnf(context.Background(), "%s invalid %s: %s, use default: %v", fun, PreStopDelayEnv, v, defaultPreStopDelay)
+	}
+	return defaultPreStopDelay
+}
+
+// gracefulStop 先删除注册节点, 等待 preStopDelay 使调用方感知实例下线, 再停止 processor 并等待处理中的请求结束,
+// 最后执行 app 的 shutdown hook
+func (m *Server) gracefulStop(sb *ServBaseV2, drainTimeout time.Duration) {
+	fun := "Server.gracefulStop -->"
+	ctx := context.Background()
+
+	sb.deregister()
+	if m.preStopDelay > 0 {
+		logger().Infof(ctx, "%s deregistered, wait pre stop delay: %v", fun, m.preStopDelay)
+		time.Sleep(m.preStopDelay)
+	}
+	m.drain(ctx, drainTimeout)
+	sb.shutdown()
+	logger().Infof(ctx, "%s stopped", fun)
+}
+
+// drain 停止 processor 的监听并等待处理中的请求, backdoor 等内部 processor 保持到进程退出
+func (m *Server) drain(ctx context.Context, timeout time.Duration) {
+	fun := "Server.drain -->"
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	m.muProcs.Lock()
+	procs := make(map[string]*runningProcessor, len(m.procs))
+	for name, p := range m.procs {
+		if !strings.HasPrefix(name, "_") && p.stop != nil {
+			procs[name] = p
+		}
+	}
+	m.muProcs.Unlock()
+
+	var wg sync.WaitGroup
+	for name, p := range procs {
+		wg.Add(1)
+		go func(name string, p *runningProcessor) {
+			defer wg.Done()
+			if err := p.stop(ctx); err != nil {
+				logger().Warnf(ctx, "%s processor: %s stop err: %v", fun, name, err)
+			}
+		}(name, p)
+	}
+	wg.Wait()
+
+	for InFlightRequests() > 0 && ctx.Err() == nil {
+		time.Sleep(time.Millisecond * 100)
+	}
+	logger().Infof(ctx, "%s processors: %d in flight requests: %d", fun, len(procs), InFlightRequests())
+}
@@ -0,0 +1,53 @@
+package rocserv
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvePreStopDelay(t *testing.T) {
+	ass := assert.New(t)
+	defer os.Unsetenv(PreStopDelayEnv)
+
+	// 未配置时不等待
+	ass.Equal(time.Duration(0), resolvePreStopDelay(nil))
+	os.Setenv(PreStopDelayEnv, "5s")
+	ass.Equal(5*time.Second, resolvePreStopDelay(nil))
+	os.Setenv(PreStopDelayEnv, "5")
+	ass.Equal(time.Duration(0), resolvePreStopDelay(nil))
+
+	d := 2 * time.Second
+	ass.Equal(d, resolvePreStopDelay(&d))
+}
+
+func TestServerGracefulStop(t *testing.T) {
+	ass := assert.New(t)
+
+	var events []string
+	stopper := func(name string) processorStopper {
+		return func(ctx context.Context) error {
+			events = append(events, "stop "+name)
+			return nil
+		}
+	}
+	srv := &Server{preStopDelay: 100 * time.Millisecond}
+	srv.addRunningProcessor("proc_http", &runningProcessor{info: &ServInfo{}, stop: stopper("proc_http")})
+	srv.addRunningProcessor("_backdoor", &runningProcessor{info: &ServInfo{}, stop: stopper("_backdoor")})
+
+	sb := &ServBaseV2{regInfos: map[string]string{}}
+	sb.SetOnShutdown(func() {
+		events = append(events, "shutdown")
+	})
+
+	st := time.Now()
+	srv.gracefulStop(sb, time.Second)
+	// 删除注册节点前等待新实例注册, 之后等待 preStopDelay
+	ass.True(time.Since(st) >= srv.preStopDelay)
+	ass.True(sb.isStop())
+	// 内部 processor 不停止, shutdown hook 在停止 processor 之后执行
+	ass.Equal([]string{"stop proc_http", "shutdown"}, events)
+}
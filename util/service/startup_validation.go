@@ -0,0 +1,150 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StrictValidationEnv set to 1 to fail startup when processor wiring problems are found, same as WithStrictValidation
+const StrictValidationEnv = "ROC_STRICT_VALIDATION"
+
+// strictValidation 启动校验发现问题时启动失败, 否则只打印告警, 在 processor 启动前设置
+var strictValidation bool
+
+// gin Any 注册的方法
+var anyMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodHead, http.MethodOptions, http.MethodDelete, http.MethodConnect, http.MethodTrace,
+}
+
+type registeredRoute struct {
+	method string
+	path   string
+}
+
+// addRoute 记录路由, 与已注册的路由重复或冲突时记录问题并返回 false,
+// 不再注册到 gin 避免 panic, 启动校验统一报告
+func (s *HttpServer) addRoute(path string, methods ...string) bool {
+	fun := "HttpServer.addRoute -->"
+
+	var issues []string
+	if !strings.HasPrefix(path, "/") {
+		issues = append(issues, fmt.Sprintf("route %s must begin with '/'", path))
+	}
+	for _, method := range methods {
+		if len(issues) > 0 {
+			break
+		}
+		for _, r := range s.routes {
+			if r.method != method {
+				continue
+			}
+			if r.path == path {
+				issues = append(issues, fmt.Sprintf("duplicate route %s %s", method, path))
+				break
+			}
+			if routeConflict(r.path, path) {
+				issues = append(issues, fmt.Sprintf("route %s %s conflicts with wildcard of route %s %s", method, path, r.method, r.path))
+				break
+			}
+		}
+	}
+	if len(issues) > 0 {
+		for _, issue := range issues {
+			logger().Warnf(context.Background(), "%s %s, route is not registered", fun, issue)
+		}
+		s.issues = append(s.issues, issues...)
+		return false
+	}
+
+	for _, method := range methods {
+		s.routes = append(s.routes, registeredRoute{method: method, path: path})
+	}
+	return true
+}
+
+// checkUseOrder gin 的中间件只作用于之后注册的路由
+func (s *HttpServer) checkUseOrder(name string) {
+	if len(s.routes) == 0 {
+		return
+	}
+	last := s.routes[len(s.routes)-1]
+	issue := fmt.Sprintf("middleware %s is added after %d routes such as %s %s, it does not run on them", name, len(s.routes), last.method, last.path)
+	logger().Warnf(context.Background(), "HttpServer.checkUseOrder --> %s", issue)
+	s.issues = append(s.issues, issue)
+}
+
+// routeConflict 同 httprouter 的规则, 公共前缀之后同一位置上的参数或通配段与其他不同的段冲突
+func routeConflict(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		return isWildSegment(as[i]) || isWildSegment(bs[i])
+	}
+	return false
+}
+
+func isWildSegment(seg string) bool {
+	return strings.HasPrefix(seg, ":") || strings.HasPrefix(seg, "*")
+}
+
+// validateDriver 检查 processor 的 driver 是否存在重复或冲突的路由, 中间件顺序错误及没有任何处理函数
+func validateDriver(driver interface{}) []string {
+	var issues []string
+	switch d := driver.(type) {
+	case *HttpServer:
+		issues = append(issues, d.issues...)
+		if len(d.routes) == 0 && len(d.Engine.Routes()) == 0 {
+			issues = append(issues, "no http route registered")
+		}
+	case *gin.Engine:
+		if len(d.Routes()) == 0 {
+			issues = append(issues, "no http route registered")
+		}
+	case *GrpcServer:
+		if d.Server != nil && len(d.Server.GetServiceInfo()) == 0 {
+			issues = append(issues, "no grpc service registered")
+		}
+	case *MuxServer:
+		if d.Grpc == nil || d.HTTP == nil {
+			issues = append(issues, "mux server needs both grpc and http")
+			break
+		}
+		issues = append(issues, validateDriver(d.Grpc)...)
+		issues = append(issues, validateDriver(d.HTTP)...)
+	case *GatewayServer:
+		if d.Grpc == nil || d.Gateway == nil || d.Register == nil {
+			issues = append(issues, "gateway server needs grpc, gateway and register")
+			break
+		}
+		issues = append(issues, validateDriver(d.Grpc)...)
+	}
+	return issues
+}
+
+// checkStartupIssues strict 模式下返回错误使启动失败, 否则打印告警
+func checkStartupIssues(ctx context.Context, processor string, issues []string) error {
+	fun := "checkStartupIssues -->"
+	if len(issues) == 0 {
+		return nil
+	}
+	if strictValidation {
+		logger().Errorf(ctx, "%s processor: %s validation failed: %s", fun, processor, strings.Join(issues, "; "))
+		return fmt.Errorf("processor: %s startup validation failed: %s", processor, strings.Join(issues, "; "))
+	}
+	for _, issue := range issues {
+		logger().Warnf(ctx, "%s processor: %s %s", fun, processor, issue)
+	}
+	return nil
+}
+
+func strictValidationFromEnv() bool {
+	return os.Getenv(StrictValidationEnv) == "1"
+}
@@ -0,0 +1,81 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func TestRouteConflict(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.True(routeConflict("/user/:id", "/user/:name"))
+	ass.True(routeConflict("/user/:id", "/user/list"))
+	ass.True(routeConflict("/static/*filepath", "/static/index"))
+	ass.True(routeConflict("/static/", "/static/*filepath"))
+	ass.False(routeConflict("/user/:id", "/user/:id/orders"))
+	ass.False(routeConflict("/user/list", "/user/detail"))
+	ass.False(routeConflict("/user", "/user/:id"))
+}
+
+func TestHttpServerRouteValidation(t *testing.T) {
+	ass := assert.New(t)
+
+	ok := func(c *Context) { c.Status(http.StatusOK) }
+	s := &HttpServer{Engine: gin.New(), fallbacks: &routeFallbacks{}}
+	s.GET("/user/:id", ok)
+	s.POST("/user/:id", ok)
+	// 重复及冲突的路由不注册到 gin, 不会 panic
+	ass.NotPanics(func() {
+		s.GET("/user/:id", ok)
+		s.GET("/user/:name", ok)
+		s.Any("/user/list", ok)
+		s.GET("user", ok)
+	})
+	s.Use(ok)
+
+	issues := validateDriver(s)
+	ass.Len(issues, 5)
+	ass.Contains(issues[0], "duplicate route GET /user/:id")
+	ass.Contains(issues[1], "conflicts with wildcard")
+	ass.Contains(issues[2], "/user/list")
+	ass.Contains(issues[3], "must begin with '/'")
+	ass.Contains(issues[4], "middleware Use is added after 2 routes")
+
+	// 先注册的路由仍然可用
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/user/1", nil))
+	ass.Equal(http.StatusOK, w.Code)
+}
+
+func TestValidateDriverNoHandler(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.Equal([]string{"no http route registered"}, validateDriver(&HttpServer{Engine: gin.New()}))
+	ass.Equal([]string{"no http route registered"}, validateDriver(gin.New()))
+	ass.Equal([]string{"no grpc service registered"}, validateDriver(&GrpcServer{Server: grpc.NewServer()}))
+
+	s := &HttpServer{Engine: gin.New()}
+	s.Use(func(c *Context) {})
+	s.GET("/ping", func(c *Context) {})
+	ass.Empty(validateDriver(s))
+}
+
+func TestCheckStartupIssues(t *testing.T) {
+	ass := assert.New(t)
+	defer func() { strictValidation = false }()
+
+	ctx := context.Background()
+	ass.NoError(checkStartupIssues(ctx, "proc_http", []string{"no http route registered"}))
+	ass.NoError(checkStartupIssues(ctx, "proc_http", nil))
+
+	strictValidation = true
+	err := checkStartupIssues(ctx, "proc_http", []string{"duplicate route GET /a", "no http route registered"})
+	ass.EqualError(err, "processor: proc_http startup validation failed: duplicate route GET /a; no http route registered")
+	ass.NoError(checkStartupIssues(ctx, "proc_http", nil))
+}
@@ -0,0 +1,216 @@
+package rocserv
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
+)
+
+const (
+	// k8s exec 探针检查的就绪文件, 就绪时存在
+	envReadyFile = "ROC_READY_FILE"
+
+	// systemd 约定的环境变量
+	envNotifySocket = "NOTIFY_SOCKET"
+	envWatchdogUsec = "WATCHDOG_USEC"
+	envWatchdogPid  = "WATCHDOG_PID"
+
+	defaultSupervisorProbeInterval = time.Second * 5
+	defaultSupervisorStopTimeout   = time.Second * 10
+)
+
+// SupervisorConf config of running under process supervisor such as systemd or k8s
+type SupervisorConf struct {
+	// 就绪时创建, 未就绪或停止时删除, 为空时不使用
+	ReadyFile string
+	// 检查就绪状态的间隔, 开启 systemd watchdog 时不超过 watchdog 超时的一半
+	ProbeInterval time.Duration
+	// 收到停止信号后等待处理中请求结束的最长时间
+	StopTimeout time.Duration
+}
+
+func supervisorConfFromEnv() *SupervisorConf {
+	return &SupervisorConf{ReadyFile: os.Getenv(envReadyFile)}
+}
+
+// RunUnderSupervisor same as Serve, but reports readiness to supervisor via sd_notify or ready file of ROC_READY_FILE,
+// pings systemd watchdog and returns after graceful stop on SIGTERM or SIGINT
+func RunUnderSupervisor(etcdAddrs []string, baseLoc string, initLogic func(ServBase) error, processors map[string]Processor) error {
+	fun := "RunUnderSupervisor -->"
+	ctx := context.Background()
+
+	args, err := server.parseFlag()
+	if err != nil {
+		xlog.Panicf(ctx, "%s parse arg err: %v", fun, err)
+		return err
+	}
+	args.supervisor = supervisorConfFromEnv()
+
+	return server.Init(configEtcd{etcdAddrs: etcdAddrs, useBaseloc: baseLoc}, args, initLogic, processors)
+}
+
+// sdNotify 向 systemd 发送状态, 不在 systemd 下运行时忽略
+func sdNotify(state string) error {
+	name := os.Getenv(envNotifySocket)
+	if len(name) == 0 {
+		return nil
+	}
+	// @ 开头为 abstract socket
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval systemd 开启 watchdog 时返回 ping 间隔, 为超时的一半
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv(envWatchdogUsec), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv(envWatchdogPid); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+type supervisor struct {
+	sb       *ServBaseV2
+	srv      *Server
+	conf     SupervisorConf
+	watchdog time.Duration
+
+	ready    bool
+	notified bool
+}
+
+func newSupervisor(sb *ServBaseV2, conf SupervisorConf) *supervisor {
+	if conf.ProbeInterval <= 0 {
+		conf.ProbeInterval = defaultSupervisorProbeInterval
+	}
+	if conf.StopTimeout <= 0 {
+		conf.StopTimeout = defaultSupervisorStopTimeout
+	}
+	s := &supervisor{sb: sb, conf: conf, watchdog: watchdogInterval()}
+	if s.watchdog > 0 && s.watchdog < s.conf.ProbeInterval {
+		s.conf.ProbeInterval = s.watchdog
+	}
+	return s
+}
+
+// probe 同步就绪状态到 systemd 和就绪文件, 并 ping watchdog
+func (m *supervisor) probe() {
+	fun := "supervisor.probe -->"
+	ctx := context.Background()
+
+	notReady := m.sb.readiness.check()
+	ready := len(notReady) == 0
+	if ready != m.ready {
+		m.ready = ready
+		if err := m.setReadyFile(ready); err != nil {
+			logger().Errorf(ctx, "%s ready file: %s err: %v", fun, m.conf.ReadyFile, err)
+		}
+	}
+
+	var state []string
+	if ready && !m.notified {
+		m.notified = true
+		state = append(state, "READY=1", fmt.Sprintf("MAINPID=%d", os.Getpid()))
+	}
+	if m.watchdog > 0 {
+		state = append(state, "WATCHDOG=1")
+	}
+	if !ready {
+		reasons := make([]string, 0, len(notReady))
+		for name, reason := range notReady {
+			reasons = append(reasons, name+": "+reason)
+		}
+		sort.Strings(reasons)
+		state = append(state, "STATUS=not ready, "+strings.Join(reasons, "; "))
+	}
+	if len(state) == 0 {
+		return
+	}
+	if err := sdNotify(strings.Join(state, "\n")); err != nil {
+		logger().Errorf(ctx, "%s sd_notify err: %v", fun, err)
+	}
+}
+
+func (m *supervisor) setReadyFile(ready bool) error {
+	if len(m.conf.ReadyFile) == 0 {
+		return nil
+	}
+	if ready {
+		return ioutil.WriteFile(m.conf.ReadyFile, []byte(strconv.Itoa(os.Getpid())), 0644)
+	}
+	if err := os.Remove(m.conf.ReadyFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// stop 先摘除就绪状态再停止服务, 下线后的等待及停止 processor 同 Server.gracefulStop
+func (m *supervisor) stop() {
+	fun := "supervisor.stop -->"
+	ctx := context.Background()
+
+	if err := sdNotify("STOPPING=1"); err != nil {
+		logger().Errorf(ctx, "%s sd_notify err: %v", fun, err)
+	}
+	m.ready = false
+	if err := m.setReadyFile(false); err != nil {
+		logger().Errorf(ctx, "%s ready file: %s err: %v", fun, m.conf.ReadyFile, err)
+	}
+
+	srv := m.srv
+	if srv == nil {
+		srv = &Server{}
+	}
+	srv.gracefulStop(m.sb, m.conf.StopTimeout)
+	logger().Infof(ctx, "%s stopped, in flight requests: %d", fun, InFlightRequests())
+}
+
+// run 阻塞直到收到 SIGTERM 或 SIGINT, 停止服务后返回;
+// SIGHUP 在 supervisor 下常用于 reload, 默认行为是退出进程, 这里忽略
+func (m *supervisor) run() error {
+	ctx := context.Background()
+
+	c := make(chan os.Signal, 1)
+	signals := []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGPIPE, syscall.SIGHUP}
+	signal.Reset(signals...)
+	signal.Notify(c, signals...)
+	defer signal.Stop(c)
+
+	ticker := time.NewTicker(m.conf.ProbeInterval)
+	defer ticker.Stop()
+
+	m.probe()
+	for {
+		select {
+		case s := <-c:
+			logger().Infof(ctx, "receive a signal: %s", s.String())
+			if s == syscall.SIGTERM || s == syscall.SIGINT {
+				m.stop()
+				return nil
+			}
+		case <-ticker.C:
+			m.probe()
+		}
+	}
+}
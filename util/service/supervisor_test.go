@@ -0,0 +1,65 @@
+package rocserv
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupervisorProbe(t *testing.T) {
+	ass := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "supervisor")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	ass.Nil(err)
+	defer conn.Close()
+	os.Setenv(envNotifySocket, sock)
+	defer os.Unsetenv(envNotifySocket)
+
+	readyFile := filepath.Join(dir, "ready")
+	sb := &ServBaseV2{}
+	s := newSupervisor(sb, SupervisorConf{ReadyFile: readyFile})
+	ass.Equal(defaultSupervisorProbeInterval, s.conf.ProbeInterval)
+
+	buf := make([]byte, 1024)
+	s.probe()
+	n, err := conn.Read(buf)
+	ass.Nil(err)
+	ass.Contains(string(buf[:n]), "STATUS=not ready")
+	_, err = os.Stat(readyFile)
+	ass.True(os.IsNotExist(err))
+
+	for _, stage := range readyStages {
+		sb.readiness.setStage(stage)
+	}
+	s.probe()
+	n, err = conn.Read(buf)
+	ass.Nil(err)
+	ass.Contains(string(buf[:n]), "READY=1")
+	_, err = os.Stat(readyFile)
+	ass.Nil(err)
+
+	ass.Nil(s.setReadyFile(false))
+	_, err = os.Stat(readyFile)
+	ass.True(os.IsNotExist(err))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	ass := assert.New(t)
+
+	ass.Equal(int64(0), int64(watchdogInterval()))
+	os.Setenv(envWatchdogUsec, "4000000")
+	defer os.Unsetenv(envWatchdogUsec)
+	ass.Equal("2s", watchdogInterval().String())
+	os.Setenv(envWatchdogPid, "1")
+	defer os.Unsetenv(envWatchdogPid)
+	ass.Equal(int64(0), int64(watchdogInterval()))
+}
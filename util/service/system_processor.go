@@ -0,0 +1,245 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+// 框架内部的 processor, 如 _PROC_BACKDOOR, _PROC_METRICS
+const systemProcessorPrefix = "_PROC_"
+
+func isSystemProcessor(name string) bool {
+	return strings.HasPrefix(name, systemProcessorPrefix)
+}
+
+// 实例目录下已使用的节点, 不能作为 system processor 的注册位置
+var reservedSystemCategories = map[string]bool{
+	BASE_LOC_REG_SERV:     true,
+	BASE_LOC_REG_MANUAL:   true,
+	BASE_LOC_REG_LOAD:     true,
+	BASE_LOC_REG_BACKDOOR: true,
+	BASE_LOC_REG_METRICS:  true,
+}
+
+var errSystemProcessorStarted = errors.New("system processors already started")
+
+type systemProcessorDef struct {
+	name      string
+	category  string
+	processor Processor
+}
+
+type systemProcessorDefs struct {
+	mu      sync.Mutex
+	started bool
+	defs    []*systemProcessorDef
+}
+
+var extraSystemProcessors = &systemProcessorDefs{}
+
+// RegisterSystemProcessor add internal processor started by Serve of every service, such as a profiling
+// or debug port; name must start with _PROC_, and its address is registered under node category of the
+// instance, like backdoor and metrics. It is started after backdoor and before initLogic, serves until the
+// process exits, and its failure only marks the instance degraded. Call it before Serve, such as in init
+func RegisterSystemProcessor(name, category string, p Processor) error {
+	if len(name) <= len(systemProcessorPrefix) || !isSystemProcessor(name) {
+		return fmt.Errorf("system processor name: %s must start with %s", name, systemProcessorPrefix)
+	}
+	if len(category) == 0 || strings.Contains(category, "/") || reservedSystemCategories[category] {
+		return fmt.Errorf("system processor: %s category: %s invalid or reserved", name, category)
+	}
+	if p == nil {
+		return fmt.Errorf("system processor: %s is nil", name)
+	}
+	return extraSystemProcessors.add(&systemProcessorDef{name: name, category: category, processor: p})
+}
+
+func (m *systemProcessorDefs) add(def *systemProcessorDef) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.started {
+		return errSystemProcessorStarted
+	}
+	if def.name == "_PROC_BACKDOOR" || def.name == "_PROC_METRICS" {
+		return fmt.Errorf("system processor: %s is builtin", def.name)
+	}
+	for _, d := range m.defs {
+		if d.name == def.name || d.category == def.category {
+			return fmt.Errorf("system processor: %s category: %s already registered", def.name, def.category)
+		}
+	}
+	m.defs = append(m.defs, def)
+	return nil
+}
+
+// start 之后不再接受注册
+func (m *systemProcessorDefs) start() []*systemProcessorDef {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started = true
+	return append([]*systemProcessorDef(nil), m.defs...)
+}
+
+// initSystemProcessors 启动通过 RegisterSystemProcessor 添加的 processor, 按注册顺序
+func (m *Server) initSystemProcessors(sb *ServBaseV2) {
+	for _, def := range extraSystemProcessors.start() {
+		category := def.category
+		m.loadSystemProcessor(def.name, def.processor, func(servs map[string]*ServInfo) error {
+			return sb.registerSystem(category, servs)
+		})
+	}
+}
+
+// SystemProcessorStatus state of internal processor such as _PROC_BACKDOOR, the instance is degraded
+// while one of them is down, because health check or metrics scraping fails
+type SystemProcessorStatus struct {
+	Name  string    `json:"name"`
+	Addr  string    `json:"addr,omitempty"`
+	Up    bool      `json:"up"`
+	Error string    `json:"error,omitempty"`
+	Since time.Time `json:"since"`
+}
+
+type systemProcessorStates struct {
+	mu     sync.Mutex
+	states map[string]*SystemProcessorStatus
+}
+
+var systemProcessors = &systemProcessorStates{}
+
+func (m *systemProcessorStates) set(name, addr string, err error) {
+	st := &SystemProcessorStatus{Name: name, Addr: addr, Up: err == nil, Since: time.Now()}
+	if err != nil {
+		st.Error = err.Error()
+	}
+	m.mu.Lock()
+	if m.states == nil {
+		m.states = make(map[string]*SystemProcessorStatus)
+	}
+	// 停止服务后保留启动时的地址
+	if old := m.states[name]; old != nil && len(st.Addr) == 0 {
+		st.Addr = old.Addr
+	}
+	m.states[name] = st
+	m.mu.Unlock()
+
+	up := 0.0
+	if err == nil {
+		up = 1
+	}
+	group, service := GetGroupAndService()
+	_metricSystemProcessorUp.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelProcessor, name).Set(up)
+}
+
+func (m *systemProcessorStates) list() []*SystemProcessorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]*SystemProcessorStatus, 0, len(m.states))
+	for _, st := range m.states {
+		c := *st
+		res = append(res, &c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// GetSystemProcessorStatus return states of internal processors ordered by name
+func GetSystemProcessorStatus() []*SystemProcessorStatus {
+	return systemProcessors.list()
+}
+
+// IsDegraded whether one of internal processors failed to start or stopped serving,
+// or the instance started without etcd and is not registered yet
+func IsDegraded() bool {
+	if sb, ok := server.sbase.(*ServBaseV2); ok && sb.RegistrationPending() {
+		return true
+	}
+	for _, st := range systemProcessors.list() {
+		if !st.Up {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSystemProcessor 启动及注册失败只标记为降级, 不影响业务 processor; Init 及 Driver 的 panic 同样处理
+func (m *Server) loadSystemProcessor(name string, p Processor, register func(map[string]*ServInfo) error) (err error) {
+	fun := "Server.loadSystemProcessor -->"
+	ctx := context.Background()
+
+	var addr string
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		if err != nil {
+			logger().Errorf(ctx, "%s processor: %s degraded, err: %v", fun, name, err)
+		}
+		systemProcessors.set(name, addr, err)
+	}()
+
+	if err = p.Init(); err != nil {
+		return fmt.Errorf("init: %v", err)
+	}
+	infos, err := m.loadDriver(map[string]Processor{name: p})
+	if err != nil {
+		return fmt.Errorf("load driver: %v", err)
+	}
+	if info := infos[name]; info != nil {
+		addr = info.Addr
+	}
+	if err = register(infos); err != nil {
+		return fmt.Errorf("register: %v", err)
+	}
+	return nil
+}
+
+// powerSystemHttp 内部 processor 不经过业务中间件, 请求按 processor 名称统计, 不计入业务请求
+func powerSystemHttp(name, addr string, tlsConfig *tls.Config, handler http.Handler) (string, processorStopper, error) {
+	fun := "powerSystemHttp -->"
+	ctx := context.Background()
+
+	netListen, laddr, err := listenServAddr(ctx, addr)
+	if err != nil {
+		return "", nil, err
+	}
+
+	serv := &http.Server{Handler: systemHttpMiddleware(name, recoveryHttpMiddleware(handler))}
+	go func() {
+		err := serveHttp(serv, netListen, tlsConfig)
+		if err != nil && err != http.ErrServerClosed {
+			logger().Errorf(ctx, "%s processor: %s laddr: %s serve err: %v", fun, name, laddr, err)
+			systemProcessors.set(name, "", fmt.Errorf("serve: %v", err))
+		}
+	}()
+
+	return laddr, serv.Shutdown, nil
+}
+
+// systemHttpMiddleware 与 rpcMetricHttpMiddleware 及 accessLogHttpMiddleware 相同, processor 为名称
+func systemHttpMiddleware(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		done := startServerRPC(r.Context(), name, r.URL.Path)
+		aw := &accessResponseWriter{ResponseWriter: w}
+		st := time.Now()
+		next.ServeHTTP(aw, r)
+		code := aw.status
+		if code == 0 {
+			code = http.StatusOK
+		}
+		done(strconv.Itoa(code))
+		logAccess(r.Context(), name, r.Method+" "+r.URL.Path, strconv.Itoa(code), code >= http.StatusInternalServerError, time.Since(st))
+	})
+}
@@ -0,0 +1,112 @@
+package rocserv
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSystemProcessor struct {
+	initErr error
+}
+
+func (m *testSystemProcessor) Init() error {
+	return m.initErr
+}
+
+func (m *testSystemProcessor) Driver() (string, interface{}) {
+	router := httprouter.New()
+	router.GET("/debug/ping", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		w.Write([]byte("pong"))
+	})
+	return "127.0.0.1:0", router
+}
+
+type panicSystemProcessor struct {
+	testSystemProcessor
+}
+
+func (m *panicSystemProcessor) Driver() (string, interface{}) {
+	panic("bad driver")
+}
+
+func TestLoadSystemProcessor(t *testing.T) {
+	ass := assert.New(t)
+	defer func() { systemProcessors = &systemProcessorStates{} }()
+
+	m := &Server{sbase: &ServBaseV2{isLocalRunning: true}}
+	noRegister := func(map[string]*ServInfo) error { return nil }
+
+	ass.Nil(m.loadSystemProcessor("_PROC_DEBUG", &testSystemProcessor{}, noRegister))
+	ass.False(IsDegraded())
+	ass.True(GetSystemProcessorStatus()[0].Up)
+
+	// 启动失败, panic 及注册失败均标记为降级
+	ass.NotNil(m.loadSystemProcessor("_PROC_INIT", &testSystemProcessor{initErr: errors.New("no config")}, noRegister))
+	ass.NotNil(m.loadSystemProcessor("_PROC_PANIC", &panicSystemProcessor{}, noRegister))
+	ass.NotNil(m.loadSystemProcessor("_PROC_REG", &testSystemProcessor{}, func(map[string]*ServInfo) error {
+		return errors.New("etcd unavailable")
+	}))
+	ass.True(IsDegraded())
+
+	states := GetSystemProcessorStatus()
+	ass.Len(states, 4)
+	ass.Equal("_PROC_DEBUG", states[0].Name)
+	ass.Equal("init: no config", states[1].Error)
+	ass.Equal("panic: bad driver", states[2].Error)
+	ass.Equal("register: etcd unavailable", states[3].Error)
+	ass.False(states[3].Up)
+}
+
+func TestSystemHttpMiddleware(t *testing.T) {
+	ass := assert.New(t)
+
+	h := systemHttpMiddleware("_PROC_DEBUG", recoveryHttpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("handler bug")
+	})))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/ping", nil))
+	ass.Equal(http.StatusInternalServerError, w.Code)
+
+	ass.True(isSystemProcessor("_PROC_BACKDOOR"))
+	ass.False(isSystemProcessor("proc_http"))
+}
+
+func TestRegisterSystemProcessor(t *testing.T) {
+	ass := assert.New(t)
+	defer func() {
+		extraSystemProcessors = &systemProcessorDefs{}
+		systemProcessors = &systemProcessorStates{}
+	}()
+
+	p := &testSystemProcessor{}
+	ass.NotNil(RegisterSystemProcessor("DEBUG", "debug", p))
+	ass.NotNil(RegisterSystemProcessor("_PROC_", "debug", p))
+	ass.NotNil(RegisterSystemProcessor("_PROC_DEBUG", "", p))
+	ass.NotNil(RegisterSystemProcessor("_PROC_DEBUG", "a/b", p))
+	ass.NotNil(RegisterSystemProcessor("_PROC_DEBUG", BASE_LOC_REG_BACKDOOR, p))
+	ass.NotNil(RegisterSystemProcessor("_PROC_DEBUG", "debug", nil))
+	ass.NotNil(RegisterSystemProcessor("_PROC_METRICS", "prof", p))
+
+	ass.Nil(RegisterSystemProcessor("_PROC_DEBUG", "debug", p))
+	ass.NotNil(RegisterSystemProcessor("_PROC_DEBUG", "prof", p))
+	ass.NotNil(RegisterSystemProcessor("_PROC_PROF", "debug", p))
+
+	// 启动时按注册顺序注册到各自的节点, 之后不再接受注册
+	var categories []string
+	m := &Server{sbase: &ServBaseV2{isLocalRunning: true}}
+	for _, def := range extraSystemProcessors.start() {
+		category := def.category
+		ass.Nil(m.loadSystemProcessor(def.name, def.processor, func(servs map[string]*ServInfo) error {
+			categories = append(categories, category)
+			ass.NotNil(servs[def.name])
+			return nil
+		}))
+	}
+	ass.Equal([]string{"debug"}, categories)
+	ass.Equal(errSystemProcessorStarted, RegisterSystemProcessor("_PROC_PROF", "prof", p))
+}
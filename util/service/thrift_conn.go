@@ -0,0 +1,178 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+const (
+	// 配置中心 application namespace 中 thrift 空闲连接超时秒数, 0 为不回收
+	thriftIdleTimeoutConfKey = "thrift_idle_timeout_sec"
+
+	// 大于客户端连接池的空闲超时, 正常的池化连接不会被回收
+	defaultThriftIdleTimeout = 10 * time.Minute
+	thriftReapInterval       = 30 * time.Second
+
+	labelDirection = "direction"
+)
+
+// thriftConn 统计单个连接的收发字节数, 阻塞在 Read 上等待下一个请求时视为空闲
+type thriftConn struct {
+	thrift.TTransport
+	raw   net.Conn
+	conns *thriftConns
+
+	// 开始等待请求的时间, 0 表示未在等待
+	readingSince int64
+	closeOnce    sync.Once
+}
+
+func (m *thriftConn) Read(buf []byte) (int, error) {
+	st := time.Now()
+	atomic.StoreInt64(&m.readingSince, st.UnixNano())
+	n, err := m.TTransport.Read(buf)
+	atomic.StoreInt64(&m.readingSince, 0)
+
+	group, service := GetGroupAndService()
+	_metricThriftConnIdle.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Observe(time.Since(st).Seconds())
+	if n > 0 {
+		_metricThriftConnBytes.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelDirection, "in").Add(float64(n))
+	}
+	return n, err
+}
+
+func (m *thriftConn) Write(buf []byte) (int, error) {
+	n, err := m.TTransport.Write(buf)
+	if n > 0 {
+		group, service := GetGroupAndService()
+		_metricThriftConnBytes.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelDirection, "out").Add(float64(n))
+	}
+	return n, err
+}
+
+func (m *thriftConn) Close() error {
+	err := m.TTransport.Close()
+	m.closeOnce.Do(func() {
+		m.conns.remove(m)
+	})
+	return err
+}
+
+// idle 等待请求的时长
+func (m *thriftConn) idle(now time.Time) time.Duration {
+	since := atomic.LoadInt64(&m.readingSince)
+	if since == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, since))
+}
+
+type thriftConns struct {
+	mu    sync.Mutex
+	conns map[*thriftConn]struct{}
+}
+
+func newThriftConns() *thriftConns {
+	return &thriftConns{conns: make(map[*thriftConn]struct{})}
+}
+
+func (m *thriftConns) add(c *thriftConn) {
+	m.mu.Lock()
+	m.conns[c] = struct{}{}
+	m.mu.Unlock()
+
+	group, service := GetGroupAndService()
+	_metricThriftConns.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Add(1)
+}
+
+func (m *thriftConns) remove(c *thriftConn) {
+	m.mu.Lock()
+	delete(m.conns, c)
+	m.mu.Unlock()
+
+	group, service := GetGroupAndService()
+	_metricThriftConns.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Add(-1)
+}
+
+// reap 关闭空闲超过 timeout 的连接, 只关闭底层连接, 由处理请求的 goroutine 读取出错后退出并 Close
+func (m *thriftConns) reap(now time.Time, timeout time.Duration) int {
+	fun := "thriftConns.reap -->"
+
+	var idle []*thriftConn
+	m.mu.Lock()
+	for c := range m.conns {
+		if c.idle(now) > timeout {
+			idle = append(idle, c)
+		}
+	}
+	m.mu.Unlock()
+
+	group, service := GetGroupAndService()
+	for _, c := range idle {
+		logger().Infof(context.Background(), "%s close idle conn remote: %s idle: %v", fun, c.raw.RemoteAddr(), c.idle(now))
+		c.raw.Close()
+		_metricThriftConnReaped.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service).Inc()
+	}
+	return len(idle)
+}
+
+func (m *thriftConns) loop(stop chan struct{}) {
+	ticker := time.NewTicker(thriftReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if timeout := thriftIdleTimeout(); timeout > 0 {
+				m.reap(now, timeout)
+			}
+		}
+	}
+}
+
+func thriftIdleTimeout() time.Duration {
+	cc := GetConfigCenter()
+	if cc == nil {
+		return defaultThriftIdleTimeout
+	}
+	sec, ok := cc.GetInt(context.TODO(), thriftIdleTimeoutConfKey)
+	if !ok {
+		return defaultThriftIdleTimeout
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// thriftConnServerTransport 记录 accept 的每个连接
+type thriftConnServerTransport struct {
+	*thrift.TServerSocket
+	conns *thriftConns
+	// 非空时在 accept 的连接上开启 TLS
+	tlsConfig *tls.Config
+}
+
+func (m *thriftConnServerTransport) Accept() (thrift.TTransport, error) {
+	t, err := m.TServerSocket.Accept()
+	if err != nil {
+		return t, err
+	}
+	sock, ok := t.(*thrift.TSocket)
+	if !ok || sock.Conn() == nil {
+		return t, nil
+	}
+	if m.tlsConfig != nil {
+		sock = thrift.NewTSocketFromConnTimeout(tls.Server(sock.Conn(), m.tlsConfig), 0)
+		t = sock
+	}
+	c := &thriftConn{TTransport: t, raw: sock.Conn(), conns: m.conns}
+	m.conns.add(c)
+	return c, nil
+}
@@ -0,0 +1,49 @@
+package rocserv
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThriftConnReap(t *testing.T) {
+	ass := assert.New(t)
+
+	sock, err := thrift.NewTServerSocket("127.0.0.1:0")
+	ass.Nil(err)
+	ass.Nil(sock.Listen())
+	conns := newThriftConns()
+	st := &thriftConnServerTransport{TServerSocket: sock, conns: conns}
+	defer st.Close()
+
+	client, err := net.Dial("tcp", sock.Addr().String())
+	ass.Nil(err)
+	defer client.Close()
+
+	tr, err := st.Accept()
+	ass.Nil(err)
+	ass.Len(conns.conns, 1)
+
+	done := make(chan error)
+	go func() {
+		buf := make([]byte, 4)
+		_, err := tr.Read(buf)
+		tr.Close()
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	ass.Equal(0, conns.reap(time.Now(), time.Minute))
+	ass.Equal(1, conns.reap(time.Now(), 10*time.Millisecond))
+
+	select {
+	case err := <-done:
+		ass.NotNil(err)
+	case <-time.After(time.Second):
+		t.Fatal("reaped conn not closed")
+	}
+	ass.Len(conns.conns, 0)
+}
@@ -0,0 +1,127 @@
+package rocserv
+
+import (
+	"fmt"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+)
+
+// thrift transport and protocol
+const (
+	THRIFT_TRANSPORT_FRAMED   = "framed"
+	THRIFT_TRANSPORT_BUFFERED = "buffered"
+
+	THRIFT_PROTOCOL_BINARY  = "binary"
+	THRIFT_PROTOCOL_COMPACT = "compact"
+	THRIFT_PROTOCOL_JSON    = "json"
+)
+
+const thriftBufferSize = 8192
+
+// ThriftConf transport and protocol of thrift processor, empty means framed transport and binary protocol;
+// header transport is not supported by the thrift library in use
+type ThriftConf struct {
+	Transport string
+	Protocol  string
+}
+
+// ThriftProcessor thrift processor with non default transport or protocol, which is advertised in ServInfo
+// so that clients use the same one; extra addresses of the processor use the same
+type ThriftProcessor interface {
+	Processor
+	ThriftConf() *ThriftConf
+}
+
+func thriftConfOf(p Processor) *ThriftConf {
+	if lazy, ok := p.(*lazyProcessor); ok {
+		p = lazy.Processor
+	}
+	if tp, ok := p.(ThriftProcessor); ok {
+		return tp.ThriftConf()
+	}
+	return nil
+}
+
+// thriftConfOfServ 老版本注册信息没有 transport 及 protocol, 为默认值
+func thriftConfOfServ(s *ServInfo) *ThriftConf {
+	if s == nil {
+		return nil
+	}
+	return &ThriftConf{Transport: s.ThriftTransport, Protocol: s.ThriftProtocol}
+}
+
+// normalize 填充默认值, m 为 nil 时返回 nil
+func (m *ThriftConf) normalize() *ThriftConf {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	if len(c.Transport) == 0 {
+		c.Transport = THRIFT_TRANSPORT_FRAMED
+	}
+	if len(c.Protocol) == 0 {
+		c.Protocol = THRIFT_PROTOCOL_BINARY
+	}
+	return &c
+}
+
+func (m *ThriftConf) factories() (thrift.TTransportFactory, thrift.TProtocolFactory, error) {
+	c := m.normalize()
+	if c == nil {
+		c = &ThriftConf{Transport: THRIFT_TRANSPORT_FRAMED, Protocol: THRIFT_PROTOCOL_BINARY}
+	}
+
+	var transportFactory thrift.TTransportFactory
+	switch c.Transport {
+	case THRIFT_TRANSPORT_FRAMED:
+		transportFactory = thrift.NewTFramedTransportFactory(thrift.NewTTransportFactory())
+	case THRIFT_TRANSPORT_BUFFERED:
+		transportFactory = thrift.NewTBufferedTransportFactory(thriftBufferSize)
+	default:
+		return nil, nil, fmt.Errorf("thrift transport: %s not supported", c.Transport)
+	}
+
+	var protocolFactory thrift.TProtocolFactory
+	switch c.Protocol {
+	case THRIFT_PROTOCOL_BINARY:
+		protocolFactory = thrift.NewTBinaryProtocolFactoryDefault()
+	case THRIFT_PROTOCOL_COMPACT:
+		protocolFactory = thrift.NewTCompactProtocolFactory()
+	case THRIFT_PROTOCOL_JSON:
+		protocolFactory = thrift.NewTJSONProtocolFactory()
+	default:
+		return nil, nil, fmt.Errorf("thrift protocol: %s not supported", c.Protocol)
+	}
+	return transportFactory, protocolFactory, nil
+}
+
+type servInfoLookup interface {
+	servInfoOfAddr(addr string) *ServInfo
+}
+
+// servInfoOfAddr addr 对应实例注册的 processor 信息
+func (m *ClientEtcdV2) servInfoOfAddr(addr string) *ServInfo {
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+
+	for _, c := range m.servCopy {
+		if c == nil || c.reg == nil {
+			continue
+		}
+		for _, s := range c.reg.Servs {
+			if s.Addr == addr {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+// dialThriftConf 按实例注册的 transport 及 protocol 建立连接
+func dialThriftConf(cb ClientLookup, addr string) *ThriftConf {
+	l, ok := cb.(servInfoLookup)
+	if !ok {
+		return nil
+	}
+	return thriftConfOfServ(l.servInfoOfAddr(addr))
+}
@@ -0,0 +1,59 @@
+package rocserv
+
+import (
+	"testing"
+
+	"git.apache.org/thrift.git/lib/go/thrift"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThriftConfFactories(t *testing.T) {
+	ass := assert.New(t)
+
+	var nilConf *ThriftConf
+	ass.Nil(nilConf.normalize())
+	ass.Equal(&ThriftConf{Transport: THRIFT_TRANSPORT_FRAMED, Protocol: THRIFT_PROTOCOL_COMPACT}, (&ThriftConf{Protocol: THRIFT_PROTOCOL_COMPACT}).normalize())
+
+	for _, conf := range []*ThriftConf{
+		nil,
+		{Transport: THRIFT_TRANSPORT_BUFFERED},
+		{Protocol: THRIFT_PROTOCOL_COMPACT},
+		{Transport: THRIFT_TRANSPORT_BUFFERED, Protocol: THRIFT_PROTOCOL_JSON},
+	} {
+		tf, pf, err := conf.factories()
+		ass.Nil(err)
+
+		// 同一配置写入的消息可以读出
+		trans := tf.GetTransport(thrift.NewTMemoryBuffer())
+		prot := pf.GetProtocol(trans)
+		ass.Nil(prot.WriteMessageBegin("Ping", thrift.CALL, 7))
+		ass.Nil(prot.WriteMessageEnd())
+		ass.Nil(prot.Flush())
+		name, typeID, seq, err := prot.ReadMessageBegin()
+		ass.Nil(err)
+		ass.Equal("Ping", name)
+		ass.Equal(thrift.CALL, typeID)
+		ass.Equal(int32(7), seq)
+	}
+
+	_, _, err := (&ThriftConf{Transport: "header"}).factories()
+	ass.NotNil(err)
+	_, _, err = (&ThriftConf{Protocol: "simplejson"}).factories()
+	ass.NotNil(err)
+}
+
+func TestDialThriftConf(t *testing.T) {
+	ass := assert.New(t)
+
+	compact := zoneServCopy(2, "a", 100)
+	compact.reg.Servs["proc_thrift"] = &ServInfo{Type: PROCESSOR_THRIFT, Addr: "127.0.0.2:9100", ThriftTransport: THRIFT_TRANSPORT_FRAMED, ThriftProtocol: THRIFT_PROTOCOL_COMPACT}
+	old := zoneServCopy(1, "a", 100)
+	old.reg.Servs["proc_thrift"] = &ServInfo{Type: PROCESSOR_THRIFT, Addr: "127.0.0.1:9100"}
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.upServlist(servCopyCollect{1: old, 2: compact})
+
+	ass.Equal(&ThriftConf{Transport: THRIFT_TRANSPORT_FRAMED, Protocol: THRIFT_PROTOCOL_COMPACT}, dialThriftConf(cli, "127.0.0.2:9100"))
+	// 老版本注册信息使用默认配置
+	ass.Equal(&ThriftConf{}, dialThriftConf(cli, "127.0.0.1:9100"))
+	ass.Nil(dialThriftConf(cli, "127.0.0.3:9100"))
+}
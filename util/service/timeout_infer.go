@@ -0,0 +1,176 @@
+package rocserv
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xutil"
+)
+
+const (
+	// TimeoutInfer percent of latency percentile used as timeout, e.g. 150 means p99*1.5, 0 disables inference
+	TimeoutInfer = "timeoutInfer"
+	// TimeoutInferPercentile latency percentile used by timeout inference, default is 99
+	TimeoutInferPercentile = "timeoutInferPercentile"
+	// TimeoutMin lower bound(ms) of inferred timeout
+	TimeoutMin = "timeoutMinMsec"
+	// TimeoutMax upper bound(ms) of inferred timeout, default is the static timeout
+	TimeoutMax = "timeoutMaxMsec"
+)
+
+const (
+	defaultTimeoutInferPercentile = 99
+	defaultTimeoutMin             = 10 * time.Millisecond
+
+	// 每个接口保留最近的成功请求耗时
+	timeoutInferWindow = 1024
+	// 样本数不足时使用静态超时
+	timeoutInferMinSamples = 100
+	timeoutInferInterval   = 10 * time.Second
+)
+
+// latencyWindow 最近 timeoutInferWindow 个成功请求的耗时
+type latencyWindow struct {
+	servKey  string
+	funcName string
+
+	samples []time.Duration
+	next    int
+	// 最近一次计算的耗时分位值, 0 表示样本不足
+	percentile time.Duration
+}
+
+func (m *latencyWindow) add(d time.Duration) {
+	if len(m.samples) < timeoutInferWindow {
+		m.samples = append(m.samples, d)
+		return
+	}
+	m.samples[m.next] = d
+	m.next = (m.next + 1) % timeoutInferWindow
+}
+
+func (m *latencyWindow) compute(percent int) time.Duration {
+	if len(m.samples) < timeoutInferMinSamples {
+		return 0
+	}
+	sorted := make([]time.Duration, len(m.samples))
+	copy(sorted, m.samples)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	idx := len(sorted)*percent/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// timeoutInferrer 按下游接口的历史耗时推算超时, 分位值定期计算, 请求链路上只读取结果
+type timeoutInferrer struct {
+	mu      sync.Mutex
+	windows map[string]*latencyWindow
+}
+
+var (
+	defaultTimeoutInferrer     *timeoutInferrer
+	defaultTimeoutInferrerOnce sync.Once
+)
+
+func getTimeoutInferrer() *timeoutInferrer {
+	defaultTimeoutInferrerOnce.Do(func() {
+		defaultTimeoutInferrer = &timeoutInferrer{windows: make(map[string]*latencyWindow)}
+		go defaultTimeoutInferrer.run()
+	})
+	return defaultTimeoutInferrer
+}
+
+// observe 只记录成功请求, 超时的请求会把分位值推向上限
+func (m *timeoutInferrer) observe(servKey, funcName string, d time.Duration) {
+	key := xutil.Concat(servKey, ".", funcName)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.windows[key]
+	if !ok {
+		w = &latencyWindow{servKey: servKey, funcName: funcName}
+		m.windows[key] = w
+	}
+	w.add(d)
+}
+
+func (m *timeoutInferrer) run() {
+	ticker := time.NewTicker(timeoutInferInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.update()
+	}
+}
+
+func (m *timeoutInferrer) update() {
+	m.mu.Lock()
+	windows := make([]*latencyWindow, 0, len(m.windows))
+	for _, w := range m.windows {
+		windows = append(windows, w)
+	}
+	m.mu.Unlock()
+
+	for _, w := range windows {
+		percent, ok := getFuncConfInt(w.servKey, w.funcName, TimeoutInferPercentile)
+		if !ok || percent <= 0 || percent > 100 {
+			percent = defaultTimeoutInferPercentile
+		}
+		m.mu.Lock()
+		w.percentile = w.compute(percent)
+		m.mu.Unlock()
+	}
+}
+
+func (m *timeoutInferrer) percentile(servKey, funcName string) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if w, ok := m.windows[xutil.Concat(servKey, ".", funcName)]; ok {
+		return w.percentile
+	}
+	return 0
+}
+
+// inferTimeout 未开启推算或样本不足时返回 false
+func inferTimeout(servKey, funcName string, static time.Duration) (time.Duration, bool) {
+	factor, ok := getFuncConfInt(servKey, funcName, TimeoutInfer)
+	if !ok || factor <= 0 {
+		return 0, false
+	}
+	p := getTimeoutInferrer().percentile(servKey, funcName)
+	if p == 0 {
+		return 0, false
+	}
+
+	min := defaultTimeoutMin
+	if t, ok := getFuncConfInt(servKey, funcName, TimeoutMin); ok && t > 0 {
+		min = time.Duration(t) * time.Millisecond
+	}
+	max := static
+	if t, ok := getFuncConfInt(servKey, funcName, TimeoutMax); ok && t > 0 {
+		max = time.Duration(t) * time.Millisecond
+	}
+	d := clampTimeout(p*time.Duration(factor)/100, min, max)
+
+	group, service := GetGroupAndService()
+	_metricInferredTimeout.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelCalleeService, servKey, xprom.LabelAPI, funcName).Set(d.Seconds())
+	return d, true
+}
+
+// clampTimeout max 为 0 表示没有上限
+func clampTimeout(d, min, max time.Duration) time.Duration {
+	if d < min {
+		d = min
+	}
+	if max > 0 && d > max {
+		d = max
+	}
+	return d
+}
@@ -0,0 +1,41 @@
+package rocserv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutInferrer(t *testing.T) {
+	ass := assert.New(t)
+
+	m := &timeoutInferrer{windows: make(map[string]*latencyWindow)}
+	for i := 1; i < timeoutInferMinSamples; i++ {
+		m.observe("base/account", "GetUser", time.Duration(i)*time.Millisecond)
+	}
+	m.update()
+	ass.Equal(time.Duration(0), m.percentile("base/account", "GetUser"))
+
+	m.observe("base/account", "GetUser", 100*time.Millisecond)
+	m.update()
+	ass.Equal(99*time.Millisecond, m.percentile("base/account", "GetUser"))
+	ass.Equal(time.Duration(0), m.percentile("base/account", "GetName"))
+
+	// 窗口满后覆盖最早的样本
+	for i := 0; i < timeoutInferWindow; i++ {
+		m.observe("base/account", "GetUser", 5*time.Millisecond)
+	}
+	m.update()
+	ass.Equal(5*time.Millisecond, m.percentile("base/account", "GetUser"))
+	ass.Len(m.windows["base/account.GetUser"].samples, timeoutInferWindow)
+
+	ass.Equal(10*time.Millisecond, clampTimeout(time.Millisecond, 10*time.Millisecond, time.Second))
+	ass.Equal(time.Second, clampTimeout(2*time.Second, 10*time.Millisecond, time.Second))
+	ass.Equal(2*time.Second, clampTimeout(2*time.Second, 10*time.Millisecond, 0))
+
+	// 未配置时不推算
+	_, ok := inferTimeout("base/account", "GetUser", time.Second)
+	ass.False(ok)
+	ass.Equal(time.Second, GetFuncTimeout("base/account", "GetUser", time.Second))
+}
@@ -0,0 +1,673 @@
+package rocserv
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.pri.ibanyu.com/middleware/seaweed/xtime"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+// 快照目录 {baseLoc}/dist2_snapshot/{servKey} 带 ttl, 由 leader 刷新, 其下:
+// base 为全量实例, delta/{seq} 为之后按顺序的增量, leader 为持有者;
+// 值均为 gzip 压缩后 base64 编码的 json
+const (
+	topologySnapshotBase   = "base"
+	topologySnapshotDelta  = "delta"
+	topologySnapshotLeader = "leader"
+
+	// 增量超过该数量后重新生成全量快照
+	topologyDeltaLimit = 32
+	// leader 退出后快照过期, 客户端改用实例节点
+	topologySnapshotTTL       = registryTTL
+	topologySnapshotHeartbeat = registryHeartbeat
+	// 合并该时间内的实例变更, 生成一个增量
+	topologyCoalesce = time.Second
+	// 使用实例节点时检查快照是否出现的间隔, 实例变更时也会检查
+	topologySnapshotCheckInterval = 5 * time.Minute
+)
+
+var (
+	errTopologySnapshotNotFound = errors.New("topology snapshot not found")
+	errTopologyLeaderChanged    = errors.New("topology snapshot leader changed")
+	errNewWatcher               = errors.New("new etcd watcher failed")
+)
+
+// topologyInstance 与 dist2 下一个实例节点的内容相同
+type topologyInstance struct {
+	Servid int           `json:"servid"`
+	Reg    *RegData      `json:"reg"`
+	Manual *ManualData   `json:"manual"`
+	Load   *InstanceLoad `json:"load,omitempty"`
+}
+
+type topologyBase struct {
+	Seq       uint64              `json:"seq"`
+	Instances []*topologyInstance `json:"instances"`
+}
+
+type topologyDelta struct {
+	Seq    uint64              `json:"seq"`
+	Upsert []*topologyInstance `json:"upsert,omitempty"`
+	Remove []int               `json:"remove,omitempty"`
+}
+
+func topologySnapshotPath(baseLoc, servKey string) string {
+	return fmt.Sprintf("%s/%s/%s", baseLoc, BASE_LOC_DIST_SNAPSHOT, servKey)
+}
+
+func encodeTopology(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeTopology(value string, v interface{}) error {
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	data, err = ioutil.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func newTopologyInstance(c *servCopyData) *topologyInstance {
+	return &topologyInstance{Servid: c.servId, Reg: c.reg, Manual: c.manual, Load: c.load}
+}
+
+func (m *topologyInstance) servCopy() *servCopyData {
+	reg, manual := m.Reg, m.Manual
+	if reg == nil {
+		reg = &RegData{}
+	}
+	if manual == nil {
+		manual = &ManualData{}
+	}
+	if manual.Ctrl == nil {
+		manual.Ctrl = &ServCtrl{}
+	}
+	if len(manual.Ctrl.Groups) == 0 {
+		manual.Ctrl.Groups = []string{""}
+	}
+	return &servCopyData{servId: m.Servid, reg: reg, manual: manual, load: m.Load}
+}
+
+// topologyState 客户端由全量快照及增量得到的实例列表
+type topologyState struct {
+	seq       uint64
+	instances map[int]*topologyInstance
+}
+
+func (m *topologyState) apply(d *topologyDelta) {
+	for _, ins := range d.Upsert {
+		m.instances[ins.Servid] = ins
+	}
+	for _, sid := range d.Remove {
+		delete(m.instances, sid)
+	}
+	m.seq = d.Seq
+}
+
+func (m *topologyState) servCopy() servCopyCollect {
+	scopy := make(servCopyCollect, len(m.instances))
+	for sid, ins := range m.instances {
+		scopy[sid] = ins.servCopy()
+	}
+	return scopy
+}
+
+// parseTopologySnapshot 应用全量快照之后连续的增量, node 为按 key 排序获取的快照目录
+func parseTopologySnapshot(snapPath string, node *etcd.Node) (*topologyState, error) {
+	var base *etcd.Node
+	var deltas etcd.Nodes
+	for _, n := range node.Nodes {
+		switch n.Key {
+		case snapPath + "/" + topologySnapshotBase:
+			base = n
+		case snapPath + "/" + topologySnapshotDelta:
+			deltas = n.Nodes
+		}
+	}
+	if base == nil {
+		return nil, errTopologySnapshotNotFound
+	}
+
+	var b topologyBase
+	if err := decodeTopology(base.Value, &b); err != nil {
+		return nil, fmt.Errorf("decode topology snapshot base err: %v", err)
+	}
+	state := &topologyState{seq: b.Seq, instances: make(map[int]*topologyInstance, len(b.Instances))}
+	for _, ins := range b.Instances {
+		state.instances[ins.Servid] = ins
+	}
+
+	sort.Slice(deltas, func(i, j int) bool {
+		return deltas[i].Key < deltas[j].Key
+	})
+	for _, n := range deltas {
+		var d topologyDelta
+		if err := decodeTopology(n.Value, &d); err != nil {
+			return nil, fmt.Errorf("decode topology snapshot delta: %s err: %v", n.Key, err)
+		}
+		if d.Seq <= state.seq {
+			continue
+		}
+		if d.Seq != state.seq+1 {
+			break
+		}
+		state.apply(&d)
+	}
+	return state, nil
+}
+
+// topologyPublisher 选举为 leader 的实例根据实例节点维护拓扑快照
+type topologyPublisher struct {
+	client   etcd.KeysAPI
+	servPath string
+	snapPath string
+	owner    string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// 以下字段只在 run 协程中使用
+	seq       uint64
+	deltas    int
+	baseIndex uint64
+	// servid -> 已发布的实例 json
+	published map[int]string
+}
+
+func newTopologyPublisher(client etcd.KeysAPI, servPath, snapPath, owner string) *topologyPublisher {
+	return &topologyPublisher{
+		client:   client,
+		servPath: servPath,
+		snapPath: snapPath,
+		owner:    owner,
+		done:     make(chan struct{}),
+	}
+}
+
+// startTopologySnapshot 参与拓扑快照 leader 选举, 同锁一样预发环境不参与
+func (m *ServBaseV2) startTopologySnapshot() {
+	if m.isPreEnvGroup() {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := newTopologyPublisher(m.etcdClient,
+		fmt.Sprintf("%s/%s/%s", m.confEtcd.useBaseloc, BASE_LOC_DIST_V2, m.servLocation),
+		topologySnapshotPath(m.confEtcd.useBaseloc, m.servLocation),
+		m.lockValue())
+	p.cancel = cancel
+	m.topology = p
+	go p.run(ctx)
+}
+
+// stopTopologySnapshot leader 删除快照, 客户端立即改用实例节点
+func (m *ServBaseV2) stopTopologySnapshot() {
+	if m.topology == nil {
+		return
+	}
+	m.topology.cancel()
+	<-m.topology.done
+}
+
+func (m *topologyPublisher) run(ctx context.Context) {
+	fun := "topologyPublisher.run -->"
+	defer close(m.done)
+
+	for {
+		led, err := m.campaign(ctx)
+		if led {
+			if err == nil {
+				logger().Infof(ctx, "%s lead topology snapshot: %s", fun, m.snapPath)
+				err = m.lead(ctx)
+			}
+			m.resign()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger().Warnf(ctx, "%s topology snapshot: %s err: %v", fun, m.snapPath, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(topologySnapshotHeartbeat):
+		}
+	}
+}
+
+// campaign 创建快照目录成功即为 leader
+func (m *topologyPublisher) campaign(ctx context.Context) (bool, error) {
+	_, err := m.client.Set(ctx, m.snapPath, "", &etcd.SetOptions{
+		Dir:       true,
+		PrevExist: etcd.PrevNoExist,
+		TTL:       topologySnapshotTTL,
+	})
+	if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeNodeExist {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	m.seq, m.deltas, m.baseIndex, m.published = 0, 0, 0, nil
+	_, err = m.client.Set(ctx, m.snapPath+"/"+topologySnapshotLeader, m.owner, nil)
+	return true, err
+}
+
+func (m *topologyPublisher) lead(ctx context.Context) error {
+	index, err := m.publish(ctx, true)
+	if err != nil {
+		return err
+	}
+
+	refreshed := time.Now()
+	for {
+		wctx, cancel := context.WithTimeout(ctx, topologySnapshotHeartbeat)
+		var werr error
+		if w := m.client.Watcher(m.servPath, &etcd.WatcherOptions{Recursive: true, AfterIndex: index}); w != nil {
+			_, werr = w.Next(wctx)
+		} else {
+			werr = errNewWatcher
+		}
+		timeout := wctx.Err() == context.DeadlineExceeded
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if time.Since(refreshed) >= topologySnapshotHeartbeat {
+			if err := m.refresh(ctx); err != nil {
+				return err
+			}
+			refreshed = time.Now()
+		}
+
+		switch {
+		case timeout:
+			continue
+		case isWatchCompacted(werr):
+			index, err = m.publish(ctx, true)
+		case werr != nil:
+			return werr
+		default:
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(topologyCoalesce):
+			}
+			index, err = m.publish(ctx, false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// refresh 确认仍是 leader 后刷新快照目录的 ttl
+func (m *topologyPublisher) refresh(ctx context.Context) error {
+	r, err := m.client.Get(ctx, m.snapPath+"/"+topologySnapshotLeader, nil)
+	if err != nil {
+		return err
+	}
+	if r.Node == nil || r.Node.Value != m.owner {
+		return errTopologyLeaderChanged
+	}
+
+	_, err = m.client.Set(ctx, m.snapPath, "", &etcd.SetOptions{
+		Dir:       true,
+		PrevExist: etcd.PrevExist,
+		TTL:       topologySnapshotTTL,
+		Refresh:   true,
+	})
+	return err
+}
+
+// resign 仍是 leader 时删除快照
+func (m *topologyPublisher) resign() {
+	fun := "topologyPublisher.resign -->"
+	ctx := context.Background()
+
+	r, err := m.client.Get(ctx, m.snapPath+"/"+topologySnapshotLeader, nil)
+	if err != nil || r.Node == nil || r.Node.Value != m.owner {
+		return
+	}
+	_, err = m.client.Delete(ctx, m.snapPath, &etcd.DeleteOptions{Recursive: true, Dir: true})
+	logger().Infof(ctx, "%s delete topology snapshot: %s err: %v", fun, m.snapPath, err)
+}
+
+// publish 获取全部实例节点, 与已发布的比较后写入增量, full 或增量过多时写入全量快照; 返回获取时的 index
+func (m *topologyPublisher) publish(ctx context.Context, full bool) (uint64, error) {
+	fun := "topologyPublisher.publish -->"
+
+	r, err := m.client.Get(ctx, m.servPath, &etcd.GetOptions{Recursive: true})
+	var index uint64
+	scopy := servCopyCollect{}
+	if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+		index = e.Index
+	} else if err != nil {
+		return 0, err
+	} else {
+		index = r.Index
+		var ok bool
+		if scopy, ok = parseServCopyV2(m.servPath, r); !ok {
+			return index, nil
+		}
+	}
+
+	current := make(map[int]string, len(scopy))
+	instances := make(map[int]*topologyInstance, len(scopy))
+	for sid, c := range scopy {
+		ins := newTopologyInstance(c)
+		js, err := json.Marshal(ins)
+		if err != nil {
+			return index, err
+		}
+		current[sid] = string(js)
+		instances[sid] = ins
+	}
+
+	if full || m.published == nil || m.deltas >= topologyDeltaLimit {
+		err = m.writeBase(ctx, instances)
+	} else {
+		err = m.writeDelta(ctx, current, instances)
+	}
+	if err != nil {
+		return index, err
+	}
+	m.published = current
+	logger().Infof(ctx, "%s topology snapshot: %s seq: %d len: %d", fun, m.snapPath, m.seq, len(current))
+	return index, nil
+}
+
+// writeBase 使用 PrevIndex 写入, 防止失去 leader 后覆盖新 leader 的快照; 写入后删除旧的增量
+func (m *topologyPublisher) writeBase(ctx context.Context, instances map[int]*topologyInstance) error {
+	b := &topologyBase{Seq: m.seq + 1}
+	for _, ins := range instances {
+		b.Instances = append(b.Instances, ins)
+	}
+	sort.Slice(b.Instances, func(i, j int) bool {
+		return b.Instances[i].Servid < b.Instances[j].Servid
+	})
+	value, err := encodeTopology(b)
+	if err != nil {
+		return err
+	}
+
+	opts := &etcd.SetOptions{PrevIndex: m.baseIndex}
+	if m.baseIndex == 0 {
+		opts = &etcd.SetOptions{PrevExist: etcd.PrevNoExist}
+	}
+	r, err := m.client.Set(ctx, m.snapPath+"/"+topologySnapshotBase, value, opts)
+	if err != nil {
+		return err
+	}
+	m.seq = b.Seq
+	m.baseIndex = r.Node.ModifiedIndex
+	m.deltas = 0
+
+	_, err = m.client.Delete(ctx, m.snapPath+"/"+topologySnapshotDelta, &etcd.DeleteOptions{Recursive: true, Dir: true})
+	if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+// writeDelta 增量 key 不可覆盖, 失去 leader 后写入失败
+func (m *topologyPublisher) writeDelta(ctx context.Context, current map[int]string, instances map[int]*topologyInstance) error {
+	d := &topologyDelta{Seq: m.seq + 1}
+	for sid, js := range current {
+		if m.published[sid] != js {
+			d.Upsert = append(d.Upsert, instances[sid])
+		}
+	}
+	for sid := range m.published {
+		if _, ok := current[sid]; !ok {
+			d.Remove = append(d.Remove, sid)
+		}
+	}
+	if len(d.Upsert) == 0 && len(d.Remove) == 0 {
+		return nil
+	}
+	sort.Slice(d.Upsert, func(i, j int) bool {
+		return d.Upsert[i].Servid < d.Upsert[j].Servid
+	})
+	sort.Ints(d.Remove)
+
+	value, err := encodeTopology(d)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s/%s/%020d", m.snapPath, topologySnapshotDelta, d.Seq)
+	if _, err := m.client.Set(ctx, key, value, &etcd.SetOptions{PrevExist: etcd.PrevNoExist}); err != nil {
+		return err
+	}
+	m.seq = d.Seq
+	m.deltas++
+	return nil
+}
+
+func (m *ClientEtcdV2) topologySnapshotPath() string {
+	return topologySnapshotPath(m.confEtcd.useBaseloc, m.servKey)
+}
+
+// hasTopologySnapshot 全量快照存在且可以解析
+func hasTopologySnapshot(ctx context.Context, client etcd.KeysAPI, snapPath string) bool {
+	r, err := client.Get(ctx, snapPath+"/"+topologySnapshotBase, nil)
+	if err != nil || r.Node == nil {
+		return false
+	}
+	var b topologyBase
+	return decodeTopology(r.Node.Value, &b) == nil
+}
+
+// watchServ dist2 的服务存在拓扑快照时优先使用快照, 否则使用实例节点
+func (m *ClientEtcdV2) watchServ() {
+	fun := "ClientEtcdV2.watchServ -->"
+	ctx := context.Background()
+
+	if m.distLoc != BASE_LOC_DIST_V2 {
+		m.watch(m.servPath, m.parseResponse, time.Second*5)
+		return
+	}
+
+	firstSync := make(chan bool)
+	var firstOnce sync.Once
+	synced := func() {
+		firstOnce.Do(func() {
+			close(firstSync)
+		})
+	}
+
+	go func() {
+		backoff := xtime.NewBackOffCtrl(time.Millisecond*100, time.Second*5)
+		for {
+			err := m.followTopologySnapshot(ctx, synced)
+			if err == errTopologySnapshotNotFound {
+				err = m.followInstances(ctx, synced)
+			}
+			synced()
+			if err != nil {
+				// 同 startWatch, 服务未部署时 key 不存在
+				logger().Infof(ctx, "%s serv: %s err: %v", fun, m.servPath, err)
+				backoff.BackOff()
+				continue
+			}
+			backoff.Reset()
+		}
+	}()
+
+	select {
+	case <-firstSync:
+		logger().Infof(ctx, "%s init ok, serv:%s", fun, m.servPath)
+	case <-time.After(time.Second):
+		logger().Warnf(ctx, "%s init timeout, serv:%s", fun, m.servPath)
+	}
+}
+
+// followTopologySnapshot 使用快照直到快照失效, 快照不存在时返回 errTopologySnapshotNotFound
+func (m *ClientEtcdV2) followTopologySnapshot(ctx context.Context, synced func()) error {
+	fun := "ClientEtcdV2.followTopologySnapshot -->"
+
+	snapPath := m.topologySnapshotPath()
+	release := func() {}
+	defer func() { release() }()
+	for {
+		r, err := m.etcdClient.Get(ctx, snapPath, &etcd.GetOptions{Recursive: true, Sort: true})
+		release()
+		release = func() {}
+		if e, ok := err.(etcd.Error); ok && e.Code == etcd.ErrorCodeKeyNotFound {
+			return errTopologySnapshotNotFound
+		}
+		if err != nil {
+			return err
+		}
+		state, err := parseTopologySnapshot(snapPath, r.Node)
+		if err != nil {
+			return err
+		}
+		logger().Infof(ctx, "%s serv: %s seq: %d len: %d", fun, m.servKey, state.seq, len(state.instances))
+		m.upServlist(state.servCopy())
+		synced()
+
+		err = m.followTopologyDeltas(ctx, snapPath, state, r.Index)
+		if isWatchCompacted(err) {
+			release = waitCompactedResync(ctx, watchKindRegistry, snapPath)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// followTopologyDeltas 依次应用增量, 全量快照更新或增量不连续时返回 nil, 由调用方重新获取
+func (m *ClientEtcdV2) followTopologyDeltas(ctx context.Context, snapPath string, state *topologyState, index uint64) error {
+	fun := "ClientEtcdV2.followTopologyDeltas -->"
+
+	deltaPrefix := snapPath + "/" + topologySnapshotDelta + "/"
+	for {
+		w := m.etcdClient.Watcher(snapPath, &etcd.WatcherOptions{Recursive: true, AfterIndex: index})
+		if w == nil {
+			return errNewWatcher
+		}
+		resp, err := w.Next(ctx)
+		if err != nil {
+			return err
+		}
+		index = resp.Index
+
+		key := resp.Node.Key
+		switch {
+		case key == snapPath:
+			// leader 退出或者没有刷新 ttl
+			logger().Warnf(ctx, "%s serv: %s topology snapshot %s, use instance nodes", fun, m.servKey, resp.Action)
+			return errTopologySnapshotNotFound
+		case key == snapPath+"/"+topologySnapshotBase:
+			return nil
+		case strings.HasPrefix(key, deltaPrefix) && len(resp.Node.Value) > 0:
+			var d topologyDelta
+			if err := decodeTopology(resp.Node.Value, &d); err != nil {
+				return fmt.Errorf("decode topology snapshot delta: %s err: %v", key, err)
+			}
+			if d.Seq <= state.seq {
+				continue
+			}
+			if d.Seq != state.seq+1 {
+				return nil
+			}
+			state.apply(&d)
+			m.upServlist(state.servCopy())
+		}
+	}
+}
+
+// followInstances 使用实例节点, 快照出现时返回 nil
+func (m *ClientEtcdV2) followInstances(ctx context.Context, synced func()) error {
+	fun := "ClientEtcdV2.followInstances -->"
+
+	snapPath := m.topologySnapshotPath()
+	release := func() {}
+	defer func() { release() }()
+	for {
+		if hasTopologySnapshot(ctx, m.etcdClient, snapPath) {
+			logger().Infof(ctx, "%s serv: %s use topology snapshot", fun, m.servKey)
+			return nil
+		}
+
+		waitRegistryRead(ctx, m.servPath)
+		r, err := m.etcdClient.Get(ctx, m.servPath, &etcd.GetOptions{Recursive: true, Sort: false})
+		release()
+		release = func() {}
+		if err != nil {
+			return err
+		}
+		m.parseResponse(r)
+		synced()
+
+		err = m.waitInstances(ctx, snapPath, r.Index)
+		if isWatchCompacted(err) {
+			release = waitCompactedResync(ctx, watchKindRegistry, m.servPath)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// waitInstances 等待实例变更, 期间定期检查快照是否出现
+func (m *ClientEtcdV2) waitInstances(ctx context.Context, snapPath string, index uint64) error {
+	for {
+		w := m.etcdClient.Watcher(m.servPath, &etcd.WatcherOptions{Recursive: true, AfterIndex: index})
+		if w == nil {
+			return errNewWatcher
+		}
+		wctx, cancel := context.WithTimeout(ctx, topologySnapshotCheckInterval)
+		_, err := w.Next(wctx)
+		timeout := wctx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+		if !timeout {
+			return err
+		}
+		if hasTopologySnapshot(ctx, m.etcdClient, snapPath) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package rocserv
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// treeKeysAPI 按 key 前缀组成目录的内存 kv, 支持 PrevExist 及 PrevIndex
+type treeKeysAPI struct {
+	etcd.KeysAPI
+	index  uint64
+	values map[string]*etcd.Node
+	dirs   map[string]bool
+}
+
+func (m *treeKeysAPI) tree(key string) *etcd.Node {
+	if n, ok := m.values[key]; ok {
+		return n
+	}
+	dir := &etcd.Node{Key: key, Dir: true}
+	seen := map[string]bool{}
+	for k := range m.values {
+		if !strings.HasPrefix(k, key+"/") {
+			continue
+		}
+		child := key + "/" + strings.SplitN(k[len(key)+1:], "/", 2)[0]
+		if !seen[child] {
+			seen[child] = true
+			dir.Nodes = append(dir.Nodes, m.tree(child))
+		}
+	}
+	if len(dir.Nodes) == 0 {
+		return nil
+	}
+	return dir
+}
+
+func (m *treeKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	n := m.tree(key)
+	if n == nil {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound, Index: m.index}
+	}
+	return &etcd.Response{Node: n, Index: m.index}, nil
+}
+
+func (m *treeKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	n, ok := m.values[key]
+	if opts != nil && opts.PrevExist == etcd.PrevNoExist && (ok || m.dirs[key] || m.tree(key) != nil) {
+		return nil, etcd.Error{Code: etcd.ErrorCodeNodeExist}
+	}
+	if opts != nil && opts.PrevIndex > 0 && (!ok || n.ModifiedIndex != opts.PrevIndex) {
+		return nil, etcd.Error{Code: etcd.ErrorCodeTestFailed}
+	}
+	m.index++
+	if opts != nil && opts.Dir {
+		m.dirs[key] = true
+		return &etcd.Response{Node: &etcd.Node{Key: key, Dir: true, ModifiedIndex: m.index}}, nil
+	}
+	m.values[key] = &etcd.Node{Key: key, Value: value, ModifiedIndex: m.index}
+	return &etcd.Response{Node: m.values[key]}, nil
+}
+
+func (m *treeKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	found := m.dirs[key]
+	delete(m.dirs, key)
+	for k := range m.values {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(m.values, k)
+			found = true
+		}
+	}
+	if !found {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	}
+	m.index++
+	return &etcd.Response{}, nil
+}
+
+func (m *treeKeysAPI) setInstance(path string, sid int, addr string, weight int) {
+	reg, _ := json.Marshal(NewRegData(map[string]*ServInfo{"proc_grpc": {Type: "grpc", Addr: addr}}, ""))
+	manual, _ := json.Marshal(&ManualData{Ctrl: &ServCtrl{Weight: weight, Groups: []string{""}}})
+	m.Set(context.Background(), path+"/"+strconv.Itoa(sid)+"/"+BASE_LOC_REG_SERV, string(reg), nil)
+	m.Set(context.Background(), path+"/"+strconv.Itoa(sid)+"/"+BASE_LOC_REG_MANUAL, string(manual), nil)
+}
+
+func TestTopologyPublisher(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	servPath := "/roc/dist2/base/account"
+	snapPath := topologySnapshotPath("/roc", "base/account")
+	ass.Equal("/roc/dist2_snapshot/base/account", snapPath)
+
+	client := &treeKeysAPI{values: map[string]*etcd.Node{}, dirs: map[string]bool{}}
+	client.setInstance(servPath, 1, "10.0.0.1:9000", 100)
+	client.setInstance(servPath, 2, "10.0.0.2:9000", 100)
+
+	p := newTopologyPublisher(client, servPath, snapPath, "base/account/1:skey")
+	led, err := p.campaign(ctx)
+	ass.True(led)
+	ass.Nil(err)
+	led, err = newTopologyPublisher(client, servPath, snapPath, "base/account/2:skey").campaign(ctx)
+	ass.False(led)
+	ass.Nil(err)
+
+	_, err = p.publish(ctx, true)
+	ass.Nil(err)
+	ass.True(hasTopologySnapshot(ctx, client, snapPath))
+
+	client.setInstance(servPath, 2, "10.0.0.2:9000", 50)
+	client.setInstance(servPath, 3, "10.0.0.3:9000", 100)
+	_, err = p.publish(ctx, false)
+	ass.Nil(err)
+	client.Delete(ctx, servPath+"/1", nil)
+	_, err = p.publish(ctx, false)
+	ass.Nil(err)
+	// 没有变更时不写增量
+	_, err = p.publish(ctx, false)
+	ass.Nil(err)
+	ass.Equal(uint64(3), p.seq)
+	ass.Len(client.tree(snapPath+"/"+topologySnapshotDelta).Nodes, 2)
+
+	state, err := parseTopologySnapshot(snapPath, client.tree(snapPath))
+	ass.Nil(err)
+	ass.Equal(uint64(3), state.seq)
+	scopy := state.servCopy()
+	ass.Len(scopy, 2)
+	ass.Equal(50, scopy[2].manual.Ctrl.Weight)
+	ass.Equal("10.0.0.3:9000", scopy[3].reg.Servs["proc_grpc"].Addr)
+
+	// 增量过多时重新生成全量快照并删除增量
+	p.deltas = topologyDeltaLimit
+	client.setInstance(servPath, 4, "10.0.0.4:9000", 100)
+	_, err = p.publish(ctx, false)
+	ass.Nil(err)
+	ass.Nil(client.tree(snapPath + "/" + topologySnapshotDelta))
+	state, err = parseTopologySnapshot(snapPath, client.tree(snapPath))
+	ass.Nil(err)
+	ass.Equal(uint64(4), state.seq)
+	ass.Len(state.instances, 3)
+
+	// 失去 leader 后不删除新 leader 的快照
+	client.Set(ctx, snapPath+"/"+topologySnapshotLeader, "base/account/2:skey", nil)
+	ass.Equal(errTopologyLeaderChanged, p.refresh(ctx))
+	p.resign()
+	ass.True(hasTopologySnapshot(ctx, client, snapPath))
+
+	client.Set(ctx, snapPath+"/"+topologySnapshotLeader, "base/account/1:skey", nil)
+	p.resign()
+	ass.False(hasTopologySnapshot(ctx, client, snapPath))
+}
+
+func TestTopologyStateApply(t *testing.T) {
+	ass := assert.New(t)
+
+	state := &topologyState{seq: 1, instances: map[int]*topologyInstance{1: {Servid: 1}, 2: {Servid: 2}}}
+	state.apply(&topologyDelta{Seq: 2, Upsert: []*topologyInstance{{Servid: 3}}, Remove: []int{1}})
+	ass.Equal(uint64(2), state.seq)
+	ass.Len(state.instances, 2)
+
+	// 缺少字段的实例与实例节点解析结果一致
+	c := state.servCopy()[3]
+	ass.NotNil(c.reg)
+	ass.Equal([]string{""}, c.manual.Ctrl.Groups)
+
+	value, err := encodeTopology(&topologyDelta{Seq: 5, Remove: []int{7}})
+	ass.Nil(err)
+	var d topologyDelta
+	ass.Nil(decodeTopology(value, &d))
+	ass.Equal(topologyDelta{Seq: 5, Remove: []int{7}}, d)
+	ass.NotNil(decodeTopology("not base64", &d))
+}
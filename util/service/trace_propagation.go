@@ -0,0 +1,132 @@
+package rocserv
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/uber/jaeger-client-go"
+)
+
+// 标准环境变量, 逗号分隔的传播格式
+const tracePropagatorsEnv = "OTEL_PROPAGATORS"
+
+// tracePropagation 接受及发送的 trace 头格式
+type tracePropagation struct {
+	// 按顺序解析, 总是包含 jaeger
+	accept []string
+	// 除 uber-trace-id 之外发送的格式
+	send map[string]bool
+}
+
+var (
+	muPropagation     sync.RWMutex
+	globalPropagation = newTracePropagation([]string{PropagatorJaeger, PropagatorTraceContext, PropagatorB3}, false)
+)
+
+// newTracePropagation formats 中没有 jaeger 时仍然最后接受 uber-trace-id, 不影响 roc 服务之间的调用链
+func newTracePropagation(formats []string, send bool) *tracePropagation {
+	fun := "newTracePropagation -->"
+
+	p := &tracePropagation{send: make(map[string]bool)}
+	seen := make(map[string]bool)
+	for _, f := range append(formats, PropagatorJaeger) {
+		f = strings.ToLower(strings.TrimSpace(f))
+		switch f {
+		case PropagatorJaeger, PropagatorTraceContext, PropagatorB3, PropagatorB3Multi:
+		default:
+			if len(f) > 0 && f != "none" {
+				logger().Warnf(context.Background(), "%s unknown trace propagator: %s", fun, f)
+			}
+			continue
+		}
+		if seen[f] {
+			continue
+		}
+		seen[f] = true
+		p.accept = append(p.accept, f)
+		if send && f != PropagatorJaeger {
+			p.send[f] = true
+		}
+	}
+	return p
+}
+
+func getTracePropagation() *tracePropagation {
+	muPropagation.RLock()
+	defer muPropagation.RUnlock()
+	return globalPropagation
+}
+
+func setTracePropagation(p *tracePropagation) {
+	muPropagation.Lock()
+	defer muPropagation.Unlock()
+	globalPropagation = p
+}
+
+// SetTracePropagators set trace header formats accepted from and sent to services not using roc, such as
+// tracecontext, b3, b3multi and jaeger; when a request carries several formats the first one in formats is used.
+// Without it tracecontext and b3 are accepted but not sent unless OpenTelemetry is enabled
+func SetTracePropagators(formats ...string) {
+	setTracePropagation(newTracePropagation(formats, true))
+}
+
+// initTracePropagation 优先使用 OTelConf.Propagators, 其次环境变量 OTEL_PROPAGATORS, 开启 OpenTelemetry 时默认发送 tracecontext 及 b3
+func initTracePropagation(conf *OTelConf) {
+	fun := "initTracePropagation -->"
+
+	var formats []string
+	if conf != nil && len(conf.Propagators) > 0 {
+		formats = conf.Propagators
+	} else if env := os.Getenv(tracePropagatorsEnv); len(env) > 0 {
+		formats = strings.Split(env, ",")
+	} else if conf != nil && len(conf.Endpoint) > 0 {
+		formats = []string{PropagatorTraceContext, PropagatorB3}
+	} else {
+		return
+	}
+	SetTracePropagators(formats...)
+	logger().Infof(context.Background(), "%s propagators: %v", fun, getTracePropagation().accept)
+}
+
+// extract 按顺序解析, 使用 jaeger 头或者都没有时返回 nil
+func (m *tracePropagation) extract(get func(key string) string) *remoteTrace {
+	for _, f := range m.accept {
+		switch f {
+		case PropagatorJaeger:
+			if len(get(jaeger.TraceContextHeaderName)) > 0 {
+				return nil
+			}
+		case PropagatorTraceContext:
+			if r, ok := parseTraceparent(get(traceparentHeader)); ok {
+				return r
+			}
+		case PropagatorB3, PropagatorB3Multi:
+			if r, ok := parseB3(get); ok {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+// inject 按配置的格式输出 span, 不包括 uber-trace-id
+func (m *tracePropagation) inject(sc jaeger.SpanContext, set func(key, value string)) {
+	traceID, spanID := otelTraceID(sc.TraceID()), otelSpanID(sc.SpanID())
+	sampled := "0"
+	if sc.IsSampled() {
+		sampled = "1"
+	}
+	if m.send[PropagatorTraceContext] {
+		set(traceparentHeader, "00-"+traceID+"-"+spanID+"-0"+sampled)
+	}
+	if m.send[PropagatorB3] {
+		set(b3Header, traceID+"-"+spanID+"-"+sampled)
+	}
+	if m.send[PropagatorB3Multi] {
+		set(b3TraceIDHeader, traceID)
+		set(b3SpanIDHeader, spanID)
+		set(b3SampledHeader, sampled)
+	}
+}
@@ -0,0 +1,87 @@
+package rocserv
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/uber/jaeger-client-go"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTracePropagationOrder(t *testing.T) {
+	ass := assert.New(t)
+
+	h := http.Header{}
+	h.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.Set(b3Header, "a3ce929d0e0e4736-00f067aa0ba902b7-1")
+	h.Set(jaeger.TraceContextHeaderName, "1:2:0:1")
+
+	// 默认 jaeger 优先
+	ass.Nil(newTracePropagation([]string{PropagatorJaeger, PropagatorTraceContext, PropagatorB3}, false).extract(h.Get))
+	// 按配置顺序解析, 没有配置 jaeger 时 jaeger 最后
+	p := newTracePropagation([]string{"B3", PropagatorTraceContext}, true)
+	ass.Equal([]string{PropagatorB3, PropagatorTraceContext, PropagatorJaeger}, p.accept)
+	ass.Equal("0000000000000000a3ce929d0e0e4736", p.extract(h.Get).traceID)
+	p = newTracePropagation([]string{PropagatorTraceContext, "unknown", PropagatorB3}, true)
+	ass.Equal("4bf92f3577b34da6a3ce929d0e0e4736", p.extract(h.Get).traceID)
+	ass.Nil(newTracePropagation([]string{"none"}, true).extract(h.Get))
+
+	// b3multi 发送多头
+	p = newTracePropagation([]string{PropagatorB3Multi}, true)
+	sc := jaeger.NewSpanContext(jaeger.TraceID{High: 1, Low: 2}, jaeger.SpanID(3), 0, false, nil)
+	out := http.Header{}
+	p.inject(sc, out.Set)
+	ass.Equal("00000000000000010000000000000002", out.Get("X-B3-TraceId"))
+	ass.Equal("0000000000000003", out.Get("X-B3-SpanId"))
+	ass.Equal("0", out.Get("X-B3-Sampled"))
+	ass.Empty(out.Get(b3Header))
+	ass.Empty(out.Get(traceparentHeader))
+	r, ok := parseB3(out.Get)
+	ass.True(ok)
+	ass.Equal("00000000000000010000000000000002", r.traceID)
+}
+
+func TestInitTracePropagation(t *testing.T) {
+	ass := assert.New(t)
+	defer setTracePropagation(getTracePropagation())
+	defer os.Unsetenv(tracePropagatorsEnv)
+
+	initTracePropagation(nil)
+	ass.Empty(getTracePropagation().send)
+
+	os.Setenv(tracePropagatorsEnv, "b3multi,tracecontext")
+	initTracePropagation(nil)
+	ass.Equal([]string{PropagatorB3Multi, PropagatorTraceContext, PropagatorJaeger}, getTracePropagation().accept)
+	ass.True(getTracePropagation().send[PropagatorB3Multi])
+
+	// OTelConf 优先
+	initTracePropagation(&OTelConf{Endpoint: "http://127.0.0.1:4318", Propagators: []string{PropagatorB3}})
+	ass.Equal([]string{PropagatorB3, PropagatorJaeger}, getTracePropagation().accept)
+
+	os.Unsetenv(tracePropagatorsEnv)
+	initTracePropagation(&OTelConf{Endpoint: "http://127.0.0.1:4318"})
+	ass.Equal(map[string]bool{PropagatorTraceContext: true, PropagatorB3: true}, getTracePropagation().send)
+}
+
+func TestTraceContextWithoutOTel(t *testing.T) {
+	ass := assert.New(t)
+	defer setTracePropagation(getTracePropagation())
+	SetTracePropagators(PropagatorTraceContext)
+
+	var got string
+	h := traceContextHttpMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(jaeger.TraceContextHeaderName)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	ass.Equal("4bf92f3577b34da6a3ce929d0e0e4736:00f067aa0ba902b7:0:1", got)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"))
+	md, _ := metadata.FromIncomingContext(traceContextIncoming(ctx))
+	ass.Equal([]string{"4bf92f3577b34da6a3ce929d0e0e4736:00f067aa0ba902b7:0:0"}, md.Get(jaeger.TraceContextHeaderName))
+}
@@ -8,7 +8,6 @@ import (
 	"strings"
 
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xcontext"
-	"gitlab.pri.ibanyu.com/middleware/seaweed/xlog"
 	"gitlab.pri.ibanyu.com/middleware/seaweed/xtrace"
 
 	"github.com/uber/jaeger-client-go"
@@ -40,7 +39,7 @@ func trafficKVFromContext(ctx context.Context) (kv map[string]interface{}) {
 	kv = map[string]interface{}{}
 
 	kv[TrafficLogKeyUID], _ = xcontext.GetUID(ctx)
-	kv[TrafficLogKeyGroup] = xcontext.GetControlRouteGroupWithDefault(ctx, xcontext.DefaultGroup)
+	kv[TrafficLogKeyGroup] = LaneFromContext(ctx)
 
 	if callerName, ok := xcontext.GetControlCallerServerName(ctx); ok {
 		kv[TrafficLogKeyCaller] = callerName
@@ -82,5 +81,5 @@ func serviceFromServPath(spath string) string {
 
 func logTrafficByKV(ctx context.Context, kv map[string]interface{}) {
 	bs, _ := json.Marshal(kv)
-	xlog.Infof(ctx, "%s\t%s", TrafficLogID, string(bs))
+	logger().Infof(ctx, "%s\t%s", TrafficLogID, string(bs))
 }
@@ -54,8 +54,16 @@ func GetFuncNameWithCtx(ctx context.Context, index int) string {
 	return funcName
 }
 
-// GetFuncTimeout get func timeout conf
+// GetFuncTimeout get func timeout conf, timeout is inferred from latency percentile if timeoutInfer is configured
 func GetFuncTimeout(servKey, funcName string, defaultTime time.Duration) time.Duration {
+	static := getStaticFuncTimeout(servKey, funcName, defaultTime)
+	if d, ok := inferTimeout(servKey, funcName, static); ok {
+		return d
+	}
+	return static
+}
+
+func getStaticFuncTimeout(servKey, funcName string, defaultTime time.Duration) time.Duration {
 	key := xutil.Concat(servKey, ".", funcName, ".", Timeout)
 	var t int
 	var exist bool
@@ -75,16 +83,7 @@ func GetFuncTimeout(servKey, funcName string, defaultTime time.Duration) time.Du
 
 // GetFuncRetry get func retry conf
 func GetFuncRetry(servKey, funcName string) int {
-	key := xutil.Concat(servKey, ".", funcName, ".", Retry)
-	var t int
-	var exist bool
-	confCenter := GetConfigCenter()
-	if confCenter != nil {
-		if t, exist = confCenter.GetIntWithNamespace(context.TODO(), RPCConfNamespace, key); !exist {
-			defaultKey := xutil.Concat(servKey, ".", Default, ".", Retry)
-			t, _ = confCenter.GetIntWithNamespace(context.TODO(), RPCConfNamespace, defaultKey)
-		}
-	}
+	t, _ := getFuncConfInt(servKey, funcName, Retry)
 	return t
 }
 
@@ -113,5 +112,5 @@ type Logger struct {
 }
 
 func (m *Logger) Printf(format string, items ...interface{}) {
-	xlog.Errorf(context.Background(), format, items...)
+	logger().Errorf(context.Background(), format, items...)
 }
@@ -0,0 +1,496 @@
+package rocserv
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// webhook event status
+const (
+	WebhookPending = "pending"
+	WebhookDone    = "done"
+	WebhookFailed  = "failed"
+)
+
+const (
+	// 接收路径, name 为 WebhookEndpoint.Name
+	webhookPath = "/webhook/:name"
+
+	defaultWebhookMaxBody      = 1 << 20
+	defaultWebhookMaxAttempts  = 8
+	defaultWebhookPollInterval = time.Second
+	defaultWebhookRetention    = 72 * time.Hour
+	defaultWebhookFailedKeep   = 7 * 24 * time.Hour
+	defaultWebhookMaxFailed    = 1000
+	defaultStripeTolerance     = 5 * time.Minute
+)
+
+// 不随事件持久化的请求头, 签名在接收时已校验
+var webhookSensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key"}
+
+var (
+	ErrWebhookSignature = errors.New("webhook signature invalid")
+	ErrWebhookNotFound  = errors.New("webhook event not found")
+)
+
+// WebhookEvent one received webhook request
+type WebhookEvent struct {
+	ID         string      `json:"id"`
+	Endpoint   string      `json:"endpoint"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	ReceivedAt time.Time   `json:"received_at"`
+
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	NextAt    time.Time `json:"next_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookVerifier verify signature of webhook request
+type WebhookVerifier interface {
+	Verify(r *http.Request, body []byte) error
+}
+
+// WebhookVerifierFunc adapter of func to WebhookVerifier
+type WebhookVerifierFunc func(r *http.Request, body []byte) error
+
+// Verify calls f(r, body)
+func (f WebhookVerifierFunc) Verify(r *http.Request, body []byte) error {
+	return f(r, body)
+}
+
+// matchHMAC 多个 secret 用于轮换, 任一匹配即通过
+func matchHMAC(secrets [][]byte, data []byte, sig string) bool {
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	for _, secret := range secrets {
+		if hmac.Equal(hmacSHA256(secret, data), got) {
+			return true
+		}
+	}
+	return false
+}
+
+// GitHubVerifier verify X-Hub-Signature-256 header: sha256=hex(hmac_sha256(secret, body))
+func GitHubVerifier(secrets ...[]byte) WebhookVerifier {
+	return WebhookVerifierFunc(func(r *http.Request, body []byte) error {
+		sig := r.Header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(sig, "sha256=") || !matchHMAC(secrets, body, sig[len("sha256="):]) {
+			return ErrWebhookSignature
+		}
+		return nil
+	})
+}
+
+// StripeVerifier verify Stripe-Signature header: t=timestamp,v1=hex(hmac_sha256(secret, timestamp.body)),
+// timestamp older than tolerance is rejected to prevent replay attack, 0 means 5 minutes
+func StripeVerifier(tolerance time.Duration, secrets ...[]byte) WebhookVerifier {
+	if tolerance <= 0 {
+		tolerance = defaultStripeTolerance
+	}
+	return WebhookVerifierFunc(func(r *http.Request, body []byte) error {
+		var ts string
+		var sigs []string
+		for _, kv := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+			parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch parts[0] {
+			case "t":
+				ts = parts[1]
+			case "v1":
+				sigs = append(sigs, parts[1])
+			}
+		}
+
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return ErrWebhookSignature
+		}
+		if d := time.Since(time.Unix(sec, 0)); d > tolerance || d < -tolerance {
+			return fmt.Errorf("%v: timestamp out of tolerance", ErrWebhookSignature)
+		}
+
+		payload := append([]byte(ts+"."), body...)
+		for _, sig := range sigs {
+			if matchHMAC(secrets, payload, sig) {
+				return nil
+			}
+		}
+		return ErrWebhookSignature
+	})
+}
+
+// HeaderEventID use header as event id, such as X-GitHub-Delivery
+func HeaderEventID(header string) func(r *http.Request, body []byte) string {
+	return func(r *http.Request, body []byte) string {
+		return r.Header.Get(header)
+	}
+}
+
+// JSONEventID use top level field of json body as event id, such as id of Stripe event
+func JSONEventID(field string) func(r *http.Request, body []byte) string {
+	return func(r *http.Request, body []byte) string {
+		var m map[string]interface{}
+		if err := json.Unmarshal(body, &m); err != nil {
+			return ""
+		}
+		if v, ok := m[field]; ok {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+}
+
+// WebhookEndpoint named webhook endpoint, served at /webhook/{Name}
+type WebhookEndpoint struct {
+	Name string
+	// 为空时不校验签名
+	Verifier WebhookVerifier
+	// 事件 id, 用于去重, 为空或返回空时使用 body 的 sha256
+	EventID func(r *http.Request, body []byte) string
+	// 处理事件, 返回 error 时按退避重试
+	Handler func(ctx context.Context, e *WebhookEvent) error
+	// 最大处理次数, 超过后置为 failed, 可通过 Replay 重新处理; 0 为默认 8 次
+	MaxAttempts int
+	// 除 Authorization, Cookie 等之外不保存的请求头, 如携带凭证的自定义头
+	SensitiveHeaders []string
+}
+
+// WebhookStore durable store of received webhook events
+type WebhookStore interface {
+	// Add save new event, returns false without error if event with the same endpoint and id exists
+	Add(e *WebhookEvent) (bool, error)
+	Update(e *WebhookEvent) error
+	Get(endpoint, id string) (*WebhookEvent, error)
+	// List events of endpoint with status, empty status means all
+	List(endpoint, status string) ([]*WebhookEvent, error)
+	Delete(endpoint, id string) error
+}
+
+// WebhookReceiver webhook processor driver, events are saved into store before response
+// and handled asynchronously by a worker with retries
+type WebhookReceiver struct {
+	store     WebhookStore
+	endpoints map[string]*WebhookEndpoint
+	router    *httprouter.Router
+	notify    chan struct{}
+
+	// 请求体大小上限
+	MaxBody int64
+	// 轮询待处理事件的间隔
+	PollInterval time.Duration
+	// done 状态事件保留时间, 期间重复的事件会被去重
+	Retention time.Duration
+	// failed 状态事件保留时间及每个 endpoint 最多保留的个数, 超过后删除最早的
+	FailedRetention time.Duration
+	MaxFailed       int
+	// 重试退避, 为空时使用 1s 到 10min
+	Backoff *RetryPolicy
+}
+
+// NewWebhookReceiver create webhook receiver with store and endpoints
+func NewWebhookReceiver(store WebhookStore, endpoints ...*WebhookEndpoint) (*WebhookReceiver, error) {
+	if store == nil {
+		return nil, fmt.Errorf("webhook store nil")
+	}
+	m := &WebhookReceiver{
+		store:           store,
+		endpoints:       make(map[string]*WebhookEndpoint),
+		notify:          make(chan struct{}, 1),
+		MaxBody:         defaultWebhookMaxBody,
+		PollInterval:    defaultWebhookPollInterval,
+		Retention:       defaultWebhookRetention,
+		FailedRetention: defaultWebhookFailedKeep,
+		MaxFailed:       defaultWebhookMaxFailed,
+		Backoff:         &RetryPolicy{Backoff: time.Second, MaxBackoff: 10 * time.Minute},
+	}
+	for _, ep := range endpoints {
+		if ep == nil || len(ep.Name) == 0 || ep.Handler == nil {
+			return nil, fmt.Errorf("webhook endpoint need name and handler")
+		}
+		if _, ok := m.endpoints[ep.Name]; ok {
+			return nil, fmt.Errorf("webhook endpoint: %s duplicated", ep.Name)
+		}
+		m.endpoints[ep.Name] = ep
+	}
+
+	m.router = httprouter.New()
+	m.router.POST(webhookPath, m.receive)
+	return m, nil
+}
+
+// ServeHTTP serve webhook requests
+func (m *WebhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.router.ServeHTTP(w, r)
+}
+
+func (m *WebhookReceiver) receive(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	fun := "WebhookReceiver.receive -->"
+	ctx := r.Context()
+
+	name := ps.ByName("name")
+	ep, ok := m.endpoints[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, m.MaxBody+1))
+	if err != nil {
+		m.stat(name, "read_error")
+		http.Error(w, "read body error", http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > m.MaxBody {
+		m.stat(name, "too_large")
+		http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if ep.Verifier != nil {
+		if err := ep.Verifier.Verify(r, body); err != nil {
+			logger().Warnf(ctx, "%s endpoint: %s verify err: %v", fun, name, err)
+			m.stat(name, "invalid_signature")
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var id string
+	if ep.EventID != nil {
+		id = ep.EventID(r, body)
+	}
+	if len(id) == 0 {
+		sum := sha256.Sum256(body)
+		id = hex.EncodeToString(sum[:])
+	}
+
+	now := time.Now()
+	e := &WebhookEvent{
+		ID:         id,
+		Endpoint:   name,
+		Header:     persistedHeader(ep, r.Header),
+		Body:       body,
+		ReceivedAt: now,
+		Status:     WebhookPending,
+		NextAt:     now,
+		UpdatedAt:  now,
+	}
+	added, err := m.store.Add(e)
+	if err != nil {
+		// 未持久化时返回 5xx 由对方重发
+		logger().Errorf(ctx, "%s endpoint: %s id: %s save err: %v", fun, name, id, err)
+		m.stat(name, "store_error")
+		http.Error(w, "store error", http.StatusInternalServerError)
+		return
+	}
+	if !added {
+		m.stat(name, "duplicate")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	m.stat(name, "accepted")
+	m.wakeup()
+	w.WriteHeader(http.StatusOK)
+}
+
+// persistedHeader 去掉携带凭证的请求头, 避免明文落盘
+func persistedHeader(ep *WebhookEndpoint, header http.Header) http.Header {
+	h := header.Clone()
+	for _, k := range webhookSensitiveHeaders {
+		h.Del(k)
+	}
+	for _, k := range ep.SensitiveHeaders {
+		h.Del(k)
+	}
+	return h
+}
+
+func (m *WebhookReceiver) stat(endpoint, result string) {
+	group, service := GetGroupAndService()
+	_metricWebhookReceived.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelEndpoint, endpoint, labelStatus, result).Inc()
+}
+
+func (m *WebhookReceiver) wakeup() {
+	select {
+	case m.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Replay reset event to pending and handle it again, attempts are cleared
+func (m *WebhookReceiver) Replay(endpoint, id string) error {
+	e, err := m.store.Get(endpoint, id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	e.Status, e.Attempts, e.LastError, e.NextAt, e.UpdatedAt = WebhookPending, 0, "", now, now
+	if err := m.store.Update(e); err != nil {
+		return err
+	}
+	m.wakeup()
+	return nil
+}
+
+// ReplayFailed replay all failed events of endpoint, returns number of events replayed
+func (m *WebhookReceiver) ReplayFailed(endpoint string) (int, error) {
+	events, err := m.store.List(endpoint, WebhookFailed)
+	if err != nil {
+		return 0, err
+	}
+	for i, e := range events {
+		if err := m.Replay(endpoint, e.ID); err != nil {
+			return i, err
+		}
+	}
+	return len(events), nil
+}
+
+// Events list events of endpoint with status, empty status means all
+func (m *WebhookReceiver) Events(endpoint, status string) ([]*WebhookEvent, error) {
+	return m.store.List(endpoint, status)
+}
+
+// run 处理待处理事件直到 ctx 结束, 进程重启后从 store 中继续处理
+func (m *WebhookReceiver) run(ctx context.Context) {
+	ticker := time.NewTicker(m.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		m.processPending(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.notify:
+		}
+	}
+}
+
+func (m *WebhookReceiver) processPending(ctx context.Context) {
+	fun := "WebhookReceiver.processPending -->"
+
+	now := time.Now()
+	for name, ep := range m.endpoints {
+		events, err := m.store.List(name, "")
+		if err != nil {
+			logger().Errorf(ctx, "%s endpoint: %s list err: %v", fun, name, err)
+			continue
+		}
+		var failed []*WebhookEvent
+		for _, e := range events {
+			if ctx.Err() != nil {
+				return
+			}
+			switch {
+			case e.Status == WebhookPending && !e.NextAt.After(now):
+				m.handle(ctx, ep, e)
+			case e.Status == WebhookDone && now.Sub(e.UpdatedAt) > m.Retention:
+				m.store.Delete(name, e.ID)
+			case e.Status == WebhookFailed:
+				failed = append(failed, e)
+			}
+		}
+		m.expireFailed(ctx, name, failed, now)
+	}
+}
+
+// expireFailed failed 事件超过保留时间或个数时删除最早的, 避免一直堆积
+func (m *WebhookReceiver) expireFailed(ctx context.Context, endpoint string, failed []*WebhookEvent, now time.Time) {
+	fun := "WebhookReceiver.expireFailed -->"
+
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].UpdatedAt.Before(failed[j].UpdatedAt)
+	})
+	for i, e := range failed {
+		expired := m.FailedRetention > 0 && now.Sub(e.UpdatedAt) > m.FailedRetention
+		overflow := m.MaxFailed > 0 && len(failed)-i > m.MaxFailed
+		if !expired && !overflow {
+			break
+		}
+		logger().Warnf(ctx, "%s endpoint: %s id: %s failed at: %s dropped", fun, endpoint, e.ID, e.UpdatedAt)
+		if err := m.store.Delete(endpoint, e.ID); err != nil {
+			logger().Errorf(ctx, "%s endpoint: %s id: %s delete err: %v", fun, endpoint, e.ID, err)
+		}
+	}
+}
+
+func (m *WebhookReceiver) handle(ctx context.Context, ep *WebhookEndpoint, e *WebhookEvent) {
+	fun := "WebhookReceiver.handle -->"
+
+	err := m.callHandler(ctx, ep, e)
+	now := time.Now()
+	e.Attempts++
+	e.UpdatedAt = now
+	maxAttempts := ep.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultWebhookMaxAttempts
+	}
+	switch {
+	case err == nil:
+		e.Status, e.LastError = WebhookDone, ""
+	case e.Attempts >= maxAttempts:
+		logger().Errorf(ctx, "%s endpoint: %s id: %s failed after %d attempts err: %v", fun, e.Endpoint, e.ID, e.Attempts, err)
+		e.Status, e.LastError = WebhookFailed, err.Error()
+	default:
+		logger().Warnf(ctx, "%s endpoint: %s id: %s attempt: %d err: %v", fun, e.Endpoint, e.ID, e.Attempts, err)
+		e.LastError = err.Error()
+		e.NextAt = now.Add(m.Backoff.backoff(e.Attempts - 1))
+	}
+	m.stat(e.Endpoint, e.Status)
+
+	if err := m.store.Update(e); err != nil {
+		logger().Errorf(ctx, "%s endpoint: %s id: %s update err: %v", fun, e.Endpoint, e.ID, err)
+	}
+}
+
+func (m *WebhookReceiver) callHandler(ctx context.Context, ep *WebhookEndpoint, e *WebhookEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	return ep.Handler(ctx, e)
+}
+
+func powerWebhook(addr string, tlsConfig *tls.Config, m *WebhookReceiver, middlewares ...middleware) (string, processorStopper, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go m.run(ctx)
+
+	sa, stopHttp, err := powerHttp(addr, tlsConfig, m.router, middlewares...)
+	if err != nil {
+		cancel()
+		return "", nil, err
+	}
+	stop := func(ctx context.Context) error {
+		err := stopHttp(ctx)
+		cancel()
+		return err
+	}
+	return sa, stop, nil
+}
@@ -0,0 +1,138 @@
+package rocserv
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileWebhookStore WebhookStore saving each event as a json file under dir/{endpoint}/
+type FileWebhookStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileWebhookStore create file store in dir, dir is created if not exist
+func NewFileWebhookStore(dir string) (*FileWebhookStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileWebhookStore{dir: dir}, nil
+}
+
+// path 事件 id 来自外部, 使用 hash 作为文件名
+func (m *FileWebhookStore) path(endpoint, id string) string {
+	sum := sha1.Sum([]byte(id))
+	return filepath.Join(m.dir, endpoint, hex.EncodeToString(sum[:])+".json")
+}
+
+// Add implements WebhookStore
+func (m *FileWebhookStore) Add(e *WebhookEvent) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.path(e.Endpoint, e.ID)
+	if _, err := os.Stat(p); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return false, err
+	}
+	return true, m.write(p, e)
+}
+
+// Update implements WebhookStore
+func (m *FileWebhookStore) Update(e *WebhookEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.write(m.path(e.Endpoint, e.ID), e)
+}
+
+// write 先写临时文件再 rename, 避免进程退出时留下不完整的文件
+func (m *FileWebhookStore) write(p string, e *WebhookEvent) error {
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (m *FileWebhookStore) read(p string) (*WebhookEvent, error) {
+	bs, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	e := &WebhookEvent{}
+	if err := json.Unmarshal(bs, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Get implements WebhookStore
+func (m *FileWebhookStore) Get(endpoint, id string) (*WebhookEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, err := m.read(m.path(endpoint, id))
+	if os.IsNotExist(err) {
+		return nil, ErrWebhookNotFound
+	}
+	return e, err
+}
+
+// List implements WebhookStore, events are sorted by received time
+func (m *FileWebhookStore) List(endpoint, status string) ([]*WebhookEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	files, err := ioutil.ReadDir(filepath.Join(m.dir, endpoint))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*WebhookEvent
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		e, err := m.read(filepath.Join(m.dir, endpoint, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(status) == 0 || e.Status == status {
+			events = append(events, e)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ReceivedAt.Before(events[j].ReceivedAt)
+	})
+	return events, nil
+}
+
+// Delete implements WebhookStore
+func (m *FileWebhookStore) Delete(endpoint, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := os.Remove(m.path(endpoint, id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package rocserv
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookVerifier(t *testing.T) {
+	ass := assert.New(t)
+
+	secret := []byte("s3cret")
+	body := []byte(`{"id":"evt_1"}`)
+
+	r := httptest.NewRequest(http.MethodPost, "/webhook/github", nil)
+	r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(hmacSHA256(secret, body)))
+	ass.Nil(GitHubVerifier([]byte("old"), secret).Verify(r, body))
+	ass.Equal(ErrWebhookSignature, GitHubVerifier([]byte("other")).Verify(r, body))
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := hex.EncodeToString(hmacSHA256(secret, append([]byte(ts+"."), body...)))
+	r.Header.Set("Stripe-Signature", "t="+ts+",v1="+sig)
+	ass.Nil(StripeVerifier(0, secret).Verify(r, body))
+
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	sig = hex.EncodeToString(hmacSHA256(secret, append([]byte(old+"."), body...)))
+	r.Header.Set("Stripe-Signature", "t="+old+",v1="+sig)
+	ass.NotNil(StripeVerifier(0, secret).Verify(r, body))
+
+	ass.Equal("evt_1", JSONEventID("id")(r, body))
+}
+
+func TestWebhookReceiver(t *testing.T) {
+	ass := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "webhook")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+	store, err := NewFileWebhookStore(dir)
+	ass.Nil(err)
+
+	var calls int
+	m, err := NewWebhookReceiver(store, &WebhookEndpoint{
+		Name:        "stripe",
+		EventID:     JSONEventID("id"),
+		MaxAttempts: 2,
+		Handler: func(ctx context.Context, e *WebhookEvent) error {
+			calls++
+			return errors.New("downstream unavailable")
+		},
+	})
+	ass.Nil(err)
+	m.Backoff = &RetryPolicy{}
+
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/webhook/stripe", bytes.NewBufferString(body)))
+		return w.Code
+	}
+	ass.Equal(http.StatusOK, post(`{"id":"evt_1"}`))
+	ass.Equal(http.StatusOK, post(`{"id":"evt_1"}`))
+	events, err := m.Events("stripe", WebhookPending)
+	ass.Nil(err)
+	ass.Len(events, 1)
+
+	ctx := context.Background()
+	m.processPending(ctx)
+	m.processPending(ctx)
+	ass.Equal(2, calls)
+	events, _ = m.Events("stripe", WebhookFailed)
+	ass.Len(events, 1)
+	ass.Equal("downstream unavailable", events[0].LastError)
+
+	n, err := m.ReplayFailed("stripe")
+	ass.Nil(err)
+	ass.Equal(1, n)
+	e, err := store.Get("stripe", "evt_1")
+	ass.Nil(err)
+	ass.Equal(WebhookPending, e.Status)
+	ass.Equal(0, e.Attempts)
+
+	_, err = store.Get("stripe", "evt_2")
+	ass.Equal(ErrWebhookNotFound, err)
+}
+
+func TestWebhookRetention(t *testing.T) {
+	ass := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "webhook")
+	ass.Nil(err)
+	defer os.RemoveAll(dir)
+	store, err := NewFileWebhookStore(dir)
+	ass.Nil(err)
+
+	m, err := NewWebhookReceiver(store, &WebhookEndpoint{
+		Name:             "github",
+		EventID:          JSONEventID("id"),
+		MaxAttempts:      1,
+		SensitiveHeaders: []string{"X-Token"},
+		Handler: func(ctx context.Context, e *WebhookEvent) error {
+			return errors.New("downstream unavailable")
+		},
+	})
+	ass.Nil(err)
+	m.MaxFailed = 2
+
+	for _, id := range []string{"1", "2", "3"} {
+		r := httptest.NewRequest(http.MethodPost, "/webhook/github", bytes.NewBufferString(`{"id":"`+id+`"}`))
+		r.Header.Set("Authorization", "Bearer abc")
+		r.Header.Set("X-Token", "abc")
+		r.Header.Set("X-GitHub-Event", "push")
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		ass.Equal(http.StatusOK, w.Code)
+	}
+
+	// 凭证不落盘
+	e, err := store.Get("github", "1")
+	ass.Nil(err)
+	ass.Empty(e.Header.Get("Authorization"))
+	ass.Empty(e.Header.Get("X-Token"))
+	ass.Equal("push", e.Header.Get("X-GitHub-Event"))
+
+	// 个数超出时删除最早失败的
+	ctx := context.Background()
+	m.processPending(ctx)
+	m.processPending(ctx)
+	events, err := m.Events("github", WebhookFailed)
+	ass.Nil(err)
+	ass.Len(events, 2)
+
+	// 超过保留时间后全部删除
+	m.FailedRetention = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	m.processPending(ctx)
+	events, _ = m.Events("github", WebhookFailed)
+	ass.Len(events, 0)
+}
@@ -0,0 +1,165 @@
+package rocserv
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+)
+
+var (
+	ErrWorkerPoolFull   = errors.New("worker pool queue is full")
+	ErrWorkerPoolClosed = errors.New("worker pool is closed")
+)
+
+const (
+	workerPoolStageWait = "wait"
+	workerPoolStageRun  = "run"
+
+	workerPoolStatTick = time.Second * 10
+)
+
+type workerTask struct {
+	ctx      context.Context
+	fn       func(ctx context.Context)
+	enqueued time.Time
+}
+
+// WorkerPool bounded goroutine pool, tasks are executed by fixed workers,
+// panic in task is recovered and reported, queue length and latency are exported to prometheus
+type WorkerPool struct {
+	name    string
+	workers int
+	queue   chan *workerTask
+
+	mu     sync.RWMutex
+	closed bool
+	wg     sync.WaitGroup
+	done   chan struct{}
+}
+
+// NewWorkerPool create worker pool with workers goroutines and queue size
+func NewWorkerPool(name string, workers, queueSize int) *WorkerPool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+
+	m := &WorkerPool{
+		name:    name,
+		workers: workers,
+		queue:   make(chan *workerTask, queueSize),
+		done:    make(chan struct{}),
+	}
+
+	m.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+	go m.stat()
+	return m
+}
+
+// Submit put task into queue, block until queued, ctx done or pool closed
+func (m *WorkerPool) Submit(ctx context.Context, fn func(ctx context.Context)) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return ErrWorkerPoolClosed
+	}
+
+	select {
+	case m.queue <- &workerTask{ctx: ctx, fn: fn, enqueued: time.Now()}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TrySubmit put task into queue, return ErrWorkerPoolFull immediately if queue is full
+func (m *WorkerPool) TrySubmit(ctx context.Context, fn func(ctx context.Context)) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return ErrWorkerPoolClosed
+	}
+
+	select {
+	case m.queue <- &workerTask{ctx: ctx, fn: fn, enqueued: time.Now()}:
+		return nil
+	default:
+		group, service := GetGroupAndService()
+		_metricWorkerPoolRejected.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelPoolName, m.name).Inc()
+		return ErrWorkerPoolFull
+	}
+}
+
+// Close stop accepting tasks and wait queued tasks finished
+func (m *WorkerPool) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	close(m.queue)
+	m.mu.Unlock()
+
+	m.wg.Wait()
+	close(m.done)
+}
+
+// QueueLen return count of tasks waiting in queue
+func (m *WorkerPool) QueueLen() int {
+	return len(m.queue)
+}
+
+func (m *WorkerPool) worker() {
+	defer m.wg.Done()
+	for task := range m.queue {
+		m.run(task)
+	}
+}
+
+func (m *WorkerPool) run(task *workerTask) {
+	group, service := GetGroupAndService()
+	start := time.Now()
+	_metricWorkerPoolDuration.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelPoolName, m.name, labelPoolStage, workerPoolStageWait).Observe(start.Sub(task.enqueued).Seconds())
+
+	defer func() {
+		_metricWorkerPoolDuration.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelPoolName, m.name, labelPoolStage, workerPoolStageRun).Observe(time.Since(start).Seconds())
+		if p := recover(); p != nil {
+			const size = 4096
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			logger().Errorf(task.ctx, "WorkerPool.run --> pool: %s catch panic: %v, stack: %s", m.name, p, string(buf))
+			ReportPanic(task.ctx, p, buf)
+			_metricWorkerPoolPanic.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelPoolName, m.name).Inc()
+		}
+	}()
+
+	// 排队期间调用方已经取消的任务直接丢弃
+	if task.ctx.Err() != nil {
+		return
+	}
+	task.fn(task.ctx)
+}
+
+func (m *WorkerPool) stat() {
+	ticker := time.NewTicker(workerPoolStatTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+			group, service := GetGroupAndService()
+			_metricWorkerPoolQueue.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, labelPoolName, m.name).Set(float64(len(m.queue)))
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package rocserv
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPool(t *testing.T) {
+	ass := assert.New(t)
+	ctx := context.Background()
+
+	p := NewWorkerPool("test", 2, 10)
+
+	var mu sync.Mutex
+	count := 0
+	for i := 0; i < 10; i++ {
+		err := p.Submit(ctx, func(ctx context.Context) {
+			mu.Lock()
+			count++
+			mu.Unlock()
+		})
+		ass.Nil(err)
+	}
+	// panic 不影响其他任务
+	ass.Nil(p.Submit(ctx, func(ctx context.Context) { panic("boom") }))
+	ass.Nil(p.Submit(ctx, func(ctx context.Context) {
+		mu.Lock()
+		count++
+		mu.Unlock()
+	}))
+
+	p.Close()
+	ass.Equal(11, count)
+	ass.Equal(ErrWorkerPoolClosed, p.Submit(ctx, func(ctx context.Context) {}))
+}
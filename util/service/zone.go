@@ -0,0 +1,174 @@
+package rocserv
+
+import (
+	"context"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"strings"
+
+	xprom "gitlab.pri.ibanyu.com/middleware/seaweed/xstat/xmetric/xprometheus"
+
+	"github.com/shawnfeng/consistent"
+)
+
+// DefaultZoneMinLocalPercent see ZoneConf.MinLocalPercent
+const DefaultZoneMinLocalPercent = 20
+
+// ZoneConf locality preference of client: instances in the same zone are preferred,
+// requests spill over to all zones when local zone has no healthy instance or not enough capacity
+type ZoneConf struct {
+	// Zone 调用方所在的可用区, 默认取环境变量 ZONE
+	Zone string
+	// MinLocalPercent 同可用区健康实例的权重占所有健康实例权重的百分比低于该值时不区分可用区
+	MinLocalPercent int
+}
+
+func getZoneFromEnv() string {
+	return strings.ToLower(os.Getenv("ZONE"))
+}
+
+// defaultZoneConf 未设置环境变量 ZONE 时不区分可用区
+func defaultZoneConf() *ZoneConf {
+	zone := getZoneFromEnv()
+	if zone == "" {
+		return nil
+	}
+	return &ZoneConf{Zone: zone, MinLocalPercent: DefaultZoneMinLocalPercent}
+}
+
+// SetZonePreference set zone preference of routing, nil disables it
+func (m *ClientEtcdV2) SetZonePreference(conf *ZoneConf) {
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+	if conf == nil || conf.Zone == "" {
+		m.zone = nil
+		return
+	}
+	c := *conf
+	m.zone = &c
+}
+
+func endpointWeight(ep *Endpoint) int {
+	if ep.Weight == 0 {
+		return 100
+	}
+	return ep.Weight
+}
+
+// localEndpoints 同可用区的健康实例, 没有可用区偏好或者同可用区容量不足时返回 nil
+func (m *ClientEtcdV2) localEndpoints(endpoints []*Endpoint) []*Endpoint {
+	if m.zone == nil || len(endpoints) == 0 {
+		return nil
+	}
+
+	var local []*Endpoint
+	var localWeight, totalWeight int
+	for _, ep := range m.healthyEndpoints(endpoints) {
+		totalWeight += endpointWeight(ep)
+		if ep.Zone == m.zone.Zone {
+			local = append(local, ep)
+			localWeight += endpointWeight(ep)
+		}
+	}
+	if totalWeight == 0 {
+		return nil
+	}
+	if len(local) == 0 || localWeight*100 < totalWeight*m.zone.MinLocalPercent {
+		group, service := GetGroupAndService()
+		_metricZoneSpillover.With(xprom.LabelGroupName, group, xprom.LabelServiceName, service, xprom.LabelCalleeService, m.servKey).Inc()
+		return nil
+	}
+	return local
+}
+
+// hashInZone 在同可用区的一致性 hash 环上选取, 同一 key 在可用区内尽量落到同一实例
+func (m *ClientEtcdV2) hashInZone(group, processor, key string) *ServInfo {
+	if m.zone == nil {
+		return nil
+	}
+	endpoints := m.endpoints(group, processor)
+	if len(endpoints) == 0 && group != "" {
+		group = ""
+		endpoints = m.endpoints("", processor)
+	}
+	local := m.localEndpoints(endpoints)
+	if len(local) == 0 {
+		return nil
+	}
+
+	if shash := m.zoneHash[group][m.zone.Zone]; shash != nil {
+		s := m.getFromHash(shash, processor, key)
+		if s != nil && (m.breaker == nil || !m.breaker.isOpen(s.Addr)) {
+			return s
+		}
+	}
+	return local[crc32.ChecksumIEEE([]byte(key))%uint32(len(local))].Serv
+}
+
+type zonePreferer interface {
+	preferZone(group, processor string, list []*ServInfo) []*ServInfo
+}
+
+// preferZone 过滤出 list 中同可用区的实例, 容量不足时原样返回
+func (m *ClientEtcdV2) preferZone(group, processor string, list []*ServInfo) []*ServInfo {
+	m.muServlist.Lock()
+	defer m.muServlist.Unlock()
+
+	if m.zone == nil {
+		return list
+	}
+	local := m.localEndpoints(m.endpoints(group, processor))
+	if len(local) == 0 {
+		return list
+	}
+	addrs := make(map[string]bool, len(local))
+	for _, ep := range local {
+		addrs[ep.Serv.Addr] = true
+	}
+	filtered := make([]*ServInfo, 0, len(local))
+	for _, s := range list {
+		if addrs[s.Addr] {
+			filtered = append(filtered, s)
+		}
+	}
+	if len(filtered) == 0 {
+		return list
+	}
+	return filtered
+}
+
+// buildZoneHash 按可用区拆分 upServlist 生成的 hash 元素, 元素形如 {servid}-{i}
+func buildZoneHash(slist map[string][]string, scopy servCopyCollect) map[string]map[string]*consistent.Consistent {
+	fun := "buildZoneHash -->"
+
+	zhash := make(map[string]map[string]*consistent.Consistent)
+	for group, list := range slist {
+		zlist := make(map[string][]string)
+		for _, elt := range list {
+			idx := strings.Index(elt, "-")
+			if idx == -1 {
+				continue
+			}
+			sid, err := strconv.Atoi(elt[:idx])
+			if err != nil {
+				logger().Warnf(context.Background(), "%s invalid elt: %s", fun, elt)
+				continue
+			}
+			c := scopy[sid]
+			if c == nil || c.reg == nil || c.reg.Zone == "" {
+				continue
+			}
+			zlist[c.reg.Zone] = append(zlist[c.reg.Zone], elt)
+		}
+		for zone, l := range zlist {
+			if hash := consistent.NewWithElts(l); hash != nil {
+				if zhash[group] == nil {
+					zhash[group] = make(map[string]*consistent.Consistent)
+				}
+				zhash[group][zone] = hash
+			}
+		}
+	}
+	return zhash
+}
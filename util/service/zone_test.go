@@ -0,0 +1,69 @@
+package rocserv
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func zoneServCopy(sid int, zone string, weight int) *servCopyData {
+	return &servCopyData{
+		servId: sid,
+		reg: &RegData{
+			Servs: map[string]*ServInfo{"proc_grpc": {Type: PROCESSOR_GRPC, Addr: fmt.Sprintf("127.0.0.%d:9000", sid)}},
+			Zone:  zone,
+		},
+		manual: &ManualData{Ctrl: &ServCtrl{Weight: weight, Groups: []string{""}}},
+	}
+}
+
+func TestZonePreference(t *testing.T) {
+	ass := assert.New(t)
+
+	cli := &ClientEtcdV2{servKey: "base/account"}
+	cli.upServlist(servCopyCollect{
+		1: zoneServCopy(1, "a", 100),
+		2: zoneServCopy(2, "a", 100),
+		3: zoneServCopy(3, "b", 100),
+	})
+	cli.SetZonePreference(&ZoneConf{Zone: "a", MinLocalPercent: DefaultZoneMinLocalPercent})
+
+	zones := map[string]int{}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint(i)
+		s := cli.GetServAddr("proc_grpc", key)
+		ass.Equal(s, cli.GetServAddr("proc_grpc", key))
+		zones[s.Addr]++
+	}
+	ass.Equal(0, zones["127.0.0.3:9000"])
+
+	cli.SetLoadBalancer(NewRoundRobinBalancer())
+	for i := 0; i < 10; i++ {
+		ass.NotEqual("127.0.0.3:9000", cli.GetServAddr("proc_grpc", "").Addr)
+	}
+	cli.SetLoadBalancer(nil)
+
+	all := cli.GetAllServAddrWithGroup("", "proc_grpc")
+	ass.Len(cli.preferZone("", "proc_grpc", all), 2)
+
+	// 同可用区容量不足时溢出到所有可用区
+	cli.upServlist(servCopyCollect{
+		1: zoneServCopy(1, "a", 10),
+		3: zoneServCopy(3, "b", 100),
+	})
+	ass.Len(cli.preferZone("", "proc_grpc", cli.GetAllServAddrWithGroup("", "proc_grpc")), 2)
+
+	// 同可用区实例熔断时溢出
+	cli.upServlist(servCopyCollect{
+		1: zoneServCopy(1, "a", 100),
+		3: zoneServCopy(3, "b", 100),
+	})
+	cli.breaker = newInstanceBreakers("base/account", InstanceBreakerConf{ConsecutiveFailures: 1, Cooldown: time.Minute})
+	cli.breaker.report("127.0.0.1:9000", true)
+	ass.Equal("127.0.0.3:9000", cli.GetServAddr("proc_grpc", "k").Addr)
+
+	cli.SetZonePreference(nil)
+	ass.Nil(cli.localEndpoints(cli.endpoints("", "proc_grpc")))
+}